@@ -0,0 +1,181 @@
+// Package api holds the request and response conventions shared by the HTTP handlers
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidLimit   = errors.New("limit must be a positive integer")
+	errInvalidCursor  = errors.New("cursor is invalid or belongs to another listing")
+	errCursorSortDiff = errors.New("sort must not change while paging with a cursor")
+)
+
+// cursorSignatureLen is how many bytes of the HMAC a cursor carries
+const cursorSignatureLen = 16
+
+// PageSpec describes how one list endpoint pages
+type PageSpec struct {
+	// Scope ties cursors to one listing: the endpoint, the caller and every filter that
+	// shapes the result. A cursor issued under one scope is refused under any other, so a
+	// client cannot replay it against another tenant's data or a different filter.
+	Scope string
+	// DefaultLimit applies when the request has no limit; larger limits are cut to MaxLimit
+	DefaultLimit int
+	MaxLimit     int
+	// Sorts lists the accepted values of ?sort=, the first being the default. A leading
+	// "-" means descending.
+	Sorts []string
+}
+
+// PageRequest is a parsed and validated page request
+type PageRequest struct {
+	Limit int
+	Sort  string
+	// After holds the sort values of the last row of the previous page, as the endpoint
+	// put them in its cursor; nil for the first page
+	After []string
+
+	scope string
+}
+
+// Descending reports whether the requested sort is descending
+func (r PageRequest) Descending() bool {
+	return strings.HasPrefix(r.Sort, "-")
+}
+
+// SortField returns the requested sort without its direction
+func (r PageRequest) SortField() string {
+	return strings.TrimPrefix(r.Sort, "-")
+}
+
+// Page is the envelope every paged list endpoint responds with. When Truncated is set,
+// NextCursor should be passed back as ?cursor= for the next page. TotalEstimate is only
+// reported by endpoints that can count their rows cheaply.
+type Page[T any] struct {
+	Items         []T    `json:"items"`
+	Truncated     bool   `json:"truncated"`
+	NextCursor    string `json:"next_cursor,omitempty"`
+	TotalEstimate *int   `json:"total_estimate,omitempty"`
+}
+
+// NewPage builds the envelope for a page of items; an empty nextCursor marks the last page
+func NewPage[T any](items []T, nextCursor string) Page[T] {
+	if items == nil {
+		items = []T{}
+	}
+	return Page[T]{Items: items, Truncated: nextCursor != "", NextCursor: nextCursor}
+}
+
+// cursorPayload is what a cursor carries before it is signed
+type cursorPayload struct {
+	Scope string   `json:"s"`
+	Sort  string   `json:"o"`
+	After []string `json:"a"`
+}
+
+// Pager parses page requests and signs the cursors it hands out, so a cursor a client
+// edits or builds itself is refused
+type Pager struct {
+	secret []byte
+}
+
+// NewPager returns a Pager signing cursors with secret. Replicas serving the same clients
+// must share the secret, or a cursor from one is refused by the next.
+func NewPager(secret []byte) *Pager {
+	return &Pager{secret: secret}
+}
+
+// Parse reads ?limit=, ?sort= and ?cursor= for an endpoint. An out-of-range limit is
+// clamped rather than refused. A cursor keeps the sort it was issued for: ?sort= may be
+// left out when paging, but must not name a different sort.
+func (p *Pager) Parse(query url.Values, spec PageSpec) (PageRequest, error) {
+	req := PageRequest{Limit: spec.DefaultLimit, Sort: spec.Sorts[0], scope: spec.Scope}
+
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil {
+			return req, errInvalidLimit
+		}
+		req.Limit = limit
+	}
+	if req.Limit < 1 {
+		req.Limit = 1
+	}
+	if req.Limit > spec.MaxLimit {
+		req.Limit = spec.MaxLimit
+	}
+
+	sort := query.Get("sort")
+	if sort != "" && !contains(spec.Sorts, sort) {
+		return req, fmt.Errorf("sort must be one of %s", strings.Join(spec.Sorts, ", "))
+	}
+
+	if raw := query.Get("cursor"); raw != "" {
+		payload, err := p.decode(raw)
+		if err != nil || payload.Scope != spec.Scope || !contains(spec.Sorts, payload.Sort) {
+			return req, errInvalidCursor
+		}
+		if sort != "" && sort != payload.Sort {
+			return req, errCursorSortDiff
+		}
+		req.Sort = payload.Sort
+		req.After = payload.After
+		return req, nil
+	}
+	if sort != "" {
+		req.Sort = sort
+	}
+	return req, nil
+}
+
+// Next returns the signed cursor for the page after the one req asked for, which ended
+// on a row with the sort values after
+func (p *Pager) Next(req PageRequest, after ...string) string {
+	body, _ := json.Marshal(cursorPayload{Scope: req.scope, Sort: req.Sort, After: after})
+	return base64.RawURLEncoding.EncodeToString(body) + "." + base64.RawURLEncoding.EncodeToString(p.sign(body))
+}
+
+// decode verifies a cursor's signature and returns what it carries
+func (p *Pager) decode(cursor string) (cursorPayload, error) {
+	var payload cursorPayload
+	encodedBody, encodedSig, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return payload, errInvalidCursor
+	}
+	body, err := base64.RawURLEncoding.DecodeString(encodedBody)
+	if err != nil {
+		return payload, errInvalidCursor
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil || !hmac.Equal(sig, p.sign(body)) {
+		return payload, errInvalidCursor
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return payload, errInvalidCursor
+	}
+	return payload, nil
+}
+
+func (p *Pager) sign(body []byte) []byte {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(body)
+	return mac.Sum(nil)[:cursorSignatureLen]
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,19 +1,23 @@
 package cache
 
 import (
+	"context"
 	"os"
 
+	"file-upload-service/config"
+	"file-upload-service/logger"
+
+	"github.com/go-redis/redis/v8"
 	"github.com/umakantv/go-utils/cache"
-	"github.com/umakantv/go-utils/logger"
 	"go.uber.org/zap"
 )
 
-func InitializeCache() cache.Cache {
+func InitializeCache(cfg *config.Config) cache.Cache {
 	cacheInstance, err := cache.New(cache.Config{
 		Type:          "redis",
-		RedisAddr:     "localhost:6379",
-		RedisPassword: "",
-		RedisDB:       0,
+		RedisAddr:     cfg.RedisAddr,
+		RedisPassword: cfg.RedisPassword,
+		RedisDB:       cfg.RedisDB,
 	})
 	if err != nil {
 		logger.Error("Failed to initialize Redis cache:", zap.Error(err))
@@ -21,3 +25,18 @@ func InitializeCache() cache.Cache {
 	}
 	return cacheInstance
 }
+
+// InitializeRedisClient connects to the Redis behind InitializeCache. The lease, rate limit,
+// token batch, upload quota and upload use stores all share the one client and its pool.
+func InitializeRedisClient(cfg *config.Config) *redis.Client {
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.RedisAddr,
+		Password: cfg.RedisPassword,
+		DB:       cfg.RedisDB,
+	})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		logger.Error("Failed to connect to Redis:", zap.Error(err))
+		os.Exit(1)
+	}
+	return client
+}
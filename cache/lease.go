@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// LeaseStore grants named, expiring leases to one holder at a time. A lease lapses when
+// its holder stops renewing it, so another instance can take over after a crash.
+type LeaseStore interface {
+	// Acquire takes the lease for holder if it is free or already held by holder
+	Acquire(name, holder string, ttl time.Duration) (bool, error)
+	// Renew extends the lease if holder still holds it
+	Renew(name, holder string, ttl time.Duration) (bool, error)
+	// Release gives up the lease if holder still holds it
+	Release(name, holder string) error
+	// Holder reports who holds the lease and for how much longer; empty when it is free
+	Holder(name string) (string, time.Duration, error)
+}
+
+// leaseKeyPrefix namespaces lease keys away from the upload and download tokens
+const leaseKeyPrefix = "lease:"
+
+// The scripts compare the stored holder before touching the key, so an instance whose
+// lease lapsed and was taken over can never extend or delete the new holder's lease.
+var (
+	acquireLeaseScript = redis.NewScript(`
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+return 0`)
+
+	renewLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+	releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+// RedisLeaseStore implements LeaseStore on the Redis instance backing the cache
+type RedisLeaseStore struct {
+	client *redis.Client
+	ctx    context.Context
+}
+
+// NewLeaseStore builds the lease store on the Redis client shared with the other stores
+func NewLeaseStore(client *redis.Client) LeaseStore {
+	return &RedisLeaseStore{client: client, ctx: context.Background()}
+}
+
+// Acquire takes the lease with SET NX, or extends it when holder already has it
+func (s *RedisLeaseStore) Acquire(name, holder string, ttl time.Duration) (bool, error) {
+	n, err := acquireLeaseScript.Run(s.ctx, s.client, []string{leaseKeyPrefix + name}, holder, ttl.Milliseconds()).Int()
+	return n == 1, err
+}
+
+// Renew extends the lease if holder still holds it
+func (s *RedisLeaseStore) Renew(name, holder string, ttl time.Duration) (bool, error) {
+	n, err := renewLeaseScript.Run(s.ctx, s.client, []string{leaseKeyPrefix + name}, holder, ttl.Milliseconds()).Int()
+	return n == 1, err
+}
+
+// Release deletes the lease if holder still holds it
+func (s *RedisLeaseStore) Release(name, holder string) error {
+	return releaseLeaseScript.Run(s.ctx, s.client, []string{leaseKeyPrefix + name}, holder).Err()
+}
+
+// Holder reports the lease's holder and remaining time
+func (s *RedisLeaseStore) Holder(name string) (string, time.Duration, error) {
+	holder, err := s.client.Get(s.ctx, leaseKeyPrefix+name).Result()
+	if err == redis.Nil {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	ttl, err := s.client.PTTL(s.ctx, leaseKeyPrefix+name).Result()
+	if err != nil {
+		return "", 0, err
+	}
+	return holder, ttl, nil
+}
@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RateLimitStore keeps token buckets limiting how often something may happen, so every
+// instance draws from the same buckets
+type RateLimitStore interface {
+	// Allow takes a token from the bucket at key, which refills at perMinute tokens a
+	// minute up to burst. When it is empty, it reports false and how long until the next
+	// token.
+	Allow(key string, perMinute, burst int) (bool, time.Duration, error)
+}
+
+// rateLimitKeyPrefix namespaces rate limit buckets away from the tokens and leases
+const rateLimitKeyPrefix = "ratelimit:"
+
+// takeTokenScript refills the bucket for the time since it was last touched, then takes a
+// token if one is left. Running it as one script keeps concurrent requests from taking the
+// same token. The bucket expires once it would have refilled completely, since a missing
+// bucket is a full one.
+var takeTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call("HMGET", KEYS[1], "tokens", "at")
+local tokens = tonumber(state[1]) or burst
+local at = tonumber(state[2]) or now
+if now > at then
+	tokens = math.min(burst, tokens + (now - at) * rate)
+	at = now
+end
+local allowed, wait = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate)
+end
+redis.call("HSET", KEYS[1], "tokens", tokens, "at", at)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate))
+return {allowed, wait}`)
+
+// RedisRateLimitStore implements RateLimitStore on the Redis instance backing the cache
+type RedisRateLimitStore struct {
+	client *redis.Client
+	ctx    context.Context
+}
+
+// NewRateLimitStore builds the rate limit store on the Redis client shared with the other stores
+func NewRateLimitStore(client *redis.Client) RateLimitStore {
+	return &RedisRateLimitStore{client: client, ctx: context.Background()}
+}
+
+// Allow runs takeTokenScript with the time of this instance, in milliseconds
+func (s *RedisRateLimitStore) Allow(key string, perMinute, burst int) (bool, time.Duration, error) {
+	rate := float64(perMinute) / float64(time.Minute.Milliseconds())
+	result, err := takeTokenScript.Run(s.ctx, s.client, []string{rateLimitKeyPrefix + key},
+		rate, burst, time.Now().UnixMilli()).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// TokenEntry is one value to store with TokenBatchStore
+type TokenEntry struct {
+	Key   string
+	Value interface{}
+	TTL   time.Duration
+}
+
+// TokenBatchStore writes many tokens at once, so issuing a batch of signed URLs costs one
+// round trip instead of one per URL. Values are JSON-encoded exactly as the cache's Set
+// encodes them, so they read back through the cache's Get.
+type TokenBatchStore interface {
+	// SetMany stores every entry. With onlyNew, entries whose key already exists are left
+	// as they are and their keys returned.
+	SetMany(entries []TokenEntry, onlyNew bool) (taken []string, err error)
+}
+
+// RedisTokenBatchStore implements TokenBatchStore with a pipeline on the Redis instance
+// backing the cache
+type RedisTokenBatchStore struct {
+	client *redis.Client
+	ctx    context.Context
+}
+
+// NewTokenBatchStore builds the token store on the Redis client shared with the other stores
+func NewTokenBatchStore(client *redis.Client) TokenBatchStore {
+	return &RedisTokenBatchStore{client: client, ctx: context.Background()}
+}
+
+// SetMany sends one SET, or SET NX, per entry in a single pipeline
+func (s *RedisTokenBatchStore) SetMany(entries []TokenEntry, onlyNew bool) ([]string, error) {
+	data := make([][]byte, len(entries))
+	for i, entry := range entries {
+		encoded, err := json.Marshal(entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		data[i] = encoded
+	}
+
+	created := make([]*redis.BoolCmd, len(entries))
+	_, err := s.client.Pipelined(s.ctx, func(pipe redis.Pipeliner) error {
+		for i, entry := range entries {
+			if onlyNew {
+				created[i] = pipe.SetNX(s.ctx, entry.Key, data[i], entry.TTL)
+			} else {
+				pipe.Set(s.ctx, entry.Key, data[i], entry.TTL)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var taken []string
+	if onlyNew {
+		for i, cmd := range created {
+			if !cmd.Val() {
+				taken = append(taken, entries[i].Key)
+			}
+		}
+	}
+	return taken, nil
+}
@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// UploadQuotaStore counts the files and bytes uploaded through a token that accepts
+// several uploads, so every instance enforces the same limits
+type UploadQuotaStore interface {
+	// Take adds files and bytes to token's counts if both stay within maxFiles and
+	// maxBytes. Nothing is counted when it reports false. The counts expire after ttl.
+	Take(token string, files int, bytes int64, maxFiles int, maxBytes int64, ttl time.Duration) (bool, error)
+	// Give takes back files and bytes counted for an upload that did not complete
+	Give(token string, files int, bytes int64) error
+	// Usage reports the files and bytes counted so far
+	Usage(token string) (files int, bytes int64, err error)
+}
+
+// uploadQuotaKeyPrefix namespaces quota counters away from the tokens they belong to
+const uploadQuotaKeyPrefix = "quota:"
+
+// RedisUploadQuotaStore implements UploadQuotaStore with INCRBY on the Redis instance
+// backing the cache. Each counter is raised first and lowered again when it went past
+// its limit, so concurrent uploads can briefly see each other's overshoot but are
+// never all accepted beyond the limit.
+type RedisUploadQuotaStore struct {
+	client *redis.Client
+	ctx    context.Context
+}
+
+// NewUploadQuotaStore builds the quota store on the Redis client shared with the other stores
+func NewUploadQuotaStore(client *redis.Client) UploadQuotaStore {
+	return &RedisUploadQuotaStore{client: client, ctx: context.Background()}
+}
+
+func uploadQuotaKeys(token string) (filesKey, bytesKey string) {
+	return uploadQuotaKeyPrefix + token + ":files", uploadQuotaKeyPrefix + token + ":bytes"
+}
+
+// Take raises the file count, then the byte count, backing both out when either passes its limit
+func (s *RedisUploadQuotaStore) Take(token string, files int, bytes int64, maxFiles int, maxBytes int64, ttl time.Duration) (bool, error) {
+	filesKey, bytesKey := uploadQuotaKeys(token)
+
+	fileCount, err := s.client.IncrBy(s.ctx, filesKey, int64(files)).Result()
+	if err != nil {
+		return false, err
+	}
+	s.client.PExpire(s.ctx, filesKey, ttl)
+	if fileCount > int64(maxFiles) {
+		return false, s.client.DecrBy(s.ctx, filesKey, int64(files)).Err()
+	}
+
+	byteCount, err := s.client.IncrBy(s.ctx, bytesKey, bytes).Result()
+	if err != nil {
+		s.client.DecrBy(s.ctx, filesKey, int64(files))
+		return false, err
+	}
+	s.client.PExpire(s.ctx, bytesKey, ttl)
+	if byteCount > maxBytes {
+		s.client.DecrBy(s.ctx, filesKey, int64(files))
+		return false, s.client.DecrBy(s.ctx, bytesKey, bytes).Err()
+	}
+	return true, nil
+}
+
+// Give lowers both counts
+func (s *RedisUploadQuotaStore) Give(token string, files int, bytes int64) error {
+	filesKey, bytesKey := uploadQuotaKeys(token)
+	if err := s.client.DecrBy(s.ctx, filesKey, int64(files)).Err(); err != nil {
+		return err
+	}
+	return s.client.DecrBy(s.ctx, bytesKey, bytes).Err()
+}
+
+// Usage reads both counts; missing counters are zero
+func (s *RedisUploadQuotaStore) Usage(token string) (int, int64, error) {
+	filesKey, bytesKey := uploadQuotaKeys(token)
+	files, err := s.client.Get(s.ctx, filesKey).Int()
+	if err != nil && err != redis.Nil {
+		return 0, 0, err
+	}
+	bytes, err := s.client.Get(s.ctx, bytesKey).Int64()
+	if err != nil && err != redis.Nil {
+		return 0, 0, err
+	}
+	return files, bytes, nil
+}
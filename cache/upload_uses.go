@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// UploadUseStore counts the uploads a file's upload tokens still accept, so every
+// instance draws on the same count. A file's count covers all its outstanding tokens.
+type UploadUseStore interface {
+	// Grant adds uses to a file's count and keeps the count for at least ttl
+	Grant(fileID string, uses int, ttl time.Duration) error
+	// Claim takes one use and reports how many are left after it. ok is false, and
+	// nothing is taken, when no uses are left or the count expired.
+	Claim(fileID string) (remaining int, ok bool, err error)
+	// Give returns a use claimed by an upload that did not complete
+	Give(fileID string) error
+	// Revoke drops every use left
+	Revoke(fileID string) error
+}
+
+// uploadUseKeyPrefix namespaces use counters away from the tokens they belong to
+const uploadUseKeyPrefix = "uses:"
+
+// The scripts read and change a counter in one step, so concurrent uploads with one
+// token can never together claim more uses than were granted.
+var (
+	grantUsesScript = redis.NewScript(`
+local uses = redis.call("INCRBY", KEYS[1], ARGV[1])
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return uses`)
+
+	claimUseScript = redis.NewScript(`
+local uses = tonumber(redis.call("GET", KEYS[1]))
+if not uses or uses <= 0 then
+	return -1
+end
+return redis.call("DECR", KEYS[1])`)
+
+	giveUseScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("INCR", KEYS[1])
+end
+return 0`)
+)
+
+// RedisUploadUseStore implements UploadUseStore with DECR on the Redis instance backing the cache
+type RedisUploadUseStore struct {
+	client *redis.Client
+	ctx    context.Context
+}
+
+// NewUploadUseStore builds the use store on the Redis client shared with the other stores
+func NewUploadUseStore(client *redis.Client) UploadUseStore {
+	return &RedisUploadUseStore{client: client, ctx: context.Background()}
+}
+
+// Grant raises the count and extends its expiry when ttl outlasts it
+func (s *RedisUploadUseStore) Grant(fileID string, uses int, ttl time.Duration) error {
+	return grantUsesScript.Run(s.ctx, s.client, []string{uploadUseKeyPrefix + fileID}, uses, ttl.Milliseconds()).Err()
+}
+
+// Claim decrements the count unless it is already exhausted
+func (s *RedisUploadUseStore) Claim(fileID string) (int, bool, error) {
+	remaining, err := claimUseScript.Run(s.ctx, s.client, []string{uploadUseKeyPrefix + fileID}).Int()
+	if err != nil {
+		return 0, false, err
+	}
+	if remaining < 0 {
+		return 0, false, nil
+	}
+	return remaining, true, nil
+}
+
+// Give increments the count; a count that expired meanwhile stays gone
+func (s *RedisUploadUseStore) Give(fileID string) error {
+	return giveUseScript.Run(s.ctx, s.client, []string{uploadUseKeyPrefix + fileID}).Err()
+}
+
+// Revoke deletes the count
+func (s *RedisUploadUseStore) Revoke(fileID string) error {
+	return s.client.Del(s.ctx, uploadUseKeyPrefix+fileID).Err()
+}
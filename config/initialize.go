@@ -0,0 +1,494 @@
+package config
+
+import (
+	"crypto/rand"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"file-upload-service/logger"
+)
+
+// Config holds deployment-tunable settings for the service
+type Config struct {
+	// MaxSyncRows caps how many file rows a single synchronous request may process.
+	// Listings beyond it are truncated with a cursor; bulk deletes beyond it are refused.
+	MaxSyncRows int
+
+	// UploadGroupTTL is how long an upload group stays open before its staged files are discarded
+	UploadGroupTTL time.Duration
+
+	// DirectUploadMaxBytes is the largest file accepted by the single-request direct upload
+	DirectUploadMaxBytes int64
+
+	// DeleteReadConflict decides what a deletion does about downloads still streaming the file:
+	// "wait" lets them finish for up to DeleteReadWait, "cancel" aborts them straight away
+	DeleteReadConflict string
+
+	// DeleteReadWait is how long a deletion waits for active downloads before cancelling them
+	DeleteReadWait time.Duration
+
+	// UploadWriteWait is how long an upload waits for another upload writing the same path
+	// to finish before it is refused with 409
+	UploadWriteWait time.Duration
+
+	// DevMode seeds an empty database with demo data on startup
+	DevMode bool
+
+	// SnapshotStorage decides how bucket snapshots keep file bytes: "hardlink" links the
+	// stored files (falling back to a copy across filesystems), "copy" always copies them
+	SnapshotStorage string
+
+	// SnapshotRetention is how long a bucket snapshot is kept before it is removed
+	SnapshotRetention time.Duration
+
+	// SignedURLMinTTL and SignedURLMaxTTL bound the expires_in_seconds a caller may
+	// request for an upload or download signed URL
+	SignedURLMinTTL time.Duration
+	SignedURLMaxTTL time.Duration
+
+	// MimetypeBackfillBatchSize is how many files the mimetype backfill sniffs per batch
+	MimetypeBackfillBatchSize int
+
+	// MimetypeBackfillPause is how long the mimetype backfill rests between batches
+	MimetypeBackfillPause time.Duration
+
+	// UploadFormEnabled serves the HTML upload form for manually testing signed URLs.
+	// Off by default so production deployments do not expose it.
+	UploadFormEnabled bool
+
+	// FileEventRetention is how long bucket change events are kept for sync clients;
+	// cursors older than that get a full resync response
+	FileEventRetention time.Duration
+
+	// FileMetaHeaders emits a file's custom metadata as X-File-Meta-* headers on signed
+	// URL downloads and public file responses
+	FileMetaHeaders bool
+
+	// URLImportMaxBytes is the largest file POST /files/import-url will fetch
+	URLImportMaxBytes int64
+
+	// URLImportTimeout bounds the whole fetch of a URL import, redirects and body included
+	URLImportTimeout time.Duration
+
+	// URLImportMaxRedirects is how many redirects a URL import follows before giving up
+	URLImportMaxRedirects int
+
+	// URLImportAllowPrivate lets URL imports fetch from loopback, private and link-local
+	// addresses. Off by default so the endpoint cannot be used to reach internal services.
+	URLImportAllowPrivate bool
+
+	// InlineUploadMaxBytes is the largest decoded file accepted by the base64 inline upload
+	InlineUploadMaxBytes int64
+
+	// UploadCallbackAllowPrivate lets signed URL upload callbacks target loopback, private
+	// and link-local addresses. Off by default for the same reason as URL imports.
+	UploadCallbackAllowPrivate bool
+
+	// UploadBufferBytes is the size of the pooled buffer upload bytes are copied to disk through
+	UploadBufferBytes int
+
+	// FastTransfers turns on the tuned copy paths: pooled UploadBufferBytes buffers for
+	// uploads and sendfile for downloads. Set FAST_TRANSFERS=false to fall back to plain
+	// 32 KiB copies if the tuned paths misbehave on a platform.
+	FastTransfers bool
+
+	// InstanceID names this replica in the leases that keep each background job on one
+	// instance. Defaults to the hostname and process id, which differ between replicas.
+	InstanceID string
+
+	// JobLeaseTTL is how long a background job lease lasts without renewal, and so how
+	// long a crashed holder's jobs wait before another instance takes them over
+	JobLeaseTTL time.Duration
+
+	// Scanner chooses the virus scanner uploads are checked with: "none" stores uploads
+	// unscanned, "clamd" streams them to the clamd daemon at ClamdAddress
+	Scanner string
+
+	// ClamdAddress is where clamd listens: host:port, or unix:<path> for a local socket
+	ClamdAddress string
+
+	// ScanSyncMaxBytes is the largest upload scanned before its request returns; larger
+	// uploads are scanned by a background job and cannot be downloaded until it has run
+	ScanSyncMaxBytes int64
+
+	// ScanTimeout bounds a single scan, connection and reply included
+	ScanTimeout time.Duration
+
+	// ImageEncoder chooses how public JPEG and PNG images are converted for browsers that
+	// accept smaller formats: "none" never converts, "cli" runs the cwebp and avifenc tools
+	// found at CwebpPath and AvifencPath
+	ImageEncoder string
+
+	// CwebpPath and AvifencPath name the WebP and AVIF encoders; a format whose encoder is
+	// not found is not offered
+	CwebpPath   string
+	AvifencPath string
+
+	// ImageEncodeTimeout bounds a single image conversion
+	ImageEncodeTimeout time.Duration
+
+	// BrotliPath names the brotli tool public text assets are compressed with for clients
+	// accepting br, bounded by ImageEncodeTimeout; br is not offered when it is not found
+	BrotliPath string
+
+	// CompressInlineMaxBytes is the largest public asset gzipped for each request; larger
+	// ones, and every br response, are compressed once and cached on disk
+	CompressInlineMaxBytes int64
+
+	// ShortURLPath is the first path segment of short signed URLs, /<ShortURLPath>/<token>,
+	// issued to clients that opted into them
+	ShortURLPath string
+
+	// InactivityDays is how many days without an authenticated request or a download of
+	// its files flag a client as inactive; 0 turns the policy off unless a client sets its
+	// own limit
+	InactivityDays int
+
+	// InactivityGrace is how long a flagged client has to become active again before its
+	// buckets are archived
+	InactivityGrace time.Duration
+
+	// InactivityWebhookURL is POSTed each client flagged or archived by the inactivity
+	// policy, for relaying to the client's owners; unset sends nothing
+	InactivityWebhookURL string
+
+	// ArchiveExpandMaxEntryBytes is the largest single file POST /files/{id}/expand extracts
+	// from an archive; larger entries are reported as errors
+	ArchiveExpandMaxEntryBytes int64
+
+	// ArchiveExpandMaxTotalBytes caps the bytes one expansion extracts across all entries
+	ArchiveExpandMaxTotalBytes int64
+
+	// ArchiveExpandMaxEntries is the most file entries an archive may have to be expanded
+	ArchiveExpandMaxEntries int
+
+	// ArchiveExpandMaxRatio is how many times its compressed size an entry may expand to;
+	// entries past it are refused as likely zip bombs
+	ArchiveExpandMaxRatio int
+
+	// ZipDownloadMaxFiles is the most files one zip download URL may cover
+	ZipDownloadMaxFiles int
+
+	// ZipDownloadMaxBytes caps the stored bytes of the files one zip download URL covers
+	ZipDownloadMaxBytes int64
+
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For header is believed when
+	// working out the address a request came from; without any, the connecting address is used
+	TrustedProxies []*net.IPNet
+
+	// PublicRateLimitPerMinute is how many public file requests one address may make a
+	// minute, across instances; 0 turns the limit off. Buckets may set a lower one.
+	PublicRateLimitPerMinute int
+
+	// PublicRateLimitBurst is how many public file requests one address may make at once
+	// before PublicRateLimitPerMinute paces it
+	PublicRateLimitBurst int
+
+	// PaginationSecret signs list cursors. Replicas must share it; when unset a random one
+	// is generated, so cursors stop working across restarts and between replicas.
+	PaginationSecret []byte
+
+	// DownloadRedemptionRetention is how long downloads through signed URLs are kept for
+	// GET /files/{id}/redemptions; a redemption of a URL that has not expired yet is kept longer
+	DownloadRedemptionRetention time.Duration
+
+	// GeoResolver chooses how redemption addresses are placed: "none" records no location,
+	// "ranges" looks them up in the CSV of address ranges at GeoRangesFile
+	GeoResolver string
+
+	// GeoRangesFile holds one "<cidr>,<country>[,<region>]" line per address range
+	GeoRangesFile string
+
+	// FileSizeTolerance is how many bytes an upload may differ from the file_size declared
+	// for its signed URL before it is flagged, or rejected in a strict bucket
+	FileSizeTolerance int64
+
+	// UploadDiskReserve is how many bytes of the uploads volume uploads must leave free;
+	// uploads that would eat into it are refused with 507
+	UploadDiskReserve int64
+
+	// UploadPolicySecret signs upload policies. Replicas must share it; when unset a random
+	// one is generated, so policies stop working across restarts and between replicas.
+	UploadPolicySecret []byte
+
+	// PresignedURLSecret signs presigned public URLs. Replicas must share it; when unset a
+	// random one is generated, so the URLs stop working across restarts and between replicas.
+	PresignedURLSecret []byte
+
+	// RedisAddr, RedisPassword and RedisDB locate the Redis holding the cache, tokens,
+	// job leases and counters; one client is shared by all of them
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+}
+
+// DeleteReadWaitTimeout is how long a deletion may wait for active downloads of the file
+// before cancelling them; zero when the policy is to cancel immediately
+func (c *Config) DeleteReadWaitTimeout() time.Duration {
+	if c.DeleteReadConflict == "cancel" {
+		return 0
+	}
+	return c.DeleteReadWait
+}
+
+// InitializeConfig loads the service configuration from environment variables,
+// falling back to defaults for anything unset
+func InitializeConfig() *Config {
+	cfg := &Config{
+		MaxSyncRows:                 getEnvInt("MAX_SYNC_ROWS", 10000),
+		UploadGroupTTL:              time.Duration(getEnvInt("UPLOAD_GROUP_TTL_SECONDS", 3600)) * time.Second,
+		DirectUploadMaxBytes:        int64(getEnvInt("DIRECT_UPLOAD_MAX_BYTES", 1<<20)),
+		DeleteReadConflict:          getEnvChoice("DELETE_READ_CONFLICT", "wait", "cancel"),
+		DeleteReadWait:              time.Duration(getEnvInt("DELETE_READ_WAIT_SECONDS", 30)) * time.Second,
+		UploadWriteWait:             time.Duration(getEnvInt("UPLOAD_WRITE_WAIT_SECONDS", 10)) * time.Second,
+		DevMode:                     os.Getenv("DEV_MODE") == "true",
+		SnapshotStorage:             getEnvChoice("SNAPSHOT_STORAGE", "hardlink", "copy"),
+		SnapshotRetention:           time.Duration(getEnvInt("SNAPSHOT_RETENTION_HOURS", 168)) * time.Hour,
+		SignedURLMinTTL:             time.Duration(getEnvInt("SIGNED_URL_MIN_TTL_SECONDS", 30)) * time.Second,
+		SignedURLMaxTTL:             time.Duration(getEnvInt("SIGNED_URL_MAX_TTL_SECONDS", 86400)) * time.Second,
+		MimetypeBackfillBatchSize:   getEnvInt("MIMETYPE_BACKFILL_BATCH_SIZE", 100),
+		MimetypeBackfillPause:       time.Duration(getEnvInt("MIMETYPE_BACKFILL_PAUSE_MS", 500)) * time.Millisecond,
+		UploadFormEnabled:           os.Getenv("UPLOAD_FORM_ENABLED") == "true",
+		FileEventRetention:          time.Duration(getEnvInt("FILE_EVENT_RETENTION_HOURS", 720)) * time.Hour,
+		FileMetaHeaders:             os.Getenv("FILE_META_HEADERS") == "true",
+		URLImportMaxBytes:           int64(getEnvInt("URL_IMPORT_MAX_BYTES", 100<<20)),
+		URLImportTimeout:            time.Duration(getEnvInt("URL_IMPORT_TIMEOUT_SECONDS", 60)) * time.Second,
+		URLImportMaxRedirects:       getEnvInt("URL_IMPORT_MAX_REDIRECTS", 5),
+		URLImportAllowPrivate:       os.Getenv("URL_IMPORT_ALLOW_PRIVATE") == "true",
+		InlineUploadMaxBytes:        int64(getEnvInt("INLINE_UPLOAD_MAX_BYTES", 1<<20)),
+		UploadCallbackAllowPrivate:  os.Getenv("UPLOAD_CALLBACK_ALLOW_PRIVATE") == "true",
+		UploadBufferBytes:           getEnvInt("UPLOAD_BUFFER_BYTES", 256<<10),
+		FastTransfers:               os.Getenv("FAST_TRANSFERS") != "false",
+		InstanceID:                  getInstanceID(),
+		JobLeaseTTL:                 time.Duration(getEnvInt("JOB_LEASE_TTL_SECONDS", 30)) * time.Second,
+		Scanner:                     getEnvChoice("SCANNER", "none", "clamd"),
+		ClamdAddress:                getEnvString("CLAMD_ADDRESS", "localhost:3310"),
+		ScanSyncMaxBytes:            int64(getEnvInt("SCAN_SYNC_MAX_BYTES", 10<<20)),
+		ScanTimeout:                 time.Duration(getEnvInt("SCAN_TIMEOUT_SECONDS", 60)) * time.Second,
+		ImageEncoder:                getEnvChoice("IMAGE_ENCODER", "none", "cli"),
+		CwebpPath:                   getEnvString("CWEBP_PATH", "cwebp"),
+		AvifencPath:                 getEnvString("AVIFENC_PATH", "avifenc"),
+		ImageEncodeTimeout:          time.Duration(getEnvInt("IMAGE_ENCODE_TIMEOUT_SECONDS", 30)) * time.Second,
+		BrotliPath:                  getEnvString("BROTLI_PATH", "brotli"),
+		CompressInlineMaxBytes:      int64(getEnvInt("COMPRESS_INLINE_MAX_BYTES", 64<<10)),
+		ShortURLPath:                getShortURLPath(),
+		InactivityDays:              getEnvInt("INACTIVITY_DAYS", 0),
+		InactivityGrace:             time.Duration(getEnvInt("INACTIVITY_GRACE_DAYS", 14)) * 24 * time.Hour,
+		InactivityWebhookURL:        os.Getenv("INACTIVITY_WEBHOOK_URL"),
+		ArchiveExpandMaxEntryBytes:  int64(getEnvInt("ARCHIVE_EXPAND_MAX_ENTRY_BYTES", 100<<20)),
+		ArchiveExpandMaxTotalBytes:  int64(getEnvInt("ARCHIVE_EXPAND_MAX_TOTAL_BYTES", 1<<30)),
+		ArchiveExpandMaxEntries:     getEnvInt("ARCHIVE_EXPAND_MAX_ENTRIES", 10000),
+		ArchiveExpandMaxRatio:       getEnvInt("ARCHIVE_EXPAND_MAX_RATIO", 100),
+		ZipDownloadMaxFiles:         getEnvInt("ZIP_DOWNLOAD_MAX_FILES", 1000),
+		ZipDownloadMaxBytes:         int64(getEnvInt("ZIP_DOWNLOAD_MAX_BYTES", 1<<30)),
+		TrustedProxies:              getTrustedProxies(),
+		PublicRateLimitPerMinute:    getEnvNonNegativeInt("PUBLIC_RATE_LIMIT_PER_MINUTE", 600),
+		PublicRateLimitBurst:        getEnvInt("PUBLIC_RATE_LIMIT_BURST", 100),
+		PaginationSecret:            getSecret("PAGINATION_SECRET", "list cursors"),
+		DownloadRedemptionRetention: time.Duration(getEnvInt("DOWNLOAD_REDEMPTION_RETENTION_HOURS", 2160)) * time.Hour,
+		GeoResolver:                 getEnvChoice("GEO_RESOLVER", "none", "ranges"),
+		GeoRangesFile:               os.Getenv("GEO_RANGES_FILE"),
+		FileSizeTolerance:           int64(getEnvInt("FILE_SIZE_TOLERANCE_BYTES", 0)),
+		UploadDiskReserve:           int64(getEnvInt("UPLOAD_DISK_RESERVE_BYTES", 256<<20)),
+		UploadPolicySecret:          getSecret("UPLOAD_POLICY_SECRET", "upload policies"),
+		PresignedURLSecret:          getSecret("PRESIGNED_URL_SECRET", "presigned public URLs"),
+		RedisAddr:                   getEnvString("REDIS_ADDR", "localhost:6379"),
+		RedisPassword:               os.Getenv("REDIS_PASSWORD"),
+		RedisDB:                     getEnvNonNegativeInt("REDIS_DB", 0),
+	}
+
+	logger.Info("Configuration loaded",
+		zap.Int("max_sync_rows", cfg.MaxSyncRows),
+		zap.Duration("upload_group_ttl", cfg.UploadGroupTTL),
+		zap.Int64("direct_upload_max_bytes", cfg.DirectUploadMaxBytes),
+		zap.String("delete_read_conflict", cfg.DeleteReadConflict),
+		zap.Duration("delete_read_wait", cfg.DeleteReadWait),
+		zap.Duration("upload_write_wait", cfg.UploadWriteWait),
+		zap.Bool("dev_mode", cfg.DevMode),
+		zap.String("snapshot_storage", cfg.SnapshotStorage),
+		zap.Duration("snapshot_retention", cfg.SnapshotRetention),
+		zap.Duration("signed_url_min_ttl", cfg.SignedURLMinTTL),
+		zap.Duration("signed_url_max_ttl", cfg.SignedURLMaxTTL),
+		zap.Int("mimetype_backfill_batch_size", cfg.MimetypeBackfillBatchSize),
+		zap.Duration("mimetype_backfill_pause", cfg.MimetypeBackfillPause),
+		zap.Bool("upload_form_enabled", cfg.UploadFormEnabled),
+		zap.Duration("file_event_retention", cfg.FileEventRetention),
+		zap.Bool("file_meta_headers", cfg.FileMetaHeaders),
+		zap.Int64("url_import_max_bytes", cfg.URLImportMaxBytes),
+		zap.Duration("url_import_timeout", cfg.URLImportTimeout),
+		zap.Int("url_import_max_redirects", cfg.URLImportMaxRedirects),
+		zap.Bool("url_import_allow_private", cfg.URLImportAllowPrivate),
+		zap.Int64("inline_upload_max_bytes", cfg.InlineUploadMaxBytes),
+		zap.Bool("upload_callback_allow_private", cfg.UploadCallbackAllowPrivate),
+		zap.Int("upload_buffer_bytes", cfg.UploadBufferBytes),
+		zap.Bool("fast_transfers", cfg.FastTransfers),
+		zap.String("instance_id", cfg.InstanceID),
+		zap.Duration("job_lease_ttl", cfg.JobLeaseTTL),
+		zap.String("scanner", cfg.Scanner),
+		zap.String("clamd_address", cfg.ClamdAddress),
+		zap.Int64("scan_sync_max_bytes", cfg.ScanSyncMaxBytes),
+		zap.Duration("scan_timeout", cfg.ScanTimeout),
+		zap.String("image_encoder", cfg.ImageEncoder),
+		zap.Duration("image_encode_timeout", cfg.ImageEncodeTimeout),
+		zap.Int64("compress_inline_max_bytes", cfg.CompressInlineMaxBytes),
+		zap.String("short_url_path", cfg.ShortURLPath),
+		zap.Int("inactivity_days", cfg.InactivityDays),
+		zap.Duration("inactivity_grace", cfg.InactivityGrace),
+		zap.Bool("inactivity_webhook", cfg.InactivityWebhookURL != ""),
+		zap.Int64("archive_expand_max_entry_bytes", cfg.ArchiveExpandMaxEntryBytes),
+		zap.Int64("archive_expand_max_total_bytes", cfg.ArchiveExpandMaxTotalBytes),
+		zap.Int("archive_expand_max_entries", cfg.ArchiveExpandMaxEntries),
+		zap.Int("archive_expand_max_ratio", cfg.ArchiveExpandMaxRatio),
+		zap.Int("zip_download_max_files", cfg.ZipDownloadMaxFiles),
+		zap.Int64("zip_download_max_bytes", cfg.ZipDownloadMaxBytes),
+		zap.Int("trusted_proxies", len(cfg.TrustedProxies)),
+		zap.Int("public_rate_limit_per_minute", cfg.PublicRateLimitPerMinute),
+		zap.Int("public_rate_limit_burst", cfg.PublicRateLimitBurst),
+		zap.Duration("download_redemption_retention", cfg.DownloadRedemptionRetention),
+		zap.String("geo_resolver", cfg.GeoResolver),
+		zap.String("geo_ranges_file", cfg.GeoRangesFile),
+		zap.Int64("file_size_tolerance", cfg.FileSizeTolerance),
+		zap.Int64("upload_disk_reserve", cfg.UploadDiskReserve),
+		zap.String("redis_addr", cfg.RedisAddr),
+		zap.Int("redis_db", cfg.RedisDB),
+	)
+	return cfg
+}
+
+// getEnvInt reads a positive integer from the environment, returning fallback when unset or invalid
+func getEnvInt(key string, fallback int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value <= 0 {
+		logger.Error("Invalid value for "+key+", using default", zap.String("value", raw), zap.Int("default", fallback))
+		return fallback
+	}
+	return value
+}
+
+// getEnvNonNegativeInt reads an integer from the environment for settings that 0 turns off,
+// returning fallback when unset or invalid
+func getEnvNonNegativeInt(key string, fallback int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 0 {
+		logger.Error("Invalid value for "+key+", using default", zap.String("value", raw), zap.Int("default", fallback))
+		return fallback
+	}
+	return value
+}
+
+// getEnvString reads a string from the environment, returning fallback when unset
+func getEnvString(key, fallback string) string {
+	if raw := os.Getenv(key); raw != "" {
+		return raw
+	}
+	return fallback
+}
+
+// getEnvChoice reads one of a fixed set of values from the environment.
+// The first choice is the default, used when the variable is unset or not one of the choices.
+func getEnvChoice(key string, choices ...string) string {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return choices[0]
+	}
+	for _, choice := range choices {
+		if raw == choice {
+			return raw
+		}
+	}
+	logger.Error("Invalid value for "+key+", using default", zap.String("value", raw), zap.String("default", choices[0]))
+	return choices[0]
+}
+
+// reservedPathSegments are the first path segments of the service's own routes, which a
+// short URL path would shadow or be shadowed by
+var reservedPathSegments = map[string]bool{
+	"admin": true, "buckets": true, "clients": true, "files": true, "health": true, "limits": true,
+}
+
+// shortURLPathPattern is a single lowercase path segment
+var shortURLPathPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// getShortURLPath reads SHORT_URL_PATH, defaulting to "u" when unset or when it is not a
+// single path segment free of the service's own routes
+func getShortURLPath() string {
+	raw := os.Getenv("SHORT_URL_PATH")
+	if raw == "" {
+		return "u"
+	}
+	if !shortURLPathPattern.MatchString(raw) || reservedPathSegments[raw] {
+		logger.Error("Invalid value for SHORT_URL_PATH, using default", zap.String("value", raw), zap.String("default", "u"))
+		return "u"
+	}
+	return raw
+}
+
+// getTrustedProxies reads TRUSTED_PROXIES, a comma-separated list of IP addresses and CIDR
+// ranges. Entries that are neither are logged and left out.
+func getTrustedProxies() []*net.IPNet {
+	var proxies []*net.IPNet
+	for _, raw := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		if !strings.Contains(raw, "/") {
+			if ip := net.ParseIP(raw); ip != nil {
+				if ip.To4() != nil {
+					raw += "/32"
+				} else {
+					raw += "/128"
+				}
+			}
+		}
+		_, network, err := net.ParseCIDR(raw)
+		if err != nil {
+			logger.Error("Invalid entry in TRUSTED_PROXIES, ignoring it", zap.String("value", raw))
+			continue
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies
+}
+
+// getSecret reads a signing secret from key, generating a random one when it is unset.
+// A generated secret only holds on this instance until it restarts, which is logged
+// naming what it signs.
+func getSecret(key, signs string) []byte {
+	if secret := os.Getenv(key); secret != "" {
+		return []byte(secret)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		logger.Error("Failed to generate a secret", zap.String("key", key), zap.Error(err))
+		os.Exit(1)
+	}
+	logger.Info(key + " is unset; " + signs + " are only valid on this instance until it restarts")
+	return secret
+}
+
+// getInstanceID reads INSTANCE_ID, defaulting to the hostname and process id
+func getInstanceID() string {
+	if id := os.Getenv("INSTANCE_ID"); id != "" {
+		return id
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return hostname + "-" + strconv.Itoa(os.Getpid())
+}
@@ -3,10 +3,11 @@ package database
 import (
 	"os"
 
+	"file-upload-service/logger"
+
 	"github.com/jmoiron/sqlx"
 	"github.com/umakantv/go-utils/db"
 	"github.com/umakantv/go-utils/db/migrations"
-	"github.com/umakantv/go-utils/logger"
 	"go.uber.org/zap"
 )
 
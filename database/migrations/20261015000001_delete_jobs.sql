@@ -0,0 +1,23 @@
+-- Migration: delete_jobs
+-- Created: 2026-10-15
+
+-- Delete-by-path requests matching more files than MAX_SYNC_ROWS run as background jobs
+CREATE TABLE IF NOT EXISTS delete_jobs (
+    id TEXT PRIMARY KEY,
+    client_id TEXT NOT NULL,
+    bucket_id INTEGER NOT NULL REFERENCES buckets(id),
+    path TEXT NOT NULL,
+    status TEXT NOT NULL,
+    matched INTEGER NOT NULL DEFAULT 0,
+    deleted INTEGER NOT NULL DEFAULT 0,
+    missing INTEGER NOT NULL DEFAULT 0,
+    failed INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    finished_at DATETIME
+);
+
+-- Jobs are looked up by client, and unfinished ones by status on startup
+CREATE INDEX IF NOT EXISTS idx_delete_jobs_client_id ON delete_jobs(client_id);
+CREATE INDEX IF NOT EXISTS idx_delete_jobs_status ON delete_jobs(status);
@@ -0,0 +1,29 @@
+-- Migration: upload_groups
+-- Created: 2026-10-16
+
+-- Create upload_groups table.
+-- A group bundles several signed-URL uploads that must become visible together:
+-- entries are uploaded into a staging area and only moved to their final paths
+-- when the group is committed. Open groups past expires_at are cleaned up.
+CREATE TABLE IF NOT EXISTS upload_groups (
+    id TEXT PRIMARY KEY,
+    client_id TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'open',
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create index on client_id for faster lookups
+CREATE INDEX IF NOT EXISTS idx_upload_groups_client_id ON upload_groups(client_id);
+
+-- Create index for the expiry sweeper
+CREATE INDEX IF NOT EXISTS idx_upload_groups_status_expires_at ON upload_groups(status, expires_at);
+
+-- Link files to their upload group. Staged files are invisible to listings,
+-- downloads and deletes until the group is committed.
+ALTER TABLE files ADD COLUMN upload_group_id TEXT REFERENCES upload_groups(id);
+ALTER TABLE files ADD COLUMN staged INTEGER NOT NULL DEFAULT 0;
+
+-- Create index on upload_group_id for faster lookups
+CREATE INDEX IF NOT EXISTS idx_files_upload_group_id ON files(upload_group_id);
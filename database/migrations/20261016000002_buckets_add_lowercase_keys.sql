@@ -0,0 +1,7 @@
+-- Migration: buckets_add_lowercase_keys
+-- Created: 2026-10-16
+
+-- Add lowercase_keys flag to buckets table.
+-- When set, object keys are lowercased during canonicalization so that
+-- "Reports/Q1.pdf" and "reports/q1.pdf" address the same file.
+ALTER TABLE buckets ADD COLUMN lowercase_keys INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,9 @@
+-- Migration: content_type_sniffing
+-- Created: 2026-10-16
+
+-- Store the content type detected from the uploaded bytes next to the declared mimetype.
+-- NULL for files uploaded before sniffing was introduced.
+ALTER TABLE files ADD COLUMN detected_mimetype TEXT;
+
+-- Let a bucket opt out of rejecting uploads whose content does not match the declared mimetype
+ALTER TABLE buckets ADD COLUMN allow_mimetype_mismatch INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+-- Migration: buckets_add_allowed_mimetypes
+-- Created: 2026-10-16
+
+-- Add allowed_mimetypes column to buckets table.
+-- This stores a JSON array of mimetypes that signed URLs may be requested for.
+-- Entries can use a wildcard subtype; an empty array allows every mimetype.
+-- Example: ["image/*", "application/pdf"]
+ALTER TABLE buckets ADD COLUMN allowed_mimetypes TEXT NOT NULL DEFAULT '[]';
@@ -0,0 +1,39 @@
+-- Migration: bucket_snapshots
+-- Created: 2026-10-16
+
+-- Create bucket_snapshots table.
+-- A snapshot records every live file of a bucket at a point in time so the bucket
+-- can be restored after a bad bulk operation. The bytes are kept under
+-- ./snapshots/<snapshot_id>/ as hard links or copies, depending on SNAPSHOT_STORAGE.
+-- Snapshots past expires_at are removed by the retention sweeper.
+CREATE TABLE IF NOT EXISTS bucket_snapshots (
+    id TEXT PRIMARY KEY,
+    bucket_id INTEGER NOT NULL REFERENCES buckets(id),
+    client_id TEXT NOT NULL,
+    storage TEXT NOT NULL,
+    file_count INTEGER NOT NULL DEFAULT 0,
+    total_bytes INTEGER NOT NULL DEFAULT 0,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create index on bucket_id for listing a bucket's snapshots
+CREATE INDEX IF NOT EXISTS idx_bucket_snapshots_bucket_id ON bucket_snapshots(bucket_id);
+
+-- Create index for the retention sweeper
+CREATE INDEX IF NOT EXISTS idx_bucket_snapshots_expires_at ON bucket_snapshots(expires_at);
+
+-- Create bucket_snapshot_files table holding the file rows as they were when the snapshot was taken
+CREATE TABLE IF NOT EXISTS bucket_snapshot_files (
+    snapshot_id TEXT NOT NULL REFERENCES bucket_snapshots(id),
+    file_id TEXT NOT NULL,
+    key TEXT NOT NULL,
+    file_name TEXT NOT NULL,
+    file_size INTEGER NOT NULL,
+    mimetype TEXT NOT NULL,
+    detected_mimetype TEXT,
+    owner_entity_type TEXT NOT NULL,
+    owner_entity_id TEXT NOT NULL,
+    created_at DATETIME,
+    PRIMARY KEY (snapshot_id, file_id)
+);
@@ -0,0 +1,19 @@
+-- Migration: upload_reservations
+-- Created: 2026-10-16
+
+-- Create upload_reservations table.
+-- A reservation records the one outstanding upload token for a key of a bucket, so
+-- repeated signed URL requests for the same key are refused instead of piling up
+-- pending file rows. It lapses at expires_at (when the token expires) and is removed
+-- once the upload completes.
+CREATE TABLE IF NOT EXISTS upload_reservations (
+    bucket_id INTEGER NOT NULL REFERENCES buckets(id),
+    key TEXT NOT NULL,
+    file_id TEXT NOT NULL,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (bucket_id, key)
+);
+
+-- Create index on file_id to release a reservation when its upload completes
+CREATE INDEX IF NOT EXISTS idx_upload_reservations_file_id ON upload_reservations(file_id);
@@ -0,0 +1,13 @@
+-- Migration: files_add_status
+-- Created: 2026-10-16
+
+-- Track the lifecycle of each file row: 'pending' when a signed URL is issued,
+-- 'uploaded' once its bytes are stored and 'deleted' once removed. Rows created
+-- before this column existed cannot be told apart, so live rows are assumed
+-- uploaded and soft-deleted rows are marked deleted.
+ALTER TABLE files ADD COLUMN status TEXT NOT NULL DEFAULT 'uploaded';
+
+UPDATE files SET status = 'deleted' WHERE deleted_at IS NOT NULL;
+
+-- Create index for listings, which only show uploaded files
+CREATE INDEX IF NOT EXISTS idx_files_bucket_id_status ON files(bucket_id, status);
@@ -0,0 +1,22 @@
+-- Migration: file_grants
+-- Created: 2026-10-16
+
+-- Create file_grants table.
+-- A grant lets one other client download one specific file by id without the file
+-- being public. Grants may expire and are revoked by setting revoked_at. Downloads
+-- made through a grant are counted on the grant.
+CREATE TABLE IF NOT EXISTS file_grants (
+    id TEXT PRIMARY KEY,
+    file_id TEXT NOT NULL REFERENCES files(id),
+    owner_client_id TEXT NOT NULL,
+    grantee_client_id TEXT NOT NULL,
+    permission TEXT NOT NULL,
+    expires_at DATETIME,
+    revoked_at DATETIME,
+    download_count INTEGER NOT NULL DEFAULT 0,
+    last_downloaded_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create index for looking up a file's grants and a grantee's access to a file
+CREATE INDEX IF NOT EXISTS idx_file_grants_file_id_grantee ON file_grants(file_id, grantee_client_id);
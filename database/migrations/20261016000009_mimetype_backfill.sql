@@ -0,0 +1,56 @@
+-- Migration: mimetype_backfill
+-- Created: 2026-10-16
+
+-- Create audit_events table.
+-- An append-only record of administrative changes to stored data. detail holds a
+-- JSON object describing the change.
+CREATE TABLE IF NOT EXISTS audit_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    action TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    client_id TEXT,
+    file_id TEXT,
+    detail TEXT NOT NULL DEFAULT '{}',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_file_id ON audit_events(file_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events(created_at);
+
+-- Create mimetype_backfill_jobs table.
+-- A job walks stored files in id order, sniffing their leading bytes. cursor is the
+-- last file id processed so an interrupted job resumes where it stopped.
+CREATE TABLE IF NOT EXISTS mimetype_backfill_jobs (
+    id TEXT PRIMARY KEY,
+    status TEXT NOT NULL,
+    bucket_id INTEGER,
+    auto_apply INTEGER NOT NULL DEFAULT 0,
+    cursor TEXT NOT NULL DEFAULT '',
+    scanned INTEGER NOT NULL DEFAULT 0,
+    proposed INTEGER NOT NULL DEFAULT 0,
+    applied INTEGER NOT NULL DEFAULT 0,
+    unreadable INTEGER NOT NULL DEFAULT 0,
+    error TEXT,
+    started_at DATETIME NOT NULL,
+    finished_at DATETIME
+);
+
+-- Create mimetype_corrections table.
+-- A proposed change of a file's stored mimetype to the type sniffed from its bytes.
+-- unambiguous marks proposals safe to apply without review (a generic type replaced
+-- by a recognised binary signature).
+CREATE TABLE IF NOT EXISTS mimetype_corrections (
+    id TEXT PRIMARY KEY,
+    job_id TEXT NOT NULL REFERENCES mimetype_backfill_jobs(id),
+    file_id TEXT NOT NULL REFERENCES files(id),
+    current_mimetype TEXT NOT NULL,
+    proposed_mimetype TEXT NOT NULL,
+    unambiguous INTEGER NOT NULL DEFAULT 0,
+    status TEXT NOT NULL,
+    resolved_by TEXT,
+    resolved_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_mimetype_corrections_status ON mimetype_corrections(status, created_at);
+CREATE INDEX IF NOT EXISTS idx_mimetype_corrections_file_id ON mimetype_corrections(file_id);
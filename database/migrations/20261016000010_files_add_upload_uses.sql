@@ -0,0 +1,7 @@
+-- Migration: files_add_upload_uses
+-- Created: 2026-10-16
+
+-- Count how many more uploads the file's signed URL token accepts. A successful
+-- upload uses one; the token is removed once none are left. Existing tokens were
+-- issued single-use.
+ALTER TABLE files ADD COLUMN upload_uses_remaining INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,86 @@
+-- Migration: file_events
+-- Created: 2026-10-16
+
+-- Create file_events table.
+-- Every change to the visible files of a bucket is appended here in commit order, so sync
+-- clients can ask for the changes after a cursor (the seq of the last event they saw)
+-- instead of listing the whole bucket. A file is visible once it is uploaded and not
+-- staged in an upload group: becoming visible is a created event, leaving it (deleted,
+-- superseded, discarded) a deleted event, and any metadata, key or content change while
+-- visible an updated event. Events older than FILE_EVENT_RETENTION_HOURS are compacted away.
+CREATE TABLE IF NOT EXISTS file_events (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    bucket_id INTEGER NOT NULL,
+    file_id TEXT NOT NULL,
+    event TEXT NOT NULL,
+    key TEXT NOT NULL,
+    previous_key TEXT,
+    file_name TEXT NOT NULL,
+    file_size INTEGER NOT NULL,
+    mimetype TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create index for reading a bucket's events after a cursor
+CREATE INDEX IF NOT EXISTS idx_file_events_bucket_id_seq ON file_events(bucket_id, seq);
+
+-- Create index for compacting old events
+CREATE INDEX IF NOT EXISTS idx_file_events_created_at ON file_events(created_at);
+
+-- Create file_events_horizon table.
+-- A single row recording how far events have been compacted: cursors before
+-- compacted_seq (or timestamps before compacted_before) need a full resync.
+CREATE TABLE IF NOT EXISTS file_events_horizon (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    compacted_seq INTEGER NOT NULL DEFAULT 0,
+    compacted_before DATETIME
+);
+
+INSERT OR IGNORE INTO file_events_horizon (id) VALUES (1);
+
+-- Files that are already visible start the history with a created event
+INSERT INTO file_events (bucket_id, file_id, event, key, file_name, file_size, mimetype)
+SELECT bucket_id, id, 'created', key, file_name, file_size, mimetype
+FROM files
+WHERE status = 'uploaded' AND staged = 0
+ORDER BY created_at, id;
+
+-- The events are written by triggers so that no code path changing files can skip one
+CREATE TRIGGER IF NOT EXISTS files_event_insert AFTER INSERT ON files
+WHEN NEW.status = 'uploaded' AND NEW.staged = 0
+BEGIN
+    INSERT INTO file_events (bucket_id, file_id, event, key, file_name, file_size, mimetype)
+    VALUES (NEW.bucket_id, NEW.id, 'created', NEW.key, NEW.file_name, NEW.file_size, NEW.mimetype);
+END;
+
+CREATE TRIGGER IF NOT EXISTS files_event_visible AFTER UPDATE ON files
+WHEN NEW.status = 'uploaded' AND NEW.staged = 0
+    AND NOT (OLD.status = 'uploaded' AND OLD.staged = 0)
+BEGIN
+    INSERT INTO file_events (bucket_id, file_id, event, key, file_name, file_size, mimetype)
+    VALUES (NEW.bucket_id, NEW.id, 'created', NEW.key, NEW.file_name, NEW.file_size, NEW.mimetype);
+END;
+
+CREATE TRIGGER IF NOT EXISTS files_event_hidden AFTER UPDATE ON files
+WHEN OLD.status = 'uploaded' AND OLD.staged = 0
+    AND NOT (NEW.status = 'uploaded' AND NEW.staged = 0)
+BEGIN
+    INSERT INTO file_events (bucket_id, file_id, event, key, file_name, file_size, mimetype)
+    VALUES (OLD.bucket_id, OLD.id, 'deleted', OLD.key, OLD.file_name, OLD.file_size, OLD.mimetype);
+END;
+
+CREATE TRIGGER IF NOT EXISTS files_event_changed AFTER UPDATE ON files
+WHEN OLD.status = 'uploaded' AND OLD.staged = 0
+    AND NEW.status = 'uploaded' AND NEW.staged = 0
+    AND (NEW.key IS NOT OLD.key
+        OR NEW.file_name IS NOT OLD.file_name
+        OR NEW.file_size IS NOT OLD.file_size
+        OR NEW.mimetype IS NOT OLD.mimetype
+        OR NEW.detected_mimetype IS NOT OLD.detected_mimetype
+        OR NEW.updated_at IS NOT OLD.updated_at)
+BEGIN
+    INSERT INTO file_events (bucket_id, file_id, event, key, previous_key, file_name, file_size, mimetype)
+    VALUES (NEW.bucket_id, NEW.id, 'updated', NEW.key,
+        CASE WHEN NEW.key IS NOT OLD.key THEN OLD.key END,
+        NEW.file_name, NEW.file_size, NEW.mimetype);
+END;
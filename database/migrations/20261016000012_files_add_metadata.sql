@@ -0,0 +1,9 @@
+-- Migration: files_add_metadata
+-- Created: 2026-10-16
+
+-- Add metadata column to files table.
+-- Custom key/value pairs attached to a file when its signed URL is requested, stored as
+-- a JSON object of strings. Snapshots keep a copy so a restore brings them back too.
+ALTER TABLE files ADD COLUMN metadata TEXT NOT NULL DEFAULT '{}';
+
+ALTER TABLE bucket_snapshot_files ADD COLUMN metadata TEXT NOT NULL DEFAULT '{}';
@@ -0,0 +1,20 @@
+-- Migration: file_tombstones
+-- Created: 2026-10-16
+
+-- Create file_tombstones table.
+-- POST /files/purge erases a file for good: its bytes (live, staged and in snapshots) and
+-- every row mentioning it are removed. Only this tombstone remains, recording when the
+-- file existed and when it was erased, with no key, name or owner. The request's legal
+-- basis is kept in the audit log.
+CREATE TABLE IF NOT EXISTS file_tombstones (
+    file_id TEXT PRIMARY KEY,
+    client_id TEXT NOT NULL,
+    bucket_id INTEGER NOT NULL,
+    file_created_at DATETIME,
+    file_deleted_at DATETIME,
+    secure_wipe INTEGER NOT NULL DEFAULT 0,
+    purged_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create index for listing a client's erasures
+CREATE INDEX IF NOT EXISTS idx_file_tombstones_client_id ON file_tombstones(client_id);
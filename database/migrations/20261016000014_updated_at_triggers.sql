@@ -0,0 +1,104 @@
+-- Migration: updated_at_triggers
+-- Created: 2026-10-16
+
+-- updated_at is kept by the database rather than by each handler, so it is a reliable
+-- sync signal: any update of a row that does not set updated_at itself has it stamped
+-- here. Handlers may still set it to their own clock; the triggers only fill in what a
+-- statement leaves unchanged. The stamp uses the format the Go driver writes, so the
+-- values still order as text.
+--
+-- created_at is immutable: updates that change it are aborted.
+
+-- files: bookkeeping columns (upload_uses_remaining) do not count as a change. The
+-- stamp below only sets updated_at, which is why files_event_changed is recreated to
+-- listen to the file's own columns: the stamp must not look like a second change.
+DROP TRIGGER IF EXISTS files_event_changed;
+
+CREATE TRIGGER IF NOT EXISTS files_event_changed
+AFTER UPDATE OF key, file_name, file_size, mimetype, detected_mimetype, metadata,
+    owner_entity_type, owner_entity_id, status, staged, deleted_at ON files
+WHEN OLD.status = 'uploaded' AND OLD.staged = 0
+    AND NEW.status = 'uploaded' AND NEW.staged = 0
+    AND (NEW.key IS NOT OLD.key
+        OR NEW.file_name IS NOT OLD.file_name
+        OR NEW.file_size IS NOT OLD.file_size
+        OR NEW.mimetype IS NOT OLD.mimetype
+        OR NEW.detected_mimetype IS NOT OLD.detected_mimetype
+        OR NEW.metadata IS NOT OLD.metadata
+        OR NEW.owner_entity_type IS NOT OLD.owner_entity_type
+        OR NEW.owner_entity_id IS NOT OLD.owner_entity_id
+        OR NEW.updated_at IS NOT OLD.updated_at)
+BEGIN
+    INSERT INTO file_events (bucket_id, file_id, event, key, previous_key, file_name, file_size, mimetype)
+    VALUES (NEW.bucket_id, NEW.id, 'updated', NEW.key,
+        CASE WHEN NEW.key IS NOT OLD.key THEN OLD.key END,
+        NEW.file_name, NEW.file_size, NEW.mimetype);
+END;
+
+CREATE TRIGGER IF NOT EXISTS files_touch_updated_at
+AFTER UPDATE OF key, file_name, file_size, mimetype, detected_mimetype, metadata,
+    owner_entity_type, owner_entity_id, status, staged, deleted_at ON files
+WHEN NEW.updated_at IS OLD.updated_at
+    AND (NEW.key IS NOT OLD.key
+        OR NEW.file_name IS NOT OLD.file_name
+        OR NEW.file_size IS NOT OLD.file_size
+        OR NEW.mimetype IS NOT OLD.mimetype
+        OR NEW.detected_mimetype IS NOT OLD.detected_mimetype
+        OR NEW.metadata IS NOT OLD.metadata
+        OR NEW.owner_entity_type IS NOT OLD.owner_entity_type
+        OR NEW.owner_entity_id IS NOT OLD.owner_entity_id
+        OR NEW.status IS NOT OLD.status
+        OR NEW.staged IS NOT OLD.staged
+        OR NEW.deleted_at IS NOT OLD.deleted_at)
+BEGIN
+    UPDATE files SET updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now') WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS files_created_at_immutable
+BEFORE UPDATE OF created_at ON files
+WHEN NEW.created_at IS NOT OLD.created_at
+BEGIN
+    SELECT RAISE(ABORT, 'files.created_at cannot be changed');
+END;
+
+-- buckets
+CREATE TRIGGER IF NOT EXISTS buckets_touch_updated_at AFTER UPDATE ON buckets
+WHEN NEW.updated_at IS OLD.updated_at
+BEGIN
+    UPDATE buckets SET updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now') WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS buckets_created_at_immutable
+BEFORE UPDATE OF created_at ON buckets
+WHEN NEW.created_at IS NOT OLD.created_at
+BEGIN
+    SELECT RAISE(ABORT, 'buckets.created_at cannot be changed');
+END;
+
+-- clients
+CREATE TRIGGER IF NOT EXISTS clients_touch_updated_at AFTER UPDATE ON clients
+WHEN NEW.updated_at IS OLD.updated_at
+BEGIN
+    UPDATE clients SET updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now') WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS clients_created_at_immutable
+BEFORE UPDATE OF created_at ON clients
+WHEN NEW.created_at IS NOT OLD.created_at
+BEGIN
+    SELECT RAISE(ABORT, 'clients.created_at cannot be changed');
+END;
+
+-- upload_groups
+CREATE TRIGGER IF NOT EXISTS upload_groups_touch_updated_at AFTER UPDATE ON upload_groups
+WHEN NEW.updated_at IS OLD.updated_at
+BEGIN
+    UPDATE upload_groups SET updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now') WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS upload_groups_created_at_immutable
+BEFORE UPDATE OF created_at ON upload_groups
+WHEN NEW.created_at IS NOT OLD.created_at
+BEGIN
+    SELECT RAISE(ABORT, 'upload_groups.created_at cannot be changed');
+END;
@@ -0,0 +1,7 @@
+-- Migration: file_checksums
+-- Created: 2026-10-16
+
+-- Record the hex SHA-256 of a file's bytes when they arrive through a signed URL, including
+-- content replacements (POST /files/{id}/replace-url). Files stored before this migration,
+-- and through other upload paths, have none.
+ALTER TABLE files ADD COLUMN checksum TEXT;
@@ -0,0 +1,30 @@
+-- Migration: file_versions
+-- Created: 2026-10-16
+
+-- Add versioning column to buckets table.
+-- In a versioning bucket, content that an upload, replacement or deletion would otherwise
+-- discard is kept as a version of its key instead.
+ALTER TABLE buckets ADD COLUMN versioning INTEGER NOT NULL DEFAULT 0;
+
+-- Create file_versions table.
+-- Each row is one earlier content of a key, kept under ./versions/<version_id>: file_id is
+-- the file that held it and created_at is when it stopped being current. A delete marker
+-- records that the key's file was deleted; it has no bytes of its own. Versions stay until
+-- they are purged, even when versioning is turned off again.
+CREATE TABLE IF NOT EXISTS file_versions (
+    id TEXT PRIMARY KEY,
+    bucket_id INTEGER NOT NULL REFERENCES buckets(id),
+    key TEXT NOT NULL,
+    file_id TEXT NOT NULL,
+    file_size INTEGER NOT NULL DEFAULT 0,
+    mimetype TEXT NOT NULL DEFAULT '',
+    checksum TEXT,
+    delete_marker INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create index for listing a key's versions, newest first
+CREATE INDEX IF NOT EXISTS idx_file_versions_bucket_key ON file_versions(bucket_id, key, created_at);
+
+-- Create index for finding a file's versions when it is purged
+CREATE INDEX IF NOT EXISTS idx_file_versions_file_id ON file_versions(file_id);
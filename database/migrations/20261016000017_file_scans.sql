@@ -0,0 +1,14 @@
+-- Migration: file_scans
+-- Created: 2026-10-16
+
+-- Add virus scan columns to files table.
+-- scan_status is NULL for files stored while no scanner was configured, 'pending' until
+-- the scanner has checked the current content, then 'clean' or 'infected'; 'released'
+-- marks an infected file an admin let out of quarantine. Infected files get the status
+-- 'quarantined' and their bytes are moved under ./quarantine/<file_id>.
+ALTER TABLE files ADD COLUMN scan_status TEXT;
+ALTER TABLE files ADD COLUMN scan_signature TEXT;
+ALTER TABLE files ADD COLUMN scanned_at DATETIME;
+
+-- Create index for the background scanner and the quarantine listing
+CREATE INDEX IF NOT EXISTS idx_files_scan_status ON files(scan_status, status);
@@ -0,0 +1,7 @@
+-- Migration: client_short_urls
+-- Created: 2026-10-16
+
+-- Add short_urls flag to clients table.
+-- Clients with short_urls = 1 get signed URLs of the form /<SHORT_URL_PATH>/<short token>
+-- instead of /files/upload?token= and /files/download?token=. Both forms keep working.
+ALTER TABLE clients ADD COLUMN short_urls INTEGER NOT NULL DEFAULT 0;
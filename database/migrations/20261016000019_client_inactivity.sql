@@ -0,0 +1,16 @@
+-- Migration: client_inactivity
+-- Created: 2026-10-16
+
+-- Add activity and inactivity policy columns to clients table.
+-- last_used_at is the last authenticated request and last_download_at the last signed URL
+-- or public download of one of the client's files, both kept to within an hour.
+-- inactivity_days overrides INACTIVITY_DAYS for the client (NULL uses the global value).
+-- inactive_flagged_at is set when the client passes its inactivity limit and cleared when
+-- it is active again; inactive_archived_at is when its buckets were archived for it.
+-- Exempt clients are never flagged.
+ALTER TABLE clients ADD COLUMN last_used_at DATETIME;
+ALTER TABLE clients ADD COLUMN last_download_at DATETIME;
+ALTER TABLE clients ADD COLUMN inactivity_days INTEGER;
+ALTER TABLE clients ADD COLUMN inactivity_exempt INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE clients ADD COLUMN inactive_flagged_at DATETIME;
+ALTER TABLE clients ADD COLUMN inactive_archived_at DATETIME;
@@ -0,0 +1,14 @@
+-- Migration: customer_encryption_keys
+-- Created: 2026-10-16
+
+-- Files uploaded with a customer-provided key (X-Encryption-Key) are stored encrypted with
+-- AES-256-CTR. The key itself is never stored: encryption_key_hash is "<salt>:<sha256>" in
+-- hex, the SHA-256 of the salt followed by the key, and encryption_iv is the hex IV the
+-- content was encrypted with. Both are NULL for unencrypted files. Versions and snapshot
+-- copies keep the values of the content they preserve.
+ALTER TABLE files ADD COLUMN encryption_key_hash TEXT;
+ALTER TABLE files ADD COLUMN encryption_iv TEXT;
+ALTER TABLE file_versions ADD COLUMN encryption_key_hash TEXT;
+ALTER TABLE file_versions ADD COLUMN encryption_iv TEXT;
+ALTER TABLE bucket_snapshot_files ADD COLUMN encryption_key_hash TEXT;
+ALTER TABLE bucket_snapshot_files ADD COLUMN encryption_iv TEXT;
@@ -0,0 +1,54 @@
+-- Migration: storage_objects
+-- Created: 2026-10-16
+
+-- Add dedupe column to buckets table.
+-- In a dedupe bucket, a signed URL upload whose checksum and size match content already
+-- stored in the bucket shares that content's bytes instead of keeping its own copy.
+ALTER TABLE buckets ADD COLUMN dedupe INTEGER NOT NULL DEFAULT 0;
+
+-- Create storage_objects table.
+-- Each row is one distinct content of a dedupe bucket, kept under ./objects/<id>. Files
+-- holding the content are hard links to that blob and point at the row through
+-- files.storage_object_id; ref_count is how many files do. Once it drops to zero the
+-- object sweeper removes the row and the blob. linked_at is when a file last took a
+-- reference.
+CREATE TABLE IF NOT EXISTS storage_objects (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    bucket_id INTEGER NOT NULL REFERENCES buckets(id),
+    checksum TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    ref_count INTEGER NOT NULL DEFAULT 0,
+    linked_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (bucket_id, checksum, size)
+);
+
+-- Create index for the object sweeper
+CREATE INDEX IF NOT EXISTS idx_storage_objects_ref_count ON storage_objects(ref_count);
+
+ALTER TABLE files ADD COLUMN storage_object_id INTEGER REFERENCES storage_objects(id);
+
+-- The reference counts are kept by triggers so that no code path changing files can skip
+-- one: pointing a file at an object takes a reference and pointing it elsewhere (or at
+-- nothing) gives it back. A deleted file lets go of its object, and so does a purged row.
+CREATE TRIGGER IF NOT EXISTS files_storage_object_changed
+AFTER UPDATE OF storage_object_id ON files
+WHEN NEW.storage_object_id IS NOT OLD.storage_object_id
+BEGIN
+    UPDATE storage_objects SET ref_count = ref_count - 1 WHERE id = OLD.storage_object_id;
+    UPDATE storage_objects SET ref_count = ref_count + 1 WHERE id = NEW.storage_object_id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS files_storage_object_deleted
+AFTER UPDATE OF status ON files
+WHEN NEW.status = 'deleted' AND NEW.storage_object_id IS NOT NULL
+BEGIN
+    UPDATE files SET storage_object_id = NULL WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS files_storage_object_removed
+AFTER DELETE ON files
+WHEN OLD.storage_object_id IS NOT NULL
+BEGIN
+    UPDATE storage_objects SET ref_count = ref_count - 1 WHERE id = OLD.storage_object_id;
+END;
@@ -0,0 +1,8 @@
+-- Migration: bucket_key_limits
+-- Created: 2026-10-16
+
+-- Guards against pathological key layouts. New keys may have at most max_key_depth
+-- slash-separated segments, and may not start a new top-level folder once the bucket
+-- holds max_top_level_folders of them (0 means no limit). Existing keys are not checked.
+ALTER TABLE buckets ADD COLUMN max_key_depth INTEGER NOT NULL DEFAULT 20;
+ALTER TABLE buckets ADD COLUMN max_top_level_folders INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,14 @@
+-- Migration: image_dimensions
+-- Created: 2026-10-16
+
+-- Pixel size and format of GIF, JPEG and PNG files, read from the image header at upload
+-- so front-ends can reserve layout space without downloading the image. NULL for other
+-- content and for images whose header could not be decoded. Snapshots keep them for the
+-- content they preserve.
+ALTER TABLE files ADD COLUMN image_width INTEGER;
+ALTER TABLE files ADD COLUMN image_height INTEGER;
+ALTER TABLE files ADD COLUMN image_format TEXT;
+
+ALTER TABLE bucket_snapshot_files ADD COLUMN image_width INTEGER;
+ALTER TABLE bucket_snapshot_files ADD COLUMN image_height INTEGER;
+ALTER TABLE bucket_snapshot_files ADD COLUMN image_format TEXT;
@@ -0,0 +1,29 @@
+-- Migration: thumbnails
+-- Created: 2026-10-16
+
+-- Widths of the JPEG thumbnails made of every GIF, JPEG and PNG image uploaded to a
+-- bucket, as a JSON array of pixel widths. An empty array turns thumbnails off.
+ALTER TABLE buckets ADD COLUMN thumbnail_widths TEXT NOT NULL DEFAULT '[]';
+
+-- Outcome of the last thumbnail generation of a file ('ready' or 'failed') and what it was
+-- run on: the content checksum and the bucket's widths, joined by ':'. A file whose
+-- thumbnail_source differs from its current checksum and widths is due for generation.
+ALTER TABLE files ADD COLUMN thumbnail_status TEXT;
+ALTER TABLE files ADD COLUMN thumbnail_source TEXT;
+
+-- Create file_thumbnails table.
+-- Each row is one thumbnail kept at path, under the .thumbs folder of the file's bucket,
+-- made for one of the bucket's widths (size) of the content with the given checksum.
+-- width and height are its pixel size: an image narrower than size is not enlarged.
+-- Rows outliving their file or content are removed with their thumbnails by the
+-- thumbnail sweeper.
+CREATE TABLE IF NOT EXISTS file_thumbnails (
+    file_id TEXT NOT NULL REFERENCES files(id),
+    size INTEGER NOT NULL,
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    checksum TEXT NOT NULL,
+    path TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (file_id, size)
+);
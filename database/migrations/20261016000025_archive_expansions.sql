@@ -0,0 +1,24 @@
+-- Migration: archive_expansions
+-- Created: 2026-10-16
+
+-- Create archive_expansions table.
+-- A background expansion of a zip file too large to expand in its request. Entries are
+-- processed in archive order; entries_done counts those handled so an interrupted job
+-- resumes after the last one. summary holds the JSON created/skipped/errors lists so far.
+CREATE TABLE IF NOT EXISTS archive_expansions (
+    id TEXT PRIMARY KEY,
+    status TEXT NOT NULL,
+    file_id TEXT NOT NULL,
+    client_id TEXT NOT NULL,
+    bucket_id INTEGER NOT NULL,
+    prefix TEXT NOT NULL,
+    on_conflict TEXT NOT NULL DEFAULT '',
+    entries_total INTEGER NOT NULL DEFAULT 0,
+    entries_done INTEGER NOT NULL DEFAULT 0,
+    summary TEXT NOT NULL DEFAULT '{}',
+    error TEXT,
+    started_at DATETIME NOT NULL,
+    finished_at DATETIME
+);
+
+CREATE INDEX IF NOT EXISTS idx_archive_expansions_status ON archive_expansions(status);
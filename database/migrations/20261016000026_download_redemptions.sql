@@ -0,0 +1,31 @@
+-- Migration: download_redemptions
+-- Created: 2026-10-16
+
+-- Create download_redemptions table.
+-- Every download through a signed URL is recorded here for the client that issued the
+-- URL: a SHA-256 of the token (never the token itself), where the request came from, and
+-- the country and region a geo resolver placed that address in, if one is configured.
+-- The rows also count a URL's uses against its max_uses, so a row is kept until its URL
+-- has expired even when it is older than DOWNLOAD_REDEMPTION_RETENTION_HOURS.
+CREATE TABLE IF NOT EXISTS download_redemptions (
+    id TEXT PRIMARY KEY,
+    token_hash TEXT NOT NULL,
+    file_id TEXT NOT NULL,
+    version_id TEXT,
+    client_id TEXT NOT NULL,
+    remote_ip TEXT NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    country TEXT,
+    region TEXT,
+    token_expires_at DATETIME NOT NULL,
+    redeemed_at DATETIME NOT NULL
+);
+
+-- Create index for counting a URL's uses
+CREATE INDEX IF NOT EXISTS idx_download_redemptions_token_hash ON download_redemptions(token_hash);
+
+-- Create index for listing a file's redemptions for the client that issued the URLs
+CREATE INDEX IF NOT EXISTS idx_download_redemptions_file_client ON download_redemptions(file_id, client_id, redeemed_at);
+
+-- Create index for removing redemptions past their retention
+CREATE INDEX IF NOT EXISTS idx_download_redemptions_redeemed_at ON download_redemptions(redeemed_at);
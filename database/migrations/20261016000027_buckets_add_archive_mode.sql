@@ -0,0 +1,11 @@
+-- Migration: buckets_add_archive_mode
+-- Created: 2026-10-16
+
+-- Add archive_mode to buckets.
+-- Set when a bucket is archived: 'freeze-writes' stops changes to its files but keeps
+-- them listable and downloadable, 'freeze-all' also stops listing, downloads and public
+-- serving. NULL while the bucket is not archived.
+ALTER TABLE buckets ADD COLUMN archive_mode TEXT;
+
+-- Buckets archived so far could neither be listed nor served publicly
+UPDATE buckets SET archive_mode = 'freeze-all' WHERE archived = 1;
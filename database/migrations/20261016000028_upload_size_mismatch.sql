@@ -0,0 +1,13 @@
+-- Migration: upload_size_mismatch
+-- Created: 2026-10-16
+
+-- Add strict_file_size column to buckets table.
+-- In a strict bucket, an upload whose size differs from the file_size declared for its
+-- signed URL by more than FILE_SIZE_TOLERANCE_BYTES is rejected instead of flagged.
+ALTER TABLE buckets ADD COLUMN strict_file_size INTEGER NOT NULL DEFAULT 0;
+
+-- Add size_mismatch and declared_file_size columns to files table.
+-- file_size holds the bytes actually uploaded; declared_file_size keeps what the signed
+-- URL was requested for, and size_mismatch is set when the two differ beyond the tolerance.
+ALTER TABLE files ADD COLUMN size_mismatch INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE files ADD COLUMN declared_file_size INTEGER;
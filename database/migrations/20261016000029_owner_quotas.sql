@@ -0,0 +1,18 @@
+-- Migration: owner_quotas
+-- Created: 2026-10-16
+
+-- Create owner_quotas table.
+-- Caps the bytes a client may store for one owner entity. A row with an empty
+-- owner_entity_id is the default for every owner of that type; a row naming an id
+-- overrides it for that owner. Owners without either are not capped.
+CREATE TABLE IF NOT EXISTS owner_quotas (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    client_id TEXT NOT NULL,
+    owner_entity_type TEXT NOT NULL,
+    owner_entity_id TEXT NOT NULL DEFAULT '',
+    max_bytes INTEGER NOT NULL,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL,
+    UNIQUE (client_id, owner_entity_type, owner_entity_id)
+);
+
@@ -0,0 +1,9 @@
+-- Migration: files_uploader
+-- Created: 2026-10-16
+
+-- Add uploader_ip and uploader_user_agent columns to files table.
+-- They record where the bytes of an unauthenticated upload (a signed URL or an upload
+-- policy) came from, for abuse investigations. A replacement records its own uploader.
+-- Soft-deleting a file keeps them; only purging the file erases them.
+ALTER TABLE files ADD COLUMN uploader_ip TEXT;
+ALTER TABLE files ADD COLUMN uploader_user_agent TEXT;
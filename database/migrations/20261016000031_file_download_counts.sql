@@ -0,0 +1,8 @@
+-- Migration: file_download_counts
+-- Created: 2026-10-16
+
+-- Add download_count and last_downloaded_at columns to files table.
+-- They count completed downloads through download URLs and the public route. Downloads
+-- are gathered in memory and added in batches, so both trail by a few seconds.
+ALTER TABLE files ADD COLUMN download_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE files ADD COLUMN last_downloaded_at DATETIME;
@@ -0,0 +1,7 @@
+-- Migration: bucket_image_sizes
+-- Created: 2026-10-16
+
+-- Sizes the public route may resize a bucket's images to on request, as a JSON array of
+-- "<width>x<height>" strings; 0 for either side keeps the aspect ratio. An empty array
+-- turns resizing off.
+ALTER TABLE buckets ADD COLUMN image_sizes TEXT NOT NULL DEFAULT '[]';
@@ -0,0 +1,6 @@
+-- Migration: bucket_convert_images
+-- Created: 2026-10-16
+
+-- Whether the public route may serve a bucket's JPEG and PNG images converted to WebP or
+-- AVIF to browsers that accept them. Off by default.
+ALTER TABLE buckets ADD COLUMN convert_images INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+-- Migration: bucket_compression
+-- Created: 2026-10-16
+
+-- Whether the public route compresses a bucket's text assets (CSS, JavaScript, JSON, SVG
+-- and the like) for clients accepting gzip or br, and the smallest file, in bytes, it
+-- compresses. Off by default.
+ALTER TABLE buckets ADD COLUMN compression INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE buckets ADD COLUMN compression_min_bytes INTEGER NOT NULL DEFAULT 1024;
@@ -0,0 +1,7 @@
+-- Migration: bucket_hotlink_protection
+-- Created: 2026-10-16
+
+-- Which sites may embed a bucket's public files, as a JSON object with allowed_referers,
+-- allow_empty_referer and an optional placeholder_key. JSON null, the default, lets any
+-- site embed them.
+ALTER TABLE buckets ADD COLUMN hotlink_protection TEXT NOT NULL DEFAULT 'null';
@@ -0,0 +1,6 @@
+-- Migration: bucket_public_rate_limit
+-- Created: 2026-10-16
+
+-- How many public file requests a minute one address may make to a bucket, on top of the
+-- server-wide PUBLIC_RATE_LIMIT_PER_MINUTE. 0, the default, leaves only the server-wide limit.
+ALTER TABLE buckets ADD COLUMN public_rate_limit INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,7 @@
+-- Migration: bucket_quotas
+-- Created: 2026-10-16
+
+-- The most bytes and files a bucket may hold, counting uploads still reserved by signed
+-- URLs. 0, the default, leaves the bucket without that limit.
+ALTER TABLE buckets ADD COLUMN max_total_bytes INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE buckets ADD COLUMN max_file_count INTEGER NOT NULL DEFAULT 0;
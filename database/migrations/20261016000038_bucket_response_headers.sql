@@ -0,0 +1,6 @@
+-- Migration: bucket_response_headers
+-- Created: 2026-10-16
+
+-- Headers sent with every public response of a bucket, as a JSON object of header names
+-- and values. The default, an empty object, adds none.
+ALTER TABLE buckets ADD COLUMN response_headers TEXT NOT NULL DEFAULT '{}';
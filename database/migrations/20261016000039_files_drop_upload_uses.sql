@@ -0,0 +1,6 @@
+-- Migration: files_drop_upload_uses
+-- Created: 2026-10-16
+
+-- The uploads a file's tokens still accept are counted in the cache next to the tokens
+-- themselves (see cache.UploadUseStore), so the column is no longer read or written.
+ALTER TABLE files DROP COLUMN upload_uses_remaining;
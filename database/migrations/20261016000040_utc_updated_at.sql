@@ -0,0 +1,17 @@
+-- Migration: utc_updated_at
+-- Created: 2026-10-16
+
+-- The service now writes every timestamp in UTC, the zone the updated_at triggers stamp
+-- in, so the text of updated_at orders by time again. Values written before in another
+-- zone are converted; SQLite reads the offset they carry.
+UPDATE clients SET updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', updated_at)
+WHERE updated_at NOT LIKE '%+00:00' AND strftime('%Y-%m-%d %H:%M:%f+00:00', updated_at) IS NOT NULL;
+
+UPDATE buckets SET updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', updated_at)
+WHERE updated_at NOT LIKE '%+00:00' AND strftime('%Y-%m-%d %H:%M:%f+00:00', updated_at) IS NOT NULL;
+
+UPDATE files SET updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', updated_at)
+WHERE updated_at NOT LIKE '%+00:00' AND strftime('%Y-%m-%d %H:%M:%f+00:00', updated_at) IS NOT NULL;
+
+UPDATE upload_groups SET updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', updated_at)
+WHERE updated_at NOT LIKE '%+00:00' AND strftime('%Y-%m-%d %H:%M:%f+00:00', updated_at) IS NOT NULL;
@@ -0,0 +1,709 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// Archives with more file entries or more uncompressed bytes than these are expanded by a
+// background job instead of in the request
+const (
+	archiveExpandSyncMaxEntries = 100
+	archiveExpandSyncMaxBytes   = 32 << 20
+)
+
+var errArchiveEntryPath = errors.New("entry name must be a relative path without '.' or '..' segments")
+
+// archiveExpansionColumns lists the columns scanned into models.ArchiveExpansion
+const archiveExpansionColumns = `id, status, file_id, client_id, bucket_id, prefix, on_conflict, entries_total, entries_done, summary, error, started_at, finished_at`
+
+// archiveSource is a stored zip file being expanded
+type archiveSource struct {
+	FileID          string
+	ClientID        string
+	BucketID        int
+	Key             string
+	OwnerEntityType string
+	OwnerEntityID   string
+	// Path is where the archive is stored on disk
+	Path string
+}
+
+// archiveExpander extracts the entries of one open archive. remaining is what is left of
+// ARCHIVE_EXPAND_MAX_TOTAL_BYTES once the entries already stored are counted.
+type archiveExpander struct {
+	h          *FileHandler
+	source     archiveSource
+	prefix     string
+	onConflict string
+	remaining  int64
+	summary    models.ExpandArchiveSummary
+	// uploader is recorded on the files of a zip extracted as it was uploaded
+	uploader uploaderInfo
+}
+
+// validateArchiveEntryName refuses entry names that would climb out of the target prefix
+// (zip-slip) before they are joined to it. Keys built from the rest still go through the
+// bucket's key policy like any other upload.
+func validateArchiveEntryName(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") || windowsVolumePattern.MatchString(name) {
+		return errArchiveEntryPath
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "." || segment == ".." {
+			return errArchiveEntryPath
+		}
+	}
+	return nil
+}
+
+// archiveFileEntries returns the entries of an archive that expand to files. Directory
+// entries are left out: the directories of an archive become key segments of its files.
+func archiveFileEntries(archive *zip.Reader) []*zip.File {
+	var entries []*zip.File
+	for _, entry := range archive.File {
+		if !entry.FileInfo().IsDir() {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// expansionResponse converts a stored expansion to its API form
+func expansionResponse(job models.ArchiveExpansion) models.ArchiveExpansionResponse {
+	response := models.ArchiveExpansionResponse{
+		ID:           job.ID,
+		Status:       job.Status,
+		FileID:       job.FileID,
+		BucketID:     job.BucketID,
+		Prefix:       job.Prefix,
+		EntriesTotal: job.EntriesTotal,
+		EntriesDone:  job.EntriesDone,
+		Summary:      expansionSummary(job),
+		Error:        job.Error.String,
+		StartedAt:    job.StartedAt,
+	}
+	if job.FinishedAt.Valid {
+		response.FinishedAt = &job.FinishedAt.Time
+	}
+	return response
+}
+
+// expansionSummary decodes the summary stored with an expansion; lists are never null
+func expansionSummary(job models.ArchiveExpansion) models.ExpandArchiveSummary {
+	var summary models.ExpandArchiveSummary
+	json.Unmarshal([]byte(job.Summary), &summary)
+	if summary.Created == nil {
+		summary.Created = []models.ExpandedEntry{}
+	}
+	if summary.Skipped == nil {
+		summary.Skipped = []models.ExpandEntryOutcome{}
+	}
+	if summary.Errors == nil {
+		summary.Errors = []models.ExpandEntryOutcome{}
+	}
+	return summary
+}
+
+// ExpandArchive handles POST /files/{id}/expand - extract a stored zip file into its bucket,
+// one new file per entry under the request's prefix. Entry names are checked for traversal
+// and each key goes through the bucket's key and mimetype policy, so a bad entry is reported
+// and the rest still expand. Small archives are expanded in the request; larger ones are
+// handed to a background job whose progress is read from GET /files/expansions/{id}.
+// The archive itself is left untouched.
+func (h *FileHandler) ExpandArchive(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	fileID := mux.Vars(r)["id"]
+
+	var req models.ExpandArchiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+	prefix, err := sanitizeKey(strings.TrimSuffix(req.Prefix, "/"), false)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid prefix", zap.String("prefix", req.Prefix), zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("prefix is invalid: " + err.Error()))
+		return
+	}
+	switch req.OnConflict {
+	case "", models.OnConflictReject, models.OnConflictError, models.OnConflictOverwrite, models.OnConflictNewVersion, models.OnConflictRename:
+	default:
+		h.logRequest(ctx, "error", "Invalid on_conflict", zap.String("on_conflict", req.OnConflict))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("on_conflict must be one of reject, overwrite, new-version, rename"))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Expanding archive",
+		zap.String("file_id", fileID),
+		zap.String("client_id", clientID),
+		zap.String("prefix", prefix),
+	)
+
+	source, status, appErr := h.loadArchiveSource(ctx, fileID, clientID)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	// Register as a reader so a concurrent deletion does not remove the archive mid-expansion
+	readCtx, release, ok := h.locks.acquireRead(ctx, source.Path)
+	if !ok {
+		h.logRequest(ctx, "info", "File is being deleted", zap.String("file_id", fileID))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+		return
+	}
+	defer release()
+
+	f, err := os.Open(source.Path)
+	if err != nil {
+		h.logRequest(ctx, "error", "File not found on disk", zap.String("file_id", fileID), zap.Error(err))
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(errs.NewValidationError("File has been deleted"))
+		return
+	}
+	defer f.Close()
+
+	archive, status, appErr := h.openArchive(ctx, f)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+	entries := archiveFileEntries(archive)
+	var declared uint64
+	for _, entry := range entries {
+		declared += entry.UncompressedSize64
+	}
+
+	if len(entries) > archiveExpandSyncMaxEntries || declared > archiveExpandSyncMaxBytes {
+		job, err := h.startArchiveExpansion(source, prefix, req.OnConflict, len(entries))
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to create archive expansion", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to expand archive"))
+			return
+		}
+		h.logRequest(ctx, "info", "Archive expansion queued",
+			zap.String("file_id", fileID),
+			zap.String("job_id", job.ID),
+			zap.Int("entries", len(entries)),
+		)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/files/expansions/"+job.ID)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(expansionResponse(job))
+		return
+	}
+
+	expander := &archiveExpander{
+		h:          h,
+		source:     source,
+		prefix:     prefix,
+		onConflict: req.OnConflict,
+		remaining:  h.config.ArchiveExpandMaxTotalBytes,
+		summary:    expansionSummary(models.ArchiveExpansion{}),
+	}
+	for _, entry := range entries {
+		if readCtx.Err() != nil {
+			break
+		}
+		expander.expandEntry(readCtx, entry)
+	}
+	summary := expander.summary
+
+	h.logRequest(ctx, "info", "Archive expanded",
+		zap.String("file_id", fileID),
+		zap.Int("created", len(summary.Created)),
+		zap.Int("skipped", len(summary.Skipped)),
+		zap.Int("errors", len(summary.Errors)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file_id": fileID,
+		"prefix":  prefix,
+		"created": summary.Created,
+		"skipped": summary.Skipped,
+		"errors":  summary.Errors,
+	})
+}
+
+// loadArchiveSource looks up a file to expand for its owner. Only uploaded, scanned files
+// stored without a customer key can be read by the server.
+func (h *FileHandler) loadArchiveSource(ctx context.Context, fileID, clientID string) (archiveSource, int, *errs.AppError) {
+	var source archiveSource
+	var status string
+	var deletedAt sql.NullTime
+	var scanStatus string
+	var encrypted bool
+	var bucketArchived int
+	var clientName, bucketName string
+	err := h.db.QueryRow(
+		`SELECT f.id, f.client_id, f.bucket_id, f.key, f.owner_entity_type, f.owner_entity_id, f.status, f.deleted_at,
+			COALESCE(f.scan_status, ''), f.encryption_key_hash IS NOT NULL, b.archived, c.name, b.name
+		 FROM files f
+		 JOIN clients c ON f.client_id = c.client_id
+		 JOIN buckets b ON f.bucket_id = b.id
+		 WHERE f.id = ? AND f.staged = 0`,
+		fileID,
+	).Scan(&source.FileID, &source.ClientID, &source.BucketID, &source.Key, &source.OwnerEntityType, &source.OwnerEntityID,
+		&status, &deletedAt, &scanStatus, &encrypted, &bucketArchived, &clientName, &bucketName)
+	if err != nil {
+		h.logRequest(ctx, "info", "File not found", zap.String("file_id", fileID), zap.Error(err))
+		return source, http.StatusNotFound, errs.NewNotFoundError("File not found")
+	}
+
+	switch {
+	case deletedAt.Valid || status == models.FileStatusDeleted:
+		h.logRequest(ctx, "info", "File has been deleted", zap.String("file_id", fileID))
+		return source, http.StatusGone, errs.NewValidationError("File has been deleted")
+	case status != models.FileStatusUploaded:
+		h.logRequest(ctx, "info", "File has not been uploaded", zap.String("file_id", fileID), zap.String("status", status))
+		return source, http.StatusNotFound, errs.NewNotFoundError("File not found")
+	case source.ClientID != clientID:
+		h.logRequest(ctx, "error", "Client does not own this file",
+			zap.String("file_id", fileID),
+			zap.String("requesting_client", clientID),
+			zap.String("owner_client", source.ClientID),
+		)
+		return source, http.StatusForbidden, errs.NewAuthorizationError("Access denied")
+	case scanStatus == models.ScanStatusPending:
+		h.logRequest(ctx, "info", "File is awaiting its scan", zap.String("file_id", fileID))
+		return source, http.StatusConflict, &errs.AppError{
+			Code:    http.StatusConflict,
+			Message: "File is awaiting its virus scan; try again shortly",
+		}
+	case encrypted:
+		h.logRequest(ctx, "error", "Cannot expand an encrypted file", zap.String("file_id", fileID))
+		return source, http.StatusBadRequest, errs.NewValidationError("Files encrypted with a customer key cannot be expanded")
+	case bucketArchived != 0:
+		h.logRequest(ctx, "error", "Bucket is archived", zap.Int("bucket_id", source.BucketID))
+		return source, http.StatusConflict, errs.NewValidationError("Cannot upload to an archived bucket")
+	}
+
+	source.Path, err = bucketFilePath(clientName, bucketName, source.Key)
+	if err != nil {
+		h.logRequest(ctx, "error", "Stored key escapes bucket directory", zap.String("file_id", fileID), zap.Error(err))
+		return source, http.StatusInternalServerError, errs.NewInternalServerError("Failed to read file")
+	}
+	return source, 0, nil
+}
+
+// openArchive reads the directory of a zip file and checks it against the expansion limits
+func (h *FileHandler) openArchive(ctx context.Context, f *os.File) (*zip.Reader, int, *errs.AppError) {
+	fileInfo, err := f.Stat()
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to stat file", zap.Error(err))
+		return nil, http.StatusInternalServerError, errs.NewInternalServerError("Failed to read file")
+	}
+	archive, err := zip.NewReader(f, fileInfo.Size())
+	if err != nil {
+		h.logRequest(ctx, "error", "File is not a zip archive", zap.Error(err))
+		return nil, http.StatusBadRequest, errs.NewValidationError("File is not a zip archive")
+	}
+
+	entries := archiveFileEntries(archive)
+	if len(entries) > h.config.ArchiveExpandMaxEntries {
+		h.logRequest(ctx, "error", "Archive has too many entries", zap.Int("entries", len(entries)))
+		return nil, http.StatusRequestEntityTooLarge, &errs.AppError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("Archive has %d files; at most %d can be expanded", len(entries), h.config.ArchiveExpandMaxEntries),
+		}
+	}
+	var declared uint64
+	for _, entry := range entries {
+		declared += entry.UncompressedSize64
+	}
+	if declared > uint64(h.config.ArchiveExpandMaxTotalBytes) {
+		h.logRequest(ctx, "error", "Archive exceeds total size limit", zap.Uint64("uncompressed_bytes", declared))
+		return nil, http.StatusRequestEntityTooLarge, &errs.AppError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("Archive expands to %d bytes, over the limit of %d bytes", declared, h.config.ArchiveExpandMaxTotalBytes),
+		}
+	}
+	return archive, 0, nil
+}
+
+// expandEntry stores one archive entry as a new file, the way a URL import stores fetched
+// bytes, and records the outcome in the summary. The entry's mimetype comes from its
+// extension, falling back to its sniffed content. Failures affect only this entry.
+func (e *archiveExpander) expandEntry(ctx context.Context, entry *zip.File) {
+	h := e.h
+	name := entry.Name
+	fail := func(key, reason string) {
+		e.summary.Errors = append(e.summary.Errors, models.ExpandEntryOutcome{Name: name, Key: key, Reason: reason})
+	}
+	skip := func(key, reason string) {
+		e.summary.Skipped = append(e.summary.Skipped, models.ExpandEntryOutcome{Name: name, Key: key, Reason: reason})
+	}
+
+	if !entry.Mode().IsRegular() {
+		skip("", "entry is not a regular file")
+		return
+	}
+	if err := validateArchiveEntryName(name); err != nil {
+		h.logRequest(ctx, "error", "Unsafe archive entry name", zap.String("file_id", e.source.FileID), zap.String("entry", name))
+		fail("", err.Error())
+		return
+	}
+	key := e.prefix + "/" + name
+
+	maxSize := h.config.ArchiveExpandMaxEntryBytes
+	if entry.UncompressedSize64 > uint64(maxSize) {
+		fail(key, fmt.Sprintf("entry exceeds the limit of %d bytes per file", maxSize))
+		return
+	}
+	if e.remaining < maxSize {
+		maxSize = e.remaining
+	}
+	if entry.UncompressedSize64 > uint64(maxSize) {
+		fail(key, fmt.Sprintf("archive exceeds the limit of %d bytes in total", h.config.ArchiveExpandMaxTotalBytes))
+		return
+	}
+	if entry.UncompressedSize64 == 0 {
+		skip(key, "entry is empty")
+		return
+	}
+	// The reader refuses entries that inflate past their declared size, so the declared
+	// sizes are enough to spot a zip bomb
+	maxRatio := uint64(h.config.ArchiveExpandMaxRatio)
+	if entry.CompressedSize64 == 0 || entry.UncompressedSize64/entry.CompressedSize64 > maxRatio {
+		h.logRequest(ctx, "error", "Archive entry compression ratio too high",
+			zap.String("entry", name),
+			zap.Uint64("compressed", entry.CompressedSize64),
+			zap.Uint64("uncompressed", entry.UncompressedSize64),
+		)
+		fail(key, fmt.Sprintf("entry expands to more than %d times its compressed size", maxRatio))
+		return
+	}
+
+	content, err := entry.Open()
+	if err != nil {
+		fail(key, "entry cannot be read: "+err.Error())
+		return
+	}
+	defer content.Close()
+	detected, body, err := sniffContentType(content)
+	if err != nil {
+		fail(key, "entry cannot be read: "+err.Error())
+		return
+	}
+	mimetype := normalizeMimetype(mime.TypeByExtension(path.Ext(name)))
+	if mimetype == "" || mimetype == "application/octet-stream" {
+		mimetype = detected
+	}
+
+	prepared, _, appErr := h.prepareUpload(ctx, e.source.ClientID, models.CreateSignedURLRequest{
+		BucketID:        e.source.BucketID,
+		Key:             key,
+		FileName:        path.Base(name),
+		FileSize:        int64(entry.UncompressedSize64),
+		Mimetype:        mimetype,
+		OwnerEntityType: e.source.OwnerEntityType,
+		OwnerEntityID:   e.source.OwnerEntityID,
+		OnConflict:      e.onConflict,
+	})
+	if appErr != nil {
+		fail(key, appErr.Message)
+		return
+	}
+	key = prepared.Key
+	if key == e.source.Key {
+		fail(key, "entry would replace the archive being expanded")
+		return
+	}
+	prepared.DetectedMimetype = detected
+	if !prepared.TokenData.AllowMimetypeMismatch && !mimetypesMatch(mimetype, detected) {
+		fail(key, fmt.Sprintf("content looks like %s, which does not match %s", detected, mimetype))
+		return
+	}
+
+	head := &headCapture{}
+	buf := h.buffers.get()
+	tmpPath, written, err := stageFile(filepath.Join(uploadsRoot, prepared.TokenData.FilePath), io.TeeReader(body, head), maxSize, buf)
+	h.buffers.put(buf)
+	if err == errFileTooLarge {
+		fail(key, fmt.Sprintf("entry exceeds the limit of %d bytes", maxSize))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to extract archive entry", zap.String("entry", name), zap.Error(err))
+		fail(key, "entry cannot be read: "+err.Error())
+		return
+	}
+	e.remaining -= written
+	prepared.TokenData.FileSize = written
+	prepared.Image = h.imageDimensions(ctx, prepared.TokenData.FileID, detected, head.buf)
+	prepared.Uploader = e.uploader
+
+	outcome, _, err := h.storeImportedFile(prepared, e.onConflict, tmpPath)
+	if err != nil {
+		if quotaErr, ok := asQuotaError(err); ok {
+			_, message := quotaErr.refusal("")
+			fail(key, message)
+			return
+		}
+		h.logRequest(ctx, "error", "Failed to store archive entry", zap.String("entry", name), zap.Error(err))
+		fail(key, "Failed to save file")
+		return
+	}
+	if outcome == keyExhausted {
+		fail(key, keyConflictMessage(outcome))
+		return
+	}
+	if outcome != keyClaimed {
+		skip(key, keyConflictMessage(outcome))
+		return
+	}
+
+	scanStatus, signature := h.scanAfterUpload(ctx, prepared.TokenData.FileID, written, nil)
+	if scanStatus == models.ScanStatusInfected {
+		fail(prepared.Key, fmt.Sprintf("entry failed the virus scan (%s) and has been quarantined", signature))
+		return
+	}
+	e.summary.Created = append(e.summary.Created, models.ExpandedEntry{
+		Name:       name,
+		Key:        prepared.Key,
+		FileID:     prepared.TokenData.FileID,
+		FileSize:   written,
+		Mimetype:   mimetype,
+		ScanStatus: scanStatus,
+	})
+}
+
+// startArchiveExpansion records a background expansion and starts running it
+func (h *FileHandler) startArchiveExpansion(source archiveSource, prefix, onConflict string, entries int) (models.ArchiveExpansion, error) {
+	job := models.ArchiveExpansion{
+		ID:           uuid.New().String(),
+		Status:       models.ExpansionStatusRunning,
+		FileID:       source.FileID,
+		ClientID:     source.ClientID,
+		BucketID:     source.BucketID,
+		Prefix:       prefix,
+		OnConflict:   onConflict,
+		EntriesTotal: entries,
+		Summary:      "{}",
+		StartedAt:    time.Now().UTC(),
+	}
+	if _, err := h.db.Exec(
+		`INSERT INTO archive_expansions (id, status, file_id, client_id, bucket_id, prefix, on_conflict, entries_total, started_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		job.ID, job.Status, job.FileID, job.ClientID, job.BucketID, job.Prefix, job.OnConflict, job.EntriesTotal, job.StartedAt,
+	); err != nil {
+		return job, err
+	}
+
+	go h.jobs.runOnce(archiveExpansionLease(job.ID), func(ctx context.Context) {
+		h.runArchiveExpansion(ctx, job.ID)
+	})
+	return job, nil
+}
+
+// GetArchiveExpansion handles GET /files/expansions/{id} - report a background expansion's
+// progress and, once it has finished, its summary. Only the client that started it sees it.
+func (h *FileHandler) GetArchiveExpansion(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+
+	var job models.ArchiveExpansion
+	err := h.db.Get(&job, "SELECT "+archiveExpansionColumns+" FROM archive_expansions WHERE id = ?", jobID)
+	if err == nil && job.ClientID != auth.Client {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "error", "Archive expansion not found", zap.String("job_id", jobID))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Archive expansion not found"))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query archive expansion", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to get archive expansion"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(expansionResponse(job))
+}
+
+// StartArchiveExpansionResumer resumes running expansions now and then periodically, the
+// same way StartMimetypeBackfillResumer does for backfills
+func (h *FileHandler) StartArchiveExpansionResumer(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			h.resumeArchiveExpansions()
+			<-ticker.C
+		}
+	}()
+}
+
+// resumeArchiveExpansions runs every expansion marked running that no instance is running
+func (h *FileHandler) resumeArchiveExpansions() {
+	var jobIDs []string
+	if err := h.db.Select(&jobIDs, "SELECT id FROM archive_expansions WHERE status = ?", models.ExpansionStatusRunning); err != nil {
+		logger.Error("Failed to query running archive expansions", zap.Error(err))
+		return
+	}
+	for _, jobID := range jobIDs {
+		jobID := jobID
+		go h.jobs.runOnce(archiveExpansionLease(jobID), func(ctx context.Context) {
+			logger.Info("Resuming archive expansion", zap.String("job_id", jobID))
+			h.runArchiveExpansion(ctx, jobID)
+		})
+	}
+}
+
+// runArchiveExpansion expands the job's entries in archive order, saving progress and the
+// summary after each one. Once ctx is cancelled the run stops, leaving the job running for
+// the next lease holder, which picks up after the last saved entry. The job fails if the
+// archive is deleted, replaced by something that is no zip, or outgrows the limits.
+func (h *FileHandler) runArchiveExpansion(ctx context.Context, jobID string) {
+	var job models.ArchiveExpansion
+	if err := h.db.Get(&job, "SELECT "+archiveExpansionColumns+" FROM archive_expansions WHERE id = ?", jobID); err != nil {
+		logger.Error("Failed to load archive expansion", zap.String("job_id", jobID), zap.Error(err))
+		return
+	}
+	// Another instance may have finished the job since it was listed
+	if job.Status != models.ExpansionStatusRunning {
+		return
+	}
+
+	source, _, appErr := h.loadArchiveSource(ctx, job.FileID, job.ClientID)
+	if appErr != nil {
+		h.finishArchiveExpansion(&job, nil, errors.New("archive can no longer be expanded: "+appErr.Message))
+		return
+	}
+	readCtx, release, ok := h.locks.acquireRead(ctx, source.Path)
+	if !ok {
+		h.finishArchiveExpansion(&job, nil, errors.New("archive was deleted"))
+		return
+	}
+	defer release()
+	f, err := os.Open(source.Path)
+	if err != nil {
+		h.finishArchiveExpansion(&job, nil, err)
+		return
+	}
+	defer f.Close()
+	archive, _, appErr := h.openArchive(ctx, f)
+	if appErr != nil {
+		h.finishArchiveExpansion(&job, nil, errors.New(appErr.Message))
+		return
+	}
+
+	expander := &archiveExpander{
+		h:          h,
+		source:     source,
+		prefix:     job.Prefix,
+		onConflict: job.OnConflict,
+		remaining:  h.config.ArchiveExpandMaxTotalBytes,
+		summary:    expansionSummary(job),
+	}
+	for _, created := range expander.summary.Created {
+		expander.remaining -= created.FileSize
+	}
+
+	entries := archiveFileEntries(archive)
+	job.EntriesTotal = len(entries)
+	for job.EntriesDone < len(entries) {
+		if readCtx.Err() != nil {
+			logger.Info("Archive expansion stopped", zap.String("job_id", jobID), zap.Int("entries_done", job.EntriesDone))
+			return
+		}
+		expander.expandEntry(readCtx, entries[job.EntriesDone])
+		job.EntriesDone++
+
+		summary, _ := json.Marshal(expander.summary)
+		job.Summary = string(summary)
+		if _, err := h.db.Exec(
+			"UPDATE archive_expansions SET entries_total = ?, entries_done = ?, summary = ? WHERE id = ?",
+			job.EntriesTotal, job.EntriesDone, job.Summary, job.ID,
+		); err != nil {
+			h.finishArchiveExpansion(&job, expander, err)
+			return
+		}
+	}
+	h.finishArchiveExpansion(&job, expander, nil)
+}
+
+// finishArchiveExpansion records the end of a job, failed when err is set
+func (h *FileHandler) finishArchiveExpansion(job *models.ArchiveExpansion, expander *archiveExpander, err error) {
+	job.Status = models.ExpansionStatusCompleted
+	var errMessage sql.NullString
+	if err != nil {
+		job.Status = models.ExpansionStatusFailed
+		errMessage = sql.NullString{String: err.Error(), Valid: true}
+		logger.Error("Archive expansion failed", zap.String("job_id", job.ID), zap.Error(err))
+	}
+	if expander != nil {
+		summary, _ := json.Marshal(expander.summary)
+		job.Summary = string(summary)
+	}
+
+	if _, err := h.db.Exec(
+		`UPDATE archive_expansions SET status = ?, entries_total = ?, entries_done = ?, summary = ?, error = ?, finished_at = ?
+		WHERE id = ?`,
+		job.Status, job.EntriesTotal, job.EntriesDone, job.Summary, errMessage, time.Now().UTC(), job.ID,
+	); err != nil {
+		logger.Error("Failed to record archive expansion result", zap.String("job_id", job.ID), zap.Error(err))
+		return
+	}
+
+	summary := expansionSummary(*job)
+	logger.Info("Archive expansion finished",
+		zap.String("job_id", job.ID),
+		zap.String("status", job.Status),
+		zap.Int("created", len(summary.Created)),
+		zap.Int("skipped", len(summary.Skipped)),
+		zap.Int("errors", len(summary.Errors)),
+	)
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"file-upload-service/models"
+)
+
+// zipEntry is a file stored in a test archive; a name ending in '/' is a directory
+type zipEntry struct {
+	name    string
+	content string
+}
+
+// zipBytes builds a zip archive of entries
+func zipBytes(t *testing.T, entries ...zipEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := archive.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// expandArchive expands a stored archive under prefix through POST /files/{id}/expand
+func (e *testEnv) expandArchive(fileID, prefix string) *httptest.ResponseRecorder {
+	return e.serve(e.files.ExpandArchive, newRequest(http.MethodPost, "/files/"+fileID+"/expand",
+		models.ExpandArchiveRequest{Prefix: prefix}), map[string]string{"id": fileID})
+}
+
+// expandedSummary decodes the outcome of an expansion done in the request
+func expandedSummary(t *testing.T, w *httptest.ResponseRecorder) models.ExpandArchiveSummary {
+	t.Helper()
+	expectStatus(t, w, http.StatusOK)
+	var summary models.ExpandArchiveSummary
+	decode(t, w, &summary)
+	return summary
+}
+
+// createdKeys lists the keys of the entries an expansion stored, sorted
+func createdKeys(summary models.ExpandArchiveSummary) []string {
+	var keys []string
+	for _, entry := range summary.Created {
+		keys = append(keys, entry.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestExpandArchiveStoresEachEntryUnderThePrefix(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	content := map[string]string{
+		"a.txt":                numberLines(20),
+		"docs/guide/readme.md": "# readme\n" + numberLines(10),
+	}
+	archiveID := env.putFile(bucketID, "uploads/bundle.zip", zipBytes(t,
+		zipEntry{"a.txt", content["a.txt"]},
+		zipEntry{"docs/", ""},
+		zipEntry{"docs/guide/", ""},
+		zipEntry{"docs/guide/readme.md", content["docs/guide/readme.md"]},
+	))
+
+	summary := expandedSummary(t, env.expandArchive(archiveID, "unz/"))
+	if keys := createdKeys(summary); strings.Join(keys, ",") != "unz/a.txt,unz/docs/guide/readme.md" {
+		t.Fatalf("created %v, want each file entry under unz/ with its directories as key segments", keys)
+	}
+	if len(summary.Skipped) != 0 || len(summary.Errors) != 0 {
+		t.Fatalf("skipped %+v and failed %+v, want neither", summary.Skipped, summary.Errors)
+	}
+
+	for _, entry := range summary.Created {
+		if stored, err := os.ReadFile(env.diskPath(bucketID, entry.Key)); err != nil || string(stored) != content[entry.Name] {
+			t.Fatalf("%s stored differently from its entry (%v)", entry.Key, err)
+		}
+		w := serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, env.downloadTarget(entry.FileID), nil), nil)
+		expectStatus(t, w, http.StatusOK)
+		if w.Body.String() != content[entry.Name] {
+			t.Fatalf("%s downloaded differently from its entry", entry.Key)
+		}
+	}
+	if keys := env.liveKeys(bucketID, "unz/docs/guide"); len(keys) != 1 || keys[0] != "unz/docs/guide/readme.md" {
+		t.Fatalf("listing unz/docs/guide = %v", keys)
+	}
+
+	// The archive itself is left as it was
+	w := serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, env.downloadTarget(archiveID), nil), nil)
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestExpandArchiveRefusesEntriesOutsideThePrefix(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	unsafe := []string{"../evil.txt", "docs/../../evil.txt", "/evil.txt", `..\evil.txt`, "C:/evil.txt", "./evil.txt"}
+	entries := []zipEntry{{"safe.txt", numberLines(5)}}
+	for _, name := range unsafe {
+		entries = append(entries, zipEntry{name, numberLines(5)})
+	}
+	archiveID := env.putFile(bucketID, "uploads/slip.zip", zipBytes(t, entries...))
+
+	summary := expandedSummary(t, env.expandArchive(archiveID, "unz"))
+	if keys := createdKeys(summary); len(keys) != 1 || keys[0] != "unz/safe.txt" {
+		t.Fatalf("created %v, want only unz/safe.txt", keys)
+	}
+	if len(summary.Errors) != len(unsafe) {
+		t.Fatalf("errors %+v, want one per unsafe entry", summary.Errors)
+	}
+	for _, outcome := range summary.Errors {
+		if outcome.Key != "" || outcome.Reason != errArchiveEntryPath.Error() {
+			t.Fatalf("entry %q: %+v, want it refused before a key is built", outcome.Name, outcome)
+		}
+	}
+
+	// Nothing was written next to the prefix, the bucket or the uploads root
+	bucketDir := filepath.Dir(env.diskPath(bucketID, "x"))
+	for _, path := range []string{
+		filepath.Join(bucketDir, "evil.txt"),
+		filepath.Join(filepath.Dir(bucketDir), "evil.txt"),
+		filepath.Join(uploadsRoot, "evil.txt"),
+		filepath.Join(filepath.Dir(uploadsRoot), "evil.txt"),
+	} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s exists after expanding an archive with traversing entries", path)
+		}
+	}
+	var count int
+	if err := env.db.Get(&count, "SELECT COUNT(*) FROM files WHERE key LIKE '%evil%'"); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("%d file rows created for traversing entries", count)
+	}
+}
+
+func TestExpandArchiveLimits(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	archiveID := env.putFile(bucketID, "uploads/three.zip", zipBytes(t,
+		zipEntry{"one.txt", numberLines(10)},
+		zipEntry{"two.txt", numberLines(20)},
+		zipEntry{"big.txt", numberLines(200)},
+	))
+	total := int64(len(numberLines(10)) + len(numberLines(20)) + len(numberLines(200)))
+
+	// Directory entries do not count towards the entry limit
+	env.cfg.ArchiveExpandMaxEntries = 2
+	expectStatus(t, env.expandArchive(archiveID, "unz"), http.StatusRequestEntityTooLarge)
+	env.cfg.ArchiveExpandMaxEntries = 3
+
+	env.cfg.ArchiveExpandMaxTotalBytes = total - 1
+	expectStatus(t, env.expandArchive(archiveID, "unz"), http.StatusRequestEntityTooLarge)
+	env.cfg.ArchiveExpandMaxTotalBytes = total
+	if n := env.rowsFor("files", "bucket_id", strconv.Itoa(bucketID)); n != 1 {
+		t.Fatalf("%d file rows after refused expansions, want only the archive", n)
+	}
+
+	// An entry over the per-file limit fails on its own; the others still expand
+	env.cfg.ArchiveExpandMaxEntryBytes = int64(len(numberLines(20)))
+	summary := expandedSummary(t, env.expandArchive(archiveID, "unz"))
+	if keys := createdKeys(summary); strings.Join(keys, ",") != "unz/one.txt,unz/two.txt" {
+		t.Fatalf("created %v, want the entries within the per-file limit", keys)
+	}
+	if len(summary.Errors) != 1 || summary.Errors[0].Name != "big.txt" {
+		t.Fatalf("errors %+v, want big.txt over the per-file limit", summary.Errors)
+	}
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// recordAuditEvent appends an event to the audit log. Pass the transaction making the
+// audited change so the event is only recorded if the change commits.
+func recordAuditEvent(exec sqlx.Execer, event models.AuditEvent, now time.Time) error {
+	detail := event.Detail
+	if detail == nil {
+		detail = map[string]interface{}{}
+	}
+	encoded, err := json.Marshal(detail)
+	if err != nil {
+		return err
+	}
+
+	_, err = exec.Exec(
+		"INSERT INTO audit_events (action, actor, client_id, file_id, detail, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		event.Action, event.Actor,
+		sql.NullString{String: event.ClientID, Valid: event.ClientID != ""},
+		sql.NullString{String: event.FileID, Valid: event.FileID != ""},
+		string(encoded), now,
+	)
+	return err
+}
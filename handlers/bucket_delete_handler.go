@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/umakantv/go-utils/errs"
+	"go.uber.org/zap"
+)
+
+// DeleteBucket handles DELETE /buckets/{id} - delete an empty bucket, or with ?force=true
+// a bucket and every file in it. The bucket row is removed, so its name is free again and
+// every route naming the bucket answers 404; its directory, versions, quarantined bytes
+// and snapshots go with it.
+func (h *BucketHandler) DeleteBucket(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	clientID, ok := h.getClientID(ctx)
+	if !ok {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+
+	idStr := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid bucket ID", zap.String("id", idStr))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid bucket ID"))
+		return
+	}
+	force := r.URL.Query().Get("force") == "true"
+
+	h.logRequest(ctx, "info", "Deleting bucket", zap.Int("bucket_id", id), zap.String("client_id", clientID), zap.Bool("force", force))
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to begin transaction", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to delete bucket"))
+		return
+	}
+	defer tx.Rollback()
+
+	var bucketName, clientName string
+	var archivedInt int
+	err = tx.QueryRow(
+		"SELECT b.name, b.archived, c.name FROM buckets b JOIN clients c ON b.client_id = c.client_id WHERE b.id = ? AND b.client_id = ?",
+		id, clientID,
+	).Scan(&bucketName, &archivedInt, &clientName)
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "info", "Bucket not found", zap.Int("bucket_id", id))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Bucket not found"))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query bucket", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to delete bucket"))
+		return
+	}
+	if archivedInt != 0 {
+		h.logRequest(ctx, "info", "Cannot delete an archived bucket", zap.Int("bucket_id", id))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Cannot delete an archived bucket"))
+		return
+	}
+
+	// Pending files were never uploaded and do not keep a bucket from being deleted
+	var fileIDs, quarantinedIDs []string
+	if err := tx.Select(&fileIDs,
+		"SELECT id FROM files WHERE bucket_id = ? AND status NOT IN (?, ?)",
+		id, models.FileStatusDeleted, models.FileStatusPending,
+	); err != nil {
+		h.logRequest(ctx, "error", "Failed to query bucket files", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to delete bucket"))
+		return
+	}
+	if len(fileIDs) > 0 && !force {
+		h.logRequest(ctx, "info", "Bucket is not empty", zap.Int("bucket_id", id), zap.Int("files", len(fileIDs)))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError(
+			fmt.Sprintf("Bucket still holds %d files; delete them first or pass force=true", len(fileIDs))))
+		return
+	}
+
+	var versions []struct {
+		ID           string `db:"id"`
+		DeleteMarker bool   `db:"delete_marker"`
+	}
+	err = tx.Select(&quarantinedIDs, "SELECT id FROM files WHERE bucket_id = ? AND status = ?", id, models.FileStatusQuarantined)
+	if err == nil {
+		err = tx.Select(&versions, "SELECT id, delete_marker FROM file_versions WHERE bucket_id = ?", id)
+	}
+	if err == nil {
+		err = removeBucketRows(tx, id, time.Now().UTC())
+	}
+	if err == nil {
+		err = recordAuditEvent(tx, models.AuditEvent{
+			Action:   models.AuditActionBucketDeleted,
+			Actor:    clientID,
+			ClientID: clientID,
+			Detail: map[string]interface{}{
+				"bucket_id":        id,
+				"name":             bucketName,
+				"files_deleted":    len(fileIDs),
+				"versions_deleted": len(versions),
+			},
+		}, time.Now().UTC())
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to delete bucket", zap.Int("bucket_id", id), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to delete bucket"))
+		return
+	}
+
+	// The rows are gone, so nothing serves these bytes any more. Bytes that cannot be
+	// removed are only logged: the bucket is deleted either way.
+	if bucketDir, err := bucketDirPath(clientName, bucketName); err != nil {
+		h.logRequest(ctx, "error", "Invalid bucket directory", zap.Int("bucket_id", id), zap.Error(err))
+	} else if err := os.RemoveAll(bucketDir); err != nil {
+		h.logRequest(ctx, "error", "Failed to remove bucket directory", zap.Int("bucket_id", id), zap.Error(err))
+	}
+	for _, fileID := range quarantinedIDs {
+		if err := os.Remove(quarantinePath(fileID)); err != nil && !os.IsNotExist(err) {
+			h.logRequest(ctx, "error", "Failed to remove quarantined bytes", zap.String("file_id", fileID), zap.Error(err))
+		}
+	}
+	for _, version := range versions {
+		if version.DeleteMarker {
+			continue
+		}
+		if err := os.Remove(versionBlobPath(version.ID)); err != nil && !os.IsNotExist(err) {
+			h.logRequest(ctx, "error", "Failed to remove version bytes", zap.String("version_id", version.ID), zap.Error(err))
+		}
+	}
+
+	h.logRequest(ctx, "info", "Bucket deleted successfully", zap.Int("bucket_id", id), zap.Int("files_deleted", len(fileIDs)))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.DeleteBucketResponse{
+		ID:              id,
+		Name:            bucketName,
+		FilesDeleted:    len(fileIDs),
+		VersionsDeleted: len(versions),
+	})
+}
+
+// removeBucketRows deletes a bucket's row and marks every file in it deleted, which gives
+// back their storage object references. Rows that only mean something with the bucket go
+// too; its snapshots are expired for the snapshot sweeper to remove with their bytes.
+func removeBucketRows(tx *sqlx.Tx, bucketID int, now time.Time) error {
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"DELETE FROM file_thumbnails WHERE file_id IN (SELECT id FROM files WHERE bucket_id = ?)", []interface{}{bucketID}},
+		{"UPDATE files SET status = ?, deleted_at = ?, updated_at = ? WHERE bucket_id = ? AND status <> ?",
+			[]interface{}{models.FileStatusDeleted, now, now, bucketID, models.FileStatusDeleted}},
+		{"DELETE FROM file_versions WHERE bucket_id = ?", []interface{}{bucketID}},
+		{"DELETE FROM upload_reservations WHERE bucket_id = ?", []interface{}{bucketID}},
+		{"UPDATE bucket_snapshots SET expires_at = ? WHERE bucket_id = ?", []interface{}{now, bucketID}},
+		{"DELETE FROM buckets WHERE id = ?", []interface{}{bucketID}},
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"file-upload-service/api"
+	"file-upload-service/models"
+)
+
+// deleteBucket deletes a bucket, with ?force=true when force is set
+func (e *testEnv) deleteBucket(bucketID int, force bool) *httptest.ResponseRecorder {
+	buckets := NewBucketHandler(e.db, api.NewPager(e.cfg.PaginationSecret))
+	target := "/buckets/" + strconv.Itoa(bucketID)
+	if force {
+		target += "?force=true"
+	}
+	return e.serve(buckets.DeleteBucket, newRequest(http.MethodDelete, target, nil), map[string]string{"id": strconv.Itoa(bucketID)})
+}
+
+// undeletedFiles counts the files of a bucket not marked deleted
+func (e *testEnv) undeletedFiles(bucketID int) int {
+	e.t.Helper()
+	var n int
+	if err := e.db.Get(&n, "SELECT COUNT(*) FROM files WHERE bucket_id = ? AND status <> ?", bucketID, models.FileStatusDeleted); err != nil {
+		e.t.Fatal(err)
+	}
+	return n
+}
+
+// expectNotServed checks the request named name was refused with status
+func expectNotServed(t *testing.T, name string, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("%s: %d %s, want %d", name, w.Code, w.Body.String(), status)
+	}
+}
+
+func TestDeleteBucketRefusesFilesWithoutForce(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.putFile(bucketID, "docs/a.txt", []byte("a"))
+	env.putFile(bucketID, "docs/b.txt", []byte("b"))
+
+	expectRefused(t, env.deleteBucket(bucketID, false), http.StatusConflict, "Bucket still holds 2 files")
+	if n := env.undeletedFiles(bucketID); n != 2 {
+		t.Fatalf("%d files left after a refused delete, want 2", n)
+	}
+
+	w := env.deleteBucket(bucketID, true)
+	expectStatus(t, w, http.StatusOK)
+	var deleted models.DeleteBucketResponse
+	decode(t, w, &deleted)
+	if deleted.ID != bucketID || deleted.Name != "photos" || deleted.FilesDeleted != 2 {
+		t.Fatalf("response = %+v, want 2 files deleted from photos", deleted)
+	}
+}
+
+func TestDeleteBucketRemovesFilesAndInvalidatesURLs(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.db.MustExec(`UPDATE buckets SET public_paths = '["pub/*"]' WHERE id = ?`, bucketID)
+	fileID := env.putFile(bucketID, "pub/a.txt", []byte("public a"))
+	bucketDir := filepath.Dir(filepath.Dir(env.diskPath(bucketID, "pub/a.txt")))
+
+	upload := env.signedUpload(signedURLRequest(bucketID, "docs/b.txt", 64))
+	download := env.downloadTarget(fileID)
+	presigned := env.presign(fileID)
+	env.useShortURLs()
+	shortUpload := env.signedUpload(signedURLRequest(bucketID, "docs/c.txt", 64))
+	shortDownload := env.downloadTarget(fileID)
+
+	expectStatus(t, env.deleteBucket(bucketID, true), http.StatusOK)
+
+	if n := env.undeletedFiles(bucketID); n != 0 {
+		t.Fatalf("%d files of the deleted bucket are not marked deleted", n)
+	}
+	if n := env.rowsFor("buckets", "id", strconv.Itoa(bucketID)); n != 0 {
+		t.Fatal("the bucket row was kept")
+	}
+	if _, err := os.Stat(bucketDir); !os.IsNotExist(err) {
+		t.Fatalf("bucket directory still exists: %v", err)
+	}
+
+	// Tokens issued before the delete, long and short, no longer upload or download
+	expectNotServed(t, "upload URL", serveAnonymous(env.files.UploadFile, uploadRequest(upload.SignedURL, []byte("late")), nil), http.StatusConflict)
+	expectNotServed(t, "download URL", serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, download, nil), nil), http.StatusConflict)
+	expectNotServed(t, "short upload URL", serveAnonymous(env.files.ShortUpload, uploadRequest(shortUpload.SignedURL, []byte("late")),
+		map[string]string{"token": env.shortTokenOf(shortUpload.SignedURL)}), http.StatusConflict)
+	expectNotServed(t, "short download URL", serveAnonymous(env.files.ShortDownload, newRequest(http.MethodGet, shortDownload, nil),
+		map[string]string{"token": env.shortTokenOf("http://localhost:8080" + shortDownload)}), http.StatusConflict)
+	expectNotServed(t, "public URL", env.servePublic("photos", "pub/a.txt"), http.StatusNotFound)
+	expectNotServed(t, "presigned URL", env.servePresigned(presigned), http.StatusNotFound)
+
+	// Nothing new can be issued for the bucket or its files
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, "docs/d.txt", 64)), nil)
+	expectRefused(t, w, http.StatusNotFound, "Bucket not found")
+	w = env.serve(env.files.GenerateDownloadSignedURL, newRequest(http.MethodPost, "/files/download-url",
+		models.GenerateDownloadSignedURLRequest{FileID: fileID}), nil)
+	expectStatus(t, w, http.StatusNotFound)
+	w = env.serve(env.files.GeneratePresignedURL, newRequest(http.MethodPost, "/files/presigned-url",
+		models.PresignedURLRequest{FileID: fileID}), nil)
+	expectStatus(t, w, http.StatusNotFound)
+}
+
+func TestBucketRecreatedUnderTheSameNameStartsEmpty(t *testing.T) {
+	env := newTestEnv(t)
+	oldID := env.createBucket("photos")
+	env.db.MustExec(`UPDATE buckets SET public_paths = '["pub/*"]' WHERE id = ?`, oldID)
+	oldFile := env.putFile(oldID, "pub/a.txt", []byte("old bucket"))
+	upload := env.signedUpload(signedURLRequest(oldID, "pub/b.txt", 64))
+	download := env.downloadTarget(oldFile)
+	expectStatus(t, env.deleteBucket(oldID, true), http.StatusOK)
+
+	newID := env.createBucket("photos")
+	if newID == oldID {
+		t.Fatal("the recreated bucket reused the deleted bucket's id")
+	}
+	env.db.MustExec(`UPDATE buckets SET public_paths = '["pub/*"]' WHERE id = ?`, newID)
+
+	if keys := env.liveKeys(newID, "pub"); len(keys) != 0 {
+		t.Fatalf("the recreated bucket lists %v of the deleted one", keys)
+	}
+	expectNotServed(t, "old public key", env.servePublic("photos", "pub/a.txt"), http.StatusNotFound)
+	expectNotServed(t, "old download URL", serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, download, nil), nil), http.StatusConflict)
+
+	// An upload URL issued for the deleted bucket does not write into the new one
+	expectNotServed(t, "old upload URL", serveAnonymous(env.files.UploadFile, uploadRequest(upload.SignedURL, []byte("late")), nil), http.StatusConflict)
+	if _, err := os.Stat(env.diskPath(newID, "pub/b.txt")); !os.IsNotExist(err) {
+		t.Fatalf("an upload URL of the deleted bucket wrote into the new one: %v", err)
+	}
+	if n := env.undeletedFiles(newID); n != 0 {
+		t.Fatalf("the recreated bucket has %d files", n)
+	}
+}
@@ -4,19 +4,23 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"file-upload-service/api"
+	"file-upload-service/logger"
 	"file-upload-service/models"
 
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
 	"github.com/umakantv/go-utils/errs"
 	"github.com/umakantv/go-utils/httpserver"
-	logger "github.com/umakantv/go-utils/logger"
 	"go.uber.org/zap"
 )
 
@@ -25,16 +29,73 @@ var bucketNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]$|
 
 // BucketHandler handles bucket-related operations
 type BucketHandler struct {
-	db *sqlx.DB
+	db    *sqlx.DB
+	pager *api.Pager
 }
 
 // NewBucketHandler creates a new bucket handler
-func NewBucketHandler(db *sqlx.DB) *BucketHandler {
+func NewBucketHandler(db *sqlx.DB, pager *api.Pager) *BucketHandler {
 	return &BucketHandler{
-		db: db,
+		db:    db,
+		pager: pager,
 	}
 }
 
+// Paging of GET /buckets
+const (
+	defaultBucketPageSize = 100
+	maxBucketPageSize     = 1000
+)
+
+// bucketSortColumns maps the sorts GET /buckets accepts to the column they order by
+var bucketSortColumns = map[string]string{
+	"created_at": "created_at",
+	"name":       "name",
+}
+
+// bucketColumns lists the columns of a bucket in the order scanBucket reads them
+const bucketColumns = "id, name, client_id, cors_policy, public_paths, archived, lowercase_keys, allow_mimetype_mismatch, strict_file_size, allowed_mimetypes, versioning, dedupe, max_key_depth, max_top_level_folders, thumbnail_widths, image_sizes, convert_images, compression, compression_min_bytes, hotlink_protection, public_rate_limit, max_total_bytes, max_file_count, response_headers, COALESCE(archive_mode, ''), created_at, updated_at"
+
+// rowScanner is a single row or the current row of a result set
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanBucket reads a bucket selected with bucketColumns; extra receives any columns
+// selected after them
+func scanBucket(row rowScanner, extra ...interface{}) (models.Bucket, error) {
+	var b models.Bucket
+	var corsPolicyStr string
+	var publicPathsStr string
+	var archivedInt int
+	var lowercaseKeysInt int
+	var allowMismatchInt int
+	var allowedMimetypesStr string
+	var thumbnailWidthsStr string
+	var imageSizesStr string
+	var hotlinkProtectionStr string
+	var responseHeadersStr string
+	var versioningInt int
+	var dedupeInt int
+	dest := []interface{}{&b.ID, &b.Name, &b.ClientID, &corsPolicyStr, &publicPathsStr, &archivedInt, &lowercaseKeysInt, &allowMismatchInt, &b.StrictFileSize, &allowedMimetypesStr, &versioningInt, &dedupeInt, &b.MaxKeyDepth, &b.MaxTopLevelFolders, &thumbnailWidthsStr, &imageSizesStr, &b.ConvertImages, &b.Compression, &b.CompressionMinBytes, &hotlinkProtectionStr, &b.PublicRateLimit, &b.MaxTotalBytes, &b.MaxFileCount, &responseHeadersStr, &b.ArchiveMode, &b.CreatedAt, &b.UpdatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return b, err
+	}
+	b.CORSPolicy = json.RawMessage(corsPolicyStr)
+	b.PublicPaths = json.RawMessage(publicPathsStr)
+	b.Archived = archivedInt != 0
+	b.LowercaseKeys = lowercaseKeysInt != 0
+	b.AllowMimetypeMismatch = allowMismatchInt != 0
+	b.AllowedMimetypes = json.RawMessage(allowedMimetypesStr)
+	b.ThumbnailWidths = json.RawMessage(thumbnailWidthsStr)
+	b.ImageSizes = json.RawMessage(imageSizesStr)
+	b.HotlinkProtection = json.RawMessage(hotlinkProtectionStr)
+	b.ResponseHeaders = json.RawMessage(responseHeadersStr)
+	b.Versioning = versioningInt != 0
+	b.Dedupe = dedupeInt != 0
+	return b, nil
+}
+
 // logRequest logs the request with the specified format
 func (h *BucketHandler) logRequest(ctx context.Context, level string, message string, fields ...zap.Field) {
 	routeName := httpserver.GetRouteName(ctx)
@@ -72,16 +133,25 @@ func (h *BucketHandler) getClientID(ctx context.Context) (string, bool) {
 	return auth.Client, true
 }
 
-// validateCORSPolicy validates that the cors_policy field is a valid JSON array
-// Returns the raw JSON to store (defaults to "[]" if nil/empty)
+// validateCORSPolicy validates that the cors_policy field is a JSON array of CORS rules
+// that can each match something (see validateCORSRule). A policy that does not parse
+// fails with errCORSPolicy; one whose rules are wrong fails with every problem found,
+// each naming its rule and field.
+// Returns the normalised JSON to store (defaults to "[]" if nil/empty)
 func validateCORSPolicy(raw json.RawMessage) (json.RawMessage, error) {
-	if len(raw) == 0 {
+	if len(raw) == 0 || string(raw) == "null" {
 		return json.RawMessage("[]"), nil
 	}
-	// Ensure it is a valid JSON array of CORS rules
 	var rules []models.CORSRule
 	if err := json.Unmarshal(raw, &rules); err != nil {
-		return nil, err
+		return nil, errCORSPolicy
+	}
+	var problems []string
+	for i := range rules {
+		problems = append(problems, validateCORSRule(i, &rules[i])...)
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
 	}
 	// Re-marshal to ensure clean storage
 	clean, err := json.Marshal(rules)
@@ -91,7 +161,8 @@ func validateCORSPolicy(raw json.RawMessage) (json.RawMessage, error) {
 	return clean, nil
 }
 
-// validatePublicPaths validates that the public_paths field is a valid JSON array of strings
+// validatePublicPaths validates that the public_paths field is a valid JSON array of
+// patterns, where a pattern prefixed with "!" excludes the keys it matches
 // Returns the raw JSON to store (defaults to "[]" if nil/empty)
 func validatePublicPaths(raw json.RawMessage) (json.RawMessage, error) {
 	if len(raw) == 0 {
@@ -100,7 +171,12 @@ func validatePublicPaths(raw json.RawMessage) (json.RawMessage, error) {
 	// Ensure it is a valid JSON array of strings
 	var paths []string
 	if err := json.Unmarshal(raw, &paths); err != nil {
-		return nil, err
+		return nil, errPublicPaths
+	}
+	for i, path := range paths {
+		if strings.TrimPrefix(path, "!") == "" {
+			return nil, fmt.Errorf("public_paths[%d] must be a pattern or \"!\" followed by one", i)
+		}
 	}
 	// Re-marshal to ensure clean storage
 	clean, err := json.Marshal(paths)
@@ -110,43 +186,58 @@ func validatePublicPaths(raw json.RawMessage) (json.RawMessage, error) {
 	return clean, nil
 }
 
-// matchesPublicPath checks if a given file key matches any of the public path patterns
-// Supports wildcards: * matches any sequence of characters except /
-// Example patterns: "images/*", "*.jpg", "public/*"
-func matchesPublicPath(key string, patterns []string) bool {
-	for _, pattern := range patterns {
-		if matchPattern(key, pattern) {
-			return true
+// validateAllowedMimetypes validates that the allowed_mimetypes field is a JSON array of
+// "type/subtype" entries, where the subtype may be "*" (e.g. "image/*")
+// Returns the normalised JSON to store (defaults to "[]" if nil/empty)
+func validateAllowedMimetypes(raw json.RawMessage) (json.RawMessage, error) {
+	if len(raw) == 0 {
+		return json.RawMessage("[]"), nil
+	}
+	var mimetypes []string
+	if err := json.Unmarshal(raw, &mimetypes); err != nil {
+		return nil, err
+	}
+	for i, mimetype := range mimetypes {
+		mimetype = strings.ToLower(strings.TrimSpace(mimetype))
+		parts := strings.Split(mimetype, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" || (parts[0] == "*" && parts[1] != "*") {
+			return nil, fmt.Errorf("invalid mimetype %q", mimetypes[i])
+		}
+		// A wildcard stands for a whole part only; "image/png*" would never match anything
+		for _, part := range parts {
+			if part != "*" && strings.Contains(part, "*") {
+				return nil, fmt.Errorf("invalid mimetype %q", mimetypes[i])
+			}
 		}
+		mimetypes[i] = mimetype
 	}
-	return false
+	clean, err := json.Marshal(mimetypes)
+	if err != nil {
+		return nil, err
+	}
+	return clean, nil
 }
 
-// matchPattern matches a key against a pattern with * wildcards
-func matchPattern(key, pattern string) bool {
-	// Simple wildcard matching: * matches any sequence of characters
-	if pattern == "*" || pattern == "*/*" || pattern == "**" {
+// mimetypeAllowed checks a declared mimetype against a bucket's allowed list.
+// An empty list allows everything; "type/*" matches any subtype and "*/*" matches anything.
+func mimetypeAllowed(mimetype string, allowed []string) bool {
+	if len(allowed) == 0 {
 		return true
 	}
-	
-	// Convert pattern to regex
-	// Escape special regex characters except *
-	regexPattern := "^"
-	for i := 0; i < len(pattern); i++ {
-		c := pattern[i]
-		switch c {
-		case '*':
-			regexPattern += "[^/]*"
-		case '.', '+', '?', '(', ')', '[', ']', '{', '}', '^', '$', '|', '\\':
-			regexPattern += "\\" + string(c)
-		default:
-			regexPattern += string(c)
+	mimetype = normalizeMimetype(mimetype)
+	for _, pattern := range allowed {
+		switch {
+		case pattern == "*/*":
+			return true
+		case strings.HasSuffix(pattern, "/*"):
+			if strings.HasPrefix(mimetype, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		case normalizeMimetype(pattern) == mimetype:
+			return true
 		}
 	}
-	regexPattern += "$"
-	
-	matched, _ := regexp.MatchString(regexPattern, key)
-	return matched
+	return false
 }
 
 // CreateBucket handles POST /buckets - create a new bucket for the authenticated client
@@ -186,7 +277,7 @@ func (h *BucketHandler) CreateBucket(ctx context.Context, w http.ResponseWriter,
 	if err != nil {
 		h.logRequest(ctx, "error", "Invalid cors_policy", zap.Error(err))
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("cors_policy must be a valid JSON array of CORS rules"))
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
 		return
 	}
 
@@ -195,16 +286,96 @@ func (h *BucketHandler) CreateBucket(ctx context.Context, w http.ResponseWriter,
 	if err != nil {
 		h.logRequest(ctx, "error", "Invalid public_paths", zap.Error(err))
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("public_paths must be a valid JSON array of strings"))
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	// Validate and normalise allowed mimetypes
+	allowedMimetypes, err := validateAllowedMimetypes(req.AllowedMimetypes)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid allowed_mimetypes", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("allowed_mimetypes must be a JSON array of mimetypes such as \"image/png\" or \"image/*\""))
+		return
+	}
+
+	thumbnailWidths, err := validateThumbnailWidths(req.ThumbnailWidths)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid thumbnail_widths", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(errThumbnailWidths.Error()))
+		return
+	}
+
+	imageSizes, err := validateImageSizes(req.ImageSizes)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid image_sizes", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(errImageSizes.Error()))
+		return
+	}
+
+	maxKeyDepth, maxTopLevelFolders := defaultMaxKeyDepth, 0
+	if req.MaxKeyDepth != nil {
+		maxKeyDepth = *req.MaxKeyDepth
+	}
+	if req.MaxTopLevelFolders != nil {
+		maxTopLevelFolders = *req.MaxTopLevelFolders
+	}
+	if err := validateKeyLimits(&maxKeyDepth, &maxTopLevelFolders); err != nil {
+		h.logRequest(ctx, "error", "Invalid key limits", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	compressionMinBytes := int64(defaultCompressionMinBytes)
+	if req.CompressionMinBytes != nil {
+		compressionMinBytes = *req.CompressionMinBytes
+	}
+	if compressionMinBytes < 0 {
+		h.logRequest(ctx, "error", "Invalid compression_min_bytes", zap.Int64("compression_min_bytes", compressionMinBytes))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(errCompressionMinBytes.Error()))
+		return
+	}
+
+	if req.PublicRateLimit < 0 {
+		h.logRequest(ctx, "error", "Invalid public_rate_limit", zap.Int("public_rate_limit", req.PublicRateLimit))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(errPublicRateLimit.Error()))
+		return
+	}
+
+	if err := validateBucketQuotas(&req.MaxTotalBytes, &req.MaxFileCount); err != nil {
+		h.logRequest(ctx, "error", "Invalid bucket quotas", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	hotlinkProtection, err := validateHotlinkProtection(req.HotlinkProtection)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid hotlink_protection", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(errHotlinkProtection.Error()))
+		return
+	}
+
+	responseHeaders, err := validateResponseHeaders(req.ResponseHeaders)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid response_headers", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
 		return
 	}
 
 	h.logRequest(ctx, "info", "Creating bucket", zap.String("name", req.Name), zap.String("client_id", clientID))
 
-	now := time.Now()
+	now := time.Now().UTC()
 	result, err := h.db.Exec(
-		"INSERT INTO buckets (name, client_id, cors_policy, public_paths, archived, created_at, updated_at) VALUES (?, ?, ?, ?, 0, ?, ?)",
-		req.Name, clientID, string(corsPolicy), string(publicPaths), now, now,
+		"INSERT INTO buckets (name, client_id, cors_policy, public_paths, archived, lowercase_keys, allow_mimetype_mismatch, strict_file_size, allowed_mimetypes, versioning, dedupe, max_key_depth, max_top_level_folders, thumbnail_widths, image_sizes, convert_images, compression, compression_min_bytes, hotlink_protection, public_rate_limit, max_total_bytes, max_file_count, response_headers, created_at, updated_at) VALUES (?, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		req.Name, clientID, string(corsPolicy), string(publicPaths), req.LowercaseKeys, req.AllowMimetypeMismatch, req.StrictFileSize, string(allowedMimetypes), req.Versioning, req.Dedupe, maxKeyDepth, maxTopLevelFolders, string(thumbnailWidths), string(imageSizes), req.ConvertImages, req.Compression, compressionMinBytes, string(hotlinkProtection), req.PublicRateLimit, req.MaxTotalBytes, req.MaxFileCount, string(responseHeaders), now, now,
 	)
 	if err != nil {
 		// SQLite UNIQUE constraint violation
@@ -225,14 +396,32 @@ func (h *BucketHandler) CreateBucket(ctx context.Context, w http.ResponseWriter,
 	h.logRequest(ctx, "info", "Bucket created successfully", zap.Int64("bucket_id", id), zap.String("name", req.Name))
 
 	bucket := models.Bucket{
-		ID:          int(id),
-		Name:        req.Name,
-		ClientID:    clientID,
-		CORSPolicy:  corsPolicy,
-		PublicPaths: publicPaths,
-		Archived:    false,
-		CreatedAt:   now,
-		UpdatedAt:   now,
+		ID:                    int(id),
+		Name:                  req.Name,
+		ClientID:              clientID,
+		CORSPolicy:            corsPolicy,
+		PublicPaths:           publicPaths,
+		Archived:              false,
+		LowercaseKeys:         req.LowercaseKeys,
+		AllowMimetypeMismatch: req.AllowMimetypeMismatch,
+		StrictFileSize:        req.StrictFileSize,
+		AllowedMimetypes:      allowedMimetypes,
+		Versioning:            req.Versioning,
+		Dedupe:                req.Dedupe,
+		MaxKeyDepth:           maxKeyDepth,
+		MaxTopLevelFolders:    maxTopLevelFolders,
+		ThumbnailWidths:       thumbnailWidths,
+		ImageSizes:            imageSizes,
+		ConvertImages:         req.ConvertImages,
+		Compression:           req.Compression,
+		CompressionMinBytes:   compressionMinBytes,
+		HotlinkProtection:     hotlinkProtection,
+		PublicRateLimit:       req.PublicRateLimit,
+		MaxTotalBytes:         req.MaxTotalBytes,
+		MaxFileCount:          req.MaxFileCount,
+		ResponseHeaders:       responseHeaders,
+		CreatedAt:             now,
+		UpdatedAt:             now,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -250,12 +439,65 @@ func (h *BucketHandler) GetBuckets(ctx context.Context, w http.ResponseWriter, r
 		return
 	}
 
-	h.logRequest(ctx, "info", "Listing buckets", zap.String("client_id", clientID))
+	// ?archived= keeps only archived (true) or active (false) buckets; all, the default,
+	// lists both. Cursors are bound to the filter.
+	scope := "buckets:" + clientID
+	archivedFilter := ""
+	switch archived := r.URL.Query().Get("archived"); archived {
+	case "", "all":
+	case "true":
+		archivedFilter = " AND archived = 1"
+		scope += ":archived"
+	case "false":
+		archivedFilter = " AND archived = 0"
+		scope += ":active"
+	default:
+		h.logRequest(ctx, "error", "Invalid archived filter", zap.String("archived", archived))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("archived must be true, false or all"))
+		return
+	}
 
-	rows, err := h.db.Query(
-		"SELECT id, name, client_id, cors_policy, public_paths, archived, created_at, updated_at FROM buckets WHERE client_id = ? ORDER BY created_at DESC",
-		clientID,
-	)
+	page, err := h.pager.Parse(r.URL.Query(), api.PageSpec{
+		Scope:        scope,
+		DefaultLimit: defaultBucketPageSize,
+		MaxLimit:     maxBucketPageSize,
+		Sorts:        []string{"-created_at", "created_at", "name", "-name"},
+	})
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid page request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Listing buckets", zap.String("client_id", clientID), zap.String("sort", page.Sort))
+
+	var total int
+	if err := h.db.QueryRow("SELECT COUNT(*) FROM buckets WHERE client_id = ?"+archivedFilter, clientID).Scan(&total); err != nil {
+		h.logRequest(ctx, "error", "Failed to count buckets", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Database error"))
+		return
+	}
+
+	// Keyset paging on the sort column, with the id breaking ties. The cursor carries the
+	// column's stored text so the comparison matches the ordering exactly.
+	column := bucketSortColumns[page.SortField()]
+	direction, comparison := "ASC", ">"
+	if page.Descending() {
+		direction, comparison = "DESC", "<"
+	}
+	query := "SELECT " + bucketColumns + ", CAST(" + column + " AS TEXT) FROM buckets WHERE client_id = ?" + archivedFilter
+	args := []interface{}{clientID}
+	if len(page.After) == 2 {
+		query += " AND (CAST(" + column + " AS TEXT) " + comparison + " ? OR (CAST(" + column + " AS TEXT) = ? AND id " + comparison + " ?))"
+		args = append(args, page.After[0], page.After[0], page.After[1])
+	}
+	query += " ORDER BY CAST(" + column + " AS TEXT) " + direction + ", id " + direction + " LIMIT ?"
+	args = append(args, page.Limit+1)
+
+	rows, err := h.db.Query(query, args...)
 	if err != nil {
 		h.logRequest(ctx, "error", "Failed to query buckets", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
@@ -265,28 +507,29 @@ func (h *BucketHandler) GetBuckets(ctx context.Context, w http.ResponseWriter, r
 	defer rows.Close()
 
 	var buckets []models.Bucket
+	nextCursor := ""
+	lastSortValue := ""
 	for rows.Next() {
-		var b models.Bucket
-		var corsPolicyStr string
-		var publicPathsStr string
-		var archivedInt int
-		if err := rows.Scan(&b.ID, &b.Name, &b.ClientID, &corsPolicyStr, &publicPathsStr, &archivedInt, &b.CreatedAt, &b.UpdatedAt); err != nil {
+		if len(buckets) == page.Limit {
+			last := buckets[len(buckets)-1]
+			nextCursor = h.pager.Next(page, lastSortValue, strconv.Itoa(last.ID))
+			break
+		}
+		b, err := scanBucket(rows, &lastSortValue)
+		if err != nil {
 			h.logRequest(ctx, "error", "Failed to scan bucket row", zap.Error(err))
 			continue
 		}
-		b.CORSPolicy = json.RawMessage(corsPolicyStr)
-		b.PublicPaths = json.RawMessage(publicPathsStr)
-		b.Archived = archivedInt != 0
 		buckets = append(buckets, b)
 	}
 
 	h.logRequest(ctx, "info", "Buckets retrieved successfully", zap.Int("count", len(buckets)))
 
+	response := api.NewPage(buckets, nextCursor)
+	response.TotalEstimate = &total
+
 	w.Header().Set("Content-Type", "application/json")
-	if buckets == nil {
-		buckets = []models.Bucket{}
-	}
-	json.NewEncoder(w).Encode(buckets)
+	json.NewEncoder(w).Encode(response)
 }
 
 // GetBucket handles GET /buckets/{id} - get a bucket by ID for the authenticated client
@@ -311,15 +554,10 @@ func (h *BucketHandler) GetBucket(ctx context.Context, w http.ResponseWriter, r
 
 	h.logRequest(ctx, "info", "Getting bucket", zap.Int("bucket_id", id), zap.String("client_id", clientID))
 
-	var b models.Bucket
-	var corsPolicyStr string
-	var publicPathsStr string
-	var archivedInt int
-	err = h.db.QueryRow(
-		"SELECT id, name, client_id, cors_policy, public_paths, archived, created_at, updated_at FROM buckets WHERE id = ? AND client_id = ?",
+	b, err := scanBucket(h.db.QueryRow(
+		"SELECT "+bucketColumns+" FROM buckets WHERE id = ? AND client_id = ?",
 		id, clientID,
-	).Scan(&b.ID, &b.Name, &b.ClientID, &corsPolicyStr, &publicPathsStr, &archivedInt, &b.CreatedAt, &b.UpdatedAt)
-
+	))
 	if err == sql.ErrNoRows {
 		h.logRequest(ctx, "info", "Bucket not found", zap.Int("bucket_id", id))
 		w.WriteHeader(http.StatusNotFound)
@@ -333,18 +571,65 @@ func (h *BucketHandler) GetBucket(ctx context.Context, w http.ResponseWriter, r
 		return
 	}
 
-	b.CORSPolicy = json.RawMessage(corsPolicyStr)
-	b.PublicPaths = json.RawMessage(publicPathsStr)
-	b.Archived = archivedInt != 0
-
 	h.logRequest(ctx, "info", "Bucket retrieved successfully", zap.Int("bucket_id", id))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(b)
 }
 
-// UpdateBucket handles PUT /buckets/{id} - update a bucket's CORS policy
+// GetBucketByName handles GET /buckets/by-name/{name} - get a bucket by the name the
+// authenticated client created it with
+func (h *BucketHandler) GetBucketByName(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	clientID, ok := h.getClientID(ctx)
+	if !ok {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+
+	h.logRequest(ctx, "info", "Getting bucket by name", zap.String("name", name), zap.String("client_id", clientID))
+
+	b, err := scanBucket(h.db.QueryRow(
+		"SELECT "+bucketColumns+" FROM buckets WHERE name = ? AND client_id = ?",
+		name, clientID,
+	))
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "info", "Bucket not found", zap.String("name", name))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Bucket not found"))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query bucket", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Database error"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Bucket retrieved successfully", zap.Int("bucket_id", b.ID))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// UpdateBucket handles PUT /buckets/{id} - update a bucket's settings. cors_policy and
+// public_paths are replaced by what the body holds, [] when omitted; every other setting
+// omitted is left unchanged.
 func (h *BucketHandler) UpdateBucket(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	h.updateBucket(ctx, w, r, false)
+}
+
+// PatchBucket handles PATCH /buckets/{id} - update only the settings the body holds.
+// Unlike PUT, an omitted cors_policy or public_paths is left unchanged; send [] to clear it.
+func (h *BucketHandler) PatchBucket(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	h.updateBucket(ctx, w, r, true)
+}
+
+// updateBucket applies a PUT or, when partial, a PATCH of a bucket's settings
+func (h *BucketHandler) updateBucket(ctx context.Context, w http.ResponseWriter, r *http.Request, partial bool) {
 	clientID, ok := h.getClientID(ctx)
 	if !ok {
 		h.logRequest(ctx, "error", "Client ID not found in auth context")
@@ -371,28 +656,145 @@ func (h *BucketHandler) UpdateBucket(ctx context.Context, w http.ResponseWriter,
 		return
 	}
 
-	corsPolicy, err := validateCORSPolicy(req.CORSPolicy)
-	if err != nil {
-		h.logRequest(ctx, "error", "Invalid cors_policy", zap.Error(err))
+	if req.CreatedAt != nil {
+		h.logRequest(ctx, "error", "Attempt to change created_at", zap.Int("bucket_id", id))
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("cors_policy must be a valid JSON array of CORS rules"))
+		json.NewEncoder(w).Encode(errs.NewValidationError("created_at cannot be changed"))
 		return
 	}
 
-	publicPaths, err := validatePublicPaths(req.PublicPaths)
-	if err != nil {
-		h.logRequest(ctx, "error", "Invalid public_paths", zap.Error(err))
+	// A PUT resets an omitted cors_policy or public_paths to []; a PATCH keeps them as-is
+	var corsPolicy interface{}
+	if !partial || len(req.CORSPolicy) > 0 {
+		clean, err := validateCORSPolicy(req.CORSPolicy)
+		if err != nil {
+			h.logRequest(ctx, "error", "Invalid cors_policy", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+			return
+		}
+		corsPolicy = string(clean)
+	}
+
+	var publicPaths interface{}
+	if !partial || len(req.PublicPaths) > 0 {
+		clean, err := validatePublicPaths(req.PublicPaths)
+		if err != nil {
+			h.logRequest(ctx, "error", "Invalid public_paths", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+			return
+		}
+		publicPaths = string(clean)
+	}
+
+	// allowed_mimetypes is kept as-is when omitted; send [] to allow every mimetype again
+	var allowedMimetypes interface{}
+	if len(req.AllowedMimetypes) > 0 {
+		clean, err := validateAllowedMimetypes(req.AllowedMimetypes)
+		if err != nil {
+			h.logRequest(ctx, "error", "Invalid allowed_mimetypes", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError("allowed_mimetypes must be a JSON array of mimetypes such as \"image/png\" or \"image/*\""))
+			return
+		}
+		allowedMimetypes = string(clean)
+	}
+
+	if err := validateKeyLimits(req.MaxKeyDepth, req.MaxTopLevelFolders); err != nil {
+		h.logRequest(ctx, "error", "Invalid key limits", zap.Error(err))
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("public_paths must be a valid JSON array of strings"))
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
 		return
 	}
 
-	h.logRequest(ctx, "info", "Updating bucket", zap.Int("bucket_id", id), zap.String("client_id", clientID))
+	if req.PublicRateLimit != nil && *req.PublicRateLimit < 0 {
+		h.logRequest(ctx, "error", "Invalid public_rate_limit", zap.Int("public_rate_limit", *req.PublicRateLimit))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(errPublicRateLimit.Error()))
+		return
+	}
 
-	now := time.Now()
-	result, err := h.db.Exec(
-		"UPDATE buckets SET cors_policy = ?, public_paths = ?, updated_at = ? WHERE id = ? AND client_id = ? AND archived = 0",
-		string(corsPolicy), string(publicPaths), now, id, clientID,
+	if err := validateBucketQuotas(req.MaxTotalBytes, req.MaxFileCount); err != nil {
+		h.logRequest(ctx, "error", "Invalid bucket quotas", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	if req.CompressionMinBytes != nil && *req.CompressionMinBytes < 0 {
+		h.logRequest(ctx, "error", "Invalid compression_min_bytes", zap.Int64("compression_min_bytes", *req.CompressionMinBytes))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(errCompressionMinBytes.Error()))
+		return
+	}
+
+	// thumbnail_widths is kept as-is when omitted; send [] to stop making thumbnails
+	var thumbnailWidths interface{}
+	if len(req.ThumbnailWidths) > 0 {
+		clean, err := validateThumbnailWidths(req.ThumbnailWidths)
+		if err != nil {
+			h.logRequest(ctx, "error", "Invalid thumbnail_widths", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(errThumbnailWidths.Error()))
+			return
+		}
+		thumbnailWidths = string(clean)
+	}
+
+	// image_sizes likewise; send [] to stop resizing
+	var imageSizes interface{}
+	if len(req.ImageSizes) > 0 {
+		clean, err := validateImageSizes(req.ImageSizes)
+		if err != nil {
+			h.logRequest(ctx, "error", "Invalid image_sizes", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(errImageSizes.Error()))
+			return
+		}
+		imageSizes = string(clean)
+	}
+
+	// hotlink_protection likewise; send null to let any site embed the bucket's files
+	var hotlinkProtection interface{}
+	if len(req.HotlinkProtection) > 0 {
+		clean, err := validateHotlinkProtection(req.HotlinkProtection)
+		if err != nil {
+			h.logRequest(ctx, "error", "Invalid hotlink_protection", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(errHotlinkProtection.Error()))
+			return
+		}
+		hotlinkProtection = string(clean)
+	}
+
+	// response_headers likewise; send {} or null to stop sending them
+	var responseHeaders interface{}
+	if len(req.ResponseHeaders) > 0 {
+		clean, err := validateResponseHeaders(req.ResponseHeaders)
+		if err != nil {
+			h.logRequest(ctx, "error", "Invalid response_headers", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+			return
+		}
+		responseHeaders = string(clean)
+	}
+
+	h.logRequest(ctx, "info", "Updating bucket", zap.Int("bucket_id", id), zap.String("client_id", clientID), zap.Bool("partial", partial))
+
+	now := time.Now().UTC()
+	tx, err := h.db.Beginx()
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to update bucket", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to update bucket"))
+		return
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(
+		"UPDATE buckets SET cors_policy = COALESCE(?, cors_policy), public_paths = COALESCE(?, public_paths), lowercase_keys = COALESCE(?, lowercase_keys), allow_mimetype_mismatch = COALESCE(?, allow_mimetype_mismatch), strict_file_size = COALESCE(?, strict_file_size), allowed_mimetypes = COALESCE(?, allowed_mimetypes), versioning = COALESCE(?, versioning), dedupe = COALESCE(?, dedupe), max_key_depth = COALESCE(?, max_key_depth), max_top_level_folders = COALESCE(?, max_top_level_folders), thumbnail_widths = COALESCE(?, thumbnail_widths), image_sizes = COALESCE(?, image_sizes), convert_images = COALESCE(?, convert_images), compression = COALESCE(?, compression), compression_min_bytes = COALESCE(?, compression_min_bytes), hotlink_protection = COALESCE(?, hotlink_protection), public_rate_limit = COALESCE(?, public_rate_limit), max_total_bytes = COALESCE(?, max_total_bytes), max_file_count = COALESCE(?, max_file_count), response_headers = COALESCE(?, response_headers), updated_at = ? WHERE id = ? AND client_id = ? AND archived = 0",
+		corsPolicy, publicPaths, req.LowercaseKeys, req.AllowMimetypeMismatch, req.StrictFileSize, allowedMimetypes, req.Versioning, req.Dedupe, req.MaxKeyDepth, req.MaxTopLevelFolders, thumbnailWidths, imageSizes, req.ConvertImages, req.Compression, req.CompressionMinBytes, hotlinkProtection, req.PublicRateLimit, req.MaxTotalBytes, req.MaxFileCount, responseHeaders, now, id, clientID,
 	)
 	if err != nil {
 		h.logRequest(ctx, "error", "Failed to update bucket", zap.Error(err))
@@ -405,7 +807,7 @@ func (h *BucketHandler) UpdateBucket(ctx context.Context, w http.ResponseWriter,
 	if rowsAffected == 0 {
 		// Check whether it exists at all (might be archived or belong to another client)
 		var count int
-		h.db.QueryRow("SELECT COUNT(*) FROM buckets WHERE id = ? AND client_id = ?", id, clientID).Scan(&count)
+		tx.QueryRow("SELECT COUNT(*) FROM buckets WHERE id = ? AND client_id = ?", id, clientID).Scan(&count)
 		if count == 0 {
 			h.logRequest(ctx, "info", "Bucket not found", zap.Int("bucket_id", id))
 			w.WriteHeader(http.StatusNotFound)
@@ -419,18 +821,38 @@ func (h *BucketHandler) UpdateBucket(ctx context.Context, w http.ResponseWriter,
 		return
 	}
 
+	// Keys stored with uppercase letters could no longer be reached once lookups lowercase
+	// them. The check runs after the update so no upload can store such a key in between.
+	if req.LowercaseKeys != nil && *req.LowercaseKeys {
+		count, example, err := uppercaseKeys(tx, id)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to check keys for lowercase_keys", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to update bucket"))
+			return
+		}
+		if count > 0 {
+			h.logRequest(ctx, "error", "Bucket holds keys with uppercase letters", zap.Int("bucket_id", id), zap.Int("count", count))
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(errs.AppError{
+				Code:    http.StatusConflict,
+				Message: fmt.Sprintf("lowercase_keys cannot be turned on while the bucket holds %d files with uppercase letters in their keys, such as %q; rename or delete them first", count, example),
+			})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		h.logRequest(ctx, "error", "Failed to update bucket", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to update bucket"))
+		return
+	}
+
 	// Fetch the updated bucket to return
-	var b models.Bucket
-	var corsPolicyStr string
-	var publicPathsStr string
-	var archivedInt int
-	h.db.QueryRow(
-		"SELECT id, name, client_id, cors_policy, public_paths, archived, created_at, updated_at FROM buckets WHERE id = ?",
+	b, _ := scanBucket(h.db.QueryRow(
+		"SELECT "+bucketColumns+" FROM buckets WHERE id = ?",
 		id,
-	).Scan(&b.ID, &b.Name, &b.ClientID, &corsPolicyStr, &publicPathsStr, &archivedInt, &b.CreatedAt, &b.UpdatedAt)
-	b.CORSPolicy = json.RawMessage(corsPolicyStr)
-	b.PublicPaths = json.RawMessage(publicPathsStr)
-	b.Archived = archivedInt != 0
+	))
 
 	h.logRequest(ctx, "info", "Bucket updated successfully", zap.Int("bucket_id", id))
 
@@ -438,7 +860,8 @@ func (h *BucketHandler) UpdateBucket(ctx context.Context, w http.ResponseWriter,
 	json.NewEncoder(w).Encode(b)
 }
 
-// ArchiveBucket handles POST /buckets/{id}/archive - archive a bucket
+// ArchiveBucket handles POST /buckets/{id}/archive - archive a bucket. The optional body
+// picks what archiving freezes: writes only, or every access to the bucket's files.
 func (h *BucketHandler) ArchiveBucket(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	clientID, ok := h.getClientID(ctx)
 	if !ok {
@@ -458,12 +881,30 @@ func (h *BucketHandler) ArchiveBucket(ctx context.Context, w http.ResponseWriter
 		return
 	}
 
-	h.logRequest(ctx, "info", "Archiving bucket", zap.Int("bucket_id", id), zap.String("client_id", clientID))
+	// The body is optional: without one the bucket is archived with freeze-all
+	var req models.ArchiveBucketRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = models.ArchiveModeFreezeAll
+	}
+	if req.Mode != models.ArchiveModeFreezeWrites && req.Mode != models.ArchiveModeFreezeAll {
+		h.logRequest(ctx, "error", "Invalid archive mode", zap.String("mode", req.Mode))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("mode must be freeze-writes or freeze-all"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Archiving bucket", zap.Int("bucket_id", id), zap.String("client_id", clientID), zap.String("mode", req.Mode))
 
-	now := time.Now()
+	now := time.Now().UTC()
 	result, err := h.db.Exec(
-		"UPDATE buckets SET archived = 1, updated_at = ? WHERE id = ? AND client_id = ? AND archived = 0",
-		now, id, clientID,
+		"UPDATE buckets SET archived = 1, archive_mode = ?, updated_at = ? WHERE id = ? AND client_id = ? AND archived = 0",
+		req.Mode, now, id, clientID,
 	)
 	if err != nil {
 		h.logRequest(ctx, "error", "Failed to archive bucket", zap.Error(err))
@@ -492,17 +933,74 @@ func (h *BucketHandler) ArchiveBucket(ctx context.Context, w http.ResponseWriter
 	h.logRequest(ctx, "info", "Bucket archived successfully", zap.Int("bucket_id", id))
 
 	// Fetch and return the archived bucket
-	var b models.Bucket
-	var corsPolicyStr string
-	var publicPathsStr string
-	var archivedInt int
-	h.db.QueryRow(
-		"SELECT id, name, client_id, cors_policy, public_paths, archived, created_at, updated_at FROM buckets WHERE id = ?",
+	b, _ := scanBucket(h.db.QueryRow(
+		"SELECT "+bucketColumns+" FROM buckets WHERE id = ?",
 		id,
-	).Scan(&b.ID, &b.Name, &b.ClientID, &corsPolicyStr, &publicPathsStr, &archivedInt, &b.CreatedAt, &b.UpdatedAt)
-	b.CORSPolicy = json.RawMessage(corsPolicyStr)
-	b.PublicPaths = json.RawMessage(publicPathsStr)
-	b.Archived = archivedInt != 0
+	))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// UnarchiveBucket handles POST /buckets/{id}/unarchive - bring an archived bucket back,
+// open to uploads, listing and downloads again.
+func (h *BucketHandler) UnarchiveBucket(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	clientID, ok := h.getClientID(ctx)
+	if !ok {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid bucket ID", zap.String("id", idStr))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid bucket ID"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Unarchiving bucket", zap.Int("bucket_id", id), zap.String("client_id", clientID))
+
+	now := time.Now().UTC()
+	result, err := h.db.Exec(
+		"UPDATE buckets SET archived = 0, archive_mode = NULL, updated_at = ? WHERE id = ? AND client_id = ? AND archived = 1",
+		now, id, clientID,
+	)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to unarchive bucket", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to unarchive bucket"))
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		var count int
+		h.db.QueryRow("SELECT COUNT(*) FROM buckets WHERE id = ? AND client_id = ?", id, clientID).Scan(&count)
+		if count == 0 {
+			h.logRequest(ctx, "info", "Bucket not found", zap.Int("bucket_id", id))
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(errs.NewNotFoundError("Bucket not found"))
+			return
+		}
+		// Not archived
+		h.logRequest(ctx, "info", "Bucket is not archived", zap.Int("bucket_id", id))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Bucket is not archived"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Bucket unarchived successfully", zap.Int("bucket_id", id))
+
+	// Fetch and return the unarchived bucket
+	b, _ := scanBucket(h.db.QueryRow(
+		"SELECT "+bucketColumns+" FROM buckets WHERE id = ?",
+		id,
+	))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(b)
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"file-upload-service/api"
+	"file-upload-service/models"
+)
+
+// listBuckets fetches one page of the test client's buckets
+func (e *testEnv) listBuckets(buckets *BucketHandler, query string) api.Page[models.Bucket] {
+	e.t.Helper()
+	w := e.serve(buckets.GetBuckets, newRequest(http.MethodGet, "/buckets?"+query, nil), nil)
+	expectStatus(e.t, w, http.StatusOK)
+
+	var page api.Page[models.Bucket]
+	decode(e.t, w, &page)
+	return page
+}
+
+func TestGetBucketsPagesBySort(t *testing.T) {
+	env := newTestEnv(t)
+	buckets := NewBucketHandler(env.db, api.NewPager(env.cfg.PaginationSecret))
+	for _, name := range []string{"charlie", "alpha", "delta", "bravo"} {
+		env.createBucket(name)
+	}
+
+	var names []string
+	query := "sort=name&limit=1"
+	for i := 0; i < 5; i++ {
+		page := env.listBuckets(buckets, query)
+		if len(page.Items) > 1 {
+			t.Fatalf("page %d has %d buckets, want at most 1", i, len(page.Items))
+		}
+		if page.TotalEstimate == nil || *page.TotalEstimate != 4 {
+			t.Fatalf("total_estimate = %v, want 4", page.TotalEstimate)
+		}
+		for _, b := range page.Items {
+			names = append(names, b.Name)
+		}
+		if !page.Truncated {
+			break
+		}
+		query = "sort=name&limit=1&cursor=" + page.NextCursor
+	}
+
+	want := []string{"alpha", "bravo", "charlie", "delta"}
+	if len(names) != len(want) {
+		t.Fatalf("listed %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("listed %v, want %v", names, want)
+		}
+	}
+}
+
+func TestGetBucketsRejectsBadPageRequests(t *testing.T) {
+	env := newTestEnv(t)
+	buckets := NewBucketHandler(env.db, api.NewPager(env.cfg.PaginationSecret))
+	env.createBucket("alpha")
+	env.createBucket("bravo")
+
+	page := env.listBuckets(buckets, "sort=name&limit=1")
+	if !page.Truncated {
+		t.Fatal("first page of two buckets with limit=1 is not truncated")
+	}
+
+	for name, query := range map[string]string{
+		"unknown sort":      "sort=size",
+		"non-numeric limit": "limit=ten",
+		"tampered cursor":   "sort=name&cursor=" + page.NextCursor + "x",
+		"sort changed":      "sort=-name&cursor=" + page.NextCursor,
+		"garbage cursor":    "cursor=not-a-cursor",
+	} {
+		w := env.serve(buckets.GetBuckets, newRequest(http.MethodGet, "/buckets?"+query, nil), nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d; body: %s", name, w.Code, http.StatusBadRequest, w.Body.String())
+		}
+	}
+}
+
+// archiveBucket archives a bucket with the given request body and returns the response
+func (e *testEnv) archiveBucket(buckets *BucketHandler, bucketID int, body interface{}) *httptest.ResponseRecorder {
+	e.t.Helper()
+	return e.serve(buckets.ArchiveBucket, newRequest(http.MethodPost, "/buckets/"+strconv.Itoa(bucketID)+"/archive", body),
+		map[string]string{"id": strconv.Itoa(bucketID)})
+}
+
+func TestArchiveFreezeWritesKeepsReads(t *testing.T) {
+	env := newTestEnv(t)
+	buckets := NewBucketHandler(env.db, api.NewPager(env.cfg.PaginationSecret))
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "docs/a.txt", []byte("a"))
+
+	w := env.archiveBucket(buckets, bucketID, models.ArchiveBucketRequest{Mode: models.ArchiveModeFreezeWrites})
+	expectStatus(t, w, http.StatusOK)
+	var bucket models.Bucket
+	decode(t, w, &bucket)
+	if !bucket.Archived || bucket.ArchiveMode != models.ArchiveModeFreezeWrites {
+		t.Fatalf("bucket = %+v, want archived with freeze-writes", bucket)
+	}
+
+	w = env.serve(env.files.ListFiles, newRequest(http.MethodGet, "/buckets/1/files?path=docs", nil),
+		map[string]string{"id": strconv.Itoa(bucketID)})
+	expectStatus(t, w, http.StatusOK)
+
+	w = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, env.downloadTarget(fileID), nil), nil)
+	expectStatus(t, w, http.StatusOK)
+
+	w = env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, "docs/b.txt", 64)), nil)
+	expectStatus(t, w, http.StatusConflict)
+}
+
+func TestArchiveDefaultsToFreezeAll(t *testing.T) {
+	env := newTestEnv(t)
+	buckets := NewBucketHandler(env.db, api.NewPager(env.cfg.PaginationSecret))
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "docs/a.txt", []byte("a"))
+	download := env.downloadTarget(fileID)
+
+	w := env.archiveBucket(buckets, bucketID, nil)
+	expectStatus(t, w, http.StatusOK)
+	var bucket models.Bucket
+	decode(t, w, &bucket)
+	if bucket.ArchiveMode != models.ArchiveModeFreezeAll {
+		t.Fatalf("archive_mode = %q, want %q", bucket.ArchiveMode, models.ArchiveModeFreezeAll)
+	}
+
+	w = env.serve(env.files.ListFiles, newRequest(http.MethodGet, "/buckets/1/files?path=docs", nil),
+		map[string]string{"id": strconv.Itoa(bucketID)})
+	expectStatus(t, w, http.StatusConflict)
+
+	w = env.serve(env.files.GenerateDownloadSignedURL, newRequest(http.MethodPost, "/files/download-url",
+		models.GenerateDownloadSignedURLRequest{FileID: fileID}), nil)
+	expectStatus(t, w, http.StatusConflict)
+
+	w = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, download, nil), nil)
+	expectStatus(t, w, http.StatusConflict)
+}
+
+func TestArchiveRejectsUnknownMode(t *testing.T) {
+	env := newTestEnv(t)
+	buckets := NewBucketHandler(env.db, api.NewPager(env.cfg.PaginationSecret))
+	bucketID := env.createBucket("photos")
+
+	w := env.archiveBucket(buckets, bucketID, models.ArchiveBucketRequest{Mode: "freeze-some"})
+	expectStatus(t, w, http.StatusBadRequest)
+
+	var archived bool
+	if err := env.db.Get(&archived, "SELECT archived FROM buckets WHERE id = ?", bucketID); err != nil {
+		t.Fatal(err)
+	}
+	if archived {
+		t.Fatal("bucket was archived by a refused request")
+	}
+}
+
+func TestValidateAllowedMimetypes(t *testing.T) {
+	clean, err := validateAllowedMimetypes([]byte(`[" Image/PNG ", "image/*", "*/*"]`))
+	if err != nil || string(clean) != `["image/png","image/*","*/*"]` {
+		t.Fatalf("valid list gave %s, %v", clean, err)
+	}
+	for _, mimetype := range []string{"png", "image/", "*/png", "image/png*", "image/*png", "im*ge/png", "image/png/x"} {
+		if _, err := validateAllowedMimetypes([]byte(`["` + mimetype + `"]`)); err == nil {
+			t.Errorf("%q was accepted", mimetype)
+		}
+	}
+}
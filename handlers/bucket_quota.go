@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// bucketQuotaUsage is what a bucket holds against its max_total_bytes and max_file_count,
+// counted like ownerUsage: stored files, the pending uploads still outstanding and the
+// bytes its snapshots hold on their own
+type bucketQuotaUsage struct {
+	BucketID      int
+	UsedBytes     int64
+	ReservedBytes int64
+	SnapshotBytes int64
+	FileCount     int
+	ReservedFiles int
+	MaxTotalBytes int64
+	MaxFileCount  int
+}
+
+// bucketQuotaError refuses an upload that would take its bucket past one of its limits
+type bucketQuotaError struct {
+	usage     bucketQuotaUsage
+	requested int64
+}
+
+func (e *bucketQuotaError) Error() string {
+	return fmt.Sprintf("quota of bucket %d exceeded", e.usage.BucketID)
+}
+
+// validateBucketQuotas checks the max_total_bytes and max_file_count of a bucket create
+// or update request; nil values are left unchecked
+func validateBucketQuotas(maxTotalBytes *int64, maxFileCount *int) error {
+	if maxTotalBytes != nil && *maxTotalBytes < 0 {
+		return errors.New("max_total_bytes must be 0 (no limit) or greater")
+	}
+	if maxFileCount != nil && *maxFileCount < 0 {
+		return errors.New("max_file_count must be 0 (no limit) or greater")
+	}
+	return nil
+}
+
+// bucketUsageAgainstQuota sums what a bucket holds against its limits. Stored files
+// count whatever their visibility; pending files count while their upload is still
+// outstanding, that is while they hold a key reservation or belong to an open upload
+// group. Pending files of allow_parallel URLs reserve nothing and only count once their
+// bytes arrive. Deleted files count for nothing, so deleting frees quota at once, unless
+// an unexpired snapshot of the bucket still holds their bytes.
+func bucketUsageAgainstQuota(q sqlx.Queryer, bucketID int, now time.Time) (bucketQuotaUsage, error) {
+	usage := bucketQuotaUsage{BucketID: bucketID}
+	err := q.QueryRowx(
+		"SELECT max_total_bytes, max_file_count FROM buckets WHERE id = ?", bucketID,
+	).Scan(&usage.MaxTotalBytes, &usage.MaxFileCount)
+	if err != nil || (usage.MaxTotalBytes == 0 && usage.MaxFileCount == 0) {
+		return usage, err
+	}
+	err = q.QueryRowx(
+		`SELECT
+			COUNT(CASE WHEN f.status <> ? THEN 1 END),
+			COUNT(CASE WHEN f.status = ? THEN 1 END),
+			COALESCE(SUM(CASE WHEN f.status <> ? THEN f.file_size END), 0),
+			COALESCE(SUM(CASE WHEN f.status = ? THEN f.file_size END), 0)
+		FROM files f
+		WHERE f.bucket_id = ?
+		AND (f.status IN (?, ?) OR (f.status = ? AND (
+			EXISTS (SELECT 1 FROM upload_reservations r WHERE r.file_id = f.id AND r.expires_at > ?)
+			OR EXISTS (SELECT 1 FROM upload_groups g WHERE g.id = f.upload_group_id AND g.status = ? AND g.expires_at > ?)
+		)))`,
+		models.FileStatusPending, models.FileStatusPending, models.FileStatusPending, models.FileStatusPending,
+		bucketID,
+		models.FileStatusUploaded, models.FileStatusQuarantined, models.FileStatusPending,
+		now, models.UploadGroupStatusOpen, now,
+	).Scan(&usage.FileCount, &usage.ReservedFiles, &usage.UsedBytes, &usage.ReservedBytes)
+	if err != nil {
+		return usage, err
+	}
+	usage.SnapshotBytes, err = heldSnapshotBytes(q, now, "s.bucket_id = ?", bucketID)
+	return usage, err
+}
+
+// heldBytes is everything counted against max_total_bytes
+func (u bucketQuotaUsage) heldBytes() int64 {
+	return u.UsedBytes + u.ReservedBytes + u.SnapshotBytes
+}
+
+// checkBucketQuota refuses a prepared upload with a *bucketQuotaError when its size or
+// one more file would take its bucket past max_total_bytes or max_file_count. It runs
+// inside the serialized transaction that inserts the upload's row, so signed URLs issued
+// together cannot overshoot the limits. Files an overwrite would supersede are still counted.
+func checkBucketQuota(q sqlx.Queryer, upload *pendingUpload, now time.Time) error {
+	data := upload.TokenData
+	usage, err := bucketUsageAgainstQuota(q, data.BucketID, now)
+	if err != nil {
+		return err
+	}
+	overBytes := usage.MaxTotalBytes > 0 && usage.heldBytes()+data.FileSize > usage.MaxTotalBytes
+	overFiles := usage.MaxFileCount > 0 && usage.FileCount+usage.ReservedFiles+1 > usage.MaxFileCount
+	if overBytes || overFiles {
+		return &bucketQuotaError{usage: usage, requested: data.FileSize}
+	}
+	return nil
+}
+
+func (e *bucketQuotaError) refusal(prefix string) (interface{}, string) {
+	usage := e.usage
+	var message string
+	if usage.MaxTotalBytes > 0 && usage.heldBytes()+e.requested > usage.MaxTotalBytes {
+		message = fmt.Sprintf("Upload of %d bytes would exceed the bucket's max_total_bytes: %d of %d bytes in use",
+			e.requested, usage.heldBytes(), usage.MaxTotalBytes)
+	} else {
+		message = fmt.Sprintf("Upload would exceed the bucket's max_file_count: %d of %d files in use",
+			usage.FileCount+usage.ReservedFiles, usage.MaxFileCount)
+	}
+	message = prefix + message
+	return models.BucketQuotaExceededError{
+		Code:           http.StatusForbidden,
+		Message:        message,
+		BucketID:       usage.BucketID,
+		UsedBytes:      usage.UsedBytes,
+		ReservedBytes:  usage.ReservedBytes,
+		SnapshotBytes:  usage.SnapshotBytes,
+		RequestedBytes: e.requested,
+		MaxTotalBytes:  usage.MaxTotalBytes,
+		FileCount:      usage.FileCount,
+		ReservedFiles:  usage.ReservedFiles,
+		MaxFileCount:   usage.MaxFileCount,
+	}, message
+}
+
+func (e *bucketQuotaError) logFields() []zap.Field {
+	return []zap.Field{
+		zap.Int("bucket_id", e.usage.BucketID),
+		zap.Int64("used_bytes", e.usage.UsedBytes),
+		zap.Int64("reserved_bytes", e.usage.ReservedBytes),
+		zap.Int64("snapshot_bytes", e.usage.SnapshotBytes),
+		zap.Int64("requested_bytes", e.requested),
+		zap.Int64("max_total_bytes", e.usage.MaxTotalBytes),
+		zap.Int("file_count", e.usage.FileCount),
+		zap.Int("reserved_files", e.usage.ReservedFiles),
+		zap.Int("max_file_count", e.usage.MaxFileCount),
+	}
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/gorilla/mux"
+	"github.com/umakantv/go-utils/errs"
+	"go.uber.org/zap"
+)
+
+// errBucketRenamedMessage answers signed URLs issued before their bucket was renamed
+const errBucketRenamedMessage = "Bucket was renamed after the URL was issued; request a new URL"
+
+// RenameBucket handles POST /buckets/{id}/rename - give a bucket a new name. Its directory
+// is moved to the new name in the same step, so public URLs under the old name answer 404
+// and signed URLs issued before answer 409.
+func (h *BucketHandler) RenameBucket(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	clientID, ok := h.getClientID(ctx)
+	if !ok {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+
+	idStr := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid bucket ID", zap.String("id", idStr))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid bucket ID"))
+		return
+	}
+
+	var req models.RenameBucketRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+	if req.Name == "" {
+		h.logRequest(ctx, "error", "Missing required field: name")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("name is required"))
+		return
+	}
+	if !bucketNameRegex.MatchString(req.Name) {
+		h.logRequest(ctx, "error", "Invalid bucket name", zap.String("name", req.Name))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("name must be alphanumeric with dashes (cannot start or end with a dash)"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Renaming bucket", zap.Int("bucket_id", id), zap.String("client_id", clientID), zap.String("name", req.Name))
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to begin transaction", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to rename bucket"))
+		return
+	}
+	defer tx.Rollback()
+
+	var oldName, clientName string
+	var archived bool
+	err = tx.QueryRow(
+		"SELECT b.name, b.archived, c.name FROM buckets b JOIN clients c ON b.client_id = c.client_id WHERE b.id = ? AND b.client_id = ?",
+		id, clientID,
+	).Scan(&oldName, &archived, &clientName)
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "info", "Bucket not found", zap.Int("bucket_id", id))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Bucket not found"))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query bucket", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to rename bucket"))
+		return
+	}
+	if archived {
+		h.logRequest(ctx, "info", "Cannot rename an archived bucket", zap.Int("bucket_id", id))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Cannot rename an archived bucket"))
+		return
+	}
+
+	if req.Name != oldName {
+		_, err = tx.Exec("UPDATE buckets SET name = ?, updated_at = ? WHERE id = ?", req.Name, time.Now().UTC(), id)
+		if isUniqueConstraintError(err) {
+			h.logRequest(ctx, "error", "Bucket name already exists for client", zap.String("name", req.Name))
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(errs.NewValidationError("A bucket with this name already exists for your account"))
+			return
+		}
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to rename bucket", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to rename bucket"))
+			return
+		}
+
+		moved, status, appErr := h.moveBucketDir(ctx, clientName, oldName, req.Name)
+		if appErr != nil {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(appErr)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			h.logRequest(ctx, "error", "Failed to commit bucket rename", zap.Error(err))
+			if moved {
+				h.moveBucketDir(ctx, clientName, req.Name, oldName)
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to rename bucket"))
+			return
+		}
+		h.logRequest(ctx, "info", "Bucket renamed successfully", zap.Int("bucket_id", id), zap.String("old_name", oldName), zap.String("name", req.Name))
+	}
+
+	// Fetch and return the renamed bucket
+	b, _ := scanBucket(h.db.QueryRow(
+		"SELECT "+bucketColumns+" FROM buckets WHERE id = ?",
+		id,
+	))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// moveBucketDir renames a bucket's directory from one name to another. A bucket nothing
+// was uploaded to has no directory, which is not an error; moved reports whether there was
+// one. The target must not exist yet, so a rename never mixes two buckets' files.
+// On failure it returns the HTTP status to respond with and the error body.
+func (h *BucketHandler) moveBucketDir(ctx context.Context, clientName, from, to string) (moved bool, status int, appErr *errs.AppError) {
+	fromDir, err := bucketDirPath(clientName, from)
+	if err == nil {
+		var toDir string
+		toDir, err = bucketDirPath(clientName, to)
+		if err == nil {
+			if _, statErr := os.Lstat(toDir); statErr == nil {
+				h.logRequest(ctx, "error", "Bucket directory already exists", zap.String("dir", toDir))
+				return false, http.StatusConflict, errs.NewValidationError("Files are still stored under this bucket name; pick another name")
+			}
+			err = os.Rename(fromDir, toDir)
+		}
+	}
+	if os.IsNotExist(err) {
+		return false, 0, nil
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to move bucket directory", zap.String("from", from), zap.String("to", to), zap.Error(err))
+		return false, http.StatusInternalServerError, errs.NewInternalServerError("Failed to rename bucket")
+	}
+	return true, 0, nil
+}
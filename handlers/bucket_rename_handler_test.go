@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"file-upload-service/api"
+	"file-upload-service/models"
+)
+
+// renameBucket gives a bucket a new name
+func (e *testEnv) renameBucket(bucketID int, name string) *httptest.ResponseRecorder {
+	buckets := NewBucketHandler(e.db, api.NewPager(e.cfg.PaginationSecret))
+	return e.serve(buckets.RenameBucket, newRequest(http.MethodPost, "/buckets/"+strconv.Itoa(bucketID)+"/rename",
+		models.RenameBucketRequest{Name: name}), map[string]string{"id": strconv.Itoa(bucketID)})
+}
+
+func TestRenameBucketMovesItsDirectory(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.db.MustExec(`UPDATE buckets SET public_paths = '["pub/*"]' WHERE id = ?`, bucketID)
+	env.putFile(bucketID, "pub/a.txt", []byte("public a"))
+	oldPath := env.diskPath(bucketID, "pub/a.txt")
+
+	expectStatus(t, env.renameBucket(bucketID, "albums"), http.StatusOK)
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Fatalf("content still under the old name: %v", err)
+	}
+	if content, err := os.ReadFile(env.diskPath(bucketID, "pub/a.txt")); err != nil || string(content) != "public a" {
+		t.Fatalf("content under the new name = %q, %v", content, err)
+	}
+	w := env.servePublic("albums", "pub/a.txt")
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != "public a" {
+		t.Fatalf("served %q under the new name", w.Body.String())
+	}
+}
+
+func TestRenameBucketRetiresURLsUnderTheOldName(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.db.MustExec(`UPDATE buckets SET public_paths = '["pub/*"]' WHERE id = ?`, bucketID)
+	publicID := env.putFile(bucketID, "pub/a.txt", []byte("public a"))
+	privateID := env.putFile(bucketID, "private/b.txt", []byte("private b"))
+
+	presigned := env.presign(privateID)
+	download := env.downloadTarget(publicID)
+	upload := env.signedUpload(signedURLRequest(bucketID, "docs/c.txt", 64))
+	env.useShortURLs()
+	shortDownload := env.downloadTarget(publicID)
+
+	expectStatus(t, env.renameBucket(bucketID, "albums"), http.StatusOK)
+
+	expectRefused(t, env.servePublic("photos", "pub/a.txt"), http.StatusNotFound, "Bucket not found")
+	expectRefused(t, env.servePresigned(presigned), http.StatusNotFound, "Bucket not found")
+	expectRefused(t, serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, download, nil), nil),
+		http.StatusConflict, errBucketRenamedMessage)
+	expectRefused(t, serveAnonymous(env.files.ShortDownload, newRequest(http.MethodGet, shortDownload, nil),
+		map[string]string{"token": env.shortTokenOf("http://localhost:8080" + shortDownload)}), http.StatusConflict, errBucketRenamedMessage)
+	expectRefused(t, serveAnonymous(env.files.UploadFile, uploadRequest(upload.SignedURL, []byte("late")), nil),
+		http.StatusConflict, errBucketRenamedMessage)
+
+	// Once another bucket takes the old name, the old URLs still reach nothing
+	taken := env.createBucket("photos")
+	env.db.MustExec(`UPDATE buckets SET public_paths = '["pub/*"]' WHERE id = ?`, taken)
+	expectRefused(t, env.servePublic("photos", "pub/a.txt"), http.StatusNotFound, "")
+	expectRefused(t, env.servePresigned(presigned), http.StatusForbidden, "Invalid URL signature")
+	env.putFile(taken, "private/b.txt", []byte("another bucket's b"))
+	expectRefused(t, env.servePresigned(presigned), http.StatusForbidden, "Invalid URL signature")
+
+	// URLs issued after the rename work
+	w := env.servePresigned(env.presign(privateID))
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != "private b" {
+		t.Fatalf("served %q through a presigned URL issued after the rename", w.Body.String())
+	}
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/gorilla/mux"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// bucketUsageCacheTTL is how long a computed bucket usage is served from the cache.
+// Usage is aggregated over every file row of the bucket, which gets expensive on large
+// buckets, so clients polling it share one computation.
+const bucketUsageCacheTTL = 30 * time.Second
+
+// bucketUsageCacheKey is the cache key of a bucket's usage
+func bucketUsageCacheKey(bucketID int) string {
+	return "bucket-usage:" + strconv.Itoa(bucketID)
+}
+
+// cachedBucketUsage returns the usage of a bucket computed within bucketUsageCacheTTL
+func (h *FileHandler) cachedBucketUsage(bucketID int) (models.BucketUsage, bool) {
+	var usage models.BucketUsage
+	cachedData, err := h.cache.Get(bucketUsageCacheKey(bucketID))
+	if err != nil {
+		return usage, false
+	}
+	// Same re-marshal as loadUploadToken: the cache hands back a generic map
+	intermediate, err := json.Marshal(cachedData)
+	if err != nil {
+		return usage, false
+	}
+	return usage, json.Unmarshal(intermediate, &usage) == nil
+}
+
+// computeBucketUsage aggregates what a bucket stores. Live files are its uploaded files
+// outside open upload groups; every figure is summed in SQL, so no file row is loaded.
+func (h *FileHandler) computeBucketUsage(bucketID int, dedupe bool, now time.Time) (models.BucketUsage, error) {
+	usage := models.BucketUsage{BucketID: bucketID, Dedupe: dedupe, Folders: []models.FolderUsage{}, ComputedAt: now}
+	err := h.db.QueryRow(
+		`SELECT
+			COUNT(CASE WHEN status = ? AND staged = 0 THEN 1 END),
+			COALESCE(SUM(CASE WHEN status = ? AND staged = 0 THEN file_size END), 0),
+			COUNT(CASE WHEN status = ? THEN 1 END),
+			COALESCE(SUM(CASE WHEN status = ? THEN file_size END), 0)
+		FROM files WHERE bucket_id = ?`,
+		models.FileStatusUploaded, models.FileStatusUploaded, models.FileStatusDeleted, models.FileStatusDeleted, bucketID,
+	).Scan(&usage.FileCount, &usage.LogicalBytes, &usage.DeletedFileCount, &usage.DeletedBytes)
+	if err != nil {
+		return usage, err
+	}
+
+	// Every live file of an object past the first one is a copy that was not stored
+	err = h.db.QueryRow(
+		`SELECT COALESCE(SUM(n - 1), 0), COALESCE(SUM((n - 1) * size), 0) FROM (
+			SELECT COUNT(*) AS n, so.size AS size
+			FROM files f JOIN storage_objects so ON f.storage_object_id = so.id
+			WHERE f.bucket_id = ? AND f.status = ? AND f.staged = 0
+			GROUP BY so.id
+		)`,
+		bucketID, models.FileStatusUploaded,
+	).Scan(&usage.DedupedFiles, &usage.SavedBytes)
+	if err != nil {
+		return usage, err
+	}
+	usage.StoredBytes = usage.LogicalBytes - usage.SavedBytes
+
+	// The folder expression matches topLevelFolder: "" for keys at the bucket's root
+	err = h.db.Select(&usage.Folders,
+		`SELECT CASE WHEN instr(key, '/') > 0 THEN substr(key, 1, instr(key, '/') - 1) ELSE '' END AS folder,
+			COUNT(*) AS file_count, COALESCE(SUM(file_size), 0) AS bytes
+		FROM files WHERE bucket_id = ? AND status = ? AND staged = 0
+		GROUP BY folder ORDER BY folder`,
+		bucketID, models.FileStatusUploaded,
+	)
+	return usage, err
+}
+
+// BucketUsage handles GET /buckets/{id}/usage - report what a bucket stores, what it has
+// deleted and what deduplication saves it, overall and per top-level folder. Results are
+// cached for bucketUsageCacheTTL; computed_at tells how fresh they are.
+func (h *FileHandler) BucketUsage(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	idStr := mux.Vars(r)["id"]
+	bucketID, err := strconv.Atoi(idStr)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid bucket ID", zap.String("id", idStr))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid bucket ID"))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Getting bucket usage", zap.Int("bucket_id", bucketID), zap.String("client_id", clientID))
+
+	// Like GetBucket, another client's bucket is not found. Ownership is checked on every
+	// request, before the cache is consulted.
+	var dedupe bool
+	err = h.db.QueryRow("SELECT dedupe FROM buckets WHERE id = ? AND client_id = ?", bucketID, clientID).Scan(&dedupe)
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "info", "Bucket not found", zap.Int("bucket_id", bucketID))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Bucket not found"))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query bucket", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Database error"))
+		return
+	}
+
+	usage, cached := h.cachedBucketUsage(bucketID)
+	if !cached {
+		usage, err = h.computeBucketUsage(bucketID, dedupe, time.Now().UTC())
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to query bucket usage", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to get bucket usage"))
+			return
+		}
+		if err := h.cache.Set(bucketUsageCacheKey(bucketID), usage, bucketUsageCacheTTL); err != nil {
+			h.logRequest(ctx, "error", "Failed to cache bucket usage", zap.Error(err))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// checksumHeader carries the hex SHA-256 of a file's content, as stored at upload, so
+// clients can check what they received
+const checksumHeader = "X-Checksum-SHA256"
+
+// fileChecksum returns the checksum stored for a file's current content, or for one of
+// its versions when versionID is set; empty for content stored before checksums were
+func fileChecksum(q sqlx.Queryer, fileID, versionID string) (string, error) {
+	query, id := "SELECT COALESCE(checksum, '') FROM files WHERE id = ?", fileID
+	if versionID != "" {
+		query, id = "SELECT COALESCE(checksum, '') FROM file_versions WHERE id = ?", versionID
+	}
+	var checksum string
+	err := q.QueryRowx(query, id).Scan(&checksum)
+	return checksum, err
+}
+
+// setChecksumHeader sends the checksum of the content a response carries, when one is stored
+func setChecksumHeader(w http.ResponseWriter, checksum string) {
+	if checksum != "" {
+		w.Header().Set(checksumHeader, checksum)
+	}
+}
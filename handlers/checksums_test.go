@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"file-upload-service/models"
+)
+
+func TestChecksumSentOnDownloadAndPublicFile(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.db.MustExec(`UPDATE buckets SET public_paths = '["pub/*"]' WHERE id = ?`, bucketID)
+
+	content := []byte("content")
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, "pub/a.txt", int64(len(content)))), nil)
+	expectStatus(t, w, http.StatusCreated)
+	var signed models.SignedURLResponse
+	decode(t, w, &signed)
+	w = serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, content), nil)
+	expectStatus(t, w, http.StatusOK)
+
+	sum := sha256.Sum256(content)
+	want := hex.EncodeToString(sum[:])
+
+	w = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, env.downloadTarget(signed.FileID), nil), nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get(checksumHeader); got != want {
+		t.Fatalf("download %s = %q, want %q", checksumHeader, got, want)
+	}
+
+	vars := map[string]string{"bucket_name": "photos", "file_path": "pub/a.txt"}
+	w = serveAnonymous(env.public.ServePublicFile, newRequest(http.MethodGet, "/files/photos/pub/a.txt", nil), vars)
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get(checksumHeader); got != want {
+		t.Fatalf("public %s = %q, want %q", checksumHeader, got, want)
+	}
+	if got := w.Header().Get("ETag"); got != `"`+want+`"` {
+		t.Fatalf("public ETag = %q, want the quoted checksum", got)
+	}
+
+	r := newRequest(http.MethodGet, "/files/photos/pub/a.txt", nil)
+	r.Header.Set("If-None-Match", `"`+want+`"`)
+	w = serveAnonymous(env.public.ServePublicFile, r, vars)
+	expectStatus(t, w, http.StatusNotModified)
+}
+
+func TestNoChecksumHeaderWithoutStoredChecksum(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.db.MustExec(`UPDATE buckets SET public_paths = '["pub/*"]' WHERE id = ?`, bucketID)
+	fileID := env.putFile(bucketID, "pub/a.txt", []byte("content"))
+
+	w := serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, env.downloadTarget(fileID), nil), nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get(checksumHeader); got != "" {
+		t.Fatalf("download %s = %q, want none", checksumHeader, got)
+	}
+
+	w = serveAnonymous(env.public.ServePublicFile, newRequest(http.MethodGet, "/files/photos/pub/a.txt", nil),
+		map[string]string{"bucket_name": "photos", "file_path": "pub/a.txt"})
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get(checksumHeader); got != "" {
+		t.Fatalf("public %s = %q, want none", checksumHeader, got)
+	}
+}
@@ -8,13 +8,13 @@ import (
 	"strconv"
 	"time"
 
+	"file-upload-service/logger"
 	"file-upload-service/models"
 
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
 	"github.com/umakantv/go-utils/errs"
 	"github.com/umakantv/go-utils/httpserver"
-	logger "github.com/umakantv/go-utils/logger"
 	"go.uber.org/zap"
 )
 
@@ -72,11 +72,15 @@ func generateClientCredentials(name string) (string, string) {
 // toClientResponse converts Client to ClientResponse (hides secret)
 func toClientResponse(client models.Client) models.ClientResponse {
 	return models.ClientResponse{
-		ID:        client.ID,
-		Name:      client.Name,
-		ClientID:  client.ClientID,
-		CreatedAt: client.CreatedAt,
-		UpdatedAt: client.UpdatedAt,
+		ID:             client.ID,
+		Name:           client.Name,
+		ClientID:       client.ClientID,
+		ShortURLs:      client.ShortURLs,
+		LastUsedAt:     client.LastUsedAt,
+		LastDownloadAt: client.LastDownloadAt,
+		InactivityDays: client.InactivityDays,
+		CreatedAt:      client.CreatedAt,
+		UpdatedAt:      client.UpdatedAt,
 	}
 }
 
@@ -102,12 +106,12 @@ func (h *ClientHandler) CreateClient(ctx context.Context, w http.ResponseWriter,
 
 	// Generate credentials
 	clientID, clientSecret := generateClientCredentials(req.Name)
-	now := time.Now()
+	now := time.Now().UTC()
 
 	// Insert client
 	result, err := h.db.Exec(
-		"INSERT INTO clients (name, client_id, client_secret, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
-		req.Name, clientID, clientSecret, now, now,
+		"INSERT INTO clients (name, client_id, client_secret, short_urls, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+		req.Name, clientID, clientSecret, req.ShortURLs, now, now,
 	)
 	if err != nil {
 		h.logRequest(ctx, "error", "Failed to create client", zap.Error(err))
@@ -126,6 +130,7 @@ func (h *ClientHandler) CreateClient(ctx context.Context, w http.ResponseWriter,
 		Name:         req.Name,
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
+		ShortURLs:    req.ShortURLs,
 		CreatedAt:    now,
 		UpdatedAt:    now,
 	}
@@ -140,7 +145,7 @@ func (h *ClientHandler) GetClients(ctx context.Context, w http.ResponseWriter, r
 	h.logRequest(ctx, "info", "Listing clients")
 
 	// Query database
-	rows, err := h.db.Query("SELECT id, name, client_id, created_at, updated_at FROM clients ORDER BY created_at DESC")
+	rows, err := h.db.Query("SELECT id, name, client_id, short_urls, last_used_at, last_download_at, inactivity_days, created_at, updated_at FROM clients ORDER BY created_at DESC")
 	if err != nil {
 		h.logRequest(ctx, "error", "Failed to query clients", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
@@ -152,7 +157,7 @@ func (h *ClientHandler) GetClients(ctx context.Context, w http.ResponseWriter, r
 	var clients []models.ClientResponse
 	for rows.Next() {
 		var client models.Client
-		err := rows.Scan(&client.ID, &client.Name, &client.ClientID, &client.CreatedAt, &client.UpdatedAt)
+		err := rows.Scan(&client.ID, &client.Name, &client.ClientID, &client.ShortURLs, &client.LastUsedAt, &client.LastDownloadAt, &client.InactivityDays, &client.CreatedAt, &client.UpdatedAt)
 		if err != nil {
 			h.logRequest(ctx, "error", "Failed to scan client", zap.Error(err))
 			continue
@@ -183,8 +188,8 @@ func (h *ClientHandler) GetClient(ctx context.Context, w http.ResponseWriter, r
 
 	// Query database (without returning secret)
 	var client models.Client
-	err = h.db.QueryRow("SELECT id, name, client_id, created_at, updated_at FROM clients WHERE id = ?", id).
-		Scan(&client.ID, &client.Name, &client.ClientID, &client.CreatedAt, &client.UpdatedAt)
+	err = h.db.QueryRow("SELECT id, name, client_id, short_urls, last_used_at, last_download_at, inactivity_days, created_at, updated_at FROM clients WHERE id = ?", id).
+		Scan(&client.ID, &client.Name, &client.ClientID, &client.ShortURLs, &client.LastUsedAt, &client.LastDownloadAt, &client.InactivityDays, &client.CreatedAt, &client.UpdatedAt)
 
 	if err == sql.ErrNoRows {
 		h.logRequest(ctx, "info", "Client not found", zap.Int("client_id", id))
@@ -203,4 +208,62 @@ func (h *ClientHandler) GetClient(ctx context.Context, w http.ResponseWriter, r
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(toClientResponse(client))
-}
\ No newline at end of file
+}
+
+// UpdateClient handles PUT /clients/{id} - change a client's settings
+func (h *ClientHandler) UpdateClient(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid client ID", zap.String("id", idStr))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid client ID"))
+		return
+	}
+
+	var req models.UpdateClientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+
+	if req.InactivityDays != nil && *req.InactivityDays < 0 {
+		h.logRequest(ctx, "error", "Invalid inactivity_days", zap.Int("inactivity_days", *req.InactivityDays))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("inactivity_days cannot be negative"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Updating client", zap.Int("client_id", id))
+
+	var client models.Client
+	err = h.db.QueryRow(
+		`UPDATE clients SET short_urls = COALESCE(?, short_urls),
+			inactivity_days = CASE WHEN ? IS NULL THEN inactivity_days ELSE NULLIF(?, 0) END,
+			updated_at = ? WHERE id = ?
+		 RETURNING id, name, client_id, short_urls, last_used_at, last_download_at, inactivity_days, created_at, updated_at`,
+		req.ShortURLs, req.InactivityDays, req.InactivityDays, time.Now().UTC(), id,
+	).Scan(&client.ID, &client.Name, &client.ClientID, &client.ShortURLs, &client.LastUsedAt, &client.LastDownloadAt, &client.InactivityDays, &client.CreatedAt, &client.UpdatedAt)
+
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "info", "Client not found", zap.Int("client_id", id))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Client not found"))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to update client", zap.Error(err), zap.Int("client_id", id))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Database error"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Client updated successfully", zap.Int("client_id", id), zap.Bool("short_urls", client.ShortURLs))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toClientResponse(client))
+}
@@ -0,0 +1,446 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// clientActivityResolution is how stale a client's last_used_at or last_download_at may
+// get before activity writes it again, so busy clients cost one write an hour
+const clientActivityResolution = time.Hour
+
+// inactivityActor is the audit actor of changes the inactivity policy makes on its own
+const inactivityActor = "inactivity-policy"
+
+// TouchClientLastUsed records an authenticated request by the client. A client flagged by
+// the inactivity policy is active again and no longer flagged.
+func TouchClientLastUsed(exec sqlx.Execer, clientID string, now time.Time) error {
+	_, err := exec.Exec(
+		`UPDATE clients SET last_used_at = ?, inactive_flagged_at = NULL, inactive_archived_at = NULL
+		 WHERE client_id = ? AND (last_used_at IS NULL OR last_used_at < ?)`,
+		now, clientID, now.Add(-clientActivityResolution),
+	)
+	return err
+}
+
+// touchClientDownload records a download of one of the client's files, which keeps the
+// client active like its own requests do
+func touchClientDownload(exec sqlx.Execer, clientID string, now time.Time) error {
+	_, err := exec.Exec(
+		`UPDATE clients SET last_download_at = ?, inactive_flagged_at = NULL, inactive_archived_at = NULL
+		 WHERE client_id = ? AND (last_download_at IS NULL OR last_download_at < ?)`,
+		now, clientID, now.Add(-clientActivityResolution),
+	)
+	return err
+}
+
+// StartInactivitySweeper flags clients idle past their inactivity limit and archives the
+// buckets of those still idle after the grace period, on the replica holding the lease
+func (h *FileHandler) StartInactivitySweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			h.jobs.runPeriodic(inactivitySweeperLease, h.sweepInactiveClients)
+		}
+	}()
+}
+
+// sweepInactiveClients runs one pass of the inactivity policy: archive first, so a client
+// flagged in this pass is never archived in the same one
+func (h *FileHandler) sweepInactiveClients(ctx context.Context) {
+	now := time.Now().UTC()
+	h.archiveInactiveClients(ctx, now)
+	h.flagInactiveClients(ctx, now)
+}
+
+// idleClient is a client the sweeper is checking against its inactivity limit
+type idleClient struct {
+	ClientID       string
+	Name           string
+	CreatedAt      time.Time
+	LastUsedAt     sql.NullTime
+	LastDownloadAt sql.NullTime
+	InactivityDays int
+}
+
+// lastActiveAt is the later of the client's last request and last download, or its
+// creation when it has had neither
+func (c *idleClient) lastActiveAt() time.Time {
+	if !c.LastUsedAt.Valid && !c.LastDownloadAt.Valid {
+		return c.CreatedAt
+	}
+	if c.LastDownloadAt.Valid && (!c.LastUsedAt.Valid || c.LastDownloadAt.Time.After(c.LastUsedAt.Time)) {
+		return c.LastDownloadAt.Time
+	}
+	return c.LastUsedAt.Time
+}
+
+// queryIdleClients loads the clients matching a condition on the clients table
+func (h *FileHandler) queryIdleClients(condition string, args ...interface{}) ([]idleClient, error) {
+	rows, err := h.db.Query(
+		`SELECT client_id, name, created_at, last_used_at, last_download_at, COALESCE(inactivity_days, ?)
+		 FROM clients WHERE `+condition+` ORDER BY client_id`,
+		append([]interface{}{h.config.InactivityDays}, args...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []idleClient
+	for rows.Next() {
+		var c idleClient
+		if err := rows.Scan(&c.ClientID, &c.Name, &c.CreatedAt, &c.LastUsedAt, &c.LastDownloadAt, &c.InactivityDays); err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+// flagInactiveClients flags every unflagged, non-exempt client whose last activity is older
+// than its inactivity limit, records it in the audit log and notifies the webhook
+func (h *FileHandler) flagInactiveClients(ctx context.Context, now time.Time) {
+	candidates, err := h.queryIdleClients(
+		"inactivity_exempt = 0 AND inactive_flagged_at IS NULL AND COALESCE(inactivity_days, ?) > 0",
+		h.config.InactivityDays,
+	)
+	if err != nil {
+		logger.Error("Failed to query clients for inactivity", zap.Error(err))
+		return
+	}
+	var idle []idleClient
+	for _, c := range candidates {
+		if c.lastActiveAt().Before(now.Add(-time.Duration(c.InactivityDays) * 24 * time.Hour)) {
+			idle = append(idle, c)
+		}
+	}
+
+	for _, c := range idle {
+		if ctx.Err() != nil {
+			return
+		}
+		flagged, err := h.flagInactiveClient(&c, now)
+		if err != nil {
+			logger.Error("Failed to flag inactive client", zap.String("client_id", c.ClientID), zap.Error(err))
+			continue
+		}
+		if !flagged {
+			continue
+		}
+		archiveAfter := now.Add(h.config.InactivityGrace)
+		logger.Info("Flagged inactive client",
+			zap.String("client_id", c.ClientID),
+			zap.Time("last_active_at", c.lastActiveAt()),
+			zap.Time("archive_after", archiveAfter),
+		)
+		h.sendInactivityWebhook(models.InactivityWebhookPayload{
+			Event:        models.InactivityEventFlagged,
+			ClientID:     c.ClientID,
+			ClientName:   c.Name,
+			LastActiveAt: c.lastActiveAt(),
+			ArchiveAfter: &archiveAfter,
+			OccurredAt:   now,
+		})
+	}
+}
+
+// flagInactiveClient flags one client with its audit event. The update re-checks the
+// activity columns, so a client that made a request since it was read is left alone.
+func (h *FileHandler) flagInactiveClient(c *idleClient, now time.Time) (bool, error) {
+	cutoff := now.Add(-time.Duration(c.InactivityDays) * 24 * time.Hour)
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`UPDATE clients SET inactive_flagged_at = ?
+		 WHERE client_id = ? AND inactive_flagged_at IS NULL AND inactivity_exempt = 0
+		 AND (last_used_at IS NULL OR last_used_at < ?) AND (last_download_at IS NULL OR last_download_at < ?)`,
+		now, c.ClientID, cutoff, cutoff,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	if err := recordAuditEvent(tx, models.AuditEvent{
+		Action:   models.AuditActionClientInactive,
+		Actor:    inactivityActor,
+		ClientID: c.ClientID,
+		Detail: map[string]interface{}{
+			"last_active_at":  c.lastActiveAt(),
+			"inactivity_days": c.InactivityDays,
+			"archive_after":   now.Add(h.config.InactivityGrace),
+		},
+	}, now); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// archiveInactiveClients archives the buckets of clients flagged longer than the grace
+// period ago. Buckets are only ever archived, never deleted.
+func (h *FileHandler) archiveInactiveClients(ctx context.Context, now time.Time) {
+	idle, err := h.queryIdleClients(
+		"inactivity_exempt = 0 AND inactive_archived_at IS NULL AND inactive_flagged_at IS NOT NULL AND inactive_flagged_at <= ?",
+		now.Add(-h.config.InactivityGrace),
+	)
+	if err != nil {
+		logger.Error("Failed to query flagged clients", zap.Error(err))
+		return
+	}
+
+	for _, c := range idle {
+		if ctx.Err() != nil {
+			return
+		}
+		bucketIDs, archived, err := h.archiveInactiveClient(c.ClientID, now)
+		if err != nil {
+			logger.Error("Failed to archive inactive client", zap.String("client_id", c.ClientID), zap.Error(err))
+			continue
+		}
+		if !archived {
+			continue
+		}
+		logger.Info("Archived buckets of inactive client", zap.String("client_id", c.ClientID), zap.Ints("bucket_ids", bucketIDs))
+
+		h.sendInactivityWebhook(models.InactivityWebhookPayload{
+			Event:        models.InactivityEventArchived,
+			ClientID:     c.ClientID,
+			ClientName:   c.Name,
+			LastActiveAt: c.lastActiveAt(),
+			BucketIDs:    bucketIDs,
+			OccurredAt:   now,
+		})
+	}
+}
+
+// archiveInactiveClient archives a flagged client's live buckets and marks it archived in
+// one transaction with its audit event. It reports false when the client was unflagged or
+// exempted in the meantime.
+func (h *FileHandler) archiveInactiveClient(clientID string, now time.Time) ([]int, bool, error) {
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`UPDATE clients SET inactive_archived_at = ?
+		 WHERE client_id = ? AND inactive_flagged_at IS NOT NULL AND inactive_archived_at IS NULL AND inactivity_exempt = 0`,
+		now, clientID,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, false, nil
+	}
+
+	bucketIDs := []int{}
+	if err := tx.Select(&bucketIDs,
+		"UPDATE buckets SET archived = 1, archive_mode = ?, updated_at = ? WHERE client_id = ? AND archived = 0 RETURNING id",
+		models.ArchiveModeFreezeAll, now, clientID,
+	); err != nil {
+		return nil, false, err
+	}
+
+	if err := recordAuditEvent(tx, models.AuditEvent{
+		Action:   models.AuditActionClientArchived,
+		Actor:    inactivityActor,
+		ClientID: clientID,
+		Detail:   map[string]interface{}{"bucket_ids": bucketIDs},
+	}, now); err != nil {
+		return nil, false, err
+	}
+	return bucketIDs, true, tx.Commit()
+}
+
+// inactivityWebhookClient posts to the operator's INACTIVITY_WEBHOOK_URL. Unlike upload
+// callbacks the URL is configured by the operator, so it may point inside the network.
+var inactivityWebhookClient = &http.Client{Timeout: uploadCallbackTimeout}
+
+// sendInactivityWebhook delivers a policy event to INACTIVITY_WEBHOOK_URL, retrying with
+// the same backoff as upload callbacks. The audit event is already recorded, so failures
+// are only logged.
+func (h *FileHandler) sendInactivityWebhook(payload models.InactivityWebhookPayload) {
+	if h.config.InactivityWebhookURL == "" {
+		return
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.Error("Failed to encode inactivity webhook", zap.String("client_id", payload.ClientID), zap.Error(err))
+		return
+	}
+
+	backoff := uploadCallbackBackoff
+	for attempt := 1; attempt <= uploadCallbackAttempts; attempt++ {
+		resp, err := inactivityWebhookClient.Post(h.config.InactivityWebhookURL, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+				return
+			}
+			err = fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+		}
+		logger.Error("Inactivity webhook attempt failed",
+			zap.String("client_id", payload.ClientID),
+			zap.String("event", payload.Event),
+			zap.Int("attempt", attempt),
+			zap.Error(err),
+		)
+		if attempt < uploadCallbackAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// ListInactiveClients handles GET /admin/inactive-clients - clients the inactivity policy
+// flagged, with when their buckets are or were archived, and clients exempt from it
+func (h *FileHandler) ListInactiveClients(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(ctx, w) {
+		return
+	}
+	cursor := r.URL.Query().Get("cursor")
+	maxRows := h.config.MaxSyncRows
+
+	rows, err := h.db.Query(
+		`SELECT client_id, name, last_used_at, last_download_at, COALESCE(inactivity_days, ?),
+			inactivity_exempt, inactive_flagged_at, inactive_archived_at
+		 FROM clients
+		 WHERE (inactive_flagged_at IS NOT NULL OR inactivity_exempt = 1) AND client_id > ?
+		 ORDER BY client_id LIMIT ?`,
+		h.config.InactivityDays, cursor, maxRows+1,
+	)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query inactive clients", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to list inactive clients"))
+		return
+	}
+	defer rows.Close()
+
+	clients := make([]models.InactiveClient, 0)
+	for rows.Next() {
+		var c models.InactiveClient
+		if err := rows.Scan(&c.ClientID, &c.Name, &c.LastUsedAt, &c.LastDownloadAt, &c.InactivityDays,
+			&c.Exempt, &c.FlaggedAt, &c.ArchivedAt); err != nil {
+			h.logRequest(ctx, "error", "Failed to scan inactive client", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to list inactive clients"))
+			return
+		}
+		if c.FlaggedAt != nil {
+			archiveAfter := c.FlaggedAt.Add(h.config.InactivityGrace)
+			c.ArchiveAfter = &archiveAfter
+		}
+		clients = append(clients, c)
+	}
+
+	response := models.InactiveClientListResponse{Clients: clients}
+	if len(clients) > maxRows {
+		response.Clients = clients[:maxRows]
+		response.Truncated = true
+		response.NextCursor = clients[maxRows-1].ClientID
+	}
+
+	h.logRequest(ctx, "info", "Listed inactive clients", zap.Int("count", len(response.Clients)))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ExemptInactiveClient handles POST /admin/inactive-clients/{client_id}/exempt - keep a
+// client out of the inactivity policy. Its flag is cleared, so once the exemption is
+// removed the clock restarts from its last activity.
+func (h *FileHandler) ExemptInactiveClient(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	h.setInactivityExempt(ctx, w, r, true)
+}
+
+// UnexemptInactiveClient handles DELETE /admin/inactive-clients/{client_id}/exempt - put
+// a client back under the inactivity policy
+func (h *FileHandler) UnexemptInactiveClient(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	h.setInactivityExempt(ctx, w, r, false)
+}
+
+// setInactivityExempt sets or clears a client's exemption with its audit event
+func (h *FileHandler) setInactivityExempt(ctx context.Context, w http.ResponseWriter, r *http.Request, exempt bool) {
+	if !h.requireAdmin(ctx, w) {
+		return
+	}
+	clientID := mux.Vars(r)["client_id"]
+	auth := httpserver.GetRequestAuth(ctx)
+	now := time.Now().UTC()
+
+	action := models.AuditActionClientUnexempted
+	if exempt {
+		action = models.AuditActionClientExempted
+	}
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to begin transaction", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to update client"))
+		return
+	}
+	defer tx.Rollback()
+
+	var c models.InactiveClient
+	err = tx.QueryRow(
+		`UPDATE clients SET inactivity_exempt = ?,
+			inactive_flagged_at = CASE WHEN ? THEN NULL ELSE inactive_flagged_at END,
+			inactive_archived_at = CASE WHEN ? THEN NULL ELSE inactive_archived_at END
+		 WHERE client_id = ?
+		 RETURNING client_id, name, last_used_at, last_download_at, COALESCE(inactivity_days, ?), inactivity_exempt`,
+		exempt, exempt, exempt, clientID, h.config.InactivityDays,
+	).Scan(&c.ClientID, &c.Name, &c.LastUsedAt, &c.LastDownloadAt, &c.InactivityDays, &c.Exempt)
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "info", "Client not found", zap.String("client_id", clientID))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Client not found"))
+		return
+	}
+	if err == nil {
+		err = recordAuditEvent(tx, models.AuditEvent{Action: action, Actor: auth.Client, ClientID: clientID}, now)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to update inactivity exemption", zap.String("client_id", clientID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to update client"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Updated inactivity exemption", zap.String("client_id", clientID), zap.Bool("exempt", exempt))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(c)
+}
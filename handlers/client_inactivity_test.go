@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"file-upload-service/models"
+)
+
+// inactivityWebhook records the payloads the inactivity policy posts
+type inactivityWebhook struct {
+	mu       sync.Mutex
+	payloads []models.InactivityWebhookPayload
+}
+
+func (h *inactivityWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var payload models.InactivityWebhookPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	h.mu.Lock()
+	h.payloads = append(h.payloads, payload)
+	h.mu.Unlock()
+}
+
+// events lists the events received for a client
+func (h *inactivityWebhook) events(clientID string) []models.InactivityWebhookPayload {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var events []models.InactivityWebhookPayload
+	for _, payload := range h.payloads {
+		if payload.ClientID == clientID {
+			events = append(events, payload)
+		}
+	}
+	return events
+}
+
+// newInactivityEnv is a test env with a 30 day inactivity limit, a 7 day grace period
+// and a recording webhook
+func newInactivityEnv(t *testing.T) (*testEnv, *inactivityWebhook) {
+	env := newTestEnv(t)
+	webhook := &inactivityWebhook{}
+	srv := httptest.NewServer(webhook)
+	t.Cleanup(srv.Close)
+	env.cfg.InactivityDays = 30
+	env.cfg.InactivityGrace = 7 * 24 * time.Hour
+	env.cfg.InactivityWebhookURL = srv.URL
+	return env, webhook
+}
+
+// backdateClient makes a client's last request days old
+func (e *testEnv) backdateClient(clientID string, days int) {
+	e.db.MustExec("UPDATE clients SET last_used_at = ? WHERE client_id = ?", time.Now().UTC().AddDate(0, 0, -days), clientID)
+}
+
+// backdateFlag moves a client's flag days into the past
+func (e *testEnv) backdateFlag(clientID string, days int) {
+	e.db.MustExec("UPDATE clients SET inactive_flagged_at = ? WHERE client_id = ?", time.Now().UTC().AddDate(0, 0, -days), clientID)
+}
+
+// inactivityState reads whether a client is flagged and archived
+func (e *testEnv) inactivityState(clientID string) (flagged, archived bool) {
+	e.t.Helper()
+	var state struct {
+		Flagged  bool `db:"flagged"`
+		Archived bool `db:"archived"`
+	}
+	if err := e.db.Get(&state, `SELECT inactive_flagged_at IS NOT NULL AS flagged, inactive_archived_at IS NOT NULL AS archived
+		FROM clients WHERE client_id = ?`, clientID); err != nil {
+		e.t.Fatal(err)
+	}
+	return state.Flagged, state.Archived
+}
+
+// bucketArchived reads whether a bucket is archived
+func (e *testEnv) bucketArchived(bucketID int) bool {
+	e.t.Helper()
+	var archived bool
+	if err := e.db.Get(&archived, "SELECT archived FROM buckets WHERE id = ?", bucketID); err != nil {
+		e.t.Fatal(err)
+	}
+	return archived
+}
+
+func TestInactiveClientIsFlaggedNotifiedThenArchived(t *testing.T) {
+	env, webhook := newInactivityEnv(t)
+	bucketID := env.createBucket("photos")
+	env.backdateClient(env.clientID, 40)
+
+	env.files.sweepInactiveClients(context.Background())
+	if flagged, archived := env.inactivityState(env.clientID); !flagged || archived {
+		t.Fatalf("after the first sweep flagged=%v archived=%v, want flagged only", flagged, archived)
+	}
+	if env.bucketArchived(bucketID) {
+		t.Fatal("bucket archived when the client was only flagged")
+	}
+	events := webhook.events(env.clientID)
+	if len(events) != 1 || events[0].Event != models.InactivityEventFlagged || events[0].ArchiveAfter == nil {
+		t.Fatalf("webhook events = %+v, want one flagged event with archive_after", events)
+	}
+	if n := env.rowsFor("audit_events", "client_id", env.clientID); n != 1 {
+		t.Fatalf("%d audit events after flagging, want 1", n)
+	}
+
+	// Within the grace period nothing more happens
+	env.files.sweepInactiveClients(context.Background())
+	if _, archived := env.inactivityState(env.clientID); archived || len(webhook.events(env.clientID)) != 1 {
+		t.Fatal("the client was archived or notified again within the grace period")
+	}
+
+	env.backdateFlag(env.clientID, 8)
+	env.files.sweepInactiveClients(context.Background())
+	if _, archived := env.inactivityState(env.clientID); !archived {
+		t.Fatal("the client was not archived after the grace period")
+	}
+	var bucket struct {
+		Archived    bool   `db:"archived"`
+		ArchiveMode string `db:"archive_mode"`
+	}
+	if err := env.db.Get(&bucket, "SELECT archived, archive_mode FROM buckets WHERE id = ?", bucketID); err != nil {
+		t.Fatal(err)
+	}
+	if !bucket.Archived || bucket.ArchiveMode != models.ArchiveModeFreezeAll {
+		t.Fatalf("bucket = %+v, want archived with freeze-all", bucket)
+	}
+	events = webhook.events(env.clientID)
+	if len(events) != 2 || events[1].Event != models.InactivityEventArchived || len(events[1].BucketIDs) != 1 || events[1].BucketIDs[0] != bucketID {
+		t.Fatalf("webhook events = %+v, want an archived event for bucket %d", events, bucketID)
+	}
+}
+
+func TestActivityClearsTheFlag(t *testing.T) {
+	env, webhook := newInactivityEnv(t)
+	bucketID := env.createBucket("photos")
+	env.backdateClient(env.clientID, 40)
+	env.files.sweepInactiveClients(context.Background())
+
+	if err := TouchClientLastUsed(env.db, env.clientID, time.Now().UTC()); err != nil {
+		t.Fatal(err)
+	}
+	env.files.sweepInactiveClients(context.Background())
+	if flagged, archived := env.inactivityState(env.clientID); flagged || archived {
+		t.Fatalf("flagged=%v archived=%v after a request, want neither", flagged, archived)
+	}
+	if env.bucketArchived(bucketID) || len(webhook.events(env.clientID)) != 1 {
+		t.Fatal("an active client was archived or notified again")
+	}
+}
+
+func TestExemptClientIsNeverArchived(t *testing.T) {
+	env, webhook := newInactivityEnv(t)
+	partner := env.addClient("partner")
+	env.db.MustExec("INSERT INTO buckets (name, client_id, cors_policy, public_paths, created_at, updated_at) VALUES ('shared', ?, '[]', '[]', ?, ?)",
+		partner, time.Now().UTC(), time.Now().UTC())
+	var bucketID int
+	if err := env.db.Get(&bucketID, "SELECT id FROM buckets WHERE client_id = ?", partner); err != nil {
+		t.Fatal(err)
+	}
+	env.backdateClient(partner, 400)
+
+	w := serveAdmin(env.files.ExemptInactiveClient, newRequest(http.MethodPost, "/admin/inactive-clients/"+partner+"/exempt", nil),
+		map[string]string{"client_id": partner})
+	expectStatus(t, w, http.StatusOK)
+
+	env.files.sweepInactiveClients(context.Background())
+	if flagged, _ := env.inactivityState(partner); flagged {
+		t.Fatal("an exempt client was flagged")
+	}
+
+	// Even a flag left from before the exemption never leads to archiving
+	env.backdateFlag(partner, 30)
+	env.files.sweepInactiveClients(context.Background())
+	if _, archived := env.inactivityState(partner); archived || env.bucketArchived(bucketID) {
+		t.Fatal("an exempt client was archived")
+	}
+	if events := webhook.events(partner); len(events) != 0 {
+		t.Fatalf("webhook events for an exempt client: %+v", events)
+	}
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"strings"
+
+	"file-upload-service/models"
+)
+
+// trustedProxy reports whether ip belongs to one of the TRUSTED_PROXIES
+func trustedProxy(ip net.IP, proxies []*net.IPNet) bool {
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestIP returns the address a request came from
+func (h *FileHandler) requestIP(r *http.Request) string {
+	return clientIP(r, h.config.TrustedProxies)
+}
+
+// clientIP returns the address a request came from. X-Forwarded-For is only believed when
+// the connection comes from a trusted proxy, and then it is read from the right: each hop
+// is appended by the proxy it passed through, so the first address that is not a trusted
+// proxy is the client. Anything to its left was sent by the client and could be forged.
+func clientIP(r *http.Request, proxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && trustedProxy(ip, proxies); i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip.String()
+}
+
+// maxUploaderUserAgentLength is how much of an uploader's User-Agent is kept
+const maxUploaderUserAgentLength = 512
+
+// uploaderInfo is where the bytes of an unauthenticated upload came from. It is kept on
+// the file for abuse investigations and only shown to the file's client.
+type uploaderInfo struct {
+	IP        string
+	UserAgent string
+}
+
+// uploaderOf returns where an upload request came from
+func (h *FileHandler) uploaderOf(r *http.Request) uploaderInfo {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUploaderUserAgentLength {
+		userAgent = userAgent[:maxUploaderUserAgentLength]
+	}
+	return uploaderInfo{IP: h.requestIP(r), UserAgent: userAgent}
+}
+
+// columns returns the uploader_ip and uploader_user_agent values of a file; NULL when the
+// upload was authenticated and nothing was recorded
+func (u uploaderInfo) columns() (ip, userAgent sql.NullString) {
+	return sql.NullString{String: u.IP, Valid: u.IP != ""},
+		sql.NullString{String: u.UserAgent, Valid: u.UserAgent != ""}
+}
+
+// sameIP reports whether two addresses are the same, treating an IPv4 address and its
+// IPv4-mapped IPv6 form as equal
+func sameIP(a, b string) bool {
+	if ipA, ipB := net.ParseIP(a), net.ParseIP(b); ipA != nil && ipB != nil {
+		return ipA.Equal(ipB)
+	}
+	return a == b
+}
+
+// restrictUploadIP binds a prepared upload's token to the address req asks for: its
+// allowed_ip, or the address the signing request came from
+func (h *FileHandler) restrictUploadIP(r *http.Request, upload *pendingUpload, req models.CreateSignedURLRequest) {
+	if !req.RestrictIP {
+		return
+	}
+	if req.AllowedIP != "" {
+		upload.TokenData.AllowedIP = net.ParseIP(req.AllowedIP).String()
+		return
+	}
+	upload.TokenData.AllowedIP = h.requestIP(r)
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"os"
+	"strings"
+)
+
+// defaultCompressionMinBytes is the smallest file compressed when a bucket does not set
+// compression_min_bytes; below it the savings do not pay for the work
+const defaultCompressionMinBytes = 1024
+
+// errCompressionMinBytes is returned for a negative compression_min_bytes
+var errCompressionMinBytes = errors.New("compression_min_bytes must be 0 or greater")
+
+// compressibleMimetypes are the types besides text/* the public route compresses. Images,
+// video, audio and archives are compressed already and are never compressed again; SVG is
+// the one image type made of text.
+var compressibleMimetypes = map[string]bool{
+	"application/javascript":    true,
+	"application/json":          true,
+	"application/ld+json":       true,
+	"application/manifest+json": true,
+	"application/wasm":          true,
+	"application/xml":           true,
+	"image/svg+xml":             true,
+}
+
+// compressibleMimetype reports whether content of a type, parameters aside, is compressed
+func compressibleMimetype(contentType string) bool {
+	mimetype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mimetype, "text/") || compressibleMimetypes[mimetype]
+}
+
+// contentEncodings are the encodings the public route compresses with, most preferred first,
+// with the file extension their cached copies are stored under
+var contentEncodings = []struct {
+	Name      string
+	Extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// acceptedEncoding returns the name and extension of the most preferred encoding an
+// Accept-Encoding header allows, by name or through "*". br is only offered when the
+// brotli tool was found.
+func acceptedEncoding(acceptEncoding string, brotli bool) (string, string, bool) {
+	accepted, refused := parseAcceptList(acceptEncoding)
+	for _, encoding := range contentEncodings {
+		if encoding.Name == "br" && !brotli {
+			continue
+		}
+		if accepted[encoding.Name] || (accepted["*"] && !refused[encoding.Name]) {
+			return encoding.Name, encoding.Extension, true
+		}
+	}
+	return "", "", false
+}
+
+// compressContent compresses the content at sourcePath with encoding. Files up to
+// COMPRESS_INLINE_MAX_BYTES are gzipped in memory for each request and returned as bytes;
+// larger ones, and every br copy, are compressed once into compressedPath and returned
+// opened, made again once older than the source. Both are nil when compressing does not
+// make the content smaller, which is then better served as it is.
+func (h *PublicFileHandler) compressContent(ctx context.Context, sourcePath string, source os.FileInfo, compressedPath, encoding string) ([]byte, *os.File, error) {
+	if encoding == "gzip" && source.Size() <= h.config.CompressInlineMaxBytes {
+		src, err := os.Open(sourcePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer src.Close()
+		var buf bytes.Buffer
+		if err := gzipTo(&buf, src, gzip.DefaultCompression); err != nil {
+			return nil, nil, err
+		}
+		if int64(buf.Len()) >= source.Size() {
+			return nil, nil, nil
+		}
+		return buf.Bytes(), nil, nil
+	}
+
+	f, err := h.openDerived(ctx, compressedPath, source, func() error {
+		if encoding == "br" {
+			return runTool(ctx, h.config.ImageEncodeTimeout, compressedPath, h.brotli, func(tmpPath string) []string {
+				return []string{"-q", "11", "-f", "-o", tmpPath, sourcePath}
+			})
+		}
+		src, err := os.Open(sourcePath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			pw.CloseWithError(gzipTo(pw, src, gzip.BestCompression))
+		}()
+		// Incompressible content grows by a few bytes per block at most
+		_, err = storeFile(compressedPath, pr, 2*source.Size()+1024, nil)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if info.Size() >= source.Size() {
+		f.Close()
+		return nil, nil, nil
+	}
+	return nil, f, nil
+}
+
+// gzipTo writes src to dst gzipped at level
+func gzipTo(dst io.Writer, src io.Reader, level int) error {
+	zw, err := gzip.NewWriterLevel(dst, level)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, src); err != nil {
+		return err
+	}
+	return zw.Close()
+}
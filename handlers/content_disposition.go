@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxDownloadFilenameLength caps the download_filename of a download URL, in bytes
+const maxDownloadFilenameLength = 255
+
+// validateDownloadFilename checks a download_filename chosen for a download URL
+func validateDownloadFilename(name string) error {
+	if strings.TrimSpace(name) == "" || len(name) > maxDownloadFilenameLength || !utf8.ValidString(name) {
+		return fmt.Errorf("download_filename must be between 1 and %d bytes of UTF-8", maxDownloadFilenameLength)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return errors.New("download_filename must not contain control characters")
+		}
+	}
+	return nil
+}
+
+// contentDisposition builds a Content-Disposition header value (RFC 6266) for a file
+// named filename. Control characters are dropped, so no name can break the header. The
+// filename parameter carries an ASCII fallback for old clients, with characters outside
+// printable ASCII and the quotes and backslashes a quoted string would need escaped
+// replaced by "_"; filename* carries the full name, percent-encoded UTF-8 (RFC 5987).
+func contentDisposition(disposition, filename string) string {
+	var fallback, encoded strings.Builder
+	for _, r := range strings.ToValidUTF8(filename, "") {
+		if unicode.IsControl(r) {
+			continue
+		}
+		if r < utf8.RuneSelf && r != '"' && r != '\\' {
+			fallback.WriteRune(r)
+		} else {
+			fallback.WriteByte('_')
+		}
+		var buf [utf8.UTFMax]byte
+		for _, b := range buf[:utf8.EncodeRune(buf[:], r)] {
+			if isAttrChar(b) {
+				encoded.WriteByte(b)
+			} else {
+				fmt.Fprintf(&encoded, "%%%02X", b)
+			}
+		}
+	}
+	if strings.TrimSpace(fallback.String()) == "" {
+		return fmt.Sprintf(`%s; filename="download"`, disposition)
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback.String(), encoded.String())
+}
+
+// isAttrChar reports whether b may appear unencoded in an RFC 5987 ext-value
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"file-upload-service/models"
+)
+
+func TestDownloadFilenameOverride(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "docs/a.pdf", []byte("content"))
+
+	target := env.downloadTargetFor(models.GenerateDownloadSignedURLRequest{FileID: fileID, DownloadFilename: "résumé — final.pdf"})
+	w := serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, target, nil), nil)
+	expectStatus(t, w, http.StatusOK)
+
+	want := `attachment; filename="r_sum_ _ final.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9%20%E2%80%94%20final.pdf`
+	if got := w.Header().Get("Content-Disposition"); got != want {
+		t.Fatalf("Content-Disposition = %q, want %q", got, want)
+	}
+}
+
+func TestDownloadOfStoredNameWithControlCharacters(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "docs/a.txt", []byte("content"))
+	env.db.MustExec("UPDATE files SET file_name = ? WHERE id = ?", "a\"b\r\nSet-Cookie: x=1.txt", fileID)
+
+	w := serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, env.downloadTarget(fileID), nil), nil)
+	expectStatus(t, w, http.StatusOK)
+
+	got := w.Header().Get("Content-Disposition")
+	if strings.ContainsAny(got, "\r\n") {
+		t.Fatalf("Content-Disposition holds a line break: %q", got)
+	}
+	want := `attachment; filename="a_bSet-Cookie: x=1.txt"; filename*=UTF-8''a%22bSet-Cookie%3A%20x%3D1.txt`
+	if got != want {
+		t.Fatalf("Content-Disposition = %q, want %q", got, want)
+	}
+}
+
+func TestDownloadFilenameRejected(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "docs/a.txt", []byte("content"))
+
+	for _, name := range []string{"a\r\nb.txt", "   ", strings.Repeat("a", maxDownloadFilenameLength+1)} {
+		w := env.serve(env.files.GenerateDownloadSignedURL, newRequest(http.MethodPost, "/files/download-url",
+			models.GenerateDownloadSignedURLRequest{FileID: fileID, DownloadFilename: name}), nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("download_filename %q: status = %d, want %d", name, w.Code, http.StatusBadRequest)
+		}
+	}
+}
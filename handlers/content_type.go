@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// sniffLen is the number of leading bytes http.DetectContentType looks at
+const sniffLen = 512
+
+// mimetypeAliases maps common non-standard spellings to the type DetectContentType reports
+var mimetypeAliases = map[string]string{
+	"image/jpg":         "image/jpeg",
+	"image/pjpeg":       "image/jpeg",
+	"application/gzip":  "application/x-gzip",
+	"application/x-pdf": "application/pdf",
+	"audio/mp3":         "audio/mpeg",
+	"audio/x-wav":       "audio/wave",
+	"audio/wav":         "audio/wave",
+	"video/x-msvideo":   "video/avi",
+}
+
+// textualMimetypes are non text/* types whose content is plain text to the sniffer
+var textualMimetypes = map[string]bool{
+	"application/json":       true,
+	"application/xml":        true,
+	"application/javascript": true,
+	"application/x-ndjson":   true,
+	"application/x-yaml":     true,
+	"application/yaml":       true,
+	"application/sql":        true,
+	"image/svg+xml":          true,
+}
+
+// zipContainerMimetypes are formats stored as zip archives, which the sniffer reports as application/zip
+var zipContainerMimetypes = map[string]bool{
+	"application/zip":          true,
+	"application/java-archive": true,
+	"application/epub+zip":     true,
+}
+
+// sniffContentType reads the first bytes of src and detects their content type.
+// It returns the detected type without parameters and a reader that replays the
+// sniffed bytes followed by the rest of src.
+func sniffContentType(src io.Reader) (string, io.Reader, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	head = head[:n]
+	return normalizeMimetype(http.DetectContentType(head)), io.MultiReader(bytes.NewReader(head), src), nil
+}
+
+// normalizeMimetype lowercases a media type, drops its parameters and resolves aliases
+func normalizeMimetype(mimetype string) string {
+	mediaType, _, err := mime.ParseMediaType(mimetype)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(mimetype))
+	}
+	if alias, ok := mimetypeAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+// isTextual reports whether content of the given type is plain text
+func isTextual(mimetype string) bool {
+	return strings.HasPrefix(mimetype, "text/") || textualMimetypes[mimetype] ||
+		strings.HasSuffix(mimetype, "+json") || strings.HasSuffix(mimetype, "+xml")
+}
+
+// isScriptable reports whether a browser displaying content of the given type may run
+// scripts in it
+func isScriptable(mimetype string) bool {
+	return mimetype == "text/html" || mimetype == "application/xhtml+xml" || mimetype == "image/svg+xml" ||
+		mimetype == "application/xml" || mimetype == "text/xml" || strings.HasSuffix(mimetype, "+xml")
+}
+
+// isZipContainer reports whether files of the given type are zip archives
+func isZipContainer(mimetype string) bool {
+	return zipContainerMimetypes[mimetype] ||
+		strings.HasPrefix(mimetype, "application/vnd.openxmlformats-officedocument.") ||
+		strings.HasPrefix(mimetype, "application/vnd.oasis.opendocument.")
+}
+
+// hasSignature reports whether the sniffer recognises files of the given type by
+// their leading bytes, so an unrecognised (application/octet-stream) body cannot be one
+func hasSignature(mimetype string) bool {
+	switch {
+	case strings.HasPrefix(mimetype, "image/") && mimetype != "image/svg+xml",
+		strings.HasPrefix(mimetype, "audio/"),
+		strings.HasPrefix(mimetype, "video/"),
+		strings.HasPrefix(mimetype, "font/"):
+		return true
+	}
+	return mimetype == "application/pdf" || mimetype == "application/x-gzip" ||
+		mimetype == "application/wasm" || isZipContainer(mimetype)
+}
+
+// mimetypesMatch reports whether sniffed content of type detected is acceptable for
+// an upload declared as declared. The sniffer only knows a limited set of signatures,
+// so the rules are deliberately forgiving: application/octet-stream accepts anything,
+// any text is accepted for a textual type, any zip for a zip-based format, and
+// unrecognised binary for any type the sniffer has no signature for.
+func mimetypesMatch(declared, detected string) bool {
+	declared = normalizeMimetype(declared)
+	detected = normalizeMimetype(detected)
+
+	switch {
+	case declared == detected, declared == "application/octet-stream":
+		return true
+	case strings.HasPrefix(detected, "text/") || detected == "application/json":
+		return isTextual(declared)
+	case detected == "application/zip":
+		return isZipContainer(declared)
+	case detected == "application/octet-stream":
+		return !isTextual(declared) && !hasSignature(declared)
+	}
+	return false
+}
+
+// sniffFile detects the content type of a stored file from its leading bytes.
+// It returns an empty type for an empty file, which has nothing to sniff.
+func sniffFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() == 0 {
+		return "", nil
+	}
+	detected, _, err := sniffContentType(f)
+	return detected, err
+}
+
+// proposeMimetypeCorrection decides whether a stored mimetype should be corrected to
+// the type sniffed from the file's bytes. It only proposes a correction where the
+// sniffer confidently disagrees, and reports the proposal as unambiguous only when a
+// generic type would be replaced by a recognised binary signature, e.g.
+// application/octet-stream by image/png. Everything else is left for review.
+func proposeMimetypeCorrection(stored, detected string) (propose, unambiguous bool) {
+	stored = normalizeMimetype(stored)
+	detected = normalizeMimetype(detected)
+
+	switch {
+	case detected == "", detected == stored, detected == "application/octet-stream":
+		// Nothing to correct, or the sniffer does not recognise the content
+		return false, false
+	case stored == "" || stored == "application/octet-stream":
+		// A zip may be any zip-based format, and text any textual one
+		return true, hasSignature(detected) && !isZipContainer(detected)
+	case isTextual(detected):
+		if isTextual(stored) {
+			// Text of one kind for another is only worth flagging when it is markup a
+			// browser would render
+			return detected == "text/html" && stored != "application/xhtml+xml", false
+		}
+		// Text where the sniffer would have recognised the declared binary type
+		return hasSignature(stored), false
+	case detected == "application/zip" && isZipContainer(stored):
+		return false, false
+	}
+	return true, false
+}
@@ -0,0 +1,379 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"file-upload-service/models"
+
+	"github.com/umakantv/go-utils/errs"
+	"go.uber.org/zap"
+)
+
+// defaultCORSMaxAge is how long browsers may cache a preflight answer, in seconds, for
+// rules without MaxAgeSeconds
+const defaultCORSMaxAge = 600
+
+// errCORSPolicy is returned for a cors_policy that is not a JSON array of CORS rules
+var errCORSPolicy = errors.New("cors_policy must be a valid JSON array of CORS rules")
+
+// corsMethods are the methods a CORS rule may allow besides "*"
+var corsMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// validateCORSRule checks rule i of a policy and normalises it in place: methods are
+// uppercased and origins lowercased, as browsers send them. A rule needs at least one
+// origin and one method. Origins are "*" or scheme://host[:port], where one label of the
+// host may be the wildcard "*"; header names must be HTTP tokens or "*". It returns the
+// problems found, each naming the rule and field, such as
+// cors_policy[0].AllowedMethods[1]: "TELEPORT" is not an HTTP method.
+func validateCORSRule(i int, rule *models.CORSRule) []string {
+	var problems []string
+	field := func(name string) string {
+		return fmt.Sprintf("cors_policy[%d].%s", i, name)
+	}
+
+	if len(rule.AllowedOrigins) == 0 {
+		problems = append(problems, field("AllowedOrigins")+" must list at least one origin")
+	}
+	for j, origin := range rule.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSpace(origin))
+		if problem := corsOriginProblem(origin); problem != "" {
+			problems = append(problems, fmt.Sprintf("%s[%d]: %q %s", field("AllowedOrigins"), j, rule.AllowedOrigins[j], problem))
+			continue
+		}
+		rule.AllowedOrigins[j] = origin
+	}
+
+	if len(rule.AllowedMethods) == 0 {
+		problems = append(problems, field("AllowedMethods")+" must list at least one method")
+	}
+	for j, method := range rule.AllowedMethods {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method != "*" && !corsMethods[method] {
+			problems = append(problems, fmt.Sprintf("%s[%d]: %q is not an HTTP method", field("AllowedMethods"), j, rule.AllowedMethods[j]))
+			continue
+		}
+		rule.AllowedMethods[j] = method
+	}
+
+	for _, list := range []struct {
+		name    string
+		headers []string
+	}{{"AllowedHeaders", rule.AllowedHeaders}, {"ExposeHeaders", rule.ExposeHeaders}} {
+		for j, header := range list.headers {
+			if header != "*" && !validHeaderName(header) {
+				problems = append(problems, fmt.Sprintf("%s[%d]: %q is not a header name", field(list.name), j, header))
+			}
+		}
+	}
+
+	if rule.MaxAgeSeconds < 0 {
+		problems = append(problems, field("MaxAgeSeconds")+" must not be negative")
+	}
+	return problems
+}
+
+// corsOriginProblem describes what is wrong with an origin of a CORS rule; "" when it is
+// "*" or scheme://host[:port] with at most one "*" label
+func corsOriginProblem(origin string) string {
+	if origin == "*" {
+		return ""
+	}
+	scheme, host, found := strings.Cut(origin, "://")
+	if !found || scheme == "" || host == "" {
+		return "must be \"*\" or scheme://host[:port]"
+	}
+	if strings.ContainsAny(host, "/?#@ ") {
+		return "must not have a path, query or credentials"
+	}
+	u, err := url.Parse(scheme + "://" + strings.ReplaceAll(host, "*", "x"))
+	if err != nil || u.Hostname() == "" {
+		return "must be \"*\" or scheme://host[:port]"
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "has an invalid port"
+		}
+	}
+	hostname, _, _ := strings.Cut(host, ":")
+	wildcards := 0
+	for _, label := range strings.Split(hostname, ".") {
+		if strings.Contains(label, "*") {
+			if label != "*" {
+				return "may only use * as a whole label, as in https://*.example.com"
+			}
+			wildcards++
+		}
+	}
+	if wildcards > 1 {
+		return "may have at most one * label"
+	}
+	return ""
+}
+
+// validHeaderName reports whether name is an HTTP token, as header names must be
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > unicode.MaxASCII || !(unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCORSRules reads a bucket's stored CORS policy; none when it is empty or unreadable
+func parseCORSRules(policy json.RawMessage) []models.CORSRule {
+	var rules []models.CORSRule
+	if err := json.Unmarshal(policy, &rules); err != nil {
+		return nil
+	}
+	return rules
+}
+
+// bucketCORSRules reads the CORS rules of a bucket; none when its policy is empty or unreadable
+func (h *FileHandler) bucketCORSRules(bucketID int) ([]models.CORSRule, error) {
+	var policy string
+	if err := h.db.QueryRow("SELECT cors_policy FROM buckets WHERE id = ?", bucketID).Scan(&policy); err != nil {
+		return nil, err
+	}
+	return parseCORSRules(json.RawMessage(policy)), nil
+}
+
+// corsListAllows reports whether value is in list, ignoring case, or list holds "*"
+func corsListAllows(list []string, value string) bool {
+	for _, allowed := range list {
+		if allowed == "*" || strings.EqualFold(allowed, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsRuleFor returns the first rule allowing origin to send method with headers
+func corsRuleFor(rules []models.CORSRule, origin, method string, headers []string) (models.CORSRule, bool) {
+	for _, rule := range rules {
+		if !isOriginAllowed(origin, rule.AllowedOrigins) || !corsListAllows(rule.AllowedMethods, method) {
+			continue
+		}
+		allowed := true
+		for _, header := range headers {
+			if !corsListAllows(rule.AllowedHeaders, header) {
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			return rule, true
+		}
+	}
+	return models.CORSRule{}, false
+}
+
+// preflightHeaders returns the headers a preflight asks to send, from Access-Control-Request-Headers
+func preflightHeaders(r *http.Request) []string {
+	var headers []string
+	for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, header)
+		}
+	}
+	return headers
+}
+
+// writePreflight answers a preflight that rule allows with 204 and the CORS headers
+func writePreflight(w http.ResponseWriter, origin string, rule models.CORSRule, headers []string) {
+	setCORSHeaders(w, origin, rule)
+	// A "*" rule is answered with the headers asked for, which also covers credentialed requests
+	if corsListAllows(rule.AllowedHeaders, "*") && len(headers) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+	maxAge := rule.MaxAgeSeconds
+	if maxAge == 0 {
+		maxAge = defaultCORSMaxAge
+	}
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeOriginNotAllowed answers a browser request the bucket's CORS policy does not allow
+func writeOriginNotAllowed(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(errs.NewAuthorizationError("Origin is not allowed by the bucket's CORS policy"))
+}
+
+// applyCORSHeaders sets the CORS headers of a public file response from the bucket's CORS
+// policy. Public files are only read, so HEAD requests match rules allowing GET. Requests
+// whose origin no rule allows are still served, just without the headers, so the browser
+// keeps the response from the page.
+func applyCORSHeaders(w http.ResponseWriter, r *http.Request, corsPolicy json.RawMessage) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	if rule, ok := corsRuleFor(parseCORSRules(corsPolicy), origin, http.MethodGet, nil); ok {
+		setCORSHeaders(w, origin, rule)
+	}
+}
+
+// setCORSHeaders sets the CORS response headers granting origin what rule allows
+func setCORSHeaders(w http.ResponseWriter, origin string, rule models.CORSRule) {
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Add("Vary", "Origin")
+
+	if len(rule.AllowedMethods) > 0 {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(rule.AllowedMethods, ", "))
+	}
+
+	if len(rule.AllowedHeaders) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(rule.AllowedHeaders, ", "))
+	}
+
+	if len(rule.ExposeHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(rule.ExposeHeaders, ", "))
+	}
+}
+
+// applyUploadCORS checks a browser upload against the CORS policy of the bucket it goes
+// to and sets the headers that let the page read the response, errors included. Requests
+// without an Origin header are not from a browser and pass untouched, as do all requests
+// to buckets without a policy. It answers the request itself and returns false when the
+// policy refuses the origin.
+func (h *FileHandler) applyUploadCORS(ctx context.Context, w http.ResponseWriter, r *http.Request, bucketID int) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	rules, err := h.bucketCORSRules(bucketID)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to read bucket CORS policy", zap.Int("bucket_id", bucketID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to process upload"))
+		return false
+	}
+	if len(rules) == 0 {
+		return true
+	}
+	rule, ok := corsRuleFor(rules, origin, r.Method, nil)
+	if !ok {
+		h.logRequest(ctx, "error", "Upload origin not allowed by bucket CORS policy",
+			zap.Int("bucket_id", bucketID),
+			zap.String("origin", origin),
+		)
+		writeOriginNotAllowed(w)
+		return false
+	}
+	setCORSHeaders(w, origin, rule)
+	return true
+}
+
+// UploadPreflight handles OPTIONS /files/upload - answer a browser's CORS preflight for an
+// upload URL from the CORS policy of the bucket the token uploads to. The token is looked
+// up but not used.
+func (h *FileHandler) UploadPreflight(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	if token == "" || origin == "" || method == "" {
+		h.logRequest(ctx, "error", "Incomplete upload preflight request")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Preflight requests need a token, Origin and Access-Control-Request-Method"))
+		return
+	}
+
+	tokenData, status, appErr := h.loadUploadToken(ctx, token)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+	rules, err := h.bucketCORSRules(tokenData.BucketID)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to read bucket CORS policy", zap.Int("bucket_id", tokenData.BucketID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to process preflight"))
+		return
+	}
+
+	headers := preflightHeaders(r)
+	rule, ok := corsRuleFor(rules, origin, method, headers)
+	if !ok {
+		h.logRequest(ctx, "info", "Upload preflight not allowed by bucket CORS policy",
+			zap.Int("bucket_id", tokenData.BucketID),
+			zap.String("origin", origin),
+			zap.String("method", method),
+		)
+		writeOriginNotAllowed(w)
+		return
+	}
+
+	writePreflight(w, origin, rule, headers)
+}
+
+// isOriginAllowed checks if the origin matches any of the allowed origins
+// Supports wildcards: * matches any sequence of characters
+func isOriginAllowed(origin string, allowedOrigins []string) bool {
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+		if allowed == origin {
+			return true
+		}
+		// Check for wildcard match
+		if strings.Contains(allowed, "*") {
+			if matchWildcard(origin, allowed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchWildcard matches an origin against a pattern with wildcards
+func matchWildcard(origin, pattern string) bool {
+	// Simple wildcard matching - * matches any sequence of characters
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return origin == pattern
+	}
+
+	// Check prefix
+	if !strings.HasPrefix(origin, parts[0]) {
+		return false
+	}
+
+	// Check suffix
+	if !strings.HasSuffix(origin, parts[len(parts)-1]) {
+		return false
+	}
+
+	// Check middle parts in order
+	remaining := origin[len(parts[0]):]
+	for i := 1; i < len(parts)-1; i++ {
+		idx := strings.Index(remaining, parts[i])
+		if idx == -1 {
+			return false
+		}
+		remaining = remaining[idx+len(parts[i]):]
+	}
+
+	return true
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// deleteJobColumns lists the delete_jobs columns in models.DeleteJob order
+const deleteJobColumns = `id, client_id, bucket_id, path, status, matched, deleted, missing, failed, error, created_at, updated_at, finished_at`
+
+// enqueueDeleteJob records a delete-by-path job and starts it in the background
+func (h *FileHandler) enqueueDeleteJob(clientID string, bucketID int, path string, matched int) (models.DeleteJob, error) {
+	now := time.Now().UTC()
+	job := models.DeleteJob{
+		ID:        uuid.New().String(),
+		ClientID:  clientID,
+		BucketID:  bucketID,
+		Path:      path,
+		Status:    models.DeleteJobStatusQueued,
+		Matched:   matched,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	_, err := h.db.Exec(
+		`INSERT INTO delete_jobs (id, client_id, bucket_id, path, status, matched, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		job.ID, job.ClientID, job.BucketID, job.Path, job.Status, job.Matched, job.CreatedAt, job.UpdatedAt,
+	)
+	if err != nil {
+		return models.DeleteJob{}, err
+	}
+
+	go h.jobs.runOnce(deleteJobLease(job.ID), func(ctx context.Context) {
+		h.runDeleteJob(ctx, job)
+	})
+	return job, nil
+}
+
+// StartDeleteJobResumer resumes unfinished delete jobs now and then periodically. A job is
+// resumed when no instance holds its lease: it was left by a previous process, or its
+// holder crashed or lost the lease. A job only ever looks at files still under its path,
+// so running it again is safe.
+func (h *FileHandler) StartDeleteJobResumer(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			h.resumeDeleteJobs()
+			<-ticker.C
+		}
+	}()
+}
+
+// resumeDeleteJobs runs every queued or running delete job that no instance is running
+func (h *FileHandler) resumeDeleteJobs() {
+	var jobs []models.DeleteJob
+	err := h.db.Select(&jobs,
+		"SELECT "+deleteJobColumns+" FROM delete_jobs WHERE status IN (?, ?) ORDER BY created_at",
+		models.DeleteJobStatusQueued, models.DeleteJobStatusRunning,
+	)
+	if err != nil {
+		logger.Error("Failed to load unfinished delete jobs", zap.Error(err))
+		return
+	}
+	for _, job := range jobs {
+		job := job
+		go h.jobs.runOnce(deleteJobLease(job.ID), func(ctx context.Context) {
+			logger.Info("Resuming delete job", zap.String("job_id", job.ID), zap.String("status", job.Status))
+			h.runDeleteJob(ctx, job)
+		})
+	}
+}
+
+// runDeleteJob deletes the files under a job's path in batches of MaxSyncRows. Keys are
+// walked in order, so files that are missing on disk or fail to delete are counted once
+// and not picked up again. Once ctx is cancelled the run stops between batches, leaving the
+// job running for the next lease holder.
+func (h *FileHandler) runDeleteJob(ctx context.Context, job models.DeleteJob) {
+	// Another instance may have finished the job since it was listed
+	var status string
+	if err := h.db.Get(&status, "SELECT status FROM delete_jobs WHERE id = ?", job.ID); err != nil {
+		logger.Error("Failed to load delete job", zap.String("job_id", job.ID), zap.Error(err))
+		return
+	}
+	if status != models.DeleteJobStatusQueued && status != models.DeleteJobStatusRunning {
+		return
+	}
+
+	if _, err := h.db.Exec(
+		"UPDATE delete_jobs SET status = ?, updated_at = ? WHERE id = ?",
+		models.DeleteJobStatusRunning, time.Now().UTC(), job.ID,
+	); err != nil {
+		logger.Error("Failed to start delete job", zap.String("job_id", job.ID), zap.Error(err))
+		return
+	}
+
+	afterKey, afterID := "", ""
+	for {
+		if ctx.Err() != nil {
+			logger.Info("Delete job stopped", zap.String("job_id", job.ID))
+			return
+		}
+
+		fileIDs, records, lastKey, lastID, err := h.filesUnderPath(job.ClientID, job.BucketID, job.Path, afterKey, afterID, h.config.MaxSyncRows)
+		if err != nil {
+			h.finishDeleteJob(job.ID, models.DeleteJobStatusFailed, err)
+			return
+		}
+		if len(fileIDs) == 0 {
+			break
+		}
+
+		deleted, missing, failed := h.removeFiles(ctx, fileIDs, records)
+		if _, err := h.db.Exec(
+			"UPDATE delete_jobs SET deleted = deleted + ?, missing = missing + ?, failed = failed + ?, updated_at = ? WHERE id = ?",
+			len(deleted), len(missing), len(failed), time.Now().UTC(), job.ID,
+		); err != nil {
+			h.finishDeleteJob(job.ID, models.DeleteJobStatusFailed, err)
+			return
+		}
+		afterKey, afterID = lastKey, lastID
+	}
+
+	h.finishDeleteJob(job.ID, models.DeleteJobStatusCompleted, nil)
+}
+
+// finishDeleteJob records how a delete job ended
+func (h *FileHandler) finishDeleteJob(jobID, status string, jobErr error) {
+	message := ""
+	if jobErr != nil {
+		message = jobErr.Error()
+		logger.Error("Delete job failed", zap.String("job_id", jobID), zap.Error(jobErr))
+	} else {
+		logger.Info("Delete job completed", zap.String("job_id", jobID))
+	}
+
+	now := time.Now().UTC()
+	if _, err := h.db.Exec(
+		"UPDATE delete_jobs SET status = ?, error = ?, updated_at = ?, finished_at = ? WHERE id = ?",
+		status, message, now, now, jobID,
+	); err != nil {
+		logger.Error("Failed to record delete job result", zap.String("job_id", jobID), zap.Error(err))
+	}
+}
+
+// GetDeleteJob handles GET /files/delete-jobs/{id} - progress of a delete-by-path job
+func (h *FileHandler) GetDeleteJob(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+
+	clientID := ""
+	if auth := httpserver.GetRequestAuth(ctx); auth != nil {
+		clientID = auth.Client
+	}
+
+	if clientID == "" {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+
+	var job models.DeleteJob
+	err := h.db.Get(&job, "SELECT "+deleteJobColumns+" FROM delete_jobs WHERE id = ? AND client_id = ?", jobID, clientID)
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "error", "Delete job not found", zap.String("job_id", jobID))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Delete job not found"))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query delete job", zap.String("job_id", jobID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to get delete job"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"file-upload-service/logger"
+
+	"github.com/umakantv/go-utils/errs"
+	"go.uber.org/zap"
+)
+
+// errFreeSpaceUnknown is returned by availableBytes on platforms it cannot measure
+var errFreeSpaceUnknown = errors.New("free disk space cannot be read on this platform")
+
+// hasDiskSpace reports whether the volume holding path can take size more bytes and still
+// keep UPLOAD_DISK_RESERVE_BYTES free. Free space that cannot be read lets the upload
+// through. Free space falling below the reserve is logged once, as is its recovery, so
+// operators hear about a filling volume before uploads start failing.
+func (h *FileHandler) hasDiskSpace(path string, size int64) bool {
+	free, err := availableBytes(path)
+	if errors.Is(err, errFreeSpaceUnknown) {
+		return true
+	}
+	if err != nil {
+		logger.Error("Failed to read free disk space", zap.String("path", path), zap.Error(err))
+		return true
+	}
+
+	reserve := uint64(h.config.UploadDiskReserve)
+	low := free < reserve
+	if h.diskLow.Swap(low) != low {
+		if low {
+			logger.Error("Free disk space is below the upload reserve",
+				zap.String("path", path), zap.Uint64("free_bytes", free), zap.Uint64("reserve_bytes", reserve))
+		} else {
+			logger.Info("Free disk space is back above the upload reserve",
+				zap.String("path", path), zap.Uint64("free_bytes", free), zap.Uint64("reserve_bytes", reserve))
+		}
+	}
+	return free >= reserve && free-reserve >= uint64(size)
+}
+
+// writeInsufficientStorage responds with 507 for uploads the volume has no room for
+func writeInsufficientStorage(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusInsufficientStorage)
+	json.NewEncoder(w).Encode(errs.AppError{
+		Code:    http.StatusInsufficientStorage,
+		Message: "Not enough storage space for this upload",
+	})
+}
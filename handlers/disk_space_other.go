@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package handlers
+
+// availableBytes cannot measure free space here, so uploads are never refused for it
+func availableBytes(path string) (uint64, error) {
+	return 0, errFreeSpaceUnknown
+}
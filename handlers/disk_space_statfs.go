@@ -0,0 +1,27 @@
+//go:build linux || darwin
+
+package handlers
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+)
+
+// availableBytes returns how many bytes unprivileged writers can still store on the
+// filesystem holding path. A path that does not exist yet is measured at its nearest
+// existing parent.
+func availableBytes(path string) (uint64, error) {
+	for {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(path, &stat)
+		if err == nil {
+			return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+		}
+		parent := filepath.Dir(path)
+		if !errors.Is(err, syscall.ENOENT) || parent == path {
+			return 0, err
+		}
+		path = parent
+	}
+}
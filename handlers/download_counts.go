@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"file-upload-service/logger"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// pendingDownloads is what DownloadCounts has gathered for one file since its last flush
+type pendingDownloads struct {
+	count int64
+	last  time.Time
+}
+
+// DownloadCounts gathers file downloads in memory and adds them to the files table in
+// batches, so the requests for a hot public file do not serialize on updates of its row.
+// The file and public file handlers share one.
+type DownloadCounts struct {
+	db      *sqlx.DB
+	mu      sync.Mutex
+	pending map[string]pendingDownloads
+}
+
+// NewDownloadCounts creates download counts flushed to db
+func NewDownloadCounts(db *sqlx.DB) *DownloadCounts {
+	return &DownloadCounts{db: db, pending: map[string]pendingDownloads{}}
+}
+
+// Record counts a completed download of a file. It only touches memory; the count
+// reaches the database with the next flush.
+func (c *DownloadCounts) Record(fileID string) {
+	c.add(fileID, 1, time.Now().UTC())
+}
+
+// add counts n downloads of fileID, the latest at last
+func (c *DownloadCounts) add(fileID string, n int64, last time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.pending[fileID]
+	p.count += n
+	if last.After(p.last) {
+		p.last = last
+	}
+	c.pending[fileID] = p
+}
+
+// take returns the downloads gathered so far and starts gathering anew
+func (c *DownloadCounts) take() map[string]pendingDownloads {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := c.pending
+	c.pending = map[string]pendingDownloads{}
+	return pending
+}
+
+// StartFlusher periodically writes the gathered downloads to the files table. Every
+// instance flushes its own, so it runs without a lease. Downloads gathered since the
+// last flush are lost if the process stops.
+func (c *DownloadCounts) StartFlusher(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			c.flush()
+		}
+	}()
+}
+
+// flush adds the gathered downloads to their files in one transaction. A flush that
+// fails keeps its downloads for the next one; a file purged meanwhile matches no row and
+// its downloads are dropped.
+func (c *DownloadCounts) flush() {
+	pending := c.take()
+	if len(pending) == 0 {
+		return
+	}
+
+	err := func() error {
+		tx, err := c.db.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		// Another instance may have flushed a later download of the same file first
+		for fileID, p := range pending {
+			if _, err := tx.Exec(
+				`UPDATE files SET download_count = download_count + ?,
+					last_downloaded_at = CASE WHEN last_downloaded_at IS NULL OR last_downloaded_at < ? THEN ? ELSE last_downloaded_at END
+				WHERE id = ?`,
+				p.count, p.last, p.last, fileID,
+			); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		logger.Error("Failed to flush download counts", zap.Int("files", len(pending)), zap.Error(err))
+		for fileID, p := range pending {
+			c.add(fileID, p.count, p.last)
+		}
+	}
+}
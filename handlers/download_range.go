@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errRangeNotSatisfiable is returned by parseByteRange for a range starting past the end
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// byteRange is the part of a file a Range request asks for
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+// last reports whether the range runs to the file's final byte
+func (b byteRange) last(size int64) bool {
+	return b.start+b.length == size
+}
+
+// parseByteRange reads a Range header against a file of size bytes. Only a single range
+// is served; a header asking for several, or one that cannot be parsed, is ignored and ok
+// is false, so the whole file is sent as if no range had been asked for. A range that
+// starts past the end gives errRangeNotSatisfiable.
+func parseByteRange(header string, size int64) (rng byteRange, ok bool, err error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return byteRange{}, false, nil
+	}
+	spec := strings.TrimPrefix(header, "bytes=")
+	if strings.Contains(spec, ",") {
+		return byteRange{}, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return byteRange{}, false, nil
+	}
+
+	// "-n" asks for the last n bytes
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return byteRange{}, false, nil
+		}
+		if n == 0 || size == 0 {
+			return byteRange{}, false, errRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return byteRange{start: size - n, length: n}, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return byteRange{}, false, nil
+		}
+	}
+	if start >= size {
+		return byteRange{}, false, errRangeNotSatisfiable
+	}
+	if end >= size {
+		end = size - 1
+	}
+	return byteRange{start: start, length: end - start + 1}, true, nil
+}
+
+// ifRangeMatches reports whether the Range of r still applies to content last modified at
+// modTime. Downloads carry no ETag, so an If-Range holding one never matches and the whole
+// file is sent.
+func ifRangeMatches(r *http.Request, modTime time.Time) bool {
+	header := r.Header.Get("If-Range")
+	if header == "" {
+		return true
+	}
+	t, err := http.ParseTime(header)
+	if err != nil {
+		return false
+	}
+	return t.Unix() == modTime.Unix()
+}
@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"file-upload-service/api"
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// maxRedemptionUserAgentLength is how much of a redeeming request's User-Agent is kept
+const maxRedemptionUserAgentLength = 512
+
+// Page sizes of GET /files/{id}/redemptions
+const (
+	defaultRedemptionPageSize = 100
+	maxRedemptionPageSize     = 1000
+)
+
+// hashDownloadToken returns the hex SHA-256 a download token is recorded under, so the
+// redemption log never holds a token that could still be used
+func hashDownloadToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// redeemDownloadToken records a download through token for the client that issued it.
+// The insert only happens while the token has uses left, so concurrent downloads cannot
+// together go over its max_uses. redemptionID is empty when the uses were already spent;
+// spent is true when none remain after this redemption.
+func (h *FileHandler) redeemDownloadToken(r *http.Request, token string, data models.DownloadTokenData) (redemptionID string, spent bool, err error) {
+	maxUses := data.MaxUses
+	if maxUses == 0 {
+		maxUses = 1
+	}
+	now := time.Now().UTC()
+	expiresAt := data.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = now
+	}
+	issuerClientID := data.ClientID
+	if data.GranteeClientID != "" {
+		issuerClientID = data.GranteeClientID
+	}
+
+	remoteIP := h.requestIP(r)
+	var country, region sql.NullString
+	if ip := net.ParseIP(remoteIP); ip != nil && h.geo != nil {
+		if location, found := h.geo.Resolve(ip); found {
+			country = sql.NullString{String: location.Country, Valid: true}
+			region = sql.NullString{String: location.Region, Valid: location.Region != ""}
+		}
+	}
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxRedemptionUserAgentLength {
+		userAgent = userAgent[:maxRedemptionUserAgentLength]
+	}
+
+	tokenHash := hashDownloadToken(token)
+	redemptionID = uuid.New().String()
+	result, err := h.db.Exec(
+		`INSERT INTO download_redemptions (id, token_hash, file_id, version_id, client_id, remote_ip, user_agent, country, region, token_expires_at, redeemed_at)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+		WHERE (SELECT COUNT(*) FROM download_redemptions WHERE token_hash = ?) < ?`,
+		redemptionID, tokenHash, data.FileID,
+		sql.NullString{String: data.VersionID, Valid: data.VersionID != ""},
+		issuerClientID, remoteIP, userAgent, country, region, expiresAt.UTC(), now,
+		tokenHash, maxUses,
+	)
+	if err != nil {
+		return "", false, err
+	}
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		return "", true, nil
+	}
+
+	var uses int
+	if err := h.db.QueryRow("SELECT COUNT(*) FROM download_redemptions WHERE token_hash = ?", tokenHash).Scan(&uses); err != nil {
+		return redemptionID, false, err
+	}
+	return redemptionID, uses >= maxUses, nil
+}
+
+// refundDownloadRedemption gives back the use a download claimed when its transfer did
+// not complete. The token is stored again for the rest of its lifetime, since its last
+// use, or a request turned away meanwhile, may have removed it.
+func (h *FileHandler) refundDownloadRedemption(redemptionID, token string, data models.DownloadTokenData) error {
+	if _, err := h.db.Exec("DELETE FROM download_redemptions WHERE id = ?", redemptionID); err != nil {
+		return err
+	}
+	remaining := time.Until(data.ExpiresAt)
+	if data.ExpiresAt.IsZero() || remaining <= 0 {
+		return nil
+	}
+	return h.cache.Set("download:"+token, data, remaining)
+}
+
+// downloadUsesLeft reports whether token still has uses to redeem, without claiming one.
+// It lets a partial download through while the token remains redeemable.
+func (h *FileHandler) downloadUsesLeft(token string, data models.DownloadTokenData) (bool, error) {
+	maxUses := data.MaxUses
+	if maxUses == 0 {
+		maxUses = 1
+	}
+	var uses int
+	if err := h.db.QueryRow("SELECT COUNT(*) FROM download_redemptions WHERE token_hash = ?", hashDownloadToken(token)).Scan(&uses); err != nil {
+		return false, err
+	}
+	return uses < maxUses, nil
+}
+
+// redemptionResponse converts a redemption to its API representation
+func redemptionResponse(redemption models.DownloadRedemption) models.DownloadRedemptionResponse {
+	response := models.DownloadRedemptionResponse{
+		ID:         redemption.ID,
+		TokenHash:  redemption.TokenHash,
+		VersionID:  redemption.VersionID.String,
+		RemoteIP:   redemption.RemoteIP,
+		UserAgent:  redemption.UserAgent,
+		RedeemedAt: redemption.RedeemedAt,
+	}
+	if redemption.Country.Valid {
+		response.Geo = &models.GeoLocation{Country: redemption.Country.String, Region: redemption.Region.String}
+	}
+	return response
+}
+
+// ListDownloadRedemptions handles GET /files/{id}/redemptions - the downloads made through
+// signed URLs the requesting client issued for a file, newest first. The file's owner
+// and clients holding, or once holding, a grant on it may ask; each sees only the URLs
+// it issued itself.
+func (h *FileHandler) ListDownloadRedemptions(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	fileID := mux.Vars(r)["id"]
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	page, err := h.pager.Parse(r.URL.Query(), api.PageSpec{
+		Scope:        "redemptions:" + clientID + ":" + fileID,
+		DefaultLimit: defaultRedemptionPageSize,
+		MaxLimit:     maxRedemptionPageSize,
+		Sorts:        []string{"-redeemed_at", "redeemed_at"},
+	})
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid page request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Listing download redemptions", zap.String("file_id", fileID), zap.String("client_id", clientID))
+
+	// Redemptions outlive deletion, so deleted files are still listed
+	var ownerClientID string
+	err = h.db.QueryRow("SELECT client_id FROM files WHERE id = ? AND staged = 0", fileID).Scan(&ownerClientID)
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "info", "File not found", zap.String("file_id", fileID))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query file", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Database error"))
+		return
+	}
+	if ownerClientID != clientID {
+		var granted int
+		if err := h.db.QueryRow(
+			"SELECT COUNT(*) FROM file_grants WHERE file_id = ? AND grantee_client_id = ?",
+			fileID, clientID,
+		).Scan(&granted); err != nil {
+			h.logRequest(ctx, "error", "Failed to query file grants", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Database error"))
+			return
+		}
+		if granted == 0 {
+			h.logRequest(ctx, "error", "Client does not own this file",
+				zap.String("file_id", fileID),
+				zap.String("requesting_client", clientID),
+			)
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(errs.NewAuthorizationError("Access denied"))
+			return
+		}
+	}
+
+	direction, comparison := "ASC", ">"
+	if page.Descending() {
+		direction, comparison = "DESC", "<"
+	}
+	query := `SELECT id, token_hash, file_id, version_id, client_id, remote_ip, user_agent, country, region, token_expires_at, redeemed_at, CAST(redeemed_at AS TEXT)
+		FROM download_redemptions WHERE file_id = ? AND client_id = ?`
+	args := []interface{}{fileID, clientID}
+	if len(page.After) == 2 {
+		query += " AND (CAST(redeemed_at AS TEXT) " + comparison + " ? OR (CAST(redeemed_at AS TEXT) = ? AND id " + comparison + " ?))"
+		args = append(args, page.After[0], page.After[0], page.After[1])
+	}
+	query += " ORDER BY CAST(redeemed_at AS TEXT) " + direction + ", id " + direction + " LIMIT ?"
+	args = append(args, page.Limit+1)
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query download redemptions", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to list redemptions"))
+		return
+	}
+	defer rows.Close()
+
+	var redemptions []models.DownloadRedemptionResponse
+	nextCursor := ""
+	lastRedeemedAt := ""
+	for rows.Next() {
+		if len(redemptions) == page.Limit {
+			nextCursor = h.pager.Next(page, lastRedeemedAt, redemptions[len(redemptions)-1].ID)
+			break
+		}
+		var redemption models.DownloadRedemption
+		if err := rows.Scan(&redemption.ID, &redemption.TokenHash, &redemption.FileID, &redemption.VersionID, &redemption.ClientID,
+			&redemption.RemoteIP, &redemption.UserAgent, &redemption.Country, &redemption.Region,
+			&redemption.TokenExpiresAt, &redemption.RedeemedAt, &lastRedeemedAt); err != nil {
+			h.logRequest(ctx, "error", "Failed to scan download redemption", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to list redemptions"))
+			return
+		}
+		redemptions = append(redemptions, redemptionResponse(redemption))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.DownloadRedemptionListResponse{
+		Page:   api.NewPage(redemptions, nextCursor),
+		FileID: fileID,
+	})
+}
+
+// StartRedemptionSweeper periodically removes download redemptions past their retention.
+// Only the instance holding the sweeper's lease runs it.
+func (h *FileHandler) StartRedemptionSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			h.jobs.runPeriodic(redemptionSweeperLease, h.sweepDownloadRedemptions)
+		}
+	}()
+}
+
+// sweepDownloadRedemptions deletes redemptions older than the retention. Those of URLs
+// that have not expired yet still count the URL's uses, so they wait for it to expire.
+func (h *FileHandler) sweepDownloadRedemptions(ctx context.Context) {
+	now := time.Now().UTC()
+	result, err := h.db.ExecContext(ctx,
+		"DELETE FROM download_redemptions WHERE redeemed_at < ? AND token_expires_at < ?",
+		now.Add(-h.config.DownloadRedemptionRetention), now,
+	)
+	if err != nil {
+		logger.Error("Failed to delete expired download redemptions", zap.Error(err))
+		return
+	}
+	if deleted, _ := result.RowsAffected(); deleted > 0 {
+		logger.Info("Removed expired download redemptions", zap.Int64("deleted", deleted))
+	}
+}
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"file-upload-service/models"
+)
+
+func TestReusableDownloadURL(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "docs/a.txt", []byte("content"))
+
+	expiresIn := 3600
+	w := env.serve(env.files.GenerateDownloadSignedURL, newRequest(http.MethodPost, "/files/download-url",
+		models.GenerateDownloadSignedURLRequest{FileID: fileID, MaxUses: 10, ExpiresInSeconds: &expiresIn}), nil)
+	expectStatus(t, w, http.StatusCreated)
+	var signed models.SignedURLResponse
+	decode(t, w, &signed)
+	if left := time.Until(signed.ExpiresAt); left < 59*time.Minute || left > time.Hour {
+		t.Fatalf("URL expires in %s, want an hour", left)
+	}
+	target := signed.SignedURL[strings.Index(signed.SignedURL, "/files/"):]
+
+	for i := 0; i < 10; i++ {
+		w := serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, target, nil), nil)
+		expectStatus(t, w, http.StatusOK)
+		if w.Body.String() != "content" {
+			t.Fatalf("download %d returned %q", i+1, w.Body.String())
+		}
+	}
+	w = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, target, nil), nil)
+	expectStatus(t, w, http.StatusUnauthorized)
+}
+
+func TestConcurrentDownloadsStayWithinMaxUses(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "docs/a.txt", []byte("content"))
+
+	w := env.serve(env.files.GenerateDownloadSignedURL, newRequest(http.MethodPost, "/files/download-url",
+		models.GenerateDownloadSignedURLRequest{FileID: fileID, MaxUses: 3}), nil)
+	expectStatus(t, w, http.StatusCreated)
+	var signed models.SignedURLResponse
+	decode(t, w, &signed)
+	target := signed.SignedURL[strings.Index(signed.SignedURL, "/files/"):]
+
+	const requests = 20
+	codes := make([]int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, target, nil), nil).Code
+		}(i)
+	}
+	wg.Wait()
+
+	downloaded := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			downloaded++
+		case http.StatusUnauthorized:
+		default:
+			t.Fatalf("unexpected status %d", code)
+		}
+	}
+	if downloaded != 3 {
+		t.Fatalf("%d downloads succeeded with a 3-use token, want 3", downloaded)
+	}
+
+	var redemptions int
+	if err := env.db.Get(&redemptions, "SELECT COUNT(*) FROM download_redemptions WHERE file_id = ?", fileID); err != nil {
+		t.Fatal(err)
+	}
+	if redemptions != 3 {
+		t.Fatalf("%d redemptions recorded, want 3", redemptions)
+	}
+}
+
+func TestRedeemDownloadTokenConcurrently(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	data := models.DownloadTokenData{
+		FileID:   env.putFile(bucketID, "docs/a.txt", []byte("content")),
+		ClientID: env.clientID,
+		BucketID: bucketID,
+		MaxUses:  5,
+	}
+
+	const requests = 50
+	redemptionIDs := make([]string, requests)
+	spent := make([]bool, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			redemptionIDs[i], spent[i], err = env.files.redeemDownloadToken(newRequest(http.MethodGet, "/files/download", nil), "token-1", data)
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	claims, lastUses := 0, 0
+	for i, id := range redemptionIDs {
+		if id != "" {
+			claims++
+			if spent[i] {
+				lastUses++
+			}
+		} else if !spent[i] {
+			t.Fatalf("redemption %d was refused without the token being spent", i)
+		}
+	}
+	if claims != data.MaxUses {
+		t.Fatalf("%d redemptions claimed a use, want %d", claims, data.MaxUses)
+	}
+	// The claims that race for the last uses may all count every use taken
+	if lastUses == 0 {
+		t.Fatal("no claimed redemption reported the token spent")
+	}
+}
+
+// brokenConnection is a response whose client goes away once the headers are sent
+type brokenConnection struct {
+	*httptest.ResponseRecorder
+}
+
+func (b brokenConnection) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestBrokenDownloadGivesItsUseBack(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "docs/a.txt", []byte("content"))
+	target := env.downloadTarget(fileID)
+
+	broken := brokenConnection{httptest.NewRecorder()}
+	r := newRequest(http.MethodGet, target, nil)
+	env.files.DownloadFile(r.Context(), broken, r)
+	expectStatus(t, broken.ResponseRecorder, http.StatusOK)
+
+	var redemptions int
+	if err := env.db.Get(&redemptions, "SELECT COUNT(*) FROM download_redemptions WHERE file_id = ?", fileID); err != nil {
+		t.Fatal(err)
+	}
+	if redemptions != 0 {
+		t.Fatalf("%d redemptions kept for a broken download, want 0", redemptions)
+	}
+
+	w := serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, target, nil), nil)
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != "content" {
+		t.Fatalf("retried download returned %q", w.Body.String())
+	}
+	w = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, target, nil), nil)
+	expectStatus(t, w, http.StatusUnauthorized)
+}
+
+// fixedGeo places every address in one region
+type fixedGeo models.GeoLocation
+
+func (g fixedGeo) Resolve(ip net.IP) (models.GeoLocation, bool) {
+	return models.GeoLocation(g), true
+}
+
+// redemptionsOf lists the redemptions of a file's download URLs through GET /files/{id}/redemptions
+func (e *testEnv) redemptionsOf(fileID string) []models.DownloadRedemptionResponse {
+	e.t.Helper()
+	w := e.serve(e.files.ListDownloadRedemptions, newRequest(http.MethodGet, "/files/"+fileID+"/redemptions", nil), map[string]string{"id": fileID})
+	expectStatus(e.t, w, http.StatusOK)
+	var list models.DownloadRedemptionListResponse
+	decode(e.t, w, &list)
+	return list.Items
+}
+
+func TestRedemptionsRecordAddressAndPlace(t *testing.T) {
+	env := newTestEnv(t)
+	env.files.geo = fixedGeo{Country: "DE", Region: "BE"}
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "docs/a.txt", []byte("content"))
+
+	w := env.serve(env.files.GenerateDownloadSignedURL, newRequest(http.MethodPost, "/files/download-url",
+		models.GenerateDownloadSignedURLRequest{FileID: fileID, MaxUses: 2}), nil)
+	expectStatus(t, w, http.StatusCreated)
+	var signed models.SignedURLResponse
+	decode(t, w, &signed)
+	for _, from := range []struct{ addr, agent string }{{"203.0.113.7:4000", "curl/8.0"}, {"198.51.100.9:5000", "wget/1.21"}} {
+		r := newRequest(http.MethodGet, signedURLTarget(signed.SignedURL), nil)
+		r.RemoteAddr = from.addr
+		r.Header.Set("User-Agent", from.agent)
+		expectStatus(t, serveAnonymous(env.files.DownloadFile, r, nil), http.StatusOK)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	redemptions := env.redemptionsOf(fileID)
+	if len(redemptions) != 2 {
+		t.Fatalf("%d redemptions listed, want 2", len(redemptions))
+	}
+	// Newest first
+	for i, want := range []struct{ ip, agent string }{{"198.51.100.9", "wget/1.21"}, {"203.0.113.7", "curl/8.0"}} {
+		got := redemptions[i]
+		if got.RemoteIP != want.ip || got.UserAgent != want.agent {
+			t.Fatalf("redemption %d came from %s with %q, want %s with %q", i, got.RemoteIP, got.UserAgent, want.ip, want.agent)
+		}
+		if got.Geo == nil || got.Geo.Country != "DE" || got.Geo.Region != "BE" {
+			t.Fatalf("redemption %d placed at %+v, want DE/BE", i, got.Geo)
+		}
+	}
+	if redemptions[0].TokenHash != redemptions[1].TokenHash || strings.Contains(signed.SignedURL, redemptions[0].TokenHash) {
+		t.Fatalf("token hashes %s and %s, want one hash that is not the token", redemptions[0].TokenHash, redemptions[1].TokenHash)
+	}
+
+	// Another client sees none of them
+	partner := env.addClient("partner")
+	w = serveAs(partner, env.files.ListDownloadRedemptions, newRequest(http.MethodGet, "/files/"+fileID+"/redemptions", nil), map[string]string{"id": fileID})
+	expectStatus(t, w, http.StatusForbidden)
+}
+
+func TestSweepRemovesOldRedemptionsOfExpiredURLs(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.DownloadRedemptionRetention = 24 * time.Hour
+	bucketID := env.createBucket("photos")
+	expired := env.putFile(bucketID, "docs/expired.txt", []byte("expired"))
+	live := env.putFile(bucketID, "docs/live.txt", []byte("live"))
+	recent := env.putFile(bucketID, "docs/recent.txt", []byte("recent"))
+	for _, fileID := range []string{expired, live, recent} {
+		expectStatus(t, serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, env.downloadTarget(fileID), nil), nil), http.StatusOK)
+	}
+
+	now := time.Now().UTC()
+	backdate := func(fileID string, redeemedAt, tokenExpiresAt time.Time) {
+		env.db.MustExec("UPDATE download_redemptions SET redeemed_at = ?, token_expires_at = ? WHERE file_id = ?", redeemedAt, tokenExpiresAt, fileID)
+	}
+	// Past the retention with its URL expired
+	backdate(expired, now.Add(-48*time.Hour), now.Add(-47*time.Hour))
+	// Past the retention but its URL still counts uses
+	backdate(live, now.Add(-48*time.Hour), now.Add(time.Hour))
+	// Its URL expired, but it is within the retention
+	backdate(recent, now.Add(-time.Hour), now.Add(-time.Minute))
+
+	env.files.sweepDownloadRedemptions(context.Background())
+	for fileID, want := range map[string]int{expired: 0, live: 1, recent: 1} {
+		if n := env.rowsFor("download_redemptions", "file_id", fileID); n != want {
+			t.Fatalf("%d redemptions of %s left, want %d", n, fileID, want)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	cachepackage "file-upload-service/cache"
+	"file-upload-service/models"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// batchDownloadFile is a file row looked up for a download URL batch
+type batchDownloadFile struct {
+	ID                string       `db:"id"`
+	FileName          string       `db:"file_name"`
+	Mimetype          string       `db:"mimetype"`
+	ClientID          string       `db:"client_id"`
+	BucketID          int          `db:"bucket_id"`
+	Key               string       `db:"key"`
+	Status            string       `db:"status"`
+	DeletedAt         sql.NullTime `db:"deleted_at"`
+	Metadata          string       `db:"metadata"`
+	ScanStatus        string       `db:"scan_status"`
+	Encrypted         bool         `db:"encrypted"`
+	ClientName        string       `db:"client_name"`
+	BucketName        string       `db:"bucket_name"`
+	BucketArchived    bool         `db:"bucket_archived"`
+	BucketArchiveMode string       `db:"bucket_archive_mode"`
+}
+
+// GenerateDownloadSignedURLs handles POST /files/download-urls - download URLs for up to
+// maxSignedURLBatchSize files at once, such as the images of a gallery. The files are read
+// in one query and each is checked like POST /files/download-url; a file that fails gets
+// an error of its own without stopping the rest. The tokens are written to the cache in
+// one round trip.
+func (h *FileHandler) GenerateDownloadSignedURLs(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req models.GenerateDownloadSignedURLsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+
+	// Repeated IDs get one URL
+	var fileIDs []string
+	seen := map[string]bool{}
+	for _, fileID := range req.FileIDs {
+		if !seen[fileID] {
+			seen[fileID] = true
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+	if len(fileIDs) == 0 {
+		h.logRequest(ctx, "error", "Missing required field: file_ids")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("file_ids is required"))
+		return
+	}
+	if len(fileIDs) > maxSignedURLBatchSize {
+		h.logRequest(ctx, "error", "Too many download URL batch entries", zap.Int("count", len(fileIDs)))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(fmt.Sprintf("file_ids cannot contain more than %d items", maxSignedURLBatchSize)))
+		return
+	}
+	if req.MaxUses < 0 || req.MaxUses > maxUploadTokenUses {
+		h.logRequest(ctx, "error", "Invalid max_uses", zap.Int("max_uses", req.MaxUses))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(fmt.Sprintf("max_uses must be between 1 and %d", maxUploadTokenUses)))
+		return
+	}
+	switch req.Disposition {
+	case "":
+		req.Disposition = models.DispositionAttachment
+	case models.DispositionAttachment, models.DispositionInline:
+	default:
+		h.logRequest(ctx, "error", "Invalid disposition", zap.String("disposition", req.Disposition))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("disposition must be one of: inline, attachment"))
+		return
+	}
+
+	ttl, err := h.signedURLTTL(req.ExpiresInSeconds)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid signed URL lifetime", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Generating download URL batch",
+		zap.String("client_id", clientID),
+		zap.Int("files", len(fileIDs)),
+	)
+
+	query, args, err := sqlx.In(
+		`SELECT f.id, f.file_name, f.mimetype, f.client_id, f.bucket_id, f.key, f.status, f.deleted_at, f.metadata,
+			COALESCE(f.scan_status, '') AS scan_status, f.encryption_key_hash IS NOT NULL AS encrypted,
+			c.name AS client_name, b.name AS bucket_name, b.archived AS bucket_archived, COALESCE(b.archive_mode, '') AS bucket_archive_mode
+		 FROM files f
+		 JOIN clients c ON f.client_id = c.client_id
+		 JOIN buckets b ON f.bucket_id = b.id
+		 WHERE f.id IN (?) AND f.staged = 0`,
+		fileIDs,
+	)
+	var rows []batchDownloadFile
+	if err == nil {
+		err = h.db.Select(&rows, h.db.Rebind(query), args...)
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query files", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to generate download URLs"))
+		return
+	}
+	files := make(map[string]batchDownloadFile, len(rows))
+	for _, file := range rows {
+		files[file.ID] = file
+	}
+
+	results := make(map[string]models.DownloadURLBatchResult, len(fileIDs))
+	fail := func(fileID string, code int, message string) {
+		results[fileID] = models.DownloadURLBatchResult{Error: &models.BatchItemError{Code: code, Message: message}}
+	}
+
+	// Each file is checked in the order POST /files/download-url checks it
+	maxUses := req.MaxUses
+	if maxUses == 0 {
+		maxUses = 1
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(ttl)
+	var issued []string
+	var tokens []string
+	var entries []cachepackage.TokenEntry
+	for _, fileID := range fileIDs {
+		file, found := files[fileID]
+		switch {
+		case !found:
+			fail(fileID, http.StatusNotFound, "File not found")
+			continue
+		case file.DeletedAt.Valid || file.Status == models.FileStatusDeleted:
+			fail(fileID, http.StatusGone, "File has been deleted")
+			continue
+		case file.Status != models.FileStatusUploaded:
+			fail(fileID, http.StatusNotFound, "File not found")
+			continue
+		case file.ScanStatus == models.ScanStatusPending:
+			fail(fileID, http.StatusConflict, "File is awaiting its virus scan; try again shortly")
+			continue
+		}
+
+		var grantID string
+		if file.ClientID != clientID {
+			grant, found, err := h.activeGrant(file.ID, clientID, models.GrantPermissionDownload)
+			if err != nil {
+				h.logRequest(ctx, "error", "Failed to query file grants", zap.String("file_id", fileID), zap.Error(err))
+				fail(fileID, http.StatusInternalServerError, "Failed to generate download URL")
+				continue
+			}
+			if !found {
+				h.logRequest(ctx, "error", "Client does not own this file",
+					zap.String("file_id", fileID),
+					zap.String("requesting_client", clientID),
+					zap.String("owner_client", file.ClientID),
+				)
+				fail(fileID, http.StatusForbidden, "Access denied")
+				continue
+			}
+			grantID = grant.ID
+		}
+
+		if readsFrozen(file.BucketArchived, file.BucketArchiveMode) {
+			fail(fileID, http.StatusConflict, "Cannot download from an archived bucket")
+			continue
+		}
+
+		resolvedFilePath := filepath.Join(file.ClientName, file.BucketName, file.Key)
+		if _, err := os.Stat(filepath.Join("./uploads", resolvedFilePath)); os.IsNotExist(err) {
+			h.logRequest(ctx, "error", "File missing on disk", zap.String("file_id", fileID), zap.String("file_path", resolvedFilePath))
+			fail(fileID, http.StatusGone, "File has been deleted")
+			continue
+		}
+
+		tokenData := models.DownloadTokenData{
+			FileID:      file.ID,
+			FileName:    file.FileName,
+			Mimetype:    file.Mimetype,
+			ClientID:    file.ClientID,
+			BucketID:    file.BucketID,
+			FilePath:    resolvedFilePath,
+			Metadata:    decodeFileMetadata(file.Metadata),
+			Encrypted:   file.Encrypted,
+			MaxUses:     maxUses,
+			ExpiresAt:   expiresAt,
+			Disposition: req.Disposition,
+		}
+		if grantID != "" {
+			tokenData.GrantID = grantID
+			tokenData.GranteeClientID = clientID
+		}
+		token := generateDownloadToken()
+		issued = append(issued, fileID)
+		tokens = append(tokens, token)
+		entries = append(entries, cachepackage.TokenEntry{Key: "download:" + token, Value: tokenData, TTL: ttl})
+		results[fileID] = models.DownloadURLBatchResult{ExpiresAt: &expiresAt, EncryptionKeyRequired: file.Encrypted}
+	}
+
+	if len(entries) > 0 {
+		var signedURLs []string
+		_, err := h.tokens.SetMany(entries, false)
+		if err == nil {
+			signedURLs, err = h.signedURLBatch(clientID, models.ShortTokenKindDownload, tokens, ttl)
+		}
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to store download tokens", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to generate download URLs"))
+			return
+		}
+		for i, fileID := range issued {
+			result := results[fileID]
+			result.SignedURL = signedURLs[i]
+			results[fileID] = result
+		}
+	}
+
+	batch := models.DownloadURLBatchResponse{Results: results}
+	for _, result := range results {
+		if result.Error != nil {
+			batch.Failed++
+		} else {
+			batch.Succeeded++
+		}
+	}
+
+	h.logRequest(ctx, "info", "Download URL batch generated",
+		zap.String("client_id", clientID),
+		zap.Int("succeeded", batch.Succeeded),
+		zap.Int("failed", batch.Failed),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(batch)
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/umakantv/go-utils/errs"
+	"go.uber.org/zap"
+)
+
+// encryptionKeyHeader carries a customer-provided AES-256 key, base64 encoded, on uploads
+// that should be stored encrypted and on downloads of such files
+const encryptionKeyHeader = "X-Encryption-Key"
+
+var (
+	// errInvalidEncryptionKey is returned for an X-Encryption-Key that is not a base64 AES-256 key
+	errInvalidEncryptionKey = errors.New("X-Encryption-Key must be a base64-encoded 256-bit AES key")
+	// errEncryptionKeyRequired is returned when an encrypted file is downloaded without its key
+	errEncryptionKeyRequired = errors.New("File is encrypted with a customer-provided key; send the key in the X-Encryption-Key header")
+	// errEncryptionKeyMismatch is returned when the key sent does not match the one the file was encrypted with
+	errEncryptionKeyMismatch = errors.New("X-Encryption-Key does not match the key the file was encrypted with")
+)
+
+// customerKey is a key sent with a request. Only Hash and IV are ever stored; the key
+// itself lives for the request alone.
+type customerKey struct {
+	Key []byte
+	// IV is the random counter the content of a new upload is encrypted from
+	IV []byte
+	// Hash is "<salt>:<sha256>" in hex, the SHA-256 of a random salt followed by the key
+	Hash string
+}
+
+// parseCustomerKey reads the X-Encryption-Key header of an upload, generating a fresh IV
+// and salted hash for it. It returns nil when the header is absent.
+func parseCustomerKey(r *http.Request) (*customerKey, error) {
+	key, err := decodeCustomerKey(r)
+	if key == nil || err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	salt := make([]byte, 16)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &customerKey{Key: key, IV: iv, Hash: hashCustomerKey(salt, key)}, nil
+}
+
+// decodeCustomerKey decodes the X-Encryption-Key header; nil when it is absent
+func decodeCustomerKey(r *http.Request) ([]byte, error) {
+	value := strings.TrimSpace(r.Header.Get(encryptionKeyHeader))
+	if value == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		return nil, errInvalidEncryptionKey
+	}
+	return key, nil
+}
+
+// hashCustomerKey returns the stored form of a key hashed with salt
+func hashCustomerKey(salt, key []byte) string {
+	sum := sha256.Sum256(append(append([]byte{}, salt...), key...))
+	return hex.EncodeToString(salt) + ":" + hex.EncodeToString(sum[:])
+}
+
+// customerKeyMatches reports whether key hashes to storedHash
+func customerKeyMatches(storedHash string, key []byte) bool {
+	saltHex, _, ok := strings.Cut(storedHash, ":")
+	if !ok {
+		return false
+	}
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashCustomerKey(salt, key)), []byte(storedHash)) == 1
+}
+
+// columns returns the encryption_key_hash and encryption_iv values stored for content
+// written with k; both NULL when k is nil
+func (k *customerKey) columns() (sql.NullString, sql.NullString) {
+	if k == nil {
+		return sql.NullString{}, sql.NullString{}
+	}
+	return sql.NullString{String: k.Hash, Valid: true}, sql.NullString{String: hex.EncodeToString(k.IV), Valid: true}
+}
+
+// encrypt wraps r so its bytes are encrypted as they are read; r itself when k is nil.
+// AES-CTR keeps the stored size equal to the plaintext size.
+func (k *customerKey) encrypt(r io.Reader) (io.Reader, error) {
+	if k == nil {
+		return r, nil
+	}
+	return ctrReader(k.Key, k.IV, r)
+}
+
+// decryptStored wraps r, the stored bytes of content encrypted with key from the hex iv
+// kept with it
+func decryptStored(key []byte, ivHex string, r io.Reader) (io.Reader, error) {
+	iv, err := hex.DecodeString(ivHex)
+	if err != nil {
+		return nil, err
+	}
+	return ctrReader(key, iv, r)
+}
+
+// ctrReader applies AES-CTR to what is read from r; the same call encrypts and decrypts
+func ctrReader(key, iv []byte, r io.Reader) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, errors.New("invalid encryption IV")
+	}
+	return cipher.StreamReader{S: cipher.NewCTR(block, iv), R: r}, nil
+}
+
+// decryptStoredFrom returns the plaintext of content encrypted with key from the hex iv,
+// starting offset bytes into it. CTR mode lets decryption start at any block: f is
+// positioned at the block holding offset, the counter is advanced to it, and the bytes
+// before offset within that block are discarded.
+func decryptStoredFrom(key []byte, ivHex string, f io.ReadSeeker, offset int64) (io.Reader, error) {
+	iv, err := hex.DecodeString(ivHex)
+	if err != nil {
+		return nil, err
+	}
+	blockStart := offset - offset%aes.BlockSize
+	if _, err := f.Seek(blockStart, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// The counter is the IV read as a big-endian integer, incremented once per block
+	counter := append([]byte{}, iv...)
+	carry := uint64(blockStart / aes.BlockSize)
+	for i := len(counter) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+
+	plain, err := ctrReader(key, counter, f)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, plain, offset-blockStart); err != nil {
+		return nil, err
+	}
+	return plain, nil
+}
+
+// fileEncryption returns the key hash and hex IV stored for a file's current content, or
+// for one of its versions when versionID is set; both empty when it is not encrypted
+func fileEncryption(q sqlx.Queryer, fileID, versionID string) (string, string, error) {
+	query, id := "SELECT COALESCE(encryption_key_hash, ''), COALESCE(encryption_iv, '') FROM files WHERE id = ?", fileID
+	if versionID != "" {
+		query, id = "SELECT COALESCE(encryption_key_hash, ''), COALESCE(encryption_iv, '') FROM file_versions WHERE id = ?", versionID
+	}
+	var keyHash, iv string
+	err := q.QueryRowx(query, id).Scan(&keyHash, &iv)
+	return keyHash, iv, err
+}
+
+// rejectCustomerKey answers 400 when an upload that cannot store encrypted content was
+// sent an X-Encryption-Key, so the content is never stored in the clear by mistake.
+// It reports whether the request was rejected.
+func (h *FileHandler) rejectCustomerKey(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get(encryptionKeyHeader) == "" {
+		return false
+	}
+	h.logRequest(ctx, "error", "Encryption key sent to an upload that cannot be encrypted", zap.String("path", r.URL.Path))
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(errs.NewValidationError(
+		"X-Encryption-Key is only supported on signed URL uploads (POST /files/upload)",
+	))
+	return true
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/umakantv/go-utils/errs"
+	"go.uber.org/zap"
+)
+
+// validateExtractRequest checks the fields a signed URL with extract=true must agree with
+func validateExtractRequest(req models.CreateSignedURLRequest) error {
+	switch {
+	case normalizeMimetype(req.Mimetype) != "application/zip":
+		return errors.New("extract requires mimetype application/zip")
+	case req.MaxUses > 1:
+		return errors.New("extract URLs accept a single upload; max_uses must be 1")
+	case req.CallbackURL != "":
+		return errors.New("callback_url is not supported with extract")
+	}
+	return nil
+}
+
+// uploadAndExtract answers POST /files/upload for a token issued with extract=true: the
+// posted zip is staged, checked like an archive given to POST /files/{id}/expand, and
+// unpacked beneath the token's key, one file per entry. The zip itself is not kept. The
+// whole archive is extracted in the request, so the response lists every entry created,
+// skipped or refused; the expansion limits still apply.
+func (h *FileHandler) uploadAndExtract(ctx context.Context, w http.ResponseWriter, r *http.Request, token string, tokenData models.UploadTokenData) {
+	if r.Header.Get(encryptionKeyHeader) != "" {
+		h.logRequest(ctx, "error", "Encryption key sent to an extract upload")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("X-Encryption-Key is not supported on extract upload URLs"))
+		return
+	}
+	if !h.hasDiskSpace(uploadsRoot, tokenData.FileSize) {
+		h.logRequest(ctx, "error", "Not enough disk space for upload",
+			zap.String("file_id", tokenData.FileID),
+			zap.Int64("file_size", tokenData.FileSize),
+		)
+		writeInsufficientStorage(w)
+		return
+	}
+
+	_, claimed, err := h.claimUploadUse(tokenData.FileID)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to claim upload token use", zap.String("file_id", tokenData.FileID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to process upload"))
+		return
+	}
+	if !claimed {
+		h.logRequest(ctx, "error", "Upload token has no uses left", zap.String("file_id", tokenData.FileID))
+		h.cache.Delete("upload:" + token)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Invalid or expired upload token"))
+		return
+	}
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		if err := h.refundUploadUse(tokenData.FileID); err != nil {
+			h.logRequest(ctx, "error", "Failed to refund upload token use", zap.String("file_id", tokenData.FileID), zap.Error(err))
+		}
+	}()
+
+	r.Body = http.MaxBytesReader(w, r.Body, tokenData.FileSize+multipartOverhead)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		h.logRequest(ctx, "error", "Upload is not a multipart form", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Missing file in upload"))
+		return
+	}
+	_, file, status, appErr := h.readFormFields(ctx, reader)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+	defer file.Close()
+
+	detected, body, err := sniffContentType(file)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeFileTooLarge(w)
+			return
+		}
+		h.logRequest(ctx, "error", "Failed to read upload body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Failed to read upload body"))
+		return
+	}
+	if !tokenData.AllowMimetypeMismatch && !mimetypesMatch(tokenData.Mimetype, detected) {
+		h.logRequest(ctx, "error", "Uploaded content does not match declared mimetype",
+			zap.String("file_id", tokenData.FileID),
+			zap.String("declared", tokenData.Mimetype),
+			zap.String("detected", detected),
+		)
+		writeMimetypeMismatch(w, tokenData.Mimetype, detected)
+		return
+	}
+
+	buf := h.buffers.get()
+	stagedPath, written, err := stageFile(filepath.Join(uploadsRoot, tokenData.FilePath), body, tokenData.FileSize, buf)
+	h.buffers.put(buf)
+	var maxBytesErr *http.MaxBytesError
+	if errors.Is(err, errFileTooLarge) || errors.As(err, &maxBytesErr) {
+		h.logRequest(ctx, "error", "File size exceeds limit", zap.Int64("max_size", tokenData.FileSize))
+		writeFileTooLarge(w)
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to write file", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to save file"))
+		return
+	}
+	defer os.Remove(stagedPath)
+
+	f, err := os.Open(stagedPath)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to open staged archive", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to read file"))
+		return
+	}
+	defer f.Close()
+	archive, status, appErr := h.openArchive(ctx, f)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	// The URL is spent from here on. Its row stops counting against the owner's quota and
+	// the bucket's limits before the entries are stored; the zip is never stored, so the
+	// row was never visible.
+	if _, err := retirePendingUpload(h.db, tokenData.FileID, time.Now().UTC()); err != nil {
+		h.logRequest(ctx, "error", "Failed to retire extract upload", zap.String("file_id", tokenData.FileID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to record upload"))
+		return
+	}
+	succeeded = true
+	h.cache.Delete("upload:" + token)
+
+	expander := &archiveExpander{
+		h: h,
+		source: archiveSource{
+			FileID:          tokenData.FileID,
+			ClientID:        tokenData.ClientID,
+			BucketID:        tokenData.BucketID,
+			OwnerEntityType: tokenData.OwnerEntityType,
+			OwnerEntityID:   tokenData.OwnerEntityID,
+			Path:            stagedPath,
+		},
+		prefix:     tokenData.ExtractTo,
+		onConflict: tokenData.OnConflict,
+		remaining:  h.config.ArchiveExpandMaxTotalBytes,
+		summary:    expansionSummary(models.ArchiveExpansion{}),
+		uploader:   h.uploaderOf(r),
+	}
+	for _, entry := range archiveFileEntries(archive) {
+		if ctx.Err() != nil {
+			break
+		}
+		expander.expandEntry(ctx, entry)
+	}
+	summary := expander.summary
+
+	h.logRequest(ctx, "info", "Uploaded archive extracted",
+		zap.String("file_id", tokenData.FileID),
+		zap.String("prefix", tokenData.ExtractTo),
+		zap.Int64("archive_bytes", written),
+		zap.Int("created", len(summary.Created)),
+		zap.Int("skipped", len(summary.Skipped)),
+		zap.Int("errors", len(summary.Errors)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":   "Archive extracted",
+		"bucket_id": tokenData.BucketID,
+		"prefix":    tokenData.ExtractTo,
+		"created":   summary.Created,
+		"skipped":   summary.Skipped,
+		"errors":    summary.Errors,
+	})
+}
@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// eventTimeFormat is how file_events.created_at (CURRENT_TIMESTAMP, UTC) is stored,
+// so timestamps compared against it in SQL must use the same format
+const eventTimeFormat = "2006-01-02 15:04:05"
+
+// errResyncRequired means the events a cursor asks for have been compacted away
+var errResyncRequired = errors.New("resync required")
+
+// fileEventsHead returns the cursor of the newest event, counting compacted ones
+func fileEventsHead(q sqlx.Queryer) (int64, error) {
+	var head int64
+	err := q.QueryRowx(
+		"SELECT MAX(COALESCE((SELECT MAX(seq) FROM file_events), 0), compacted_seq) FROM file_events_horizon WHERE id = 1",
+	).Scan(&head)
+	return head, err
+}
+
+// resolveEventCursor turns ?since= into the seq to read events after. since is either a
+// cursor returned by the changes endpoint or an RFC 3339 timestamp; empty means from the
+// start of the history. errResyncRequired is returned when the history has been compacted
+// past the requested point.
+func resolveEventCursor(q sqlx.Queryer, since string) (int64, error) {
+	var compactedSeq int64
+	var compactedBefore sql.NullString
+	if err := q.QueryRowx("SELECT compacted_seq, compacted_before FROM file_events_horizon WHERE id = 1").Scan(&compactedSeq, &compactedBefore); err != nil {
+		return 0, err
+	}
+
+	if seq, err := strconv.ParseInt(since, 10, 64); err == nil || since == "" {
+		if seq < 0 {
+			return 0, errors.New("since must be a cursor returned by this endpoint or an RFC 3339 timestamp")
+		}
+		if seq < compactedSeq {
+			return 0, errResyncRequired
+		}
+		return seq, nil
+	}
+
+	ts, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return 0, errors.New("since must be a cursor returned by this endpoint or an RFC 3339 timestamp")
+	}
+	// Event times have one-second precision, so the whole second of ts is replayed:
+	// a change may be returned twice but is never skipped
+	at := ts.UTC().Format(eventTimeFormat)
+	if compactedBefore.Valid && at < compactedBefore.String {
+		return 0, errResyncRequired
+	}
+	var first sql.NullInt64
+	if err := q.QueryRowx("SELECT MIN(seq) FROM file_events WHERE created_at >= ?", at).Scan(&first); err != nil {
+		return 0, err
+	}
+	if !first.Valid {
+		return fileEventsHead(q)
+	}
+	return first.Int64 - 1, nil
+}
+
+// ListBucketChanges handles GET /buckets/{id}/changes - list the file changes of a bucket
+// after ?since= (a cursor from a previous call or an RFC 3339 timestamp), oldest first
+func (h *FileHandler) ListBucketChanges(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	idStr := mux.Vars(r)["id"]
+	bucketID, err := strconv.Atoi(idStr)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid bucket ID", zap.String("id", idStr))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid bucket ID"))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+
+	if _, status, appErr := h.loadSnapshotBucket(ctx, auth.Client, bucketID); appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	since := r.URL.Query().Get("since")
+
+	// Read the cursor, the events and the head in one transaction so they agree
+	tx, err := h.db.Beginx()
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to begin transaction", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to list changes"))
+		return
+	}
+	defer tx.Rollback()
+
+	after, err := resolveEventCursor(tx, since)
+	if err == errResyncRequired {
+		head, err := fileEventsHead(tx)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to read file events head", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to list changes"))
+			return
+		}
+		h.logRequest(ctx, "info", "Changes cursor is past retention", zap.Int("bucket_id", bucketID), zap.String("since", since))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(models.ResyncRequiredError{
+			Code:           http.StatusGone,
+			Message:        "Changes since this cursor are no longer available; list the bucket again and continue from the returned cursor",
+			ResyncRequired: true,
+			Cursor:         strconv.FormatInt(head, 10),
+		})
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid changes cursor", zap.String("since", since), zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	// Fetch one event past the limit so we know whether the response was truncated
+	maxRows := h.config.MaxSyncRows
+	events := make([]models.FileEvent, 0)
+	if err := tx.Select(&events,
+		`SELECT seq, event, file_id, key, COALESCE(previous_key, '') AS previous_key, file_name, file_size, mimetype, created_at
+		FROM file_events WHERE bucket_id = ? AND seq > ? ORDER BY seq LIMIT ?`,
+		bucketID, after, maxRows+1,
+	); err != nil {
+		h.logRequest(ctx, "error", "Failed to query file events", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to list changes"))
+		return
+	}
+
+	response := models.BucketChangesResponse{BucketID: bucketID}
+	if len(events) > maxRows {
+		events = events[:maxRows]
+		response.Truncated = true
+		response.Cursor = strconv.FormatInt(events[len(events)-1].Seq, 10)
+	} else {
+		// Every event up to the head has been seen, including those of other buckets
+		head, err := fileEventsHead(tx)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to read file events head", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to list changes"))
+			return
+		}
+		if head < after {
+			head = after
+		}
+		response.Cursor = strconv.FormatInt(head, 10)
+	}
+	response.Events = events
+
+	h.logRequest(ctx, "info", "Listed bucket changes",
+		zap.Int("bucket_id", bucketID),
+		zap.Int("events", len(events)),
+		zap.String("cursor", response.Cursor),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// StartFileEventSweeper periodically compacts file events past their retention. Only the
+// instance holding the sweeper's lease runs it.
+func (h *FileHandler) StartFileEventSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			h.jobs.runPeriodic(fileEventSweeperLease, h.compactFileEvents)
+		}
+	}()
+}
+
+// compactFileEvents deletes events older than the retention and moves the horizon past
+// them, so cursors that still point into the deleted range get a resync response. The
+// compaction is rolled back if ctx is cancelled before it commits.
+func (h *FileHandler) compactFileEvents(ctx context.Context) {
+	cutoff := time.Now().Add(-h.config.FileEventRetention).UTC().Format(eventTimeFormat)
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		logger.Error("Failed to begin file event compaction", zap.Error(err))
+		return
+	}
+	defer tx.Rollback()
+
+	var last sql.NullInt64
+	if err := tx.QueryRow("SELECT MAX(seq) FROM file_events WHERE created_at < ?", cutoff).Scan(&last); err != nil {
+		logger.Error("Failed to query expired file events", zap.Error(err))
+		return
+	}
+	if !last.Valid {
+		return
+	}
+
+	result, err := tx.Exec("DELETE FROM file_events WHERE seq <= ?", last.Int64)
+	if err != nil {
+		logger.Error("Failed to delete expired file events", zap.Error(err))
+		return
+	}
+	if _, err := tx.Exec(
+		"UPDATE file_events_horizon SET compacted_seq = ?, compacted_before = ? WHERE id = 1",
+		last.Int64, cutoff,
+	); err != nil {
+		logger.Error("Failed to move file events horizon", zap.Error(err))
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		logger.Error("Failed to commit file event compaction", zap.Error(err))
+		return
+	}
+
+	deleted, _ := result.RowsAffected()
+	logger.Info("Compacted file events", zap.Int64("deleted", deleted), zap.Int64("compacted_seq", last.Int64))
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+
+	"file-upload-service/models"
+)
+
+// bucketChanges lists the changes of a bucket after a cursor
+func (e *testEnv) bucketChanges(bucketID int, since string) *httptest.ResponseRecorder {
+	return e.serve(e.files.ListBucketChanges,
+		newRequest(http.MethodGet, "/buckets/"+strconv.Itoa(bucketID)+"/changes?since="+url.QueryEscape(since), nil),
+		map[string]string{"id": strconv.Itoa(bucketID)})
+}
+
+// expectChanges lists the changes after a cursor and checks their kinds and keys
+func (e *testEnv) expectChanges(bucketID int, since string, want ...string) models.BucketChangesResponse {
+	e.t.Helper()
+	w := e.bucketChanges(bucketID, since)
+	expectStatus(e.t, w, http.StatusOK)
+	var changes models.BucketChangesResponse
+	decode(e.t, w, &changes)
+	if len(changes.Events) != len(want) {
+		e.t.Fatalf("since %q: events = %+v, want %v", since, changes.Events, want)
+	}
+	for i, event := range changes.Events {
+		if got := event.Event + " " + event.Key; got != want[i] {
+			e.t.Fatalf("since %q: event %d is %q, want %q", since, i, got, want[i])
+		}
+	}
+	return changes
+}
+
+func TestBucketChangesReplayAcrossCursors(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	otherID := env.createBucket("other")
+
+	fileID := env.putFile(bucketID, "docs/a.txt", []byte("aaaa"))
+	changes := env.expectChanges(bucketID, "", "created docs/a.txt")
+	if changes.Events[0].FileID != fileID {
+		t.Fatalf("created event is for %s, want %s", changes.Events[0].FileID, fileID)
+	}
+	created := changes.Cursor
+
+	// No endpoint moves a single file; the triggers record a key change whatever makes it
+	if err := os.Rename(env.diskPath(bucketID, "docs/a.txt"), env.diskPath(bucketID, "docs/b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	env.db.MustExec("UPDATE files SET key = ? WHERE id = ?", "docs/b.txt", fileID)
+	changes = env.expectChanges(bucketID, created, "updated docs/b.txt")
+	if changes.Events[0].PreviousKey != "docs/a.txt" {
+		t.Fatalf("rename event has previous_key %q, want docs/a.txt", changes.Events[0].PreviousKey)
+	}
+	renamed := changes.Cursor
+
+	env.deletePath(bucketID, "docs")
+	deleted := env.expectChanges(bucketID, renamed, "deleted docs/b.txt").Cursor
+
+	// Replaying from an earlier cursor returns the later changes again, in order
+	env.expectChanges(bucketID, created, "updated docs/b.txt", "deleted docs/b.txt")
+
+	// Changes of another bucket are not listed but still move the cursor on
+	env.putFile(otherID, "x.txt", []byte("x"))
+	changes = env.expectChanges(bucketID, deleted)
+	if next, _ := strconv.Atoi(changes.Cursor); next <= mustAtoi(t, deleted) {
+		t.Fatalf("cursor stayed at %s after another bucket's change", changes.Cursor)
+	}
+	if again := env.expectChanges(bucketID, changes.Cursor); again.Cursor != changes.Cursor {
+		t.Fatalf("cursor moved from %s to %s without changes", changes.Cursor, again.Cursor)
+	}
+}
+
+func mustAtoi(t *testing.T, s string) int {
+	t.Helper()
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestCompactedCursorNeedsResync(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.putFile(bucketID, "docs/a.txt", []byte("aaaa"))
+	env.putFile(bucketID, "docs/b.txt", []byte("bbbb"))
+	stale := env.expectChanges(bucketID, "0", "created docs/a.txt", "created docs/b.txt").Cursor
+
+	env.db.MustExec("UPDATE file_events SET created_at = '2020-01-01 00:00:00'")
+	env.putFile(bucketID, "docs/c.txt", []byte("cccc"))
+	env.files.compactFileEvents(context.Background())
+
+	for _, since := range []string{"0", "1", "2019-12-31T00:00:00Z"} {
+		w := env.bucketChanges(bucketID, since)
+		expectStatus(t, w, http.StatusGone)
+		var resync models.ResyncRequiredError
+		decode(t, w, &resync)
+		if !resync.ResyncRequired || resync.Cursor != "3" {
+			t.Fatalf("since %q: resync = %+v, want resync_required from cursor 3", since, resync)
+		}
+	}
+
+	// The newest cursor from before the compaction is still good
+	env.expectChanges(bucketID, stale, "created docs/c.txt")
+}
@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// fileGrantColumns are the file_grants columns scanned into models.FileGrant
+const fileGrantColumns = "id, file_id, owner_client_id, grantee_client_id, permission, expires_at, revoked_at, download_count, last_downloaded_at, created_at"
+
+// grantResponse converts a grant to its API representation
+func grantResponse(grant models.FileGrant) models.FileGrantResponse {
+	response := models.FileGrantResponse{
+		ID:              grant.ID,
+		FileID:          grant.FileID,
+		GranteeClientID: grant.GranteeClientID,
+		Permission:      grant.Permission,
+		DownloadCount:   grant.DownloadCount,
+		CreatedAt:       grant.CreatedAt,
+	}
+	if grant.ExpiresAt.Valid {
+		response.ExpiresAt = &grant.ExpiresAt.Time
+	}
+	if grant.LastDownloadedAt.Valid {
+		response.LastDownloadedAt = &grant.LastDownloadedAt.Time
+	}
+	if grant.RevokedAt.Valid {
+		response.RevokedAt = &grant.RevokedAt.Time
+	}
+	return response
+}
+
+// activeGrant returns the unrevoked, unexpired grant giving a client the permission on a file.
+// found is false when the client has no such grant.
+func (h *FileHandler) activeGrant(fileID, granteeClientID, permission string) (grant models.FileGrant, found bool, err error) {
+	err = h.db.Get(&grant,
+		"SELECT "+fileGrantColumns+` FROM file_grants
+		WHERE file_id = ? AND grantee_client_id = ? AND permission = ? AND revoked_at IS NULL
+		AND (expires_at IS NULL OR expires_at > ?)`,
+		fileID, granteeClientID, permission, time.Now().UTC(),
+	)
+	if err == sql.ErrNoRows {
+		return grant, false, nil
+	}
+	return grant, err == nil, err
+}
+
+// recordGrantDownload counts a download made through a grant
+func (h *FileHandler) recordGrantDownload(grantID string) error {
+	now := time.Now().UTC()
+	_, err := h.db.Exec(
+		"UPDATE file_grants SET download_count = download_count + 1, last_downloaded_at = ? WHERE id = ?",
+		now, grantID,
+	)
+	return err
+}
+
+// loadOwnedFile checks that a live file exists and belongs to the client.
+// On failure it returns the HTTP status to respond with and the error body.
+func (h *FileHandler) loadOwnedFile(ctx context.Context, clientID, fileID string) (int, *errs.AppError) {
+	var ownerClientID string
+	err := h.db.QueryRow(
+		"SELECT client_id FROM files WHERE id = ? AND status <> ? AND staged = 0",
+		fileID, models.FileStatusDeleted,
+	).Scan(&ownerClientID)
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "info", "File not found", zap.String("file_id", fileID))
+		return http.StatusNotFound, errs.NewNotFoundError("File not found")
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query file", zap.Error(err))
+		return http.StatusInternalServerError, errs.NewInternalServerError("Database error")
+	}
+	if ownerClientID != clientID {
+		h.logRequest(ctx, "error", "Client does not own this file",
+			zap.String("file_id", fileID),
+			zap.String("requesting_client", clientID),
+		)
+		return http.StatusForbidden, errs.NewAuthorizationError("Access denied")
+	}
+	return 0, nil
+}
+
+// CreateFileGrant handles POST /files/{id}/grants - let another client download a file
+func (h *FileHandler) CreateFileGrant(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	fileID := mux.Vars(r)["id"]
+
+	var req models.CreateFileGrantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	if req.Permission == "" {
+		req.Permission = models.GrantPermissionDownload
+	}
+	if req.Permission != models.GrantPermissionDownload {
+		h.logRequest(ctx, "error", "Invalid grant permission", zap.String("permission", req.Permission))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("permission must be download"))
+		return
+	}
+	if req.GranteeClientID == "" {
+		h.logRequest(ctx, "error", "Missing required field: grantee_client_id")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("grantee_client_id is required"))
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		h.logRequest(ctx, "error", "Grant expiry is in the past", zap.Time("expires_at", *req.ExpiresAt))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("expires_at must be in the future"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Creating file grant",
+		zap.String("file_id", fileID),
+		zap.String("client_id", clientID),
+		zap.String("grantee_client_id", req.GranteeClientID),
+	)
+
+	if status, appErr := h.loadOwnedFile(ctx, clientID, fileID); appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	if req.GranteeClientID == clientID {
+		h.logRequest(ctx, "error", "Grantee is the file owner", zap.String("file_id", fileID))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("grantee_client_id must be another client"))
+		return
+	}
+
+	var granteeExists int
+	if err := h.db.QueryRow("SELECT COUNT(*) FROM clients WHERE client_id = ?", req.GranteeClientID).Scan(&granteeExists); err != nil {
+		h.logRequest(ctx, "error", "Failed to query grantee client", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to create grant"))
+		return
+	}
+	if granteeExists == 0 {
+		h.logRequest(ctx, "error", "Grantee client not found", zap.String("grantee_client_id", req.GranteeClientID))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("grantee_client_id does not match any client"))
+		return
+	}
+
+	if existing, found, err := h.activeGrant(fileID, req.GranteeClientID, req.Permission); err != nil {
+		h.logRequest(ctx, "error", "Failed to query file grants", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to create grant"))
+		return
+	} else if found {
+		h.logRequest(ctx, "error", "Grantee already has an active grant", zap.String("grant_id", existing.ID))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Client already has an active grant on this file: " + existing.ID))
+		return
+	}
+
+	grant := models.FileGrant{
+		ID:              uuid.New().String(),
+		FileID:          fileID,
+		OwnerClientID:   clientID,
+		GranteeClientID: req.GranteeClientID,
+		Permission:      req.Permission,
+		CreatedAt:       time.Now().UTC(),
+	}
+	if req.ExpiresAt != nil {
+		grant.ExpiresAt = sql.NullTime{Time: req.ExpiresAt.UTC(), Valid: true}
+	}
+
+	if _, err := h.db.NamedExec(
+		`INSERT INTO file_grants (id, file_id, owner_client_id, grantee_client_id, permission, expires_at, created_at)
+		VALUES (:id, :file_id, :owner_client_id, :grantee_client_id, :permission, :expires_at, :created_at)`,
+		grant,
+	); err != nil {
+		h.logRequest(ctx, "error", "Failed to insert file grant", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to create grant"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "File grant created", zap.String("grant_id", grant.ID), zap.String("file_id", fileID))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(grantResponse(grant))
+}
+
+// ListFileGrants handles GET /files/{id}/grants - list a file's unrevoked grants
+func (h *FileHandler) ListFileGrants(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	fileID := mux.Vars(r)["id"]
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Listing file grants", zap.String("file_id", fileID), zap.String("client_id", clientID))
+
+	if status, appErr := h.loadOwnedFile(ctx, clientID, fileID); appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	var grants []models.FileGrant
+	if err := h.db.Select(&grants,
+		"SELECT "+fileGrantColumns+" FROM file_grants WHERE file_id = ? AND revoked_at IS NULL ORDER BY created_at",
+		fileID,
+	); err != nil {
+		h.logRequest(ctx, "error", "Failed to query file grants", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to list grants"))
+		return
+	}
+
+	response := models.FileGrantListResponse{
+		FileID: fileID,
+		Grants: make([]models.FileGrantResponse, 0, len(grants)),
+	}
+	for _, grant := range grants {
+		response.Grants = append(response.Grants, grantResponse(grant))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// RevokeFileGrant handles DELETE /files/{id}/grants/{grant_id} - revoke a grant
+func (h *FileHandler) RevokeFileGrant(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fileID := vars["id"]
+	grantID := vars["grant_id"]
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Revoking file grant", zap.String("file_id", fileID), zap.String("grant_id", grantID))
+
+	if status, appErr := h.loadOwnedFile(ctx, clientID, fileID); appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	result, err := h.db.Exec(
+		"UPDATE file_grants SET revoked_at = ? WHERE id = ? AND file_id = ? AND revoked_at IS NULL",
+		time.Now().UTC(), grantID, fileID,
+	)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to revoke file grant", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to revoke grant"))
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		h.logRequest(ctx, "info", "File grant not found", zap.String("grant_id", grantID))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Grant not found"))
+		return
+	}
+
+	var grant models.FileGrant
+	if err := h.db.Get(&grant, "SELECT "+fileGrantColumns+" FROM file_grants WHERE id = ?", grantID); err != nil {
+		h.logRequest(ctx, "error", "Failed to query revoked grant", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to revoke grant"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "File grant revoked", zap.String("grant_id", grantID))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(grantResponse(grant))
+}
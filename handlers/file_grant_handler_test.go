@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/umakantv/go-utils/httpserver"
+)
+
+// addClient registers another client and returns its client ID
+func (e *testEnv) addClient(name string) string {
+	e.t.Helper()
+	clientID := "client_" + name
+	e.db.MustExec("INSERT INTO clients (name, client_id, client_secret) VALUES (?, ?, ?)", name, clientID, "secret_"+name)
+	return clientID
+}
+
+// serveAs calls a handler as the router does for another client
+func serveAs(clientID string, handler httpserver.HandlerFunc, r *http.Request, vars map[string]string) *httptest.ResponseRecorder {
+	ctx := context.WithValue(r.Context(), httpserver.RequestAuthKey, httpserver.RequestAuth{Type: "basic", Client: clientID})
+	return serveAnonymous(handler, r.WithContext(ctx), vars)
+}
+
+// grantDownload gives a client a download grant on a file
+func (e *testEnv) grantDownload(fileID, granteeClientID string, expiresAt *time.Time) models.FileGrantResponse {
+	e.t.Helper()
+	w := e.serve(e.files.CreateFileGrant, newRequest(http.MethodPost, "/files/"+fileID+"/grants",
+		models.CreateFileGrantRequest{GranteeClientID: granteeClientID, ExpiresAt: expiresAt}),
+		map[string]string{"id": fileID})
+	expectStatus(e.t, w, http.StatusCreated)
+	var grant models.FileGrantResponse
+	decode(e.t, w, &grant)
+	return grant
+}
+
+// requestDownloadAs asks for a download URL of a file as a client
+func (e *testEnv) requestDownloadAs(clientID, fileID string) *httptest.ResponseRecorder {
+	return serveAs(clientID, e.files.GenerateDownloadSignedURL, newRequest(http.MethodPost, "/files/download-url",
+		models.GenerateDownloadSignedURLRequest{FileID: fileID}), nil)
+}
+
+func TestGranteeDownloadsFile(t *testing.T) {
+	env := newTestEnv(t)
+	grantee := env.addClient("grantee")
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "docs/a.txt", []byte("shared"))
+	grant := env.grantDownload(fileID, grantee, nil)
+
+	w := env.requestDownloadAs(grantee, fileID)
+	expectStatus(t, w, http.StatusCreated)
+	var signed models.SignedURLResponse
+	decode(t, w, &signed)
+	target := signed.SignedURL[strings.Index(signed.SignedURL, "/files/"):]
+
+	w = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, target, nil), nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Body.String(); got != "shared" {
+		t.Fatalf("downloaded %q, want %q", got, "shared")
+	}
+
+	var count int
+	if err := env.db.Get(&count, "SELECT download_count FROM file_grants WHERE id = ?", grant.ID); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("grant download_count = %d, want 1", count)
+	}
+}
+
+func TestRevokedGrantStopsDownloads(t *testing.T) {
+	env := newTestEnv(t)
+	grantee := env.addClient("grantee")
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "docs/a.txt", []byte("shared"))
+	grant := env.grantDownload(fileID, grantee, nil)
+
+	// A URL issued before the revocation stops working with it
+	w := env.requestDownloadAs(grantee, fileID)
+	expectStatus(t, w, http.StatusCreated)
+	var signed models.SignedURLResponse
+	decode(t, w, &signed)
+
+	w = env.serve(env.files.RevokeFileGrant, newRequest(http.MethodDelete, "/files/"+fileID+"/grants/"+grant.ID, nil),
+		map[string]string{"id": fileID, "grant_id": grant.ID})
+	expectStatus(t, w, http.StatusOK)
+
+	target := signed.SignedURL[strings.Index(signed.SignedURL, "/files/"):]
+	w = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, target, nil), nil)
+	expectStatus(t, w, http.StatusForbidden)
+	expectStatus(t, env.requestDownloadAs(grantee, fileID), http.StatusForbidden)
+}
+
+func TestExpiredGrantStopsDownloads(t *testing.T) {
+	env := newTestEnv(t)
+	grantee := env.addClient("grantee")
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "docs/a.txt", []byte("shared"))
+	expiresAt := time.Now().Add(time.Hour)
+	grant := env.grantDownload(fileID, grantee, &expiresAt)
+	expectStatus(t, env.requestDownloadAs(grantee, fileID), http.StatusCreated)
+
+	env.db.MustExec("UPDATE file_grants SET expires_at = ? WHERE id = ?", time.Now().Add(-time.Minute), grant.ID)
+	expectStatus(t, env.requestDownloadAs(grantee, fileID), http.StatusForbidden)
+}
+
+func TestClientWithoutGrantIsDenied(t *testing.T) {
+	env := newTestEnv(t)
+	grantee := env.addClient("grantee")
+	other := env.addClient("other")
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "docs/a.txt", []byte("shared"))
+	env.grantDownload(fileID, grantee, nil)
+
+	expectStatus(t, env.requestDownloadAs(other, fileID), http.StatusForbidden)
+
+	// Nor can a grantee pass its access on
+	w := serveAs(grantee, env.files.CreateFileGrant, newRequest(http.MethodPost, "/files/"+fileID+"/grants",
+		models.CreateFileGrantRequest{GranteeClientID: other}), map[string]string{"id": fileID})
+	expectStatus(t, w, http.StatusForbidden)
+	expectStatus(t, env.requestDownloadAs(other, fileID), http.StatusForbidden)
+}
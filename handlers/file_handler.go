@@ -1,21 +1,31 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"file-upload-service/api"
+	cachepackage "file-upload-service/cache"
+	"file-upload-service/config"
+	"file-upload-service/logger"
 	"file-upload-service/models"
 
 	"github.com/google/uuid"
@@ -24,21 +34,86 @@ import (
 	"github.com/umakantv/go-utils/cache"
 	"github.com/umakantv/go-utils/errs"
 	"github.com/umakantv/go-utils/httpserver"
-	logger "github.com/umakantv/go-utils/logger"
 	"go.uber.org/zap"
 )
 
 // FileHandler handles file-related operations
 type FileHandler struct {
-	db    *sqlx.DB
-	cache cache.Cache
+	db     *sqlx.DB
+	cache  cache.Cache
+	config *config.Config
+	locks  *PathLocks
+
+	// jobs keeps each background job on one instance when several replicas run
+	jobs *JobLeases
+
+	// quotas counts what prefix upload tokens have taken of their limits
+	quotas cachepackage.UploadQuotaStore
+
+	// uses counts the uploads each file's upload tokens still accept
+	uses cachepackage.UploadUseStore
+
+	// tokens writes the tokens of signed URL batches in one round trip
+	tokens cachepackage.TokenBatchStore
+
+	// shortToken draws the tokens of short signed URLs
+	shortToken func() string
+
+	// downloads gathers file downloads until they are flushed to the files table
+	downloads *DownloadCounts
+
+	// scanner checks uploads for malware; nil when SCANNER is none
+	scanner Scanner
+
+	// geo places the addresses download URLs are redeemed from; nil when GEO_RESOLVER is none
+	geo GeoResolver
+
+	// purgeFS removes the bytes of purged files
+	purgeFS purgeFS
+
+	// importClient fetches the sources of URL imports
+	importClient *http.Client
+
+	// callbackClient notifies signed URL callback URLs of completed uploads
+	callbackClient *http.Client
+
+	// buffers holds the buffers uploads are copied to disk through; nil when FAST_TRANSFERS is off
+	buffers *copyBuffers
+
+	// pager parses list requests and signs their cursors
+	pager *api.Pager
+
+	// diskLow is set while free space on the uploads volume is below UPLOAD_DISK_RESERVE_BYTES
+	diskLow atomic.Bool
+
+	// reserveMu serializes upload key reservations
+	reserveMu sync.Mutex
+
+	// backfillMu serializes starting mimetype backfill jobs
+	backfillMu sync.Mutex
 }
 
 // NewFileHandler creates a new file handler
-func NewFileHandler(db *sqlx.DB, cache cache.Cache) *FileHandler {
+func NewFileHandler(db *sqlx.DB, cache cache.Cache, cfg *config.Config, locks *PathLocks, jobs *JobLeases, quotas cachepackage.UploadQuotaStore, uses cachepackage.UploadUseStore, tokens cachepackage.TokenBatchStore, downloads *DownloadCounts) *FileHandler {
 	return &FileHandler{
-		db:    db,
-		cache: cache,
+		db:           db,
+		cache:        cache,
+		config:       cfg,
+		locks:        locks,
+		jobs:         jobs,
+		quotas:       quotas,
+		uses:         uses,
+		tokens:       tokens,
+		shortToken:   generateShortToken,
+		downloads:    downloads,
+		scanner:      newScanner(cfg),
+		geo:          newGeoResolver(cfg),
+		purgeFS:      osPurgeFS{},
+		importClient: newURLImportClient(cfg),
+
+		callbackClient: newUploadCallbackClient(cfg),
+		buffers:        newCopyBuffers(cfg.UploadBufferBytes, cfg.FastTransfers),
+		pager:          api.NewPager(cfg.PaginationSecret),
 	}
 }
 
@@ -72,6 +147,26 @@ func (h *FileHandler) logRequest(ctx context.Context, level string, message stri
 	}
 }
 
+// defaultSignedURLTTL is how long a signed URL stays valid when the caller does not choose
+const defaultSignedURLTTL = 15 * time.Minute
+
+// maxUploadTokenUses is the most uploads, or downloads, a single signed URL may accept
+const maxUploadTokenUses = 10
+
+// signedURLTTL resolves the lifetime of a signed URL from the optional expires_in_seconds
+// of a request. Values outside the configured range are rejected rather than clamped.
+func (h *FileHandler) signedURLTTL(expiresInSeconds *int) (time.Duration, error) {
+	if expiresInSeconds == nil {
+		return defaultSignedURLTTL, nil
+	}
+	ttl := time.Duration(*expiresInSeconds) * time.Second
+	if ttl < h.config.SignedURLMinTTL || ttl > h.config.SignedURLMaxTTL {
+		return 0, fmt.Errorf("expires_in_seconds must be between %d and %d",
+			int(h.config.SignedURLMinTTL/time.Second), int(h.config.SignedURLMaxTTL/time.Second))
+	}
+	return ttl, nil
+}
+
 // generateUploadToken generates a random token for signed URL
 func generateUploadToken() string {
 	bytes := make([]byte, 32)
@@ -79,57 +174,246 @@ func generateUploadToken() string {
 	return hex.EncodeToString(bytes)
 }
 
-// GenerateSignedURL handles POST /files/signed-url - generate a signed URL for file upload
-func (h *FileHandler) GenerateSignedURL(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	var req models.CreateSignedURLRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
-		return
+// pendingUpload is a validated signed URL request resolved to its storage location
+type pendingUpload struct {
+	Key       string
+	TokenData models.UploadTokenData
+	// BucketPath is <client_name>/<bucket_name>, the part of FilePath before the key
+	BucketPath string
+	// MaxUses is how many successful uploads the token accepts
+	MaxUses int
+	// DetectedMimetype is set when the bytes are already known at insert time (direct uploads)
+	DetectedMimetype string
+	// Image is set with DetectedMimetype for images whose dimensions could be read
+	Image *models.ImageDimensions
+	// ScanStatus is set when the bytes are stored with the row and await a virus scan
+	ScanStatus sql.NullString
+	// Uploader is set when the bytes arrive with the row through an unauthenticated upload
+	Uploader uploaderInfo
+}
+
+// setKey moves a prepared upload to another key of the same bucket
+func (u *pendingUpload) setKey(key string) {
+	u.Key = key
+	u.TokenData.FilePath = filepath.Join(u.BucketPath, key)
+}
+
+// validateCreateSignedURLRequest checks the required fields of a signed URL request
+func validateCreateSignedURLRequest(req models.CreateSignedURLRequest) error {
+	switch {
+	case req.KeyPrefix != "":
+		return errors.New("key_prefix is only supported on POST /files/signed-url")
+	case req.MaxFiles != 0 || req.MaxTotalBytes != 0:
+		return errors.New("max_files and max_total_bytes require key_prefix instead of key")
+	case req.BucketID <= 0:
+		return errors.New("bucket_id is required and must be a positive integer")
+	case req.Key == "":
+		return errors.New("key is required")
+	case req.FileName == "":
+		return errors.New("file_name is required")
+	case req.FileSize <= 0:
+		return errors.New("file_size must be greater than 0")
+	case req.Mimetype == "":
+		return errors.New("mimetype is required")
+	case req.OwnerEntityType == "":
+		return errors.New("owner_entity_type is required")
+	case req.OwnerEntityID == "":
+		return errors.New("owner_entity_id is required")
+	case req.OnConflict != "" && req.OnConflict != models.OnConflictReject && req.OnConflict != models.OnConflictError &&
+		req.OnConflict != models.OnConflictOverwrite && req.OnConflict != models.OnConflictNewVersion &&
+		req.OnConflict != models.OnConflictRename:
+		return errors.New("on_conflict must be one of reject, overwrite, new-version, rename")
+	case req.OnConflict == models.OnConflictRename && req.AllowParallel:
+		return errors.New("allow_parallel cannot be combined with on_conflict=rename")
+	case req.MaxUses < 0 || req.MaxUses > maxUploadTokenUses:
+		return fmt.Errorf("max_uses must be between 1 and %d", maxUploadTokenUses)
+	case req.AllowedIP != "" && !req.RestrictIP:
+		return errors.New("allowed_ip requires restrict_ip")
+	case req.AllowedIP != "" && net.ParseIP(req.AllowedIP) == nil:
+		return errors.New("allowed_ip must be an IPv4 or IPv6 address")
+	}
+	return nil
+}
+
+// prepareUpload validates a signed URL request for the client and resolves its storage path.
+// On failure it returns the HTTP status to respond with and the error body.
+func (h *FileHandler) prepareUpload(ctx context.Context, clientID string, req models.CreateSignedURLRequest) (*pendingUpload, int, *errs.AppError) {
+	if err := validateCreateSignedURLRequest(req); err != nil {
+		h.logRequest(ctx, "error", "Invalid signed URL request", zap.Error(err))
+		return nil, http.StatusBadRequest, errs.NewValidationError(err.Error())
+	}
+	metadata, err := normalizeFileMetadata(req.Metadata)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid file metadata", zap.Error(err))
+		return nil, http.StatusBadRequest, errs.NewValidationError(err.Error())
+	}
+	if req.CallbackURL != "" {
+		if err := validateCallbackURL(req.CallbackURL, h.config.UploadCallbackAllowPrivate); err != nil {
+			h.logRequest(ctx, "error", "Invalid callback URL", zap.Error(err))
+			return nil, http.StatusBadRequest, errs.NewValidationError(err.Error())
+		}
 	}
 
-	// Validate input
-	if req.BucketID <= 0 {
-		h.logRequest(ctx, "error", "Missing or invalid required field: bucket_id")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("bucket_id is required and must be a positive integer"))
-		return
+	// Verify the bucket exists, belongs to the authenticated client, and is not archived
+	// Also fetch the bucket name for folder structure
+	var bucketClientID string
+	var bucketName string
+	var bucketArchived int
+	var bucketLowercaseKeys int
+	var bucketAllowMismatch int
+	var bucketStrictFileSize bool
+	var bucketAllowedMimetypes string
+	var bucketMaxKeyDepth int
+	var bucketMaxTopLevelFolders int
+	err = h.db.QueryRow(
+		"SELECT client_id, name, archived, lowercase_keys, allow_mimetype_mismatch, strict_file_size, allowed_mimetypes, max_key_depth, max_top_level_folders FROM buckets WHERE id = ?",
+		req.BucketID,
+	).Scan(&bucketClientID, &bucketName, &bucketArchived, &bucketLowercaseKeys, &bucketAllowMismatch, &bucketStrictFileSize, &bucketAllowedMimetypes, &bucketMaxKeyDepth, &bucketMaxTopLevelFolders)
+	if err != nil {
+		h.logRequest(ctx, "error", "Bucket not found", zap.Int("bucket_id", req.BucketID), zap.Error(err))
+		return nil, http.StatusNotFound, errs.NewNotFoundError("Bucket not found")
 	}
-	if req.Key == "" {
-		h.logRequest(ctx, "error", "Missing required field: key")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("key is required"))
-		return
+	if bucketClientID != clientID {
+		h.logRequest(ctx, "error", "Bucket does not belong to client",
+			zap.Int("bucket_id", req.BucketID),
+			zap.String("client_id", clientID),
+		)
+		return nil, http.StatusForbidden, errs.NewAuthorizationError("Access denied: bucket does not belong to your account")
 	}
-	if req.FileName == "" {
-		h.logRequest(ctx, "error", "Missing required field: file_name")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("file_name is required"))
-		return
+	if bucketArchived != 0 {
+		h.logRequest(ctx, "error", "Bucket is archived", zap.Int("bucket_id", req.BucketID))
+		return nil, http.StatusConflict, errs.NewValidationError("Cannot upload to an archived bucket")
 	}
-	if req.FileSize <= 0 {
-		h.logRequest(ctx, "error", "Invalid file_size", zap.Int64("file_size", req.FileSize))
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("file_size must be greater than 0"))
-		return
+
+	key, err := sanitizeKey(req.Key, bucketLowercaseKeys != 0)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid key", zap.String("key", req.Key), zap.Error(err))
+		return nil, http.StatusBadRequest, errs.NewValidationError(err.Error())
 	}
-	if req.Mimetype == "" {
-		h.logRequest(ctx, "error", "Missing required field: mimetype")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("mimetype is required"))
-		return
+	if reservedKey(key) {
+		h.logRequest(ctx, "error", "Key is reserved", zap.String("key", key))
+		return nil, http.StatusBadRequest, errs.NewValidationError(errReservedKey.Error())
 	}
-	if req.OwnerEntityType == "" {
-		h.logRequest(ctx, "error", "Missing required field: owner_entity_type")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("owner_entity_type is required"))
-		return
+	if status, appErr := checkKeyLimits(h.db, req.BucketID, key, bucketMaxKeyDepth, bucketMaxTopLevelFolders); appErr != nil {
+		h.logRequest(ctx, "error", "Key exceeds bucket limits", zap.String("key", key), zap.String("reason", appErr.Message))
+		return nil, status, appErr
+	}
+
+	// Enforce the bucket's mimetype allow-list
+	var allowedMimetypes []string
+	if err := json.Unmarshal([]byte(bucketAllowedMimetypes), &allowedMimetypes); err != nil {
+		h.logRequest(ctx, "error", "Failed to parse allowed_mimetypes", zap.Int("bucket_id", req.BucketID), zap.Error(err))
+		return nil, http.StatusInternalServerError, errs.NewInternalServerError("Failed to check allowed mimetypes")
+	}
+	if !mimetypeAllowed(req.Mimetype, allowedMimetypes) {
+		h.logRequest(ctx, "error", "Mimetype not allowed in bucket",
+			zap.Int("bucket_id", req.BucketID),
+			zap.String("mimetype", req.Mimetype),
+		)
+		return nil, http.StatusBadRequest, errs.NewValidationError(fmt.Sprintf(
+			"mimetype %s is not allowed in this bucket; allowed mimetypes: %s",
+			req.Mimetype, strings.Join(allowedMimetypes, ", "),
+		))
 	}
-	if req.OwnerEntityID == "" {
-		h.logRequest(ctx, "error", "Missing required field: owner_entity_id")
+
+	// Fetch the client name for folder structure
+	var clientName string
+	err = h.db.QueryRow("SELECT name FROM clients WHERE client_id = ?", clientID).Scan(&clientName)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to fetch client name", zap.String("client_id", clientID), zap.Error(err))
+		return nil, http.StatusInternalServerError, errs.NewInternalServerError("Failed to fetch client information")
+	}
+
+	if _, err := bucketFilePath(clientName, bucketName, key); err != nil {
+		h.logRequest(ctx, "error", "Key escapes bucket directory", zap.String("key", key), zap.String("client_name", clientName))
+		return nil, http.StatusBadRequest, errs.NewValidationError(err.Error())
+	}
+
+	fileID := uuid.New().String()
+	maxUses := req.MaxUses
+	if maxUses == 0 {
+		maxUses = 1
+	}
+
+	// FilePath carries the full resolved path so the upload handler needs no extra DB lookups.
+	// It is <client_name>/<bucket_name>/<key>, where the key may contain slashes for deeper
+	// nesting (e.g. "invoices/2024/receipt.pdf")
+	return &pendingUpload{
+		Key:        key,
+		BucketPath: filepath.Join(clientName, bucketName),
+		MaxUses:    maxUses,
+		TokenData: models.UploadTokenData{
+			FileID:                fileID,
+			FileName:              req.FileName,
+			FileSize:              req.FileSize,
+			Mimetype:              req.Mimetype,
+			ClientID:              clientID,
+			BucketID:              req.BucketID,
+			FilePath:              filepath.Join(clientName, bucketName, key),
+			OwnerEntityType:       req.OwnerEntityType,
+			OwnerEntityID:         req.OwnerEntityID,
+			AllowMimetypeMismatch: bucketAllowMismatch != 0,
+			StrictFileSize:        bucketStrictFileSize,
+			Metadata:              metadata,
+			CallbackURL:           req.CallbackURL,
+		},
+	}, 0, nil
+}
+
+// insertFileRecord writes the files row for a prepared upload with the given status:
+// pending when the bytes are still to come, uploaded when they are already stored.
+// Uploads that belong to a group are inserted staged so they stay invisible until commit.
+func insertFileRecord(exec sqlx.Execer, upload *pendingUpload, status string, now time.Time) error {
+	data := upload.TokenData
+	var groupID interface{}
+	staged := 0
+	if data.GroupID != "" {
+		groupID = data.GroupID
+		staged = 1
+	}
+	var detectedMimetype interface{}
+	if upload.DetectedMimetype != "" {
+		detectedMimetype = upload.DetectedMimetype
+	}
+	imageWidth, imageHeight, imageFormat := imageDimensionColumns(upload.Image)
+	uploaderIP, uploaderUserAgent := upload.Uploader.columns()
+	_, err := exec.Exec(
+		"INSERT INTO files (id, file_name, file_size, mimetype, detected_mimetype, image_width, image_height, image_format, client_id, bucket_id, key, owner_entity_type, owner_entity_id, upload_group_id, staged, status, metadata, scan_status, uploader_ip, uploader_user_agent, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		data.FileID, data.FileName, data.FileSize, data.Mimetype, detectedMimetype, imageWidth, imageHeight, imageFormat, data.ClientID, data.BucketID, upload.Key, data.OwnerEntityType, data.OwnerEntityID, groupID, staged, status, encodeFileMetadata(data.Metadata), upload.ScanStatus, uploaderIP, uploaderUserAgent, now, now,
+	)
+	return err
+}
+
+// issueUploadToken grants the file the prepared upload's uses, stores the upload token and
+// builds the signed URL response
+func (h *FileHandler) issueUploadToken(upload *pendingUpload, ttl time.Duration, now time.Time) (models.SignedURLResponse, error) {
+	if err := h.uses.Grant(upload.TokenData.FileID, upload.MaxUses, ttl); err != nil {
+		return models.SignedURLResponse{}, err
+	}
+	uploadToken := generateUploadToken()
+	upload.TokenData.ExpiresAt = now.Add(ttl)
+	if err := h.cache.Set("upload:"+uploadToken, upload.TokenData, ttl); err != nil {
+		return models.SignedURLResponse{}, err
+	}
+	signedURL, err := h.signedURL(upload.TokenData.ClientID, models.ShortTokenKindUpload, uploadToken, ttl)
+	if err != nil {
+		return models.SignedURLResponse{}, err
+	}
+	return models.SignedURLResponse{
+		FileID:    upload.TokenData.FileID,
+		Key:       upload.Key,
+		SignedURL: signedURL,
+		ExpiresAt: now.Add(ttl),
+	}, nil
+}
+
+// GenerateSignedURL handles POST /files/signed-url - generate a signed URL for file upload
+func (h *FileHandler) GenerateSignedURL(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req models.CreateSignedURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("owner_entity_id is required"))
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
 		return
 	}
 
@@ -143,44 +427,49 @@ func (h *FileHandler) GenerateSignedURL(ctx context.Context, w http.ResponseWrit
 	}
 	clientID := auth.Client
 
-	// Verify the bucket exists, belongs to the authenticated client, and is not archived
-	// Also fetch the bucket name for folder structure
-	var bucketClientID string
-	var bucketName string
-	var bucketArchived int
-	err := h.db.QueryRow(
-		"SELECT client_id, name, archived FROM buckets WHERE id = ?",
-		req.BucketID,
-	).Scan(&bucketClientID, &bucketName, &bucketArchived)
+	ttl, err := h.signedURLTTL(req.ExpiresInSeconds)
 	if err != nil {
-		h.logRequest(ctx, "error", "Bucket not found", zap.Int("bucket_id", req.BucketID), zap.Error(err))
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(errs.NewNotFoundError("Bucket not found"))
+		h.logRequest(ctx, "error", "Invalid signed URL lifetime", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
 		return
 	}
-	if bucketClientID != clientID {
-		h.logRequest(ctx, "error", "Bucket does not belong to client",
-			zap.Int("bucket_id", req.BucketID),
-			zap.String("client_id", clientID),
-		)
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(errs.NewAuthorizationError("Access denied: bucket does not belong to your account"))
+
+	if req.KeyPrefix != "" {
+		h.generatePrefixSignedURL(ctx, w, r, clientID, req, ttl)
 		return
 	}
-	if bucketArchived != 0 {
-		h.logRequest(ctx, "error", "Bucket is archived", zap.Int("bucket_id", req.BucketID))
-		w.WriteHeader(http.StatusConflict)
-		json.NewEncoder(w).Encode(errs.NewValidationError("Cannot upload to an archived bucket"))
+	if req.Extract {
+		if err := validateExtractRequest(req); err != nil {
+			h.logRequest(ctx, "error", "Invalid extract request", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+			return
+		}
+	}
+
+	upload, status, appErr := h.prepareUpload(ctx, clientID, req)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
 		return
 	}
+	h.restrictUploadIP(r, upload, req)
 
-	// Fetch the client name for folder structure
-	var clientName string
-	err = h.db.QueryRow("SELECT name FROM clients WHERE client_id = ?", clientID).Scan(&clientName)
-	if err != nil {
-		h.logRequest(ctx, "error", "Failed to fetch client name", zap.String("client_id", clientID), zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to fetch client information"))
+	// The key of an extract URL is the folder its entries go to, which on_conflict is
+	// about; a file stored at the key itself always refuses the URL
+	claimConflict := req.OnConflict
+	if req.Extract {
+		upload.TokenData.ExtractTo = upload.Key
+		upload.TokenData.OnConflict = req.OnConflict
+		claimConflict = models.OnConflictReject
+	}
+
+	// A URL whose upload the volume could not take now is not handed out; the upload
+	// itself checks again
+	if !h.hasDiskSpace(uploadsRoot, req.FileSize) {
+		h.logRequest(ctx, "error", "Not enough disk space for upload", zap.Int64("file_size", req.FileSize))
+		writeInsufficientStorage(w)
 		return
 	}
 
@@ -188,147 +477,508 @@ func (h *FileHandler) GenerateSignedURL(ctx context.Context, w http.ResponseWrit
 		zap.String("file_name", req.FileName),
 		zap.String("client_id", clientID),
 		zap.Int("bucket_id", req.BucketID),
-		zap.String("key", req.Key),
+		zap.String("key", upload.Key),
 	)
 
-	// Generate file ID
-	fileID := uuid.New().String()
-	now := time.Now()
-
-	// Build the resolved file path: <client_name>/<bucket_name>/<key>
-	// The key may contain slashes for deeper nesting (e.g. "invoices/2024/receipt.pdf")
-	filePath := filepath.Join(clientName, bucketName, req.Key)
+	now := time.Now().UTC()
 
-	// Insert file record into database (including the key)
-	_, err = h.db.Exec(
-		"INSERT INTO files (id, file_name, file_size, mimetype, client_id, bucket_id, key, owner_entity_type, owner_entity_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		fileID, req.FileName, req.FileSize, req.Mimetype, clientID, req.BucketID, req.Key, req.OwnerEntityType, req.OwnerEntityID, now, now,
-	)
+	// Insert file record into database (including the key), reserving the key for this
+	// upload unless the caller allows parallel uploads
+	outcome, existingID, err := h.insertPendingUpload(upload, req.AllowParallel, claimConflict, now.Add(ttl), now)
 	if err != nil {
+		if quotaErr, ok := asQuotaError(err); ok {
+			h.writeQuotaExceeded(ctx, w, quotaErr, "")
+			return
+		}
 		h.logRequest(ctx, "error", "Failed to create file record", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to create file record"))
 		return
 	}
-
-	// Generate upload token
-	uploadToken := generateUploadToken()
-
-	// Store upload token data in Redis with 15 minute TTL.
-	// FilePath carries the full resolved path so the upload handler needs no extra DB lookups.
-	tokenData := models.UploadTokenData{
-		FileID:          fileID,
-		FileName:        req.FileName,
-		FileSize:        req.FileSize,
-		Mimetype:        req.Mimetype,
-		ClientID:        clientID,
-		BucketID:        req.BucketID,
-		FilePath:        filePath,
-		OwnerEntityType: req.OwnerEntityType,
-		OwnerEntityID:   req.OwnerEntityID,
+	switch outcome {
+	case keyPending:
+		h.writePendingUploadConflict(ctx, w, req.BucketID, upload.Key)
+		return
+	case keyExists:
+		h.writeFileExistsConflict(ctx, w, existingID, upload.Key)
+		return
+	case keyExhausted:
+		h.logRequest(ctx, "error", "No free key left to rename to", zap.String("key", upload.Key))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.AppError{Code: http.StatusConflict, Message: keyConflictMessage(outcome)})
+		return
 	}
 
-	ttl := 15 * time.Minute
-
-	err = h.cache.Set("upload:"+uploadToken, tokenData, ttl)
+	// Store upload token data in Redis for the URL's lifetime and build the signed URL
+	response, err := h.issueUploadToken(upload, ttl, now)
 	if err != nil {
+		if err := h.releaseReservation(upload.TokenData.FileID); err != nil {
+			h.logRequest(ctx, "error", "Failed to release upload reservation", zap.String("file_id", upload.TokenData.FileID), zap.Error(err))
+		}
 		h.logRequest(ctx, "error", "Failed to store upload token in cache", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to generate signed URL"))
 		return
 	}
 
-	// Generate signed URL
-	signedURL := fmt.Sprintf("http://localhost:8080/files/upload?token=%s", uploadToken)
-	expiresAt := now.Add(ttl)
-
 	h.logRequest(ctx, "info", "Signed URL generated successfully",
-		zap.String("file_id", fileID),
+		zap.String("file_id", response.FileID),
 		zap.String("client_id", clientID),
 		zap.Int("bucket_id", req.BucketID),
 	)
 
-	// Return signed URL response
-	response := models.SignedURLResponse{
-		FileID:    fileID,
-		SignedURL: signedURL,
-		ExpiresAt: expiresAt,
-	}
-
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(response)
 }
 
-// UploadFile handles POST /files/upload - upload file using token from URL (no auth header required)
-func (h *FileHandler) UploadFile(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	// Get token from URL query parameter
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		h.logRequest(ctx, "error", "Missing upload token")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("Missing upload token"))
-		return
+// writePendingUploadConflict responds with 409 for a key that already has an outstanding
+// upload token, pointing the caller at the pending file
+func (h *FileHandler) writePendingUploadConflict(ctx context.Context, w http.ResponseWriter, bucketID int, key string) {
+	conflict := models.PendingUploadConflict{
+		Code:    http.StatusConflict,
+		Message: "An upload for this key is already pending; wait for it to complete or expire, or pass allow_parallel=true",
+	}
+	fileID, expiresAt, found, err := h.activeReservation(bucketID, key)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to look up upload reservation", zap.Error(err))
+	}
+	if found {
+		conflict.FileID = fileID
+		conflict.ExpiresAt = expiresAt
 	}
 
-	h.logRequest(ctx, "info", "Processing file upload", zap.String("token", token[:8]+"..."))
+	h.logRequest(ctx, "info", "Upload already pending for key",
+		zap.Int("bucket_id", bucketID),
+		zap.String("key", key),
+		zap.String("pending_file_id", conflict.FileID),
+	)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(conflict)
+}
+
+// fileExistsConflictMessage explains a refused request for a key that holds a stored file
+const fileExistsConflictMessage = "A file already exists at this key; pass on_conflict=overwrite to replace it, on_conflict=new-version to update its content or on_conflict=rename to store the upload under a new key"
+
+// keyConflictMessage explains a key that could not be claimed because of files already stored
+func keyConflictMessage(outcome int) string {
+	if outcome == keyExhausted {
+		return fmt.Sprintf("No free key found after %d renames; choose another key", maxRenameAttempts)
+	}
+	return fileExistsConflictMessage
+}
+
+// writeFileExistsConflict responds with 409 for an upload to a key that already holds a
+// file when on_conflict is reject, naming the stored file
+func (h *FileHandler) writeFileExistsConflict(ctx context.Context, w http.ResponseWriter, existingID, key string) {
+	h.logRequest(ctx, "info", "File already stored at key",
+		zap.String("key", key),
+		zap.String("existing_file_id", existingID),
+	)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(models.FileExistsConflict{
+		Code:    http.StatusConflict,
+		Message: fileExistsConflictMessage,
+		FileID:  existingID,
+	})
+}
+
+// multipartOverhead is the slack allowed on top of the declared file size for
+// multipart boundaries and part headers
+const multipartOverhead = 64 << 10
+
+// writeMimetypeMismatch responds with 422 for uploads whose content does not match the declared mimetype
+func writeMimetypeMismatch(w http.ResponseWriter, declared, detected string) {
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(errs.NewValidationError(
+		fmt.Sprintf("File content looks like %s, which does not match the declared mimetype %s", detected, declared),
+	))
+}
+
+// sizeMismatch reports whether an upload of written bytes differs from the file_size
+// declared for its signed URL by more than FILE_SIZE_TOLERANCE_BYTES
+func (h *FileHandler) sizeMismatch(declared, written int64) bool {
+	diff := declared - written
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff > h.config.FileSizeTolerance
+}
+
+// writeSizeMismatch responds with 422 for uploads to a strict bucket whose size does not
+// match the declared file_size
+func writeSizeMismatch(w http.ResponseWriter, declared, written int64) {
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(errs.NewValidationError(
+		fmt.Sprintf("Uploaded file is %d bytes, which does not match the declared file_size %d", written, declared),
+	))
+}
+
+// writeFileTooLarge responds with 413 for uploads larger than their declared size
+func writeFileTooLarge(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(errs.AppError{
+		Code:    http.StatusRequestEntityTooLarge,
+		Message: "File size exceeds allowed limit",
+	})
+}
+
+// claimUploadUse takes one use of a file's upload token before its bytes are written,
+// returning how many uses are left after it. ok is false when the token has none left.
+// The count is decremented atomically in the cache, so concurrent uploads can never
+// together exceed the token's max_uses.
+func (h *FileHandler) claimUploadUse(fileID string) (remaining int, ok bool, err error) {
+	return h.uses.Claim(fileID)
+}
+
+// refundUploadUse gives back a use claimed by an upload that failed
+func (h *FileHandler) refundUploadUse(fileID string) error {
+	return h.uses.Give(fileID)
+}
+
+// markFileUploaded records a completed signed URL upload and returns the file's key. The
+// file's size becomes the written bytes rather than the size declared for the URL, and the
+// file is flagged when the two differ beyond the tolerance. The staged bytes are renamed
+// into place inside the transaction that marks the file uploaded, after the content they
+// replace has been kept as a version in a versioning bucket. encKey is the customer key the
+// bytes were encrypted with, nil when they are stored in the clear, dims the image
+// dimensions read from them, nil when there are none, and uploader is where they came
+// from. In a dedupe bucket, bytes identical
+// to content already stored there are shared with it; the returned bool reports whether
+// they were. A new-version upload also takes on the name and metadata it was requested
+// with, and an overwrite deletes the file it replaces. The staged file is removed on any
+// failure, including the bucket having been archived or the file deleted since the URL
+// was issued.
+func (h *FileHandler) markFileUploaded(tokenData models.UploadTokenData, stagedPath, filePath string, written int64, detectedMimetype, checksum string, dims *models.ImageDimensions, encKey *customerKey, uploader uploaderInfo) (string, bool, error) {
+	tx, err := h.db.Beginx()
+	if err != nil {
+		os.Remove(stagedPath)
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	if err := checkTokenTarget(tx, tokenData.FileID, models.ShortTokenKindUpload, tokenData.FilePath, false); err != nil {
+		os.Remove(stagedPath)
+		return "", false, err
+	}
+
+	now := time.Now().UTC()
+	var key string
+	var version *keptVersion
+	var objectID sql.NullInt64
+	var shared bool
+	discardObject := func() {}
+	err = tx.QueryRow("SELECT key FROM files WHERE id = ?", tokenData.FileID).Scan(&key)
+	if err == nil && tokenData.GroupID == "" {
+		version, err = preserveVersionAtKey(tx, tokenData.BucketID, key, filePath, now)
+		// Encrypted bytes differ with every upload, so they are never deduplicated
+		if err == nil && encKey == nil {
+			objectID, shared, discardObject, err = dedupeStaged(tx, tokenData.BucketID, checksum, written, stagedPath, now)
+		}
+	}
+	if err == nil {
+		if tokenData.NewVersion {
+			err = updateFileVersion(tx, tokenData, storedContent{
+				Size:             written,
+				DetectedMimetype: detectedMimetype,
+				Checksum:         checksum,
+				ScanStatus:       h.pendingScanStatus(),
+				EncKey:           encKey,
+				Image:            dims,
+				ObjectID:         objectID,
+				DeclaredSize:     sql.NullInt64{Int64: tokenData.FileSize, Valid: true},
+				SizeMismatch:     h.sizeMismatch(tokenData.FileSize, written),
+				Uploader:         uploader,
+			}, now)
+		} else {
+			keyHash, iv := encKey.columns()
+			imageWidth, imageHeight, imageFormat := imageDimensionColumns(dims)
+			uploaderIP, uploaderUserAgent := uploader.columns()
+			_, err = tx.Exec(
+				`UPDATE files SET status = ?, file_size = ?, size_mismatch = ?, declared_file_size = ?, detected_mimetype = ?, checksum = ?, scan_status = ?, scan_signature = NULL, scanned_at = NULL,
+				encryption_key_hash = ?, encryption_iv = ?, image_width = ?, image_height = ?, image_format = ?, storage_object_id = ?, uploader_ip = ?, uploader_user_agent = ?, updated_at = ?
+				WHERE id = ? AND status <> ?`,
+				models.FileStatusUploaded, written, h.sizeMismatch(tokenData.FileSize, written), tokenData.FileSize,
+				detectedMimetype, checksum, h.pendingScanStatus(), keyHash, iv, imageWidth, imageHeight, imageFormat,
+				objectID, uploaderIP, uploaderUserAgent, now, tokenData.FileID, models.FileStatusDeleted,
+			)
+		}
+	}
+	if err == nil && tokenData.Replaces != "" {
+		err = retireReplacedFile(tx, tokenData.Replaces, now)
+	}
+	if err == nil {
+		err = os.Rename(stagedPath, filePath)
+	}
+	if err != nil {
+		os.Remove(stagedPath)
+		version.discard()
+		discardObject()
+		return "", false, err
+	}
+	if err := tx.Commit(); err != nil {
+		version.putBack(filePath)
+		discardObject()
+		return "", false, err
+	}
+	return key, shared, nil
+}
+
+// loadUploadToken looks up the data stored for an upload token without using it up.
+// On failure it returns the HTTP status to respond with and the error body.
+func (h *FileHandler) loadUploadToken(ctx context.Context, token string) (models.UploadTokenData, int, *errs.AppError) {
+	var tokenData models.UploadTokenData
 
 	// Retrieve token data from Redis
 	cachedData, err := h.cache.Get("upload:" + token)
 	if err != nil {
 		h.logRequest(ctx, "error", "Invalid or expired upload token", zap.Error(err))
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Invalid or expired upload token"))
-		return
+		return tokenData, http.StatusUnauthorized, errs.NewAuthenticationError("Invalid or expired upload token")
 	}
 
 	// Parse token data.
 	// The Redis cache layer does json.Marshal on Set and json.Unmarshal on Get,
 	// so cachedData comes back as map[string]interface{} for a JSON object.
 	// Re-marshal to JSON then unmarshal into the typed struct.
-	var tokenData models.UploadTokenData
-
 	intermediate, err := json.Marshal(cachedData)
 	if err != nil {
 		h.logRequest(ctx, "error", "Failed to re-marshal token data", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to parse token data"))
-		return
+		return tokenData, http.StatusInternalServerError, errs.NewInternalServerError("Failed to parse token data")
 	}
 	if err := json.Unmarshal(intermediate, &tokenData); err != nil {
 		h.logRequest(ctx, "error", "Failed to parse token data", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to parse token data"))
-		return
+		return tokenData, http.StatusInternalServerError, errs.NewInternalServerError("Failed to parse token data")
 	}
+	return tokenData, 0, nil
+}
+
+// Errors reported when what a signed URL was issued against changed before it was used
+var (
+	errTargetBucketArchived = errors.New("bucket has been archived")
+	errTargetBucketRenamed  = errors.New("bucket has been renamed")
+	errTargetFileDeleted    = errors.New("file has been deleted")
+)
+
+// readsFrozen reports whether a bucket's files can no longer be listed, downloaded or
+// served publicly: it is archived, and not with freeze-writes. Writes stop in either mode.
+func readsFrozen(archived bool, archiveMode string) bool {
+	return archived && archiveMode != models.ArchiveModeFreezeWrites
+}
 
-	// Parse multipart form
-	err = r.ParseMultipartForm(100 << 20) // 100 MB max memory
+// checkTokenTarget re-reads the bucket and file a signed URL of kind (an upload or download
+// token kind) was issued for, since the token only records how they were when it was
+// handed out. It returns errTargetBucketArchived when the bucket has been archived since -
+// for downloads, only when its archive mode freezes reads - errTargetBucketRenamed when
+// filePath, the token's resolved path, is no longer in the bucket's directory, and
+// errTargetFileDeleted when the file has been deleted or purged, unless allowDeleted is
+// set. Any other bucket state that stops transfers belongs here too.
+func checkTokenTarget(q sqlx.Queryer, fileID, kind, filePath string, allowDeleted bool) error {
+	var archived bool
+	var archiveMode string
+	var status string
+	var clientName, bucketName string
+	err := q.QueryRowx(
+		`SELECT b.archived, COALESCE(b.archive_mode, ''), f.status, c.name, b.name
+		FROM files f JOIN buckets b ON b.id = f.bucket_id JOIN clients c ON c.client_id = b.client_id
+		WHERE f.id = ?`,
+		fileID,
+	).Scan(&archived, &archiveMode, &status, &clientName, &bucketName)
+	if err == sql.ErrNoRows {
+		return errTargetFileDeleted
+	}
 	if err != nil {
-		h.logRequest(ctx, "error", "Failed to parse multipart form", zap.Error(err))
+		return err
+	}
+	if kind == models.ShortTokenKindDownload && readsFrozen(archived, archiveMode) ||
+		kind != models.ShortTokenKindDownload && archived {
+		return errTargetBucketArchived
+	}
+	if !strings.HasPrefix(filepath.ToSlash(filePath), clientName+"/"+bucketName+"/") {
+		return errTargetBucketRenamed
+	}
+	if !allowDeleted && status == models.FileStatusDeleted {
+		return errTargetFileDeleted
+	}
+	return nil
+}
+
+// writeUploadTargetError answers 409 for an upload whose bucket was archived or renamed,
+// or whose file was deleted, after the URL was issued, and 500 when that could not be
+// checked
+func (h *FileHandler) writeUploadTargetError(ctx context.Context, w http.ResponseWriter, fileID string, err error) {
+	switch {
+	case errors.Is(err, errTargetBucketArchived):
+		h.logRequest(ctx, "info", "Bucket was archived after the upload URL was issued", zap.String("file_id", fileID))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Cannot upload to an archived bucket"))
+	case errors.Is(err, errTargetBucketRenamed):
+		h.logRequest(ctx, "info", "Bucket was renamed after the upload URL was issued", zap.String("file_id", fileID))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError(errBucketRenamedMessage))
+	case errors.Is(err, errTargetFileDeleted):
+		h.logRequest(ctx, "info", "File was deleted after the upload URL was issued", zap.String("file_id", fileID))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("File has been deleted"))
+	default:
+		h.logRequest(ctx, "error", "Failed to check upload target", zap.String("file_id", fileID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to process upload"))
+	}
+}
+
+// UploadTokenInfo handles GET /files/upload/info - describe the upload a token allows so a
+// page holding only the signed URL can render it. Like the upload itself it needs no auth
+// header; it neither uses up nor extends the token.
+func (h *FileHandler) UploadTokenInfo(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		h.logRequest(ctx, "error", "Missing upload token")
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("Failed to parse upload form"))
+		json.NewEncoder(w).Encode(errs.NewValidationError("Missing upload token"))
 		return
 	}
 
-	// Get file from form
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		h.logRequest(ctx, "error", "Failed to get file from form", zap.Error(err))
+	tokenData, status, appErr := h.loadUploadToken(ctx, token)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	info := models.UploadTokenInfo{
+		FileName: tokenData.FileName,
+		MaxSize:  tokenData.FileSize,
+		Mimetype: tokenData.Mimetype,
+	}
+	if !tokenData.ExpiresAt.IsZero() {
+		info.ExpiresAt = &tokenData.ExpiresAt
+	}
+	if tokenData.KeyPrefix != "" {
+		usedFiles, usedBytes, err := h.quotas.Usage(token)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to read prefix upload counts", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to read upload token"))
+			return
+		}
+		filesRemaining := tokenData.MaxFiles - usedFiles
+		bytesRemaining := tokenData.MaxTotalBytes - usedBytes
+		info.KeyPrefix = tokenData.KeyPrefix
+		info.FilesRemaining = &filesRemaining
+		info.BytesRemaining = &bytesRemaining
+	}
+
+	h.logRequest(ctx, "info", "Serving upload token info", zap.String("file_id", tokenData.FileID))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
+
+// onBusyHeader tells an upload what to do when another upload is writing the same path:
+// wait for it (the default, up to UploadWriteWait) or fail with 409 straight away
+const (
+	onBusyHeader = "X-On-Busy"
+	onBusyWait   = "wait"
+	onBusyFail   = "fail"
+)
+
+// acquireUploadWrite takes the write hold of the path an upload stores its bytes at, so
+// racing uploads of the same key each leave one complete file rather than mixing their
+// versions and rows. The X-On-Busy header chooses whether to wait for another writer or be
+// refused straight away. When ok is false the response has been written.
+func (h *FileHandler) acquireUploadWrite(ctx context.Context, w http.ResponseWriter, r *http.Request, fileID, path string) (release func(), ok bool) {
+	writeWait := h.config.UploadWriteWait
+	switch r.Header.Get(onBusyHeader) {
+	case "", onBusyWait:
+	case onBusyFail:
+		writeWait = 0
+	default:
+		h.logRequest(ctx, "error", "Invalid on-busy option", zap.String("on_busy", r.Header.Get(onBusyHeader)))
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("Missing file in upload"))
+		json.NewEncoder(w).Encode(errs.NewValidationError(onBusyHeader + " must be one of: wait, fail"))
+		return nil, false
+	}
+	release, ok = h.locks.acquireWrite(ctx, path, writeWait)
+	if !ok {
+		h.logRequest(ctx, "error", "Another upload is writing the same path", zap.String("file_id", fileID))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Another upload is writing to this key; retry shortly"))
+		return nil, false
+	}
+	return release, true
+}
+
+// UploadFile handles POST /files/upload - upload file using token from URL (no auth header required)
+func (h *FileHandler) UploadFile(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	// Get token from URL query parameter
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		h.logRequest(ctx, "error", "Missing upload token")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Missing upload token"))
 		return
 	}
-	defer file.Close()
 
-	// Validate file size
-	if header.Size > tokenData.FileSize {
-		h.logRequest(ctx, "error", "File size exceeds limit",
-			zap.Int64("uploaded_size", header.Size),
-			zap.Int64("max_size", tokenData.FileSize),
-		)
+	h.logRequest(ctx, "info", "Processing file upload", zap.String("token", token[:8]+"..."))
+
+	tokenData, status, appErr := h.loadUploadToken(ctx, token)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	// A token bound to an address only accepts uploads from it
+	if tokenData.AllowedIP != "" {
+		if ip := h.requestIP(r); !sameIP(ip, tokenData.AllowedIP) {
+			h.logRequest(ctx, "error", "Upload from an address the token is not bound to",
+				zap.String("file_id", tokenData.FileID),
+				zap.String("request_ip", ip),
+			)
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(errs.NewAuthorizationError("This upload URL is restricted to another IP address"))
+			return
+		}
+	}
+
+	// Browser uploads must come from an origin the bucket's CORS policy allows
+	if !h.applyUploadCORS(ctx, w, r, tokenData.BucketID) {
+		return
+	}
+
+	// A prefix token creates a new file with each upload rather than completing one
+	if tokenData.KeyPrefix != "" {
+		h.uploadUnderPrefix(ctx, w, r, token, tokenData)
+		return
+	}
+
+	// The bucket may have been archived, or the file deleted, since the URL was issued.
+	// This is checked again when the bytes are moved into place.
+	if err := checkTokenTarget(h.db, tokenData.FileID, models.ShortTokenKindUpload, tokenData.FilePath, false); err != nil {
+		h.writeUploadTargetError(ctx, w, tokenData.FileID, err)
+		return
+	}
+
+	// An extract token unpacks the zip instead of storing it
+	if tokenData.ExtractTo != "" {
+		h.uploadAndExtract(ctx, w, r, token, tokenData)
+		return
+	}
+
+	// A customer-provided key has the content stored encrypted. Grouped uploads are
+	// scanned once committed, when the key is no longer at hand, so they cannot use one.
+	encKey, err := parseCustomerKey(r)
+	if err == nil && encKey != nil && tokenData.GroupID != "" {
+		err = errors.New("X-Encryption-Key is not supported on grouped uploads")
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid encryption key", zap.String("file_id", tokenData.FileID), zap.Error(err))
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("File size exceeds allowed limit"))
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
 		return
 	}
 
@@ -337,56 +987,540 @@ func (h *FileHandler) UploadFile(ctx context.Context, w http.ResponseWriter, r *
 	// The actual file is stored at that exact path under ./uploads/.
 	absFilePath := filepath.Join("./uploads", tokenData.FilePath)
 
-	// Ensure all parent directories exist (key may introduce extra nesting)
-	if err := os.MkdirAll(filepath.Dir(absFilePath), 0755); err != nil {
-		h.logRequest(ctx, "error", "Failed to create nested upload directory", zap.Error(err))
+	// Grouped uploads are staged outside the uploads root until the group is committed
+	if tokenData.GroupID != "" {
+		if !h.isUploadGroupOpen(tokenData.GroupID) {
+			h.logRequest(ctx, "error", "Upload group is no longer open", zap.String("group_id", tokenData.GroupID))
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(errs.NewValidationError("Upload group is no longer open"))
+			return
+		}
+		absFilePath = stagingPath(tokenData.GroupID, tokenData.FileID)
+	}
+
+	// Refuse the upload before anything is written when the volume has no room for the
+	// declared size, rather than failing part way through the copy
+	if !h.hasDiskSpace(absFilePath, tokenData.FileSize) {
+		h.logRequest(ctx, "error", "Not enough disk space for upload",
+			zap.String("file_id", tokenData.FileID),
+			zap.Int64("file_size", tokenData.FileSize),
+		)
+		writeInsufficientStorage(w)
+		return
+	}
+
+	// One upload at a time stages and moves bytes into a path
+	releaseWrite, ok := h.acquireUploadWrite(ctx, w, r, tokenData.FileID, absFilePath)
+	if !ok {
+		return
+	}
+	defer releaseWrite()
+
+	// Take one of the token's uses up front; it is given back if the upload fails
+	remainingUses, claimed, err := h.claimUploadUse(tokenData.FileID)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to claim upload token use", zap.String("file_id", tokenData.FileID), zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to prepare upload storage"))
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to process upload"))
+		return
+	}
+	if !claimed {
+		h.logRequest(ctx, "error", "Upload token has no uses left", zap.String("file_id", tokenData.FileID))
+		h.cache.Delete("upload:" + token)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Invalid or expired upload token"))
 		return
 	}
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		if err := h.refundUploadUse(tokenData.FileID); err != nil {
+			h.logRequest(ctx, "error", "Failed to refund upload token use", zap.String("file_id", tokenData.FileID), zap.Error(err))
+		}
+	}()
 
 	filePath := absFilePath
 
-	// Create destination file
-	destFile, err := os.Create(filePath)
+	// Cap the request body at the declared size plus multipart framing so an
+	// oversized upload is cut off as soon as it crosses the limit
+	r.Body = http.MaxBytesReader(w, r.Body, tokenData.FileSize+multipartOverhead)
+
+	// Stream the multipart body: skip to the "file" part and copy it straight to disk,
+	// without buffering the upload in memory or temp files
+	reader, err := r.MultipartReader()
 	if err != nil {
-		h.logRequest(ctx, "error", "Failed to create destination file", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to save file"))
+		h.logRequest(ctx, "error", "Upload is not a multipart form", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Missing file in upload"))
 		return
 	}
-	defer destFile.Close()
 
-	// Copy file content
-	written, err := io.Copy(destFile, file)
+	var written int64
+	var detectedMimetype string
+	var stagedPath string
+	checksum := sha256.New()
+	head := &headCapture{}
+	found := false
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				h.logRequest(ctx, "error", "Upload body exceeds declared file size", zap.Int64("max_size", tokenData.FileSize))
+				writeFileTooLarge(w)
+				return
+			}
+			h.logRequest(ctx, "error", "Failed to parse multipart form", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError("Failed to parse upload form"))
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		// Check the leading bytes against the declared mimetype before anything reaches disk
+		var content io.Reader
+		detectedMimetype, content, err = sniffContentType(part)
+		if err != nil {
+			part.Close()
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				h.logRequest(ctx, "error", "Upload body exceeds declared file size", zap.Int64("max_size", tokenData.FileSize))
+				writeFileTooLarge(w)
+				return
+			}
+			h.logRequest(ctx, "error", "Failed to read upload body", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError("Failed to read upload body"))
+			return
+		}
+		if !tokenData.AllowMimetypeMismatch && !mimetypesMatch(tokenData.Mimetype, detectedMimetype) {
+			part.Close()
+			h.logRequest(ctx, "error", "Uploaded content does not match declared mimetype",
+				zap.String("file_id", tokenData.FileID),
+				zap.String("declared", tokenData.Mimetype),
+				zap.String("detected", detectedMimetype),
+			)
+			writeMimetypeMismatch(w, tokenData.Mimetype, detectedMimetype)
+			return
+		}
+
+		// Write the file, never accepting more than the declared size.
+		// The declared size is an upper bound: smaller files are accepted.
+		// The bytes are kept in a temp file until the file row is updated.
+		// The checksum is of the content as uploaded, before any encryption, and so is the
+		// head kept to read image dimensions from.
+		stored, err := encKey.encrypt(io.TeeReader(content, io.MultiWriter(checksum, head)))
+		if err != nil {
+			part.Close()
+			h.logRequest(ctx, "error", "Failed to set up encryption", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to save file"))
+			return
+		}
+		buf := h.buffers.get()
+		stagedPath, written, err = stageFile(filePath, stored, tokenData.FileSize, buf)
+		h.buffers.put(buf)
+		part.Close()
+		var maxBytesErr *http.MaxBytesError
+		if errors.Is(err, errFileTooLarge) || errors.As(err, &maxBytesErr) {
+			h.logRequest(ctx, "error", "File size exceeds limit", zap.Int64("max_size", tokenData.FileSize))
+			writeFileTooLarge(w)
+			return
+		}
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to write file", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to save file"))
+			return
+		}
+		found = true
+		break
+	}
+
+	if !found {
+		h.logRequest(ctx, "error", "Missing file part in upload")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Missing file in upload"))
+		return
+	}
+
+	// The declared size is only an upper bound while the bytes stream in. A smaller upload
+	// is recorded at its real size and flagged, or turned away by a strict bucket; the
+	// token keeps its use so the upload can be retried.
+	if tokenData.StrictFileSize && h.sizeMismatch(tokenData.FileSize, written) {
+		os.Remove(stagedPath)
+		h.logRequest(ctx, "error", "Uploaded size does not match declared file size",
+			zap.String("file_id", tokenData.FileID),
+			zap.Int64("declared", tokenData.FileSize),
+			zap.Int64("written", written),
+		)
+		writeSizeMismatch(w, tokenData.FileSize, written)
+		return
+	}
+
+	// The file only becomes visible to listings and downloads once marked uploaded, which
+	// also moves its bytes into place and deletes the file an overwrite replaces.
+	// A replacement swaps in its bytes as it updates the file.
+	// On failure the token is kept so the upload can be retried.
+	sum := hex.EncodeToString(checksum.Sum(nil))
+	dims := h.imageDimensions(ctx, tokenData.FileID, detectedMimetype, head.buf)
+	var key string
+	var deduplicated bool
+	uploader := h.uploaderOf(r)
+	if tokenData.Replace {
+		key, deduplicated, err = h.replaceFileContent(tokenData, stagedPath, filePath, written, detectedMimetype, sum, dims, encKey, uploader)
+	} else {
+		key, deduplicated, err = h.markFileUploaded(tokenData, stagedPath, filePath, written, detectedMimetype, sum, dims, encKey, uploader)
+	}
+	if errors.Is(err, errTargetBucketArchived) || errors.Is(err, errTargetBucketRenamed) || errors.Is(err, errTargetFileDeleted) {
+		h.cache.Delete("upload:" + token)
+		h.writeUploadTargetError(ctx, w, tokenData.FileID, err)
+		return
+	}
 	if err != nil {
-		h.logRequest(ctx, "error", "Failed to write file", zap.Error(err))
+		h.logRequest(ctx, "error", "Failed to mark file uploaded", zap.String("file_id", tokenData.FileID), zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to save file"))
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to record upload"))
 		return
 	}
+	releaseWrite()
 
-	// Delete the token from Redis (one-time use)
-	h.cache.Delete("upload:" + token)
+	succeeded = true
+
+	// A replacement URL is good for a single upload, whatever uses the file has left
+	if tokenData.Replace && remainingUses > 0 {
+		h.cache.Delete("upload:" + token)
+	}
+
+	// Once the token's uses are exhausted, delete it from Redis and free the key for the next upload
+	if remainingUses == 0 {
+		h.cache.Delete("upload:" + token)
+		if err := h.releaseReservation(tokenData.FileID); err != nil {
+			h.logRequest(ctx, "error", "Failed to release upload reservation", zap.String("file_id", tokenData.FileID), zap.Error(err))
+		}
+	}
+
+	// Small uploads are scanned before answering; an infected one is reported instead of
+	// the usual response. Grouped uploads are scanned in the background once committed.
+	var scanStatus, signature string
+	if tokenData.GroupID == "" {
+		scanStatus, signature = h.scanAfterUpload(ctx, tokenData.FileID, written, encKey)
+	} else if h.scanner != nil {
+		scanStatus = models.ScanStatusPending
+	}
+	if scanStatus == models.ScanStatusInfected {
+		h.logRequest(ctx, "info", "Uploaded file quarantined", zap.String("file_id", tokenData.FileID), zap.String("signature", signature))
+		writeQuarantined(w, signature)
+		return
+	}
 
 	h.logRequest(ctx, "info", "File uploaded successfully",
 		zap.String("file_id", tokenData.FileID),
 		zap.String("client_id", tokenData.ClientID),
 		zap.Int("bucket_id", tokenData.BucketID),
 		zap.Int64("bytes_written", written),
+		zap.Int("remaining_uses", remainingUses),
 	)
 
+	// Tell the caller's callback URL, if any, without holding up the response
+	if tokenData.CallbackURL != "" {
+		callbackEvent := uploadCallbackEvent
+		if tokenData.Replace {
+			callbackEvent = replaceCallbackEvent
+		}
+		go h.sendUploadCallback(ctx, tokenData.CallbackURL, models.UploadCallbackPayload{
+			Event:           callbackEvent,
+			FileID:          tokenData.FileID,
+			BucketID:        tokenData.BucketID,
+			Key:             key,
+			FileName:        tokenData.FileName,
+			Size:            written,
+			Mimetype:        tokenData.Mimetype,
+			Checksum:        sum,
+			OwnerEntityType: tokenData.OwnerEntityType,
+			OwnerEntityID:   tokenData.OwnerEntityID,
+			GroupID:         tokenData.GroupID,
+			UploadedAt:      time.Now().UTC(),
+		})
+	}
+
 	// Return success response
+	response := map[string]interface{}{
+		"message":        "File uploaded successfully",
+		"file_id":        tokenData.FileID,
+		"file_name":      tokenData.FileName,
+		"file_size":      written,
+		"bucket_id":      tokenData.BucketID,
+		"saved_path":     filePath,
+		"checksum":       sum,
+		"remaining_uses": remainingUses,
+	}
+	if len(tokenData.Metadata) > 0 {
+		response["metadata"] = tokenData.Metadata
+	}
+	if h.sizeMismatch(tokenData.FileSize, written) {
+		response["size_mismatch"] = true
+		response["declared_file_size"] = tokenData.FileSize
+	}
+	if scanStatus != "" {
+		response["scan_status"] = scanStatus
+	}
+	if encKey != nil {
+		response["encrypted"] = true
+	}
+	if deduplicated {
+		response["deduplicated"] = true
+	}
+	if dims != nil {
+		response["image"] = dims
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	json.NewEncoder(w).Encode(response)
+}
+
+// directUploadHeaders maps metadata fields to the headers carrying them on raw-body direct uploads
+var directUploadHeaders = map[string]string{
+	"bucket_id":         "X-Bucket-Id",
+	"key":               "X-Key",
+	"file_name":         "X-File-Name",
+	"mimetype":          "Content-Type",
+	"owner_entity_type": "X-Owner-Entity-Type",
+	"owner_entity_id":   "X-Owner-Entity-Id",
+	"on_conflict":       "X-On-Conflict",
+}
+
+// DirectUpload handles POST /files/direct-upload - create and write a small file in a single request.
+// Accepts either a multipart form (metadata as form fields, bytes in "file") or a raw body
+// with metadata in X-* headers. Larger files must go through the signed URL flow.
+func (h *FileHandler) DirectUpload(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if h.rejectCustomerKey(ctx, w, r) {
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	maxSize := h.config.DirectUploadMaxBytes
+	tooLarge := func() {
+		h.logRequest(ctx, "error", "Direct upload exceeds size limit", zap.Int64("max_size", maxSize))
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(errs.AppError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("File exceeds the direct upload limit of %d bytes; use POST /files/signed-url for larger files", maxSize),
+		})
+	}
+
+	if r.ContentLength > maxSize+multipartOverhead {
+		tooLarge()
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+multipartOverhead)
+
+	var req models.CreateSignedURLRequest
+	var body io.Reader
+	field := func(name string) string { return r.Header.Get(directUploadHeaders[name]) }
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(maxSize + multipartOverhead); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				tooLarge()
+				return
+			}
+			h.logRequest(ctx, "error", "Failed to parse multipart form", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError("Failed to parse upload form"))
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to get file from form", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError("Missing file in upload"))
+			return
+		}
+		defer file.Close()
+
+		field = r.FormValue
+		if v := r.FormValue("metadata"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Metadata); err != nil {
+				h.logRequest(ctx, "error", "Invalid metadata form field", zap.Error(err))
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(errs.NewValidationError("metadata must be a JSON object of string values"))
+				return
+			}
+		}
+		req.FileName = header.Filename
+		req.Mimetype = header.Header.Get("Content-Type")
+		body = file
+	} else {
+		req.Metadata = metadataFromHeaders(r.Header)
+		body = r.Body
+	}
+
+	// Small files are read fully so the actual size is known before the row is created
+	data, err := io.ReadAll(body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			tooLarge()
+			return
+		}
+		h.logRequest(ctx, "error", "Failed to read upload body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Failed to read upload body"))
+		return
+	}
+	if int64(len(data)) > maxSize {
+		tooLarge()
+		return
+	}
+
+	req.BucketID, _ = strconv.Atoi(field("bucket_id"))
+	req.Key = field("key")
+	if v := field("file_name"); v != "" {
+		req.FileName = v
+	}
+	if v := field("mimetype"); v != "" {
+		req.Mimetype = v
+	}
+	req.OwnerEntityType = field("owner_entity_type")
+	req.OwnerEntityID = field("owner_entity_id")
+	req.OnConflict = field("on_conflict")
+	req.FileSize = int64(len(data))
+
+	upload, status, appErr := h.prepareUpload(ctx, clientID, req)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+	tokenData := upload.TokenData
+
+	upload.DetectedMimetype = normalizeMimetype(http.DetectContentType(data))
+	if !tokenData.AllowMimetypeMismatch && !mimetypesMatch(req.Mimetype, upload.DetectedMimetype) {
+		h.logRequest(ctx, "error", "Uploaded content does not match declared mimetype",
+			zap.String("declared", req.Mimetype),
+			zap.String("detected", upload.DetectedMimetype),
+		)
+		writeMimetypeMismatch(w, req.Mimetype, upload.DetectedMimetype)
+		return
+	}
+	upload.Image = h.imageDimensions(ctx, tokenData.FileID, upload.DetectedMimetype, data)
+
+	// The bytes are in memory already, so the volume is checked for their real size
+	if !h.hasDiskSpace(uploadsRoot, int64(len(data))) {
+		h.logRequest(ctx, "error", "Not enough disk space for upload", zap.Int("file_size", len(data)))
+		writeInsufficientStorage(w)
+		return
+	}
+
+	h.logRequest(ctx, "info", "Processing direct upload",
+		zap.String("file_id", tokenData.FileID),
+		zap.String("client_id", clientID),
+		zap.Int("bucket_id", req.BucketID),
+		zap.String("key", upload.Key),
+	)
+
+	releaseWrite, ok := h.acquireUploadWrite(ctx, w, r, tokenData.FileID, filepath.Join(uploadsRoot, tokenData.FilePath))
+	if !ok {
+		return
+	}
+	outcome, existingID, written, err := h.storeDirectUpload(upload, req.OnConflict, data)
+	releaseWrite()
+	if err != nil {
+		if quotaErr, ok := asQuotaError(err); ok {
+			h.writeQuotaExceeded(ctx, w, quotaErr, "")
+			return
+		}
+		h.logRequest(ctx, "error", "Failed to store direct upload", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to save file"))
+		return
+	}
+	switch outcome {
+	case keyExists:
+		h.writeFileExistsConflict(ctx, w, existingID, upload.Key)
+		return
+	case keyExhausted:
+		h.logRequest(ctx, "error", "No free key left to rename to", zap.String("key", upload.Key))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.AppError{Code: http.StatusConflict, Message: keyConflictMessage(outcome)})
+		return
+	}
+	// A new version takes over the id of the stored file, and a rename may have moved
+	// the upload to another key
+	tokenData = upload.TokenData
+	filePath := filepath.Join("./uploads", tokenData.FilePath)
+
+	scanStatus, signature := h.scanAfterUpload(ctx, tokenData.FileID, written, nil)
+	if scanStatus == models.ScanStatusInfected {
+		h.logRequest(ctx, "info", "Uploaded file quarantined", zap.String("file_id", tokenData.FileID), zap.String("signature", signature))
+		writeQuarantined(w, signature)
+		return
+	}
+
+	h.logRequest(ctx, "info", "File uploaded successfully",
+		zap.String("file_id", tokenData.FileID),
+		zap.String("client_id", clientID),
+		zap.Int("bucket_id", tokenData.BucketID),
+		zap.Int64("bytes_written", written),
+	)
+
+	response := map[string]interface{}{
 		"message":    "File uploaded successfully",
 		"file_id":    tokenData.FileID,
 		"file_name":  tokenData.FileName,
 		"file_size":  written,
 		"bucket_id":  tokenData.BucketID,
+		"key":        upload.Key,
 		"saved_path": filePath,
-	})
+	}
+	if len(tokenData.Metadata) > 0 {
+		response["metadata"] = tokenData.Metadata
+	}
+	if scanStatus != "" {
+		response["scan_status"] = scanStatus
+	}
+	if upload.Image != nil {
+		response["image"] = upload.Image
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// storeDirectUpload writes the bytes of a direct upload next to its key, then claims the
+// key and records the file in one serialized transaction like storeImportedFile, so the
+// on_conflict check sees every earlier upload without holding other uploads up while the
+// bytes are written. Callers hold the write hold of the key's path. The outcome is
+// keyClaimed when the file was stored; an upload past its owner's quota or its bucket's
+// limits fails with a quotaError.
+func (h *FileHandler) storeDirectUpload(upload *pendingUpload, onConflict string, data []byte) (outcome int, existingID string, written int64, err error) {
+	tmpPath, written, err := stageFile(filepath.Join(uploadsRoot, upload.TokenData.FilePath), bytes.NewReader(data), int64(len(data)), nil)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	outcome, existingID, err = h.storeImportedFile(upload, onConflict, tmpPath)
+	if err != nil || outcome != keyClaimed {
+		return outcome, existingID, 0, err
+	}
+	return keyClaimed, existingID, written, nil
 }
 
 // generateDownloadToken generates a random token for a download signed URL
@@ -402,14 +1536,65 @@ func (h *FileHandler) GenerateDownloadSignedURL(ctx context.Context, w http.Resp
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+
+	byKey := req.BucketID != 0 || req.Key != ""
+	switch {
+	case req.FileID != "" && byKey:
+		h.logRequest(ctx, "error", "Both file_id and bucket_id/key given")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Give either file_id or bucket_id and key, not both"))
+		return
+	case req.FileID == "" && (req.BucketID == 0 || req.Key == ""):
+		h.logRequest(ctx, "error", "Missing required field: file_id")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("file_id, or bucket_id and key, is required"))
+		return
+	}
+	if req.MaxUses < 0 || req.MaxUses > maxUploadTokenUses {
+		h.logRequest(ctx, "error", "Invalid max_uses", zap.Int("max_uses", req.MaxUses))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(fmt.Sprintf("max_uses must be between 1 and %d", maxUploadTokenUses)))
+		return
+	}
+	switch req.Disposition {
+	case "":
+		req.Disposition = models.DispositionAttachment
+	case models.DispositionAttachment, models.DispositionInline:
+	default:
+		h.logRequest(ctx, "error", "Invalid disposition", zap.String("disposition", req.Disposition))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("disposition must be one of: inline, attachment"))
+		return
+	}
+	if req.DownloadFilename != "" {
+		if err := validateDownloadFilename(req.DownloadFilename); err != nil {
+			h.logRequest(ctx, "error", "Invalid download_filename", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+			return
+		}
+	}
+	switch {
+	case req.AllowedIP != "" && !req.RestrictIP:
+		h.logRequest(ctx, "error", "allowed_ip without restrict_ip")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("allowed_ip requires restrict_ip"))
+		return
+	case req.AllowedIP != "" && net.ParseIP(req.AllowedIP) == nil:
+		h.logRequest(ctx, "error", "Invalid allowed_ip", zap.String("allowed_ip", req.AllowedIP))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("allowed_ip must be an IPv4 or IPv6 address"))
 		return
 	}
 
-	if req.FileID == "" {
-		h.logRequest(ctx, "error", "Missing required field: file_id")
+	ttl, err := h.signedURLTTL(req.ExpiresInSeconds)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid signed URL lifetime", zap.Error(err))
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(errs.NewValidationError("file_id is required"))
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
 		return
 	}
 
@@ -423,9 +1608,56 @@ func (h *FileHandler) GenerateDownloadSignedURL(ctx context.Context, w http.Resp
 	}
 	clientID := auth.Client
 
+	// A key is resolved to its file first; everything below then checks that file
+	if byKey {
+		// Keys are canonicalized like an upload's; an unknown bucket has no files
+		var lowercaseKeys bool
+		err := h.db.QueryRow("SELECT lowercase_keys FROM buckets WHERE id = ?", req.BucketID).Scan(&lowercaseKeys)
+		if err != nil && err != sql.ErrNoRows {
+			h.logRequest(ctx, "error", "Failed to query bucket", zap.Int("bucket_id", req.BucketID), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to generate download URL"))
+			return
+		}
+		key, keyErr := sanitizeKey(req.Key, lowercaseKeys)
+		if keyErr != nil {
+			h.logRequest(ctx, "error", "Invalid key", zap.String("key", req.Key), zap.Error(keyErr))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(keyErr.Error()))
+			return
+		}
+		var fileID string
+		var matches int
+		if err == nil {
+			fileID, matches, err = fileIDAtKey(h.db, req.BucketID, key)
+		}
+		if err != nil && err != sql.ErrNoRows {
+			h.logRequest(ctx, "error", "Failed to resolve key", zap.Int("bucket_id", req.BucketID), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to generate download URL"))
+			return
+		}
+		if matches == 0 {
+			h.logRequest(ctx, "info", "No file at key", zap.Int("bucket_id", req.BucketID), zap.String("key", req.Key))
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+			return
+		}
+		if matches > 1 {
+			h.logRequest(ctx, "error", "Several uploaded files share a key; using the newest",
+				zap.Int("bucket_id", req.BucketID),
+				zap.String("key", req.Key),
+				zap.Int("matches", matches),
+				zap.String("file_id", fileID),
+			)
+		}
+		req.FileID = fileID
+	}
+
 	h.logRequest(ctx, "info", "Generating download signed URL",
 		zap.String("file_id", req.FileID),
 		zap.String("client_id", clientID),
+		zap.String("version_id", req.VersionID),
 	)
 
 	// Look up the file record — verify it exists and belongs to this client.
@@ -434,14 +1666,18 @@ func (h *FileHandler) GenerateDownloadSignedURL(ctx context.Context, w http.Resp
 	var clientName string
 	var bucketName string
 	var deletedAt sql.NullTime
-	err := h.db.QueryRow(
-		`SELECT f.id, f.file_name, f.mimetype, f.client_id, f.bucket_id, f.key, f.deleted_at, c.name, b.name
+	var metadata string
+	var scanStatus string
+	var bucketArchived bool
+	var bucketArchiveMode string
+	err = h.db.QueryRow(
+		`SELECT f.id, f.file_name, f.mimetype, f.client_id, f.bucket_id, f.key, f.status, f.deleted_at, f.metadata, COALESCE(f.scan_status, ''), c.name, b.name, b.archived, COALESCE(b.archive_mode, '')
 		 FROM files f
 		 JOIN clients c ON f.client_id = c.client_id
 		 JOIN buckets b ON f.bucket_id = b.id
-		 WHERE f.id = ?`,
+		 WHERE f.id = ? AND f.staged = 0`,
 		req.FileID,
-	).Scan(&file.ID, &file.FileName, &file.Mimetype, &file.ClientID, &file.BucketID, &file.Key, &deletedAt, &clientName, &bucketName)
+	).Scan(&file.ID, &file.FileName, &file.Mimetype, &file.ClientID, &file.BucketID, &file.Key, &file.Status, &deletedAt, &metadata, &scanStatus, &clientName, &bucketName, &bucketArchived, &bucketArchiveMode)
 	if err != nil {
 		h.logRequest(ctx, "info", "File not found", zap.String("file_id", req.FileID), zap.Error(err))
 		w.WriteHeader(http.StatusNotFound)
@@ -449,53 +1685,150 @@ func (h *FileHandler) GenerateDownloadSignedURL(ctx context.Context, w http.Resp
 		return
 	}
 
-	if deletedAt.Valid {
+	// An earlier version stays downloadable after the file is deleted or while a new upload
+	// of its key is pending; that is what the version was kept for
+	if req.VersionID == "" && (deletedAt.Valid || file.Status == models.FileStatusDeleted) {
 		h.logRequest(ctx, "info", "File has been deleted", zap.String("file_id", req.FileID))
 		w.WriteHeader(http.StatusGone)
 		json.NewEncoder(w).Encode(errs.NewValidationError("File has been deleted"))
 		return
 	}
 
-	// Verify the requesting client owns the file
+	// A pending file's bytes were never uploaded, so there is nothing to download
+	if req.VersionID == "" && file.Status != models.FileStatusUploaded {
+		h.logRequest(ctx, "info", "File has not been uploaded", zap.String("file_id", req.FileID), zap.String("status", file.Status))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+		return
+	}
+
+	// Content that has not been scanned yet is held back until the scanner clears it
+	if req.VersionID == "" && scanStatus == models.ScanStatusPending {
+		h.logRequest(ctx, "info", "File is awaiting its scan", zap.String("file_id", req.FileID))
+		writeAwaitingScan(w)
+		return
+	}
+
+	// Verify the requesting client owns the file or holds a download grant on it
+	var grantID string
 	if file.ClientID != clientID {
-		h.logRequest(ctx, "error", "Client does not own this file",
-			zap.String("file_id", req.FileID),
-			zap.String("requesting_client", clientID),
-			zap.String("owner_client", file.ClientID),
-		)
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(errs.NewAuthorizationError("Access denied"))
+		grant, found, err := h.activeGrant(file.ID, clientID, models.GrantPermissionDownload)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to query file grants", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to generate download URL"))
+			return
+		}
+		if !found {
+			h.logRequest(ctx, "error", "Client does not own this file",
+				zap.String("file_id", req.FileID),
+				zap.String("requesting_client", clientID),
+				zap.String("owner_client", file.ClientID),
+			)
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(errs.NewAuthorizationError("Access denied"))
+			return
+		}
+		grantID = grant.ID
+	}
+
+	// Buckets archived with freeze-all serve no downloads, so no URL is issued for them
+	if readsFrozen(bucketArchived, bucketArchiveMode) {
+		h.logRequest(ctx, "info", "Bucket is archived", zap.Int("bucket_id", file.BucketID))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Cannot download from an archived bucket"))
 		return
 	}
 
 	// Reconstruct the storage path: <client_name>/<bucket_name>/<key>
 	resolvedFilePath := filepath.Join(clientName, bucketName, file.Key)
+	absFilePath := filepath.Join("./uploads", resolvedFilePath)
+
+	// An earlier version is looked up among those kept for the file's key. A grant only
+	// reaches the versions of the granted file, not those of other files stored at the key.
+	if req.VersionID != "" {
+		var versionFileID string
+		var deleteMarker bool
+		err := h.db.QueryRow(
+			"SELECT file_id, mimetype, delete_marker FROM file_versions WHERE id = ? AND bucket_id = ? AND key = ?",
+			req.VersionID, file.BucketID, file.Key,
+		).Scan(&versionFileID, &file.Mimetype, &deleteMarker)
+		if err == sql.ErrNoRows || (err == nil && grantID != "" && versionFileID != file.ID) {
+			h.logRequest(ctx, "info", "Version not found", zap.String("file_id", file.ID), zap.String("version_id", req.VersionID))
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(errs.NewNotFoundError("Version not found"))
+			return
+		}
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to query file version", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to generate download URL"))
+			return
+		}
+		if deleteMarker {
+			h.logRequest(ctx, "info", "Version is a delete marker", zap.String("version_id", req.VersionID))
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(errs.NewNotFoundError("Version is a delete marker and has no content"))
+			return
+		}
+		absFilePath = versionBlobPath(req.VersionID)
+	}
 
 	// Verify the file exists on disk
-	absFilePath := filepath.Join("./uploads", resolvedFilePath)
 	if _, err := os.Stat(absFilePath); os.IsNotExist(err) {
 		h.logRequest(ctx, "error", "File missing on disk",
 			zap.String("file_id", file.ID),
-			zap.String("path", absFilePath),
+			zap.String("full_path", absFilePath),
 		)
 		w.WriteHeader(http.StatusGone)
 		json.NewEncoder(w).Encode(errs.NewValidationError("File has been deleted"))
 		return
 	}
 
+	// Content encrypted with a customer key can only be downloaded with that key
+	keyHash, _, err := fileEncryption(h.db, file.ID, req.VersionID)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query file encryption", zap.String("file_id", file.ID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to generate download URL"))
+		return
+	}
+
 	// Generate download token
 	downloadToken := generateDownloadToken()
-	ttl := 15 * time.Minute
+	maxUses := req.MaxUses
+	if maxUses == 0 {
+		maxUses = 1
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(ttl)
 
 	// Store token data in Redis.
 	// FilePath carries the full resolved path so the download handler needs no extra DB lookups.
 	tokenData := models.DownloadTokenData{
-		FileID:   file.ID,
-		FileName: file.FileName,
-		Mimetype: file.Mimetype,
-		ClientID: clientID,
-		BucketID: file.BucketID,
-		FilePath: resolvedFilePath,
+		FileID:           file.ID,
+		FileName:         file.FileName,
+		Mimetype:         file.Mimetype,
+		ClientID:         file.ClientID,
+		BucketID:         file.BucketID,
+		FilePath:         resolvedFilePath,
+		VersionID:        req.VersionID,
+		Metadata:         decodeFileMetadata(metadata),
+		Encrypted:        keyHash != "",
+		MaxUses:          maxUses,
+		ExpiresAt:        expiresAt,
+		Disposition:      req.Disposition,
+		DownloadFilename: req.DownloadFilename,
+	}
+	if grantID != "" {
+		tokenData.GrantID = grantID
+		tokenData.GranteeClientID = clientID
+	}
+	if req.RestrictIP {
+		tokenData.AllowedIP = h.requestIP(r)
+		if req.AllowedIP != "" {
+			tokenData.AllowedIP = net.ParseIP(req.AllowedIP).String()
+		}
 	}
 
 	if err := h.cache.Set("download:"+downloadToken, tokenData, ttl); err != nil {
@@ -505,26 +1838,50 @@ func (h *FileHandler) GenerateDownloadSignedURL(ctx context.Context, w http.Resp
 		return
 	}
 
-	now := time.Now()
-	signedURL := fmt.Sprintf("http://localhost:8080/files/download?token=%s", downloadToken)
-	expiresAt := now.Add(ttl)
+	signedURL, err := h.signedURL(clientID, models.ShortTokenKindDownload, downloadToken, ttl)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to build download URL", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to generate download URL"))
+		return
+	}
 
 	h.logRequest(ctx, "info", "Download signed URL generated successfully",
 		zap.String("file_id", file.ID),
 		zap.String("client_id", clientID),
 		zap.Int("bucket_id", file.BucketID),
+		zap.String("grant_id", grantID),
 	)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(models.SignedURLResponse{
-		FileID:    file.ID,
-		SignedURL: signedURL,
-		ExpiresAt: expiresAt,
+		FileID:                file.ID,
+		SignedURL:             signedURL,
+		ExpiresAt:             expiresAt,
+		EncryptionKeyRequired: tokenData.Encrypted,
 	})
 }
 
-// DownloadFile handles GET /files/download - download file using token from URL (no auth header required)
+// fileIDAtKey returns the newest uploaded, undeleted file stored at a canonical key in a
+// bucket, and how many such files there are; a key holds one at a time, so more means a
+// stray row
+func fileIDAtKey(q sqlx.Queryer, bucketID int, key string) (string, int, error) {
+	var fileIDs []string
+	err := sqlx.Select(q, &fileIDs,
+		`SELECT id FROM files
+		WHERE bucket_id = ? AND key = ? AND status = ? AND deleted_at IS NULL AND staged = 0
+		ORDER BY updated_at DESC`,
+		bucketID, key, models.FileStatusUploaded,
+	)
+	if err != nil || len(fileIDs) == 0 {
+		return "", 0, err
+	}
+	return fileIDs[0], len(fileIDs), nil
+}
+
+// DownloadFile handles GET /files/download - download file using token from URL (no auth header required).
+// HEAD answers with the same status and headers without using the token up.
 func (h *FileHandler) DownloadFile(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	token := r.URL.Query().Get("token")
 	if token == "" {
@@ -561,8 +1918,125 @@ func (h *FileHandler) DownloadFile(ctx context.Context, w http.ResponseWriter, r
 		return
 	}
 
-	// Open the file from disk using the resolved path stored in the token
+	// A token bound to an address only downloads to it, and is not used up by others
+	if tokenData.AllowedIP != "" {
+		if ip := h.requestIP(r); !sameIP(ip, tokenData.AllowedIP) {
+			h.logRequest(ctx, "error", "Download from an address the token is not bound to",
+				zap.String("file_id", tokenData.FileID),
+				zap.String("request_ip", ip),
+			)
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(errs.NewAuthorizationError("This download URL is restricted to another IP address"))
+			return
+		}
+	}
+
+	// A grant revoked or expired after the URL was issued no longer allows the download
+	if tokenData.GrantID != "" {
+		if _, found, err := h.activeGrant(tokenData.FileID, tokenData.GranteeClientID, models.GrantPermissionDownload); err != nil || !found {
+			h.logRequest(ctx, "error", "Download grant is no longer active",
+				zap.String("file_id", tokenData.FileID),
+				zap.String("grant_id", tokenData.GrantID),
+				zap.Error(err),
+			)
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(errs.NewAuthorizationError("Access denied"))
+			return
+		}
+	}
+
+	// The bucket may have been archived, or the file deleted, since the URL was issued.
+	// Earlier versions outlive the file, so only the bucket matters for them.
+	if err := checkTokenTarget(h.db, tokenData.FileID, models.ShortTokenKindDownload, tokenData.FilePath, tokenData.VersionID != ""); err != nil {
+		switch {
+		case errors.Is(err, errTargetBucketArchived):
+			h.logRequest(ctx, "info", "Bucket was archived after the download URL was issued", zap.String("file_id", tokenData.FileID))
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(errs.NewValidationError("Cannot download from an archived bucket"))
+		case errors.Is(err, errTargetBucketRenamed):
+			h.logRequest(ctx, "info", "Bucket was renamed after the download URL was issued", zap.String("file_id", tokenData.FileID))
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(errs.NewValidationError(errBucketRenamedMessage))
+		case errors.Is(err, errTargetFileDeleted):
+			h.logRequest(ctx, "info", "File was deleted after the download URL was issued", zap.String("file_id", tokenData.FileID))
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(errs.NewValidationError("File has been deleted"))
+		default:
+			h.logRequest(ctx, "error", "Failed to check download target", zap.String("file_id", tokenData.FileID), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to access file"))
+		}
+		return
+	}
+
+	// The file may have been replaced by content not yet scanned since the URL was issued;
+	// the token is kept so the download can be retried once the scan clears it
+	if tokenData.VersionID == "" {
+		pending, err := awaitingScan(h.db, tokenData.FileID)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to query scan status", zap.String("file_id", tokenData.FileID), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to access file"))
+			return
+		}
+		if pending {
+			h.logRequest(ctx, "info", "File is awaiting its scan", zap.String("file_id", tokenData.FileID))
+			writeAwaitingScan(w)
+			return
+		}
+	}
+
+	// Content encrypted with a customer key needs the key to be decrypted. The current
+	// content is checked as well, since the file may have been replaced since the URL was
+	// issued; the token is kept so the download can be retried with the right key.
+	keyHash, iv, err := fileEncryption(h.db, tokenData.FileID, tokenData.VersionID)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query file encryption", zap.String("file_id", tokenData.FileID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to access file"))
+		return
+	}
+	var encKey []byte
+	if tokenData.Encrypted || keyHash != "" {
+		encKey, err = decodeCustomerKey(r)
+		if err == nil && encKey == nil {
+			err = errEncryptionKeyRequired
+		}
+		if err == nil && keyHash != "" && !customerKeyMatches(keyHash, encKey) {
+			err = errEncryptionKeyMismatch
+		}
+		if err != nil {
+			h.logRequest(ctx, "error", "Encryption key missing or wrong", zap.String("file_id", tokenData.FileID), zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+			return
+		}
+	}
+
+	// The checksum is of the content as uploaded, which is what the download sends, decrypted
+	checksum, err := fileChecksum(h.db, tokenData.FileID, tokenData.VersionID)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query file checksum", zap.String("file_id", tokenData.FileID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to access file"))
+		return
+	}
+
+	// Open the file from disk using the resolved path stored in the token.
+	// Register as a reader first so a concurrent deletion cannot remove it mid-stream.
 	filePath := filepath.Join("./uploads", tokenData.FilePath)
+	if tokenData.VersionID != "" {
+		filePath = versionBlobPath(tokenData.VersionID)
+	}
+	readCtx, release, ok := h.locks.acquireDownload(ctx, filePath, w)
+	if !ok {
+		h.logRequest(ctx, "info", "File is being deleted", zap.String("file_id", tokenData.FileID))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+		return
+	}
+	defer release()
+
 	f, err := os.Open(filePath)
 	if err != nil {
 		h.logRequest(ctx, "error", "File not found on disk",
@@ -575,24 +2049,174 @@ func (h *FileHandler) DownloadFile(ctx context.Context, w http.ResponseWriter, r
 	}
 	defer f.Close()
 
-	// Delete the token from Redis (one-time use)
-	h.cache.Delete("download:" + token)
+	fileInfo, err := f.Stat()
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to stat file", zap.String("file_id", tokenData.FileID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to access file"))
+		return
+	}
+	size := fileInfo.Size()
+
+	// A single byte range is served with 206, unless If-Range names older content
+	var rng byteRange
+	partial := false
+	if header := r.Header.Get("Range"); header != "" && ifRangeMatches(r, fileInfo.ModTime()) {
+		rng, partial, err = parseByteRange(header, size)
+		if err != nil {
+			h.logRequest(ctx, "info", "Download range outside the file",
+				zap.String("file_id", tokenData.FileID),
+				zap.String("range", header),
+				zap.Int64("file_size", size),
+			)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			json.NewEncoder(w).Encode(models.ReadRangeNotSatisfiableError{
+				Code:     http.StatusRequestedRangeNotSatisfiable,
+				Message:  fmt.Sprintf("range %s is outside the file of %d bytes", header, size),
+				FileSize: size,
+			})
+			return
+		}
+	}
+
+	var decrypted io.Reader
+	if keyHash != "" {
+		if partial {
+			decrypted, err = decryptStoredFrom(encKey, iv, f, rng.start)
+		} else {
+			decrypted, err = decryptStored(encKey, iv, f)
+		}
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to set up decryption", zap.String("file_id", tokenData.FileID), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to access file"))
+			return
+		}
+	} else if partial {
+		if _, err := f.Seek(rng.start, io.SeekStart); err != nil {
+			h.logRequest(ctx, "error", "Failed to position file", zap.String("file_id", tokenData.FileID), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to access file"))
+			return
+		}
+	}
+
+	// Record the redemption, which also counts it against the token's uses. A token whose
+	// uses are spent is deleted, so its last redemption is the last one accepted. A range
+	// that stops short of the end only needs a use left, so a download can be resumed or
+	// fetched in parts; the range that reaches the final byte claims the use. A HEAD
+	// sends no content, so it only checks that a use is left as well.
+	final := r.Method != http.MethodHead && (!partial || rng.last(size))
+	var redemptionID string
+	claimed, spent := false, false
+	if final {
+		redemptionID, spent, err = h.redeemDownloadToken(r, token, tokenData)
+		claimed = redemptionID != ""
+	} else {
+		claimed, err = h.downloadUsesLeft(token, tokenData)
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to record download redemption", zap.String("file_id", tokenData.FileID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to access file"))
+		return
+	}
+	if spent {
+		h.cache.Delete("download:" + token)
+	}
+	if !claimed {
+		h.logRequest(ctx, "info", "Download token has no uses left", zap.String("file_id", tokenData.FileID))
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Invalid or expired download token"))
+		return
+	}
+
+	if tokenData.GrantID != "" && final {
+		if err := h.recordGrantDownload(tokenData.GrantID); err != nil {
+			h.logRequest(ctx, "error", "Failed to record grant download", zap.String("grant_id", tokenData.GrantID), zap.Error(err))
+		}
+	}
+	if r.Method != http.MethodHead {
+		if err := touchClientDownload(h.db, tokenData.ClientID, time.Now().UTC()); err != nil {
+			h.logRequest(ctx, "error", "Failed to record client activity", zap.String("client_id", tokenData.ClientID), zap.Error(err))
+		}
+	}
 
 	h.logRequest(ctx, "info", "Serving file download",
 		zap.String("file_id", tokenData.FileID),
 		zap.String("file_name", tokenData.FileName),
 		zap.String("client_id", tokenData.ClientID),
+		zap.String("grantee_client_id", tokenData.GranteeClientID),
 		zap.Int("bucket_id", tokenData.BucketID),
+		zap.String("version_id", tokenData.VersionID),
+		zap.Bool("partial", partial),
 	)
 
 	// Set response headers for file download
+	disposition := tokenData.Disposition
+	if disposition == "" {
+		disposition = models.DispositionAttachment
+	}
+	filename := tokenData.FileName
+	if tokenData.DownloadFilename != "" {
+		filename = tokenData.DownloadFilename
+	}
 	w.Header().Set("Content-Type", tokenData.Mimetype)
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, tokenData.FileName))
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, filename))
+	// Browsers render the file as its recorded type, never as one they guess; displayed
+	// markup that could run scripts is sandboxed away from the service's origin
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if disposition == models.DispositionInline && isScriptable(normalizeMimetype(tokenData.Mimetype)) {
+		w.Header().Set("Content-Security-Policy", "sandbox")
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Last-Modified", fileInfo.ModTime().UTC().Format(http.TimeFormat))
+	setChecksumHeader(w, checksum)
+	if h.config.FileMetaHeaders {
+		setFileMetaHeaders(w, tokenData.Metadata)
+	}
+	// An explicit length makes a stream cut short by a deletion fail visibly on the client
+	if partial {
+		w.Header().Set("Content-Length", strconv.FormatInt(rng.length, 10))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.start+rng.length-1, size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
 
-	// Stream file content to response
-	if _, err := io.Copy(w, f); err != nil {
-		h.logRequest(ctx, "error", "Failed to stream file", zap.Error(err))
+	// Stream file content to response, decrypting it on the way when it is encrypted
+	switch {
+	case decrypted != nil:
+		if partial {
+			decrypted = io.LimitReader(decrypted, rng.length)
+		}
+		_, err = copyWithContext(readCtx, w, decrypted)
+	case partial:
+		_, err = streamFileRange(readCtx, w, f, rng.length, h.config.FastTransfers)
+	default:
+		_, err = streamFile(readCtx, w, f, h.config.FastTransfers)
+	}
+	if err == nil {
+		if final {
+			h.downloads.Record(tokenData.FileID)
+		}
+		return
+	}
+	h.logRequest(ctx, "error", "Failed to stream file", zap.String("file_id", tokenData.FileID), zap.Error(err))
+
+	// A transfer cut short, such as by a dropped connection, gives its use back so the
+	// same URL can be retried
+	if redemptionID != "" {
+		if err := h.refundDownloadRedemption(redemptionID, token, tokenData); err != nil {
+			h.logRequest(ctx, "error", "Failed to refund download redemption", zap.String("file_id", tokenData.FileID), zap.Error(err))
+			return
+		}
+		h.logRequest(ctx, "info", "Download use refunded after incomplete transfer", zap.String("file_id", tokenData.FileID))
 	}
 }
 
@@ -608,7 +2232,9 @@ func (h *FileHandler) ListFiles(ctx context.Context, w http.ResponseWriter, r *h
 		return
 	}
 
-	path := strings.Trim(r.URL.Query().Get("path"), "/")
+	rawPath := r.URL.Query().Get("path")
+	// includePending also lists files whose upload has not completed, for debugging
+	includePending := r.URL.Query().Get("include_pending") == "true"
 
 	clientID := ""
 	if auth := httpserver.GetRequestAuth(ctx); auth != nil {
@@ -622,11 +2248,14 @@ func (h *FileHandler) ListFiles(ctx context.Context, w http.ResponseWriter, r *h
 		return
 	}
 
-	h.logRequest(ctx, "info", "Listing files in bucket", zap.Int("bucket_id", bucketID), zap.String("path", path))
+	h.logRequest(ctx, "info", "Listing files in bucket", zap.Int("bucket_id", bucketID), zap.String("path", rawPath))
 
 	var bucketClientID string
-	var bucketArchived int
-	if err := h.db.QueryRow("SELECT client_id, archived FROM buckets WHERE id = ?", bucketID).Scan(&bucketClientID, &bucketArchived); err != nil {
+	var bucketArchived bool
+	var bucketArchiveMode string
+	var bucketLowercaseKeys int
+	var bucketThumbnailWidths string
+	if err := h.db.QueryRow("SELECT client_id, archived, COALESCE(archive_mode, ''), lowercase_keys, thumbnail_widths FROM buckets WHERE id = ?", bucketID).Scan(&bucketClientID, &bucketArchived, &bucketArchiveMode, &bucketLowercaseKeys, &bucketThumbnailWidths); err != nil {
 		h.logRequest(ctx, "error", "Bucket not found", zap.Int("bucket_id", bucketID), zap.Error(err))
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(errs.NewNotFoundError("Bucket not found"))
@@ -643,26 +2272,75 @@ func (h *FileHandler) ListFiles(ctx context.Context, w http.ResponseWriter, r *h
 		return
 	}
 
-	if bucketArchived != 0 {
+	// A bucket archived with freeze-writes stays listable
+	if readsFrozen(bucketArchived, bucketArchiveMode) {
 		h.logRequest(ctx, "error", "Bucket is archived", zap.Int("bucket_id", bucketID))
 		w.WriteHeader(http.StatusConflict)
 		json.NewEncoder(w).Encode(errs.NewValidationError("Cannot list files in an archived bucket"))
 		return
 	}
 
-	query := `SELECT id, file_name, file_size, mimetype, key, created_at
+	path, err := canonicalizeKey(rawPath, bucketLowercaseKeys != 0)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid path", zap.String("path", rawPath), zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	// A page scans at most MAX_SYNC_ROWS files; cursors are bound to this bucket, path and filter
+	page, err := h.pager.Parse(r.URL.Query(), api.PageSpec{
+		Scope:        fmt.Sprintf("files:%s:%d:%s:%t", clientID, bucketID, path, includePending),
+		DefaultLimit: h.config.MaxSyncRows,
+		MaxLimit:     h.config.MaxSyncRows,
+		Sorts:        []string{"key", "-key"},
+	})
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid page request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	query := `SELECT id, file_name, file_size, mimetype, COALESCE(detected_mimetype, ''), COALESCE(checksum, ''), metadata, key, status, COALESCE(scan_status, ''), created_at,
+		image_width, image_height, image_format,
+		encryption_key_hash IS NOT NULL, COALESCE(thumbnail_status, ''), COALESCE(thumbnail_source, ''), size_mismatch, declared_file_size,
+		COALESCE(uploader_ip, ''), COALESCE(uploader_user_agent, ''), download_count, last_downloaded_at
 		FROM files
-		WHERE bucket_id = ? AND deleted_at IS NULL`
+		WHERE bucket_id = ? AND staged = 0`
 	args := []interface{}{bucketID}
 
+	if includePending {
+		query += " AND status IN (?, ?)"
+		args = append(args, models.FileStatusUploaded, models.FileStatusPending)
+	} else {
+		query += " AND status = ?"
+		args = append(args, models.FileStatusUploaded)
+	}
+
 	if path == "" {
 		query += " AND key <> ''"
 	} else {
-		query += " AND key LIKE ?"
-		args = append(args, path+"/%")
+		condition, conditionArgs := keyPrefixCondition("key", path)
+		query += " AND " + condition
+		args = append(args, conditionArgs...)
+	}
+
+	// Resume after the last row of the previous page when a cursor is supplied; the id
+	// breaks ties between a pending upload and the file stored at the same key
+	direction, comparison := "ASC", ">"
+	if page.Descending() {
+		direction, comparison = "DESC", "<"
+	}
+	if len(page.After) == 2 {
+		query += " AND (key " + comparison + " ? OR (key = ? AND id " + comparison + " ?))"
+		args = append(args, page.After[0], page.After[0], page.After[1])
 	}
 
-	query += " ORDER BY key ASC"
+	// Fetch one row past the limit so we know whether the listing was truncated
+	maxRows := page.Limit
+	query += " ORDER BY key " + direction + ", id " + direction + " LIMIT ?"
+	args = append(args, maxRows+1)
 
 	rows, err := h.db.Query(query, args...)
 	if err != nil {
@@ -680,13 +2358,56 @@ func (h *FileHandler) ListFiles(ctx context.Context, w http.ResponseWriter, r *h
 		prefix += "/"
 	}
 
+	scanned := 0
+	truncated := false
+	lastKey, lastID := "", ""
 	for rows.Next() {
+		if scanned == maxRows {
+			truncated = true
+			break
+		}
+		scanned++
+
 		var file models.FileListItem
 		var key string
-		if err := rows.Scan(&file.ID, &file.FileName, &file.FileSize, &file.Mimetype, &key, &file.CreatedAt); err != nil {
+		var metadata string
+		var imageWidth, imageHeight sql.NullInt64
+		var imageFormat sql.NullString
+		var encrypted bool
+		var thumbnailsStatus, thumbnailsSource string
+		var declaredFileSize sql.NullInt64
+		var uploader models.Uploader
+		var lastDownloadedAt sql.NullTime
+		if err := rows.Scan(&file.ID, &file.FileName, &file.FileSize, &file.Mimetype, &file.DetectedMimetype, &file.Checksum, &metadata, &key, &file.Status, &file.ScanStatus, &file.CreatedAt,
+			&imageWidth, &imageHeight, &imageFormat, &encrypted, &thumbnailsStatus, &thumbnailsSource, &file.SizeMismatch, &declaredFileSize,
+			&uploader.IP, &uploader.UserAgent, &file.DownloadCount, &lastDownloadedAt); err != nil {
 			h.logRequest(ctx, "error", "Failed to scan file row", zap.Error(err))
 			continue
 		}
+		file.Metadata = decodeFileMetadata(metadata)
+		if file.SizeMismatch && declaredFileSize.Valid {
+			file.DeclaredFileSize = &declaredFileSize.Int64
+		}
+		if imageWidth.Valid && imageHeight.Valid {
+			file.Image = &models.ImageDimensions{Width: int(imageWidth.Int64), Height: int(imageHeight.Int64), Format: imageFormat.String}
+		}
+		if uploader.IP != "" {
+			file.UploadedFrom = &uploader
+		}
+		if lastDownloadedAt.Valid {
+			file.LastDownloadedAt = &lastDownloadedAt.Time
+		}
+		mimetype := file.DetectedMimetype
+		if mimetype == "" {
+			mimetype = file.Mimetype
+		}
+		if status := thumbnailStatus(bucketThumbnailWidths, mimetype, file.Checksum, encrypted, thumbnailsStatus, thumbnailsSource); status != "" {
+			file.Thumbnails = &models.FileThumbnails{Status: status}
+		}
+		if !includePending {
+			file.Status = ""
+		}
+		lastKey, lastID = key, file.ID
 
 		if !strings.HasPrefix(key, prefix) {
 			continue
@@ -706,16 +2427,43 @@ func (h *FileHandler) ListFiles(ctx context.Context, w http.ResponseWriter, r *h
 		}
 	}
 
+	rows.Close()
+
+	// Thumbnails are listed for the images whose thumbnails are ready
+	readyIDs := make([]string, 0)
+	for _, file := range files {
+		if file.Thumbnails != nil && file.Thumbnails.Status == models.ThumbnailStatusReady {
+			readyIDs = append(readyIDs, file.ID)
+		}
+	}
+	thumbnails, err := listedThumbnails(h.db, readyIDs)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query thumbnails", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to list files"))
+		return
+	}
+	for i := range files {
+		if items, ok := thumbnails[files[i].ID]; ok {
+			files[i].Thumbnails.Items = items
+		}
+	}
+
 	folders := make([]string, 0, len(foldersSet))
 	for folder := range foldersSet {
 		folders = append(folders, folder)
 	}
 	sort.Strings(folders)
 
+	nextCursor := ""
+	if truncated {
+		h.logRequest(ctx, "info", "File listing truncated", zap.Int("bucket_id", bucketID), zap.Int("max_rows", maxRows))
+		nextCursor = h.pager.Next(page, lastKey, lastID)
+	}
 	response := models.ListFilesResponse{
+		Page:     api.NewPage(files, nextCursor),
 		BucketID: bucketID,
 		Path:     path,
-		Files:    files,
 		Folders:  folders,
 	}
 
@@ -783,10 +2531,23 @@ func (h *FileHandler) DeleteFiles(ctx context.Context, w http.ResponseWriter, r
 func (h *FileHandler) deleteFilesByIDs(ctx context.Context, w http.ResponseWriter, clientID string, fileIDs []string) {
 	h.logRequest(ctx, "info", "Deleting files by IDs", zap.Int("count", len(fileIDs)))
 
+	if len(fileIDs) > h.config.MaxSyncRows {
+		h.logRequest(ctx, "error", "Too many file IDs for synchronous delete",
+			zap.Int("count", len(fileIDs)),
+			zap.Int("max_rows", h.config.MaxSyncRows),
+		)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(errs.AppError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("Cannot delete more than %d files in one request; split the file_ids into smaller batches", h.config.MaxSyncRows),
+		})
+		return
+	}
+
 	placeholders := strings.Repeat("?,", len(fileIDs))
 	placeholders = strings.TrimSuffix(placeholders, ",")
-	args := make([]interface{}, 0, len(fileIDs)+1)
-	args = append(args, clientID)
+	args := make([]interface{}, 0, len(fileIDs)+2)
+	args = append(args, clientID, models.FileStatusDeleted)
 	for _, id := range fileIDs {
 		args = append(args, id)
 	}
@@ -795,7 +2556,7 @@ func (h *FileHandler) deleteFilesByIDs(ctx context.Context, w http.ResponseWrite
 		FROM files f
 		JOIN clients c ON f.client_id = c.client_id
 		JOIN buckets b ON f.bucket_id = b.id
-		WHERE f.client_id = ? AND f.deleted_at IS NULL AND f.id IN (%s)`, placeholders)
+		WHERE f.client_id = ? AND f.status <> ? AND f.staged = 0 AND f.id IN (%s)`, placeholders)
 
 	rows, err := h.db.Query(query, args...)
 	if err != nil {
@@ -830,15 +2591,14 @@ func (h *FileHandler) deleteFilesByIDs(ctx context.Context, w http.ResponseWrite
 }
 
 // deleteFilesByPath deletes all files in a bucket under the given path
-func (h *FileHandler) deleteFilesByPath(ctx context.Context, w http.ResponseWriter, clientID string, bucketID int, path string) {
-	path = strings.Trim(path, "/")
-
-	h.logRequest(ctx, "info", "Deleting files by path", zap.Int("bucket_id", bucketID), zap.String("path", path))
+func (h *FileHandler) deleteFilesByPath(ctx context.Context, w http.ResponseWriter, clientID string, bucketID int, rawPath string) {
+	h.logRequest(ctx, "info", "Deleting files by path", zap.Int("bucket_id", bucketID), zap.String("path", rawPath))
 
 	// Verify bucket exists and belongs to client
 	var bucketClientID string
 	var bucketArchived int
-	if err := h.db.QueryRow("SELECT client_id, archived FROM buckets WHERE id = ?", bucketID).Scan(&bucketClientID, &bucketArchived); err != nil {
+	var bucketLowercaseKeys int
+	if err := h.db.QueryRow("SELECT client_id, archived, lowercase_keys FROM buckets WHERE id = ?", bucketID).Scan(&bucketClientID, &bucketArchived, &bucketLowercaseKeys); err != nil {
 		h.logRequest(ctx, "error", "Bucket not found", zap.Int("bucket_id", bucketID))
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(errs.NewNotFoundError("Bucket not found"))
@@ -862,33 +2622,57 @@ func (h *FileHandler) deleteFilesByPath(ctx context.Context, w http.ResponseWrit
 		return
 	}
 
-	// Query all files under the given path (recursive)
-	query := `SELECT f.id, f.key, c.name, b.name
-		FROM files f
-		JOIN clients c ON f.client_id = c.client_id
-		JOIN buckets b ON f.bucket_id = b.id
-		WHERE f.bucket_id = ? AND f.client_id = ? AND f.deleted_at IS NULL AND f.key LIKE ?`
-
-	prefix := path + "/%"
-	rows, err := h.db.Query(query, bucketID, clientID, prefix)
+	path, err := canonicalizeKey(rawPath, bucketLowercaseKeys != 0)
 	if err != nil {
-		h.logRequest(ctx, "error", "Failed to query files by path", zap.Error(err))
+		h.logRequest(ctx, "error", "Invalid path", zap.String("path", rawPath), zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	condition, conditionArgs := keyPrefixCondition("f.key", path)
+	scopeArgs := append([]interface{}{bucketID, clientID, models.FileStatusDeleted}, conditionArgs...)
+
+	// Refuse to process more rows than a synchronous request is allowed to handle
+	var matched int
+	if err := h.db.QueryRow(
+		"SELECT COUNT(*) FROM files f WHERE f.bucket_id = ? AND f.client_id = ? AND f.status <> ? AND f.staged = 0 AND "+condition,
+		scopeArgs...,
+	).Scan(&matched); err != nil {
+		h.logRequest(ctx, "error", "Failed to count files by path", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to delete files"))
 		return
 	}
-	defer rows.Close()
-
-	fileIDs := make([]string, 0)
-	records := make(map[string]string)
-	for rows.Next() {
-		var fileID, key, clientName, bucketName string
-		if err := rows.Scan(&fileID, &key, &clientName, &bucketName); err != nil {
-			h.logRequest(ctx, "error", "Failed to scan file row", zap.Error(err))
-			continue
+	if matched > h.config.MaxSyncRows {
+		// Too many rows for one request: hand the path to a background job instead
+		job, err := h.enqueueDeleteJob(clientID, bucketID, path, matched)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to enqueue delete job", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to delete files"))
+			return
 		}
-		fileIDs = append(fileIDs, fileID)
-		records[fileID] = filepath.Join("./uploads", clientName, bucketName, key)
+		h.logRequest(ctx, "info", "Path delete queued as a background job",
+			zap.String("job_id", job.ID),
+			zap.String("path", path),
+			zap.Int("matched", matched),
+			zap.Int("max_rows", h.config.MaxSyncRows),
+		)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/files/delete-jobs/"+job.ID)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+		return
+	}
+
+	// Query all files under the given path (recursive)
+	fileIDs, records, _, _, err := h.filesUnderPath(clientID, bucketID, path, "", "", h.config.MaxSyncRows)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query files by path", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to delete files"))
+		return
 	}
 
 	if len(fileIDs) == 0 {
@@ -911,7 +2695,58 @@ func (h *FileHandler) deleteFilesByPath(ctx context.Context, w http.ResponseWrit
 	json.NewEncoder(w).Encode(response)
 }
 
-// removeFiles deletes files from disk and marks them deleted in the database.
+// filesUnderPath returns up to limit live files of a client's bucket under path, ordered by
+// key and id, with the disk path of each. Passing the key and id of the last file returned
+// resumes after it, so a caller can walk a large path in batches.
+func (h *FileHandler) filesUnderPath(clientID string, bucketID int, path, afterKey, afterID string, limit int) (fileIDs []string, records map[string]string, lastKey, lastID string, err error) {
+	condition, conditionArgs := keyPrefixCondition("f.key", path)
+	query := `SELECT f.id, f.key, c.name, b.name
+		FROM files f
+		JOIN clients c ON f.client_id = c.client_id
+		JOIN buckets b ON f.bucket_id = b.id
+		WHERE f.bucket_id = ? AND f.client_id = ? AND f.status <> ? AND f.staged = 0 AND ` + condition + `
+		AND (f.key > ? OR (f.key = ? AND f.id > ?))
+		ORDER BY f.key, f.id
+		LIMIT ?`
+
+	args := append([]interface{}{bucketID, clientID, models.FileStatusDeleted}, conditionArgs...)
+	rows, err := h.db.Query(query, append(args, afterKey, afterKey, afterID, limit)...)
+	if err != nil {
+		return nil, nil, "", "", err
+	}
+	defer rows.Close()
+
+	fileIDs = make([]string, 0)
+	records = make(map[string]string)
+	for rows.Next() {
+		var fileID, key, clientName, bucketName string
+		if err := rows.Scan(&fileID, &key, &clientName, &bucketName); err != nil {
+			return nil, nil, "", "", err
+		}
+		fileIDs = append(fileIDs, fileID)
+		records[fileID] = filepath.Join("./uploads", clientName, bucketName, key)
+		lastKey, lastID = key, fileID
+	}
+	return fileIDs, records, lastKey, lastID, rows.Err()
+}
+
+// removeStoredFile deletes a file from disk once no download is streaming it.
+// Downloads still running after the configured wait are cancelled.
+func (h *FileHandler) removeStoredFile(ctx context.Context, fileID, diskPath string) error {
+	release, contended := h.locks.acquireDelete(diskPath)
+	defer release()
+
+	if contended > 0 {
+		h.logRequest(ctx, "info", "Deletion contended with active downloads",
+			zap.String("file_id", fileID),
+			zap.Int("active_readers", contended),
+		)
+	}
+	return os.Remove(diskPath)
+}
+
+// removeFiles deletes files from disk and marks them deleted in the database. Files of a
+// versioning bucket are kept as versions behind a delete marker (see removeVersionedFile).
 // Returns lists of deleted, missing, and failed file IDs.
 func (h *FileHandler) removeFiles(ctx context.Context, fileIDs []string, records map[string]string) (deleted, missing, failed []string) {
 	deleted = make([]string, 0)
@@ -925,7 +2760,33 @@ func (h *FileHandler) removeFiles(ctx context.Context, fileIDs []string, records
 			continue
 		}
 
-		if err := os.Remove(diskPath); err != nil {
+		// A versioning bucket keeps the bytes and records a delete marker instead
+		var bucketID int
+		var key string
+		var versioning bool
+		if err := h.db.QueryRow(
+			"SELECT f.bucket_id, f.key, b.versioning FROM files f JOIN buckets b ON f.bucket_id = b.id WHERE f.id = ?", id,
+		).Scan(&bucketID, &key, &versioning); err != nil {
+			h.logRequest(ctx, "error", "Failed to query file bucket", zap.String("file_id", id), zap.Error(err))
+			failed = append(failed, id)
+			continue
+		}
+		if versioning {
+			if err := h.removeVersionedFile(ctx, id, bucketID, key, diskPath); err != nil {
+				if os.IsNotExist(err) {
+					missing = append(missing, id)
+					continue
+				}
+				h.logRequest(ctx, "error", "Failed to delete versioned file", zap.String("file_id", id), zap.Error(err))
+				failed = append(failed, id)
+				continue
+			}
+			h.removeDeletedThumbnails(ctx, id)
+			deleted = append(deleted, id)
+			continue
+		}
+
+		if err := h.removeStoredFile(ctx, id, diskPath); err != nil {
 			if os.IsNotExist(err) {
 				missing = append(missing, id)
 				continue
@@ -935,15 +2796,28 @@ func (h *FileHandler) removeFiles(ctx context.Context, fileIDs []string, records
 			continue
 		}
 
-		_, err := h.db.Exec("UPDATE files SET deleted_at = ?, updated_at = ? WHERE id = ?", time.Now(), time.Now(), id)
+		_, err := h.db.Exec("UPDATE files SET status = ?, deleted_at = ?, updated_at = ? WHERE id = ?", models.FileStatusDeleted, time.Now().UTC(), time.Now().UTC(), id)
 		if err != nil {
 			h.logRequest(ctx, "error", "Failed to mark file deleted", zap.String("file_id", id), zap.Error(err))
 			failed = append(failed, id)
 			continue
 		}
 
+		h.removeDeletedThumbnails(ctx, id)
 		deleted = append(deleted, id)
 	}
 
 	return deleted, missing, failed
 }
+
+// removeDeletedThumbnails removes the thumbnails and renditions of a file just deleted.
+// Thumbnails that cannot be removed now are left to the thumbnail sweeper; renditions left
+// behind are never served, as the public route answers 404 for the file first.
+func (h *FileHandler) removeDeletedThumbnails(ctx context.Context, fileID string) {
+	if err := removeThumbnails(h.db, fileID); err != nil {
+		h.logRequest(ctx, "error", "Failed to remove thumbnails", zap.String("file_id", fileID), zap.Error(err))
+	}
+	if err := removeRenditions(h.db, fileID); err != nil {
+		h.logRequest(ctx, "error", "Failed to remove renditions", zap.String("file_id", fileID), zap.Error(err))
+	}
+}
@@ -0,0 +1,732 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"file-upload-service/models"
+)
+
+func TestListFilesTruncatesAtMaxSyncRows(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.MaxSyncRows = 2
+	bucketID := env.createBucket("photos")
+	for i := 0; i < 5; i++ {
+		env.putFile(bucketID, fmt.Sprintf("docs/%d.txt", i), []byte("x"))
+	}
+
+	var keys []string
+	cursor := ""
+	for page := 0; page < 5; page++ {
+		w := env.serve(env.files.ListFiles, newRequest(http.MethodGet, "/buckets/1/files?path=docs&cursor="+cursor, nil),
+			map[string]string{"id": strconv.Itoa(bucketID)})
+		expectStatus(t, w, http.StatusOK)
+
+		var resp models.ListFilesResponse
+		decode(t, w, &resp)
+		if len(resp.Items) > env.cfg.MaxSyncRows {
+			t.Fatalf("page %d has %d files, more than MaxSyncRows", page, len(resp.Items))
+		}
+		for _, f := range resp.Items {
+			keys = append(keys, f.Key)
+		}
+		if !resp.Truncated {
+			break
+		}
+		cursor = resp.NextCursor
+	}
+
+	if len(keys) != 5 {
+		t.Fatalf("listed %v, want all 5 keys across pages", keys)
+	}
+	for i, key := range keys {
+		if want := fmt.Sprintf("docs/%d.txt", i); key != want {
+			t.Fatalf("key %d = %q, want %q", i, key, want)
+		}
+	}
+}
+
+func TestDeleteFilesByIDsOverMaxSyncRows(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.MaxSyncRows = 2
+	bucketID := env.createBucket("photos")
+	ids := []string{
+		env.putFile(bucketID, "a.txt", []byte("a")),
+		env.putFile(bucketID, "b.txt", []byte("b")),
+		env.putFile(bucketID, "c.txt", []byte("c")),
+	}
+
+	w := env.serve(env.files.DeleteFiles, newRequest(http.MethodDelete, "/files", models.DeleteFilesRequest{FileIDs: ids}), nil)
+	expectStatus(t, w, http.StatusRequestEntityTooLarge)
+
+	var live int
+	if err := env.db.Get(&live, "SELECT COUNT(*) FROM files WHERE deleted_at IS NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if live != 3 {
+		t.Fatalf("%d live files after a refused delete, want 3", live)
+	}
+}
+
+func TestDeleteFilesByPathUnderMaxSyncRows(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	id := env.putFile(bucketID, "docs/a.txt", []byte("a"))
+	kept := env.putFile(bucketID, "other/b.txt", []byte("b"))
+
+	path := "docs"
+	w := env.serve(env.files.DeleteFiles, newRequest(http.MethodDelete, "/files",
+		models.DeleteFilesRequest{BucketID: &bucketID, Path: &path}), nil)
+	expectStatus(t, w, http.StatusOK)
+
+	var resp models.DeleteFilesResponse
+	decode(t, w, &resp)
+	if len(resp.Deleted) != 1 || resp.Deleted[0] != id {
+		t.Fatalf("deleted %v, want [%s]", resp.Deleted, id)
+	}
+	if _, err := os.Stat(env.diskPath(bucketID, "other/b.txt")); err != nil {
+		t.Fatalf("file %s outside the path was touched: %v", kept, err)
+	}
+}
+
+func TestDeleteFilesByPathOverMaxSyncRowsQueuesJob(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.MaxSyncRows = 2
+	bucketID := env.createBucket("photos")
+	for i := 0; i < 7; i++ {
+		env.putFile(bucketID, fmt.Sprintf("docs/%d.txt", i), []byte("x"))
+	}
+	env.putFile(bucketID, "keep/a.txt", []byte("x"))
+
+	path := "docs"
+	w := env.serve(env.files.DeleteFiles, newRequest(http.MethodDelete, "/files",
+		models.DeleteFilesRequest{BucketID: &bucketID, Path: &path}), nil)
+	expectStatus(t, w, http.StatusAccepted)
+
+	var job models.DeleteJob
+	decode(t, w, &job)
+	if job.ID == "" || job.Matched != 7 {
+		t.Fatalf("job = %+v, want an id and 7 matched files", job)
+	}
+	if got, want := w.Header().Get("Location"), "/files/delete-jobs/"+job.ID; got != want {
+		t.Fatalf("Location = %q, want %q", got, want)
+	}
+
+	eventually(t, func() bool {
+		w := env.serve(env.files.GetDeleteJob, newRequest(http.MethodGet, "/files/delete-jobs/"+job.ID, nil),
+			map[string]string{"id": job.ID})
+		expectStatus(t, w, http.StatusOK)
+		decode(t, w, &job)
+		return job.Status == models.DeleteJobStatusCompleted || job.Status == models.DeleteJobStatusFailed
+	})
+	if job.Status != models.DeleteJobStatusCompleted || job.Deleted != 7 || job.FinishedAt == nil {
+		t.Fatalf("job = %+v, want completed with 7 deleted", job)
+	}
+
+	var live []string
+	if err := env.db.Select(&live, "SELECT key FROM files WHERE deleted_at IS NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 1 || live[0] != "keep/a.txt" {
+		t.Fatalf("live files after the job = %v, want only keep/a.txt", live)
+	}
+}
+
+func TestGetDeleteJobOfAnotherClient(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.db.MustExec(
+		"INSERT INTO delete_jobs (id, client_id, bucket_id, path, status, created_at, updated_at) VALUES ('job-1', 'client_other', ?, 'docs', 'queued', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)",
+		bucketID,
+	)
+
+	w := env.serve(env.files.GetDeleteJob, newRequest(http.MethodGet, "/files/delete-jobs/job-1", nil),
+		map[string]string{"id": "job-1"})
+	expectStatus(t, w, http.StatusNotFound)
+}
+
+func TestListFilesRejectsCursorOfAnotherListing(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.MaxSyncRows = 1
+	bucketID := env.createBucket("photos")
+	otherID := env.createBucket("videos")
+	for _, key := range []string{"docs/a.txt", "docs/b.txt", "other/c.txt"} {
+		env.putFile(bucketID, key, []byte("x"))
+	}
+
+	w := env.serve(env.files.ListFiles, newRequest(http.MethodGet, "/buckets/1/files?path=docs", nil),
+		map[string]string{"id": strconv.Itoa(bucketID)})
+	expectStatus(t, w, http.StatusOK)
+	var resp models.ListFilesResponse
+	decode(t, w, &resp)
+	if !resp.Truncated || resp.NextCursor == "" {
+		t.Fatalf("first page = %+v, want a cursor to the next page", resp.Page)
+	}
+
+	for name, tc := range map[string]struct {
+		bucketID int
+		query    string
+	}{
+		"other path":      {bucketID, "path=other&cursor=" + resp.NextCursor},
+		"other bucket":    {otherID, "path=docs&cursor=" + resp.NextCursor},
+		"tampered cursor": {bucketID, "path=docs&cursor=x" + resp.NextCursor},
+	} {
+		w := env.serve(env.files.ListFiles, newRequest(http.MethodGet, "/buckets/1/files?"+tc.query, nil),
+			map[string]string{"id": strconv.Itoa(tc.bucketID)})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d; body: %s", name, w.Code, http.StatusBadRequest, w.Body.String())
+		}
+	}
+}
+
+// downloadTarget issues a download URL for a file and returns its path and query
+func (e *testEnv) downloadTarget(fileID string) string {
+	e.t.Helper()
+	return e.downloadTargetFor(models.GenerateDownloadSignedURLRequest{FileID: fileID})
+}
+
+// downloadTargetFor issues a download URL as requested and returns its path and query
+func (e *testEnv) downloadTargetFor(req models.GenerateDownloadSignedURLRequest) string {
+	e.t.Helper()
+	w := e.serve(e.files.GenerateDownloadSignedURL, newRequest(http.MethodPost, "/files/download-url", req), nil)
+	expectStatus(e.t, w, http.StatusCreated)
+
+	var resp models.SignedURLResponse
+	decode(e.t, w, &resp)
+	return signedURLTarget(resp.SignedURL)
+}
+
+func TestUploadToBucketArchivedAfterURLIssued(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, "docs/a.txt", 64)), nil)
+	expectStatus(t, w, http.StatusCreated)
+	var signed models.SignedURLResponse
+	decode(t, w, &signed)
+
+	env.db.MustExec("UPDATE buckets SET archived = 1 WHERE id = ?", bucketID)
+
+	w = serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, []byte("content")), nil)
+	expectStatus(t, w, http.StatusConflict)
+	if _, err := os.Stat(env.diskPath(bucketID, "docs/a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("content was written for a refused upload: %v", err)
+	}
+}
+
+func TestUploadToFileDeletedAfterURLIssued(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, "docs/a.txt", 64)), nil)
+	expectStatus(t, w, http.StatusCreated)
+	var signed models.SignedURLResponse
+	decode(t, w, &signed)
+
+	env.db.MustExec("UPDATE files SET status = ?, deleted_at = CURRENT_TIMESTAMP WHERE id = ?", models.FileStatusDeleted, signed.FileID)
+
+	w = serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, []byte("content")), nil)
+	expectStatus(t, w, http.StatusConflict)
+}
+
+func TestDownloadAfterBucketArchivedOrFileDeleted(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	archivedID := env.putFile(bucketID, "docs/a.txt", []byte("a"))
+	deletedID := env.putFile(bucketID, "docs/b.txt", []byte("b"))
+
+	archived := env.downloadTarget(archivedID)
+	deleted := env.downloadTarget(deletedID)
+	env.db.MustExec("UPDATE files SET status = ?, deleted_at = CURRENT_TIMESTAMP WHERE id = ?", models.FileStatusDeleted, deletedID)
+
+	w := serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, deleted, nil), nil)
+	expectStatus(t, w, http.StatusConflict)
+
+	env.db.MustExec("UPDATE buckets SET archived = 1 WHERE id = ?", bucketID)
+	w = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, archived, nil), nil)
+	expectStatus(t, w, http.StatusConflict)
+
+	// The refused URL was not used up, so it works once the bucket is unarchived
+	env.db.MustExec("UPDATE buckets SET archived = 0 WHERE id = ?", bucketID)
+	w = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, archived, nil), nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Body.String(); got != "a" {
+		t.Fatalf("downloaded %q, want %q", got, "a")
+	}
+}
+
+func TestUploadsRefusedWithoutDiskSpace(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.UploadDiskReserve = math.MaxInt64
+	bucketID := env.createBucket("photos")
+
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, "docs/signed.txt", 64)), nil)
+	expectStatus(t, w, http.StatusInsufficientStorage)
+
+	w = env.serve(env.files.DirectUpload, directUploadRequest(map[string]string{
+		"bucket_id":         strconv.Itoa(bucketID),
+		"key":               "docs/direct.txt",
+		"mimetype":          "text/plain",
+		"owner_entity_type": "user",
+		"owner_entity_id":   "user-1",
+	}, []byte("content")), nil)
+	expectStatus(t, w, http.StatusInsufficientStorage)
+
+	w = env.serve(env.files.InlineUpload, newRequest(http.MethodPost, "/files/inline", models.InlineUploadRequest{
+		BucketID:        bucketID,
+		Key:             "docs/inline.txt",
+		FileName:        "inline.txt",
+		Mimetype:        "text/plain",
+		OwnerEntityType: "user",
+		OwnerEntityID:   "user-1",
+		Content:         base64.StdEncoding.EncodeToString([]byte("content")),
+	}), nil)
+	expectStatus(t, w, http.StatusInsufficientStorage)
+
+	var rows int
+	if err := env.db.Get(&rows, "SELECT COUNT(*) FROM files"); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Fatalf("%d file rows after refused uploads, want none", rows)
+	}
+	if _, err := os.Stat(env.diskPath(bucketID, "docs")); !os.IsNotExist(err) {
+		t.Fatalf("refused uploads wrote to the bucket: %v", err)
+	}
+}
+
+func TestZeroByteFileUploadDownloadAndServe(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.db.MustExec(`UPDATE buckets SET public_paths = '["pub/*"]' WHERE id = ?`, bucketID)
+
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, "pub/empty.txt", 1)), nil)
+	expectStatus(t, w, http.StatusCreated)
+	var signed models.SignedURLResponse
+	decode(t, w, &signed)
+	w = serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, nil), nil)
+	expectStatus(t, w, http.StatusOK)
+
+	var size int64
+	if err := env.db.Get(&size, "SELECT file_size FROM files WHERE id = ?", signed.FileID); err != nil {
+		t.Fatal(err)
+	}
+	if size != 0 {
+		t.Fatalf("file_size = %d, want 0", size)
+	}
+	if info, err := os.Stat(env.diskPath(bucketID, "pub/empty.txt")); err != nil || info.Size() != 0 {
+		t.Fatalf("stored file = %v, %v; want an empty file", info, err)
+	}
+
+	target := env.downloadTargetFor(models.GenerateDownloadSignedURLRequest{FileID: signed.FileID, MaxUses: 2})
+	w = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, target, nil), nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Content-Length"); got != "0" || w.Body.Len() != 0 {
+		t.Fatalf("download Content-Length = %q with %d body bytes, want 0 and none", got, w.Body.Len())
+	}
+
+	r := newRequest(http.MethodGet, target, nil)
+	r.Header.Set("Range", "bytes=0-")
+	w = serveAnonymous(env.files.DownloadFile, r, nil)
+	expectStatus(t, w, http.StatusRequestedRangeNotSatisfiable)
+	if got := w.Header().Get("Content-Range"); got != "bytes */0" {
+		t.Fatalf("Content-Range = %q, want %q", got, "bytes */0")
+	}
+
+	w = serveAnonymous(env.public.ServePublicFile, newRequest(http.MethodGet, "/files/photos/pub/empty.txt", nil),
+		map[string]string{"bucket_name": "photos", "file_path": "pub/empty.txt"})
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Content-Length"); got != "0" || w.Body.Len() != 0 {
+		t.Fatalf("public Content-Length = %q with %d body bytes, want 0 and none", got, w.Body.Len())
+	}
+}
+
+func TestHeadDownloadKeepsTheUse(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+
+	content := []byte("content")
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, "docs/a.txt", int64(len(content)))), nil)
+	expectStatus(t, w, http.StatusCreated)
+	var signed models.SignedURLResponse
+	decode(t, w, &signed)
+	w = serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, content), nil)
+	expectStatus(t, w, http.StatusOK)
+	target := env.downloadTarget(signed.FileID)
+
+	for i := 0; i < 2; i++ {
+		w = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodHead, target, nil), nil)
+		expectStatus(t, w, http.StatusOK)
+		if w.Body.Len() != 0 {
+			t.Fatalf("HEAD sent %d body bytes", w.Body.Len())
+		}
+		for header, want := range map[string]string{
+			"Content-Length":      strconv.Itoa(len(content)),
+			"Content-Type":        "text/plain",
+			"Content-Disposition": `attachment; filename="a.txt"; filename*=UTF-8''a.txt`,
+			"Accept-Ranges":       "bytes",
+		} {
+			if got := w.Header().Get(header); got != want {
+				t.Fatalf("HEAD %s = %q, want %q", header, got, want)
+			}
+		}
+		if w.Header().Get(checksumHeader) == "" || w.Header().Get("Last-Modified") == "" {
+			t.Fatalf("HEAD headers = %v, want the checksum and Last-Modified", w.Header())
+		}
+	}
+
+	var redemptions int
+	if err := env.db.Get(&redemptions, "SELECT COUNT(*) FROM download_redemptions WHERE file_id = ?", signed.FileID); err != nil {
+		t.Fatal(err)
+	}
+	if redemptions != 0 {
+		t.Fatalf("%d redemptions recorded for HEAD requests, want 0", redemptions)
+	}
+
+	w = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, target, nil), nil)
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != string(content) {
+		t.Fatalf("download after HEAD returned %q", w.Body.String())
+	}
+
+	// A HEAD needs a use to be left, like the GET it stands in for
+	w = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodHead, target, nil), nil)
+	expectStatus(t, w, http.StatusUnauthorized)
+}
+
+func TestUploadLargerThanDeclaredIs413(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+
+	for key, content := range map[string][]byte{
+		"docs/one-byte-over.txt": []byte("0123456789!"),
+		"docs/past-framing.txt":  bytes.Repeat([]byte("a"), multipartOverhead+1024),
+	} {
+		signed := env.signedUpload(signedURLRequest(bucketID, key, 10))
+		w := serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, content), nil)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("%s: status = %d, want 413; body: %s", key, w.Code, w.Body.String())
+		}
+		if _, err := os.Stat(env.diskPath(bucketID, key)); !os.IsNotExist(err) {
+			t.Fatalf("%s: file stored at the key after a 413: %v", key, err)
+		}
+		if leftovers, _ := filepath.Glob(env.diskPath(bucketID, key) + ".tmp-*"); len(leftovers) != 0 {
+			t.Fatalf("%s: staged leftovers %v", key, leftovers)
+		}
+
+		// The refused upload gave its use back, so the right file still goes through
+		w = serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, []byte("0123456789")), nil)
+		expectStatus(t, w, http.StatusOK)
+	}
+}
+
+func TestUploadShorterThanDeclared(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+
+	signed := env.signedUpload(signedURLRequest(bucketID, "docs/a.txt", 100))
+	w := serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, []byte("hello\n")), nil)
+	expectStatus(t, w, http.StatusOK)
+	var resp struct {
+		FileSize         int64 `json:"file_size"`
+		SizeMismatch     bool  `json:"size_mismatch"`
+		DeclaredFileSize int64 `json:"declared_file_size"`
+	}
+	decode(t, w, &resp)
+	if resp.FileSize != 6 || !resp.SizeMismatch || resp.DeclaredFileSize != 100 {
+		t.Fatalf("response = %+v, want 6 bytes flagged against the declared 100", resp)
+	}
+	var size int64
+	if err := env.db.Get(&size, "SELECT file_size FROM files WHERE id = ?", signed.FileID); err != nil {
+		t.Fatal(err)
+	}
+	if size != 6 {
+		t.Fatalf("file_size = %d, want the 6 bytes written", size)
+	}
+
+	// A strict bucket refuses the short body and keeps the token's use
+	strict := env.createBucket("strict")
+	env.db.MustExec("UPDATE buckets SET strict_file_size = 1 WHERE id = ?", strict)
+	signed = env.signedUpload(signedURLRequest(strict, "docs/a.txt", 100))
+	w = serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, []byte("hello\n")), nil)
+	expectStatus(t, w, http.StatusUnprocessableEntity)
+	w = serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, bytes.Repeat([]byte("a"), 100)), nil)
+	expectStatus(t, w, http.StatusOK)
+}
+
+// directUpload sends content to a key of a bucket in one direct upload
+func (e *testEnv) directUpload(bucketID int, key string, content []byte) *httptest.ResponseRecorder {
+	return e.serve(e.files.DirectUpload, directUploadRequest(map[string]string{
+		"bucket_id":         strconv.Itoa(bucketID),
+		"key":               key,
+		"mimetype":          "text/plain",
+		"owner_entity_type": "user",
+		"owner_entity_id":   "user-1",
+	}, content), nil)
+}
+
+func TestDirectUploadRoundTrip(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+
+	w := env.directUpload(bucketID, "docs/small.txt", []byte("small file\n"))
+	expectStatus(t, w, http.StatusCreated)
+	var resp struct {
+		FileID   string `json:"file_id"`
+		FileSize int64  `json:"file_size"`
+		Key      string `json:"key"`
+	}
+	decode(t, w, &resp)
+	if resp.FileSize != 11 || resp.Key != "docs/small.txt" {
+		t.Fatalf("response = %+v, want 11 bytes at docs/small.txt", resp)
+	}
+
+	var stored struct {
+		Status   string `db:"status"`
+		FileSize int64  `db:"file_size"`
+	}
+	if err := env.db.Get(&stored, "SELECT status, file_size FROM files WHERE id = ?", resp.FileID); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != models.FileStatusUploaded || stored.FileSize != 11 {
+		t.Fatalf("stored row has status %q and size %d, want an uploaded file of 11 bytes", stored.Status, stored.FileSize)
+	}
+
+	w = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, env.downloadTarget(resp.FileID), nil), nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Body.String(); got != "small file\n" {
+		t.Fatalf("downloaded %q, want %q", got, "small file\n")
+	}
+}
+
+func TestDirectUploadTooLargePointsToSignedURL(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.DirectUploadMaxBytes = 16
+	bucketID := env.createBucket("photos")
+
+	w := env.directUpload(bucketID, "docs/exact.txt", bytes.Repeat([]byte("a"), 16))
+	expectStatus(t, w, http.StatusCreated)
+
+	w = env.directUpload(bucketID, "docs/large.txt", bytes.Repeat([]byte("a"), 17))
+	expectStatus(t, w, http.StatusRequestEntityTooLarge)
+	if body := w.Body.String(); !strings.Contains(body, "POST /files/signed-url") {
+		t.Fatalf("oversize error %s does not point to the signed URL flow", body)
+	}
+	if _, err := os.Stat(env.diskPath(bucketID, "docs/large.txt")); !os.IsNotExist(err) {
+		t.Fatalf("oversize upload was stored: %v", err)
+	}
+	var rows int
+	if err := env.db.Get(&rows, "SELECT COUNT(*) FROM files WHERE key = ?", "docs/large.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Fatalf("%d rows for the oversize upload, want none", rows)
+	}
+}
+
+func TestDirectUploadQuotas(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.putFile(bucketID, "docs/held.txt", []byte("123456"))
+
+	// The bucket's limit counts the file it holds
+	env.db.MustExec("UPDATE buckets SET max_total_bytes = 10 WHERE id = ?", bucketID)
+	w := env.directUpload(bucketID, "docs/over.txt", []byte("12345"))
+	expectStatus(t, w, http.StatusForbidden)
+	var bucketErr models.BucketQuotaExceededError
+	decode(t, w, &bucketErr)
+	if bucketErr.UsedBytes != 6 || bucketErr.RequestedBytes != 5 || bucketErr.MaxTotalBytes != 10 {
+		t.Fatalf("bucket refusal = %+v, want 6 used, 5 requested of 10", bucketErr)
+	}
+	w = env.directUpload(bucketID, "docs/fits.txt", []byte("1234"))
+	expectStatus(t, w, http.StatusCreated)
+
+	// The owner's quota applies across buckets
+	env.db.MustExec("UPDATE buckets SET max_total_bytes = 0 WHERE id = ?", bucketID)
+	env.db.MustExec(
+		"INSERT INTO owner_quotas (client_id, owner_entity_type, owner_entity_id, max_bytes, created_at, updated_at) VALUES (?, 'user', 'user-1', 12, ?, ?)",
+		env.clientID, time.Now(), time.Now(),
+	)
+	otherID := env.createBucket("other")
+	w = env.directUpload(otherID, "docs/over.txt", []byte("123"))
+	expectStatus(t, w, http.StatusForbidden)
+	var ownerErr models.OwnerQuotaExceededError
+	decode(t, w, &ownerErr)
+	if ownerErr.UsedBytes != 10 || ownerErr.RequestedBytes != 3 || ownerErr.LimitBytes != 12 {
+		t.Fatalf("owner refusal = %+v, want 10 used, 3 requested of 12", ownerErr)
+	}
+	w = env.directUpload(otherID, "docs/fits.txt", []byte("12"))
+	expectStatus(t, w, http.StatusCreated)
+
+	var rows int
+	if err := env.db.Get(&rows, "SELECT COUNT(*) FROM files WHERE key = ?", "docs/over.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Fatalf("%d rows for refused uploads, want none", rows)
+	}
+}
+
+func TestMultiUseUploadTokenCountsDown(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	req := signedURLRequest(bucketID, "docs/a.txt", 64)
+	req.MaxUses = 3
+	signed := env.signedUpload(req)
+
+	// A failed upload gives its use back
+	w := serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, pngBytes), nil)
+	expectStatus(t, w, http.StatusUnprocessableEntity)
+
+	for _, want := range []int{2, 1, 0} {
+		w = serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, []byte("content")), nil)
+		expectStatus(t, w, http.StatusOK)
+		var resp struct {
+			RemainingUses int `json:"remaining_uses"`
+		}
+		decode(t, w, &resp)
+		if resp.RemainingUses != want {
+			t.Fatalf("remaining_uses = %d, want %d", resp.RemainingUses, want)
+		}
+	}
+
+	w = serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, []byte("content")), nil)
+	expectStatus(t, w, http.StatusUnauthorized)
+	if _, ok, _ := env.files.uses.Claim(signed.FileID); ok {
+		t.Fatal("the exhausted token still has a use to claim")
+	}
+}
+
+func TestConcurrentUploadsStayWithinMaxUses(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	req := signedURLRequest(bucketID, "docs/a.txt", 64)
+	req.MaxUses = 1
+	signed := env.signedUpload(req)
+
+	const requests = 20
+	codes := make([]int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, []byte("upload "+strconv.Itoa(i))), nil).Code
+		}(i)
+	}
+	wg.Wait()
+
+	uploaded := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			uploaded++
+		case http.StatusUnauthorized:
+		default:
+			t.Fatalf("unexpected status %d; statuses %v", code, codes)
+		}
+	}
+	if uploaded != 1 {
+		t.Fatalf("%d uploads succeeded with a single-use token, want 1", uploaded)
+	}
+	if n := env.rowsFor("files", "bucket_id", strconv.Itoa(bucketID)); n != 1 {
+		t.Fatalf("%d file rows, want the one upload", n)
+	}
+}
+
+// uploadTokenInfo asks what the token of a signed upload URL allows
+func (e *testEnv) uploadTokenInfo(signedURL string) *httptest.ResponseRecorder {
+	token := signedURL[strings.Index(signedURL, "token=")+len("token="):]
+	return serveAnonymous(e.files.UploadTokenInfo, newRequest(http.MethodGet, "/files/upload/info?token="+token, nil), nil)
+}
+
+func TestUploadTokenInfoDescribesTheUpload(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	req := signedURLRequest(bucketID, "invoices/2024/invoice.pdf", 4096)
+	req.Mimetype = "application/pdf"
+	signed := env.signedUpload(req)
+
+	w := env.uploadTokenInfo(signed.SignedURL)
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Fatalf("Cache-Control = %q, want no-store", got)
+	}
+	var info map[string]interface{}
+	decode(t, w, &info)
+	if info["file_name"] != "invoice.pdf" || info["max_size"] != float64(4096) || info["mimetype"] != "application/pdf" {
+		t.Fatalf("info = %v, want the file name, size and mimetype of the request", info)
+	}
+	if expiresAt, err := time.Parse(time.RFC3339, fmt.Sprint(info["expires_at"])); err != nil || !expiresAt.Equal(signed.ExpiresAt) {
+		t.Fatalf("expires_at = %v (%v), want %v", info["expires_at"], err, signed.ExpiresAt)
+	}
+	for _, field := range []string{"key_prefix", "files_remaining", "bytes_remaining"} {
+		if _, ok := info[field]; ok {
+			t.Fatalf("info of a single-file token has %s", field)
+		}
+	}
+
+	// Nothing tells the holder whose upload it is or where it is stored
+	body := w.Body.String()
+	for _, hidden := range []string{env.clientID, env.clientName, env.bucketName(bucketID), "invoices/2024", "uploads", signed.FileID} {
+		if strings.Contains(body, hidden) {
+			t.Fatalf("info exposes %q: %s", hidden, body)
+		}
+	}
+
+	// Reading the info leaves the token usable
+	w = serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, []byte("%PDF-1.4\n")), nil)
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestUploadTokenInfoOfPrefixToken(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	signed := env.signedUpload(models.CreateSignedURLRequest{
+		BucketID:        bucketID,
+		KeyPrefix:       "inbox",
+		MaxFiles:        3,
+		MaxTotalBytes:   1000,
+		FileSize:        500,
+		OwnerEntityType: "user",
+		OwnerEntityID:   "user-1",
+	})
+
+	w := env.uploadTokenInfo(signed.SignedURL)
+	expectStatus(t, w, http.StatusOK)
+	var info models.UploadTokenInfo
+	decode(t, w, &info)
+	if info.KeyPrefix != signed.KeyPrefix || info.MaxSize != 500 || info.FilesRemaining == nil || *info.FilesRemaining != 3 ||
+		info.BytesRemaining == nil || *info.BytesRemaining != 1000 {
+		t.Fatalf("info = %+v, want 3 files and 1000 bytes left under %s", info, signed.KeyPrefix)
+	}
+}
+
+func TestUploadTokenInfoUnknownOrExpired(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.SignedURLMinTTL = time.Second
+	bucketID := env.createBucket("photos")
+
+	w := serveAnonymous(env.files.UploadTokenInfo, newRequest(http.MethodGet, "/files/upload/info?token=unknown", nil), nil)
+	expectStatus(t, w, http.StatusUnauthorized)
+
+	expiresIn := 1
+	req := signedURLRequest(bucketID, "docs/a.txt", 64)
+	req.ExpiresInSeconds = &expiresIn
+	signed := env.signedUpload(req)
+	expectStatus(t, env.uploadTokenInfo(signed.SignedURL), http.StatusOK)
+	eventually(t, func() bool {
+		return env.uploadTokenInfo(signed.SignedURL).Code == http.StatusUnauthorized
+	})
+}
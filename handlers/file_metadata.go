@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// fileMetaHeaderPrefix prefixes each custom metadata pair when it travels as an HTTP header
+const fileMetaHeaderPrefix = "X-File-Meta-"
+
+// maxFileMetadataBytes caps the combined size of a file's metadata keys and values
+const maxFileMetadataBytes = 2048
+
+// maxFileMetadataKeyLength caps the length of a single metadata key
+const maxFileMetadataKeyLength = 128
+
+// normalizeFileMetadata validates custom metadata and lowercases its keys. Keys may only
+// hold letters, digits and hyphens so they are valid header names, and values may not hold
+// control characters so they cannot break out of a header line. Keys differing only in
+// case are rejected because headers are case-insensitive.
+func normalizeFileMetadata(metadata map[string]string) (map[string]string, error) {
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+
+	normalized := make(map[string]string, len(metadata))
+	size := 0
+	for key, value := range metadata {
+		if key == "" || len(key) > maxFileMetadataKeyLength {
+			return nil, fmt.Errorf("metadata keys must be 1 to %d characters long", maxFileMetadataKeyLength)
+		}
+		for _, c := range key {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return nil, fmt.Errorf("metadata key %q may only contain letters, digits and hyphens", key)
+			}
+		}
+		for _, c := range value {
+			if c < 0x20 || c == 0x7f {
+				return nil, fmt.Errorf("metadata value of %q contains control characters", key)
+			}
+		}
+
+		lower := strings.ToLower(key)
+		if _, ok := normalized[lower]; ok {
+			return nil, fmt.Errorf("metadata key %q is given more than once (keys are case-insensitive)", lower)
+		}
+		normalized[lower] = value
+		size += len(lower) + len(value)
+	}
+	if size > maxFileMetadataBytes {
+		return nil, fmt.Errorf("metadata cannot exceed %d bytes of keys and values", maxFileMetadataBytes)
+	}
+	return normalized, nil
+}
+
+// encodeFileMetadata serializes metadata for the files.metadata column
+func encodeFileMetadata(metadata map[string]string) string {
+	if len(metadata) == 0 {
+		return "{}"
+	}
+	encoded, _ := json.Marshal(metadata)
+	return string(encoded)
+}
+
+// decodeFileMetadata parses the files.metadata column; nil when the file has none
+func decodeFileMetadata(raw string) map[string]string {
+	var metadata map[string]string
+	if err := json.Unmarshal([]byte(raw), &metadata); err != nil || len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
+
+// metadataFromHeaders collects X-File-Meta-* request headers into a metadata map
+func metadataFromHeaders(header http.Header) map[string]string {
+	var metadata map[string]string
+	for name, values := range header {
+		if !strings.HasPrefix(name, fileMetaHeaderPrefix) || len(values) == 0 {
+			continue
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[strings.TrimPrefix(name, fileMetaHeaderPrefix)] = values[0]
+	}
+	return metadata
+}
+
+// setFileMetaHeaders emits a file's metadata as X-File-Meta-* response headers
+func setFileMetaHeaders(w http.ResponseWriter, metadata map[string]string) {
+	for key, value := range metadata {
+		w.Header().Set(fileMetaHeaderPrefix+key, value)
+	}
+}
@@ -0,0 +1,425 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// maxLegalBasisLength caps the legal basis note recorded with a purge
+const maxLegalBasisLength = 1024
+
+// wipeChunkSize is how many zero bytes a secure wipe writes at a time
+const wipeChunkSize = 64 * 1024
+
+// purgeFile is an open file a secure wipe overwrites
+type purgeFile interface {
+	io.Writer
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Close() error
+}
+
+// purgeFS is the file system purges remove bytes through. It is kept behind an interface
+// so the secure wipe path can be exercised without inspecting real disk blocks.
+type purgeFS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (purgeFile, error)
+	Remove(name string) error
+}
+
+// osPurgeFS is the purgeFS backed by the os package
+type osPurgeFS struct{}
+
+func (osPurgeFS) OpenFile(name string, flag int, perm os.FileMode) (purgeFile, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osPurgeFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// secureWipe overwrites every byte of a file with zeros and syncs it to disk. Snapshot
+// copies made in hardlink mode share the bytes, so they are wiped along with it.
+func secureWipe(fsys purgeFS, path string) error {
+	f, err := fsys.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		zeros := make([]byte, wipeChunkSize)
+		for remaining := info.Size(); remaining > 0 && err == nil; {
+			n := int64(len(zeros))
+			if remaining < n {
+				n = remaining
+			}
+			_, err = f.Write(zeros[:n])
+			remaining -= n
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// purgeTarget is a file row selected for purging, with where its bytes may be stored
+type purgeTarget struct {
+	ID            string
+	ClientID      string
+	BucketID      int
+	Status        string
+	Staged        bool
+	CreatedAt     sql.NullTime
+	DeletedAt     sql.NullTime
+	UploadPath    string
+	StagingPath   string
+	SnapshotPaths []string
+	VersionPaths  []string
+	// ThumbnailPaths are the file's thumbnails no other file's rows share
+	ThumbnailPaths []string
+	// SharedBlobs are storage object blobs other files of a dedupe bucket share with this
+	// one; copies linked to them are unlinked but never wiped
+	SharedBlobs []string
+}
+
+// paths lists every copy of the file's bytes, the live one first, then its thumbnails
+func (t *purgeTarget) paths() []string {
+	paths := make([]string, 0, len(t.SnapshotPaths)+len(t.VersionPaths)+len(t.ThumbnailPaths)+1)
+	if t.UploadPath != "" {
+		paths = append(paths, t.UploadPath)
+	}
+	if t.StagingPath != "" {
+		paths = append(paths, t.StagingPath)
+	}
+	paths = append(paths, t.SnapshotPaths...)
+	paths = append(paths, t.VersionPaths...)
+	return append(paths, t.ThumbnailPaths...)
+}
+
+// visible reports whether the file is listed, and so known to change feed clients
+func (t *purgeTarget) visible() bool {
+	return t.Status == models.FileStatusUploaded && !t.Staged
+}
+
+// PurgeFiles handles POST /files/purge - permanently erase files by IDs or by owner entity.
+// Unlike DELETE /files, which keeps the row, purging removes the bytes everywhere they are
+// kept and every row mentioning the file, leaving only an erasure tombstone.
+func (h *FileHandler) PurgeFiles(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req models.PurgeFilesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+
+	hasFileIDs := len(req.FileIDs) > 0
+	hasOwner := req.OwnerEntityType != "" || req.OwnerEntityID != ""
+
+	// Validate: exactly one mode
+	if hasFileIDs && hasOwner {
+		h.logRequest(ctx, "error", "Cannot specify both file_ids and owner entity")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("file_ids and owner_entity_type/owner_entity_id cannot be used together"))
+		return
+	}
+	if !hasFileIDs && (req.OwnerEntityType == "" || req.OwnerEntityID == "") {
+		h.logRequest(ctx, "error", "Missing file_ids or owner entity")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Either file_ids or (owner_entity_type and owner_entity_id) is required"))
+		return
+	}
+
+	legalBasis := strings.TrimSpace(req.LegalBasis)
+	if legalBasis == "" {
+		h.logRequest(ctx, "error", "Missing required field: legal_basis")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("legal_basis is required"))
+		return
+	}
+	if len(legalBasis) > maxLegalBasisLength {
+		h.logRequest(ctx, "error", "legal_basis is too long", zap.Int("length", len(legalBasis)))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(fmt.Sprintf("legal_basis cannot exceed %d bytes", maxLegalBasisLength)))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	// Deleted, pending and staged files are purged too; they may still hold personal data
+	condition := "f.client_id = ? AND f.owner_entity_type = ? AND f.owner_entity_id = ?"
+	args := []interface{}{clientID, req.OwnerEntityType, req.OwnerEntityID}
+	requested := len(req.FileIDs)
+	if hasFileIDs {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(req.FileIDs)), ",")
+		condition = fmt.Sprintf("f.client_id = ? AND f.id IN (%s)", placeholders)
+		args = []interface{}{clientID}
+		for _, id := range req.FileIDs {
+			args = append(args, id)
+		}
+	} else if err := h.db.QueryRow("SELECT COUNT(*) FROM files f WHERE "+condition, args...).Scan(&requested); err != nil {
+		h.logRequest(ctx, "error", "Failed to count files by owner entity", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to purge files"))
+		return
+	}
+
+	// Refuse to process more rows than a synchronous request is allowed to handle
+	if requested > h.config.MaxSyncRows {
+		h.logRequest(ctx, "error", "Too many files for synchronous purge",
+			zap.Int("count", requested),
+			zap.Int("max_rows", h.config.MaxSyncRows),
+		)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(errs.AppError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("Cannot purge more than %d files in one request; split the file_ids into smaller batches", h.config.MaxSyncRows),
+		})
+		return
+	}
+
+	h.logRequest(ctx, "info", "Purging files",
+		zap.String("client_id", clientID),
+		zap.Int("count", requested),
+		zap.Bool("secure_wipe", req.SecureWipe),
+	)
+
+	targets, err := h.loadPurgeTargets(condition, args)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query files to purge", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to purge files"))
+		return
+	}
+
+	response := models.PurgeFilesResponse{
+		Purged:  make([]string, 0),
+		Missing: make([]string, 0),
+		Failed:  make([]string, 0),
+	}
+	found := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		found[target.ID] = true
+		if err := h.purgeFile(ctx, target, clientID, legalBasis, req.SecureWipe); err != nil {
+			h.logRequest(ctx, "error", "Failed to purge file", zap.String("file_id", target.ID), zap.Error(err))
+			response.Failed = append(response.Failed, target.ID)
+			continue
+		}
+		response.Purged = append(response.Purged, target.ID)
+	}
+	for _, id := range req.FileIDs {
+		if !found[id] {
+			response.Missing = append(response.Missing, id)
+		}
+	}
+
+	h.logRequest(ctx, "info", "Purged files",
+		zap.String("client_id", clientID),
+		zap.Int("purged", len(response.Purged)),
+		zap.Int("missing", len(response.Missing)),
+		zap.Int("failed", len(response.Failed)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// loadPurgeTargets fetches the files matching condition with every path their bytes may
+// be kept at. A stored path is only used while the row is live: once a file is deleted or
+// superseded, its key may already hold another file's bytes.
+func (h *FileHandler) loadPurgeTargets(condition string, args []interface{}) ([]*purgeTarget, error) {
+	rows, err := h.db.Query(
+		`SELECT f.id, f.client_id, f.bucket_id, f.key, f.status, f.staged, COALESCE(f.upload_group_id, ''),
+		f.created_at, f.deleted_at, c.name, b.name
+		FROM files f
+		JOIN clients c ON f.client_id = c.client_id
+		JOIN buckets b ON f.bucket_id = b.id
+		WHERE `+condition+` ORDER BY f.id`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := make([]*purgeTarget, 0)
+	for rows.Next() {
+		var target purgeTarget
+		var key, groupID, clientName, bucketName string
+		if err := rows.Scan(
+			&target.ID, &target.ClientID, &target.BucketID, &key, &target.Status, &target.Staged, &groupID,
+			&target.CreatedAt, &target.DeletedAt, &clientName, &bucketName,
+		); err != nil {
+			return nil, err
+		}
+		if target.Staged && groupID != "" {
+			target.StagingPath = stagingPath(groupID, target.ID)
+		} else if target.visible() {
+			target.UploadPath = (&snapshotBucket{Name: bucketName, ClientName: clientName}).uploadPath(key)
+		} else if target.Status == models.FileStatusQuarantined {
+			target.UploadPath = quarantinePath(target.ID)
+		}
+		targets = append(targets, &target)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, target := range targets {
+		sharedBlobs, err := sharedObjectBlobs(h.db, target.ID)
+		if err != nil {
+			return nil, err
+		}
+		target.SharedBlobs = sharedBlobs
+		var snapshotIDs []string
+		if err := h.db.Select(&snapshotIDs, "SELECT snapshot_id FROM bucket_snapshot_files WHERE file_id = ?", target.ID); err != nil {
+			return nil, err
+		}
+		for _, snapshotID := range snapshotIDs {
+			target.SnapshotPaths = append(target.SnapshotPaths, snapshotBlobPath(snapshotID, target.ID))
+		}
+		var versionIDs []string
+		if err := h.db.Select(&versionIDs, "SELECT id FROM file_versions WHERE file_id = ? AND delete_marker = 0", target.ID); err != nil {
+			return nil, err
+		}
+		for _, versionID := range versionIDs {
+			target.VersionPaths = append(target.VersionPaths, versionBlobPath(versionID))
+		}
+		if target.ThumbnailPaths, err = exclusiveThumbnailPaths(h.db, target.ID); err != nil {
+			return nil, err
+		}
+	}
+	return targets, nil
+}
+
+// removePurgedBytes wipes (when asked) and unlinks one copy of a purged file's bytes.
+// A copy that is already gone counts as removed.
+func (h *FileHandler) removePurgedBytes(path string, wipe bool) error {
+	if wipe {
+		if err := secureWipe(h.purgeFS, path); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+	}
+	if err := h.purgeFS.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// linkedToAny reports whether path is a hard link to any of the given files
+func linkedToAny(path string, others []string) bool {
+	if len(others) == 0 {
+		return false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	for _, other := range others {
+		if otherInfo, err := os.Stat(other); err == nil && os.SameFile(info, otherInfo) {
+			return true
+		}
+	}
+	return false
+}
+
+// purgeFile erases one file. The bytes go first so a failure leaves the rows in place and
+// the purge can simply be retried; the rows are then replaced by a tombstone and an audit
+// event in one transaction.
+func (h *FileHandler) purgeFile(ctx context.Context, target *purgeTarget, actor, legalBasis string, secureWipe bool) error {
+	paths := target.paths()
+	for _, path := range paths {
+		// Wait for downloads streaming the file, like a regular delete
+		release, _ := h.locks.acquireDelete(path)
+		err := h.removePurgedBytes(path, secureWipe && !linkedToAny(path, target.SharedBlobs))
+		release()
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The file's past events carry its key and name, so they go too. Clients that listed
+	// the file still learn it is gone from a deleted event holding nothing but its ID.
+	if _, err := tx.Exec("DELETE FROM file_events WHERE file_id = ?", target.ID); err != nil {
+		return err
+	}
+	if target.visible() {
+		if _, err := tx.Exec(
+			"INSERT INTO file_events (bucket_id, file_id, event, key, file_name, file_size, mimetype) VALUES (?, ?, ?, '', '', 0, '')",
+			target.BucketID, target.ID, models.FileEventDeleted,
+		); err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{"file_grants", "mimetype_corrections", "upload_reservations", "bucket_snapshot_files", "file_versions", "file_thumbnails", "archive_expansions", "download_redemptions"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE file_id = ?", target.ID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM files WHERE id = ?", target.ID); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.Exec(
+		`INSERT INTO file_tombstones (file_id, client_id, bucket_id, file_created_at, file_deleted_at, secure_wipe, purged_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		target.ID, target.ClientID, target.BucketID, target.CreatedAt, target.DeletedAt, secureWipe, now,
+	); err != nil {
+		return err
+	}
+	if err := recordAuditEvent(tx, models.AuditEvent{
+		Action:   models.AuditActionFilePurged,
+		Actor:    actor,
+		ClientID: target.ClientID,
+		FileID:   target.ID,
+		Detail: map[string]interface{}{
+			"bucket_id":   target.BucketID,
+			"legal_basis": legalBasis,
+			"secure_wipe": secureWipe,
+			"copies":      len(paths),
+		},
+	}, now); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	h.logRequest(ctx, "info", "File purged", zap.String("file_id", target.ID), zap.Bool("secure_wipe", secureWipe))
+	return nil
+}
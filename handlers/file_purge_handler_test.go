@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+
+	"file-upload-service/models"
+)
+
+// recordingPurgeFS is the os-backed purgeFS that records what secure wipes write
+type recordingPurgeFS struct {
+	mu      sync.Mutex
+	zeros   map[string]int64
+	dirty   map[string]bool
+	synced  map[string]bool
+	removed []string
+}
+
+func newRecordingPurgeFS() *recordingPurgeFS {
+	return &recordingPurgeFS{zeros: make(map[string]int64), dirty: make(map[string]bool), synced: make(map[string]bool)}
+}
+
+func (fsys *recordingPurgeFS) OpenFile(name string, flag int, perm os.FileMode) (purgeFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingPurgeFile{File: f, fsys: fsys, name: name}, nil
+}
+
+func (fsys *recordingPurgeFS) Remove(name string) error {
+	fsys.mu.Lock()
+	fsys.removed = append(fsys.removed, name)
+	fsys.mu.Unlock()
+	return os.Remove(name)
+}
+
+// wiped reports how many zero bytes were written to a path and whether they were synced
+func (fsys *recordingPurgeFS) wiped(name string) (int64, bool) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if fsys.dirty[name] {
+		return -1, false
+	}
+	return fsys.zeros[name], fsys.synced[name]
+}
+
+// wasRemoved reports whether a path was unlinked
+func (fsys *recordingPurgeFS) wasRemoved(name string) bool {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	for _, removed := range fsys.removed {
+		if removed == name {
+			return true
+		}
+	}
+	return false
+}
+
+type recordingPurgeFile struct {
+	*os.File
+	fsys *recordingPurgeFS
+	name string
+}
+
+func (f *recordingPurgeFile) Write(p []byte) (int, error) {
+	f.fsys.mu.Lock()
+	if bytes.Count(p, []byte{0}) == len(p) {
+		f.fsys.zeros[f.name] += int64(len(p))
+	} else {
+		f.fsys.dirty[f.name] = true
+	}
+	f.fsys.mu.Unlock()
+	return f.File.Write(p)
+}
+
+func (f *recordingPurgeFile) Sync() error {
+	f.fsys.mu.Lock()
+	f.fsys.synced[f.name] = true
+	f.fsys.mu.Unlock()
+	return f.File.Sync()
+}
+
+// purge erases files by ID
+func (e *testEnv) purge(secureWipe bool, fileIDs ...string) models.PurgeFilesResponse {
+	e.t.Helper()
+	w := e.serve(e.files.PurgeFiles, newRequest(http.MethodPost, "/files/purge",
+		models.PurgeFilesRequest{FileIDs: fileIDs, LegalBasis: "erasure request #42", SecureWipe: secureWipe}), nil)
+	expectStatus(e.t, w, http.StatusOK)
+	var resp models.PurgeFilesResponse
+	decode(e.t, w, &resp)
+	return resp
+}
+
+// rowsFor counts the rows of a table mentioning a file
+func (e *testEnv) rowsFor(table, column, fileID string) int {
+	e.t.Helper()
+	var n int
+	if err := e.db.Get(&n, "SELECT COUNT(*) FROM "+table+" WHERE "+column+" = ?", fileID); err != nil {
+		e.t.Fatal(err)
+	}
+	return n
+}
+
+func TestPurgeRemovesEveryCopyAndRow(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.SnapshotStorage = "copy"
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "docs/a.txt", []byte("personal data"))
+	keep := env.putFile(bucketID, "docs/b.txt", []byte("other data"))
+	env.grantDownload(fileID, env.addClient("partner"), nil)
+	snapshot := env.createSnapshot(bucketID)
+	snapshotCopy := snapshotBlobPath(snapshot.ID, fileID)
+	if _, err := os.Stat(snapshotCopy); err != nil {
+		t.Fatalf("snapshot copy missing before the purge: %v", err)
+	}
+	if env.rowsFor("file_grants", "file_id", fileID) != 1 || env.rowsFor("bucket_snapshot_files", "file_id", fileID) != 1 {
+		t.Fatal("grant and snapshot rows missing before the purge")
+	}
+
+	resp := env.purge(false, fileID, "missing-id")
+	if len(resp.Purged) != 1 || resp.Purged[0] != fileID || len(resp.Missing) != 1 || len(resp.Failed) != 0 {
+		t.Fatalf("purge = %+v, want %s purged and missing-id missing", resp, fileID)
+	}
+
+	for _, path := range []string{env.diskPath(bucketID, "docs/a.txt"), snapshotCopy} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s survived the purge (%v)", path, err)
+		}
+	}
+	for _, table := range []string{"file_grants", "mimetype_corrections", "upload_reservations", "bucket_snapshot_files", "file_versions", "file_thumbnails", "archive_expansions", "download_redemptions"} {
+		if n := env.rowsFor(table, "file_id", fileID); n != 0 {
+			t.Fatalf("%s still has %d rows for the purged file", table, n)
+		}
+	}
+	if n := env.rowsFor("files", "id", fileID); n != 0 {
+		t.Fatal("the file row survived the purge")
+	}
+
+	// Only a deleted event without the key or name is left in the change feed
+	var events []models.FileEvent
+	if err := env.db.Select(&events, "SELECT seq, event, file_id, key, file_name FROM file_events WHERE file_id = ?", fileID); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Event != models.FileEventDeleted || events[0].Key != "" || events[0].FileName != "" {
+		t.Fatalf("events = %+v, want one blank deleted event", events)
+	}
+
+	// The tombstone records the erasure
+	var tombstone struct {
+		ClientID   string `db:"client_id"`
+		BucketID   int    `db:"bucket_id"`
+		SecureWipe bool   `db:"secure_wipe"`
+	}
+	if err := env.db.Get(&tombstone, "SELECT client_id, bucket_id, secure_wipe FROM file_tombstones WHERE file_id = ?", fileID); err != nil {
+		t.Fatalf("no tombstone: %v", err)
+	}
+	if tombstone.ClientID != env.clientID || tombstone.BucketID != bucketID || tombstone.SecureWipe {
+		t.Fatalf("tombstone = %+v", tombstone)
+	}
+	if n := env.rowsFor("audit_events", "file_id", fileID); n != 1 {
+		t.Fatalf("%d audit events for the purge, want 1", n)
+	}
+
+	// Other files are untouched
+	if content, err := os.ReadFile(env.diskPath(bucketID, "docs/b.txt")); err != nil || string(content) != "other data" {
+		t.Fatalf("docs/b.txt holds %q (%v)", content, err)
+	}
+	if n := env.rowsFor("files", "id", keep); n != 1 {
+		t.Fatal("the other file's row was purged")
+	}
+}
+
+func TestPurgeSecureWipeZeroesEveryCopy(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.SnapshotStorage = "copy"
+	fsys := newRecordingPurgeFS()
+	env.files.purgeFS = fsys
+	bucketID := env.createBucket("photos")
+	content := bytes.Repeat([]byte("x"), wipeChunkSize+100)
+	fileID := env.putFile(bucketID, "docs/a.txt", content)
+	snapshot := env.createSnapshot(bucketID)
+
+	resp := env.purge(true, fileID)
+	if len(resp.Purged) != 1 {
+		t.Fatalf("purge = %+v", resp)
+	}
+
+	for _, path := range []string{env.diskPath(bucketID, "docs/a.txt"), snapshotBlobPath(snapshot.ID, fileID)} {
+		zeros, synced := fsys.wiped(path)
+		if zeros != int64(len(content)) || !synced {
+			t.Fatalf("%s: wrote %d zero bytes (synced %v), want %d synced", path, zeros, synced, len(content))
+		}
+		if !fsys.wasRemoved(path) {
+			t.Fatalf("%s was wiped but not unlinked", path)
+		}
+	}
+
+	var secureWipe bool
+	if err := env.db.Get(&secureWipe, "SELECT secure_wipe FROM file_tombstones WHERE file_id = ?", fileID); err != nil || !secureWipe {
+		t.Fatalf("tombstone secure_wipe = %v (%v), want true", secureWipe, err)
+	}
+}
+
+func TestPurgeNeverWipesSharedDedupeBlobs(t *testing.T) {
+	env := newTestEnv(t)
+	fsys := newRecordingPurgeFS()
+	env.files.purgeFS = fsys
+	bucketID := env.createBucket("photos")
+	env.db.MustExec("UPDATE buckets SET dedupe = 1 WHERE id = ?", bucketID)
+
+	content := []byte("shared content")
+	var fileIDs []string
+	for _, key := range []string{"docs/a.txt", "docs/b.txt"} {
+		signed := env.signedUpload(signedURLRequest(bucketID, key, int64(len(content))))
+		expectStatus(t, serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, content), nil), http.StatusOK)
+		fileIDs = append(fileIDs, signed.FileID)
+	}
+	var objectID int64
+	if err := env.db.Get(&objectID, "SELECT storage_object_id FROM files WHERE id = ?", fileIDs[0]); err != nil {
+		t.Fatalf("upload does not reference a storage object: %v", err)
+	}
+
+	resp := env.purge(true, fileIDs[0])
+	if len(resp.Purged) != 1 {
+		t.Fatalf("purge = %+v", resp)
+	}
+
+	path := env.diskPath(bucketID, "docs/a.txt")
+	if zeros, _ := fsys.wiped(path); zeros != 0 {
+		t.Fatalf("wrote %d bytes over a copy linked to a shared blob", zeros)
+	}
+	if !fsys.wasRemoved(path) {
+		t.Fatal("the purged file's link to the shared blob was not removed")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("%s survived the purge (%v)", path, err)
+	}
+	for _, shared := range []string{env.diskPath(bucketID, "docs/b.txt"), objectBlobPath(objectID)} {
+		if got, err := os.ReadFile(shared); err != nil || !bytes.Equal(got, content) {
+			t.Fatalf("%s holds %q (%v), want the shared content", shared, got, err)
+		}
+	}
+}
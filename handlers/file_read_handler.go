@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/gorilla/mux"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// maxReadRangeBytes caps how much of a file a single POST /files/{id}/read may return
+const maxReadRangeBytes = 10 << 20
+
+// ReadFileRange handles POST /files/{id}/read - return part of a file's current content in
+// the response, for tools that only need a header or a tail of a large file. Access is
+// checked as for a download URL: the file's owner or a client holding a download grant.
+// No token is issued; the bytes are served synchronously.
+func (h *FileHandler) ReadFileRange(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	fileID := mux.Vars(r)["id"]
+
+	var req models.ReadFileRangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+	if req.Length <= 0 || req.Length > maxReadRangeBytes {
+		h.logRequest(ctx, "error", "Invalid read length", zap.Int64("length", req.Length))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(fmt.Sprintf("length must be between 1 and %d", maxReadRangeBytes)))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Reading file range",
+		zap.String("file_id", fileID),
+		zap.String("client_id", clientID),
+		zap.Int64("offset", req.Offset),
+		zap.Int64("length", req.Length),
+	)
+
+	var file models.File
+	var clientName string
+	var bucketName string
+	var deletedAt sql.NullTime
+	var scanStatus string
+	var bucketArchived bool
+	var bucketArchiveMode string
+	err := h.db.QueryRow(
+		`SELECT f.id, f.mimetype, f.client_id, f.key, f.status, f.deleted_at, COALESCE(f.scan_status, ''), c.name, b.name, b.archived, COALESCE(b.archive_mode, '')
+		 FROM files f
+		 JOIN clients c ON f.client_id = c.client_id
+		 JOIN buckets b ON f.bucket_id = b.id
+		 WHERE f.id = ? AND f.staged = 0`,
+		fileID,
+	).Scan(&file.ID, &file.Mimetype, &file.ClientID, &file.Key, &file.Status, &deletedAt, &scanStatus, &clientName, &bucketName, &bucketArchived, &bucketArchiveMode)
+	if err != nil {
+		h.logRequest(ctx, "info", "File not found", zap.String("file_id", fileID), zap.Error(err))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+		return
+	}
+
+	// A deleted or never uploaded file has no content to read, as if it did not exist
+	if deletedAt.Valid || file.Status != models.FileStatusUploaded {
+		h.logRequest(ctx, "info", "File is deleted or not uploaded", zap.String("file_id", fileID), zap.String("status", file.Status))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+		return
+	}
+
+	var grantID string
+	if file.ClientID != clientID {
+		grant, found, err := h.activeGrant(file.ID, clientID, models.GrantPermissionDownload)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to query file grants", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to read file"))
+			return
+		}
+		if !found {
+			h.logRequest(ctx, "error", "Client does not own this file",
+				zap.String("file_id", fileID),
+				zap.String("requesting_client", clientID),
+				zap.String("owner_client", file.ClientID),
+			)
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(errs.NewAuthorizationError("Access denied"))
+			return
+		}
+		grantID = grant.ID
+	}
+
+	// Reads stop with downloads when the bucket is archived with freeze-all
+	if readsFrozen(bucketArchived, bucketArchiveMode) {
+		h.logRequest(ctx, "info", "Bucket is archived", zap.String("file_id", fileID))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Cannot download from an archived bucket"))
+		return
+	}
+
+	if scanStatus == models.ScanStatusPending {
+		h.logRequest(ctx, "info", "File is awaiting its scan", zap.String("file_id", fileID))
+		writeAwaitingScan(w)
+		return
+	}
+
+	// Content encrypted with a customer key is decrypted with the key sent in the request
+	keyHash, iv, err := fileEncryption(h.db, file.ID, "")
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query file encryption", zap.String("file_id", fileID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to read file"))
+		return
+	}
+	var encKey []byte
+	if keyHash != "" {
+		encKey, err = decodeCustomerKey(r)
+		if err == nil && encKey == nil {
+			err = errEncryptionKeyRequired
+		}
+		if err == nil && !customerKeyMatches(keyHash, encKey) {
+			err = errEncryptionKeyMismatch
+		}
+		if err != nil {
+			h.logRequest(ctx, "error", "Encryption key missing or wrong", zap.String("file_id", fileID), zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+			return
+		}
+	}
+
+	// Register as a reader first so a concurrent deletion cannot remove the file mid-read
+	filePath := filepath.Join(uploadsRoot, clientName, bucketName, file.Key)
+	readCtx, release, ok := h.locks.acquireDownload(ctx, filePath, w)
+	if !ok {
+		h.logRequest(ctx, "info", "File is being deleted", zap.String("file_id", fileID))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+		return
+	}
+	defer release()
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		h.logRequest(ctx, "error", "File not found on disk", zap.String("file_id", fileID), zap.Error(err))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+		return
+	}
+	defer f.Close()
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to stat file", zap.String("file_id", fileID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to read file"))
+		return
+	}
+	size := fileInfo.Size()
+
+	// A negative offset counts back from the end; the whole range must lie inside the file
+	start := req.Offset
+	if start < 0 {
+		start += size
+	}
+	length := req.Length
+	if start < 0 || start >= size || start+length > size {
+		h.logRequest(ctx, "info", "Read range outside the file",
+			zap.String("file_id", fileID),
+			zap.Int64("offset", req.Offset),
+			zap.Int64("length", req.Length),
+			zap.Int64("file_size", size),
+		)
+		message := fmt.Sprintf("offset %d is outside the file of %d bytes", req.Offset, size)
+		if start >= 0 && start < size {
+			message = fmt.Sprintf("offset %d and length %d run past the end of the file of %d bytes", req.Offset, req.Length, size)
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.Header().Set("X-File-Total-Size", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		json.NewEncoder(w).Encode(models.ReadRangeNotSatisfiableError{
+			Code:     http.StatusRequestedRangeNotSatisfiable,
+			Message:  message,
+			FileSize: size,
+		})
+		return
+	}
+
+	var content io.Reader
+	if keyHash != "" {
+		content, err = decryptStoredFrom(encKey, iv, f, start)
+	} else {
+		_, err = f.Seek(start, io.SeekStart)
+		content = f
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to position file", zap.String("file_id", fileID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to read file"))
+		return
+	}
+
+	if grantID != "" {
+		if err := h.recordGrantDownload(grantID); err != nil {
+			h.logRequest(ctx, "error", "Failed to record grant download", zap.String("grant_id", grantID), zap.Error(err))
+		}
+	}
+	if err := touchClientDownload(h.db, file.ClientID, time.Now().UTC()); err != nil {
+		h.logRequest(ctx, "error", "Failed to record client activity", zap.String("client_id", file.ClientID), zap.Error(err))
+	}
+
+	w.Header().Set("Content-Type", file.Mimetype)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+	w.Header().Set("X-File-Total-Size", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := copyWithContext(readCtx, w, io.LimitReader(content, length)); err != nil {
+		h.logRequest(ctx, "error", "Failed to stream file range", zap.String("file_id", fileID), zap.Error(err))
+	}
+}
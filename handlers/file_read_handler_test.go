@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"file-upload-service/models"
+)
+
+// readRange reads part of a file through POST /files/{id}/read
+func (e *testEnv) readRange(fileID string, offset, length int64) *httptest.ResponseRecorder {
+	return e.serve(e.files.ReadFileRange, newRequest(http.MethodPost, "/files/"+fileID+"/read",
+		models.ReadFileRangeRequest{Offset: offset, Length: length}), map[string]string{"id": fileID})
+}
+
+// expectRange checks a successful read returned want as the bytes from start of a file of size bytes
+func expectRange(t *testing.T, w *httptest.ResponseRecorder, want string, start, size int) {
+	t.Helper()
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Body.String(); got != want {
+		t.Fatalf("read %q, want %q", got, want)
+	}
+	contentRange := "bytes " + strconv.Itoa(start) + "-" + strconv.Itoa(start+len(want)-1) + "/" + strconv.Itoa(size)
+	if got := w.Header().Get("Content-Range"); got != contentRange {
+		t.Fatalf("Content-Range = %q, want %q", got, contentRange)
+	}
+	if got := w.Header().Get("X-File-Total-Size"); got != strconv.Itoa(size) {
+		t.Fatalf("X-File-Total-Size = %q, want %d", got, size)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/plain" {
+		t.Fatalf("Content-Type = %q, want the file's text/plain", got)
+	}
+}
+
+// numberLines is the output of seq 1 n
+func numberLines(n int) string {
+	var lines strings.Builder
+	for i := 1; i <= n; i++ {
+		lines.WriteString(strconv.Itoa(i) + "\n")
+	}
+	return lines.String()
+}
+
+func TestReadFileRangeHeaderAndTail(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	content := numberLines(2000)
+	size := len(content)
+	fileID := env.putFile(bucketID, "data/numbers.txt", []byte(content))
+
+	expectRange(t, env.readRange(fileID, 0, 10), "1\n2\n3\n4\n5\n", 0, size)
+
+	// A negative offset reads the tail without knowing the size; explicit math reads the same bytes
+	tail := "1999\n2000\n"
+	expectRange(t, env.readRange(fileID, -10, 10), tail, size-10, size)
+	expectRange(t, env.readRange(fileID, int64(size-10), 10), tail, size-10, size)
+	expectRange(t, env.readRange(fileID, -1, 1), "\n", size-1, size)
+}
+
+func TestReadFileRangeOutOfBounds(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	content := numberLines(2000)
+	size := int64(len(content))
+	fileID := env.putFile(bucketID, "data/numbers.txt", []byte(content))
+
+	ranges := []struct {
+		offset, length int64
+	}{
+		{size, 1},
+		{size + 100, 1},
+		{-size - 1, 1},
+		{size - 3, 100},
+		{-10, 11},
+	}
+	for _, rng := range ranges {
+		w := env.readRange(fileID, rng.offset, rng.length)
+		if w.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Fatalf("offset %d length %d: status = %d, want 416; body: %s", rng.offset, rng.length, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Content-Range"); got != "bytes */"+strconv.FormatInt(size, 10) {
+			t.Fatalf("offset %d length %d: Content-Range = %q", rng.offset, rng.length, got)
+		}
+		var body models.ReadRangeNotSatisfiableError
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.FileSize != size {
+			t.Fatalf("offset %d length %d: body %s does not carry the file size", rng.offset, rng.length, w.Body.String())
+		}
+	}
+
+	// The length is bounded before the file is looked at
+	for _, length := range []int64{0, -1, maxReadRangeBytes + 1} {
+		expectStatus(t, env.readRange(fileID, 0, length), http.StatusBadRequest)
+	}
+}
+
+func TestReadFileRangeOfDeletedFile(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "data/numbers.txt", []byte(numberLines(10)))
+	expectStatus(t, env.readRange(fileID, 0, 2), http.StatusOK)
+
+	env.deletePath(bucketID, "data")
+	expectStatus(t, env.readRange(fileID, 0, 2), http.StatusNotFound)
+	expectStatus(t, env.readRange("no-such-file", 0, 2), http.StatusNotFound)
+}
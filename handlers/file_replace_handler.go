@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/gorilla/mux"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// replaceFileContent swaps the staged bytes of a replacement into place and records the new
+// size, mimetype, checksum, image dimensions and uploader. The rename happens inside the transaction that updates the
+// row, once the file is known to still be live, so the file is never left with a row and
+// bytes that disagree; readers see either the old content or the new one. In a versioning
+// bucket the old content is kept as a version first. The new content is encrypted with
+// encKey when it is set, and stored in the clear otherwise, whatever the old content was.
+// As with new uploads, content already stored in a dedupe bucket is shared; the returned
+// bool reports whether it was. The staged file is removed on any failure. It returns the
+// file's key.
+func (h *FileHandler) replaceFileContent(tokenData models.UploadTokenData, stagedPath, filePath string, written int64, detectedMimetype, checksum string, dims *models.ImageDimensions, encKey *customerKey, uploader uploaderInfo) (string, bool, error) {
+	tx, err := h.db.Beginx()
+	if err != nil {
+		os.Remove(stagedPath)
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	if err := checkTokenTarget(tx, tokenData.FileID, models.ShortTokenKindUpload, tokenData.FilePath, false); err != nil {
+		os.Remove(stagedPath)
+		return "", false, err
+	}
+
+	var key string
+	err = tx.QueryRow(
+		"SELECT key FROM files WHERE id = ? AND status = ? AND staged = 0",
+		tokenData.FileID, models.FileStatusUploaded,
+	).Scan(&key)
+	if err == sql.ErrNoRows {
+		os.Remove(stagedPath)
+		return "", false, errTargetFileDeleted
+	}
+	if err != nil {
+		os.Remove(stagedPath)
+		return "", false, err
+	}
+
+	now := time.Now().UTC()
+	var objectID sql.NullInt64
+	var shared bool
+	discardObject := func() {}
+	version, err := preserveVersionAtKey(tx, tokenData.BucketID, key, filePath, now)
+	if err == nil && encKey == nil {
+		objectID, shared, discardObject, err = dedupeStaged(tx, tokenData.BucketID, checksum, written, stagedPath, now)
+	}
+	if err == nil {
+		keyHash, iv := encKey.columns()
+		imageWidth, imageHeight, imageFormat := imageDimensionColumns(dims)
+		uploaderIP, uploaderUserAgent := uploader.columns()
+		_, err = tx.Exec(
+			`UPDATE files SET file_size = ?, size_mismatch = ?, declared_file_size = ?, mimetype = ?, detected_mimetype = ?, checksum = ?,
+			scan_status = ?, scan_signature = NULL, scanned_at = NULL, encryption_key_hash = ?, encryption_iv = ?,
+			image_width = ?, image_height = ?, image_format = ?, storage_object_id = ?, uploader_ip = ?, uploader_user_agent = ?, updated_at = ? WHERE id = ?`,
+			written, h.sizeMismatch(tokenData.FileSize, written), tokenData.FileSize, tokenData.Mimetype, detectedMimetype, checksum, h.pendingScanStatus(), keyHash, iv,
+			imageWidth, imageHeight, imageFormat, objectID, uploaderIP, uploaderUserAgent, now, tokenData.FileID,
+		)
+	}
+	if err == nil {
+		err = os.Rename(stagedPath, filePath)
+	}
+	if err != nil {
+		os.Remove(stagedPath)
+		version.discard()
+		discardObject()
+		return "", false, err
+	}
+	if err := tx.Commit(); err != nil {
+		version.putBack(filePath)
+		discardObject()
+		return "", false, err
+	}
+	return key, shared, nil
+}
+
+// ReplaceFileURL handles POST /files/{id}/replace-url - generate a signed URL whose upload
+// overwrites the content of an existing file. The file keeps its file_id and key, so stored
+// references stay valid; its size, mimetype, checksum and updated_at follow the new bytes.
+func (h *FileHandler) ReplaceFileURL(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	fileID := mux.Vars(r)["id"]
+
+	var req models.ReplaceFileURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	if req.FileSize <= 0 {
+		h.logRequest(ctx, "error", "Invalid file size", zap.Int64("file_size", req.FileSize))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("file_size must be greater than 0"))
+		return
+	}
+	ttl, err := h.signedURLTTL(req.ExpiresInSeconds)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid signed URL lifetime", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+	if req.CallbackURL != "" {
+		if err := validateCallbackURL(req.CallbackURL, h.config.UploadCallbackAllowPrivate); err != nil {
+			h.logRequest(ctx, "error", "Invalid callback URL", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+			return
+		}
+	}
+
+	h.logRequest(ctx, "info", "Generating replacement signed URL",
+		zap.String("file_id", fileID),
+		zap.String("client_id", clientID),
+	)
+
+	var file models.File
+	var metadata string
+	var clientName, bucketName string
+	var bucketArchived, bucketAllowMismatch int
+	var bucketStrictFileSize bool
+	var bucketAllowedMimetypes string
+	err = h.db.QueryRow(
+		`SELECT f.id, f.file_name, f.mimetype, f.client_id, f.bucket_id, f.key, f.owner_entity_type, f.owner_entity_id,
+			f.status, f.staged, f.metadata, c.name, b.name, b.archived, b.allow_mimetype_mismatch, b.strict_file_size, b.allowed_mimetypes
+		FROM files f
+		JOIN clients c ON f.client_id = c.client_id
+		JOIN buckets b ON f.bucket_id = b.id
+		WHERE f.id = ?`,
+		fileID,
+	).Scan(&file.ID, &file.FileName, &file.Mimetype, &file.ClientID, &file.BucketID, &file.Key, &file.OwnerEntityType, &file.OwnerEntityID,
+		&file.Status, &file.Staged, &metadata, &clientName, &bucketName, &bucketArchived, &bucketAllowMismatch, &bucketStrictFileSize, &bucketAllowedMimetypes)
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "info", "File not found", zap.String("file_id", fileID))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query file", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Database error"))
+		return
+	}
+	if file.ClientID != clientID {
+		h.logRequest(ctx, "error", "Client does not own this file",
+			zap.String("file_id", fileID),
+			zap.String("requesting_client", clientID),
+		)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(errs.NewAuthorizationError("Access denied"))
+		return
+	}
+	if file.Status == models.FileStatusDeleted {
+		h.logRequest(ctx, "info", "File has been deleted", zap.String("file_id", fileID))
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(errs.NewValidationError("File has been deleted"))
+		return
+	}
+	// Only content that exists can be replaced: pending and staged files still await theirs
+	if file.Status != models.FileStatusUploaded || file.Staged {
+		h.logRequest(ctx, "error", "File has no content to replace", zap.String("file_id", fileID), zap.String("status", file.Status))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("File has not been uploaded yet; complete its upload instead"))
+		return
+	}
+	if bucketArchived != 0 {
+		h.logRequest(ctx, "error", "Bucket is archived", zap.Int("bucket_id", file.BucketID))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Cannot upload to an archived bucket"))
+		return
+	}
+
+	mimetype := file.Mimetype
+	if req.Mimetype != "" {
+		mimetype = req.Mimetype
+	}
+	var allowedMimetypes []string
+	if err := json.Unmarshal([]byte(bucketAllowedMimetypes), &allowedMimetypes); err != nil {
+		h.logRequest(ctx, "error", "Failed to parse allowed_mimetypes", zap.Int("bucket_id", file.BucketID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to check allowed mimetypes"))
+		return
+	}
+	if !mimetypeAllowed(mimetype, allowedMimetypes) {
+		h.logRequest(ctx, "error", "Mimetype not allowed in bucket",
+			zap.Int("bucket_id", file.BucketID),
+			zap.String("mimetype", mimetype),
+		)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(fmt.Sprintf(
+			"mimetype %s is not allowed in this bucket; allowed mimetypes: %s",
+			mimetype, strings.Join(allowedMimetypes, ", "),
+		)))
+		return
+	}
+
+	// The upload takes one of the file's upload uses, so issuing the token grants it one more
+	upload := &pendingUpload{
+		Key:        file.Key,
+		BucketPath: filepath.Join(clientName, bucketName),
+		MaxUses:    1,
+		TokenData: models.UploadTokenData{
+			FileID:                file.ID,
+			FileName:              file.FileName,
+			FileSize:              req.FileSize,
+			Mimetype:              mimetype,
+			ClientID:              clientID,
+			BucketID:              file.BucketID,
+			FilePath:              filepath.Join(clientName, bucketName, file.Key),
+			OwnerEntityType:       file.OwnerEntityType,
+			OwnerEntityID:         file.OwnerEntityID,
+			AllowMimetypeMismatch: bucketAllowMismatch != 0,
+			StrictFileSize:        bucketStrictFileSize,
+			Metadata:              decodeFileMetadata(metadata),
+			CallbackURL:           req.CallbackURL,
+			Replace:               true,
+		},
+	}
+	response, err := h.issueUploadToken(upload, ttl, time.Now().UTC())
+	if err != nil {
+		if _, _, err := h.uses.Claim(fileID); err != nil {
+			h.logRequest(ctx, "error", "Failed to take back replacement upload", zap.String("file_id", fileID), zap.Error(err))
+		}
+		h.logRequest(ctx, "error", "Failed to store upload token in cache", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to generate signed URL"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Replacement signed URL generated",
+		zap.String("file_id", fileID),
+		zap.Int("bucket_id", file.BucketID),
+		zap.Duration("ttl", ttl),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
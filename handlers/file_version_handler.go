@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// versionsRoot holds the bytes of earlier versions kept by versioning buckets. It is
+// outside the uploads root so public paths can never serve them.
+const versionsRoot = "./versions"
+
+// fileVersionColumns are the file_versions columns scanned into models.FileVersion
+const fileVersionColumns = "id, file_id, file_size, mimetype, COALESCE(checksum, '') AS checksum, delete_marker, created_at"
+
+// versionBlobPath returns where the bytes of a version are kept
+func versionBlobPath(versionID string) string {
+	return filepath.Join(versionsRoot, versionID)
+}
+
+// keptVersion is the current content of a key, linked aside before it is discarded but not
+// yet recorded as a version
+type keptVersion struct {
+	ID       string
+	BlobPath string
+	BucketID int
+	Key      string
+	FileID   string
+	FileSize int64
+	Mimetype string
+	Checksum sql.NullString
+	// KeyHash and IV are kept for content encrypted with a customer key
+	KeyHash sql.NullString
+	IV      sql.NullString
+}
+
+// keepVersionAtKey links the current content of a key aside before an upload or deletion
+// discards it. It does nothing unless the bucket has versioning on and a live file is
+// stored at the key. The bytes at diskPath are hard linked (or copied) to the version's
+// blob, so renaming new bytes over diskPath or unlinking it afterwards leaves them intact.
+// It returns nil when no version was kept.
+func keepVersionAtKey(q sqlx.Queryer, bucketID int, key, diskPath string) (*keptVersion, error) {
+	var versioning bool
+	if err := q.QueryRowx("SELECT versioning FROM buckets WHERE id = ?", bucketID).Scan(&versioning); err != nil {
+		return nil, err
+	}
+	if !versioning {
+		return nil, nil
+	}
+
+	version := keptVersion{BucketID: bucketID, Key: key}
+	err := q.QueryRowx(
+		`SELECT id, file_size, mimetype, checksum, encryption_key_hash, encryption_iv FROM files
+		WHERE bucket_id = ? AND key = ? AND status = ? AND staged = 0
+		ORDER BY updated_at DESC LIMIT 1`,
+		bucketID, key, models.FileStatusUploaded,
+	).Scan(&version.FileID, &version.FileSize, &version.Mimetype, &version.Checksum, &version.KeyHash, &version.IV)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	version.ID = uuid.New().String()
+	version.BlobPath = versionBlobPath(version.ID)
+	if err := os.MkdirAll(versionsRoot, 0755); err != nil {
+		return nil, err
+	}
+	err = preserveFile(diskPath, version.BlobPath, "hardlink")
+	if os.IsNotExist(err) {
+		// The bytes are already gone, so there is nothing to keep
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The row holds the declared size of a signed URL upload; record what is actually kept
+	if info, err := os.Stat(version.BlobPath); err == nil {
+		version.FileSize = info.Size()
+	}
+	return &version, nil
+}
+
+// record inserts the version's row
+func (v *keptVersion) record(exec sqlx.Execer, now time.Time) error {
+	_, err := exec.Exec(
+		`INSERT INTO file_versions (id, bucket_id, key, file_id, file_size, mimetype, checksum, encryption_key_hash, encryption_iv, delete_marker, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?)`,
+		v.ID, v.BucketID, v.Key, v.FileID, v.FileSize, v.Mimetype, v.Checksum, v.KeyHash, v.IV, now,
+	)
+	return err
+}
+
+// discard removes the version's blob when it is not recorded after all; safe on nil
+func (v *keptVersion) discard() {
+	if v != nil {
+		os.Remove(v.BlobPath)
+	}
+}
+
+// putBack moves the kept bytes back to diskPath after the new bytes that replaced them
+// could not be recorded, reporting whether it did; safe on nil
+func (v *keptVersion) putBack(diskPath string) bool {
+	return v != nil && os.Rename(v.BlobPath, diskPath) == nil
+}
+
+// preserveVersionAtKey keeps the current content of a key as a version, recording it in tx.
+// Callers run it just before their new bytes replace the key's, and discard the returned
+// version if tx is not committed. It returns nil when no version was kept.
+func preserveVersionAtKey(tx *sqlx.Tx, bucketID int, key, diskPath string, now time.Time) (*keptVersion, error) {
+	version, err := keepVersionAtKey(tx, bucketID, key, diskPath)
+	if err != nil || version == nil {
+		return nil, err
+	}
+	if err := version.record(tx, now); err != nil {
+		version.discard()
+		return nil, err
+	}
+	return version, nil
+}
+
+// removeVersionedFile deletes a file of a versioning bucket: its bytes are kept as a version
+// and a delete marker is recorded along with the file's deletion. The bytes are linked
+// aside before the file is unlinked, which waits for active downloads like a regular
+// delete, and only then are the rows written.
+func (h *FileHandler) removeVersionedFile(ctx context.Context, fileID string, bucketID int, key, diskPath string) error {
+	version, err := keepVersionAtKey(h.db, bucketID, key, diskPath)
+	if err != nil {
+		return err
+	}
+	if err := h.removeStoredFile(ctx, fileID, diskPath); err != nil {
+		version.discard()
+		return err
+	}
+
+	now := time.Now().UTC()
+	tx, err := h.db.Beginx()
+	if err == nil {
+		defer tx.Rollback()
+		if version != nil {
+			err = version.record(tx, now)
+		}
+		if err == nil {
+			_, err = tx.Exec(
+				`INSERT INTO file_versions (id, bucket_id, key, file_id, delete_marker, created_at)
+				VALUES (?, ?, ?, ?, 1, ?)`,
+				uuid.New().String(), bucketID, key, fileID, now,
+			)
+		}
+		if err == nil {
+			_, err = tx.Exec("UPDATE files SET status = ?, deleted_at = ?, updated_at = ? WHERE id = ?", models.FileStatusDeleted, now, now, fileID)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+	}
+	if err != nil {
+		// Put the bytes back so the file is left as it was
+		version.putBack(diskPath)
+	}
+	return err
+}
+
+// loadVersionedFile fetches the bucket and key whose versions a request for fileID acts on.
+// Deleted files are included: their history is what delete markers keep. Only the owner
+// may list or purge versions.
+// On failure it returns the HTTP status to respond with and the error body.
+func (h *FileHandler) loadVersionedFile(ctx context.Context, clientID, fileID string) (bucketID int, key string, status int, appErr *errs.AppError) {
+	var ownerClientID string
+	err := h.db.QueryRow(
+		"SELECT client_id, bucket_id, key FROM files WHERE id = ? AND staged = 0",
+		fileID,
+	).Scan(&ownerClientID, &bucketID, &key)
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "info", "File not found", zap.String("file_id", fileID))
+		return 0, "", http.StatusNotFound, errs.NewNotFoundError("File not found")
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query file", zap.Error(err))
+		return 0, "", http.StatusInternalServerError, errs.NewInternalServerError("Database error")
+	}
+	if ownerClientID != clientID {
+		h.logRequest(ctx, "error", "Client does not own this file",
+			zap.String("file_id", fileID),
+			zap.String("requesting_client", clientID),
+		)
+		return 0, "", http.StatusForbidden, errs.NewAuthorizationError("Access denied")
+	}
+	return bucketID, key, 0, nil
+}
+
+// ListFileVersions handles GET /files/{id}/versions - list the earlier versions and delete
+// markers kept for a file's key, newest first
+func (h *FileHandler) ListFileVersions(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	fileID := mux.Vars(r)["id"]
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Listing file versions", zap.String("file_id", fileID), zap.String("client_id", clientID))
+
+	bucketID, key, status, appErr := h.loadVersionedFile(ctx, clientID, fileID)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	versions := make([]models.FileVersion, 0)
+	if err := h.db.Select(&versions,
+		"SELECT "+fileVersionColumns+" FROM file_versions WHERE bucket_id = ? AND key = ? ORDER BY created_at DESC, rowid DESC",
+		bucketID, key,
+	); err != nil {
+		h.logRequest(ctx, "error", "Failed to query file versions", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to list versions"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.FileVersionListResponse{
+		FileID:   fileID,
+		BucketID: bucketID,
+		Key:      key,
+		Versions: versions,
+	})
+}
+
+// PurgeFileVersions handles DELETE /files/{id}/versions - permanently remove versions of a
+// file's key, or all of them, to reclaim their space. The file's current content is left
+// alone.
+func (h *FileHandler) PurgeFileVersions(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	fileID := mux.Vars(r)["id"]
+
+	// The body is optional: without one every version of the key is purged
+	var req models.PurgeFileVersionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+	if len(req.VersionIDs) > h.config.MaxSyncRows {
+		h.logRequest(ctx, "error", "Too many version IDs for synchronous purge", zap.Int("count", len(req.VersionIDs)))
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(errs.AppError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: "Too many version_ids in one request; split them into smaller batches",
+		})
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Purging file versions",
+		zap.String("file_id", fileID),
+		zap.String("client_id", clientID),
+		zap.Int("version_ids", len(req.VersionIDs)),
+	)
+
+	bucketID, key, status, appErr := h.loadVersionedFile(ctx, clientID, fileID)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	var versions []models.FileVersion
+	query := "SELECT " + fileVersionColumns + " FROM file_versions WHERE bucket_id = ? AND key = ?"
+	args := []interface{}{bucketID, key}
+	if len(req.VersionIDs) > 0 {
+		q, inArgs, err := sqlx.In(" AND id IN (?)", req.VersionIDs)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to build version query", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to purge versions"))
+			return
+		}
+		query += q
+		args = append(args, inArgs...)
+	}
+	if err := h.db.Select(&versions, query, args...); err != nil {
+		h.logRequest(ctx, "error", "Failed to query file versions", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to purge versions"))
+		return
+	}
+
+	response := models.PurgeFileVersionsResponse{
+		Purged:  make([]string, 0),
+		Missing: make([]string, 0),
+		Failed:  make([]string, 0),
+	}
+	found := make(map[string]bool)
+	for _, version := range versions {
+		found[version.ID] = true
+		if !version.DeleteMarker {
+			// Wait for downloads streaming the version, like a regular delete
+			blobPath := versionBlobPath(version.ID)
+			release, _ := h.locks.acquireDelete(blobPath)
+			err := os.Remove(blobPath)
+			release()
+			if err != nil && !os.IsNotExist(err) {
+				h.logRequest(ctx, "error", "Failed to remove version bytes", zap.String("version_id", version.ID), zap.Error(err))
+				response.Failed = append(response.Failed, version.ID)
+				continue
+			}
+		}
+		if _, err := h.db.Exec("DELETE FROM file_versions WHERE id = ?", version.ID); err != nil {
+			h.logRequest(ctx, "error", "Failed to delete version row", zap.String("version_id", version.ID), zap.Error(err))
+			response.Failed = append(response.Failed, version.ID)
+			continue
+		}
+		response.Purged = append(response.Purged, version.ID)
+		if !version.DeleteMarker {
+			response.BytesFreed += version.FileSize
+		}
+	}
+	for _, id := range req.VersionIDs {
+		if !found[id] {
+			response.Missing = append(response.Missing, id)
+		}
+	}
+
+	h.logRequest(ctx, "info", "File versions purged",
+		zap.String("file_id", fileID),
+		zap.Int("purged", len(response.Purged)),
+		zap.Int("failed", len(response.Failed)),
+		zap.Int64("bytes_freed", response.BytesFreed),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"file-upload-service/config"
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"go.uber.org/zap"
+)
+
+// GeoResolver places an address in a country and region
+type GeoResolver interface {
+	// Resolve returns where ip is; found is false when the resolver does not know it
+	Resolve(ip net.IP) (location models.GeoLocation, found bool)
+}
+
+// newGeoResolver builds the resolver chosen by GEO_RESOLVER; nil when redemptions are
+// recorded without a location. A ranges file that cannot be loaded is logged and leaves
+// the service running without locations.
+func newGeoResolver(cfg *config.Config) GeoResolver {
+	if cfg.GeoResolver != "ranges" {
+		return nil
+	}
+	resolver, err := loadRangeResolver(cfg.GeoRangesFile)
+	if err != nil {
+		logger.Error("Failed to load geo ranges, recording redemptions without a location",
+			zap.String("file", cfg.GeoRangesFile), zap.Error(err))
+		return nil
+	}
+	logger.Info("Geo ranges loaded", zap.String("file", cfg.GeoRangesFile), zap.Int("ranges", len(resolver.ranges)))
+	return resolver
+}
+
+// geoRange is one address range of a ranges file
+type geoRange struct {
+	network  *net.IPNet
+	location models.GeoLocation
+}
+
+// rangeResolver looks addresses up in a list of ranges read from a local file, so
+// locations need no external service. The narrowest range holding an address wins.
+type rangeResolver struct {
+	ranges []geoRange
+}
+
+// loadRangeResolver reads a ranges file: one "<cidr>,<country>[,<region>]" line per range.
+// Blank lines and lines starting with # are skipped.
+func loadRangeResolver(path string) (*rangeResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	resolver := &rangeResolver{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: want <cidr>,<country>[,<region>]", line)
+		}
+		_, network, err := net.ParseCIDR(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		location := models.GeoLocation{Country: strings.TrimSpace(fields[1])}
+		if len(fields) == 3 {
+			location.Region = strings.TrimSpace(fields[2])
+		}
+		resolver.ranges = append(resolver.ranges, geoRange{network: network, location: location})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return resolver, nil
+}
+
+// Resolve returns the location of the narrowest range holding ip
+func (r *rangeResolver) Resolve(ip net.IP) (models.GeoLocation, bool) {
+	var best *geoRange
+	bestOnes := -1
+	for i := range r.ranges {
+		if !r.ranges[i].network.Contains(ip) {
+			continue
+		}
+		if ones, _ := r.ranges[i].network.Mask.Size(); ones > bestOnes {
+			best, bestOnes = &r.ranges[i], ones
+		}
+	}
+	if best == nil {
+		return models.GeoLocation{}, false
+	}
+	return best.location, true
+}
@@ -0,0 +1,509 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	cachepackage "file-upload-service/cache"
+	"file-upload-service/config"
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/umakantv/go-utils/cache"
+	"github.com/umakantv/go-utils/db/migrations"
+	"github.com/umakantv/go-utils/httpserver"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init(logger.LoggerConfig{
+		CallerKey:  "file",
+		TimeKey:    "timestamp",
+		CallerSkip: 1,
+	})
+	os.Exit(m.Run())
+}
+
+// testEnv is one service instance backed by a fresh SQLite database, an in-memory cache and
+// a temporary working directory holding ./uploads. Tests using it must not run in parallel,
+// as it changes the working directory.
+type testEnv struct {
+	t      *testing.T
+	db     *sqlx.DB
+	cache  cache.Cache
+	cfg    *config.Config
+	locks  *PathLocks
+	leases *memoryLeaseStore
+	files  *FileHandler
+	public *PublicFileHandler
+
+	clientID   string
+	clientName string
+}
+
+// newTestEnv sets up a test environment with one client
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	migrationsDir, err := filepath.Abs("../database/migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	db, err := sqlx.Open("sqlite3", filepath.Join(dir, "test.db")+"?_busy_timeout=10000&_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrations.Migrate(db, migrationsDir); err != nil {
+		t.Fatal(err)
+	}
+
+	memoryCache, err := cache.New(cache.Config{Type: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.InitializeConfig()
+
+	env := &testEnv{
+		t:          t,
+		db:         db,
+		cache:      memoryCache,
+		cfg:        cfg,
+		clientID:   "client_test",
+		clientName: "test-client",
+	}
+	env.locks = NewPathLocks(cfg.DeleteReadWaitTimeout())
+	env.leases = newMemoryLeaseStore()
+	downloads := NewDownloadCounts(db)
+	env.files = NewFileHandler(db, memoryCache, cfg, env.locks, NewJobLeases(env.leases, "instance-test", time.Minute), newMemoryUploadQuotaStore(), newMemoryUploadUseStore(), &memoryTokenBatchStore{cache: memoryCache}, downloads)
+	env.public = NewPublicFileHandler(db, cfg, env.locks, newMemoryRateLimitStore(), downloads)
+
+	db.MustExec("INSERT INTO clients (name, client_id, client_secret) VALUES (?, ?, ?)", env.clientName, env.clientID, "secret_test")
+	return env
+}
+
+// memoryLeaseStore is an in-process cache.LeaseStore; the tests stand in for a second
+// replica by taking leases under another holder
+type memoryLeaseStore struct {
+	mu      sync.Mutex
+	holders map[string]string
+	expires map[string]time.Time
+}
+
+func newMemoryLeaseStore() *memoryLeaseStore {
+	return &memoryLeaseStore{holders: make(map[string]string), expires: make(map[string]time.Time)}
+}
+
+// current returns the lease's live holder, dropping it once it lapsed
+func (s *memoryLeaseStore) current(name string) string {
+	if time.Now().After(s.expires[name]) {
+		delete(s.holders, name)
+		delete(s.expires, name)
+	}
+	return s.holders[name]
+}
+
+func (s *memoryLeaseStore) Acquire(name, holder string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current := s.current(name); current != "" && current != holder {
+		return false, nil
+	}
+	s.holders[name] = holder
+	s.expires[name] = time.Now().Add(ttl)
+	return true, nil
+}
+
+func (s *memoryLeaseStore) Renew(name, holder string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current(name) != holder {
+		return false, nil
+	}
+	s.expires[name] = time.Now().Add(ttl)
+	return true, nil
+}
+
+func (s *memoryLeaseStore) Release(name, holder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current(name) == holder {
+		delete(s.holders, name)
+		delete(s.expires, name)
+	}
+	return nil
+}
+
+func (s *memoryLeaseStore) Holder(name string) (string, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	holder := s.current(name)
+	if holder == "" {
+		return "", 0, nil
+	}
+	return holder, time.Until(s.expires[name]), nil
+}
+
+// memoryUploadQuotaStore is an in-process cache.UploadQuotaStore
+type memoryUploadQuotaStore struct {
+	mu    sync.Mutex
+	files map[string]int
+	bytes map[string]int64
+}
+
+func newMemoryUploadQuotaStore() *memoryUploadQuotaStore {
+	return &memoryUploadQuotaStore{files: make(map[string]int), bytes: make(map[string]int64)}
+}
+
+func (s *memoryUploadQuotaStore) Take(token string, files int, bytes int64, maxFiles int, maxBytes int64, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files[token]+files > maxFiles || s.bytes[token]+bytes > maxBytes {
+		return false, nil
+	}
+	s.files[token] += files
+	s.bytes[token] += bytes
+	return true, nil
+}
+
+func (s *memoryUploadQuotaStore) Give(token string, files int, bytes int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[token] -= files
+	s.bytes[token] -= bytes
+	return nil
+}
+
+func (s *memoryUploadQuotaStore) Usage(token string) (int, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files[token], s.bytes[token], nil
+}
+
+// memoryUploadUseStore is an in-process cache.UploadUseStore
+type memoryUploadUseStore struct {
+	mu      sync.Mutex
+	uses    map[string]int
+	expires map[string]time.Time
+}
+
+func newMemoryUploadUseStore() *memoryUploadUseStore {
+	return &memoryUploadUseStore{uses: make(map[string]int), expires: make(map[string]time.Time)}
+}
+
+// current returns the uses left on a file, dropping a count that expired
+func (s *memoryUploadUseStore) current(fileID string) (int, bool) {
+	if time.Now().After(s.expires[fileID]) {
+		delete(s.uses, fileID)
+		delete(s.expires, fileID)
+	}
+	uses, ok := s.uses[fileID]
+	return uses, ok
+}
+
+func (s *memoryUploadUseStore) Grant(fileID string, uses int, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, _ := s.current(fileID)
+	s.uses[fileID] = current + uses
+	if expires := time.Now().Add(ttl); expires.After(s.expires[fileID]) {
+		s.expires[fileID] = expires
+	}
+	return nil
+}
+
+func (s *memoryUploadUseStore) Claim(fileID string) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uses, ok := s.current(fileID)
+	if !ok || uses <= 0 {
+		return 0, false, nil
+	}
+	s.uses[fileID] = uses - 1
+	return uses - 1, true, nil
+}
+
+func (s *memoryUploadUseStore) Give(fileID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if uses, ok := s.current(fileID); ok {
+		s.uses[fileID] = uses + 1
+	}
+	return nil
+}
+
+func (s *memoryUploadUseStore) Revoke(fileID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uses, fileID)
+	delete(s.expires, fileID)
+	return nil
+}
+
+// memoryTokenBatchStore is a cache.TokenBatchStore writing into the test's memory cache
+type memoryTokenBatchStore struct {
+	mu    sync.Mutex
+	cache cache.Cache
+}
+
+func (s *memoryTokenBatchStore) SetMany(entries []cachepackage.TokenEntry, onlyNew bool) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var taken []string
+	for _, entry := range entries {
+		if onlyNew && s.cache.Exists(entry.Key) {
+			taken = append(taken, entry.Key)
+			continue
+		}
+		if err := s.cache.Set(entry.Key, entry.Value, entry.TTL); err != nil {
+			return nil, err
+		}
+	}
+	return taken, nil
+}
+
+// memoryRateLimitStore is an in-process cache.RateLimitStore
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	tokens  map[string]float64
+	touched map[string]time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{tokens: make(map[string]float64), touched: make(map[string]time.Time)}
+}
+
+func (s *memoryRateLimitStore) Allow(key string, perMinute, burst int) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	rate := float64(perMinute) / float64(time.Minute)
+	tokens := float64(burst)
+	if last, ok := s.touched[key]; ok {
+		tokens = math.Min(float64(burst), s.tokens[key]+float64(now.Sub(last))*rate)
+	}
+	s.touched[key] = now
+	if tokens < 1 {
+		s.tokens[key] = tokens
+		return false, time.Duration((1 - tokens) / rate), nil
+	}
+	s.tokens[key] = tokens - 1
+	return true, 0, nil
+}
+
+// createBucket inserts a bucket owned by the test client and returns its id
+func (e *testEnv) createBucket(name string) int {
+	e.t.Helper()
+	now := time.Now().UTC()
+	result := e.db.MustExec(
+		"INSERT INTO buckets (name, client_id, cors_policy, public_paths, created_at, updated_at) VALUES (?, ?, '[]', '[]', ?, ?)",
+		name, e.clientID, now, now,
+	)
+	id, err := result.LastInsertId()
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return int(id)
+}
+
+// bucketName returns the name of a bucket
+func (e *testEnv) bucketName(bucketID int) string {
+	e.t.Helper()
+	var name string
+	if err := e.db.Get(&name, "SELECT name FROM buckets WHERE id = ?", bucketID); err != nil {
+		e.t.Fatal(err)
+	}
+	return name
+}
+
+// diskPath is where the content of a key of a bucket is stored
+func (e *testEnv) diskPath(bucketID int, key string) string {
+	return filepath.Join("./uploads", e.clientName, e.bucketName(bucketID), key)
+}
+
+// putFile stores content at a key of a bucket as an uploaded file and returns its id
+func (e *testEnv) putFile(bucketID int, key string, content []byte) string {
+	e.t.Helper()
+	path := e.diskPath(bucketID, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		e.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		e.t.Fatal(err)
+	}
+
+	id := uuid.New().String()
+	now := time.Now().UTC()
+	e.db.MustExec(
+		`INSERT INTO files (id, file_name, file_size, mimetype, client_id, bucket_id, key, owner_entity_type, owner_entity_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, filepath.Base(key), len(content), "text/plain", e.clientID, bucketID, key, "user", "user-1", now, now,
+	)
+	return id
+}
+
+// signedURLRequest is a valid signed URL request for a key of a bucket
+func signedURLRequest(bucketID int, key string, size int64) models.CreateSignedURLRequest {
+	return models.CreateSignedURLRequest{
+		BucketID:        bucketID,
+		Key:             key,
+		FileName:        filepath.Base(key),
+		FileSize:        size,
+		Mimetype:        "text/plain",
+		OwnerEntityType: "user",
+		OwnerEntityID:   "user-1",
+	}
+}
+
+// signedUpload issues a signed upload URL as requested
+func (e *testEnv) signedUpload(req models.CreateSignedURLRequest) models.SignedURLResponse {
+	e.t.Helper()
+	w := e.serve(e.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+	expectStatus(e.t, w, http.StatusCreated)
+	var signed models.SignedURLResponse
+	decode(e.t, w, &signed)
+	return signed
+}
+
+// uploadRequest builds the multipart POST a client sends to a signed upload URL
+func uploadRequest(signedURL string, content []byte) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "upload.bin")
+	if err != nil {
+		panic(err)
+	}
+	part.Write(content)
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, signedURLTarget(signedURL), &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+// signedURLTarget is the path and query of a signed URL, long or short
+func signedURLTarget(signedURL string) string {
+	parsed, err := url.Parse(signedURL)
+	if err != nil {
+		panic(err)
+	}
+	return parsed.RequestURI()
+}
+
+// directUploadRequest builds a multipart direct upload with the given form fields
+func directUploadRequest(fields map[string]string, content []byte) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	part, err := form.CreateFormFile("file", "upload.txt")
+	if err != nil {
+		panic(err)
+	}
+	part.Write(content)
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/files/direct-upload", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+// newRequest builds a request with an optional JSON body
+func newRequest(method, target string, body interface{}) *http.Request {
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		reader = bytes.NewReader(b)
+	case io.Reader:
+		reader = b
+	default:
+		encoded, err := json.Marshal(b)
+		if err != nil {
+			panic(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	r := httptest.NewRequest(method, target, reader)
+	if _, ok := body.(io.Reader); !ok && body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	return r
+}
+
+// serve calls a handler as the router does for the test client: with its Basic auth and
+// the route's path variables in the context
+func (e *testEnv) serve(handler httpserver.HandlerFunc, r *http.Request, vars map[string]string) *httptest.ResponseRecorder {
+	ctx := context.WithValue(r.Context(), httpserver.RequestAuthKey, httpserver.RequestAuth{Type: "basic", Client: e.clientID})
+	return serveAnonymous(handler, r.WithContext(ctx), vars)
+}
+
+// serveAdmin calls a handler of an admin route, as the router does for the Bearer token
+func serveAdmin(handler httpserver.HandlerFunc, r *http.Request, vars map[string]string) *httptest.ResponseRecorder {
+	ctx := context.WithValue(r.Context(), httpserver.RequestAuthKey, httpserver.RequestAuth{Type: "bearer"})
+	return serveAnonymous(handler, r.WithContext(ctx), vars)
+}
+
+// serveAnonymous calls a handler of a route that needs no auth header
+func serveAnonymous(handler httpserver.HandlerFunc, r *http.Request, vars map[string]string) *httptest.ResponseRecorder {
+	if vars != nil {
+		r = mux.SetURLVars(r, vars)
+	}
+	w := httptest.NewRecorder()
+	handler(r.Context(), w, r)
+	return w
+}
+
+// decode reads a JSON response body into v
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding response %q: %v", w.Body.String(), err)
+	}
+}
+
+// expectStatus fails the test when a response has another status
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status = %d, want %d; body: %s", w.Code, status, w.Body.String())
+	}
+}
+
+// eventually polls cond until it holds or a few seconds have passed
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"file-upload-service/models"
+)
+
+// maxHotlinkReferers is how many origin patterns hotlink_protection may allow
+const maxHotlinkReferers = 50
+
+// errHotlinkProtection is returned for hotlink_protection that is not a valid setting
+var errHotlinkProtection = fmt.Errorf("hotlink_protection must be null or an object with allowed_referers, a JSON array of at most %d origins such as \"https://example.com\" or \"https://*.example.com\", allow_empty_referer and an optional placeholder_key",
+	maxHotlinkReferers)
+
+// validateHotlinkProtection validates the hotlink_protection of a bucket and returns the
+// normalised JSON to store: lowercase origin patterns and a canonical placeholder key
+// ("null" if nil/empty, which turns protection off)
+func validateHotlinkProtection(raw json.RawMessage) (json.RawMessage, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return json.RawMessage("null"), nil
+	}
+	var protection models.HotlinkProtection
+	if err := json.Unmarshal(raw, &protection); err != nil {
+		return nil, errHotlinkProtection
+	}
+	if len(protection.AllowedReferers) > maxHotlinkReferers {
+		return nil, errHotlinkProtection
+	}
+	referers := make([]string, 0, len(protection.AllowedReferers))
+	for _, pattern := range protection.AllowedReferers {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if !validOriginPattern(pattern) {
+			return nil, errHotlinkProtection
+		}
+		referers = append(referers, pattern)
+	}
+	protection.AllowedReferers = referers
+	if protection.PlaceholderKey != "" {
+		key, err := sanitizeKey(protection.PlaceholderKey, false)
+		if err != nil || reservedKey(key) {
+			return nil, errHotlinkProtection
+		}
+		protection.PlaceholderKey = key
+	}
+	clean, err := json.Marshal(protection)
+	if err != nil {
+		return nil, err
+	}
+	return clean, nil
+}
+
+// validOriginPattern reports whether a pattern is an http or https origin, without a path,
+// whose host may hold * wildcards
+func validOriginPattern(pattern string) bool {
+	scheme, host, found := strings.Cut(pattern, "://")
+	if !found || (scheme != "http" && scheme != "https") {
+		return false
+	}
+	if host == "" || strings.ContainsAny(host, "/?#@ ") {
+		return false
+	}
+	_, err := url.Parse(scheme + "://" + strings.ReplaceAll(host, "*", "x"))
+	return err == nil
+}
+
+// parseHotlinkProtection decodes a bucket's stored hotlink_protection; nil when it is off
+func parseHotlinkProtection(raw json.RawMessage) *models.HotlinkProtection {
+	var protection *models.HotlinkProtection
+	if err := json.Unmarshal(raw, &protection); err != nil {
+		return nil
+	}
+	return protection
+}
+
+// hotlinkAllowed reports whether a request comes from a site hotlink protection allows:
+// its Origin, or else the origin of its Referer, must match an allowed pattern. Requests
+// sending neither are allowed only with allow_empty_referer.
+func hotlinkAllowed(r *http.Request, protection *models.HotlinkProtection) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		referer := r.Header.Get("Referer")
+		if referer == "" {
+			return protection.AllowEmptyReferer
+		}
+		u, err := url.Parse(referer)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return false
+		}
+		origin = u.Scheme + "://" + u.Host
+	}
+	return isOriginAllowed(strings.ToLower(origin), protection.AllowedReferers)
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"file-upload-service/models"
+
+	"go.uber.org/zap"
+)
+
+// imageHeaderLimit is how many leading bytes of an image are kept to read its dimensions.
+// JPEG metadata segments can push the frame header well past the first few kilobytes.
+const imageHeaderLimit = 256 << 10
+
+// decodableImageMimetypes are the image types whose dimensions can be read. Other images,
+// such as WebP or SVG, are stored without dimensions.
+var decodableImageMimetypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// headCapture keeps the first imageHeaderLimit bytes written to it and discards the rest,
+// so it can sit on a stream of any size
+type headCapture struct {
+	buf []byte
+}
+
+func (c *headCapture) Write(p []byte) (int, error) {
+	if room := imageHeaderLimit - len(c.buf); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		c.buf = append(c.buf, p[:room]...)
+	}
+	return len(p), nil
+}
+
+// imageDimensionColumns returns the image_width, image_height and image_format values
+// stored for dims; all NULL when dims is nil
+func imageDimensionColumns(dims *models.ImageDimensions) (sql.NullInt64, sql.NullInt64, sql.NullString) {
+	if dims == nil {
+		return sql.NullInt64{}, sql.NullInt64{}, sql.NullString{}
+	}
+	return sql.NullInt64{Int64: int64(dims.Width), Valid: true},
+		sql.NullInt64{Int64: int64(dims.Height), Valid: true},
+		sql.NullString{String: dims.Format, Valid: true}
+}
+
+// imageDimensions reads the width, height and format of an image from its leading bytes.
+// It returns nil for content that is not a decodable image, and for images whose header
+// cannot be decoded: those still upload, with the failure logged and no dimensions stored.
+func (h *FileHandler) imageDimensions(ctx context.Context, fileID, detectedMimetype string, head []byte) *models.ImageDimensions {
+	if !decodableImageMimetypes[detectedMimetype] {
+		return nil
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(head))
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to decode image dimensions",
+			zap.String("file_id", fileID),
+			zap.String("mimetype", detectedMimetype),
+			zap.Error(err),
+		)
+		return nil
+	}
+	return &models.ImageDimensions{Width: config.Width, Height: config.Height, Format: format}
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"file-upload-service/config"
+	"file-upload-service/logger"
+
+	"go.uber.org/zap"
+)
+
+// convertedFormats are the formats images may be converted to, most preferred first, with
+// the file extension their cached copies are stored under
+var convertedFormats = []struct {
+	Mimetype  string
+	Extension string
+}{
+	{"image/avif", ".avif"},
+	{"image/webp", ".webp"},
+}
+
+// convertibleImageMimetypes are the image types converted for browsers accepting smaller
+// formats. GIFs may be animated, which the conversion would lose.
+var convertibleImageMimetypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// ImageEncoder converts JPEG and PNG images to formats browsers may accept in their place
+type ImageEncoder interface {
+	// Encodes reports whether the encoder can produce images of mimetype
+	Encodes(mimetype string) bool
+	// Encode converts the image at srcPath to mimetype, writing it to dstPath
+	Encode(ctx context.Context, srcPath, dstPath, mimetype string) error
+}
+
+// newImageEncoder builds the encoder chosen by IMAGE_ENCODER; nil when images are not
+// converted, or when none of its tools can be found
+func newImageEncoder(cfg *config.Config) ImageEncoder {
+	if cfg.ImageEncoder != "cli" {
+		return nil
+	}
+	commands := make(map[string]string)
+	for mimetype, name := range map[string]string{"image/webp": cfg.CwebpPath, "image/avif": cfg.AvifencPath} {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			logger.Error("Image encoder not found; images will not be converted to "+mimetype, zap.String("command", name), zap.Error(err))
+			continue
+		}
+		commands[mimetype] = path
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	return &cliImageEncoder{commands: commands, timeout: cfg.ImageEncodeTimeout}
+}
+
+// cliImageEncoder converts images by running cwebp and avifenc
+type cliImageEncoder struct {
+	// commands holds the path of the tool making each mimetype
+	commands map[string]string
+	timeout  time.Duration
+}
+
+// Encodes reports whether the tool making mimetype was found
+func (e *cliImageEncoder) Encodes(mimetype string) bool {
+	_, ok := e.commands[mimetype]
+	return ok
+}
+
+// Encode runs the tool making mimetype on srcPath. It writes to a temp file beside
+// dstPath that is renamed into place once the tool succeeds, so readers never see a
+// partial image.
+func (e *cliImageEncoder) Encode(ctx context.Context, srcPath, dstPath, mimetype string) error {
+	command, ok := e.commands[mimetype]
+	if !ok {
+		return fmt.Errorf("no encoder for %s", mimetype)
+	}
+	switch mimetype {
+	case "image/webp":
+		return runTool(ctx, e.timeout, dstPath, command, func(tmpPath string) []string {
+			return []string{"-quiet", "-q", "80", "-metadata", "none", srcPath, "-o", tmpPath}
+		})
+	default:
+		return runTool(ctx, e.timeout, dstPath, command, func(tmpPath string) []string {
+			return []string{"--speed", "6", srcPath, tmpPath}
+		})
+	}
+}
+
+// runTool runs command with the arguments made for a temp file beside dstPath, which the
+// command is to write, and renames the temp file into place once it succeeds, so readers
+// never see a partial file. The temp file keeps the extension of dstPath, as tools choose
+// their output format by it. The command is killed after timeout.
+func runTool(ctx context.Context, timeout time.Duration, dstPath, command string, args func(tmpPath string) []string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(dstPath), filepath.Base(dstPath)+".tmp-*"+filepath.Ext(dstPath))
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+
+	if output, err := exec.CommandContext(ctx, command, args(tmpPath)...).CombinedOutput(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("%s: %w: %s", filepath.Base(command), err, strings.TrimSpace(string(output)))
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, dstPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// acceptedImageFormat returns the mimetype and extension of the most preferred format the
+// encoder makes that an Accept header lists by name. Wildcards are ignored: clients
+// sending */* do not necessarily decode either format.
+func acceptedImageFormat(accept string, encoder ImageEncoder) (string, string, bool) {
+	listed, _ := parseAcceptList(accept)
+	for _, format := range convertedFormats {
+		if listed[format.Mimetype] && encoder.Encodes(format.Mimetype) {
+			return format.Mimetype, format.Extension, true
+		}
+	}
+	return "", "", false
+}
+
+// parseAcceptList splits an Accept or Accept-Encoding header into the lowercased values it
+// lists with a positive quality and those it refuses with q=0
+func parseAcceptList(header string) (accepted, refused map[string]bool) {
+	accepted, refused = make(map[string]bool), make(map[string]bool)
+	for _, entry := range strings.Split(header, ",") {
+		params := strings.Split(entry, ";")
+		value := strings.ToLower(strings.TrimSpace(params[0]))
+		if value == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			name, raw, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				q, err := strconv.ParseFloat(raw, 64)
+				if err != nil {
+					q = 0
+				}
+				quality = q
+			}
+		}
+		if quality > 0 {
+			accepted[value] = true
+		} else {
+			refused[value] = true
+		}
+	}
+	return accepted, refused
+}
+
+// convertedKey returns the key the image at key, or the rendition of it at renditionKey
+// when set, is cached under once converted to the format of extension
+func convertedKey(key, renditionKey, extension string) string {
+	if renditionKey != "" {
+		return strings.TrimSuffix(renditionKey, ".jpg") + extension
+	}
+	return thumbnailDir + "/" + key + "/original" + extension
+}
+
+// openConverted opens the image at sourcePath converted to mimetype and cached at
+// convertedPath, converting it first when the cached copy is missing or older than the
+// source. The result is false when the converted image is no smaller than the source,
+// which is then better served as it is.
+func (h *PublicFileHandler) openConverted(ctx context.Context, sourcePath string, source os.FileInfo, convertedPath, mimetype string) (*os.File, bool, error) {
+	f, err := h.openDerived(ctx, convertedPath, source, func() error {
+		return h.encoder.Encode(ctx, sourcePath, convertedPath, mimetype)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	if info.Size() >= source.Size() {
+		f.Close()
+		return nil, false, nil
+	}
+	return f, true, nil
+}
+
+// convertedETag derives the ETag of a converted image from that of the image it was made
+// of and its format
+func convertedETag(etag, extension string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + strings.TrimPrefix(extension, ".") + `"`
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	"file-upload-service/models"
+
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// inlineUploadOverhead is how many bytes an inline upload body may carry besides the
+// encoded content: the other JSON fields, including escaped metadata
+const inlineUploadOverhead = 64 << 10
+
+// InlineUpload handles POST /files/inline - create a small file whose bytes are sent
+// base64-encoded in a JSON body. The request is validated like a signed URL request and
+// the file is stored and recorded in one call, as a direct upload is.
+func (h *FileHandler) InlineUpload(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if h.rejectCustomerKey(ctx, w, r) {
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	maxSize := h.config.InlineUploadMaxBytes
+	tooLarge := func() {
+		h.logRequest(ctx, "error", "Inline upload exceeds size limit", zap.Int64("max_size", maxSize))
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(errs.AppError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("File exceeds the inline upload limit of %d bytes; use POST /files/signed-url for larger files", maxSize),
+		})
+	}
+
+	maxBody := int64(base64.StdEncoding.EncodedLen(int(maxSize))) + inlineUploadOverhead
+	if r.ContentLength > maxBody {
+		tooLarge()
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+
+	var req models.InlineUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			tooLarge()
+			return
+		}
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+
+	if req.Content == "" {
+		h.logRequest(ctx, "error", "Missing required field: content")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("content is required"))
+		return
+	}
+	if int64(base64.StdEncoding.DecodedLen(len(req.Content))) > maxSize+2 {
+		tooLarge()
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(req.Content)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid base64 content", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("content must be standard base64"))
+		return
+	}
+	if int64(len(data)) > maxSize {
+		tooLarge()
+		return
+	}
+
+	upload, status, appErr := h.prepareUpload(ctx, clientID, models.CreateSignedURLRequest{
+		BucketID:        req.BucketID,
+		Key:             req.Key,
+		FileName:        req.FileName,
+		FileSize:        int64(len(data)),
+		Mimetype:        req.Mimetype,
+		OwnerEntityType: req.OwnerEntityType,
+		OwnerEntityID:   req.OwnerEntityID,
+		Metadata:        req.Metadata,
+		OnConflict:      req.OnConflict,
+	})
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+	tokenData := upload.TokenData
+
+	upload.DetectedMimetype = normalizeMimetype(http.DetectContentType(data))
+	if !tokenData.AllowMimetypeMismatch && !mimetypesMatch(req.Mimetype, upload.DetectedMimetype) {
+		h.logRequest(ctx, "error", "Uploaded content does not match declared mimetype",
+			zap.String("declared", req.Mimetype),
+			zap.String("detected", upload.DetectedMimetype),
+		)
+		writeMimetypeMismatch(w, req.Mimetype, upload.DetectedMimetype)
+		return
+	}
+	upload.Image = h.imageDimensions(ctx, tokenData.FileID, upload.DetectedMimetype, data)
+
+	// The bytes are in memory already, so the volume is checked for their real size
+	if !h.hasDiskSpace(uploadsRoot, int64(len(data))) {
+		h.logRequest(ctx, "error", "Not enough disk space for upload", zap.Int("file_size", len(data)))
+		writeInsufficientStorage(w)
+		return
+	}
+
+	h.logRequest(ctx, "info", "Processing inline upload",
+		zap.String("file_id", tokenData.FileID),
+		zap.String("client_id", clientID),
+		zap.Int("bucket_id", req.BucketID),
+		zap.String("key", upload.Key),
+	)
+
+	releaseWrite, ok := h.acquireUploadWrite(ctx, w, r, tokenData.FileID, filepath.Join(uploadsRoot, tokenData.FilePath))
+	if !ok {
+		return
+	}
+	outcome, existingID, written, err := h.storeDirectUpload(upload, req.OnConflict, data)
+	releaseWrite()
+	if err != nil {
+		if quotaErr, ok := asQuotaError(err); ok {
+			h.writeQuotaExceeded(ctx, w, quotaErr, "")
+			return
+		}
+		h.logRequest(ctx, "error", "Failed to store inline upload", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to save file"))
+		return
+	}
+	switch outcome {
+	case keyExists:
+		h.writeFileExistsConflict(ctx, w, existingID, upload.Key)
+		return
+	case keyExhausted:
+		h.logRequest(ctx, "error", "No free key left to rename to", zap.String("key", upload.Key))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.AppError{Code: http.StatusConflict, Message: keyConflictMessage(outcome)})
+		return
+	}
+	// A new version takes over the id of the stored file, and a rename may have moved
+	// the upload to another key
+	tokenData = upload.TokenData
+	filePath := filepath.Join(uploadsRoot, tokenData.FilePath)
+
+	scanStatus, signature := h.scanAfterUpload(ctx, tokenData.FileID, written, nil)
+	if scanStatus == models.ScanStatusInfected {
+		h.logRequest(ctx, "info", "Uploaded file quarantined", zap.String("file_id", tokenData.FileID), zap.String("signature", signature))
+		writeQuarantined(w, signature)
+		return
+	}
+
+	h.logRequest(ctx, "info", "File uploaded successfully",
+		zap.String("file_id", tokenData.FileID),
+		zap.String("client_id", clientID),
+		zap.Int("bucket_id", tokenData.BucketID),
+		zap.Int64("bytes_written", written),
+	)
+
+	// Same shape as a signed URL upload's response, plus the key the file ended up at
+	response := map[string]interface{}{
+		"message":    "File uploaded successfully",
+		"file_id":    tokenData.FileID,
+		"file_name":  tokenData.FileName,
+		"file_size":  written,
+		"bucket_id":  tokenData.BucketID,
+		"key":        upload.Key,
+		"saved_path": filePath,
+	}
+	if len(tokenData.Metadata) > 0 {
+		response["metadata"] = tokenData.Metadata
+	}
+	if scanStatus != "" {
+		response["scan_status"] = scanStatus
+	}
+	if upload.Image != nil {
+		response["image"] = upload.Image
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"file-upload-service/cache"
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"github.com/umakantv/go-utils/errs"
+	"go.uber.org/zap"
+)
+
+// Names of the leases guarding the periodic background jobs
+const (
+	uploadGroupSweeperLease = "upload-group-sweeper"
+	snapshotSweeperLease    = "snapshot-sweeper"
+	fileEventSweeperLease   = "file-event-sweeper"
+	scanSweeperLease        = "scan-sweeper"
+	inactivitySweeperLease  = "inactivity-sweeper"
+	objectSweeperLease      = "storage-object-sweeper"
+	thumbnailSweeperLease   = "thumbnail-sweeper"
+	redemptionSweeperLease  = "download-redemption-sweeper"
+)
+
+// mimetypeBackfillLease names the lease guarding one backfill job
+func mimetypeBackfillLease(jobID string) string {
+	return "mimetype-backfill:" + jobID
+}
+
+// deleteJobLease names the lease guarding one delete-by-path job
+func deleteJobLease(jobID string) string {
+	return "delete-job:" + jobID
+}
+
+// archiveExpansionLease names the lease guarding one archive expansion
+func archiveExpansionLease(jobID string) string {
+	return "archive-expansion:" + jobID
+}
+
+// heldLease is a lease this instance holds. Its context is cancelled when a renewal
+// fails, so a job running under it stops at its next check.
+type heldLease struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// JobLeases makes each named background job run on one instance at a time when several
+// replicas share the cache. An instance that takes a lease keeps renewing it every third
+// of its TTL until it gives it up or a renewal fails; a crashed holder's lease lapses
+// after the TTL and the next instance to try takes over. Jobs must still be idempotent per
+// item: a holder that loses its lease mid-batch stops, and the new holder may redo the
+// items of that batch.
+type JobLeases struct {
+	store      cache.LeaseStore
+	instanceID string
+	ttl        time.Duration
+
+	mu      sync.Mutex
+	held    map[string]*heldLease
+	running map[string]bool
+	// names is every periodic lease and every one-off lease this instance is trying, for
+	// ListJobLeases
+	names map[string]bool
+}
+
+// NewJobLeases creates job leases held under instanceID
+func NewJobLeases(store cache.LeaseStore, instanceID string, ttl time.Duration) *JobLeases {
+	return &JobLeases{
+		store:      store,
+		instanceID: instanceID,
+		ttl:        ttl,
+		held:       make(map[string]*heldLease),
+		running:    make(map[string]bool),
+		names: map[string]bool{
+			uploadGroupSweeperLease: true,
+			snapshotSweeperLease:    true,
+			fileEventSweeperLease:   true,
+			inactivitySweeperLease:  true,
+			objectSweeperLease:      true,
+			thumbnailSweeperLease:   true,
+		},
+	}
+}
+
+// hold returns a context that stays live while this instance holds the named lease,
+// taking the lease if it is free. It returns nil when another instance holds it.
+func (j *JobLeases) hold(name string) context.Context {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.names[name] = true
+	if lease := j.held[name]; lease != nil && lease.ctx.Err() == nil {
+		return lease.ctx
+	}
+
+	acquired, err := j.store.Acquire(name, j.instanceID, j.ttl)
+	if err != nil {
+		logger.Error("Failed to acquire job lease", zap.String("lease", name), zap.Error(err))
+		return nil
+	}
+	if !acquired {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lease := &heldLease{ctx: ctx, cancel: cancel}
+	j.held[name] = lease
+	logger.Info("Acquired job lease", zap.String("lease", name), zap.String("instance_id", j.instanceID))
+
+	go j.keepAlive(name, lease)
+	return ctx
+}
+
+// keepAlive renews the lease until it is released or a renewal fails. A failed renewal
+// cancels the lease's context: this instance can no longer be sure it is the only one
+// running the job.
+func (j *JobLeases) keepAlive(name string, lease *heldLease) {
+	ticker := time.NewTicker(j.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lease.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		renewed, err := j.store.Renew(name, j.instanceID, j.ttl)
+		if err == nil && renewed {
+			continue
+		}
+
+		j.mu.Lock()
+		if j.held[name] == lease {
+			delete(j.held, name)
+		}
+		j.mu.Unlock()
+		lease.cancel()
+		logger.Error("Lost job lease; stopping its job",
+			zap.String("lease", name),
+			zap.String("instance_id", j.instanceID),
+			zap.Error(err),
+		)
+		return
+	}
+}
+
+// release gives up the named lease if this instance holds it
+func (j *JobLeases) release(name string) {
+	j.mu.Lock()
+	lease := j.held[name]
+	delete(j.held, name)
+	j.mu.Unlock()
+	if lease == nil {
+		return
+	}
+
+	lease.cancel()
+	if err := j.store.Release(name, j.instanceID); err != nil {
+		logger.Error("Failed to release job lease", zap.String("lease", name), zap.Error(err))
+		return
+	}
+	logger.Info("Released job lease", zap.String("lease", name), zap.String("instance_id", j.instanceID))
+}
+
+// runPeriodic runs one pass of a periodic job if this instance holds, or can take, its
+// lease. The lease is kept between passes so the job stays on one instance until it
+// stops renewing.
+func (j *JobLeases) runPeriodic(name string, job func(ctx context.Context)) {
+	if ctx := j.hold(name); ctx != nil {
+		job(ctx)
+	}
+}
+
+// runOnce runs a job that finishes, such as a backfill, under its lease and releases the
+// lease afterwards. It does nothing if the job is already running on this instance or
+// another instance holds the lease.
+func (j *JobLeases) runOnce(name string, job func(ctx context.Context)) {
+	j.mu.Lock()
+	if j.running[name] {
+		j.mu.Unlock()
+		return
+	}
+	j.running[name] = true
+	j.mu.Unlock()
+
+	defer func() {
+		j.mu.Lock()
+		delete(j.running, name)
+		delete(j.names, name)
+		j.mu.Unlock()
+	}()
+
+	ctx := j.hold(name)
+	if ctx == nil {
+		return
+	}
+	job(ctx)
+	j.release(name)
+}
+
+// jobLeaseNames lists the leases this instance knows of, in name order
+func (j *JobLeases) jobLeaseNames() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	names := make([]string, 0, len(j.names))
+	for name := range j.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ListJobLeases handles GET /admin/job-leases - which instance holds each background job
+// lease this instance knows of, for checking that replicas split the jobs as expected
+func (h *FileHandler) ListJobLeases(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(ctx, w) {
+		return
+	}
+
+	response := models.JobLeaseListResponse{
+		InstanceID: h.jobs.instanceID,
+		Leases:     []models.JobLease{},
+	}
+	for _, name := range h.jobs.jobLeaseNames() {
+		holder, ttl, err := h.jobs.store.Holder(name)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to read job lease", zap.String("lease", name), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to read job leases"))
+			return
+		}
+		response.Leases = append(response.Leases, models.JobLease{
+			Name:      name,
+			Holder:    holder,
+			HeldHere:  holder == h.jobs.instanceID,
+			ExpiresIn: ttl.Milliseconds(),
+		})
+	}
+
+	h.logRequest(ctx, "info", "Listed job leases", zap.Int("count", len(response.Leases)))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
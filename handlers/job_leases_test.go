@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"file-upload-service/models"
+)
+
+func TestRunPeriodicSkipsLeaseHeldElsewhere(t *testing.T) {
+	store := newMemoryLeaseStore()
+	jobs := NewJobLeases(store, "a", time.Minute)
+	store.Acquire(snapshotSweeperLease, "b", time.Minute)
+
+	ran := false
+	jobs.runPeriodic(snapshotSweeperLease, func(ctx context.Context) { ran = true })
+	if ran {
+		t.Fatal("job ran while another instance held its lease")
+	}
+
+	store.Release(snapshotSweeperLease, "b")
+	jobs.runPeriodic(snapshotSweeperLease, func(ctx context.Context) { ran = true })
+	if !ran {
+		t.Fatal("job did not run once its lease was free")
+	}
+	if holder, _, _ := store.Holder(snapshotSweeperLease); holder != "a" {
+		t.Fatalf("holder = %q, want the periodic lease kept by a", holder)
+	}
+}
+
+func TestRunOnceReleasesLease(t *testing.T) {
+	store := newMemoryLeaseStore()
+	jobs := NewJobLeases(store, "a", time.Minute)
+
+	name := mimetypeBackfillLease("job-1")
+	ran := false
+	jobs.runOnce(name, func(ctx context.Context) {
+		if holder, _, _ := store.Holder(name); holder != "a" {
+			t.Errorf("holder while running = %q, want a", holder)
+		}
+		ran = true
+	})
+	if !ran {
+		t.Fatal("job did not run")
+	}
+	if holder, _, _ := store.Holder(name); holder != "" {
+		t.Fatalf("holder after the job = %q, want the lease released", holder)
+	}
+}
+
+func TestLostLeaseCancelsJob(t *testing.T) {
+	store := newMemoryLeaseStore()
+	jobs := NewJobLeases(store, "a", 60*time.Millisecond)
+
+	ctx := jobs.hold(uploadGroupSweeperLease)
+	if ctx == nil {
+		t.Fatal("free lease was not taken")
+	}
+
+	// Another instance takes over, as after a lapse
+	store.Release(uploadGroupSweeperLease, "a")
+	store.Acquire(uploadGroupSweeperLease, "b", time.Minute)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("job context not cancelled after its lease was lost")
+	}
+	if holder, _, _ := store.Holder(uploadGroupSweeperLease); holder != "b" {
+		t.Fatalf("holder = %q, want the new holder untouched", holder)
+	}
+}
+
+func TestListJobLeases(t *testing.T) {
+	env := newTestEnv(t)
+	env.leases.Acquire(fileEventSweeperLease, "other", time.Minute)
+	env.files.jobs.runPeriodic(snapshotSweeperLease, func(ctx context.Context) {})
+
+	w := serveAdmin(env.files.ListJobLeases, newRequest(http.MethodGet, "/admin/job-leases", nil), nil)
+	expectStatus(t, w, http.StatusOK)
+
+	var resp models.JobLeaseListResponse
+	decode(t, w, &resp)
+	if resp.InstanceID != "instance-test" {
+		t.Fatalf("instance_id = %q", resp.InstanceID)
+	}
+	leases := make(map[string]models.JobLease)
+	for _, lease := range resp.Leases {
+		leases[lease.Name] = lease
+	}
+	if lease := leases[snapshotSweeperLease]; !lease.HeldHere || lease.ExpiresIn <= 0 {
+		t.Fatalf("snapshot sweeper lease = %+v, want held here", lease)
+	}
+	if lease := leases[fileEventSweeperLease]; lease.Holder != "other" || lease.HeldHere {
+		t.Fatalf("file event sweeper lease = %+v, want held by other", lease)
+	}
+	if lease, ok := leases[uploadGroupSweeperLease]; !ok || lease.Holder != "" {
+		t.Fatalf("upload group sweeper lease = %+v, want listed and free", lease)
+	}
+
+	w = env.serve(env.files.ListJobLeases, newRequest(http.MethodGet, "/admin/job-leases", nil), nil)
+	expectStatus(t, w, http.StatusForbidden)
+}
+
+func TestDeleteJobWaitsForLease(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.MaxSyncRows = 2
+	bucketID := env.createBucket("photos")
+	for i := 0; i < 3; i++ {
+		env.putFile(bucketID, fmt.Sprintf("docs/%d.txt", i), []byte("x"))
+	}
+	env.db.MustExec(
+		"INSERT INTO delete_jobs (id, client_id, bucket_id, path, status, matched, created_at, updated_at) VALUES ('job-1', ?, ?, 'docs', ?, 3, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)",
+		env.clientID, bucketID, models.DeleteJobStatusQueued,
+	)
+
+	// Another replica is running the job, so this one leaves it alone
+	env.leases.Acquire(deleteJobLease("job-1"), "other", time.Minute)
+	env.files.resumeDeleteJobs()
+	time.Sleep(100 * time.Millisecond)
+	var status string
+	if err := env.db.Get(&status, "SELECT status FROM delete_jobs WHERE id = 'job-1'"); err != nil {
+		t.Fatal(err)
+	}
+	if status != models.DeleteJobStatusQueued {
+		t.Fatalf("status = %q while another instance holds the lease, want queued", status)
+	}
+
+	// Once the lease is free the job is resumed and finished here
+	env.leases.Release(deleteJobLease("job-1"), "other")
+	env.files.resumeDeleteJobs()
+	var job models.DeleteJob
+	eventually(t, func() bool {
+		w := env.serve(env.files.GetDeleteJob, newRequest(http.MethodGet, "/files/delete-jobs/job-1", nil),
+			map[string]string{"id": "job-1"})
+		decode(t, w, &job)
+		return job.Status == models.DeleteJobStatusCompleted
+	})
+	if job.Deleted != 3 {
+		t.Fatalf("job = %+v, want 3 deleted", job)
+	}
+	eventually(t, func() bool {
+		holder, _, _ := env.leases.Holder(deleteJobLease("job-1"))
+		return holder == ""
+	})
+}
@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/umakantv/go-utils/errs"
+	"go.uber.org/zap"
+)
+
+// maxKeyLength is the longest key accepted, in bytes after percent-decoding
+const maxKeyLength = 1024
+
+const (
+	// defaultMaxKeyDepth is how many slash-separated segments a new key may have in a
+	// bucket created without max_key_depth
+	defaultMaxKeyDepth = 20
+	// maxKeyDepthLimit is the highest max_key_depth a bucket may set; a key of
+	// maxKeyLength bytes cannot have more segments
+	maxKeyDepthLimit = maxKeyLength / 2
+)
+
+var (
+	errKeyRequired        = errors.New("key is required")
+	errInvalidKeyEncoding = errors.New("key contains an invalid percent-encoding")
+	errEncodedTraversal   = errors.New("key must not contain encoded '.', '/' or '\\' characters")
+	errDotSegment         = errors.New("key must not contain '.' or '..' segments")
+	errBackslash          = errors.New("key must not contain '\\'")
+	errKeyTooLong         = fmt.Errorf("key must not be longer than %d bytes", maxKeyLength)
+	errAbsoluteKey        = errors.New("key must be a relative path")
+	errEmptySegment       = errors.New("key must not contain empty segments")
+	errKeyOutsideBucket   = errors.New("key resolves outside the bucket")
+)
+
+// windowsVolumePattern matches a drive letter prefix such as "C:"
+var windowsVolumePattern = regexp.MustCompile(`^[A-Za-z]:`)
+
+// canonicalizeKey reduces any equivalent spelling of an object key to the single form
+// stored in the files table. It percent-decodes the key once, collapses duplicate
+// slashes, strips leading and trailing slashes and lowercases it when the bucket asks
+// for case-insensitive keys. Dot segments and still-encoded separators are rejected
+// rather than resolved so a key can never climb out of its bucket directory.
+// Listing and delete paths are prefixes and go through this directly; keys that name
+// a single object go through the stricter sanitizeKey.
+func canonicalizeKey(raw string, lowercase bool) (string, error) {
+	decoded, err := url.PathUnescape(raw)
+	if err != nil {
+		return "", errInvalidKeyEncoding
+	}
+	return canonicalizeDecodedKey(decoded, lowercase)
+}
+
+// canonicalizeDecodedKey is canonicalizeKey for a key that was percent-decoded already,
+// such as a route variable or a stored key, so a literal '%' in it stays as it is
+func canonicalizeDecodedKey(decoded string, lowercase bool) (string, error) {
+	if len(decoded) > maxKeyLength {
+		return "", errKeyTooLong
+	}
+	if strings.Contains(decoded, "\\") {
+		return "", errBackslash
+	}
+
+	// A second layer of encoding (e.g. %252e) survives one decode as %2e; refuse it
+	lowered := strings.ToLower(decoded)
+	for _, encoded := range []string{"%2e", "%2f", "%5c"} {
+		if strings.Contains(lowered, encoded) {
+			return "", errEncodedTraversal
+		}
+	}
+
+	segments := strings.Split(decoded, "/")
+	parts := segments[:0]
+	for _, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		if segment == "." || segment == ".." {
+			return "", errDotSegment
+		}
+		parts = append(parts, segment)
+	}
+
+	key := strings.Join(parts, "/")
+	if lowercase {
+		key = strings.ToLower(key)
+	}
+	return key, nil
+}
+
+// sanitizeKey validates and canonicalizes the key of a single object. On top of what
+// canonicalizeKey rejects, the key must already be a clean relative path: absolute
+// paths (a leading slash or a drive letter) and empty segments are refused rather
+// than collapsed.
+func sanitizeKey(raw string, lowercase bool) (string, error) {
+	decoded, err := url.PathUnescape(raw)
+	if err != nil {
+		return "", errInvalidKeyEncoding
+	}
+	return sanitizeDecodedKey(decoded, lowercase)
+}
+
+// sanitizeDecodedKey is sanitizeKey for a key that was percent-decoded already. The
+// router decodes the file path of the public route, which must not be decoded again.
+func sanitizeDecodedKey(decoded string, lowercase bool) (string, error) {
+	if decoded == "" {
+		return "", errKeyRequired
+	}
+	if strings.HasPrefix(decoded, "/") || windowsVolumePattern.MatchString(decoded) {
+		return "", errAbsoluteKey
+	}
+	for _, segment := range strings.Split(decoded, "/") {
+		if segment == "" {
+			return "", errEmptySegment
+		}
+	}
+	return canonicalizeDecodedKey(decoded, lowercase)
+}
+
+// bucketFilePath returns where a sanitized key of a bucket is stored and checks that
+// the result is still inside the bucket's directory under the uploads root — a last
+// line of defence should a key, or a client or bucket name, slip past validation.
+func bucketFilePath(clientName, bucketName, key string) (string, error) {
+	bucketDir, err := bucketDirPath(clientName, bucketName)
+	if err != nil {
+		return "", err
+	}
+	fullPath := filepath.Join(bucketDir, key)
+	if !strings.HasPrefix(fullPath, bucketDir+string(filepath.Separator)) {
+		return "", errKeyOutsideBucket
+	}
+	return fullPath, nil
+}
+
+// bucketDirPath returns the directory a bucket's files are stored in, checking that it is
+// a directory under the uploads root
+func bucketDirPath(clientName, bucketName string) (string, error) {
+	root := filepath.Clean(uploadsRoot)
+	bucketDir := filepath.Join(root, clientName, bucketName)
+	if !strings.HasPrefix(bucketDir, root+string(filepath.Separator)) {
+		return "", errKeyOutsideBucket
+	}
+	return bucketDir, nil
+}
+
+// keyDepth returns how many slash-separated segments a canonical key has
+func keyDepth(key string) int {
+	return strings.Count(key, "/") + 1
+}
+
+// topLevelFolder returns the first segment of a canonical key, or "" for a key at the
+// root of the bucket
+func topLevelFolder(key string) string {
+	folder, _, found := strings.Cut(key, "/")
+	if !found {
+		return ""
+	}
+	return folder
+}
+
+// validateKeyLimits checks the max_key_depth and max_top_level_folders of a bucket
+// create or update request; nil values are left unchecked
+func validateKeyLimits(maxKeyDepth, maxTopLevelFolders *int) error {
+	if maxKeyDepth != nil && (*maxKeyDepth < 1 || *maxKeyDepth > maxKeyDepthLimit) {
+		return fmt.Errorf("max_key_depth must be between 1 and %d", maxKeyDepthLimit)
+	}
+	if maxTopLevelFolders != nil && *maxTopLevelFolders < 0 {
+		return errors.New("max_top_level_folders must be 0 (no limit) or greater")
+	}
+	return nil
+}
+
+// checkKeyLimits enforces a bucket's key limits on a new key. Keys already stored are
+// never checked, so files written before a limit was lowered keep working; only new
+// writes are refused. It returns the HTTP status and error body when the key is refused.
+func checkKeyLimits(q sqlx.Queryer, bucketID int, key string, maxKeyDepth, maxTopLevelFolders int) (int, *errs.AppError) {
+	if depth := keyDepth(key); depth > maxKeyDepth {
+		return http.StatusBadRequest, errs.NewValidationError(fmt.Sprintf(
+			"key has %d segments; this bucket allows at most %d (max_key_depth)", depth, maxKeyDepth,
+		))
+	}
+
+	folder := topLevelFolder(key)
+	if maxTopLevelFolders == 0 || folder == "" {
+		return 0, nil
+	}
+	condition, args := keyPrefixCondition("key", folder)
+	var exists bool
+	err := q.QueryRowx(
+		"SELECT EXISTS (SELECT 1 FROM files WHERE bucket_id = ? AND status <> ? AND "+condition+")",
+		append([]interface{}{bucketID, models.FileStatusDeleted}, args...)...,
+	).Scan(&exists)
+	if err != nil {
+		return http.StatusInternalServerError, errs.NewInternalServerError("Failed to check key limits")
+	}
+	if exists {
+		return 0, nil
+	}
+
+	var folders int
+	err = q.QueryRowx(
+		"SELECT COUNT(DISTINCT substr(key, 1, instr(key, '/') - 1)) FROM files WHERE bucket_id = ? AND status <> ? AND instr(key, '/') > 0",
+		bucketID, models.FileStatusDeleted,
+	).Scan(&folders)
+	if err != nil {
+		return http.StatusInternalServerError, errs.NewInternalServerError("Failed to check key limits")
+	}
+	if folders >= maxTopLevelFolders {
+		return http.StatusConflict, &errs.AppError{
+			Code: http.StatusConflict,
+			Message: fmt.Sprintf(
+				"key would add top-level folder %q; this bucket already has %d of at most %d (max_top_level_folders)",
+				folder, folders, maxTopLevelFolders,
+			),
+		}
+	}
+	return 0, nil
+}
+
+// likeEscaper escapes LIKE metacharacters so a key matches itself literally. Keys
+// can never contain a backslash, which makes it a safe escape character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// keyPrefixCondition returns a WHERE fragment matching every key under the canonical
+// path prefix, along with its arguments. SQLite's LIKE is case-insensitive, so on its
+// own it cannot seek the (bucket_id, key) index; the range bound does, and '0' is the
+// byte after '/' so the range ends exactly where the prefix does. The escaped LIKE
+// keeps '%' and '_' in user keys from acting as wildcards.
+func keyPrefixCondition(column, prefix string) (string, []interface{}) {
+	condition := fmt.Sprintf(`%[1]s >= ? AND %[1]s < ? AND %[1]s LIKE ? ESCAPE '\'`, column)
+	return condition, []interface{}{prefix + "/", prefix + "0", likeEscaper.Replace(prefix) + "/%"}
+}
+
+// ReportNonCanonicalKeys logs every live file whose stored key differs from its
+// canonical form. It runs after migrations so operators can find records written
+// before keys were canonicalized; nothing is rewritten.
+func ReportNonCanonicalKeys(db *sqlx.DB) {
+	rows, err := db.Query(
+		`SELECT f.id, f.bucket_id, f.key, b.lowercase_keys
+		FROM files f
+		JOIN buckets b ON b.id = f.bucket_id
+		WHERE f.deleted_at IS NULL`,
+	)
+	if err != nil {
+		logger.Error("Failed to scan file keys for canonical form", zap.Error(err))
+		return
+	}
+	defer rows.Close()
+
+	found := 0
+	for rows.Next() {
+		var fileID, key string
+		var bucketID, lowercaseInt int
+		if err := rows.Scan(&fileID, &bucketID, &key, &lowercaseInt); err != nil {
+			logger.Error("Failed to scan file key row", zap.Error(err))
+			continue
+		}
+
+		canonical, err := canonicalizeDecodedKey(key, lowercaseInt != 0)
+		if err == nil && canonical == key {
+			continue
+		}
+
+		found++
+		fields := []zap.Field{
+			zap.String("file_id", fileID),
+			zap.Int("bucket_id", bucketID),
+			zap.String("key", key),
+		}
+		if err != nil {
+			fields = append(fields, zap.String("reason", err.Error()))
+		} else {
+			fields = append(fields, zap.String("canonical_key", canonical))
+		}
+		logger.Error("Stored file key is not canonical", fields...)
+	}
+
+	if found > 0 {
+		logger.Error("Files with non-canonical keys found; they may be unreachable by key", zap.Int("count", found))
+		return
+	}
+	logger.Info("All stored file keys are canonical")
+}
+
+// uppercaseKeys counts the live files of a bucket whose keys are not all lowercase and
+// returns one of those keys. SQLite's GLOB narrows the scan to keys with an ASCII capital
+// or a non-ASCII byte; strings.ToLower decides for the rest.
+func uppercaseKeys(q sqlx.Queryer, bucketID int) (count int, example string, err error) {
+	rows, err := q.Query(
+		"SELECT key FROM files WHERE bucket_id = ? AND status <> ? AND (key GLOB '*[A-Z]*' OR key GLOB '*[^ -~]*') ORDER BY key",
+		bucketID, models.FileStatusDeleted,
+	)
+	if err != nil {
+		return 0, "", err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return 0, "", err
+		}
+		if strings.ToLower(key) == key {
+			continue
+		}
+		if count == 0 {
+			example = key
+		}
+		count++
+	}
+	return count, example, rows.Err()
+}
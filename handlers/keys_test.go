@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"file-upload-service/api"
+	"file-upload-service/models"
+)
+
+func TestGenerateSignedURLRejectsTraversalKeys(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+
+	keys := []string{
+		"../secret.txt",
+		"docs/../../secret.txt",
+		"%2e%2e/secret.txt",
+		"%252e%252e/secret.txt",
+		"/etc/passwd",
+		"C:/windows/win.ini",
+		`docs\secret.txt`,
+		"docs//secret.txt",
+		"./secret.txt",
+	}
+	for _, key := range keys {
+		w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, key, 64)), nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("key %q: status = %d, want 400; body: %s", key, w.Code, w.Body.String())
+		}
+	}
+
+	var count int
+	if err := env.db.Get(&count, "SELECT COUNT(*) FROM files"); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("%d file rows created for rejected keys", count)
+	}
+}
+
+func TestGenerateSignedURLRejectsOverlongKey(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+
+	key := make([]byte, maxKeyLength+1)
+	for i := range key {
+		key[i] = 'a'
+	}
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, string(key), 64)), nil)
+	expectStatus(t, w, http.StatusBadRequest)
+}
+
+func TestServePublicFileRejectsTraversalPaths(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.db.MustExec(`UPDATE buckets SET public_paths = '["pub/*"]' WHERE id = ?`, bucketID)
+	env.putFile(bucketID, "pub/a.txt", []byte("public"))
+
+	for _, path := range []string{"pub/../../../test.db", "pub/%2e%2e/a.txt", `pub\a.txt`, "pub//a.txt"} {
+		w := serveAnonymous(env.public.ServePublicFile, newRequest(http.MethodGet, "/files/photos/x", nil),
+			map[string]string{"bucket_name": "photos", "file_path": path})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("path %q: status = %d, want 400; body: %s", path, w.Code, w.Body.String())
+		}
+	}
+
+	w := serveAnonymous(env.public.ServePublicFile, newRequest(http.MethodGet, "/files/photos/pub/a.txt", nil),
+		map[string]string{"bucket_name": "photos", "file_path": "pub/a.txt"})
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != "public" {
+		t.Fatalf("body = %q, want the stored content", w.Body.String())
+	}
+}
+
+func TestBucketFilePathStaysInsideBucket(t *testing.T) {
+	if _, err := bucketFilePath("client", "photos", "docs/a.txt"); err != nil {
+		t.Fatalf("valid key rejected: %v", err)
+	}
+	for _, tc := range []struct{ client, bucket, key string }{
+		{"client", "photos", "../other/a.txt"},
+		{"client", "..", "a.txt"},
+		{"..", "photos", "a.txt"},
+		{"client", "photos", ""},
+	} {
+		if _, err := bucketFilePath(tc.client, tc.bucket, tc.key); err == nil {
+			t.Errorf("bucketFilePath(%q, %q, %q) accepted a path outside the bucket", tc.client, tc.bucket, tc.key)
+		}
+	}
+}
+
+func TestListFilesMatchesPathPrefixLiterally(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	for _, key := range []string{"a_b/1.txt", "axb/2.txt", "Docs/5.txt", "docs/6.txt", "docs0/7.txt"} {
+		env.putFile(bucketID, key, []byte("x"))
+	}
+
+	for path, want := range map[string]string{
+		"a_b":  "a_b/1.txt",
+		"docs": "docs/6.txt",
+		"Docs": "Docs/5.txt",
+	} {
+		w := env.serve(env.files.ListFiles, newRequest(http.MethodGet, "/buckets/1/files?path="+url.QueryEscape(path), nil),
+			map[string]string{"id": strconv.Itoa(bucketID)})
+		expectStatus(t, w, http.StatusOK)
+
+		var resp models.ListFilesResponse
+		decode(t, w, &resp)
+		if len(resp.Items) != 1 || resp.Items[0].Key != want {
+			t.Errorf("path %q listed %+v, want only %s", path, resp.Items, want)
+		}
+	}
+}
+
+func TestDeleteFilesByPathMatchesPrefixLiterally(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	id := env.putFile(bucketID, "a_b/1.txt", []byte("x"))
+	env.putFile(bucketID, "axb/2.txt", []byte("x"))
+	env.putFile(bucketID, "A_B/3.txt", []byte("x"))
+
+	path := "a_b"
+	w := env.serve(env.files.DeleteFiles, newRequest(http.MethodDelete, "/files",
+		models.DeleteFilesRequest{BucketID: &bucketID, Path: &path}), nil)
+	expectStatus(t, w, http.StatusOK)
+
+	var resp models.DeleteFilesResponse
+	decode(t, w, &resp)
+	if len(resp.Deleted) != 1 || resp.Deleted[0] != id {
+		t.Fatalf("deleted %v, want only [%s]", resp.Deleted, id)
+	}
+}
+
+func TestKeyPrefixConditionSeeksKeyIndex(t *testing.T) {
+	env := newTestEnv(t)
+	condition, args := keyPrefixCondition("key", "docs")
+
+	rows, err := env.db.Query("EXPLAIN QUERY PLAN SELECT id FROM files WHERE bucket_id = ? AND "+condition, append([]interface{}{1}, args...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var plan []string
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			t.Fatal(err)
+		}
+		plan = append(plan, detail)
+	}
+	if len(plan) == 0 || !strings.Contains(plan[0], "idx_files_key (bucket_id=? AND key>? AND key<?)") {
+		t.Fatalf("query plan = %q, want a range seek on idx_files_key", plan)
+	}
+}
+
+// servePublic requests a file path of a bucket on the public route, as decoded by the router
+func (e *testEnv) servePublic(bucketName, filePath string) *httptest.ResponseRecorder {
+	return serveAnonymous(e.public.ServePublicFile, newRequest(http.MethodGet, "/files/"+bucketName+"/"+url.PathEscape(filePath), nil),
+		map[string]string{"bucket_name": bucketName, "file_path": filePath})
+}
+
+func TestKeySpellingsAddressOneFileAcrossEndpoints(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.db.MustExec(`UPDATE buckets SET public_paths = '["pub/*"]' WHERE id = ?`, bucketID)
+
+	signed := env.signedUpload(signedURLRequest(bucketID, "pub/%72eport.txt", 6))
+	w := serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, []byte("report")), nil)
+	expectStatus(t, w, http.StatusOK)
+	if _, err := os.Stat(env.diskPath(bucketID, "pub/report.txt")); err != nil {
+		t.Fatalf("encoded key was not stored as pub/report.txt: %v", err)
+	}
+
+	if keys := env.liveKeys(bucketID, url.QueryEscape("/pub//")); len(keys) != 1 || keys[0] != "pub/report.txt" {
+		t.Fatalf("listing /pub// = %v, want [pub/report.txt]", keys)
+	}
+
+	w = env.servePublic("photos", "pub/report.txt")
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != "report" {
+		t.Fatalf("served %q, want the stored content", w.Body.String())
+	}
+
+	// The same key in the JSON body cannot be uploaded a second time
+	w = env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, "pub/report.txt", 6)), nil)
+	expectStatus(t, w, http.StatusConflict)
+
+	path := "//pub//"
+	w = env.serve(env.files.DeleteFiles, newRequest(http.MethodDelete, "/files",
+		models.DeleteFilesRequest{BucketID: &bucketID, Path: &path}), nil)
+	expectStatus(t, w, http.StatusOK)
+	var deleted models.DeleteFilesResponse
+	decode(t, w, &deleted)
+	if len(deleted.Deleted) != 1 || deleted.Deleted[0] != signed.FileID {
+		t.Fatalf("deleting //pub// deleted %v, want [%s]", deleted.Deleted, signed.FileID)
+	}
+	expectStatus(t, env.servePublic("photos", "pub/report.txt"), http.StatusNotFound)
+}
+
+func TestKeyWithLiteralPercentIsServed(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.db.MustExec(`UPDATE buckets SET public_paths = '["pub/*"]' WHERE id = ?`, bucketID)
+
+	signed := env.signedUpload(signedURLRequest(bucketID, "pub/100%25.txt", 4))
+	w := serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, []byte("full")), nil)
+	expectStatus(t, w, http.StatusOK)
+
+	if keys := env.liveKeys(bucketID, "pub"); len(keys) != 1 || keys[0] != "pub/100%.txt" {
+		t.Fatalf("listing pub = %v, want [pub/100%%.txt]", keys)
+	}
+
+	// The router hands over /files/photos/pub/100%25.txt decoded; it is not decoded again
+	w = env.servePublic("photos", "pub/100%.txt")
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != "full" {
+		t.Fatalf("served %q, want the stored content", w.Body.String())
+	}
+	expectStatus(t, env.servePublic("photos", "pub/100%25.txt"), http.StatusNotFound)
+}
+
+func TestLowercaseKeysBucketAcrossEndpoints(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("docs")
+	env.db.MustExec(`UPDATE buckets SET public_paths = '["pub/*"]', lowercase_keys = 1 WHERE id = ?`, bucketID)
+
+	signed := env.signedUpload(signedURLRequest(bucketID, "Pub/ReadMe.TXT", 6))
+	w := serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, []byte("readme")), nil)
+	expectStatus(t, w, http.StatusOK)
+
+	if keys := env.liveKeys(bucketID, "PUB"); len(keys) != 1 || keys[0] != "pub/readme.txt" {
+		t.Fatalf("listing PUB = %v, want [pub/readme.txt]", keys)
+	}
+	w = env.servePublic("docs", "PUB/README.txt")
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != "readme" {
+		t.Fatalf("served %q, want the stored content", w.Body.String())
+	}
+}
+
+func TestLowercaseKeysRefusedWhileUppercaseKeysExist(t *testing.T) {
+	env := newTestEnv(t)
+	buckets := NewBucketHandler(env.db, api.NewPager(env.cfg.PaginationSecret))
+	bucketID := env.createBucket("docs")
+	upper := env.putFile(bucketID, "Docs/ReadMe.txt", []byte("x"))
+	env.putFile(bucketID, "docs/lower.txt", []byte("x"))
+
+	patch := func() *httptest.ResponseRecorder {
+		return env.serve(buckets.PatchBucket, newRequest(http.MethodPatch, "/buckets/1", map[string]interface{}{"lowercase_keys": true}),
+			map[string]string{"id": strconv.Itoa(bucketID)})
+	}
+
+	w := patch()
+	expectStatus(t, w, http.StatusConflict)
+	if !strings.Contains(w.Body.String(), "Docs/ReadMe.txt") {
+		t.Fatalf("refusal %s does not name the key", w.Body.String())
+	}
+	var lowercase bool
+	if err := env.db.Get(&lowercase, "SELECT lowercase_keys FROM buckets WHERE id = ?", bucketID); err != nil {
+		t.Fatal(err)
+	}
+	if lowercase {
+		t.Fatal("lowercase_keys was turned on despite the refusal")
+	}
+
+	env.db.MustExec("UPDATE files SET status = ?, deleted_at = CURRENT_TIMESTAMP WHERE id = ?", models.FileStatusDeleted, upper)
+	w = patch()
+	expectStatus(t, w, http.StatusOK)
+	var bucket models.Bucket
+	decode(t, w, &bucket)
+	if !bucket.LowercaseKeys {
+		t.Fatal("lowercase_keys was not turned on")
+	}
+}
+
+func TestCanonicalizeDecodedKeyKeepsPercent(t *testing.T) {
+	for decoded, want := range map[string]string{
+		"pub/100%.txt": "pub/100%.txt",
+		"pub/%41.txt":  "pub/%41.txt",
+		"pub/a%zz":     "pub/a%zz",
+	} {
+		got, err := sanitizeDecodedKey(decoded, false)
+		if err != nil || got != want {
+			t.Errorf("sanitizeDecodedKey(%q) = %q, %v; want %q", decoded, got, err, want)
+		}
+	}
+	if _, err := sanitizeDecodedKey("pub/%2e%2e/a.txt", false); err != errEncodedTraversal {
+		t.Errorf("encoded traversal gave %v, want errEncodedTraversal", err)
+	}
+}
+
+// deepKey is a key of depth slash-separated segments
+func deepKey(depth int) string {
+	return strings.Repeat("d/", depth-1) + "f.txt"
+}
+
+func TestKeyDepthLimit(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+
+	env.signedUpload(signedURLRequest(bucketID, deepKey(defaultMaxKeyDepth), 64))
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, deepKey(defaultMaxKeyDepth+1), 64)), nil)
+	expectStatus(t, w, http.StatusBadRequest)
+	w = env.directUpload(bucketID, deepKey(defaultMaxKeyDepth+1), []byte("deep"))
+	expectStatus(t, w, http.StatusBadRequest)
+	var count int
+	if err := env.db.Get(&count, "SELECT COUNT(*) FROM files WHERE bucket_id = ?", bucketID); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("%d file rows, want only the key at the limit", count)
+	}
+}
+
+func TestKeysStoredBeforeALimitStayDownloadable(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	deep := deepKey(defaultMaxKeyDepth + 5)
+	fileID := env.putFile(bucketID, deep, []byte("from before the limit"))
+
+	w := serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, env.downloadTarget(fileID), nil), nil)
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != "from before the limit" {
+		t.Fatalf("downloaded %q", w.Body.String())
+	}
+
+	// Only new keys are checked; the same key cannot be written again
+	w = env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, deep, 64)), nil)
+	expectStatus(t, w, http.StatusBadRequest)
+}
+
+func TestTopLevelFolderLimit(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.db.MustExec("UPDATE buckets SET max_top_level_folders = 2 WHERE id = ?", bucketID)
+
+	env.signedUpload(signedURLRequest(bucketID, "a/one.txt", 64))
+	env.putFile(bucketID, "b/one.txt", []byte("b"))
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, "c/one.txt", 64)), nil)
+	expectStatus(t, w, http.StatusConflict)
+	expectStatus(t, env.directUpload(bucketID, "c/one.txt", []byte("c")), http.StatusConflict)
+
+	// Existing folders and keys at the bucket root do not add a folder
+	env.signedUpload(signedURLRequest(bucketID, "a/nested/two.txt", 64))
+	env.signedUpload(signedURLRequest(bucketID, "root.txt", 64))
+
+	// Emptying a folder frees its place
+	env.deletePath(bucketID, "b")
+	env.signedUpload(signedURLRequest(bucketID, "c/one.txt", 64))
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"file-upload-service/models"
+
+	"go.uber.org/zap"
+)
+
+// serviceLimits assembles the limits the handlers enforce, reading the same constants and
+// configuration values the enforcement does so the two cannot drift apart. The version is
+// a digest of every other field.
+func (h *FileHandler) serviceLimits() models.ServiceLimits {
+	limits := models.ServiceLimits{
+		DirectUploadMaxBytes:        h.config.DirectUploadMaxBytes,
+		InlineUploadMaxBytes:        h.config.InlineUploadMaxBytes,
+		URLImportMaxBytes:           h.config.URLImportMaxBytes,
+		URLImportTimeoutSeconds:     int(h.config.URLImportTimeout / time.Second),
+		URLImportMaxRedirects:       h.config.URLImportMaxRedirects,
+		ReadRangeMaxBytes:           maxReadRangeBytes,
+		ArchiveExpandMaxEntryBytes:  h.config.ArchiveExpandMaxEntryBytes,
+		ArchiveExpandMaxTotalBytes:  h.config.ArchiveExpandMaxTotalBytes,
+		ArchiveExpandMaxEntries:     h.config.ArchiveExpandMaxEntries,
+		ArchiveExpandMaxRatio:       h.config.ArchiveExpandMaxRatio,
+		ArchiveExpandSyncMaxEntries: archiveExpandSyncMaxEntries,
+		ArchiveExpandSyncMaxBytes:   archiveExpandSyncMaxBytes,
+		ZipDownloadMaxFiles:         h.config.ZipDownloadMaxFiles,
+		ZipDownloadMaxBytes:         h.config.ZipDownloadMaxBytes,
+		MaxKeyLength:                maxKeyLength,
+		DefaultMaxKeyDepth:          defaultMaxKeyDepth,
+		MaxKeyDepthLimit:            maxKeyDepthLimit,
+		MaxMetadataBytes:            maxFileMetadataBytes,
+		MaxMetadataKeyLength:        maxFileMetadataKeyLength,
+		SignedURLDefaultTTL:         int(defaultSignedURLTTL / time.Second),
+		SignedURLMinTTL:             int(h.config.SignedURLMinTTL / time.Second),
+		SignedURLMaxTTL:             int(h.config.SignedURLMaxTTL / time.Second),
+		SignedURLMaxUses:            maxUploadTokenUses,
+		SignedURLBatchMaxEntries:    maxSignedURLBatchSize,
+		SignedURLPrefixMaxFiles:     maxPrefixUploadFiles,
+		UploadGroupMaxEntries:       maxUploadGroupEntries,
+		UploadGroupTTL:              int(h.config.UploadGroupTTL / time.Second),
+		MaxSyncRows:                 h.config.MaxSyncRows,
+	}
+	body, _ := json.Marshal(limits)
+	sum := sha256.Sum256(body)
+	limits.Version = hex.EncodeToString(sum[:8])
+	return limits
+}
+
+// GetLimits handles GET /limits - the limits this instance enforces, so SDKs can discover
+// them instead of hardcoding values operators may tune. The version is also sent as the
+// ETag; a request whose If-None-Match carries it is answered with 304 Not Modified.
+func (h *FileHandler) GetLimits(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	limits := h.serviceLimits()
+	etag := `"` + limits.Version + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	h.logRequest(ctx, "info", "Serving service limits", zap.String("version", limits.Version))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(limits)
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"file-upload-service/models"
+)
+
+// getLimits fetches GET /limits, sending an If-None-Match when etag is set
+func (e *testEnv) getLimits(etag string) *httptest.ResponseRecorder {
+	r := newRequest(http.MethodGet, "/limits", nil)
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	return e.serve(e.files.GetLimits, r, nil)
+}
+
+func TestLimitsFollowTheEnforcedConfig(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.DirectUploadMaxBytes = 16
+	env.cfg.SignedURLMaxTTL = time.Hour
+	bucketID := env.createBucket("photos")
+
+	w := env.getLimits("")
+	expectStatus(t, w, http.StatusOK)
+	etag := w.Header().Get("ETag")
+	var before models.ServiceLimits
+	decode(t, w, &before)
+	if before.DirectUploadMaxBytes != 16 || before.SignedURLMaxTTL != 3600 {
+		t.Fatalf("limits = %+v, want direct uploads up to 16 bytes and URLs up to 3600s", before)
+	}
+	expectStatus(t, env.getLimits(etag), http.StatusNotModified)
+
+	expectStatus(t, env.directUpload(bucketID, "docs/a.txt", bytes.Repeat([]byte("a"), 20)), http.StatusRequestEntityTooLarge)
+	twoHours := 2 * 60 * 60
+	req := signedURLRequest(bucketID, "docs/b.txt", 64)
+	req.ExpiresInSeconds = &twoHours
+	w = env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+	expectStatus(t, w, http.StatusBadRequest)
+
+	// An operator raises both limits
+	env.cfg.DirectUploadMaxBytes = 32
+	env.cfg.SignedURLMaxTTL = 3 * time.Hour
+
+	w = env.getLimits(etag)
+	expectStatus(t, w, http.StatusOK)
+	var after models.ServiceLimits
+	decode(t, w, &after)
+	if after.DirectUploadMaxBytes != 32 || after.SignedURLMaxTTL != 3*3600 {
+		t.Fatalf("limits = %+v, want direct uploads up to 32 bytes and URLs up to 10800s", after)
+	}
+	if after.Version == before.Version || w.Header().Get("ETag") == etag {
+		t.Fatalf("version stayed %s after the limits changed", after.Version)
+	}
+
+	expectStatus(t, env.directUpload(bucketID, "docs/a.txt", bytes.Repeat([]byte("a"), 20)), http.StatusCreated)
+	env.signedUpload(req)
+}
@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+)
+
+// Counters published through expvar, served by Metrics
+var (
+	// deleteContentionEvents counts deletions that had to wait for active downloads
+	deleteContentionEvents = expvar.NewInt("delete_contention_events")
+	// downloadsCancelledByDelete counts downloads cut off by a deletion that gave up waiting
+	downloadsCancelledByDelete = expvar.NewInt("downloads_cancelled_by_delete")
+)
+
+// Metrics handles GET /admin/metrics - the service's counters as JSON, along with the
+// memstats and cmdline of the process that expvar publishes
+func Metrics(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	expvar.Handler().ServeHTTP(w, r)
+}
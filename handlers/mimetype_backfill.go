@@ -0,0 +1,612 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// backfillFile is a stored file as the mimetype backfill sees it
+type backfillFile struct {
+	ID               string         `db:"id"`
+	ClientID         string         `db:"client_id"`
+	Mimetype         string         `db:"mimetype"`
+	DetectedMimetype sql.NullString `db:"detected_mimetype"`
+	Key              string         `db:"key"`
+	ClientName       string         `db:"client_name"`
+	BucketName       string         `db:"bucket_name"`
+}
+
+// mimetypeBackfillJobColumns lists the columns scanned into models.MimetypeBackfillJob
+const mimetypeBackfillJobColumns = `id, status, bucket_id, auto_apply, cursor, scanned, proposed, applied, unreadable, error, started_at, finished_at`
+
+// backfillJobResponse converts a stored job to its API form
+func backfillJobResponse(job models.MimetypeBackfillJob) models.MimetypeBackfillJobResponse {
+	response := models.MimetypeBackfillJobResponse{
+		ID:         job.ID,
+		Status:     job.Status,
+		AutoApply:  job.AutoApply,
+		Scanned:    job.Scanned,
+		Proposed:   job.Proposed,
+		Applied:    job.Applied,
+		Unreadable: job.Unreadable,
+		Error:      job.Error.String,
+		StartedAt:  job.StartedAt,
+	}
+	if job.BucketID.Valid {
+		bucketID := int(job.BucketID.Int64)
+		response.BucketID = &bucketID
+	}
+	if job.FinishedAt.Valid {
+		response.FinishedAt = &job.FinishedAt.Time
+	}
+	return response
+}
+
+// requireAdmin rejects requests not made with the admin bearer token. A route's
+// AuthType does not stop client credentials from reaching it, and these routes touch
+// every client's files. It reports whether the request may proceed.
+func (h *FileHandler) requireAdmin(ctx context.Context, w http.ResponseWriter) bool {
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil || auth.Type != "bearer" {
+		h.logRequest(ctx, "error", "Admin access required")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(errs.NewAuthorizationError("Admin access required"))
+		return false
+	}
+	return true
+}
+
+// StartMimetypeBackfill handles POST /admin/mimetype-backfills - start a paced job that
+// sniffs stored files and proposes corrections where their stored mimetype is wrong.
+// Only one job runs at a time.
+func (h *FileHandler) StartMimetypeBackfill(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(ctx, w) {
+		return
+	}
+
+	var req models.CreateMimetypeBackfillRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+
+	var bucketID sql.NullInt64
+	if req.BucketID != nil {
+		var exists int
+		if err := h.db.QueryRow("SELECT COUNT(*) FROM buckets WHERE id = ?", *req.BucketID).Scan(&exists); err != nil {
+			h.logRequest(ctx, "error", "Failed to query bucket", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to start backfill"))
+			return
+		}
+		if exists == 0 {
+			h.logRequest(ctx, "error", "Bucket not found", zap.Int("bucket_id", *req.BucketID))
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(errs.NewNotFoundError("Bucket not found"))
+			return
+		}
+		bucketID = sql.NullInt64{Int64: int64(*req.BucketID), Valid: true}
+	}
+
+	h.backfillMu.Lock()
+	defer h.backfillMu.Unlock()
+
+	var runningID string
+	err := h.db.QueryRow("SELECT id FROM mimetype_backfill_jobs WHERE status = ?", models.BackfillStatusRunning).Scan(&runningID)
+	if err == nil {
+		h.logRequest(ctx, "error", "Mimetype backfill already running", zap.String("job_id", runningID))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("A mimetype backfill is already running: " + runningID))
+		return
+	}
+	if err != sql.ErrNoRows {
+		h.logRequest(ctx, "error", "Failed to query backfill jobs", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to start backfill"))
+		return
+	}
+
+	job := models.MimetypeBackfillJob{
+		ID:        uuid.New().String(),
+		Status:    models.BackfillStatusRunning,
+		BucketID:  bucketID,
+		AutoApply: req.AutoApply,
+		StartedAt: time.Now().UTC(),
+	}
+	if _, err := h.db.Exec(
+		"INSERT INTO mimetype_backfill_jobs (id, status, bucket_id, auto_apply, started_at) VALUES (?, ?, ?, ?, ?)",
+		job.ID, job.Status, job.BucketID, job.AutoApply, job.StartedAt,
+	); err != nil {
+		h.logRequest(ctx, "error", "Failed to create backfill job", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to start backfill"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Mimetype backfill started",
+		zap.String("job_id", job.ID),
+		zap.Bool("auto_apply", job.AutoApply),
+	)
+
+	go h.jobs.runOnce(mimetypeBackfillLease(job.ID), func(ctx context.Context) {
+		h.runMimetypeBackfill(ctx, job.ID)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(backfillJobResponse(job))
+}
+
+// GetMimetypeBackfill handles GET /admin/mimetype-backfills/{id} - report a job's progress
+func (h *FileHandler) GetMimetypeBackfill(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(ctx, w) {
+		return
+	}
+
+	jobID := mux.Vars(r)["id"]
+
+	var job models.MimetypeBackfillJob
+	err := h.db.Get(&job, "SELECT "+mimetypeBackfillJobColumns+" FROM mimetype_backfill_jobs WHERE id = ?", jobID)
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "error", "Backfill job not found", zap.String("job_id", jobID))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Backfill job not found"))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query backfill job", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to get backfill job"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(backfillJobResponse(job))
+}
+
+// ListMimetypeCorrections handles GET /admin/mimetype-corrections - list correction
+// proposals for review, filtered by ?status= (default proposed) and optionally ?job_id=
+func (h *FileHandler) ListMimetypeCorrections(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(ctx, w) {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = models.CorrectionStatusProposed
+	}
+	switch status {
+	case models.CorrectionStatusProposed, models.CorrectionStatusApplied, models.CorrectionStatusDismissed, models.CorrectionStatusStale:
+	default:
+		h.logRequest(ctx, "error", "Invalid correction status", zap.String("status", status))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("status must be one of proposed, applied, dismissed, stale"))
+		return
+	}
+
+	query := `SELECT id, job_id, file_id, current_mimetype, proposed_mimetype, unambiguous, status, resolved_by, resolved_at, created_at
+		FROM mimetype_corrections WHERE status = ?`
+	args := []interface{}{status}
+	if jobID := r.URL.Query().Get("job_id"); jobID != "" {
+		query += " AND job_id = ?"
+		args = append(args, jobID)
+	}
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		query += " AND id > ?"
+		args = append(args, cursor)
+	}
+
+	// Fetch one row past the limit so we know whether the listing was truncated
+	maxRows := h.config.MaxSyncRows
+	query += " ORDER BY id ASC LIMIT ?"
+	args = append(args, maxRows+1)
+
+	corrections := make([]models.MimetypeCorrection, 0)
+	if err := h.db.Select(&corrections, query, args...); err != nil {
+		h.logRequest(ctx, "error", "Failed to query mimetype corrections", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to list corrections"))
+		return
+	}
+
+	response := models.MimetypeCorrectionListResponse{Status: status, Corrections: corrections}
+	if len(corrections) > maxRows {
+		response.Corrections = corrections[:maxRows]
+		response.Truncated = true
+		response.NextCursor = corrections[maxRows-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ApplyMimetypeCorrections handles POST /admin/mimetype-corrections/apply - update the
+// stored mimetype of each named proposal's file, recording an audit event for each
+func (h *FileHandler) ApplyMimetypeCorrections(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	h.resolveMimetypeCorrections(ctx, w, r, models.CorrectionStatusApplied)
+}
+
+// DismissMimetypeCorrections handles POST /admin/mimetype-corrections/dismiss - reject
+// the named proposals, leaving their files untouched
+func (h *FileHandler) DismissMimetypeCorrections(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	h.resolveMimetypeCorrections(ctx, w, r, models.CorrectionStatusDismissed)
+}
+
+// resolveMimetypeCorrections applies or dismisses the proposals named in the request
+func (h *FileHandler) resolveMimetypeCorrections(ctx context.Context, w http.ResponseWriter, r *http.Request, resolution string) {
+	if !h.requireAdmin(ctx, w) {
+		return
+	}
+
+	var req models.ResolveMimetypeCorrectionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+	if len(req.CorrectionIDs) == 0 {
+		h.logRequest(ctx, "error", "Missing required field: correction_ids")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("correction_ids is required"))
+		return
+	}
+	if len(req.CorrectionIDs) > h.config.MaxSyncRows {
+		h.logRequest(ctx, "error", "Too many corrections for a synchronous request", zap.Int("count", len(req.CorrectionIDs)))
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(errs.AppError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("correction_ids cannot contain more than %d items", h.config.MaxSyncRows),
+		})
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+
+	h.logRequest(ctx, "info", "Resolving mimetype corrections",
+		zap.String("resolution", resolution),
+		zap.Int("count", len(req.CorrectionIDs)),
+	)
+
+	response := models.ResolveMimetypeCorrectionsResponse{
+		Resolved: make([]string, 0),
+		Stale:    make([]string, 0),
+		Skipped:  make([]string, 0),
+	}
+	for _, correctionID := range req.CorrectionIDs {
+		var correction models.MimetypeCorrection
+		err := h.db.Get(&correction,
+			`SELECT id, job_id, file_id, current_mimetype, proposed_mimetype, unambiguous, status, resolved_by, resolved_at, created_at
+			FROM mimetype_corrections WHERE id = ?`,
+			correctionID,
+		)
+		if err == sql.ErrNoRows || (err == nil && correction.Status != models.CorrectionStatusProposed) {
+			response.Skipped = append(response.Skipped, correctionID)
+			continue
+		}
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to query mimetype correction", zap.String("correction_id", correctionID), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to resolve corrections"))
+			return
+		}
+
+		outcome := resolution
+		if resolution == models.CorrectionStatusApplied {
+			outcome, err = h.applyMimetypeCorrection(correction, auth.Client, time.Now().UTC())
+		} else {
+			err = h.setCorrectionStatus(correction.ID, resolution, auth.Client, time.Now().UTC())
+		}
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to resolve mimetype correction", zap.String("correction_id", correctionID), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to resolve corrections"))
+			return
+		}
+
+		if outcome == models.CorrectionStatusStale {
+			response.Stale = append(response.Stale, correctionID)
+		} else {
+			response.Resolved = append(response.Resolved, correctionID)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// setCorrectionStatus resolves a proposal without touching its file
+func (h *FileHandler) setCorrectionStatus(correctionID, status, actor string, now time.Time) error {
+	_, err := h.db.Exec(
+		"UPDATE mimetype_corrections SET status = ?, resolved_by = ?, resolved_at = ? WHERE id = ? AND status = ?",
+		status, actor, now, correctionID, models.CorrectionStatusProposed,
+	)
+	return err
+}
+
+// applyMimetypeCorrection updates the file of a proposal to the proposed mimetype and
+// records the change in the audit log, all in one transaction. The file is only updated
+// while it still carries the mimetype the proposal was made against; otherwise the
+// proposal is marked stale. It returns the status the proposal ends up in.
+func (h *FileHandler) applyMimetypeCorrection(correction models.MimetypeCorrection, actor string, now time.Time) (string, error) {
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE files SET mimetype = ?, updated_at = ? WHERE id = ? AND mimetype = ? AND status = ?",
+		correction.ProposedMimetype, now, correction.FileID, correction.CurrentMimetype, models.FileStatusUploaded,
+	)
+	if err != nil {
+		return "", err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+
+	status := models.CorrectionStatusApplied
+	if updated == 0 {
+		status = models.CorrectionStatusStale
+	} else {
+		var clientID string
+		if err := tx.QueryRow("SELECT client_id FROM files WHERE id = ?", correction.FileID).Scan(&clientID); err != nil {
+			return "", err
+		}
+		if err := recordAuditEvent(tx, models.AuditEvent{
+			Action:   models.AuditActionMimetypeCorrected,
+			Actor:    actor,
+			ClientID: clientID,
+			FileID:   correction.FileID,
+			Detail: map[string]interface{}{
+				"correction_id": correction.ID,
+				"job_id":        correction.JobID,
+				"from":          correction.CurrentMimetype,
+				"to":            correction.ProposedMimetype,
+			},
+		}, now); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE mimetype_corrections SET status = ?, resolved_by = ?, resolved_at = ? WHERE id = ?",
+		status, actor, now, correction.ID,
+	); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return status, nil
+}
+
+// StartMimetypeBackfillResumer resumes running jobs now and then periodically. A job is
+// resumed from the last file it processed when no instance holds its lease: it was left
+// by a previous process, or its holder crashed or lost the lease mid-batch.
+func (h *FileHandler) StartMimetypeBackfillResumer(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			h.resumeMimetypeBackfills()
+			<-ticker.C
+		}
+	}()
+}
+
+// resumeMimetypeBackfills runs every job marked running that no instance is running
+func (h *FileHandler) resumeMimetypeBackfills() {
+	var jobIDs []string
+	if err := h.db.Select(&jobIDs, "SELECT id FROM mimetype_backfill_jobs WHERE status = ?", models.BackfillStatusRunning); err != nil {
+		logger.Error("Failed to query running mimetype backfills", zap.Error(err))
+		return
+	}
+	for _, jobID := range jobIDs {
+		jobID := jobID
+		go h.jobs.runOnce(mimetypeBackfillLease(jobID), func(ctx context.Context) {
+			logger.Info("Resuming mimetype backfill", zap.String("job_id", jobID))
+			h.runMimetypeBackfill(ctx, jobID)
+		})
+	}
+}
+
+// runMimetypeBackfill walks the job's files in id order, a batch at a time with a pause
+// between batches so the scan does not compete with live traffic for the disk. Progress
+// and the cursor are saved after every batch. Once ctx is cancelled the run stops without
+// saving the unfinished batch, leaving the job running for the next lease holder. Files
+// encrypted with a customer key are skipped: their stored bytes say nothing of the content.
+func (h *FileHandler) runMimetypeBackfill(ctx context.Context, jobID string) {
+	var job models.MimetypeBackfillJob
+	if err := h.db.Get(&job, "SELECT "+mimetypeBackfillJobColumns+" FROM mimetype_backfill_jobs WHERE id = ?", jobID); err != nil {
+		logger.Error("Failed to load mimetype backfill", zap.String("job_id", jobID), zap.Error(err))
+		return
+	}
+	// Another instance may have finished the job since it was listed
+	if job.Status != models.BackfillStatusRunning {
+		return
+	}
+
+	for {
+		if ctx.Err() != nil {
+			logger.Info("Mimetype backfill stopped", zap.String("job_id", jobID), zap.String("cursor", job.Cursor))
+			return
+		}
+
+		query := `SELECT f.id, f.client_id, f.mimetype, f.detected_mimetype, f.key, c.name AS client_name, b.name AS bucket_name
+			FROM files f
+			JOIN clients c ON f.client_id = c.client_id
+			JOIN buckets b ON f.bucket_id = b.id
+			WHERE f.status = ? AND f.staged = 0 AND f.encryption_key_hash IS NULL AND f.id > ?`
+		args := []interface{}{models.FileStatusUploaded, job.Cursor}
+		if job.BucketID.Valid {
+			query += " AND f.bucket_id = ?"
+			args = append(args, job.BucketID.Int64)
+		}
+		query += " ORDER BY f.id ASC LIMIT ?"
+		args = append(args, h.config.MimetypeBackfillBatchSize)
+
+		var files []backfillFile
+		if err := h.db.Select(&files, query, args...); err != nil {
+			h.finishMimetypeBackfill(&job, err)
+			return
+		}
+		if len(files) == 0 {
+			h.finishMimetypeBackfill(&job, nil)
+			return
+		}
+
+		for _, file := range files {
+			if ctx.Err() != nil {
+				break
+			}
+			if err := h.checkBackfillFile(&job, file); err != nil {
+				h.finishMimetypeBackfill(&job, err)
+				return
+			}
+			job.Cursor = file.ID
+			job.Scanned++
+		}
+
+		if ctx.Err() != nil {
+			logger.Info("Mimetype backfill stopped mid-batch", zap.String("job_id", jobID))
+			return
+		}
+		if _, err := h.db.Exec(
+			"UPDATE mimetype_backfill_jobs SET cursor = ?, scanned = ?, proposed = ?, applied = ?, unreadable = ? WHERE id = ?",
+			job.Cursor, job.Scanned, job.Proposed, job.Applied, job.Unreadable, job.ID,
+		); err != nil {
+			h.finishMimetypeBackfill(&job, err)
+			return
+		}
+
+		time.Sleep(h.config.MimetypeBackfillPause)
+	}
+}
+
+// checkBackfillFile sniffs one stored file, fills in its detected mimetype if it was never
+// recorded, and proposes a correction when the sniffed type confidently disagrees with
+// the stored one. Unambiguous proposals are applied straight away for auto-apply jobs.
+func (h *FileHandler) checkBackfillFile(job *models.MimetypeBackfillJob, file backfillFile) error {
+	filePath, err := bucketFilePath(file.ClientName, file.BucketName, file.Key)
+	if err != nil {
+		job.Unreadable++
+		return nil
+	}
+
+	// Register as a reader so a concurrent deletion does not remove the file mid-sniff
+	_, release, ok := h.locks.acquireRead(context.Background(), filePath)
+	if !ok {
+		return nil
+	}
+	detected, err := sniffFile(filePath)
+	release()
+	if err != nil {
+		logger.Error("Failed to sniff stored file", zap.String("file_id", file.ID), zap.Error(err))
+		job.Unreadable++
+		return nil
+	}
+
+	if detected != "" && !file.DetectedMimetype.Valid {
+		if _, err := h.db.Exec("UPDATE files SET detected_mimetype = ? WHERE id = ? AND detected_mimetype IS NULL", detected, file.ID); err != nil {
+			return err
+		}
+	}
+
+	propose, unambiguous := proposeMimetypeCorrection(file.Mimetype, detected)
+	if !propose {
+		return nil
+	}
+
+	// A file has at most one open proposal, and a dismissed proposal is not made again
+	// while the file keeps the mimetype it was dismissed for
+	correction := models.MimetypeCorrection{
+		ID:               uuid.New().String(),
+		JobID:            job.ID,
+		FileID:           file.ID,
+		CurrentMimetype:  file.Mimetype,
+		ProposedMimetype: detected,
+		Unambiguous:      unambiguous,
+		Status:           models.CorrectionStatusProposed,
+	}
+	result, err := h.db.Exec(
+		`INSERT INTO mimetype_corrections (id, job_id, file_id, current_mimetype, proposed_mimetype, unambiguous, status, created_at)
+		SELECT ?, ?, ?, ?, ?, ?, ?, ?
+		WHERE NOT EXISTS (
+			SELECT 1 FROM mimetype_corrections
+			WHERE file_id = ? AND (status = ? OR (status = ? AND current_mimetype = ?))
+		)`,
+		correction.ID, correction.JobID, correction.FileID, correction.CurrentMimetype, correction.ProposedMimetype,
+		correction.Unambiguous, correction.Status, time.Now().UTC(),
+		correction.FileID, models.CorrectionStatusProposed, models.CorrectionStatusDismissed, correction.CurrentMimetype,
+	)
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		return err
+	}
+	job.Proposed++
+
+	if job.AutoApply && unambiguous {
+		status, err := h.applyMimetypeCorrection(correction, "backfill:"+job.ID, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		if status == models.CorrectionStatusApplied {
+			job.Applied++
+		}
+	}
+	return nil
+}
+
+// finishMimetypeBackfill records the end of a job, failed when err is set
+func (h *FileHandler) finishMimetypeBackfill(job *models.MimetypeBackfillJob, err error) {
+	job.Status = models.BackfillStatusCompleted
+	var errMessage sql.NullString
+	if err != nil {
+		job.Status = models.BackfillStatusFailed
+		errMessage = sql.NullString{String: err.Error(), Valid: true}
+		logger.Error("Mimetype backfill failed", zap.String("job_id", job.ID), zap.Error(err))
+	}
+
+	if _, err := h.db.Exec(
+		`UPDATE mimetype_backfill_jobs
+		SET status = ?, cursor = ?, scanned = ?, proposed = ?, applied = ?, unreadable = ?, error = ?, finished_at = ?
+		WHERE id = ?`,
+		job.Status, job.Cursor, job.Scanned, job.Proposed, job.Applied, job.Unreadable, errMessage, time.Now().UTC(), job.ID,
+	); err != nil {
+		logger.Error("Failed to record mimetype backfill result", zap.String("job_id", job.ID), zap.Error(err))
+		return
+	}
+
+	logger.Info("Mimetype backfill finished",
+		zap.String("job_id", job.ID),
+		zap.String("status", job.Status),
+		zap.Int("scanned", job.Scanned),
+		zap.Int("proposed", job.Proposed),
+		zap.Int("applied", job.Applied),
+		zap.Int("unreadable", job.Unreadable),
+	)
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"file-upload-service/models"
+)
+
+// pngBytes starts with the PNG signature the sniffer recognises
+var pngBytes = append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 32)...)
+
+// backfillFixture is a bucket holding one file of each kind the backfill tells apart
+type backfillFixture struct {
+	bucketID     int
+	png          string // a PNG stored as application/octet-stream: unambiguous
+	html         string // HTML stored as text/plain: ambiguous
+	plain        string // text stored as text/plain: nothing to correct
+	undetectable string // unrecognised bytes stored as image/png: nothing to propose
+	missing      string // a row whose bytes are gone: unreadable
+}
+
+func (e *testEnv) newBackfillFixture() backfillFixture {
+	e.t.Helper()
+	e.cfg.MimetypeBackfillPause = 0
+	bucketID := e.createBucket("photos")
+	f := backfillFixture{
+		bucketID:     bucketID,
+		png:          e.putFile(bucketID, "img/logo", pngBytes),
+		html:         e.putFile(bucketID, "docs/page.txt", []byte("<html><body>hi</body></html>")),
+		plain:        e.putFile(bucketID, "docs/notes.txt", []byte("plain notes\n")),
+		undetectable: e.putFile(bucketID, "img/raw.png", []byte{0x00, 0x01, 0x02, 0xfe, 0xff}),
+		missing:      e.putFile(bucketID, "docs/gone.txt", []byte("gone")),
+	}
+	e.db.MustExec("UPDATE files SET mimetype = 'application/octet-stream' WHERE id = ?", f.png)
+	e.db.MustExec("UPDATE files SET mimetype = 'image/png' WHERE id = ?", f.undetectable)
+	if err := os.Remove(e.diskPath(bucketID, "docs/gone.txt")); err != nil {
+		e.t.Fatal(err)
+	}
+	return f
+}
+
+// runBackfill starts a backfill over a bucket and waits for it to finish
+func (e *testEnv) runBackfill(bucketID int, autoApply bool) models.MimetypeBackfillJobResponse {
+	e.t.Helper()
+	w := serveAdmin(e.files.StartMimetypeBackfill, newRequest(http.MethodPost, "/admin/mimetype-backfills",
+		models.CreateMimetypeBackfillRequest{BucketID: &bucketID, AutoApply: autoApply}), nil)
+	expectStatus(e.t, w, http.StatusCreated)
+	var job models.MimetypeBackfillJobResponse
+	decode(e.t, w, &job)
+
+	eventually(e.t, func() bool {
+		w := serveAdmin(e.files.GetMimetypeBackfill, newRequest(http.MethodGet, "/admin/mimetype-backfills/"+job.ID, nil),
+			map[string]string{"id": job.ID})
+		decode(e.t, w, &job)
+		return job.Status != models.BackfillStatusRunning
+	})
+	if job.Status != models.BackfillStatusCompleted {
+		e.t.Fatalf("backfill ended %s: %s", job.Status, job.Error)
+	}
+	return job
+}
+
+// corrections lists the proposals in a status, by file id
+func (e *testEnv) corrections(status string) map[string]models.MimetypeCorrection {
+	e.t.Helper()
+	w := serveAdmin(e.files.ListMimetypeCorrections, newRequest(http.MethodGet, "/admin/mimetype-corrections?status="+status, nil), nil)
+	expectStatus(e.t, w, http.StatusOK)
+	var list models.MimetypeCorrectionListResponse
+	decode(e.t, w, &list)
+	byFile := make(map[string]models.MimetypeCorrection)
+	for _, correction := range list.Corrections {
+		byFile[correction.FileID] = correction
+	}
+	return byFile
+}
+
+// storedMimetype reads the mimetype a file row carries
+func (e *testEnv) storedMimetype(fileID string) string {
+	e.t.Helper()
+	var mimetype string
+	if err := e.db.Get(&mimetype, "SELECT mimetype FROM files WHERE id = ?", fileID); err != nil {
+		e.t.Fatal(err)
+	}
+	return mimetype
+}
+
+func TestMimetypeBackfillProposesCorrections(t *testing.T) {
+	env := newTestEnv(t)
+	f := env.newBackfillFixture()
+
+	job := env.runBackfill(f.bucketID, false)
+	if job.Scanned != 5 || job.Proposed != 2 || job.Applied != 0 || job.Unreadable != 1 {
+		t.Fatalf("job = %+v, want 5 scanned, 2 proposed, 1 unreadable", job)
+	}
+
+	proposed := env.corrections(models.CorrectionStatusProposed)
+	if len(proposed) != 2 {
+		t.Fatalf("proposals = %+v, want two", proposed)
+	}
+	if c := proposed[f.png]; c.ProposedMimetype != "image/png" || !c.Unambiguous {
+		t.Fatalf("png proposal = %+v, want an unambiguous image/png", c)
+	}
+	if c := proposed[f.html]; c.ProposedMimetype != "text/html" || c.Unambiguous {
+		t.Fatalf("html proposal = %+v, want an ambiguous text/html", c)
+	}
+
+	// Proposing changes nothing
+	for id, want := range map[string]string{f.png: "application/octet-stream", f.html: "text/plain", f.undetectable: "image/png"} {
+		if got := env.storedMimetype(id); got != want {
+			t.Fatalf("file %s has mimetype %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestApplyMimetypeCorrectionsChangesOnlyNamedRows(t *testing.T) {
+	env := newTestEnv(t)
+	f := env.newBackfillFixture()
+	env.runBackfill(f.bucketID, false)
+	proposed := env.corrections(models.CorrectionStatusProposed)
+
+	w := serveAdmin(env.files.ApplyMimetypeCorrections, newRequest(http.MethodPost, "/admin/mimetype-corrections/apply",
+		models.ResolveMimetypeCorrectionsRequest{CorrectionIDs: []string{proposed[f.png].ID, "unknown"}}), nil)
+	expectStatus(t, w, http.StatusOK)
+	var resp models.ResolveMimetypeCorrectionsResponse
+	decode(t, w, &resp)
+	if len(resp.Resolved) != 1 || len(resp.Skipped) != 1 || len(resp.Stale) != 0 {
+		t.Fatalf("apply = %+v, want 1 resolved and the unknown id skipped", resp)
+	}
+
+	if got := env.storedMimetype(f.png); got != "image/png" {
+		t.Fatalf("applied file has mimetype %q, want image/png", got)
+	}
+	for id, want := range map[string]string{f.html: "text/plain", f.plain: "text/plain", f.undetectable: "image/png"} {
+		if got := env.storedMimetype(id); got != want {
+			t.Fatalf("file %s has mimetype %q, want %q", id, got, want)
+		}
+	}
+	if _, ok := env.corrections(models.CorrectionStatusProposed)[f.html]; !ok {
+		t.Fatal("the html proposal was resolved along with the png one")
+	}
+
+	var events int
+	if err := env.db.Get(&events, "SELECT COUNT(*) FROM audit_events WHERE action = ? AND file_id = ?",
+		models.AuditActionMimetypeCorrected, f.png); err != nil {
+		t.Fatal(err)
+	}
+	if events != 1 {
+		t.Fatalf("%d audit events for the applied correction, want 1", events)
+	}
+}
+
+func TestAutoApplyLeavesAmbiguousFilesForReview(t *testing.T) {
+	env := newTestEnv(t)
+	f := env.newBackfillFixture()
+
+	job := env.runBackfill(f.bucketID, true)
+	if job.Proposed != 2 || job.Applied != 1 {
+		t.Fatalf("job = %+v, want 2 proposed and 1 applied", job)
+	}
+	if got := env.storedMimetype(f.png); got != "image/png" {
+		t.Fatalf("unambiguous file has mimetype %q, want image/png", got)
+	}
+	if got := env.storedMimetype(f.html); got != "text/plain" {
+		t.Fatalf("ambiguous file was changed to %q", got)
+	}
+	if got := env.storedMimetype(f.undetectable); got != "image/png" {
+		t.Fatalf("undetectable file was changed to %q", got)
+	}
+
+	proposed := env.corrections(models.CorrectionStatusProposed)
+	if _, ok := proposed[f.html]; !ok || len(proposed) != 1 {
+		t.Fatalf("open proposals = %+v, want only the html file", proposed)
+	}
+	if _, ok := env.corrections(models.CorrectionStatusApplied)[f.png]; !ok {
+		t.Fatal("the png proposal is not recorded as applied")
+	}
+}
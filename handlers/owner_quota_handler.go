@@ -0,0 +1,337 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// ownerQuotaError refuses an upload that would take its owner entity past their quota
+type ownerQuotaError struct {
+	usage     models.OwnerUsage
+	requested int64
+}
+
+func (e *ownerQuotaError) Error() string {
+	return fmt.Sprintf("storage quota of %d bytes exceeded for %s %s", *e.usage.LimitBytes, e.usage.OwnerEntityType, e.usage.OwnerEntityID)
+}
+
+// ownerQuotaLimit returns the quota of an owner entity: their own override, else the
+// default of their type. found is false when neither is set.
+func ownerQuotaLimit(q sqlx.Queryer, clientID, ownerType, ownerID string) (limit int64, found bool, err error) {
+	err = q.QueryRowx(
+		`SELECT max_bytes FROM owner_quotas
+		WHERE client_id = ? AND owner_entity_type = ? AND owner_entity_id IN (?, '')
+		ORDER BY owner_entity_id = '' LIMIT 1`,
+		clientID, ownerType, ownerID,
+	).Scan(&limit)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return limit, err == nil, err
+}
+
+// ownerUsage sums what an owner entity holds against their quota. Stored files count
+// whatever their visibility; pending files count their declared size while their upload
+// is still outstanding, that is while they hold a key reservation or belong to an open
+// upload group. Pending files of allow_parallel URLs reserve nothing and only count once
+// their bytes arrive. Files deleted or replaced while an unexpired snapshot holds their
+// bytes count as snapshot bytes.
+func ownerUsage(q sqlx.Queryer, clientID, ownerType, ownerID string, now time.Time) (models.OwnerUsage, error) {
+	usage := models.OwnerUsage{OwnerEntityType: ownerType, OwnerEntityID: ownerID}
+	err := q.QueryRowx(
+		`SELECT
+			COUNT(CASE WHEN f.status <> ? THEN 1 END),
+			COALESCE(SUM(CASE WHEN f.status <> ? THEN f.file_size END), 0),
+			COALESCE(SUM(CASE WHEN f.status = ? THEN f.file_size END), 0)
+		FROM files f
+		WHERE f.client_id = ? AND f.owner_entity_type = ? AND f.owner_entity_id = ?
+		AND (f.status IN (?, ?) OR (f.status = ? AND (
+			EXISTS (SELECT 1 FROM upload_reservations r WHERE r.file_id = f.id AND r.expires_at > ?)
+			OR EXISTS (SELECT 1 FROM upload_groups g WHERE g.id = f.upload_group_id AND g.status = ? AND g.expires_at > ?)
+		)))`,
+		models.FileStatusPending, models.FileStatusPending, models.FileStatusPending,
+		clientID, ownerType, ownerID,
+		models.FileStatusUploaded, models.FileStatusQuarantined, models.FileStatusPending,
+		now, models.UploadGroupStatusOpen, now,
+	).Scan(&usage.FileCount, &usage.UsedBytes, &usage.ReservedBytes)
+	if err != nil {
+		return usage, err
+	}
+	usage.SnapshotBytes, err = heldSnapshotBytes(q, now,
+		"s.client_id = ? AND sf.owner_entity_type = ? AND sf.owner_entity_id = ?", clientID, ownerType, ownerID)
+	if err != nil {
+		return usage, err
+	}
+	limit, found, err := ownerQuotaLimit(q, clientID, ownerType, ownerID)
+	if err != nil {
+		return usage, err
+	}
+	if found {
+		usage.LimitBytes = &limit
+	}
+	return usage, nil
+}
+
+// ownerHeldBytes is everything counted against an owner's quota
+func ownerHeldBytes(usage models.OwnerUsage) int64 {
+	return usage.UsedBytes + usage.ReservedBytes + usage.SnapshotBytes
+}
+
+// checkOwnerQuota refuses a prepared upload with an *ownerQuotaError when its size would
+// take its owner entity past their quota. It runs inside the serialized transaction that
+// inserts the upload's row, so uploads of one owner cannot together overshoot the quota.
+// Files an overwrite would supersede are still counted.
+func checkOwnerQuota(q sqlx.Queryer, upload *pendingUpload, now time.Time) error {
+	data := upload.TokenData
+	usage, err := ownerUsage(q, data.ClientID, data.OwnerEntityType, data.OwnerEntityID, now)
+	if err != nil {
+		return err
+	}
+	if usage.LimitBytes != nil && ownerHeldBytes(usage)+data.FileSize > *usage.LimitBytes {
+		return &ownerQuotaError{usage: usage, requested: data.FileSize}
+	}
+	return nil
+}
+
+// ownerQuotaExceeded builds the body of a refusal for an owner's quota
+func ownerQuotaExceeded(quotaErr *ownerQuotaError) models.OwnerQuotaExceededError {
+	usage := quotaErr.usage
+	return models.OwnerQuotaExceededError{
+		Code: http.StatusForbidden,
+		Message: fmt.Sprintf("Upload of %d bytes would exceed the storage quota of %s %s: %d of %d bytes in use",
+			quotaErr.requested, usage.OwnerEntityType, usage.OwnerEntityID, ownerHeldBytes(usage), *usage.LimitBytes),
+		OwnerEntityType: usage.OwnerEntityType,
+		OwnerEntityID:   usage.OwnerEntityID,
+		UsedBytes:       usage.UsedBytes,
+		ReservedBytes:   usage.ReservedBytes,
+		SnapshotBytes:   usage.SnapshotBytes,
+		RequestedBytes:  quotaErr.requested,
+		LimitBytes:      *usage.LimitBytes,
+	}
+}
+
+func (e *ownerQuotaError) refusal(prefix string) (interface{}, string) {
+	body := ownerQuotaExceeded(e)
+	body.Message = prefix + body.Message
+	return body, body.Message
+}
+
+func (e *ownerQuotaError) logFields() []zap.Field {
+	return []zap.Field{
+		zap.String("owner_entity_type", e.usage.OwnerEntityType),
+		zap.String("owner_entity_id", e.usage.OwnerEntityID),
+		zap.Int64("used_bytes", e.usage.UsedBytes),
+		zap.Int64("reserved_bytes", e.usage.ReservedBytes),
+		zap.Int64("snapshot_bytes", e.usage.SnapshotBytes),
+		zap.Int64("requested_bytes", e.requested),
+		zap.Int64("limit_bytes", *e.usage.LimitBytes),
+	}
+}
+
+// ownerQuotaResponse converts a quota to its API representation
+func ownerQuotaResponse(quota models.OwnerQuota) models.OwnerQuotaResponse {
+	return models.OwnerQuotaResponse{
+		OwnerEntityType: quota.OwnerEntityType,
+		OwnerEntityID:   quota.OwnerEntityID,
+		MaxBytes:        quota.MaxBytes,
+		CreatedAt:       quota.CreatedAt,
+		UpdatedAt:       quota.UpdatedAt,
+	}
+}
+
+// SetOwnerQuota handles PUT /quotas - set the storage quota of an owner entity, or the
+// default of every owner of a type when owner_entity_id is left out
+func (h *FileHandler) SetOwnerQuota(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req models.SetOwnerQuotaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+
+	if req.OwnerEntityType == "" {
+		h.logRequest(ctx, "error", "Missing required field: owner_entity_type")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("owner_entity_type is required"))
+		return
+	}
+	if req.MaxBytes <= 0 {
+		h.logRequest(ctx, "error", "Invalid max_bytes", zap.Int64("max_bytes", req.MaxBytes))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("max_bytes must be greater than 0"))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Setting owner quota",
+		zap.String("client_id", clientID),
+		zap.String("owner_entity_type", req.OwnerEntityType),
+		zap.String("owner_entity_id", req.OwnerEntityID),
+		zap.Int64("max_bytes", req.MaxBytes),
+	)
+
+	now := time.Now().UTC()
+	var quota models.OwnerQuota
+	err := h.db.Get(&quota,
+		`INSERT INTO owner_quotas (client_id, owner_entity_type, owner_entity_id, max_bytes, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (client_id, owner_entity_type, owner_entity_id) DO UPDATE SET max_bytes = excluded.max_bytes, updated_at = excluded.updated_at
+		RETURNING id, client_id, owner_entity_type, owner_entity_id, max_bytes, created_at, updated_at`,
+		clientID, req.OwnerEntityType, req.OwnerEntityID, req.MaxBytes, now, now,
+	)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to save owner quota", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to save quota"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ownerQuotaResponse(quota))
+}
+
+// ListOwnerQuotas handles GET /quotas - list the storage quotas a client has set
+func (h *FileHandler) ListOwnerQuotas(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	var quotas []models.OwnerQuota
+	if err := h.db.Select(&quotas,
+		`SELECT id, client_id, owner_entity_type, owner_entity_id, max_bytes, created_at, updated_at
+		FROM owner_quotas WHERE client_id = ? ORDER BY owner_entity_type, owner_entity_id`,
+		clientID,
+	); err != nil {
+		h.logRequest(ctx, "error", "Failed to query owner quotas", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to list quotas"))
+		return
+	}
+
+	response := models.OwnerQuotaListResponse{Quotas: make([]models.OwnerQuotaResponse, 0, len(quotas))}
+	for _, quota := range quotas {
+		response.Quotas = append(response.Quotas, ownerQuotaResponse(quota))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteOwnerQuota handles DELETE /quotas?owner_entity_type=&owner_entity_id= - remove a
+// quota and return it. Leaving owner_entity_id out removes the default of the type; owners with an
+// override of their own keep it.
+func (h *FileHandler) DeleteOwnerQuota(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ownerType := r.URL.Query().Get("owner_entity_type")
+	ownerID := r.URL.Query().Get("owner_entity_id")
+	if ownerType == "" {
+		h.logRequest(ctx, "error", "Missing required parameter: owner_entity_type")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("owner_entity_type is required"))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Deleting owner quota",
+		zap.String("client_id", clientID),
+		zap.String("owner_entity_type", ownerType),
+		zap.String("owner_entity_id", ownerID),
+	)
+
+	var quota models.OwnerQuota
+	err := h.db.Get(&quota,
+		`DELETE FROM owner_quotas WHERE client_id = ? AND owner_entity_type = ? AND owner_entity_id = ?
+		RETURNING id, client_id, owner_entity_type, owner_entity_id, max_bytes, created_at, updated_at`,
+		clientID, ownerType, ownerID,
+	)
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "info", "Owner quota not found")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Quota not found"))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to delete owner quota", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to delete quota"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ownerQuotaResponse(quota))
+}
+
+// OwnerUsage handles GET /quotas/usage?owner_entity_type=&owner_entity_id= - report what
+// an owner entity stores against their quota
+func (h *FileHandler) OwnerUsage(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ownerType := r.URL.Query().Get("owner_entity_type")
+	ownerID := r.URL.Query().Get("owner_entity_id")
+	if ownerType == "" || ownerID == "" {
+		h.logRequest(ctx, "error", "Missing owner entity parameters")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("owner_entity_type and owner_entity_id are required"))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Getting owner usage",
+		zap.String("client_id", clientID),
+		zap.String("owner_entity_type", ownerType),
+		zap.String("owner_entity_id", ownerID),
+	)
+
+	usage, err := ownerUsage(h.db, clientID, ownerType, ownerID, time.Now().UTC())
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query owner usage", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to get owner usage"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(usage)
+}
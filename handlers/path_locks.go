@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PathLocks coordinates downloads streaming a stored file with deletions of the same path.
+// Readers register around their copy loop; a deletion blocks new readers, waits for the
+// active ones to finish and cancels any still streaming once the wait times out, so a
+// client either receives the whole file or a broken response, never a silently short one.
+// Uploads writing a path also take it one at a time (see acquireWrite).
+type PathLocks struct {
+	mu    sync.Mutex
+	paths map[string]*pathState
+	// writers holds a channel per path being written, closed when the writer finishes
+	writers map[string]chan struct{}
+
+	// waitTimeout is how long a deletion waits for active readers before cancelling them
+	waitTimeout time.Duration
+
+	nextReaderID uint64
+}
+
+// pathState tracks the active readers and any pending deletion of one path
+type pathState struct {
+	readers  map[uint64]context.CancelFunc
+	deleting bool
+	// drained is closed when the last reader leaves while a deletion waits
+	drained chan struct{}
+	// released is closed when the deletion holding the path finishes
+	released chan struct{}
+}
+
+// NewPathLocks creates a path lock manager. A zero waitTimeout makes deletions cancel
+// active readers immediately instead of waiting for them.
+func NewPathLocks(waitTimeout time.Duration) *PathLocks {
+	return &PathLocks{
+		paths:       make(map[string]*pathState),
+		writers:     make(map[string]chan struct{}),
+		waitTimeout: waitTimeout,
+	}
+}
+
+// state returns the tracking entry for path, creating it if needed. Callers hold l.mu.
+func (l *PathLocks) state(path string) *pathState {
+	st, ok := l.paths[path]
+	if !ok {
+		st = &pathState{readers: make(map[uint64]context.CancelFunc)}
+		l.paths[path] = st
+	}
+	return st
+}
+
+// forget drops an idle entry. Callers hold l.mu.
+func (l *PathLocks) forget(path string, st *pathState) {
+	if !st.deleting && len(st.readers) == 0 {
+		delete(l.paths, path)
+	}
+}
+
+// acquireRead registers a reader of path. It returns a context that is cancelled if a
+// deletion gives up waiting, and a release func to call once streaming ends.
+// ok is false when the path is being deleted and must be treated as missing.
+func (l *PathLocks) acquireRead(ctx context.Context, path string) (readCtx context.Context, release func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	st := l.state(path)
+	if st.deleting {
+		return nil, nil, false
+	}
+
+	l.nextReaderID++
+	id := l.nextReaderID
+	readCtx, cancel := context.WithCancel(ctx)
+	st.readers[id] = cancel
+
+	release = func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		cancel()
+		delete(st.readers, id)
+		if st.deleting && len(st.readers) == 0 && st.drained != nil {
+			close(st.drained)
+			st.drained = nil
+		}
+		l.forget(path, st)
+	}
+	return readCtx, release, true
+}
+
+// acquireDownload is acquireRead for a reader streaming path to a response. Cancelling
+// the read only stops the copy loop between writes, so once it is cancelled the response's
+// write deadline is moved to now: a write blocked on a client that stopped reading fails
+// at once instead of holding up the deletion waiting for it.
+func (l *PathLocks) acquireDownload(ctx context.Context, path string, w http.ResponseWriter) (readCtx context.Context, release func(), ok bool) {
+	readCtx, releaseRead, ok := l.acquireRead(ctx, path)
+	if !ok {
+		return nil, nil, false
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-readCtx.Done():
+			http.NewResponseController(w).SetWriteDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	// The watcher is stopped before the read is released, as releasing cancels readCtx
+	return readCtx, func() {
+		close(done)
+		<-stopped
+		releaseRead()
+	}, true
+}
+
+// acquireDelete takes exclusive hold of path for a deletion. New readers are refused
+// straight away; active readers are waited for up to waitTimeout and then cancelled.
+// It returns a release func and the number of readers the deletion contended with.
+func (l *PathLocks) acquireDelete(path string) (release func(), contended int) {
+	l.mu.Lock()
+	st := l.state(path)
+	for st.deleting {
+		released := st.released
+		l.mu.Unlock()
+		<-released
+		l.mu.Lock()
+		st = l.state(path)
+	}
+	st.deleting = true
+	st.released = make(chan struct{})
+
+	contended = len(st.readers)
+	if contended > 0 {
+		deleteContentionEvents.Add(1)
+		drained := make(chan struct{})
+		st.drained = drained
+		l.mu.Unlock()
+
+		timer := time.NewTimer(l.waitTimeout)
+		select {
+		case <-drained:
+			timer.Stop()
+		case <-timer.C:
+			l.mu.Lock()
+			downloadsCancelledByDelete.Add(int64(len(st.readers)))
+			for _, cancel := range st.readers {
+				cancel()
+			}
+			l.mu.Unlock()
+			<-drained
+		}
+		l.mu.Lock()
+	}
+	l.mu.Unlock()
+
+	release = func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		st.deleting = false
+		close(st.released)
+		l.forget(path, st)
+	}
+	return release, contended
+}
+
+// acquireWrite takes the write hold of path, so that one upload at a time stages and
+// moves bytes into it. Another writer is waited for up to wait (not at all when wait is
+// zero); ok is false when it still holds the path by then or ctx ends first. Readers and
+// deletions are not affected. The returned release may be called more than once.
+// The hold is per process: replicas sharing a volume still rely on the atomic rename.
+func (l *PathLocks) acquireWrite(ctx context.Context, path string, wait time.Duration) (release func(), ok bool) {
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		l.mu.Lock()
+		held, busy := l.writers[path]
+		if !busy {
+			done := make(chan struct{})
+			l.writers[path] = done
+			l.mu.Unlock()
+			var once sync.Once
+			return func() {
+				once.Do(func() {
+					l.mu.Lock()
+					delete(l.writers, path)
+					l.mu.Unlock()
+					close(done)
+				})
+			}, true
+		}
+		l.mu.Unlock()
+
+		if wait <= 0 {
+			return nil, false
+		}
+		select {
+		case <-held:
+		case <-timeout:
+			return nil, false
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// copyWithContext copies src to dst, stopping as soon as ctx is cancelled
+func copyWithContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			wn, err := dst.Write(buf[:n])
+			written += int64(wn)
+			if err != nil {
+				return written, err
+			}
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"file-upload-service/models"
+)
+
+func TestAcquireWriteWaitsForTheHolder(t *testing.T) {
+	locks := NewPathLocks(time.Second)
+	release, ok := locks.acquireWrite(context.Background(), "uploads/a", 0)
+	if !ok {
+		t.Fatal("free path was not acquired")
+	}
+
+	if _, ok := locks.acquireWrite(context.Background(), "uploads/a", 0); ok {
+		t.Fatal("held path was acquired without waiting")
+	}
+	if _, ok := locks.acquireWrite(context.Background(), "uploads/a", 20*time.Millisecond); ok {
+		t.Fatal("held path was acquired before its holder released it")
+	}
+	other, ok := locks.acquireWrite(context.Background(), "uploads/b", 0)
+	if !ok {
+		t.Fatal("another path was blocked by the held one")
+	}
+	other()
+
+	time.AfterFunc(20*time.Millisecond, release)
+	second, ok := locks.acquireWrite(context.Background(), "uploads/a", time.Second)
+	if !ok {
+		t.Fatal("waiting writer did not get the path once it was released")
+	}
+	second()
+	release()
+}
+
+func TestDirectUploadOnBusyFail(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+
+	release, ok := env.locks.acquireWrite(context.Background(), env.diskPath(bucketID, "docs/a.txt"), 0)
+	if !ok {
+		t.Fatal("free path was not acquired")
+	}
+	defer release()
+
+	r := directUploadRequest(map[string]string{
+		"bucket_id":         strconv.Itoa(bucketID),
+		"key":               "docs/a.txt",
+		"mimetype":          "text/plain",
+		"owner_entity_type": "user",
+		"owner_entity_id":   "user-1",
+	}, []byte("content"))
+	r.Header.Set(onBusyHeader, onBusyFail)
+	w := env.serve(env.files.DirectUpload, r, nil)
+	expectStatus(t, w, http.StatusConflict)
+
+	if ids := env.liveFiles(bucketID, "docs/a.txt"); len(ids) != 0 {
+		t.Fatalf("live files after a refused upload = %v, want none", ids)
+	}
+}
+
+// Direct and inline overwrites of one key, hammered at once, must leave one whole file
+// whose row describes its bytes, and no staged leftovers
+func TestConcurrentOverwritesLeaveOneWholeFile(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.putFile(bucketID, "docs/a.txt", []byte("original"))
+
+	const requests = 30
+	codes := make([]int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Every upload has its own length and letter, so a mix of two is detectable
+			content := []byte(strings.Repeat(string(rune('a'+i%26)), 4096+i))
+			if i%2 == 0 {
+				codes[i] = env.serve(env.files.DirectUpload, directUploadRequest(map[string]string{
+					"bucket_id":         strconv.Itoa(bucketID),
+					"key":               "docs/a.txt",
+					"mimetype":          "text/plain",
+					"owner_entity_type": "user",
+					"owner_entity_id":   "user-1",
+					"on_conflict":       models.OnConflictOverwrite,
+				}, content), nil).Code
+				return
+			}
+			codes[i] = env.serve(env.files.InlineUpload, newRequest(http.MethodPost, "/files/inline", models.InlineUploadRequest{
+				BucketID:        bucketID,
+				Key:             "docs/a.txt",
+				FileName:        "a.txt",
+				Mimetype:        "text/plain",
+				OwnerEntityType: "user",
+				OwnerEntityID:   "user-1",
+				Content:         base64.StdEncoding.EncodeToString(content),
+				OnConflict:      models.OnConflictOverwrite,
+			}), nil).Code
+		}(i)
+	}
+	wg.Wait()
+
+	for i, code := range codes {
+		if code != http.StatusCreated {
+			t.Fatalf("upload %d answered %d, want %d", i, code, http.StatusCreated)
+		}
+	}
+
+	ids := env.liveFiles(bucketID, "docs/a.txt")
+	if len(ids) != 1 {
+		t.Fatalf("live files at the key = %v, want 1", ids)
+	}
+	var size int64
+	if err := env.db.Get(&size, "SELECT file_size FROM files WHERE id = ?", ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(env.diskPath(bucketID, "docs/a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(content)) != size {
+		t.Fatalf("stored %d bytes, but the live row records %d", len(content), size)
+	}
+	if strings.Trim(string(content), string(content[:1])) != "" {
+		t.Fatal("stored content mixes the bytes of several uploads")
+	}
+
+	var deleted int
+	if err := env.db.Get(&deleted, "SELECT COUNT(*) FROM files WHERE key = 'docs/a.txt' AND deleted_at IS NOT NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if deleted != requests {
+		t.Fatalf("%d files at the key were retired, want %d", deleted, requests)
+	}
+
+	leftovers, err := filepath.Glob(filepath.Join(filepath.Dir(env.diskPath(bucketID, "docs/a.txt")), "*.tmp-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftovers) != 0 {
+		t.Fatalf("staged files left behind: %v", leftovers)
+	}
+}
+
+func TestDeleteCutsOffStalledDownload(t *testing.T) {
+	for _, fast := range []bool{false, true} {
+		t.Run("fast_transfers="+strconv.FormatBool(fast), func(t *testing.T) {
+			env := newTestEnv(t)
+			env.cfg.FastTransfers = fast
+			env.locks.waitTimeout = 50 * time.Millisecond
+			bucketID := env.createBucket("photos")
+			fileID := env.putFile(bucketID, "docs/big.bin", make([]byte, 32<<20))
+			target := env.downloadTarget(fileID)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				env.files.DownloadFile(r.Context(), w, r)
+			}))
+			defer srv.Close()
+
+			// A client that reads the start of the response and then stops, so the
+			// download blocks writing once the socket buffers are full
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: test\r\n\r\n", target)
+			status, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil || !strings.Contains(status, "200") {
+				t.Fatalf("download started with %q, %v", status, err)
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			cancelled := downloadsCancelledByDelete.Value()
+			contended := deleteContentionEvents.Value()
+			done := make(chan *httptest.ResponseRecorder)
+			go func() {
+				done <- env.serve(env.files.DeleteFiles, newRequest(http.MethodDelete, "/files", models.DeleteFilesRequest{FileIDs: []string{fileID}}), nil)
+			}()
+			select {
+			case w := <-done:
+				expectStatus(t, w, http.StatusOK)
+			case <-time.After(5 * time.Second):
+				t.Fatal("deletion is still waiting for the stalled download")
+			}
+
+			if _, err := os.Stat(env.diskPath(bucketID, "docs/big.bin")); !os.IsNotExist(err) {
+				t.Fatalf("file is still on disk: %v", err)
+			}
+			if got := downloadsCancelledByDelete.Value() - cancelled; got != 1 {
+				t.Fatalf("downloads_cancelled_by_delete went up by %d, want 1", got)
+			}
+			if got := deleteContentionEvents.Value() - contended; got != 1 {
+				t.Fatalf("delete_contention_events went up by %d, want 1", got)
+			}
+		})
+	}
+}
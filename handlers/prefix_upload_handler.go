@@ -0,0 +1,455 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/umakantv/go-utils/errs"
+	"go.uber.org/zap"
+)
+
+// maxPrefixUploadFiles is the most files a single prefix upload URL may accept
+const maxPrefixUploadFiles = 1000
+
+// validatePrefixSignedURLRequest checks a signed URL request for uploads under a key prefix
+func validatePrefixSignedURLRequest(req models.CreateSignedURLRequest) error {
+	switch {
+	case req.Key != "":
+		return errors.New("key and key_prefix cannot be combined")
+	case req.FileName != "":
+		return errors.New("file_name cannot be combined with key_prefix; each file's name is sent with its upload")
+	case req.BucketID <= 0:
+		return errors.New("bucket_id is required and must be a positive integer")
+	case req.MaxFiles < 1 || req.MaxFiles > maxPrefixUploadFiles:
+		return fmt.Errorf("max_files must be between 1 and %d", maxPrefixUploadFiles)
+	case req.MaxTotalBytes <= 0:
+		return errors.New("max_total_bytes must be greater than 0")
+	case req.FileSize < 0 || req.FileSize > req.MaxTotalBytes:
+		return errors.New("file_size must be between 1 and max_total_bytes")
+	case req.OwnerEntityType == "":
+		return errors.New("owner_entity_type is required")
+	case req.OwnerEntityID == "":
+		return errors.New("owner_entity_id is required")
+	case req.MaxUses != 0:
+		return errors.New("max_uses cannot be combined with key_prefix; use max_files")
+	case req.AllowParallel:
+		return errors.New("allow_parallel cannot be combined with key_prefix")
+	case req.OnConflict != "" && req.OnConflict != models.OnConflictReject && req.OnConflict != models.OnConflictError &&
+		req.OnConflict != models.OnConflictOverwrite && req.OnConflict != models.OnConflictNewVersion &&
+		req.OnConflict != models.OnConflictRename:
+		return errors.New("on_conflict must be one of reject, overwrite, new-version, rename")
+	case req.AllowedIP != "" && !req.RestrictIP:
+		return errors.New("allowed_ip requires restrict_ip")
+	}
+	if req.Mimetype != "" {
+		if _, _, err := mime.ParseMediaType(req.Mimetype); err != nil || !strings.Contains(req.Mimetype, "/") {
+			return errors.New(`mimetype must be a mimetype such as "image/png" or "image/*"`)
+		}
+	}
+	return nil
+}
+
+// generatePrefixSignedURL answers POST /files/signed-url for a request with key_prefix: a
+// URL accepting several uploads under the prefix, each creating its own file. No file row
+// is created up front; the URL's counts are kept in the upload quota store.
+func (h *FileHandler) generatePrefixSignedURL(ctx context.Context, w http.ResponseWriter, r *http.Request, clientID string, req models.CreateSignedURLRequest, ttl time.Duration) {
+	if err := validatePrefixSignedURLRequest(req); err != nil {
+		h.logRequest(ctx, "error", "Invalid prefix signed URL request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+	metadata, err := normalizeFileMetadata(req.Metadata)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid file metadata", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+	if req.CallbackURL != "" {
+		if err := validateCallbackURL(req.CallbackURL, h.config.UploadCallbackAllowPrivate); err != nil {
+			h.logRequest(ctx, "error", "Invalid callback URL", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+			return
+		}
+	}
+
+	prefix, status, appErr := h.resolveUploadPrefix(ctx, clientID, req.BucketID, req.KeyPrefix)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+	if prefix == "" {
+		h.logRequest(ctx, "error", "Key prefix names no folder", zap.String("key_prefix", req.KeyPrefix))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("key_prefix must name a folder"))
+		return
+	}
+
+	maxFileSize := req.FileSize
+	if maxFileSize == 0 {
+		maxFileSize = req.MaxTotalBytes
+	}
+	if !h.hasDiskSpace(uploadsRoot, maxFileSize) {
+		h.logRequest(ctx, "error", "Not enough disk space for upload", zap.Int64("file_size", maxFileSize))
+		writeInsufficientStorage(w)
+		return
+	}
+
+	now := time.Now().UTC()
+	upload := &pendingUpload{TokenData: models.UploadTokenData{
+		FileSize:        maxFileSize,
+		Mimetype:        strings.ToLower(req.Mimetype),
+		ClientID:        clientID,
+		BucketID:        req.BucketID,
+		OwnerEntityType: req.OwnerEntityType,
+		OwnerEntityID:   req.OwnerEntityID,
+		Metadata:        metadata,
+		ExpiresAt:       now.Add(ttl),
+		CallbackURL:     req.CallbackURL,
+		KeyPrefix:       prefix,
+		MaxFiles:        req.MaxFiles,
+		MaxTotalBytes:   req.MaxTotalBytes,
+		OnConflict:      req.OnConflict,
+	}}
+	h.restrictUploadIP(r, upload, req)
+
+	uploadToken := generateUploadToken()
+	if err := h.cache.Set("upload:"+uploadToken, upload.TokenData, ttl); err != nil {
+		h.logRequest(ctx, "error", "Failed to store upload token in cache", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to generate signed URL"))
+		return
+	}
+	signedURL, err := h.signedURL(clientID, models.ShortTokenKindUpload, uploadToken, ttl)
+	if err != nil {
+		h.cache.Delete("upload:" + uploadToken)
+		h.logRequest(ctx, "error", "Failed to build signed URL", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to generate signed URL"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Prefix signed URL generated successfully",
+		zap.String("client_id", clientID),
+		zap.Int("bucket_id", req.BucketID),
+		zap.String("key_prefix", prefix),
+		zap.Int("max_files", req.MaxFiles),
+		zap.Int64("max_total_bytes", req.MaxTotalBytes),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.SignedURLResponse{
+		SignedURL:     signedURL,
+		ExpiresAt:     upload.TokenData.ExpiresAt,
+		KeyPrefix:     prefix,
+		MaxFiles:      req.MaxFiles,
+		MaxTotalBytes: req.MaxTotalBytes,
+	})
+}
+
+// uploadUnderPrefix answers POST /files/upload for a prefix token: it stores the posted
+// file under the token's prefix at the relative key sent in the form's key field (the
+// file's name when there is none) and creates its file row. Each upload takes one of the
+// token's files and its bytes of max_total_bytes, which are given back if it fails; the
+// token is deleted once either limit is reached.
+func (h *FileHandler) uploadUnderPrefix(ctx context.Context, w http.ResponseWriter, r *http.Request, token string, tokenData models.UploadTokenData) {
+	if r.Header.Get(encryptionKeyHeader) != "" {
+		h.logRequest(ctx, "error", "Encryption key sent to a prefix upload")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("X-Encryption-Key is not supported on prefix upload URLs"))
+		return
+	}
+
+	quotaTTL := time.Until(tokenData.ExpiresAt)
+	if quotaTTL <= 0 {
+		quotaTTL = time.Minute
+	}
+	took, err := h.quotas.Take(token, 1, 0, tokenData.MaxFiles, tokenData.MaxTotalBytes, quotaTTL)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to count prefix upload", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to process upload"))
+		return
+	}
+	if !took {
+		h.logRequest(ctx, "error", "Prefix upload token has no files left", zap.String("key_prefix", tokenData.KeyPrefix))
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Invalid or expired upload token"))
+		return
+	}
+	var takenBytes int64
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		if err := h.quotas.Give(token, 1, takenBytes); err != nil {
+			h.logRequest(ctx, "error", "Failed to give back prefix upload counts", zap.Error(err))
+		}
+	}()
+
+	// A file may be no larger than the token's per-file limit or what is left of its total
+	_, usedBytes, err := h.quotas.Usage(token)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to read prefix upload counts", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to process upload"))
+		return
+	}
+	maxSize := tokenData.FileSize
+	if left := tokenData.MaxTotalBytes - usedBytes; left < maxSize {
+		maxSize = left
+	}
+	if maxSize <= 0 {
+		h.logRequest(ctx, "error", "Prefix upload token has no bytes left", zap.String("key_prefix", tokenData.KeyPrefix))
+		writeFileTooLarge(w)
+		return
+	}
+	if !h.hasDiskSpace(uploadsRoot, maxSize) {
+		h.logRequest(ctx, "error", "Not enough disk space for upload", zap.Int64("file_size", maxSize))
+		writeInsufficientStorage(w)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+multipartOverhead)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		h.logRequest(ctx, "error", "Upload is not a multipart form", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Missing file in upload"))
+		return
+	}
+	fields, file, status, appErr := h.readFormFields(ctx, reader)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+	defer file.Close()
+
+	relativeKey := fields["key"]
+	if relativeKey == "" {
+		relativeKey = file.FileName()
+	}
+	if relativeKey == "" {
+		h.logRequest(ctx, "error", "Missing required field: key")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("key is required"))
+		return
+	}
+	fileName := fields["file_name"]
+	if fileName == "" {
+		fileName = file.FileName()
+	}
+	if fileName == "" {
+		fileName = path.Base(relativeKey)
+	}
+
+	detected, body, err := sniffContentType(file)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeFileTooLarge(w)
+			return
+		}
+		h.logRequest(ctx, "error", "Failed to read upload body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Failed to read upload body"))
+		return
+	}
+	// Browsers send application/octet-stream for types they do not know
+	mimetype := normalizeMimetype(fields["mimetype"])
+	if mimetype == "" {
+		mimetype = normalizeMimetype(file.Header.Get("Content-Type"))
+	}
+	if mimetype == "" || mimetype == "application/octet-stream" {
+		mimetype = detected
+	}
+	if tokenData.Mimetype != "" && !mimetypeAllowed(mimetype, []string{tokenData.Mimetype}) {
+		h.logRequest(ctx, "error", "Mimetype not allowed by prefix upload URL",
+			zap.String("mimetype", mimetype),
+			zap.String("allowed", tokenData.Mimetype),
+		)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(
+			fmt.Sprintf("mimetype %s is not allowed by this upload URL; allowed: %s", mimetype, tokenData.Mimetype),
+		))
+		return
+	}
+
+	prepared, status, appErr := h.prepareUpload(ctx, tokenData.ClientID, models.CreateSignedURLRequest{
+		BucketID:        tokenData.BucketID,
+		Key:             tokenData.KeyPrefix + "/" + relativeKey,
+		FileName:        fileName,
+		FileSize:        maxSize,
+		Mimetype:        mimetype,
+		OwnerEntityType: tokenData.OwnerEntityType,
+		OwnerEntityID:   tokenData.OwnerEntityID,
+		Metadata:        tokenData.Metadata,
+		OnConflict:      tokenData.OnConflict,
+		CallbackURL:     tokenData.CallbackURL,
+	})
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+	prepared.DetectedMimetype = detected
+	if !prepared.TokenData.AllowMimetypeMismatch && !mimetypesMatch(mimetype, detected) {
+		h.logRequest(ctx, "error", "Uploaded content does not match declared mimetype",
+			zap.String("declared", mimetype),
+			zap.String("detected", detected),
+		)
+		writeMimetypeMismatch(w, mimetype, detected)
+		return
+	}
+
+	checksum := sha256.New()
+	head := &headCapture{}
+	buf := h.buffers.get()
+	tmpPath, written, err := stageFile(filepath.Join(uploadsRoot, prepared.TokenData.FilePath), io.TeeReader(body, io.MultiWriter(checksum, head)), maxSize, buf)
+	h.buffers.put(buf)
+	var maxBytesErr *http.MaxBytesError
+	if errors.Is(err, errFileTooLarge) || errors.As(err, &maxBytesErr) {
+		h.logRequest(ctx, "error", "File size exceeds limit", zap.Int64("max_size", maxSize))
+		writeFileTooLarge(w)
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to write file", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to save file"))
+		return
+	}
+
+	// Concurrent uploads may together have gone past the total while streaming
+	took, err = h.quotas.Take(token, 0, written, tokenData.MaxFiles, tokenData.MaxTotalBytes, quotaTTL)
+	if err != nil || !took {
+		os.Remove(tmpPath)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to count prefix upload bytes", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to process upload"))
+			return
+		}
+		h.logRequest(ctx, "error", "Prefix upload exceeds max_total_bytes", zap.Int64("bytes_written", written))
+		writeFileTooLarge(w)
+		return
+	}
+	takenBytes = written
+
+	prepared.TokenData.FileSize = written
+	prepared.Image = h.imageDimensions(ctx, prepared.TokenData.FileID, detected, head.buf)
+	prepared.Uploader = h.uploaderOf(r)
+	outcome, existingID, err := h.storeImportedFile(prepared, tokenData.OnConflict, tmpPath)
+	if err != nil {
+		if quotaErr, ok := asQuotaError(err); ok {
+			h.writeQuotaExceeded(ctx, w, quotaErr, "")
+			return
+		}
+		h.logRequest(ctx, "error", "Failed to store prefix upload", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to save file"))
+		return
+	}
+	switch outcome {
+	case keyExists:
+		h.writeFileExistsConflict(ctx, w, existingID, prepared.Key)
+		return
+	case keyExhausted:
+		h.logRequest(ctx, "error", "No free key left to rename to", zap.String("key", prepared.Key))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.AppError{Code: http.StatusConflict, Message: keyConflictMessage(outcome)})
+		return
+	}
+	succeeded = true
+
+	// The token is spent once either limit is reached
+	usedFiles, usedBytes, err := h.quotas.Usage(token)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to read prefix upload counts", zap.Error(err))
+	} else if usedFiles >= tokenData.MaxFiles || usedBytes >= tokenData.MaxTotalBytes {
+		h.cache.Delete("upload:" + token)
+	}
+
+	// A rename may have moved the upload to another key
+	fileData := prepared.TokenData
+	filePath := filepath.Join(uploadsRoot, fileData.FilePath)
+	sum := hex.EncodeToString(checksum.Sum(nil))
+
+	scanStatus, signature := h.scanAfterUpload(ctx, fileData.FileID, written, nil)
+	if scanStatus == models.ScanStatusInfected {
+		h.logRequest(ctx, "info", "Uploaded file quarantined", zap.String("file_id", fileData.FileID), zap.String("signature", signature))
+		writeQuarantined(w, signature)
+		return
+	}
+
+	h.logRequest(ctx, "info", "File uploaded successfully",
+		zap.String("file_id", fileData.FileID),
+		zap.String("client_id", fileData.ClientID),
+		zap.Int("bucket_id", fileData.BucketID),
+		zap.String("key", prepared.Key),
+		zap.Int64("bytes_written", written),
+		zap.Int("files_remaining", tokenData.MaxFiles-usedFiles),
+	)
+
+	if fileData.CallbackURL != "" {
+		go h.sendUploadCallback(ctx, fileData.CallbackURL, models.UploadCallbackPayload{
+			Event:           uploadCallbackEvent,
+			FileID:          fileData.FileID,
+			BucketID:        fileData.BucketID,
+			Key:             prepared.Key,
+			FileName:        fileData.FileName,
+			Size:            written,
+			Mimetype:        fileData.Mimetype,
+			Checksum:        sum,
+			OwnerEntityType: fileData.OwnerEntityType,
+			OwnerEntityID:   fileData.OwnerEntityID,
+			UploadedAt:      time.Now().UTC(),
+		})
+	}
+
+	response := map[string]interface{}{
+		"message":         "File uploaded successfully",
+		"file_id":         fileData.FileID,
+		"file_name":       fileData.FileName,
+		"file_size":       written,
+		"mimetype":        fileData.Mimetype,
+		"bucket_id":       fileData.BucketID,
+		"key":             prepared.Key,
+		"saved_path":      filePath,
+		"checksum":        sum,
+		"files_remaining": tokenData.MaxFiles - usedFiles,
+		"bytes_remaining": tokenData.MaxTotalBytes - usedBytes,
+	}
+	if len(fileData.Metadata) > 0 {
+		response["metadata"] = fileData.Metadata
+	}
+	if scanStatus != "" {
+		response["scan_status"] = scanStatus
+	}
+	if prepared.Image != nil {
+		response["image"] = prepared.Image
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
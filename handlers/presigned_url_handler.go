@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+var (
+	errPresignedURLExpired     = errors.New("presigned URL has expired")
+	errPresignedURLInvalid     = errors.New("presigned URL signature does not match")
+	errPresignedURLFileChanged = errors.New("presigned URL was issued for a file no longer stored at this key")
+)
+
+// signPresignedURL returns the hex HMAC-SHA256 of a bucket's id and name, a stored key, the
+// id of the file stored there and the unix time a presigned public URL expires at. Bucket
+// names can be reused after a delete or rename and are only unique per client, so the id
+// ties the URL to the bucket it was issued for.
+func signPresignedURL(secret []byte, bucketID int, bucketName, key, fileID string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d\n%s\n%s\n%s\n%d", bucketID, bucketName, key, fileID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyPresignedURL checks the file_id, expires and sig query values of a public request
+// for key in the bucket it resolved to and returns when the URL expires. The caller still
+// checks that file_id is the file stored at key.
+func verifyPresignedURL(secret []byte, bucketID int, bucketName, key, fileID, rawExpires, signature string, now time.Time) (time.Time, error) {
+	expires, err := strconv.ParseInt(rawExpires, 10, 64)
+	if err != nil || fileID == "" || !hmac.Equal([]byte(signature), []byte(signPresignedURL(secret, bucketID, bucketName, key, fileID, expires))) {
+		return time.Time{}, errPresignedURLInvalid
+	}
+	expiresAt := time.Unix(expires, 0)
+	if !now.Before(expiresAt) {
+		return time.Time{}, errPresignedURLExpired
+	}
+	return expiresAt, nil
+}
+
+// publicFileURL returns the public route URL of a key, escaping each of its segments
+func publicFileURL(bucketName, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return fmt.Sprintf("http://localhost:8080/files/%s/%s", url.PathEscape(bucketName), strings.Join(segments, "/"))
+}
+
+// GeneratePresignedURL handles POST /files/presigned-url - a URL serving a file through the
+// public route until it expires, even outside the bucket's public paths. Nothing is stored:
+// the URL carries its file and expiry and an HMAC over bucket, key, file and expiry, so high-volume links
+// cost no cache writes. It cannot be revoked before it expires, so only the file's owner
+// may ask for one.
+func (h *FileHandler) GeneratePresignedURL(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req models.PresignedURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+	if req.FileID == "" {
+		h.logRequest(ctx, "error", "Missing required field: file_id")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("file_id is required"))
+		return
+	}
+
+	ttl, err := h.signedURLTTL(req.ExpiresInSeconds)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid signed URL lifetime", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Generating presigned URL",
+		zap.String("file_id", req.FileID),
+		zap.String("client_id", clientID),
+	)
+
+	var fileClientID, key, status, scanStatus, bucketName, bucketArchiveMode string
+	var bucketID int
+	var deletedAt sql.NullTime
+	var encrypted, bucketArchived bool
+	err = h.db.QueryRow(
+		`SELECT f.client_id, f.key, f.status, f.deleted_at, COALESCE(f.scan_status, ''), f.encryption_key_hash IS NOT NULL,
+			b.id, b.name, b.archived, COALESCE(b.archive_mode, '')
+		 FROM files f
+		 JOIN buckets b ON f.bucket_id = b.id
+		 WHERE f.id = ? AND f.staged = 0`,
+		req.FileID,
+	).Scan(&fileClientID, &key, &status, &deletedAt, &scanStatus, &encrypted, &bucketID, &bucketName, &bucketArchived, &bucketArchiveMode)
+	if err != nil {
+		h.logRequest(ctx, "info", "File not found", zap.String("file_id", req.FileID), zap.Error(err))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+		return
+	}
+
+	switch {
+	case deletedAt.Valid || status == models.FileStatusDeleted:
+		h.logRequest(ctx, "info", "File has been deleted", zap.String("file_id", req.FileID))
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(errs.NewValidationError("File has been deleted"))
+		return
+	case status != models.FileStatusUploaded:
+		h.logRequest(ctx, "info", "File has not been uploaded", zap.String("file_id", req.FileID), zap.String("status", status))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+		return
+	case fileClientID != clientID:
+		h.logRequest(ctx, "error", "Client does not own this file",
+			zap.String("file_id", req.FileID),
+			zap.String("requesting_client", clientID),
+			zap.String("owner_client", fileClientID),
+		)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(errs.NewAuthorizationError("Access denied"))
+		return
+	case scanStatus == models.ScanStatusPending:
+		h.logRequest(ctx, "info", "File is awaiting its scan", zap.String("file_id", req.FileID))
+		writeAwaitingScan(w)
+		return
+	case encrypted:
+		h.logRequest(ctx, "info", "Refusing to presign encrypted file", zap.String("file_id", req.FileID))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("File is encrypted with a customer-provided key and cannot be served publicly"))
+		return
+	case readsFrozen(bucketArchived, bucketArchiveMode):
+		h.logRequest(ctx, "error", "Bucket is archived", zap.String("file_id", req.FileID))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Cannot download from an archived bucket"))
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second)
+	expires := expiresAt.Unix()
+	signedURL := fmt.Sprintf("%s?file_id=%s&expires=%d&sig=%s",
+		publicFileURL(bucketName, key), url.QueryEscape(req.FileID), expires,
+		signPresignedURL(h.config.PresignedURLSecret, bucketID, bucketName, key, req.FileID, expires))
+
+	h.logRequest(ctx, "info", "Presigned URL generated",
+		zap.String("file_id", req.FileID),
+		zap.Time("expires_at", expiresAt),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.PresignedURLResponse{SignedURL: signedURL, ExpiresAt: expiresAt})
+}
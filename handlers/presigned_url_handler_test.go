@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"file-upload-service/api"
+	"file-upload-service/models"
+)
+
+// presign issues a presigned public URL for a file
+func (e *testEnv) presign(fileID string) string {
+	e.t.Helper()
+	w := e.serve(e.files.GeneratePresignedURL, newRequest(http.MethodPost, "/files/presigned-url",
+		models.PresignedURLRequest{FileID: fileID}), nil)
+	expectStatus(e.t, w, http.StatusCreated)
+	var presigned models.PresignedURLResponse
+	decode(e.t, w, &presigned)
+	return presigned.SignedURL
+}
+
+// servePresigned requests a presigned URL on the public route, as routed by the router
+func (e *testEnv) servePresigned(presignedURL string) *httptest.ResponseRecorder {
+	e.t.Helper()
+	u, err := url.Parse(presignedURL)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(u.Path, "/files/"), "/", 2)
+	return serveAnonymous(e.public.ServePublicFile, newRequest(http.MethodGet, u.RequestURI(), nil),
+		map[string]string{"bucket_name": parts[0], "file_path": parts[1]})
+}
+
+// expectRefused checks a presigned request was refused with message
+func expectRefused(t *testing.T, w *httptest.ResponseRecorder, status int, message string) {
+	t.Helper()
+	expectStatus(t, w, status)
+	if message != "" && !strings.Contains(w.Body.String(), message) {
+		t.Fatalf("body %s, want %q", w.Body.String(), message)
+	}
+}
+
+func TestPresignedURLServesAPrivateKey(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "private/report.txt", []byte("report"))
+
+	expectStatus(t, env.servePublic("photos", "private/report.txt"), http.StatusForbidden)
+	w := env.servePresigned(env.presign(fileID))
+	expectStatus(t, w, http.StatusOK)
+	if w.Body.String() != "report" {
+		t.Fatalf("served %q", w.Body.String())
+	}
+}
+
+func TestPresignedURLRefusesTampering(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "private/report.txt", []byte("report"))
+	env.putFile(bucketID, "private/salaries.txt", []byte("salaries"))
+	presigned := env.presign(fileID)
+
+	sig := presigned[strings.Index(presigned, "sig=")+len("sig="):]
+	flipped := "0"
+	if sig[0] == '0' {
+		flipped = "1"
+	}
+	expectRefused(t, env.servePresigned(strings.Replace(presigned, "sig="+sig, "sig="+flipped+sig[1:], 1)), http.StatusForbidden, "Invalid URL signature")
+	expectRefused(t, env.servePresigned(strings.Replace(presigned, "report.txt", "salaries.txt", 1)), http.StatusForbidden, "Invalid URL signature")
+
+	u, _ := url.Parse(presigned)
+	query := u.Query()
+	query.Set("expires", strconv.FormatInt(time.Now().Add(time.Hour*24*365).Unix(), 10))
+	u.RawQuery = query.Encode()
+	expectRefused(t, env.servePresigned(u.String()), http.StatusForbidden, "Invalid URL signature")
+
+	// Without the file it was issued for the signature does not verify
+	u, _ = url.Parse(presigned)
+	query = u.Query()
+	query.Del("file_id")
+	u.RawQuery = query.Encode()
+	expectRefused(t, env.servePresigned(u.String()), http.StatusForbidden, "Invalid URL signature")
+}
+
+func TestPresignedURLExpires(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	key := "private/report.txt"
+	fileID := env.putFile(bucketID, key, []byte("report"))
+
+	expires := time.Now().Add(-time.Second).Unix()
+	expired := publicFileURL("photos", key) + "?file_id=" + fileID + "&expires=" + strconv.FormatInt(expires, 10) +
+		"&sig=" + signPresignedURL(env.cfg.PresignedURLSecret, bucketID, "photos", key, fileID, expires)
+	expectRefused(t, env.servePresigned(expired), http.StatusForbidden, "Presigned URL has expired")
+}
+
+func TestPresignedURLServesOnlyItsFile(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	fileID := env.putFile(bucketID, "private/report.txt", []byte("first"))
+	presigned := env.presign(fileID)
+
+	env.deletePath(bucketID, "private")
+	env.putFile(bucketID, "private/report.txt", []byte("second"))
+	expectRefused(t, env.servePresigned(presigned), http.StatusForbidden, "issued for another file")
+}
+
+func TestPresignedURLDoesNotFollowTheBucketName(t *testing.T) {
+	env := newTestEnv(t)
+	buckets := NewBucketHandler(env.db, api.NewPager(env.cfg.PaginationSecret))
+	key := "private/report.txt"
+
+	// Deleted, then a new bucket created under the name
+	deleted := env.createBucket("photos")
+	beforeDelete := env.presign(env.putFile(deleted, key, []byte("deleted bucket")))
+	w := env.serve(buckets.DeleteBucket, newRequest(http.MethodDelete, "/buckets/"+strconv.Itoa(deleted)+"?force=true", nil),
+		map[string]string{"id": strconv.Itoa(deleted)})
+	expectStatus(t, w, http.StatusOK)
+	expectRefused(t, env.servePresigned(beforeDelete), http.StatusNotFound, "Bucket not found")
+	recreated := env.createBucket("photos")
+	env.putFile(recreated, key, []byte("recreated bucket"))
+	expectRefused(t, env.servePresigned(beforeDelete), http.StatusForbidden, "Invalid URL signature")
+
+	// Renamed, then another bucket takes the old name
+	renamed := env.createBucket("albums")
+	beforeRename := env.presign(env.putFile(renamed, key, []byte("renamed bucket")))
+	w = env.serve(buckets.RenameBucket, newRequest(http.MethodPost, "/buckets/"+strconv.Itoa(renamed)+"/rename",
+		models.RenameBucketRequest{Name: "archive"}), map[string]string{"id": strconv.Itoa(renamed)})
+	expectStatus(t, w, http.StatusOK)
+	expectRefused(t, env.servePresigned(beforeRename), http.StatusNotFound, "Bucket not found")
+	taken := env.createBucket("albums")
+	env.putFile(taken, key, []byte("bucket that took the name"))
+	expectRefused(t, env.servePresigned(beforeRename), http.StatusForbidden, "Invalid URL signature")
+}
@@ -1,34 +1,68 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	cachepackage "file-upload-service/cache"
+	"file-upload-service/config"
+	"file-upload-service/logger"
 	"file-upload-service/models"
 
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
 	"github.com/umakantv/go-utils/errs"
 	"github.com/umakantv/go-utils/httpserver"
-	logger "github.com/umakantv/go-utils/logger"
 	"go.uber.org/zap"
 )
 
 // PublicFileHandler handles public file access operations
 type PublicFileHandler struct {
-	db *sqlx.DB
+	db     *sqlx.DB
+	config *config.Config
+	locks  *PathLocks
+
+	// encoder converts images for browsers accepting smaller formats; nil when disabled
+	encoder ImageEncoder
+
+	// brotli is the path of the tool compressing br responses; empty when it was not found
+	brotli string
+
+	// rateLimits paces the requests of each address across instances
+	rateLimits cachepackage.RateLimitStore
+
+	// downloads gathers file downloads until they are flushed to the files table
+	downloads *DownloadCounts
 }
 
 // NewPublicFileHandler creates a new public file handler
-func NewPublicFileHandler(db *sqlx.DB) *PublicFileHandler {
+func NewPublicFileHandler(db *sqlx.DB, cfg *config.Config, locks *PathLocks, rateLimits cachepackage.RateLimitStore, downloads *DownloadCounts) *PublicFileHandler {
+	brotli, err := exec.LookPath(cfg.BrotliPath)
+	if err != nil {
+		logger.Info("brotli not found; public files will be compressed with gzip only", zap.String("command", cfg.BrotliPath))
+		brotli = ""
+	}
 	return &PublicFileHandler{
-		db: db,
+		db:         db,
+		config:     cfg,
+		locks:      locks,
+		encoder:    newImageEncoder(cfg),
+		brotli:     brotli,
+		rateLimits: rateLimits,
+		downloads:  downloads,
 	}
 }
 
@@ -57,7 +91,8 @@ func (h *PublicFileHandler) logRequest(ctx context.Context, level string, messag
 }
 
 // ServePublicFile handles GET /files/{bucket_name}/{file_path...} - serve public files
-// No authentication required, but CORS policy is enforced if configured
+// No authentication required, but CORS policy is enforced if configured. HEAD runs the
+// same checks and sends the same status and headers without the body.
 func (h *PublicFileHandler) ServePublicFile(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucketName := vars["bucket_name"]
@@ -66,17 +101,27 @@ func (h *PublicFileHandler) ServePublicFile(ctx context.Context, w http.Response
 	h.logRequest(ctx, "info", "Serving public file",
 		zap.String("bucket_name", bucketName),
 		zap.String("file_path", filePath),
+		zap.String("method", r.Method),
 	)
 
+	// Scrapers are paced before they cost any lookups
+	if !h.allowPublicRequest(ctx, w, r, "public", h.config.PublicRateLimitPerMinute, h.config.PublicRateLimitBurst) {
+		return
+	}
+
 	// Look up the bucket by name
 	var bucket models.Bucket
 	var corsPolicyStr string
 	var publicPathsStr string
 	var archivedInt int
+	var lowercaseKeysInt int
+	var imageSizesStr string
+	var hotlinkProtectionStr string
+	var responseHeadersStr string
 	err := h.db.QueryRow(
-		"SELECT id, name, client_id, cors_policy, public_paths, archived, created_at, updated_at FROM buckets WHERE name = ?",
+		"SELECT id, name, client_id, cors_policy, public_paths, archived, COALESCE(archive_mode, ''), lowercase_keys, image_sizes, convert_images, compression, compression_min_bytes, hotlink_protection, public_rate_limit, response_headers, created_at, updated_at FROM buckets WHERE name = ?",
 		bucketName,
-	).Scan(&bucket.ID, &bucket.Name, &bucket.ClientID, &corsPolicyStr, &publicPathsStr, &archivedInt, &bucket.CreatedAt, &bucket.UpdatedAt)
+	).Scan(&bucket.ID, &bucket.Name, &bucket.ClientID, &corsPolicyStr, &publicPathsStr, &archivedInt, &bucket.ArchiveMode, &lowercaseKeysInt, &imageSizesStr, &bucket.ConvertImages, &bucket.Compression, &bucket.CompressionMinBytes, &hotlinkProtectionStr, &bucket.PublicRateLimit, &responseHeadersStr, &bucket.CreatedAt, &bucket.UpdatedAt)
 
 	if err != nil {
 		h.logRequest(ctx, "error", "Bucket not found", zap.String("bucket_name", bucketName), zap.Error(err))
@@ -88,36 +133,159 @@ func (h *PublicFileHandler) ServePublicFile(ctx context.Context, w http.Response
 	bucket.CORSPolicy = json.RawMessage(corsPolicyStr)
 	bucket.PublicPaths = json.RawMessage(publicPathsStr)
 	bucket.Archived = archivedInt != 0
+	bucket.LowercaseKeys = lowercaseKeysInt != 0
+	bucket.ImageSizes = json.RawMessage(imageSizesStr)
+	bucket.HotlinkProtection = json.RawMessage(hotlinkProtectionStr)
+	bucket.ResponseHeaders = json.RawMessage(responseHeadersStr)
 
-	// Check if bucket is archived
-	if bucket.Archived {
+	// A bucket archived with freeze-all serves nothing publicly; freeze-writes keeps serving
+	if readsFrozen(bucket.Archived, bucket.ArchiveMode) {
 		h.logRequest(ctx, "error", "Bucket is archived", zap.String("bucket_name", bucketName))
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(errs.NewNotFoundError("Bucket not found"))
 		return
 	}
 
-	// Parse public paths
-	var publicPaths []string
-	if err := json.Unmarshal(bucket.PublicPaths, &publicPaths); err != nil {
+	// The bucket's own headers go out with every response from here on, errors, HEAD and
+	// 304 Not Modified included
+	setResponseHeaders(w, bucket.ResponseHeaders)
+
+	// A bucket may pace each address more tightly than the server does
+	if !h.allowPublicRequest(ctx, w, r, "public:"+strconv.Itoa(bucket.ID), bucket.PublicRateLimit, h.config.PublicRateLimitBurst) {
+		return
+	}
+
+	// Sanitize the requested key so every spelling of it resolves to the stored file
+	// and no spelling can reach outside the bucket. The router decoded it already.
+	rawFilePath := filePath
+	filePath, err = sanitizeDecodedKey(rawFilePath, bucket.LowercaseKeys)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid file path",
+			zap.String("bucket_name", bucketName),
+			zap.String("file_path", rawFilePath),
+			zap.Error(err),
+		)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	// Compile public paths, or reuse the bucket's compiled ones
+	publicPaths, err := publicPathMatcherFor(bucket.ID, publicPathsStr, bucket.LowercaseKeys)
+	if err != nil {
 		h.logRequest(ctx, "error", "Failed to parse public_paths", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to check public access"))
 		return
 	}
 
-	// Check if the requested file path matches any public path pattern
-	// filePath from mux includes the full path, we need to check if it's public
-	if !matchesPublicPath(filePath, publicPaths) {
-		h.logRequest(ctx, "info", "File is not publicly accessible",
+	// Pages of sites outside the bucket's hotlink protection get its placeholder file in
+	// place of the one asked for, or nothing. The response then depends on the requesting
+	// site, so caches are told to key on it.
+	placeholder := false
+	if protection := parseHotlinkProtection(bucket.HotlinkProtection); protection != nil {
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Referer")
+		if !hotlinkAllowed(r, protection) {
+			if protection.PlaceholderKey == "" {
+				h.logRequest(ctx, "info", "Hotlink refused",
+					zap.String("bucket_name", bucketName),
+					zap.String("file_path", filePath),
+					zap.String("referer", r.Header.Get("Referer")),
+				)
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(errs.NewAuthorizationError("Hotlinking is not allowed for this bucket"))
+				return
+			}
+			filePath, placeholder = protection.PlaceholderKey, true
+			if bucket.LowercaseKeys {
+				filePath = strings.ToLower(filePath)
+			}
+		}
+	}
+
+	// A thumbnail is public when its image is, and answers for that image's key below
+	imageKey := filePath
+	thumbnailSize := 0
+	if reservedKey(filePath) {
+		key, size, ok := parseThumbnailKey(filePath)
+		if !ok {
+			h.logRequest(ctx, "info", "Not a thumbnail key", zap.String("bucket_name", bucketName), zap.String("file_path", filePath))
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+			return
+		}
+		imageKey, thumbnailSize = key, size
+	}
+
+	// w, h and fit ask for a resized rendition of an image, in one of the bucket's sizes.
+	// The placeholder is always served as it is, and displayed.
+	var rendition renditionRequest
+	var resize bool
+	if !placeholder {
+		rendition, resize, err = parseRenditionRequest(r.URL.Query())
+	}
+	if err == nil && resize && thumbnailSize != 0 {
+		err = errors.New("Thumbnails cannot be resized")
+	}
+	if err == nil && resize && !imageSizeAllowed(imageSizesStr, rendition.Size) {
+		err = fmt.Errorf("Image size %s is not allowed for this bucket", rendition.Size)
+	}
+
+	// download=1 has browsers save the file instead of displaying it, under filename or the
+	// file's own name. The query is part of the URL, so caches keep it apart from the
+	// displayed file.
+	var download bool
+	var downloadFilename string
+	if err == nil && !placeholder {
+		download, downloadFilename, err = parsePublicDownload(r.URL.Query())
+	}
+	if err != nil {
+		h.logRequest(ctx, "info", "Invalid public file request",
 			zap.String("bucket_name", bucketName),
 			zap.String("file_path", filePath),
+			zap.Error(err),
 		)
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(errs.NewAuthorizationError("File is not publicly accessible"))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
 		return
 	}
 
+	// Check if the requested file path matches any public path pattern
+	// filePath from mux includes the full path, we need to check if it's public.
+	// Outside them, a presigned URL's signature over the bucket, key and file admits the
+	// request until it expires.
+	// The placeholder is served whatever its key.
+	var presignedUntil time.Time
+	if !placeholder && !publicPaths.Matches(imageKey) {
+		query := r.URL.Query()
+		if query.Get("sig") == "" {
+			h.logRequest(ctx, "info", "File is not publicly accessible",
+				zap.String("bucket_name", bucketName),
+				zap.String("file_path", filePath),
+			)
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(errs.NewAuthorizationError("File is not publicly accessible"))
+			return
+		}
+		presignedUntil, err = verifyPresignedURL(h.config.PresignedURLSecret, bucket.ID, bucket.Name, imageKey,
+			query.Get("file_id"), query.Get("expires"), query.Get("sig"), time.Now())
+		if err != nil {
+			h.logRequest(ctx, "info", "Presigned URL refused",
+				zap.String("bucket_name", bucketName),
+				zap.String("file_path", filePath),
+				zap.Error(err),
+			)
+			message := "Invalid URL signature"
+			if err == errPresignedURLExpired {
+				message = "Presigned URL has expired"
+			}
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(errs.NewAuthorizationError(message))
+			return
+		}
+	}
+
 	// Fetch the client name for constructing the file path
 	var clientName string
 	err = h.db.QueryRow("SELECT name FROM clients WHERE client_id = ?", bucket.ClientID).Scan(&clientName)
@@ -129,7 +297,87 @@ func (h *PublicFileHandler) ServePublicFile(ctx context.Context, w http.Response
 	}
 
 	// Construct the full file path: ./uploads/<client_name>/<bucket_name>/<file_path>
-	fullPath := filepath.Join("./uploads", clientName, bucketName, filePath)
+	fullPath, err := bucketFilePath(clientName, bucketName, filePath)
+	if err != nil {
+		h.logRequest(ctx, "error", "File path escapes bucket directory",
+			zap.String("bucket_name", bucketName),
+			zap.String("file_path", filePath),
+		)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	// Only a live file is served: bytes left on disk by a deleted, staged or unfinished
+	// upload are not. Thumbnails and renditions answer for their image's file.
+	stored, err := publicFileAtKey(h.db, bucket.ID, imageKey)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to look up public file", zap.String("file_path", filePath), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to access file"))
+		return
+	}
+	if stored == nil {
+		h.logRequest(ctx, "info", "File not found", zap.String("bucket_name", bucketName), zap.String("file_path", filePath))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+		return
+	}
+
+	// A presigned URL serves only the file it was issued for, not another stored at its key since
+	if !presignedUntil.IsZero() && stored.ID != r.URL.Query().Get("file_id") {
+		h.logRequest(ctx, "info", "Presigned URL refused",
+			zap.String("bucket_name", bucketName),
+			zap.String("file_path", filePath),
+			zap.Error(errPresignedURLFileChanged),
+		)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(errs.NewAuthorizationError("Presigned URL was issued for another file"))
+		return
+	}
+
+	// Content that has not been scanned yet is not served; quarantined content has already
+	// been moved out of the bucket directory
+	if stored.ScanStatus == models.ScanStatusPending {
+		h.logRequest(ctx, "info", "File is awaiting its scan", zap.String("bucket_name", bucketName), zap.String("file_path", filePath))
+		writeAwaitingScan(w)
+		return
+	}
+
+	// Content encrypted with a customer key is never served publicly; only its owner has the key
+	if stored.Encrypted {
+		h.logRequest(ctx, "info", "Refusing to serve encrypted file publicly", zap.String("bucket_name", bucketName), zap.String("file_path", filePath))
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(errs.NewAuthorizationError("File is encrypted with a customer-provided key and cannot be served publicly"))
+		return
+	}
+
+	// Thumbnails outliving their image or its content are not served while they await removal
+	if thumbnailSize != 0 {
+		current, err := currentThumbnailExists(h.db, bucket.ID, imageKey, thumbnailSize)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to query thumbnail", zap.String("file_path", filePath), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to access file"))
+			return
+		}
+		if !current {
+			h.logRequest(ctx, "info", "Thumbnail not found", zap.String("bucket_name", bucketName), zap.String("file_path", filePath))
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+			return
+		}
+	}
+
+	// Register as a reader so a concurrent deletion cannot remove the file mid-stream
+	readCtx, release, ok := h.locks.acquireDownload(ctx, fullPath, w)
+	if !ok {
+		h.logRequest(ctx, "info", "File is being deleted", zap.String("full_path", fullPath))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("File not found"))
+		return
+	}
+	defer release()
 
 	// Check if file exists
 	fileInfo, err := os.Stat(fullPath)
@@ -166,29 +414,311 @@ func (h *PublicFileHandler) ServePublicFile(ctx context.Context, w http.Response
 		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to read file"))
 		return
 	}
-	defer file.Close()
+	defer func() { file.Close() }()
+
+	// The mimetype stored with the file names its content; the extension is only a fallback
+	// for files stored without one, and for thumbnails
+	contentType := stored.Mimetype
+	if contentType == "" || thumbnailSize != 0 {
+		contentType = getContentTypeFromExtension(filepath.Ext(filePath))
+	}
+	// The file's own content is tagged with its checksum, which only changes with the
+	// content; thumbnails are not the content the checksum was taken of
+	etag, checksum := publicFileETag(fileInfo), ""
+	if thumbnailSize == 0 && stored.Checksum != "" {
+		etag, checksum = `"`+stored.Checksum+`"`, stored.Checksum
+	}
+	servedPath, servedInfo, servedRendition := fullPath, fileInfo, ""
+
+	// A rendition is served in place of the image, made from it the first time it is asked for
+	if resize {
+		if !decodableImageMimetypes[contentType] {
+			h.logRequest(ctx, "info", "File cannot be resized", zap.String("file_path", filePath), zap.String("content_type", contentType))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError("Only GIF, JPEG and PNG images can be resized"))
+			return
+		}
+		servedRendition = renditionKey(filePath, rendition)
+		renditionPath, err := bucketFilePath(clientName, bucketName, servedRendition)
+		if err == nil {
+			var renditionFile *os.File
+			renditionFile, err = h.openRendition(ctx, fullPath, fileInfo, renditionPath, rendition)
+			if err == nil {
+				file.Close()
+				file = renditionFile
+				servedPath = renditionPath
+				servedInfo, err = file.Stat()
+			}
+		}
+		var decodeErr *renditionDecodeError
+		if errors.As(err, &decodeErr) {
+			h.logRequest(ctx, "info", "Image cannot be resized", zap.String("file_path", filePath), zap.Error(err))
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(errs.NewValidationError("Image cannot be decoded for resizing"))
+			return
+		}
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to make rendition", zap.String("file_path", filePath), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to resize image"))
+			return
+		}
+		contentType = "image/jpeg"
+		etag, checksum = renditionETag(fileInfo, rendition), ""
+	}
 
-	// Determine content type based on file extension
-	contentType := getContentTypeFromExtension(filepath.Ext(filePath))
+	// Browsers naming a smaller format in Accept get the image converted to it when the bucket
+	// allows. The response then depends on Accept, so caches are told to key on it. Failing
+	// conversions fall back to the image as stored, and so do downloads, which save the file.
+	if bucket.ConvertImages && h.encoder != nil && convertibleImageMimetypes[contentType] && !download {
+		w.Header().Add("Vary", "Accept")
+		if mimetype, extension, ok := acceptedImageFormat(r.Header.Get("Accept"), h.encoder); ok {
+			convertedPath, err := bucketFilePath(clientName, bucketName, convertedKey(filePath, servedRendition, extension))
+			var converted *os.File
+			smaller := false
+			if err == nil {
+				converted, smaller, err = h.openConverted(ctx, servedPath, servedInfo, convertedPath, mimetype)
+			}
+			if err != nil {
+				h.logRequest(ctx, "error", "Failed to convert image",
+					zap.String("file_path", filePath),
+					zap.String("mimetype", mimetype),
+					zap.Error(err),
+				)
+			} else if smaller {
+				file.Close()
+				file = converted
+				contentType = mimetype
+				etag, checksum = convertedETag(etag, extension), ""
+			}
+		}
+	}
+
+	// Text assets are compressed for clients accepting gzip or br when the bucket allows,
+	// and always vary on Accept-Encoding so caches never hand one client another's encoding.
+	// The Content-Length set here is the compressed size, which ServeContent leaves unset
+	// for encoded content. Failing compression falls back to the file as stored.
+	var compressed []byte
+	if bucket.Compression && compressibleMimetype(contentType) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding, extension, ok := acceptedEncoding(r.Header.Get("Accept-Encoding"), h.brotli != "")
+		if ok && servedInfo.Size() >= bucket.CompressionMinBytes {
+			compressedPath, err := bucketFilePath(clientName, bucketName, convertedKey(filePath, servedRendition, extension))
+			var compressedFile *os.File
+			if err == nil {
+				compressed, compressedFile, err = h.compressContent(ctx, servedPath, servedInfo, compressedPath, encoding)
+			}
+			compressedSize := int64(len(compressed))
+			if err == nil && compressedFile != nil {
+				var info os.FileInfo
+				if info, err = compressedFile.Stat(); err == nil {
+					file.Close()
+					file = compressedFile
+					compressedSize = info.Size()
+				} else {
+					compressedFile.Close()
+					compressedFile = nil
+				}
+			}
+			if err != nil {
+				h.logRequest(ctx, "error", "Failed to compress file",
+					zap.String("file_path", filePath),
+					zap.String("encoding", encoding),
+					zap.Error(err),
+				)
+			} else if compressed != nil || compressedFile != nil {
+				w.Header().Set("Content-Encoding", encoding)
+				w.Header().Set("Content-Length", strconv.FormatInt(compressedSize, 10))
+				etag, checksum = convertedETag(etag, extension), ""
+			}
+		}
+	}
 
 	// Apply CORS headers if configured
 	applyCORSHeaders(w, r, bucket.CORSPolicy)
 
+	// A HEAD only checks the file, so it does not count as a download
+	if r.Method != http.MethodHead {
+		if err := touchClientDownload(h.db, bucket.ClientID, time.Now().UTC()); err != nil {
+			h.logRequest(ctx, "error", "Failed to record client activity", zap.String("client_id", bucket.ClientID), zap.Error(err))
+		}
+	}
+
+	// The file's own download count takes the requests that fetch it from the start, so a
+	// player reading a video in ranges counts once. Thumbnails, renditions and placeholders
+	// are not the file.
+	if r.Method != http.MethodHead && thumbnailSize == 0 && !resize && !placeholder && fromFirstByte(r.Header.Get("Range")) {
+		h.downloads.Record(stored.ID)
+	}
+
 	h.logRequest(ctx, "info", "Serving public file",
 		zap.String("bucket_name", bucketName),
 		zap.String("file_path", filePath),
 		zap.String("content_type", contentType),
 	)
 
-	// Set response headers
+	// Set response headers; the CORS headers above are already in place, since ServeContent
+	// writes the status line itself
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Cache-Control", "public, max-age=3600") // Cache for 1 hour
-	w.WriteHeader(http.StatusOK)
+	if placeholder {
+		// Caches must not hand the placeholder to pages allowed the file itself
+		w.Header().Set("Cache-Control", "no-store")
+	} else if presignedUntil.IsZero() {
+		w.Header().Set("Cache-Control", "public, max-age=3600") // Cache for 1 hour
+	} else {
+		// Shared caches would keep serving the file past the URL's expiry
+		maxAge := int(time.Until(presignedUntil) / time.Second)
+		w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(maxAge))
+	}
+	w.Header().Set("ETag", etag)
+	setChecksumHeader(w, checksum)
+	if download {
+		if downloadFilename == "" {
+			downloadFilename = stored.FileName
+		}
+		w.Header().Set("Content-Disposition", contentDisposition(models.DispositionAttachment, downloadFilename))
+	}
+	if h.config.FileMetaHeaders && thumbnailSize == 0 {
+		setFileMetaHeaders(w, decodeFileMetadata(stored.Metadata))
+	}
+
+	// ServeContent answers Range, If-Range, If-None-Match and If-Modified-Since from the
+	// ETag and the modification time. With sendfile on, it gets the file itself so the
+	// kernel can copy it, and a deletion that gives up waiting breaks the response through
+	// its write deadline. Otherwise reads also stop once the deletion cancels them.
+	var content io.ReadSeeker = contextFile{ctx: readCtx, File: file}
+	if h.config.FastTransfers {
+		content = file
+	}
+	if compressed != nil {
+		content = bytes.NewReader(compressed)
+	}
+	http.ServeContent(w, r, fileInfo.Name(), fileInfo.ModTime(), content)
+}
+
+// publicFile is the row of the live file a public request resolves to
+type publicFile struct {
+	ID         string `db:"id"`
+	Mimetype   string `db:"mimetype"`
+	Metadata   string `db:"metadata"`
+	FileName   string `db:"file_name"`
+	ScanStatus string `db:"scan_status"`
+	Encrypted  bool   `db:"encrypted"`
+	Checksum   string `db:"checksum"`
+}
+
+// publicFileAtKey returns the newest uploaded, undeleted file stored at a canonical key in
+// a bucket, outside upload groups still staging it; nil when there is none
+func publicFileAtKey(q sqlx.Queryer, bucketID int, key string) (*publicFile, error) {
+	var file publicFile
+	err := sqlx.Get(q, &file,
+		`SELECT id, COALESCE(mimetype, '') AS mimetype, COALESCE(metadata, '') AS metadata, file_name,
+			COALESCE(scan_status, '') AS scan_status, encryption_key_hash IS NOT NULL AS encrypted,
+			COALESCE(checksum, '') AS checksum
+		FROM files
+		WHERE bucket_id = ? AND key = ? AND status = ? AND deleted_at IS NULL AND staged = 0
+		ORDER BY updated_at DESC LIMIT 1`,
+		bucketID, key, models.FileStatusUploaded,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// parsePublicDownload reads the download and filename query parameters of a public
+// request. A filename implies download.
+func parsePublicDownload(query url.Values) (bool, string, error) {
+	filename := query.Get("filename")
+	if filename != "" && validateDownloadFilename(filename) != nil {
+		return false, "", fmt.Errorf("filename must be between 1 and %d bytes of UTF-8 without control characters", maxDownloadFilenameLength)
+	}
+	switch query.Get("download") {
+	case "1", "true":
+		return true, filename, nil
+	case "", "0", "false":
+		return filename != "", filename, nil
+	default:
+		return false, "", errors.New("download must be 1 or 0")
+	}
+}
 
-	// Stream file content
-	if _, err := io.Copy(w, file); err != nil {
-		h.logRequest(ctx, "error", "Failed to stream file", zap.Error(err))
+// fromFirstByte reports whether a Range header, if any, asks for the start of the file
+func fromFirstByte(rangeHeader string) bool {
+	if rangeHeader == "" {
+		return true
 	}
+	return strings.HasPrefix(strings.TrimSpace(rangeHeader), "bytes=0-")
+}
+
+// publicFileETag derives a strong ETag from the size and modification time of stored
+// content, which change whenever the content is replaced
+func publicFileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// contextFile is a file whose reads fail once ctx is cancelled
+type contextFile struct {
+	ctx context.Context
+	*os.File
+}
+
+// Read reads from the file unless ctx has been cancelled
+func (f contextFile) Read(p []byte) (int, error) {
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+// PublicFilePreflight handles OPTIONS /files/{bucket_name}/{file_path...} - answer a
+// browser's CORS preflight for a public file from the CORS policy of its bucket. Only the
+// bucket is checked; whether the file is public is left to the request that follows.
+func (h *PublicFileHandler) PublicFilePreflight(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	bucketName := mux.Vars(r)["bucket_name"]
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	if origin == "" || method == "" {
+		h.logRequest(ctx, "error", "Incomplete public file preflight request", zap.String("bucket_name", bucketName))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Preflight requests need Origin and Access-Control-Request-Method"))
+		return
+	}
+
+	var corsPolicy string
+	var archived bool
+	var archiveMode string
+	var responseHeaders string
+	err := h.db.QueryRow(
+		"SELECT cors_policy, archived, COALESCE(archive_mode, ''), response_headers FROM buckets WHERE name = ?",
+		bucketName,
+	).Scan(&corsPolicy, &archived, &archiveMode, &responseHeaders)
+	if err == nil && readsFrozen(archived, archiveMode) {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Bucket not found", zap.String("bucket_name", bucketName), zap.Error(err))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Bucket not found"))
+		return
+	}
+	setResponseHeaders(w, json.RawMessage(responseHeaders))
+
+	headers := preflightHeaders(r)
+	rule, ok := corsRuleFor(parseCORSRules(json.RawMessage(corsPolicy)), origin, method, headers)
+	if !ok {
+		h.logRequest(ctx, "info", "Public file preflight not allowed by bucket CORS policy",
+			zap.String("bucket_name", bucketName),
+			zap.String("origin", origin),
+			zap.String("method", method),
+		)
+		writeOriginNotAllowed(w)
+		return
+	}
+	writePreflight(w, origin, rule, headers)
 }
 
 // getContentTypeFromExtension returns the content type based on file extension
@@ -231,91 +761,3 @@ func getContentTypeFromExtension(ext string) string {
 		return "application/octet-stream"
 	}
 }
-
-// applyCORSHeaders applies CORS headers based on the bucket's CORS policy
-func applyCORSHeaders(w http.ResponseWriter, r *http.Request, corsPolicy json.RawMessage) {
-	// Parse CORS policy
-	var rules []models.CORSRule
-	if err := json.Unmarshal(corsPolicy, &rules); err != nil {
-		return
-	}
-
-	origin := r.Header.Get("Origin")
-	if origin == "" {
-		return
-	}
-
-	// Find a matching rule
-	for _, rule := range rules {
-		if isOriginAllowed(origin, rule.AllowedOrigins) {
-			// Set CORS headers
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-			w.Header().Set("Vary", "Origin")
-
-			if len(rule.AllowedMethods) > 0 {
-				w.Header().Set("Access-Control-Allow-Methods", strings.Join(rule.AllowedMethods, ", "))
-			}
-
-			if len(rule.AllowedHeaders) > 0 {
-				w.Header().Set("Access-Control-Allow-Headers", strings.Join(rule.AllowedHeaders, ", "))
-			}
-
-			if len(rule.ExposeHeaders) > 0 {
-				w.Header().Set("Access-Control-Expose-Headers", strings.Join(rule.ExposeHeaders, ", "))
-			}
-
-			break
-		}
-	}
-}
-
-// isOriginAllowed checks if the origin matches any of the allowed origins
-// Supports wildcards: * matches any sequence of characters
-func isOriginAllowed(origin string, allowedOrigins []string) bool {
-	for _, allowed := range allowedOrigins {
-		if allowed == "*" {
-			return true
-		}
-		if allowed == origin {
-			return true
-		}
-		// Check for wildcard match
-		if strings.Contains(allowed, "*") {
-			if matchWildcard(origin, allowed) {
-				return true
-			}
-		}
-	}
-	return false
-}
-
-// matchWildcard matches an origin against a pattern with wildcards
-func matchWildcard(origin, pattern string) bool {
-	// Simple wildcard matching - * matches any sequence of characters
-	parts := strings.Split(pattern, "*")
-	if len(parts) == 1 {
-		return origin == pattern
-	}
-
-	// Check prefix
-	if !strings.HasPrefix(origin, parts[0]) {
-		return false
-	}
-
-	// Check suffix
-	if !strings.HasSuffix(origin, parts[len(parts)-1]) {
-		return false
-	}
-
-	// Check middle parts in order
-	remaining := origin[len(parts[0]):]
-	for i := 1; i < len(parts)-1; i++ {
-		idx := strings.Index(remaining, parts[i])
-		if idx == -1 {
-			return false
-		}
-		remaining = remaining[idx+len(parts[i]):]
-	}
-
-	return true
-}
\ No newline at end of file
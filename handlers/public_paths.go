@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// errPublicPaths is returned for a public_paths that is not a JSON array of strings
+var errPublicPaths = errors.New("public_paths must be a valid JSON array of strings")
+
+// publicPathMatcher holds a bucket's public_paths compiled to regular expressions, the
+// patterns prefixed with "!" apart from the others
+type publicPathMatcher struct {
+	patterns   []*regexp.Regexp
+	exclusions []*regexp.Regexp
+}
+
+// Matches checks if a file key matches any of the public path patterns and none of the
+// exclusions. An exclusion vetoes the key wherever it appears in the list.
+func (m *publicPathMatcher) Matches(key string) bool {
+	for _, exclusion := range m.exclusions {
+		if exclusion.MatchString(key) {
+			return false
+		}
+	}
+	for _, pattern := range m.patterns {
+		if pattern.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedPublicPaths is a bucket's compiled matcher and the settings it was compiled from
+type cachedPublicPaths struct {
+	source    string
+	lowercase bool
+	matcher   *publicPathMatcher
+}
+
+// publicPathCache keeps each bucket's compiled public paths, so public requests do not
+// rebuild the regular expressions. An entry is recompiled once the bucket's public_paths
+// or lowercase_keys differ from what it was compiled from.
+var publicPathCache = struct {
+	mu      sync.Mutex
+	buckets map[int]cachedPublicPaths
+}{buckets: map[int]cachedPublicPaths{}}
+
+// publicPathMatcherFor returns the matcher for a bucket's stored public_paths. Patterns
+// are written against stored keys, which are lowercase in case-insensitive buckets.
+func publicPathMatcherFor(bucketID int, publicPaths string, lowercaseKeys bool) (*publicPathMatcher, error) {
+	publicPathCache.mu.Lock()
+	cached, ok := publicPathCache.buckets[bucketID]
+	publicPathCache.mu.Unlock()
+	if ok && cached.source == publicPaths && cached.lowercase == lowercaseKeys {
+		return cached.matcher, nil
+	}
+
+	var patterns []string
+	if err := json.Unmarshal([]byte(publicPaths), &patterns); err != nil {
+		return nil, err
+	}
+	matcher := &publicPathMatcher{}
+	for _, pattern := range patterns {
+		if lowercaseKeys {
+			pattern = strings.ToLower(pattern)
+		}
+		if strings.HasPrefix(pattern, "!") {
+			matcher.exclusions = append(matcher.exclusions, compilePublicPattern(pattern[1:]))
+			continue
+		}
+		matcher.patterns = append(matcher.patterns, compilePublicPattern(pattern))
+	}
+
+	publicPathCache.mu.Lock()
+	publicPathCache.buckets[bucketID] = cachedPublicPaths{source: publicPaths, lowercase: lowercaseKeys, matcher: matcher}
+	publicPathCache.mu.Unlock()
+	return matcher, nil
+}
+
+// compilePublicPattern turns a public path pattern into a regular expression matching
+// whole keys. "**" is read before "*": a "**" segment matches any number of folders
+// ("assets/**" is everything under assets/, "**/*.jpg" every .jpg at any depth), a "**"
+// inside a segment matches any characters including /, and "*" matches any characters
+// except /. The pattern "*" alone keeps meaning the whole bucket, the same as "**".
+func compilePublicPattern(pattern string) *regexp.Regexp {
+	if pattern == "*" {
+		pattern = "**"
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/") && (i == 0 || pattern[i-1] == '/'):
+			// Zero or more whole folders
+			expr.WriteString("(?:.*/)?")
+			i += 3
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i += 2
+		case pattern[i] == '*':
+			expr.WriteString("[^/]*")
+			i++
+		default:
+			j := i
+			for j < len(pattern) && pattern[j] != '*' {
+				j++
+			}
+			expr.WriteString(regexp.QuoteMeta(pattern[i:j]))
+			i = j
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
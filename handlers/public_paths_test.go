@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"file-upload-service/api"
+	"file-upload-service/models"
+)
+
+func TestPublicPathExclusionsWin(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("site")
+	env.db.MustExec(`UPDATE buckets SET public_paths = '["!pub/drafts/**", "pub/**"]' WHERE id = ?`, bucketID)
+	env.putFile(bucketID, "pub/index.html", []byte("live"))
+	env.putFile(bucketID, "pub/drafts/launch.html", []byte("draft"))
+
+	for key, want := range map[string]int{
+		"pub/index.html":         http.StatusOK,
+		"pub/drafts/launch.html": http.StatusForbidden,
+	} {
+		w := serveAnonymous(env.public.ServePublicFile, newRequest(http.MethodGet, "/files/site/"+key, nil),
+			map[string]string{"bucket_name": "site", "file_path": key})
+		if w.Code != want {
+			t.Errorf("%s: status = %d, want %d", key, w.Code, want)
+		}
+	}
+
+	onlyExclusions := env.createBucket("private")
+	env.db.MustExec(`UPDATE buckets SET public_paths = '["!pub/drafts/**"]' WHERE id = ?`, onlyExclusions)
+	env.putFile(onlyExclusions, "pub/index.html", []byte("live"))
+	w := serveAnonymous(env.public.ServePublicFile, newRequest(http.MethodGet, "/files/private/pub/index.html", nil),
+		map[string]string{"bucket_name": "private", "file_path": "pub/index.html"})
+	expectStatus(t, w, http.StatusForbidden)
+}
+
+func TestCreateBucketRejectsInvalidPublicPaths(t *testing.T) {
+	env := newTestEnv(t)
+	buckets := NewBucketHandler(env.db, api.NewPager(env.cfg.PaginationSecret))
+
+	for _, paths := range []string{`["!"]`, `["pub/**", ""]`, `"pub/**"`} {
+		w := env.serve(buckets.CreateBucket, newRequest(http.MethodPost, "/buckets",
+			models.CreateBucketRequest{Name: "site", PublicPaths: json.RawMessage(paths)}), nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("public_paths %s: status = %d, want %d", paths, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	w := env.serve(buckets.CreateBucket, newRequest(http.MethodPost, "/buckets",
+		models.CreateBucketRequest{Name: "site", PublicPaths: json.RawMessage(`["pub/**", "!pub/drafts/**"]`)}), nil)
+	expectStatus(t, w, http.StatusCreated)
+}
@@ -0,0 +1,518 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// quarantineRoot holds the bytes of infected files, outside every bucket's directory so
+// public paths never serve them
+const quarantineRoot = "./quarantine"
+
+// quarantinePath is where a quarantined file's bytes are kept
+func quarantinePath(fileID string) string {
+	return filepath.Join(quarantineRoot, fileID)
+}
+
+// pendingScanStatus is the scan_status stored with new content: pending when a scanner is
+// configured, NULL when uploads are not scanned
+func (h *FileHandler) pendingScanStatus() sql.NullString {
+	return sql.NullString{String: models.ScanStatusPending, Valid: h.scanner != nil}
+}
+
+// awaitingScan reports whether a file's current content has not been scanned yet. Such
+// content cannot be downloaded, whether or not a scanner is still configured.
+func awaitingScan(q sqlx.Queryer, fileID string) (bool, error) {
+	var pending bool
+	err := q.QueryRowx("SELECT EXISTS (SELECT 1 FROM files WHERE id = ? AND scan_status = ?)", fileID, models.ScanStatusPending).Scan(&pending)
+	return pending, err
+}
+
+// writeAwaitingScan responds with 409 for files whose content has not been scanned yet
+func writeAwaitingScan(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(errs.AppError{
+		Code:    http.StatusConflict,
+		Message: "File is awaiting its virus scan; try again shortly",
+	})
+}
+
+// writeQuarantined responds with 422 for uploads the scanner found infected
+func writeQuarantined(w http.ResponseWriter, signature string) {
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(errs.NewValidationError(
+		fmt.Sprintf("File failed the virus scan (%s) and has been quarantined", signature),
+	))
+}
+
+// scanTarget is a file whose current content awaits a scan. UpdatedAt is kept as stored
+// so the verdict is only recorded if the content has not changed since.
+type scanTarget struct {
+	ID        string
+	ClientID  string
+	BucketID  int
+	Key       string
+	DiskPath  string
+	UpdatedAt string
+	// KeyHash and IV are set when the content is encrypted with a customer key
+	KeyHash string
+	IV      string
+}
+
+// loadScanTarget fetches a live file awaiting a scan; sql.ErrNoRows when there is none
+func (h *FileHandler) loadScanTarget(fileID string) (*scanTarget, error) {
+	var target scanTarget
+	var clientName, bucketName string
+	err := h.db.QueryRow(
+		`SELECT f.id, f.client_id, f.bucket_id, f.key, CAST(f.updated_at AS TEXT),
+			COALESCE(f.encryption_key_hash, ''), COALESCE(f.encryption_iv, ''), c.name, b.name
+		FROM files f
+		JOIN clients c ON f.client_id = c.client_id
+		JOIN buckets b ON f.bucket_id = b.id
+		WHERE f.id = ? AND f.status = ? AND f.staged = 0 AND f.scan_status = ?`,
+		fileID, models.FileStatusUploaded, models.ScanStatusPending,
+	).Scan(&target.ID, &target.ClientID, &target.BucketID, &target.Key, &target.UpdatedAt, &target.KeyHash, &target.IV, &clientName, &bucketName)
+	if err != nil {
+		return nil, err
+	}
+	target.DiskPath, err = bucketFilePath(clientName, bucketName, target.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &target, nil
+}
+
+// scanFile scans the current content of a file awaiting a scan and records the verdict,
+// quarantining infected content. A verdict for content replaced while it was scanned is
+// dropped, leaving the new content pending. Returns the file's scan status afterwards
+// (pending when the content could not be scanned), with the signature found in infected
+// content; the status is empty when the file no longer awaits a scan. Content encrypted
+// with a customer key is decrypted for the scanner with encKey, and cannot be scanned
+// without it.
+func (h *FileHandler) scanFile(ctx context.Context, fileID string, encKey *customerKey) (string, string, error) {
+	target, err := h.loadScanTarget(fileID)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	if err != nil {
+		return models.ScanStatusPending, "", err
+	}
+	if target.KeyHash != "" && (encKey == nil || !customerKeyMatches(target.KeyHash, encKey.Key)) {
+		return models.ScanStatusPending, "", errEncryptionKeyRequired
+	}
+
+	f, err := os.Open(target.DiskPath)
+	if err != nil {
+		return models.ScanStatusPending, "", err
+	}
+	var content io.Reader = f
+	if target.KeyHash != "" {
+		if content, err = decryptStored(encKey.Key, target.IV, f); err != nil {
+			f.Close()
+			return models.ScanStatusPending, "", err
+		}
+	}
+	clean, signature, err := h.scanner.Scan(ctx, content)
+	f.Close()
+	if err != nil {
+		return models.ScanStatusPending, "", err
+	}
+
+	now := time.Now().UTC()
+	if !clean {
+		return h.quarantineFile(target, signature, now)
+	}
+	result, err := h.db.Exec(
+		"UPDATE files SET scan_status = ?, scan_signature = NULL, scanned_at = ? WHERE id = ? AND scan_status = ? AND updated_at = ?",
+		models.ScanStatusClean, now, target.ID, models.ScanStatusPending, target.UpdatedAt,
+	)
+	if err != nil {
+		return models.ScanStatusPending, "", err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return models.ScanStatusPending, "", nil
+	}
+	return models.ScanStatusClean, "", nil
+}
+
+// quarantineFile marks an infected file quarantined and moves its bytes out of the bucket
+// inside the same transaction, so the key stops serving them as the file leaves listings
+func (h *FileHandler) quarantineFile(target *scanTarget, signature string, now time.Time) (string, string, error) {
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return models.ScanStatusPending, "", err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`UPDATE files SET status = ?, scan_status = ?, scan_signature = ?, scanned_at = ?, updated_at = ?
+		WHERE id = ? AND status = ? AND staged = 0 AND scan_status = ? AND updated_at = ?`,
+		models.FileStatusQuarantined, models.ScanStatusInfected, signature, now, now,
+		target.ID, models.FileStatusUploaded, models.ScanStatusPending, target.UpdatedAt,
+	)
+	if err != nil {
+		return models.ScanStatusPending, "", err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return models.ScanStatusPending, "", nil
+	}
+	if err := recordAuditEvent(tx, models.AuditEvent{
+		Action:   models.AuditActionFileQuarantined,
+		Actor:    "scanner",
+		ClientID: target.ClientID,
+		FileID:   target.ID,
+		Detail: map[string]interface{}{
+			"signature": signature,
+			"bucket_id": target.BucketID,
+			"key":       target.Key,
+		},
+	}, now); err != nil {
+		return models.ScanStatusPending, "", err
+	}
+
+	if err := os.MkdirAll(quarantineRoot, 0755); err != nil {
+		return models.ScanStatusPending, "", err
+	}
+	if err := os.Rename(target.DiskPath, quarantinePath(target.ID)); err != nil {
+		return models.ScanStatusPending, "", err
+	}
+	if err := tx.Commit(); err != nil {
+		os.Rename(quarantinePath(target.ID), target.DiskPath)
+		return models.ScanStatusPending, "", err
+	}
+
+	logger.Info("File quarantined",
+		zap.String("file_id", target.ID),
+		zap.String("client_id", target.ClientID),
+		zap.String("signature", signature),
+	)
+	return models.ScanStatusInfected, signature, nil
+}
+
+// scanAfterUpload scans content that just landed when it is no larger than
+// SCAN_SYNC_MAX_BYTES; larger content is left pending for the background scanner, as is
+// content the scanner could not be reached for. Content encrypted with a customer key is
+// always scanned here, since the background scanner never has the key. Returns the file's
+// scan status and the signature of infected content, both empty when no scanner is
+// configured.
+func (h *FileHandler) scanAfterUpload(ctx context.Context, fileID string, size int64, encKey *customerKey) (string, string) {
+	if h.scanner == nil {
+		return "", ""
+	}
+	if size > h.config.ScanSyncMaxBytes && encKey == nil {
+		return models.ScanStatusPending, ""
+	}
+	status, signature, err := h.scanFile(ctx, fileID, encKey)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to scan upload; leaving it to the background scanner",
+			zap.String("file_id", fileID),
+			zap.Error(err),
+		)
+	}
+	return status, signature
+}
+
+// StartScanSweeper periodically scans files left pending: uploads too large to scan in
+// their request, upload group commits, and scans that failed. Only the instance holding
+// the sweeper's lease runs it, and nothing runs when no scanner is configured.
+func (h *FileHandler) StartScanSweeper(interval time.Duration) {
+	if h.scanner == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			h.jobs.runPeriodic(scanSweeperLease, h.sweepPendingScans)
+		}
+	}()
+}
+
+// sweepPendingScans scans up to MAX_SYNC_ROWS pending files, oldest first, stopping
+// between files once ctx is cancelled. Content encrypted with a customer key is skipped.
+func (h *FileHandler) sweepPendingScans(ctx context.Context) {
+	var fileIDs []string
+	if err := h.db.Select(&fileIDs,
+		`SELECT id FROM files WHERE scan_status = ? AND status = ? AND staged = 0 AND encryption_key_hash IS NULL
+		ORDER BY updated_at LIMIT ?`,
+		models.ScanStatusPending, models.FileStatusUploaded, h.config.MaxSyncRows,
+	); err != nil {
+		logger.Error("Failed to query files awaiting a scan", zap.Error(err))
+		return
+	}
+
+	for _, fileID := range fileIDs {
+		if ctx.Err() != nil {
+			return
+		}
+		if _, _, err := h.scanFile(ctx, fileID, nil); err != nil {
+			logger.Error("Failed to scan file", zap.String("file_id", fileID), zap.Error(err))
+		}
+	}
+}
+
+// ListQuarantinedFiles handles GET /admin/quarantine - list files the scanner found
+// infected, in id order, a page of MAX_SYNC_ROWS at a time
+func (h *FileHandler) ListQuarantinedFiles(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(ctx, w) {
+		return
+	}
+
+	query := `SELECT id, client_id, bucket_id, key, file_name, file_size, mimetype, COALESCE(scan_signature, '') AS scan_signature, scanned_at
+		FROM files WHERE status = ?`
+	args := []interface{}{models.FileStatusQuarantined}
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		query += " AND id > ?"
+		args = append(args, cursor)
+	}
+
+	// Fetch one row past the limit so we know whether the listing was truncated
+	maxRows := h.config.MaxSyncRows
+	query += " ORDER BY id ASC LIMIT ?"
+	args = append(args, maxRows+1)
+
+	files := make([]models.QuarantinedFile, 0)
+	if err := h.db.Select(&files, query, args...); err != nil {
+		h.logRequest(ctx, "error", "Failed to query quarantined files", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to list quarantined files"))
+		return
+	}
+
+	response := models.QuarantineListResponse{Files: files}
+	if len(files) > maxRows {
+		response.Files = files[:maxRows]
+		response.Truncated = true
+		response.NextCursor = files[maxRows-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// quarantinedFile is a quarantined file with where its bytes return to on release
+type quarantinedFile struct {
+	ClientID string
+	BucketID int
+	Key      string
+	DiskPath string
+}
+
+// loadQuarantinedFile fetches a quarantined file; sql.ErrNoRows when there is none
+func (h *FileHandler) loadQuarantinedFile(fileID string) (*quarantinedFile, error) {
+	var file quarantinedFile
+	var clientName, bucketName string
+	err := h.db.QueryRow(
+		`SELECT f.client_id, f.bucket_id, f.key, c.name, b.name
+		FROM files f
+		JOIN clients c ON f.client_id = c.client_id
+		JOIN buckets b ON f.bucket_id = b.id
+		WHERE f.id = ? AND f.status = ?`,
+		fileID, models.FileStatusQuarantined,
+	).Scan(&file.ClientID, &file.BucketID, &file.Key, &clientName, &bucketName)
+	if err != nil {
+		return nil, err
+	}
+	file.DiskPath, err = bucketFilePath(clientName, bucketName, file.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// errQuarantineKeyTaken is returned when a quarantined file's key holds another file
+var errQuarantineKeyTaken = fmt.Errorf("key holds another file")
+
+// ReleaseQuarantinedFile handles POST /admin/quarantine/{id}/release - an admin judged the
+// scanner's verdict a false positive: the file's bytes return to its key and it becomes
+// downloadable again. Refused while another file is stored at the key.
+func (h *FileHandler) ReleaseQuarantinedFile(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(ctx, w) {
+		return
+	}
+	fileID := mux.Vars(r)["id"]
+	auth := httpserver.GetRequestAuth(ctx)
+
+	file, err := h.loadQuarantinedFile(fileID)
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "info", "Quarantined file not found", zap.String("file_id", fileID))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Quarantined file not found"))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to load quarantined file", zap.String("file_id", fileID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to release file"))
+		return
+	}
+
+	err = h.releaseQuarantinedFile(fileID, file, auth.Client, time.Now().UTC())
+	if err == errQuarantineKeyTaken {
+		h.logRequest(ctx, "info", "Quarantined file's key holds another file", zap.String("file_id", fileID), zap.String("key", file.Key))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.AppError{
+			Code:    http.StatusConflict,
+			Message: "Another file is stored at this key; delete it or the quarantined file",
+		})
+		return
+	}
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Quarantined file not found"))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to release quarantined file", zap.String("file_id", fileID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to release file"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Quarantined file released", zap.String("file_id", fileID))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.QuarantineResolutionResponse{
+		FileID:     fileID,
+		Status:     models.FileStatusUploaded,
+		ScanStatus: models.ScanStatusReleased,
+	})
+}
+
+// releaseQuarantinedFile marks the file uploaded and moves its bytes back to its key in
+// one transaction, recording the admin's decision in the audit log
+func (h *FileHandler) releaseQuarantinedFile(fileID string, file *quarantinedFile, actor string, now time.Time) error {
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	if err := tx.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM files WHERE bucket_id = ? AND key = ? AND status = ? AND staged = 0)",
+		file.BucketID, file.Key, models.FileStatusUploaded,
+	).Scan(&taken); err != nil {
+		return err
+	}
+	if taken {
+		return errQuarantineKeyTaken
+	}
+
+	result, err := tx.Exec(
+		"UPDATE files SET status = ?, scan_status = ?, updated_at = ? WHERE id = ? AND status = ?",
+		models.FileStatusUploaded, models.ScanStatusReleased, now, fileID, models.FileStatusQuarantined,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := recordAuditEvent(tx, models.AuditEvent{
+		Action:   models.AuditActionQuarantineRelease,
+		Actor:    actor,
+		ClientID: file.ClientID,
+		FileID:   fileID,
+	}, now); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file.DiskPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(quarantinePath(fileID), file.DiskPath); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		os.Rename(file.DiskPath, quarantinePath(fileID))
+		return err
+	}
+	return nil
+}
+
+// DeleteQuarantinedFile handles DELETE /admin/quarantine/{id} - remove an infected file's
+// bytes for good and mark it deleted
+func (h *FileHandler) DeleteQuarantinedFile(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(ctx, w) {
+		return
+	}
+	fileID := mux.Vars(r)["id"]
+	auth := httpserver.GetRequestAuth(ctx)
+
+	err := h.deleteQuarantinedFile(fileID, auth.Client, time.Now().UTC())
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "info", "Quarantined file not found", zap.String("file_id", fileID))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Quarantined file not found"))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to delete quarantined file", zap.String("file_id", fileID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to delete file"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Quarantined file deleted", zap.String("file_id", fileID))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.QuarantineResolutionResponse{
+		FileID:     fileID,
+		Status:     models.FileStatusDeleted,
+		ScanStatus: models.ScanStatusInfected,
+	})
+}
+
+// deleteQuarantinedFile marks the file deleted and removes its quarantined bytes in one
+// transaction, recording the admin's decision in the audit log
+func (h *FileHandler) deleteQuarantinedFile(fileID, actor string, now time.Time) error {
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var clientID string
+	err = tx.QueryRow(
+		"UPDATE files SET status = ?, deleted_at = ?, updated_at = ? WHERE id = ? AND status = ? RETURNING client_id",
+		models.FileStatusDeleted, now, now, fileID, models.FileStatusQuarantined,
+	).Scan(&clientID)
+	if err != nil {
+		return err
+	}
+	if err := recordAuditEvent(tx, models.AuditEvent{
+		Action:   models.AuditActionQuarantineDelete,
+		Actor:    actor,
+		ClientID: clientID,
+		FileID:   fileID,
+	}, now); err != nil {
+		return err
+	}
+
+	if err := os.Remove(quarantinePath(fileID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return tx.Commit()
+}
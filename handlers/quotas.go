@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// quotaError refuses an upload for a quota: an *ownerQuotaError or a *bucketQuotaError
+type quotaError interface {
+	error
+	// refusal builds the 403 body refusing the upload and its message, led by prefix
+	refusal(prefix string) (body interface{}, message string)
+	// logFields describe the refusal in the request log
+	logFields() []zap.Field
+}
+
+// asQuotaError reports whether err refused an upload for a quota
+func asQuotaError(err error) (quotaError, bool) {
+	var ownerErr *ownerQuotaError
+	if errors.As(err, &ownerErr) {
+		return ownerErr, true
+	}
+	var bucketErr *bucketQuotaError
+	if errors.As(err, &bucketErr) {
+		return bucketErr, true
+	}
+	return nil, false
+}
+
+// checkUploadQuotas refuses a prepared upload with a quotaError when it would take its
+// owner entity past their quota or its bucket past its limits. Like checkOwnerQuota and
+// checkBucketQuota, it must run inside the serialized transaction inserting the row.
+func checkUploadQuotas(q sqlx.Queryer, upload *pendingUpload, now time.Time) error {
+	if err := checkOwnerQuota(q, upload, now); err != nil {
+		return err
+	}
+	return checkBucketQuota(q, upload, now)
+}
+
+// writeQuotaExceeded answers 403 for an upload refused by a quota. prefix locates the
+// upload within a request of several, such as "entries[2]: "
+func (h *FileHandler) writeQuotaExceeded(ctx context.Context, w http.ResponseWriter, quotaErr quotaError, prefix string) {
+	h.logRequest(ctx, "error", "Storage quota exceeded", quotaErr.logFields()...)
+	body, _ := quotaErr.refusal(prefix)
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/umakantv/go-utils/errs"
+	"go.uber.org/zap"
+)
+
+// errPublicRateLimit is returned for a negative public_rate_limit
+var errPublicRateLimit = errors.New("public_rate_limit must be 0 or greater")
+
+// allowPublicRequest takes a token for the address a public request came from out of the
+// token bucket of scope, which refills at perMinute tokens a minute up to burst. Once the
+// address has none left, it answers 429 with Retry-After and reports false. A limit of 0
+// lets every request through, and so does a rate limit store that cannot be reached:
+// public files stay up when Redis is down.
+func (h *PublicFileHandler) allowPublicRequest(ctx context.Context, w http.ResponseWriter, r *http.Request, scope string, perMinute, burst int) bool {
+	if perMinute <= 0 || h.rateLimits == nil {
+		return true
+	}
+	if burst > perMinute {
+		burst = perMinute
+	}
+	ip := clientIP(r, h.config.TrustedProxies)
+	allowed, wait, err := h.rateLimits.Allow(scope+":"+ip, perMinute, burst)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to check public rate limit", zap.String("scope", scope), zap.Error(err))
+		return true
+	}
+	if allowed {
+		return true
+	}
+
+	h.logRequest(ctx, "info", "Public rate limit exceeded", zap.String("scope", scope), zap.String("remote_ip", ip))
+	retryAfter := int((wait + time.Second - 1) / time.Second)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(errs.AppError{
+		Code:    http.StatusTooManyRequests,
+		Message: "Too many requests; try again later",
+	})
+	return false
+}
@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// maxImageSizes is how many sizes a bucket may let the public route resize images to
+	maxImageSizes = 8
+	// renditionWait is how long a request waits for another one making the same rendition
+	renditionWait = 30 * time.Second
+)
+
+const (
+	// FitContain scales an image to fit within the requested size, keeping all of it
+	FitContain = "contain"
+	// FitCover scales an image to fill the requested size, cropping what lies outside it
+	FitCover = "cover"
+)
+
+// errImageSizes is returned for image_sizes that are not a valid list of sizes
+var errImageSizes = fmt.Errorf("image_sizes must be a JSON array of at most %d sizes such as \"640x480\" or \"320x0\", each side 0 or between %d and %d pixels",
+	maxImageSizes, minThumbnailWidth, maxThumbnailWidth)
+
+// errRenditionParams is returned for w, h and fit query parameters that cannot be parsed
+var errRenditionParams = errors.New("w and h must be whole numbers of pixels, and fit cover or contain")
+
+// imageSize is a size images may be resized to. A side of 0 follows from the other one
+// and the image's aspect ratio.
+type imageSize struct {
+	Width  int
+	Height int
+}
+
+// String formats the size the way image_sizes lists it
+func (s imageSize) String() string {
+	return strconv.Itoa(s.Width) + "x" + strconv.Itoa(s.Height)
+}
+
+// parseImageSize parses a "<width>x<height>" size
+func parseImageSize(value string) (imageSize, bool) {
+	width, height, found := strings.Cut(value, "x")
+	if !found {
+		return imageSize{}, false
+	}
+	w, errW := strconv.Atoi(width)
+	h, errH := strconv.Atoi(height)
+	if errW != nil || errH != nil {
+		return imageSize{}, false
+	}
+	return imageSize{Width: w, Height: h}, true
+}
+
+// validImageSide reports whether a side of a size is 0 or within the thumbnail bounds
+func validImageSide(side int) bool {
+	return side == 0 || (side >= minThumbnailWidth && side <= maxThumbnailWidth)
+}
+
+// validateImageSizes validates the image_sizes of a bucket and returns the normalised JSON
+// to store: the sizes without duplicates, in ascending order ("[]" if nil/empty)
+func validateImageSizes(raw json.RawMessage) (json.RawMessage, error) {
+	if len(raw) == 0 {
+		return json.RawMessage("[]"), nil
+	}
+	var values []string
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, errImageSizes
+	}
+	sizes := make([]imageSize, 0, len(values))
+	for _, value := range values {
+		size, ok := parseImageSize(strings.TrimSpace(value))
+		if !ok || !validImageSide(size.Width) || !validImageSide(size.Height) || size.Width+size.Height == 0 {
+			return nil, errImageSizes
+		}
+		sizes = append(sizes, size)
+	}
+	sort.Slice(sizes, func(i, j int) bool {
+		if sizes[i].Width != sizes[j].Width {
+			return sizes[i].Width < sizes[j].Width
+		}
+		return sizes[i].Height < sizes[j].Height
+	})
+	unique := make([]string, 0, len(sizes))
+	for i, size := range sizes {
+		if i == 0 || size != sizes[i-1] {
+			unique = append(unique, size.String())
+		}
+	}
+	if len(unique) > maxImageSizes {
+		return nil, errImageSizes
+	}
+	clean, err := json.Marshal(unique)
+	if err != nil {
+		return nil, err
+	}
+	return clean, nil
+}
+
+// renditionRequest is a resized copy of an image asked for on the public route
+type renditionRequest struct {
+	Size imageSize
+	Fit  string
+}
+
+// parseRenditionRequest reads the w, h and fit query parameters of a public request. ok
+// is false when none is set and the file itself is asked for. fit defaults to contain
+// and is always contain when a side is left to the aspect ratio, so each rendition has
+// one spelling.
+func parseRenditionRequest(query url.Values) (req renditionRequest, ok bool, err error) {
+	width, height, fit := query.Get("w"), query.Get("h"), query.Get("fit")
+	if width == "" && height == "" && fit == "" {
+		return renditionRequest{}, false, nil
+	}
+	for _, side := range []struct {
+		value string
+		dst   *int
+	}{{width, &req.Size.Width}, {height, &req.Size.Height}} {
+		if side.value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(side.value)
+		if err != nil || n < 0 {
+			return renditionRequest{}, true, errRenditionParams
+		}
+		*side.dst = n
+	}
+	switch fit {
+	case "", FitContain:
+		req.Fit = FitContain
+	case FitCover:
+		req.Fit = FitCover
+	default:
+		return renditionRequest{}, true, errRenditionParams
+	}
+	if req.Size.Width == 0 || req.Size.Height == 0 {
+		req.Fit = FitContain
+	}
+	return req, true, nil
+}
+
+// imageSizeAllowed reports whether a bucket's image_sizes, as stored, list a size
+func imageSizeAllowed(imageSizes string, size imageSize) bool {
+	var sizes []string
+	if err := json.Unmarshal([]byte(imageSizes), &sizes); err != nil {
+		return false
+	}
+	for _, allowed := range sizes {
+		if allowed == size.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// renditionKey returns the key a rendition of the image at key is cached under, beside
+// the image's thumbnails. The name never parses as a thumbnail, so it is not served at
+// its own public path.
+func renditionKey(key string, req renditionRequest) string {
+	return thumbnailDir + "/" + key + "/" + req.Size.String() + "-" + req.Fit + ".jpg"
+}
+
+// isRenditionName reports whether a file name in an image's thumbnail folder is one made
+// by renditionKey, or by convertedKey in a converted format or content encoding
+func isRenditionName(name string) bool {
+	extension := filepath.Ext(name)
+	base := strings.TrimSuffix(name, extension)
+	switch extension {
+	case ".jpg":
+	case ".webp", ".avif", ".gz", ".br":
+		if base == "original" {
+			return true
+		}
+	default:
+		return false
+	}
+	size, fit, found := strings.Cut(base, "-")
+	if !found || (fit != FitContain && fit != FitCover) {
+		return false
+	}
+	_, ok := parseImageSize(size)
+	return ok
+}
+
+// renditionETag derives the ETag of a rendition from that of its source content and the
+// requested size and fit, so caches keep one entry per rendition
+func renditionETag(source os.FileInfo, req renditionRequest) string {
+	return fmt.Sprintf(`"%x-%x-%s-%s"`, source.Size(), source.ModTime().UnixNano(), req.Size, req.Fit)
+}
+
+// renditionGeometry returns the area of a srcWidth by srcHeight image a rendition is made
+// of and the rendition's pixel size. Images are never enlarged: a rendition of a smaller
+// image keeps the requested aspect ratio at the image's own resolution.
+func renditionGeometry(srcWidth, srcHeight int, req renditionRequest) (image.Rectangle, int, int) {
+	crop := image.Rect(0, 0, srcWidth, srcHeight)
+	width, height := req.Size.Width, req.Size.Height
+	switch {
+	case height == 0 || (width != 0 && req.Fit == FitContain && srcWidth*height > srcHeight*width):
+		// The width bounds the image
+		if width > srcWidth {
+			width = srcWidth
+		}
+		height = scaleSide(srcHeight, width, srcWidth)
+	case width == 0 || req.Fit == FitContain:
+		// The height bounds the image
+		if height > srcHeight {
+			height = srcHeight
+		}
+		width = scaleSide(srcWidth, height, srcHeight)
+	default:
+		// Cover: crop the middle of the image to the requested aspect ratio
+		cropWidth, cropHeight := srcWidth, srcHeight
+		if srcWidth*height > srcHeight*width {
+			cropWidth = scaleSide(srcHeight, width, height)
+		} else {
+			cropHeight = scaleSide(srcWidth, height, width)
+		}
+		x0, y0 := (srcWidth-cropWidth)/2, (srcHeight-cropHeight)/2
+		crop = image.Rect(x0, y0, x0+cropWidth, y0+cropHeight)
+		if cropWidth < width {
+			width, height = cropWidth, cropHeight
+		}
+	}
+	return crop, width, height
+}
+
+// scaleSide returns side scaled by num/den, rounded, and at least 1 pixel
+func scaleSide(side, num, den int) int {
+	if scaled := (side*num + den/2) / den; scaled > 1 {
+		return scaled
+	}
+	return 1
+}
+
+// errRenditionBusy is returned when another request held a rendition for longer than
+// renditionWait
+var errRenditionBusy = errors.New("rendition is being made by another request")
+
+// openRendition opens the cached rendition of the source image at sourcePath, making it
+// first when it is missing or older than the source's content
+func (h *PublicFileHandler) openRendition(ctx context.Context, sourcePath string, source os.FileInfo, renditionPath string, req renditionRequest) (*os.File, error) {
+	return h.openDerived(ctx, renditionPath, source, func() error {
+		src, err := os.Open(sourcePath)
+		if err != nil {
+			return err
+		}
+		img, err := decodeThumbnailSource(src)
+		src.Close()
+		if err != nil {
+			return &renditionDecodeError{err}
+		}
+
+		crop, width, height := renditionGeometry(img.Rect.Dx(), img.Rect.Dy(), req)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resampleImage(img, crop, width, height), &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			return err
+		}
+		_, err = storeFile(renditionPath, &buf, int64(buf.Len()), nil)
+		return err
+	})
+}
+
+// openDerived opens a file cached at path that is derived from source content, calling
+// build to make it first when it is missing or older than the content. One request at a
+// time builds a given file; the others wait for it and serve the result.
+func (h *PublicFileHandler) openDerived(ctx context.Context, path string, source os.FileInfo, build func() error) (*os.File, error) {
+	if f, ok := openCurrentRendition(path, source); ok {
+		return f, nil
+	}
+
+	release, ok := h.locks.acquireWrite(ctx, path, renditionWait)
+	if !ok {
+		return nil, errRenditionBusy
+	}
+	defer release()
+
+	// Another request may have made it while this one waited
+	if f, ok := openCurrentRendition(path, source); ok {
+		return f, nil
+	}
+	if err := build(); err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// renditionDecodeError is returned when the source of a rendition cannot be decoded, or is
+// too large to
+type renditionDecodeError struct {
+	err error
+}
+
+func (e *renditionDecodeError) Error() string {
+	return "failed to decode image: " + e.err.Error()
+}
+
+// openCurrentRendition opens a cached rendition unless it is missing or was made before
+// the source's content last changed
+func openCurrentRendition(renditionPath string, source os.FileInfo) (*os.File, bool) {
+	info, err := os.Stat(renditionPath)
+	if err != nil || info.ModTime().Before(source.ModTime()) {
+		return nil, false
+	}
+	f, err := os.Open(renditionPath)
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// removeRenditions removes the cached renditions and converted copies of a file. Renditions of content that
+// was replaced since are made again on request, so only deletion needs to clear them.
+func removeRenditions(q sqlx.Queryer, fileID string) error {
+	var clientName, bucketName, key string
+	err := q.QueryRowx(
+		`SELECT c.name, b.name, f.key FROM files f
+		JOIN buckets b ON f.bucket_id = b.id
+		JOIN clients c ON f.client_id = c.client_id
+		WHERE f.id = ?`,
+		fileID,
+	).Scan(&clientName, &bucketName, &key)
+	if err != nil {
+		return err
+	}
+	dir, err := bucketFilePath(clientName, bucketName, thumbnailDir+"/"+key)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	paths := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && isRenditionName(entry.Name()) {
+			paths = append(paths, filepath.Join(dir, entry.Name()))
+		}
+	}
+	removeThumbnailFiles(paths)
+	return nil
+}
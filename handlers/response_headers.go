@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// maxResponseHeaders is how many headers response_headers may hold
+const maxResponseHeaders = 20
+
+// maxResponseHeaderValue is the longest value, in bytes, a response header may have
+const maxResponseHeaderValue = 4096
+
+// errResponseHeaders is returned for response_headers that is not a JSON object
+var errResponseHeaders = fmt.Errorf("response_headers must be null or a JSON object of at most %d header names and string values", maxResponseHeaders)
+
+// reservedResponseHeaders frame the response or the connection, so a bucket may not set them
+var reservedResponseHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Content-Encoding":  true,
+	"Content-Range":     true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Upgrade":           true,
+}
+
+// validateResponseHeaders validates the response_headers of a bucket and returns the
+// normalised JSON to store, with canonical header names ("{}" if nil/empty)
+func validateResponseHeaders(raw json.RawMessage) (json.RawMessage, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return json.RawMessage("{}"), nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal(raw, &headers); err != nil {
+		return nil, errResponseHeaders
+	}
+	if len(headers) > maxResponseHeaders {
+		return nil, errResponseHeaders
+	}
+	clean := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if name == "*" || !validHeaderName(name) {
+			return nil, fmt.Errorf("response_headers: %q is not a header name", name)
+		}
+		canonical := http.CanonicalHeaderKey(name)
+		if reservedResponseHeaders[canonical] {
+			return nil, fmt.Errorf("response_headers: %s is set by the server and cannot be overridden", canonical)
+		}
+		if _, ok := clean[canonical]; ok {
+			return nil, fmt.Errorf("response_headers: %s is given more than once", canonical)
+		}
+		if len(value) > maxResponseHeaderValue || !validHeaderValue(value) {
+			return nil, fmt.Errorf("response_headers: the value of %s must be at most %d bytes without control characters", canonical, maxResponseHeaderValue)
+		}
+		clean[canonical] = value
+	}
+	out, err := json.Marshal(clean)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// validHeaderValue reports whether value can be sent as a header value: no control
+// characters other than tab, so it cannot end the header early
+func validHeaderValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// setResponseHeaders sets a bucket's stored response_headers on w. Headers the server
+// sets for the response itself, such as Content-Type or Cache-Control, are set later and
+// take precedence.
+func setResponseHeaders(w http.ResponseWriter, raw json.RawMessage) {
+	var headers map[string]string
+	if err := json.Unmarshal(raw, &headers); err != nil {
+		return
+	}
+	for name, value := range headers {
+		w.Header().Set(name, value)
+	}
+}
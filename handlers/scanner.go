@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"file-upload-service/config"
+)
+
+// Scanner checks file content for malware
+type Scanner interface {
+	// Scan reads r to the end. clean is false when malware was found, with the name of the
+	// matched signature; err is set when the content could not be scanned at all.
+	Scan(ctx context.Context, r io.Reader) (clean bool, signature string, err error)
+}
+
+// newScanner builds the scanner chosen by SCANNER; nil when uploads are not scanned
+func newScanner(cfg *config.Config) Scanner {
+	if cfg.Scanner != "clamd" {
+		return nil
+	}
+	network, address := "tcp", cfg.ClamdAddress
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	return &clamdScanner{network: network, address: address, timeout: cfg.ScanTimeout}
+}
+
+// clamdChunkSize is how many bytes are sent to clamd per INSTREAM chunk
+const clamdChunkSize = 32 << 10
+
+// clamdScanner streams content to a clamd daemon with its INSTREAM command
+type clamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// Scan sends r to clamd as length-prefixed chunks ended by an empty chunk, then reads the
+// verdict: "stream: OK", "stream: <signature> FOUND" or "<reason> ERROR"
+func (s *clamdScanner) Scan(ctx context.Context, r io.Reader) (bool, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return false, "", fmt.Errorf("connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	writeErr := s.stream(conn, r)
+	var netErr *net.OpError
+	if writeErr != nil && !errors.As(writeErr, &netErr) {
+		// The content itself could not be read; clamd is still waiting for the rest
+		return false, "", fmt.Errorf("read content: %w", writeErr)
+	}
+
+	// clamd answers and closes the connection early when the stream exceeds its
+	// StreamMaxLength, so the reply is read even when sending failed
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		if writeErr != nil {
+			return false, "", fmt.Errorf("send to clamd: %w", writeErr)
+		}
+		return false, "", fmt.Errorf("read clamd reply: %w", err)
+	}
+
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return true, "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return false, strings.TrimSuffix(reply, " FOUND"), nil
+	default:
+		return false, "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// stream writes the INSTREAM command and r's bytes to conn
+func (s *clamdScanner) stream(conn net.Conn, r io.Reader) error {
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	cachepackage "file-upload-service/cache"
+	"file-upload-service/models"
+
+	"github.com/gorilla/mux"
+	"github.com/umakantv/go-utils/errs"
+	"go.uber.org/zap"
+)
+
+// shortTokenBytes is the entropy of a short token: 128 bits, written as 22 URL-safe characters
+const shortTokenBytes = 16
+
+// maxShortTokenAttempts is how many short tokens are drawn before giving up when each one
+// drawn is already in use
+const maxShortTokenAttempts = 5
+
+// errShortTokenTaken is returned when every short token drawn was already in use
+var errShortTokenTaken = errors.New("no unused short token found")
+
+// generateShortToken generates a random URL-safe token for a short signed URL
+func generateShortToken() string {
+	bytes := make([]byte, shortTokenBytes)
+	rand.Read(bytes)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// signedURL builds the URL handed out for an upload or download token. Clients that opted
+// into short URLs get /<SHORT_URL_PATH>/<short token>, mapped to the token in the cache for
+// ttl; everyone else gets the /files/<kind>?token= form, which also works for them.
+func (h *FileHandler) signedURL(clientID, kind, token string, ttl time.Duration) (string, error) {
+	var shortURLs bool
+	if err := h.db.QueryRow("SELECT short_urls FROM clients WHERE client_id = ?", clientID).Scan(&shortURLs); err != nil {
+		return "", err
+	}
+	if !shortURLs {
+		return fmt.Sprintf("http://localhost:8080/files/%s?token=%s", kind, token), nil
+	}
+
+	shortToken, err := h.storeShortToken(models.ShortTokenData{Kind: kind, Token: token}, ttl)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("http://localhost:8080/%s/%s", h.config.ShortURLPath, shortToken), nil
+}
+
+// signedURLBatch builds the URLs of tokens of one kind issued together, as signedURL would
+// one at a time. The short tokens of clients with short URLs are written in one round trip;
+// those drawn already in use are drawn again, as storeShortToken does.
+func (h *FileHandler) signedURLBatch(clientID, kind string, tokens []string, ttl time.Duration) ([]string, error) {
+	var shortURLs bool
+	if err := h.db.QueryRow("SELECT short_urls FROM clients WHERE client_id = ?", clientID).Scan(&shortURLs); err != nil {
+		return nil, err
+	}
+	urls := make([]string, len(tokens))
+	if !shortURLs {
+		for i, token := range tokens {
+			urls[i] = fmt.Sprintf("http://localhost:8080/files/%s?token=%s", kind, token)
+		}
+		return urls, nil
+	}
+
+	pending := make([]int, len(tokens))
+	for i := range pending {
+		pending[i] = i
+	}
+	for attempt := 0; attempt < maxShortTokenAttempts && len(pending) > 0; attempt++ {
+		entries := make([]cachepackage.TokenEntry, len(pending))
+		indexByKey := make(map[string]int, len(pending))
+		for j, i := range pending {
+			shortToken := h.shortToken()
+			urls[i] = fmt.Sprintf("http://localhost:8080/%s/%s", h.config.ShortURLPath, shortToken)
+			entries[j] = cachepackage.TokenEntry{
+				Key:   "short:" + shortToken,
+				Value: models.ShortTokenData{Kind: kind, Token: tokens[i]},
+				TTL:   ttl,
+			}
+			indexByKey[entries[j].Key] = i
+		}
+		taken, err := h.tokens.SetMany(entries, true)
+		if err != nil {
+			return nil, err
+		}
+		var retry []int
+		for _, key := range taken {
+			retry = append(retry, indexByKey[key])
+		}
+		pending = retry
+	}
+	if len(pending) > 0 {
+		return nil, errShortTokenTaken
+	}
+	return urls, nil
+}
+
+// storeShortToken maps a fresh short token to data for ttl. A drawn token that is already
+// mapped is discarded and another drawn, so a collision never hands out someone else's URL.
+// The mapping is only written when the key is new (SET NX), so two instances drawing the
+// same token at once cannot both claim it.
+func (h *FileHandler) storeShortToken(data models.ShortTokenData, ttl time.Duration) (string, error) {
+	for attempt := 0; attempt < maxShortTokenAttempts; attempt++ {
+		shortToken := h.shortToken()
+		taken, err := h.tokens.SetMany([]cachepackage.TokenEntry{{Key: "short:" + shortToken, Value: data, TTL: ttl}}, true)
+		if err != nil {
+			return "", err
+		}
+		if len(taken) == 0 {
+			return shortToken, nil
+		}
+	}
+	return "", errShortTokenTaken
+}
+
+// resolveShortToken looks up the short token in the request path and, when it stands for a
+// token of one of the wanted kinds, puts that token in the query string where the upload and
+// download handlers read it and returns its kind. Unknown tokens and tokens of other kinds
+// are answered 404.
+func (h *FileHandler) resolveShortToken(ctx context.Context, w http.ResponseWriter, r *http.Request, kinds ...string) (string, bool) {
+	shortToken := mux.Vars(r)["token"]
+
+	var data models.ShortTokenData
+	cachedData, err := h.cache.Get("short:" + shortToken)
+	if err == nil {
+		// Same re-marshal as loadUploadToken: the cache hands back a generic map
+		var intermediate []byte
+		if intermediate, err = json.Marshal(cachedData); err == nil {
+			err = json.Unmarshal(intermediate, &data)
+		}
+	}
+	wanted := false
+	for _, kind := range kinds {
+		wanted = wanted || data.Kind == kind
+	}
+	if err != nil || !wanted {
+		h.logRequest(ctx, "info", "Short signed URL not found", zap.Strings("kinds", kinds), zap.Error(err))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Signed URL not found"))
+		return "", false
+	}
+
+	query := r.URL.Query()
+	query.Set("token", data.Token)
+	r.URL.RawQuery = query.Encode()
+	return data.Kind, true
+}
+
+// ShortUpload handles POST /<SHORT_URL_PATH>/{token} - upload through a short signed URL,
+// exactly as POST /files/upload?token= would
+func (h *FileHandler) ShortUpload(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.resolveShortToken(ctx, w, r, models.ShortTokenKindUpload); ok {
+		h.UploadFile(ctx, w, r)
+	}
+}
+
+// ShortUploadPreflight handles OPTIONS /<SHORT_URL_PATH>/{token} - answer a browser's CORS
+// preflight for a short upload URL, exactly as OPTIONS /files/upload?token= would
+func (h *FileHandler) ShortUploadPreflight(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.resolveShortToken(ctx, w, r, models.ShortTokenKindUpload); ok {
+		h.UploadPreflight(ctx, w, r)
+	}
+}
+
+// ShortDownload handles GET and HEAD /<SHORT_URL_PATH>/{token} - download through a short
+// signed URL, exactly as /files/download?token= or /files/zip-download?token= would
+func (h *FileHandler) ShortDownload(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	kind, ok := h.resolveShortToken(ctx, w, r, models.ShortTokenKindDownload, models.ShortTokenKindZipDownload)
+	switch {
+	case !ok:
+	case kind == models.ShortTokenKindZipDownload:
+		h.ZipDownload(ctx, w, r)
+	default:
+		h.DownloadFile(ctx, w, r)
+	}
+}
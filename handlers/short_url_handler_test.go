@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// shortTokenOf is the short token at the end of a short signed URL
+func (e *testEnv) shortTokenOf(signedURL string) string {
+	e.t.Helper()
+	prefix := "http://localhost:8080/" + e.cfg.ShortURLPath + "/"
+	if !strings.HasPrefix(signedURL, prefix) {
+		e.t.Fatalf("%s is not a short URL", signedURL)
+	}
+	return strings.TrimPrefix(signedURL, prefix)
+}
+
+// useShortURLs opts the test client into short signed URLs
+func (e *testEnv) useShortURLs() {
+	e.db.MustExec("UPDATE clients SET short_urls = 1 WHERE client_id = ?", e.clientID)
+}
+
+func TestShortURLUploadAndDownloadRoundTrip(t *testing.T) {
+	env := newTestEnv(t)
+	env.useShortURLs()
+	bucketID := env.createBucket("photos")
+
+	signed := env.signedUpload(signedURLRequest(bucketID, "docs/a.txt", 64))
+	shortToken := env.shortTokenOf(signed.SignedURL)
+	if len(shortToken) != 22 {
+		t.Fatalf("short token %q has %d characters, want 22", shortToken, len(shortToken))
+	}
+	w := serveAnonymous(env.files.ShortUpload, uploadRequest(signed.SignedURL, []byte("short and sweet")), map[string]string{"token": shortToken})
+	expectStatus(t, w, http.StatusOK)
+
+	download := env.downloadTarget(signed.FileID)
+	shortToken = env.shortTokenOf("http://localhost:8080" + download)
+	w = serveAnonymous(env.files.ShortDownload, newRequest(http.MethodGet, download, nil), map[string]string{"token": shortToken})
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Body.String(); got != "short and sweet" {
+		t.Fatalf("downloaded %q through the short URL", got)
+	}
+}
+
+func TestUnknownShortTokenIs404(t *testing.T) {
+	env := newTestEnv(t)
+	env.useShortURLs()
+	bucketID := env.createBucket("photos")
+	target := "/" + env.cfg.ShortURLPath + "/unknown"
+
+	w := serveAnonymous(env.files.ShortDownload, newRequest(http.MethodGet, target, nil), map[string]string{"token": "unknown"})
+	expectStatus(t, w, http.StatusNotFound)
+	w = serveAnonymous(env.files.ShortUpload, uploadRequest("http://localhost:8080"+target, []byte("x")), map[string]string{"token": "unknown"})
+	expectStatus(t, w, http.StatusNotFound)
+
+	// A short upload token is not a download token
+	signed := env.signedUpload(signedURLRequest(bucketID, "docs/a.txt", 64))
+	shortToken := env.shortTokenOf(signed.SignedURL)
+	w = serveAnonymous(env.files.ShortDownload, newRequest(http.MethodGet, signedURLTarget(signed.SignedURL), nil), map[string]string{"token": shortToken})
+	expectStatus(t, w, http.StatusNotFound)
+}
+
+func TestShortTokenCollisionDrawsAgain(t *testing.T) {
+	env := newTestEnv(t)
+	env.useShortURLs()
+	bucketID := env.createBucket("photos")
+
+	draws := []string{"taken", "taken", "taken", "fresh"}
+	env.files.shortToken = func() string {
+		token := draws[0]
+		draws = draws[1:]
+		return token
+	}
+	first := env.signedUpload(signedURLRequest(bucketID, "docs/a.txt", 64))
+	second := env.signedUpload(signedURLRequest(bucketID, "docs/b.txt", 64))
+	if env.shortTokenOf(first.SignedURL) != "taken" || env.shortTokenOf(second.SignedURL) != "fresh" {
+		t.Fatalf("short URLs %s and %s, want the second to skip the token in use", first.SignedURL, second.SignedURL)
+	}
+
+	// The token drawn again still stands for the first upload
+	w := serveAnonymous(env.files.ShortUpload, uploadRequest(first.SignedURL, []byte("first")), map[string]string{"token": "taken"})
+	expectStatus(t, w, http.StatusOK)
+	var uploaded []string
+	if err := env.db.Select(&uploaded, "SELECT id FROM files WHERE status = 'uploaded'"); err != nil {
+		t.Fatal(err)
+	}
+	if len(uploaded) != 1 || uploaded[0] != first.FileID {
+		t.Fatalf("uploaded files %v, want only the first URL's %s", uploaded, first.FileID)
+	}
+
+	// Giving up after every draw collides rather than handing out a URL in use
+	env.files.shortToken = func() string { return "taken" }
+	w = env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, "docs/c.txt", 64)), nil)
+	expectStatus(t, w, http.StatusInternalServerError)
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// maxSignedURLBatchSize caps how many signed URLs a single batch request may ask for
+const maxSignedURLBatchSize = 100
+
+// batchUpload is a batch entry that passed validation, with the lifetime of its URL
+type batchUpload struct {
+	index         int
+	upload        *pendingUpload
+	ttl           time.Duration
+	allowParallel bool
+	onConflict    string
+}
+
+// insertPendingUploadBatch writes the file rows of a batch in one transaction, claiming each
+// key first like a single signed URL request. Entries whose key cannot be claimed (including
+// because of an earlier entry of the same batch) are left out and returned with their
+// outcome, and entries past their owner's quota or their bucket's limits (counting earlier
+// entries) are left out and returned with their refusal; any other failure rolls back the whole batch.
+func (h *FileHandler) insertPendingUploadBatch(uploads []batchUpload, now time.Time) (conflicts map[int]int, overQuota map[int]quotaError, err error) {
+	h.reserveMu.Lock()
+	defer h.reserveMu.Unlock()
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	conflicts = make(map[int]int)
+	overQuota = make(map[int]quotaError)
+	for _, entry := range uploads {
+		if err := checkUploadQuotas(tx, entry.upload, now); err != nil {
+			quotaErr, ok := asQuotaError(err)
+			if !ok {
+				return nil, nil, err
+			}
+			overQuota[entry.index] = quotaErr
+			continue
+		}
+		outcome, _, err := claimUploadKey(tx, entry.upload, entry.onConflict, !entry.allowParallel, now.Add(entry.ttl), now)
+		if err != nil {
+			return nil, nil, err
+		}
+		if outcome != keyClaimed {
+			conflicts[entry.index] = outcome
+			continue
+		}
+		if entry.upload.TokenData.NewVersion {
+			continue
+		}
+		if err := insertFileRecord(tx, entry.upload, models.FileStatusPending, now); err != nil {
+			return nil, nil, err
+		}
+	}
+	return conflicts, overQuota, tx.Commit()
+}
+
+// GenerateSignedURLs handles POST /files/signed-urls - generate signed upload URLs for many
+// files at once. Entries are validated like POST /files/signed-url and succeed or fail on
+// their own; the results report each entry in request order.
+func (h *FileHandler) GenerateSignedURLs(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req models.CreateSignedURLsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+
+	if len(req.Entries) == 0 {
+		h.logRequest(ctx, "error", "Missing required field: entries")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("entries is required"))
+		return
+	}
+	if len(req.Entries) > maxSignedURLBatchSize {
+		h.logRequest(ctx, "error", "Too many signed URL batch entries", zap.Int("count", len(req.Entries)))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(fmt.Sprintf("entries cannot contain more than %d items", maxSignedURLBatchSize)))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	results := make([]models.SignedURLBatchResult, len(req.Entries))
+	fail := func(i, code int, message string) {
+		results[i].Error = &models.BatchItemError{Code: code, Message: message}
+	}
+
+	// Validate every entry; invalid entries are reported without stopping the rest
+	uploads := make([]batchUpload, 0, len(req.Entries))
+	for i, entry := range req.Entries {
+		results[i].Index = i
+		ttl, err := h.signedURLTTL(entry.ExpiresInSeconds)
+		if err != nil {
+			h.logRequest(ctx, "error", "Invalid signed URL lifetime", zap.Int("entry", i), zap.Error(err))
+			fail(i, http.StatusBadRequest, err.Error())
+			continue
+		}
+		if entry.Extract {
+			h.logRequest(ctx, "error", "Extract requested in a signed URL batch", zap.Int("entry", i))
+			fail(i, http.StatusBadRequest, "extract is only supported on POST /files/signed-url")
+			continue
+		}
+		upload, status, appErr := h.prepareUpload(ctx, clientID, entry)
+		if appErr != nil {
+			fail(i, status, appErr.Message)
+			continue
+		}
+		h.restrictUploadIP(r, upload, entry)
+		uploads = append(uploads, batchUpload{index: i, upload: upload, ttl: ttl, allowParallel: entry.AllowParallel, onConflict: entry.OnConflict})
+	}
+
+	h.logRequest(ctx, "info", "Generating signed URL batch",
+		zap.String("client_id", clientID),
+		zap.Int("entries", len(req.Entries)),
+		zap.Int("valid", len(uploads)),
+	)
+
+	now := time.Now().UTC()
+	if len(uploads) > 0 {
+		conflicts, overQuota, err := h.insertPendingUploadBatch(uploads, now)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to create file records", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to create file records"))
+			return
+		}
+
+		for _, entry := range uploads {
+			if quotaErr, ok := overQuota[entry.index]; ok {
+				h.logRequest(ctx, "error", "Storage quota exceeded", append(quotaErr.logFields(), zap.Int("entry", entry.index))...)
+				_, message := quotaErr.refusal("")
+				fail(entry.index, http.StatusForbidden, message)
+				continue
+			}
+			if outcome, ok := conflicts[entry.index]; ok {
+				h.logRequest(ctx, "error", "Key is already taken",
+					zap.Int("entry", entry.index),
+					zap.String("key", entry.upload.Key),
+				)
+				if outcome == keyPending {
+					fail(entry.index, http.StatusConflict, "An upload for this key is already pending; wait for it to complete or expire, or pass allow_parallel=true")
+				} else {
+					fail(entry.index, http.StatusConflict, keyConflictMessage(outcome))
+				}
+				continue
+			}
+			response, err := h.issueUploadToken(entry.upload, entry.ttl, now)
+			if err != nil {
+				if err := h.releaseReservation(entry.upload.TokenData.FileID); err != nil {
+					h.logRequest(ctx, "error", "Failed to release upload reservation", zap.String("file_id", entry.upload.TokenData.FileID), zap.Error(err))
+				}
+				h.logRequest(ctx, "error", "Failed to store upload token in cache", zap.Int("entry", entry.index), zap.Error(err))
+				fail(entry.index, http.StatusInternalServerError, "Failed to generate signed URL")
+				continue
+			}
+			results[entry.index].FileID = response.FileID
+			results[entry.index].Key = response.Key
+			results[entry.index].SignedURL = response.SignedURL
+			results[entry.index].ExpiresAt = &response.ExpiresAt
+		}
+	}
+
+	batch := models.SignedURLBatchResponse{Results: results}
+	for _, result := range results {
+		if result.Error != nil {
+			batch.Failed++
+		} else {
+			batch.Succeeded++
+		}
+	}
+
+	h.logRequest(ctx, "info", "Signed URL batch generated",
+		zap.String("client_id", clientID),
+		zap.Int("succeeded", batch.Succeeded),
+		zap.Int("failed", batch.Failed),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(batch)
+}
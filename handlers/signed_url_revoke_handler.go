@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/gorilla/mux"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// cachedToken reads the data stored under key into v, reporting whether it was found.
+// Like loadUploadToken, it re-marshals the generic map the cache hands back.
+func (h *FileHandler) cachedToken(key string, v interface{}) bool {
+	cachedData, err := h.cache.Get(key)
+	if err != nil {
+		return false
+	}
+	intermediate, err := json.Marshal(cachedData)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(intermediate, v) == nil
+}
+
+// RevokeSignedURL handles DELETE /files/tokens/{token} - revoke an upload or download URL
+// before it expires. {token} is the token of a /files/upload, /files/download or
+// /files/zip-download URL, or the short token of a short URL. Only the client that issued the URL may revoke it. An
+// upload URL whose file has not been uploaded yet also has its pending file retired and
+// its key freed; files already uploaded through it stay. Uploads in flight when the URL
+// is revoked fail when they try to complete.
+func (h *FileHandler) RevokeSignedURL(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	token := mux.Vars(r)["token"]
+	var shortToken string
+	var short models.ShortTokenData
+	if h.cachedToken("short:"+token, &short) {
+		shortToken, token = token, short.Token
+	}
+
+	var kind, issuerClientID, fileID string
+	var upload models.UploadTokenData
+	var download models.DownloadTokenData
+	var zipDownload models.ZipDownloadTokenData
+	switch {
+	case h.cachedToken("upload:"+token, &upload):
+		kind, issuerClientID, fileID = models.ShortTokenKindUpload, upload.ClientID, upload.FileID
+	case h.cachedToken("download:"+token, &download):
+		kind, issuerClientID, fileID = models.ShortTokenKindDownload, download.ClientID, download.FileID
+		if download.GranteeClientID != "" {
+			issuerClientID = download.GranteeClientID
+		}
+	case h.cachedToken("zip-download:"+token, &zipDownload):
+		kind, issuerClientID = models.ShortTokenKindZipDownload, zipDownload.ClientID
+	default:
+		// A short token whose full token has lapsed leads nowhere; drop it as well
+		if shortToken != "" {
+			h.cache.Delete("short:" + shortToken)
+		}
+		h.logRequest(ctx, "info", "Signed URL to revoke not found", zap.String("client_id", clientID))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Signed URL not found or already expired"))
+		return
+	}
+
+	if issuerClientID != clientID {
+		h.logRequest(ctx, "error", "Signed URL was issued by another client",
+			zap.String("client_id", clientID),
+			zap.String("file_id", fileID),
+		)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(errs.NewAuthorizationError("Signed URL was issued by another client"))
+		return
+	}
+	if upload.GroupID != "" {
+		h.logRequest(ctx, "error", "Signed URL belongs to an upload group", zap.String("group_id", upload.GroupID))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Upload URLs of an upload group are revoked by aborting the group"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Revoking signed URL",
+		zap.String("client_id", clientID),
+		zap.String("kind", kind),
+		zap.String("file_id", fileID),
+	)
+
+	// The token goes first so no new request gets past it while the file is updated.
+	// Uploads that loaded the token but have not claimed a use yet are turned away too.
+	h.cache.Delete(kind + ":" + token)
+	if shortToken != "" {
+		h.cache.Delete("short:" + shortToken)
+	}
+	if kind == models.ShortTokenKindUpload && fileID != "" {
+		if err := h.uses.Revoke(fileID); err != nil {
+			h.logRequest(ctx, "error", "Failed to revoke upload uses", zap.String("file_id", fileID), zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to revoke signed URL"))
+			return
+		}
+	}
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to begin transaction", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to revoke signed URL"))
+		return
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	var cancelled bool
+	if kind == models.ShortTokenKindUpload && fileID != "" {
+		cancelled, err = retirePendingUpload(tx, fileID, now)
+	}
+	if err == nil {
+		err = recordAuditEvent(tx, models.AuditEvent{
+			Action:   models.AuditActionSignedURLRevoked,
+			Actor:    clientID,
+			ClientID: clientID,
+			FileID:   fileID,
+			Detail: map[string]interface{}{
+				"kind":             kind,
+				"short_url":        shortToken != "",
+				"upload_cancelled": cancelled,
+			},
+		}, now)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to record signed URL revocation", zap.String("file_id", fileID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to revoke signed URL"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Signed URL revoked",
+		zap.String("kind", kind),
+		zap.String("file_id", fileID),
+		zap.Bool("upload_cancelled", cancelled),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.RevokeSignedURLResponse{
+		Message:         "Signed URL revoked",
+		Kind:            kind,
+		FileID:          fileID,
+		UploadCancelled: cancelled,
+	})
+}
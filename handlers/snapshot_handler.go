@@ -0,0 +1,615 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// snapshotsRoot holds the bytes preserved by bucket snapshots
+const snapshotsRoot = "./snapshots"
+
+// snapshotBlobPath returns where a snapshot keeps the bytes of one file
+func snapshotBlobPath(snapshotID, fileID string) string {
+	return filepath.Join(snapshotsRoot, snapshotID, fileID)
+}
+
+// snapshotBucket is the bucket a snapshot request operates on
+type snapshotBucket struct {
+	ID         int
+	Name       string
+	ClientName string
+	Archived   bool
+}
+
+// uploadPath returns where a key of the bucket is stored
+func (b *snapshotBucket) uploadPath(key string) string {
+	return filepath.Join(uploadsRoot, b.ClientName, b.Name, key)
+}
+
+// heldSnapshotBytes sums the bytes that unexpired snapshots matching filter hold on
+// their own, that is of files no longer stored at the size they were snapshotted with.
+// A snapshot file still stored at that size shares its bytes with the stored file and
+// adds nothing. filter is a condition on s (bucket_snapshots) and sf (bucket_snapshot_files).
+func heldSnapshotBytes(q sqlx.Queryer, now time.Time, filter string, args ...interface{}) (int64, error) {
+	var held int64
+	err := q.QueryRowx(
+		`SELECT COALESCE(SUM(file_size), 0) FROM (
+			SELECT DISTINCT sf.file_id, sf.file_size
+			FROM bucket_snapshot_files sf JOIN bucket_snapshots s ON s.id = sf.snapshot_id
+			WHERE s.expires_at > ? AND `+filter+`
+			AND NOT EXISTS (SELECT 1 FROM files f WHERE f.id = sf.file_id AND f.status IN (?, ?) AND f.file_size = sf.file_size)
+		)`,
+		append(append([]interface{}{now}, args...), models.FileStatusUploaded, models.FileStatusQuarantined)...,
+	).Scan(&held)
+	return held, err
+}
+
+// loadSnapshotBucket fetches a bucket owned by the client.
+// On failure it returns the HTTP status to respond with and the error body.
+func (h *FileHandler) loadSnapshotBucket(ctx context.Context, clientID string, bucketID int) (*snapshotBucket, int, *errs.AppError) {
+	bucket := snapshotBucket{ID: bucketID}
+	var bucketClientID string
+	var archivedInt int
+	err := h.db.QueryRow(
+		"SELECT b.client_id, b.name, b.archived, c.name FROM buckets b JOIN clients c ON b.client_id = c.client_id WHERE b.id = ?",
+		bucketID,
+	).Scan(&bucketClientID, &bucket.Name, &archivedInt, &bucket.ClientName)
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "error", "Bucket not found", zap.Int("bucket_id", bucketID))
+		return nil, http.StatusNotFound, errs.NewNotFoundError("Bucket not found")
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query bucket", zap.Error(err))
+		return nil, http.StatusInternalServerError, errs.NewInternalServerError("Database error")
+	}
+	if bucketClientID != clientID {
+		h.logRequest(ctx, "error", "Bucket does not belong to client",
+			zap.Int("bucket_id", bucketID),
+			zap.String("client_id", clientID),
+		)
+		return nil, http.StatusForbidden, errs.NewAuthorizationError("Access denied: bucket does not belong to your account")
+	}
+	bucket.Archived = archivedInt != 0
+	return &bucket, 0, nil
+}
+
+// preserveFile keeps the bytes of src at dst. In hardlink mode dst is a hard link to src,
+// which is safe because stored files are never modified in place: overwrites rename a
+// new file over the path and deletes only unlink it. Hard links that cannot be created
+// (e.g. the snapshots root is on another filesystem) fall back to a copy.
+func preserveFile(src, dst, storage string) error {
+	if storage == "hardlink" {
+		err := os.Link(src, dst)
+		if err == nil || os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+	// No buffer: io.Copy lets the kernel copy file to file directly
+	_, err = storeFile(dst, srcFile, info.Size(), nil)
+	return err
+}
+
+// CreateSnapshot handles POST /buckets/{id}/snapshots - record every live file of a bucket
+func (h *FileHandler) CreateSnapshot(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	idStr := mux.Vars(r)["id"]
+	bucketID, err := strconv.Atoi(idStr)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid bucket ID", zap.String("id", idStr))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid bucket ID"))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Creating bucket snapshot", zap.Int("bucket_id", bucketID), zap.String("client_id", clientID))
+
+	bucket, status, appErr := h.loadSnapshotBucket(ctx, clientID, bucketID)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	// Refuse to process more rows than a synchronous request is allowed to handle
+	var liveFiles int
+	if err := h.db.QueryRow(
+		"SELECT COUNT(*) FROM files WHERE bucket_id = ? AND status = ? AND staged = 0",
+		bucketID, models.FileStatusUploaded,
+	).Scan(&liveFiles); err != nil {
+		h.logRequest(ctx, "error", "Failed to count files", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to create snapshot"))
+		return
+	}
+	if liveFiles > h.config.MaxSyncRows {
+		h.logRequest(ctx, "error", "Too many files for synchronous snapshot",
+			zap.Int("bucket_id", bucketID),
+			zap.Int("matched", liveFiles),
+			zap.Int("max_rows", h.config.MaxSyncRows),
+		)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(errs.AppError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("Bucket holds %d files which exceeds the synchronous limit of %d", liveFiles, h.config.MaxSyncRows),
+		})
+		return
+	}
+
+	var files []models.SnapshotFile
+	if err := h.db.Select(&files,
+		`SELECT id AS file_id, key, file_name, file_size, mimetype, detected_mimetype, owner_entity_type, owner_entity_id, created_at, metadata,
+			encryption_key_hash, encryption_iv, image_width, image_height, image_format
+		FROM files WHERE bucket_id = ? AND status = ? AND staged = 0 ORDER BY key`,
+		bucketID, models.FileStatusUploaded,
+	); err != nil {
+		h.logRequest(ctx, "error", "Failed to query files", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to create snapshot"))
+		return
+	}
+
+	now := time.Now().UTC()
+	snapshot := models.BucketSnapshot{
+		ID:        uuid.New().String(),
+		BucketID:  bucketID,
+		ClientID:  clientID,
+		Storage:   h.config.SnapshotStorage,
+		ExpiresAt: now.Add(h.config.SnapshotRetention),
+		CreatedAt: now,
+	}
+	snapshotDir := filepath.Join(snapshotsRoot, snapshot.ID)
+
+	// failSnapshot discards whatever was preserved so far
+	failSnapshot := func(message string, err error) {
+		os.RemoveAll(snapshotDir)
+		h.logRequest(ctx, "error", message, zap.String("snapshot_id", snapshot.ID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to create snapshot"))
+	}
+
+	if err := os.MkdirAll(snapshotDir, 0755); err != nil {
+		failSnapshot("Failed to create snapshot directory", err)
+		return
+	}
+
+	preserved := make([]models.SnapshotFile, 0, len(files))
+	skipped := make([]string, 0)
+	for _, file := range files {
+		err := preserveFile(bucket.uploadPath(file.Key), snapshotBlobPath(snapshot.ID, file.FileID), snapshot.Storage)
+		if os.IsNotExist(err) {
+			skipped = append(skipped, file.FileID)
+			continue
+		}
+		if err != nil {
+			failSnapshot("Failed to preserve file bytes", err)
+			return
+		}
+		file.SnapshotID = snapshot.ID
+		preserved = append(preserved, file)
+		snapshot.TotalBytes += file.FileSize
+	}
+	snapshot.FileCount = len(preserved)
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		failSnapshot("Failed to begin transaction", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"INSERT INTO bucket_snapshots (id, bucket_id, client_id, storage, file_count, total_bytes, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		snapshot.ID, snapshot.BucketID, snapshot.ClientID, snapshot.Storage, snapshot.FileCount, snapshot.TotalBytes, snapshot.ExpiresAt, snapshot.CreatedAt,
+	); err != nil {
+		failSnapshot("Failed to insert snapshot", err)
+		return
+	}
+	for _, file := range preserved {
+		if _, err := tx.NamedExec(
+			`INSERT INTO bucket_snapshot_files (snapshot_id, file_id, key, file_name, file_size, mimetype, detected_mimetype, owner_entity_type, owner_entity_id, created_at, metadata,
+				encryption_key_hash, encryption_iv, image_width, image_height, image_format)
+			VALUES (:snapshot_id, :file_id, :key, :file_name, :file_size, :mimetype, :detected_mimetype, :owner_entity_type, :owner_entity_id, :created_at, :metadata,
+				:encryption_key_hash, :encryption_iv, :image_width, :image_height, :image_format)`,
+			file,
+		); err != nil {
+			failSnapshot("Failed to insert snapshot file", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		failSnapshot("Failed to commit snapshot", err)
+		return
+	}
+
+	h.logRequest(ctx, "info", "Bucket snapshot created",
+		zap.String("snapshot_id", snapshot.ID),
+		zap.Int("bucket_id", bucketID),
+		zap.Int("file_count", snapshot.FileCount),
+		zap.Int("skipped", len(skipped)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.CreateSnapshotResponse{
+		BucketSnapshot: snapshot,
+		Skipped:        skipped,
+	})
+}
+
+// ListSnapshots handles GET /buckets/{id}/snapshots - list a bucket's unexpired snapshots
+func (h *FileHandler) ListSnapshots(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	idStr := mux.Vars(r)["id"]
+	bucketID, err := strconv.Atoi(idStr)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid bucket ID", zap.String("id", idStr))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid bucket ID"))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Listing bucket snapshots", zap.Int("bucket_id", bucketID), zap.String("client_id", clientID))
+
+	if _, status, appErr := h.loadSnapshotBucket(ctx, clientID, bucketID); appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	snapshots := make([]models.BucketSnapshot, 0)
+	if err := h.db.Select(&snapshots,
+		`SELECT id, bucket_id, client_id, storage, file_count, total_bytes, expires_at, created_at
+		FROM bucket_snapshots WHERE bucket_id = ? AND expires_at > ? ORDER BY created_at DESC`,
+		bucketID, time.Now().UTC(),
+	); err != nil {
+		h.logRequest(ctx, "error", "Failed to query snapshots", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to list snapshots"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.SnapshotListResponse{
+		BucketID:  bucketID,
+		Snapshots: snapshots,
+	})
+}
+
+// RestoreSnapshot handles POST /buckets/{id}/snapshots/{sid}/restore - put every file
+// recorded in a snapshot back to its snapshot state. Files uploaded since the snapshot
+// are left alone unless prune=true is passed.
+func (h *FileHandler) RestoreSnapshot(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+	snapshotID := vars["sid"]
+	bucketID, err := strconv.Atoi(idStr)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid bucket ID", zap.String("id", idStr))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid bucket ID"))
+		return
+	}
+	prune := r.URL.Query().Get("prune") == "true"
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Restoring bucket snapshot",
+		zap.Int("bucket_id", bucketID),
+		zap.String("snapshot_id", snapshotID),
+		zap.Bool("prune", prune),
+	)
+
+	bucket, status, appErr := h.loadSnapshotBucket(ctx, clientID, bucketID)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+	if bucket.Archived {
+		h.logRequest(ctx, "error", "Bucket is archived", zap.Int("bucket_id", bucketID))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Cannot restore a snapshot into an archived bucket"))
+		return
+	}
+
+	var expiresAt time.Time
+	err = h.db.QueryRow(
+		"SELECT expires_at FROM bucket_snapshots WHERE id = ? AND bucket_id = ?",
+		snapshotID, bucketID,
+	).Scan(&expiresAt)
+	if err == sql.ErrNoRows || (err == nil && !time.Now().Before(expiresAt)) {
+		h.logRequest(ctx, "error", "Snapshot not found", zap.String("snapshot_id", snapshotID))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Snapshot not found"))
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query snapshot", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to restore snapshot"))
+		return
+	}
+
+	var files []models.SnapshotFile
+	if err := h.db.Select(&files,
+		`SELECT snapshot_id, file_id, key, file_name, file_size, mimetype, detected_mimetype, owner_entity_type, owner_entity_id, created_at, metadata,
+			encryption_key_hash, encryption_iv, image_width, image_height, image_format
+		FROM bucket_snapshot_files WHERE snapshot_id = ? ORDER BY key`,
+		snapshotID,
+	); err != nil {
+		h.logRequest(ctx, "error", "Failed to query snapshot files", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to restore snapshot"))
+		return
+	}
+
+	response := models.RestoreSnapshotResponse{
+		SnapshotID: snapshotID,
+		Restored:   make([]string, 0),
+		Unchanged:  make([]string, 0),
+		Superseded: make([]string, 0),
+		Pruned:     make([]string, 0),
+		Failed:     make([]string, 0),
+	}
+
+	inSnapshot := make(map[string]bool, len(files))
+	for _, file := range files {
+		inSnapshot[file.FileID] = true
+
+		restored, superseded, err := h.restoreSnapshotFile(bucket, clientID, file)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to restore file", zap.String("file_id", file.FileID), zap.Error(err))
+			response.Failed = append(response.Failed, file.FileID)
+			continue
+		}
+		if restored {
+			response.Restored = append(response.Restored, file.FileID)
+		} else {
+			response.Unchanged = append(response.Unchanged, file.FileID)
+		}
+		response.Superseded = append(response.Superseded, superseded...)
+	}
+
+	if prune {
+		pruned, failed, err := h.pruneSinceSnapshot(ctx, bucket, clientID, inSnapshot)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to query files to prune", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to prune files"))
+			return
+		}
+		response.Pruned = pruned
+		response.Failed = append(response.Failed, failed...)
+	}
+
+	h.logRequest(ctx, "info", "Bucket snapshot restored",
+		zap.String("snapshot_id", snapshotID),
+		zap.Int("restored", len(response.Restored)),
+		zap.Int("unchanged", len(response.Unchanged)),
+		zap.Int("superseded", len(response.Superseded)),
+		zap.Int("pruned", len(response.Pruned)),
+		zap.Int("failed", len(response.Failed)),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// restoreSnapshotFile puts one snapshot file back. A file whose row is live at the same
+// key with the same size, whose bytes on disk are the size of the preserved copy, and which no newer
+// upload has replaced is left alone. Otherwise the preserved bytes are written back and
+// the row is revived; newer rows at the same key are returned as superseded and deleted.
+// Written-back bytes are a copy of their own, so the row lets go of any storage object.
+func (h *FileHandler) restoreSnapshotFile(bucket *snapshotBucket, clientID string, file models.SnapshotFile) (restored bool, superseded []string, err error) {
+	diskPath := bucket.uploadPath(file.Key)
+
+	var liveKey string
+	var liveSize int64
+	var deleted bool
+	err = h.db.QueryRow(
+		"SELECT key, file_size, status <> ? FROM files WHERE id = ?",
+		models.FileStatusUploaded, file.FileID,
+	).Scan(&liveKey, &liveSize, &deleted)
+	rowExists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return false, nil, err
+	}
+
+	if err := h.db.Select(&superseded,
+		"SELECT id FROM files WHERE bucket_id = ? AND key = ? AND id <> ? AND status = ? AND staged = 0",
+		bucket.ID, file.Key, file.FileID, models.FileStatusUploaded,
+	); err != nil {
+		return false, nil, err
+	}
+
+	blob, err := os.Open(snapshotBlobPath(file.SnapshotID, file.FileID))
+	if err != nil {
+		return false, nil, err
+	}
+	defer blob.Close()
+	blobInfo, err := blob.Stat()
+	if err != nil {
+		return false, nil, err
+	}
+
+	info, statErr := os.Stat(diskPath)
+	if rowExists && !deleted && liveKey == file.Key && liveSize == file.FileSize &&
+		statErr == nil && info.Size() == blobInfo.Size() && len(superseded) == 0 {
+		return false, nil, nil
+	}
+
+	if _, err := storeFile(diskPath, blob, blobInfo.Size(), nil); err != nil {
+		return false, nil, err
+	}
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return false, nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	if rowExists {
+		_, err = tx.Exec(
+			`UPDATE files SET key = ?, file_name = ?, file_size = ?, mimetype = ?, detected_mimetype = ?,
+			owner_entity_type = ?, owner_entity_id = ?, metadata = ?, encryption_key_hash = ?, encryption_iv = ?,
+			image_width = ?, image_height = ?, image_format = ?,
+			storage_object_id = NULL, status = ?, deleted_at = NULL, updated_at = ? WHERE id = ?`,
+			file.Key, file.FileName, file.FileSize, file.Mimetype, file.DetectedMimetype,
+			file.OwnerEntityType, file.OwnerEntityID, file.Metadata, file.EncryptionKeyHash, file.EncryptionIV,
+			file.ImageWidth, file.ImageHeight, file.ImageFormat,
+			models.FileStatusUploaded, now, file.FileID,
+		)
+	} else {
+		_, err = tx.Exec(
+			`INSERT INTO files (id, file_name, file_size, mimetype, detected_mimetype, client_id, bucket_id, key, owner_entity_type, owner_entity_id, metadata,
+			encryption_key_hash, encryption_iv, image_width, image_height, image_format, status, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			file.FileID, file.FileName, file.FileSize, file.Mimetype, file.DetectedMimetype,
+			clientID, bucket.ID, file.Key, file.OwnerEntityType, file.OwnerEntityID, file.Metadata,
+			file.EncryptionKeyHash, file.EncryptionIV, file.ImageWidth, file.ImageHeight, file.ImageFormat,
+			models.FileStatusUploaded, file.CreatedAt, now,
+		)
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	for _, id := range superseded {
+		if _, err := tx.Exec("UPDATE files SET status = ?, deleted_at = ?, updated_at = ? WHERE id = ?", models.FileStatusDeleted, now, now, id); err != nil {
+			return false, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, nil, err
+	}
+	return true, superseded, nil
+}
+
+// pruneSinceSnapshot deletes uploaded files of the bucket that are not part of the snapshot.
+// Pending rows (uploads not completed yet) are left as they are.
+func (h *FileHandler) pruneSinceSnapshot(ctx context.Context, bucket *snapshotBucket, clientID string, inSnapshot map[string]bool) (pruned, failed []string, err error) {
+	rows, err := h.db.Query(
+		"SELECT id, key FROM files WHERE bucket_id = ? AND client_id = ? AND status = ? AND staged = 0",
+		bucket.ID, clientID, models.FileStatusUploaded,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	fileIDs := make([]string, 0)
+	records := make(map[string]string)
+	for rows.Next() {
+		var fileID, key string
+		if err := rows.Scan(&fileID, &key); err != nil {
+			return nil, nil, err
+		}
+		if inSnapshot[fileID] {
+			continue
+		}
+		fileIDs = append(fileIDs, fileID)
+		records[fileID] = bucket.uploadPath(key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	rows.Close()
+
+	pruned, _, failed = h.removeFiles(ctx, fileIDs, records)
+	return pruned, failed, nil
+}
+
+// StartSnapshotSweeper periodically removes bucket snapshots past their retention. Only
+// the instance holding the sweeper's lease runs it.
+func (h *FileHandler) StartSnapshotSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			h.jobs.runPeriodic(snapshotSweeperLease, h.sweepExpiredSnapshots)
+		}
+	}()
+}
+
+// sweepExpiredSnapshots deletes every expired snapshot with its preserved bytes, stopping
+// between snapshots once ctx is cancelled
+func (h *FileHandler) sweepExpiredSnapshots(ctx context.Context) {
+	var snapshotIDs []string
+	if err := h.db.Select(&snapshotIDs, "SELECT id FROM bucket_snapshots WHERE expires_at < ?", time.Now().UTC()); err != nil {
+		logger.Error("Failed to query expired snapshots", zap.Error(err))
+		return
+	}
+
+	for _, snapshotID := range snapshotIDs {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := os.RemoveAll(filepath.Join(snapshotsRoot, snapshotID)); err != nil {
+			logger.Error("Failed to remove expired snapshot bytes", zap.String("snapshot_id", snapshotID), zap.Error(err))
+			continue
+		}
+		if _, err := h.db.Exec("DELETE FROM bucket_snapshot_files WHERE snapshot_id = ?", snapshotID); err != nil {
+			logger.Error("Failed to delete expired snapshot files", zap.String("snapshot_id", snapshotID), zap.Error(err))
+			continue
+		}
+		if _, err := h.db.Exec("DELETE FROM bucket_snapshots WHERE id = ?", snapshotID); err != nil {
+			logger.Error("Failed to delete expired snapshot", zap.String("snapshot_id", snapshotID), zap.Error(err))
+			continue
+		}
+		logger.Info("Expired snapshot removed", zap.String("snapshot_id", snapshotID))
+	}
+}
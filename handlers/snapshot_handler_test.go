@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"file-upload-service/models"
+)
+
+// createSnapshot snapshots a bucket
+func (e *testEnv) createSnapshot(bucketID int) models.CreateSnapshotResponse {
+	e.t.Helper()
+	w := e.serve(e.files.CreateSnapshot, newRequest(http.MethodPost, "/buckets/"+strconv.Itoa(bucketID)+"/snapshots", nil),
+		map[string]string{"id": strconv.Itoa(bucketID)})
+	expectStatus(e.t, w, http.StatusCreated)
+	var snapshot models.CreateSnapshotResponse
+	decode(e.t, w, &snapshot)
+	return snapshot
+}
+
+// restoreSnapshot restores a snapshot into its bucket
+func (e *testEnv) restoreSnapshot(bucketID int, snapshotID, query string) *httptest.ResponseRecorder {
+	target := "/buckets/" + strconv.Itoa(bucketID) + "/snapshots/" + snapshotID + "/restore" + query
+	return e.serve(e.files.RestoreSnapshot, newRequest(http.MethodPost, target, nil),
+		map[string]string{"id": strconv.Itoa(bucketID), "sid": snapshotID})
+}
+
+// deletePath deletes every file under a path of a bucket
+func (e *testEnv) deletePath(bucketID int, path string) {
+	e.t.Helper()
+	w := e.serve(e.files.DeleteFiles, newRequest(http.MethodDelete, "/files",
+		models.DeleteFilesRequest{BucketID: &bucketID, Path: &path}), nil)
+	expectStatus(e.t, w, http.StatusOK)
+}
+
+func TestSnapshotRestoresDeletedFiles(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	a := env.putFile(bucketID, "docs/a.txt", []byte("aaaa"))
+	b := env.putFile(bucketID, "docs/b.txt", []byte("bbbb"))
+
+	snapshot := env.createSnapshot(bucketID)
+	if snapshot.FileCount != 2 || snapshot.TotalBytes != 8 {
+		t.Fatalf("snapshot = %+v, want 2 files of 8 bytes", snapshot)
+	}
+
+	env.deletePath(bucketID, "docs")
+	env.putFile(bucketID, "docs/a.txt", []byte("newer a"))
+	c := env.putFile(bucketID, "new/c.txt", []byte("cccc"))
+
+	w := env.restoreSnapshot(bucketID, snapshot.ID, "")
+	expectStatus(t, w, http.StatusOK)
+	var resp models.RestoreSnapshotResponse
+	decode(t, w, &resp)
+	if len(resp.Restored) != 2 || len(resp.Superseded) != 1 || len(resp.Failed) != 0 {
+		t.Fatalf("restore = %+v, want 2 restored and 1 superseded", resp)
+	}
+
+	for key, want := range map[string]string{"docs/a.txt": "aaaa", "docs/b.txt": "bbbb", "new/c.txt": "cccc"} {
+		content, err := os.ReadFile(env.diskPath(bucketID, key))
+		if err != nil || string(content) != want {
+			t.Fatalf("%s holds %q (%v), want %q", key, content, err, want)
+		}
+	}
+	for _, key := range []string{"docs/a.txt", "docs/b.txt", "new/c.txt"} {
+		if live := env.liveFiles(bucketID, key); len(live) != 1 {
+			t.Fatalf("%s has live rows %v, want one", key, live)
+		}
+	}
+	if live := env.liveFiles(bucketID, "docs/a.txt"); live[0] != a {
+		t.Fatalf("docs/a.txt is %s, want the snapshot's %s", live[0], a)
+	}
+	if live := env.liveFiles(bucketID, "docs/b.txt"); live[0] != b {
+		t.Fatalf("docs/b.txt is %s, want the snapshot's %s", live[0], b)
+	}
+	if live := env.liveFiles(bucketID, "new/c.txt"); live[0] != c {
+		t.Fatalf("new/c.txt is %s, want %s left alone", live[0], c)
+	}
+}
+
+func TestSnapshotRestoreWithPrune(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	a := env.putFile(bucketID, "docs/a.txt", []byte("aaaa"))
+	snapshot := env.createSnapshot(bucketID)
+	c := env.putFile(bucketID, "new/c.txt", []byte("cccc"))
+
+	w := env.restoreSnapshot(bucketID, snapshot.ID, "?prune=true")
+	expectStatus(t, w, http.StatusOK)
+	var resp models.RestoreSnapshotResponse
+	decode(t, w, &resp)
+	if len(resp.Unchanged) != 1 || resp.Unchanged[0] != a {
+		t.Fatalf("unchanged = %v, want [%s]", resp.Unchanged, a)
+	}
+	if len(resp.Pruned) != 1 || resp.Pruned[0] != c {
+		t.Fatalf("pruned = %v, want [%s]", resp.Pruned, c)
+	}
+	if live := env.liveFiles(bucketID, "new/c.txt"); len(live) != 0 {
+		t.Fatalf("pruned file still live: %v", live)
+	}
+	if _, err := os.Stat(env.diskPath(bucketID, "new/c.txt")); !os.IsNotExist(err) {
+		t.Fatalf("pruned file still on disk: %v", err)
+	}
+}
+
+func TestExpiredSnapshotIsSweptAway(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.putFile(bucketID, "docs/a.txt", []byte("aaaa"))
+	snapshot := env.createSnapshot(bucketID)
+	env.db.MustExec("UPDATE bucket_snapshots SET expires_at = ? WHERE id = ?", time.Now().Add(-time.Minute), snapshot.ID)
+
+	w := env.serve(env.files.ListSnapshots, newRequest(http.MethodGet, "/buckets/"+strconv.Itoa(bucketID)+"/snapshots", nil),
+		map[string]string{"id": strconv.Itoa(bucketID)})
+	expectStatus(t, w, http.StatusOK)
+	var list models.SnapshotListResponse
+	decode(t, w, &list)
+	if len(list.Snapshots) != 0 {
+		t.Fatalf("expired snapshot listed: %+v", list.Snapshots)
+	}
+	expectStatus(t, env.restoreSnapshot(bucketID, snapshot.ID, ""), http.StatusNotFound)
+
+	env.files.sweepExpiredSnapshots(context.Background())
+
+	if _, err := os.Stat(filepath.Join(snapshotsRoot, snapshot.ID)); !os.IsNotExist(err) {
+		t.Fatalf("expired snapshot bytes still on disk: %v", err)
+	}
+	var rows int
+	if err := env.db.Get(&rows, "SELECT COUNT(*) FROM bucket_snapshot_files WHERE snapshot_id = ?", snapshot.ID); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Fatalf("%d snapshot file rows left", rows)
+	}
+}
+
+func TestSnapshotBytesCountAgainstQuotas(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.putFile(bucketID, "docs/a.txt", []byte("0123456789"))
+	env.db.MustExec("UPDATE buckets SET max_total_bytes = 20 WHERE id = ?", bucketID)
+	env.db.MustExec(
+		"INSERT INTO owner_quotas (client_id, owner_entity_type, owner_entity_id, max_bytes, created_at, updated_at) VALUES (?, 'user', 'user-1', 25, ?, ?)",
+		env.clientID, time.Now(), time.Now(),
+	)
+
+	// While the file is live the snapshot shares its bytes and adds nothing
+	snapshot := env.createSnapshot(bucketID)
+	usage := env.ownerUsage()
+	if usage.UsedBytes != 10 || usage.SnapshotBytes != 0 {
+		t.Fatalf("usage = %+v, want 10 used and no snapshot bytes", usage)
+	}
+
+	// Deleting the file frees nothing while the snapshot holds it
+	env.deletePath(bucketID, "docs")
+	usage = env.ownerUsage()
+	if usage.UsedBytes != 0 || usage.SnapshotBytes != 10 {
+		t.Fatalf("usage = %+v, want 10 snapshot bytes", usage)
+	}
+	w := env.directUpload(bucketID, "docs/b.txt", bytes.Repeat([]byte("x"), 15))
+	expectStatus(t, w, http.StatusForbidden)
+	var bucketErr models.BucketQuotaExceededError
+	decode(t, w, &bucketErr)
+	if bucketErr.SnapshotBytes != 10 || bucketErr.UsedBytes != 0 || bucketErr.RequestedBytes != 15 {
+		t.Fatalf("bucket refusal = %+v, want 10 snapshot bytes", bucketErr)
+	}
+
+	env.db.MustExec("UPDATE buckets SET max_total_bytes = 0 WHERE id = ?", bucketID)
+	w = env.directUpload(bucketID, "docs/b.txt", bytes.Repeat([]byte("x"), 16))
+	expectStatus(t, w, http.StatusForbidden)
+	var ownerErr models.OwnerQuotaExceededError
+	decode(t, w, &ownerErr)
+	if ownerErr.SnapshotBytes != 10 || ownerErr.RequestedBytes != 16 || ownerErr.LimitBytes != 25 {
+		t.Fatalf("owner refusal = %+v, want 10 snapshot bytes", ownerErr)
+	}
+
+	// Once the snapshot expires its bytes are free again
+	env.db.MustExec("UPDATE bucket_snapshots SET expires_at = ? WHERE id = ?", time.Now().Add(-time.Minute), snapshot.ID)
+	env.db.MustExec("UPDATE buckets SET max_total_bytes = 20 WHERE id = ?", bucketID)
+	w = env.directUpload(bucketID, "docs/b.txt", bytes.Repeat([]byte("x"), 16))
+	expectStatus(t, w, http.StatusCreated)
+}
+
+// ownerUsage reads the usage of the owner putFile and directUpload store files for
+func (e *testEnv) ownerUsage() models.OwnerUsage {
+	e.t.Helper()
+	w := e.serve(e.files.OwnerUsage, newRequest(http.MethodGet, "/quotas/usage?owner_entity_type=user&owner_entity_id=user-1", nil), nil)
+	expectStatus(e.t, w, http.StatusOK)
+	var usage models.OwnerUsage
+	decode(e.t, w, &usage)
+	return usage
+}
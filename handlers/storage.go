@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// uploadsRoot is the directory all stored files live under
+const uploadsRoot = "./uploads"
+
+// errFileTooLarge is returned when an upload carries more bytes than allowed
+var errFileTooLarge = errors.New("file exceeds allowed size")
+
+// storeFile writes src to absPath, creating parent directories as needed (the key may
+// introduce extra nesting). At most maxSize bytes are accepted. buf, when not nil, is the
+// buffer the bytes are copied through (see bufferedCopy).
+// The bytes go to a temp file in the same directory, which is synced and renamed into
+// place only once the copy succeeds, so readers never see a partial or truncated file
+// at absPath. On any error the temp file is removed and absPath is left untouched.
+func storeFile(absPath string, src io.Reader, maxSize int64, buf *[]byte) (int64, error) {
+	tmpPath, written, err := stageFile(absPath, src, maxSize, buf)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, absPath); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return written, nil
+}
+
+// stageFile is the first half of storeFile: it writes src to a synced temp file next to
+// absPath and returns its path, leaving the caller to rename it into place (any path in
+// the same directory) or remove it. On error nothing is left behind.
+func stageFile(absPath string, src io.Reader, maxSize int64, buf *[]byte) (string, int64, error) {
+	dir := filepath.Dir(absPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", 0, err
+	}
+
+	tmpFile, err := os.CreateTemp(dir, filepath.Base(absPath)+".tmp-*")
+	if err != nil {
+		return "", 0, err
+	}
+	tmpPath := tmpFile.Name()
+
+	// Read one byte past the limit so an oversized source is detected
+	written, err := bufferedCopy(tmpFile, io.LimitReader(src, maxSize+1), buf)
+	if err == nil && written > maxSize {
+		err = errFileTooLarge
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// CreateTemp uses 0600; match the permissions of files created directly
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", 0, err
+	}
+	return tmpPath, written, nil
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"file-upload-service/logger"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// objectsRoot holds the blobs of storage objects, the content shared by files of dedupe
+// buckets. It must be on the same filesystem as the uploads root, since files are hard
+// links to the blobs.
+const objectsRoot = "./objects"
+
+// objectBlobPath returns where the bytes of a storage object are kept
+func objectBlobPath(objectID int64) string {
+	return filepath.Join(objectsRoot, strconv.FormatInt(objectID, 10))
+}
+
+// dedupeStaged makes staged upload bytes share the storage object of identical content
+// already in a dedupe bucket: the staged file is swapped for a hard link to the object's
+// blob, so the new bytes are discarded once the caller renames the link into place.
+// Content the bucket has not stored yet becomes a new object whose blob links the staged
+// bytes. It returns the object the caller must point the file row at in tx, which takes
+// the reference, and whether the bytes were shared with an existing object. The object
+// is NULL when the bucket does not dedupe or the link cannot be made, in which case the
+// upload keeps its own bytes. discard removes a new object's blob when tx is not
+// committed; it is never nil.
+func dedupeStaged(tx *sqlx.Tx, bucketID int, checksum string, size int64, stagedPath string, now time.Time) (objectID sql.NullInt64, shared bool, discard func(), err error) {
+	discard = func() {}
+	var dedupe bool
+	if err := tx.QueryRow("SELECT dedupe FROM buckets WHERE id = ?", bucketID).Scan(&dedupe); err != nil || !dedupe {
+		return sql.NullInt64{}, false, discard, err
+	}
+
+	// Touching the row takes the write lock, so the sweeper cannot remove the object
+	// between finding it and the caller taking its reference
+	var id int64
+	err = tx.QueryRow(
+		"UPDATE storage_objects SET linked_at = ? WHERE bucket_id = ? AND checksum = ? AND size = ? RETURNING id",
+		now, bucketID, checksum, size,
+	).Scan(&id)
+	if err == nil {
+		linkPath := stagedPath + ".dedupe"
+		if err := os.Link(objectBlobPath(id), linkPath); err != nil {
+			logger.Error("Failed to link storage object; keeping the upload's own bytes", zap.Int64("object_id", id), zap.Error(err))
+			return sql.NullInt64{}, false, discard, nil
+		}
+		if err := os.Rename(linkPath, stagedPath); err != nil {
+			os.Remove(linkPath)
+			return sql.NullInt64{}, false, discard, err
+		}
+		return sql.NullInt64{Int64: id, Valid: true}, true, discard, nil
+	}
+	if err != sql.ErrNoRows {
+		return sql.NullInt64{}, false, discard, err
+	}
+
+	if err := tx.QueryRow(
+		"INSERT INTO storage_objects (bucket_id, checksum, size, linked_at, created_at) VALUES (?, ?, ?, ?, ?) RETURNING id",
+		bucketID, checksum, size, now, now,
+	).Scan(&id); err != nil {
+		return sql.NullInt64{}, false, discard, err
+	}
+	if err := os.MkdirAll(objectsRoot, 0755); err != nil {
+		return sql.NullInt64{}, false, discard, err
+	}
+	blobPath := objectBlobPath(id)
+	if err := os.Link(stagedPath, blobPath); err != nil {
+		// The unreferenced row is left for the sweeper
+		logger.Error("Failed to create storage object; keeping the upload's own bytes", zap.Int64("object_id", id), zap.Error(err))
+		return sql.NullInt64{}, false, discard, nil
+	}
+	return sql.NullInt64{Int64: id, Valid: true}, false, func() { os.Remove(blobPath) }, nil
+}
+
+// sharedObjectBlobs returns the blobs of storage objects that hold a file's current or
+// earlier content and that other files still reference. Bytes linked to them are shared,
+// so erasing the file must unlink them without overwriting them.
+func sharedObjectBlobs(q sqlx.Queryer, fileID string) ([]string, error) {
+	rows, err := q.Queryx(
+		`SELECT so.id FROM storage_objects so JOIN files f ON f.id = ? AND so.bucket_id = f.bucket_id
+		WHERE (so.checksum = f.checksum OR so.checksum IN (SELECT checksum FROM file_versions WHERE file_id = f.id))
+			AND EXISTS (SELECT 1 FROM files o WHERE o.storage_object_id = so.id AND o.id <> f.id)`,
+		fileID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobs []string
+	for rows.Next() {
+		var objectID int64
+		if err := rows.Scan(&objectID); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, objectBlobPath(objectID))
+	}
+	return blobs, rows.Err()
+}
+
+// StartObjectSweeper periodically removes storage objects no file references any more.
+// Only the instance holding the sweeper's lease runs it.
+func (h *FileHandler) StartObjectSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			h.jobs.runPeriodic(objectSweeperLease, h.sweepUnreferencedObjects)
+		}
+	}()
+}
+
+// sweepUnreferencedObjects deletes up to MAX_SYNC_ROWS unreferenced objects with their
+// blobs, stopping between objects once ctx is cancelled. Files that held an object's
+// content are hard links of their own, so removing the blob never touches them.
+func (h *FileHandler) sweepUnreferencedObjects(ctx context.Context) {
+	var objectIDs []int64
+	if err := h.db.Select(&objectIDs, "SELECT id FROM storage_objects WHERE ref_count <= 0 LIMIT ?", h.config.MaxSyncRows); err != nil {
+		logger.Error("Failed to query unreferenced storage objects", zap.Error(err))
+		return
+	}
+
+	for _, objectID := range objectIDs {
+		if ctx.Err() != nil {
+			return
+		}
+		// An upload may have taken a reference since the query
+		result, err := h.db.Exec("DELETE FROM storage_objects WHERE id = ? AND ref_count <= 0", objectID)
+		if err != nil {
+			logger.Error("Failed to delete storage object", zap.Int64("object_id", objectID), zap.Error(err))
+			continue
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		if err := os.Remove(objectBlobPath(objectID)); err != nil && !os.IsNotExist(err) {
+			logger.Error("Failed to remove storage object blob", zap.Int64("object_id", objectID), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// zeroReader is an endless source of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// streamingUploadRequest builds the multipart POST to a signed upload URL with a body
+// generated while it is read, so the request itself holds none of the file in memory
+func streamingUploadRequest(signedURL string, size int64) *http.Request {
+	body, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		part, err := form.CreateFormFile("file", "upload.bin")
+		if err == nil {
+			_, err = io.CopyN(part, zeroReader{}, size)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	r := httptest.NewRequest(http.MethodPost, signedURL[strings.Index(signedURL, "/files/"):], body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+func TestLargeUploadIsStreamed(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+
+	const size = 64 << 20
+	req := signedURLRequest(bucketID, "docs/large.bin", size)
+	req.Mimetype = "application/octet-stream"
+	signed := env.signedUpload(req)
+	r := streamingUploadRequest(signed.SignedURL, size)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	w := serveAnonymous(env.files.UploadFile, r, nil)
+	runtime.ReadMemStats(&after)
+
+	expectStatus(t, w, http.StatusOK)
+	if info, err := os.Stat(env.diskPath(bucketID, "docs/large.bin")); err != nil || info.Size() != size {
+		t.Fatalf("stored file = %v, %v; want %d bytes", info, err, size)
+	}
+	// Buffering the upload would allocate at least its size
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/8 {
+		t.Fatalf("upload of %d bytes allocated %d bytes", size, allocated)
+	}
+}
@@ -0,0 +1,507 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// thumbnailDir is the top-level folder of a bucket holding the thumbnails of its images.
+// Keys under it are reserved, so no upload can take the place of a thumbnail.
+const thumbnailDir = ".thumbs"
+
+const (
+	// minThumbnailWidth and maxThumbnailWidth bound each width a bucket may ask for
+	minThumbnailWidth = 16
+	maxThumbnailWidth = 2048
+	// maxThumbnailWidths is how many thumbnails a bucket may make of each image
+	maxThumbnailWidths = 4
+	// thumbnailMaxPixels caps the images thumbnails are made of; decoding one takes four
+	// bytes per pixel
+	thumbnailMaxPixels = 40 << 20
+	// thumbnailQuality is the JPEG quality thumbnails are encoded at
+	thumbnailQuality = 85
+)
+
+var errReservedKey = fmt.Errorf("keys under %s/ are reserved for thumbnails", thumbnailDir)
+
+// errThumbnailWidths is returned for thumbnail_widths that are not a valid list of widths
+var errThumbnailWidths = fmt.Errorf("thumbnail_widths must be a JSON array of at most %d widths between %d and %d pixels",
+	maxThumbnailWidths, minThumbnailWidth, maxThumbnailWidth)
+
+// reservedKey reports whether a canonical key lies under the thumbnail folder
+func reservedKey(key string) bool {
+	return key == thumbnailDir || strings.HasPrefix(key, thumbnailDir+"/")
+}
+
+// thumbnailKey returns the key the thumbnail of the image at key made for a width is
+// stored under
+func thumbnailKey(key string, size int) string {
+	return thumbnailDir + "/" + key + "/" + strconv.Itoa(size) + ".jpg"
+}
+
+// parseThumbnailKey splits a key made by thumbnailKey into the image's key and the width
+// the thumbnail was made for
+func parseThumbnailKey(key string) (string, int, bool) {
+	rest := strings.TrimPrefix(key, thumbnailDir+"/")
+	if rest == key {
+		return "", 0, false
+	}
+	slash := strings.LastIndex(rest, "/")
+	if slash <= 0 {
+		return "", 0, false
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(rest[slash+1:], ".jpg"))
+	if err != nil || !strings.HasSuffix(rest, ".jpg") || size <= 0 {
+		return "", 0, false
+	}
+	return rest[:slash], size, true
+}
+
+// validateThumbnailWidths validates the thumbnail_widths of a bucket and returns the
+// normalised JSON to store: the widths without duplicates, in ascending order ("[]" if
+// nil/empty)
+func validateThumbnailWidths(raw json.RawMessage) (json.RawMessage, error) {
+	if len(raw) == 0 {
+		return json.RawMessage("[]"), nil
+	}
+	var widths []int
+	if err := json.Unmarshal(raw, &widths); err != nil {
+		return nil, errThumbnailWidths
+	}
+	sort.Ints(widths)
+	unique := widths[:0]
+	for i, width := range widths {
+		if width < minThumbnailWidth || width > maxThumbnailWidth {
+			return nil, errThumbnailWidths
+		}
+		if i == 0 || width != widths[i-1] {
+			unique = append(unique, width)
+		}
+	}
+	if len(unique) > maxThumbnailWidths {
+		return nil, errThumbnailWidths
+	}
+	clean, err := json.Marshal(unique)
+	if err != nil {
+		return nil, err
+	}
+	return clean, nil
+}
+
+// thumbnailSource identifies what a file's thumbnails are made of: its content, by
+// checksum, and its bucket's widths as stored
+func thumbnailSource(checksum, widths string) string {
+	return checksum + ":" + widths
+}
+
+// thumbnailStatus returns the thumbnail status of a listed file: the outcome of the last
+// generation when it was made of the file's current content and widths, pending until
+// then, and "" when the bucket makes no thumbnails or the file is not an image they can
+// be made of. mimetype is the detected mimetype when there is one.
+func thumbnailStatus(widths, mimetype, checksum string, encrypted bool, status, source string) string {
+	if widths == "[]" || checksum == "" || encrypted || !decodableImageMimetypes[mimetype] {
+		return ""
+	}
+	if status != "" && source == thumbnailSource(checksum, widths) {
+		return status
+	}
+	return models.ThumbnailStatusPending
+}
+
+// thumbnailsDue is the condition on files f joined with buckets b selecting images whose
+// thumbnails were not made of their current content and widths. Content encrypted with a
+// customer key is never readable here, and content awaiting its scan waits for it.
+func thumbnailsDue() (string, []interface{}) {
+	mimetypes := make([]string, 0, len(decodableImageMimetypes))
+	for mimetype := range decodableImageMimetypes {
+		mimetypes = append(mimetypes, mimetype)
+	}
+	sort.Strings(mimetypes)
+
+	condition := `f.status = ? AND f.staged = 0 AND b.archived = 0 AND b.thumbnail_widths <> '[]'
+		AND f.encryption_key_hash IS NULL AND f.checksum IS NOT NULL AND f.scan_status IS NOT ?
+		AND COALESCE(NULLIF(f.detected_mimetype, ''), f.mimetype) IN (?` + strings.Repeat(", ?", len(mimetypes)-1) + `)
+		AND f.thumbnail_source IS NOT f.checksum || ':' || b.thumbnail_widths`
+	args := []interface{}{models.FileStatusUploaded, models.ScanStatusPending}
+	for _, mimetype := range mimetypes {
+		args = append(args, mimetype)
+	}
+	return condition, args
+}
+
+// thumbnailTarget is an image due for thumbnails. UpdatedAt is kept as stored so the
+// thumbnails are only recorded if the content has not changed since.
+type thumbnailTarget struct {
+	ID         string
+	Key        string
+	Checksum   string
+	UpdatedAt  string
+	Widths     string
+	ClientName string
+	BucketName string
+}
+
+// loadThumbnailTarget fetches an image due for thumbnails; sql.ErrNoRows when it is not
+func (h *FileHandler) loadThumbnailTarget(fileID string) (*thumbnailTarget, error) {
+	condition, args := thumbnailsDue()
+	var target thumbnailTarget
+	err := h.db.QueryRow(
+		`SELECT f.id, f.key, f.checksum, CAST(f.updated_at AS TEXT), b.thumbnail_widths, c.name, b.name
+		FROM files f
+		JOIN clients c ON f.client_id = c.client_id
+		JOIN buckets b ON f.bucket_id = b.id
+		WHERE f.id = ? AND `+condition,
+		append([]interface{}{fileID}, args...)...,
+	).Scan(&target.ID, &target.Key, &target.Checksum, &target.UpdatedAt, &target.Widths, &target.ClientName, &target.BucketName)
+	if err != nil {
+		return nil, err
+	}
+	return &target, nil
+}
+
+// generateThumbnails makes the thumbnails of an image due for them and records them with
+// a ready status, replacing those of earlier content or widths. Content that cannot be
+// decoded, or is too large to, is recorded as failed and not tried again until it
+// changes; errors reading or writing files leave it due for the next pass.
+func (h *FileHandler) generateThumbnails(fileID string) error {
+	target, err := h.loadThumbnailTarget(fileID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var widths []int
+	if err := json.Unmarshal([]byte(target.Widths), &widths); err != nil {
+		return err
+	}
+	diskPath, err := bucketFilePath(target.ClientName, target.BucketName, target.Key)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return err
+	}
+	src, decodeErr := decodeThumbnailSource(f)
+	f.Close()
+	if decodeErr != nil {
+		logger.Error("Failed to generate thumbnails", zap.String("file_id", fileID), zap.Error(decodeErr))
+		_, err := h.db.Exec(
+			"UPDATE files SET thumbnail_status = ?, thumbnail_source = ? WHERE id = ? AND updated_at = ?",
+			models.ThumbnailStatusFailed, thumbnailSource(target.Checksum, target.Widths), target.ID, target.UpdatedAt,
+		)
+		return err
+	}
+
+	thumbnails := make([]models.Thumbnail, 0, len(widths))
+	paths := make(map[string]bool, len(widths))
+	for _, width := range widths {
+		thumb := renderThumbnail(src, width)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			return err
+		}
+		thumbnail := models.Thumbnail{Size: width, Width: thumb.Rect.Dx(), Height: thumb.Rect.Dy(), Key: thumbnailKey(target.Key, width)}
+		path, err := bucketFilePath(target.ClientName, target.BucketName, thumbnail.Key)
+		if err != nil {
+			return err
+		}
+		if _, err := storeFile(path, &buf, int64(buf.Len()), nil); err != nil {
+			return err
+		}
+		thumbnails = append(thumbnails, thumbnail)
+		paths[path] = true
+	}
+
+	stale, recorded, err := h.recordThumbnails(target, thumbnails, paths)
+	if err != nil {
+		return err
+	}
+	if !recorded {
+		// The content changed or went away while the thumbnails were made
+		stale = make([]string, 0, len(paths))
+		for path := range paths {
+			stale = append(stale, path)
+		}
+	}
+	removeThumbnailFiles(stale)
+	return nil
+}
+
+// recordThumbnails replaces the thumbnail rows of a file with the ones just made and marks
+// them ready, unless the content changed since the target was loaded. Returns the paths of
+// earlier thumbnails that are no longer used, and whether anything was recorded.
+func (h *FileHandler) recordThumbnails(target *thumbnailTarget, thumbnails []models.Thumbnail, paths map[string]bool) ([]string, bool, error) {
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE files SET thumbnail_status = ?, thumbnail_source = ? WHERE id = ? AND status = ? AND updated_at = ?",
+		models.ThumbnailStatusReady, thumbnailSource(target.Checksum, target.Widths), target.ID, models.FileStatusUploaded, target.UpdatedAt,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, false, nil
+	}
+
+	previous, err := exclusiveThumbnailPaths(tx, target.ID)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err := tx.Exec("DELETE FROM file_thumbnails WHERE file_id = ?", target.ID); err != nil {
+		return nil, false, err
+	}
+	for _, thumbnail := range thumbnails {
+		path, _ := bucketFilePath(target.ClientName, target.BucketName, thumbnail.Key)
+		if _, err := tx.Exec(
+			"INSERT INTO file_thumbnails (file_id, size, width, height, checksum, path) VALUES (?, ?, ?, ?, ?, ?)",
+			target.ID, thumbnail.Size, thumbnail.Width, thumbnail.Height, target.Checksum, path,
+		); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+
+	stale := make([]string, 0, len(previous))
+	for _, path := range previous {
+		if !paths[path] {
+			stale = append(stale, path)
+		}
+	}
+	return stale, true, nil
+}
+
+// decodeThumbnailSource decodes an image into RGBA pixels, refusing images larger than
+// thumbnailMaxPixels before any pixel is decoded
+func decodeThumbnailSource(f *os.File) (*image.RGBA, error) {
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > thumbnailMaxPixels {
+		return nil, fmt.Errorf("image of %dx%d pixels is too large for thumbnails", config.Width, config.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba, nil
+}
+
+// renderThumbnail scales src down to width pixels wide, keeping its aspect ratio. Images
+// narrower than width keep their size.
+func renderThumbnail(src *image.RGBA, width int) *image.RGBA {
+	srcWidth, srcHeight := src.Rect.Dx(), src.Rect.Dy()
+	if width > srcWidth {
+		width = srcWidth
+	}
+	height := (srcHeight*width + srcWidth/2) / srcWidth
+	if height < 1 {
+		height = 1
+	}
+	return resampleImage(src, src.Rect, width, height)
+}
+
+// resampleImage scales the crop area of src to width by height pixels by averaging the
+// pixels each output pixel covers. Transparency is flattened onto white, as JPEG has none.
+func resampleImage(src *image.RGBA, crop image.Rectangle, width, height int) *image.RGBA {
+	cropWidth, cropHeight := crop.Dx(), crop.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := crop.Min.Y+y*cropHeight/height, crop.Min.Y+(y+1)*cropHeight/height
+		for x := 0; x < width; x++ {
+			x0, x1 := crop.Min.X+x*cropWidth/width, crop.Min.X+(x+1)*cropWidth/width
+			var r, g, b, a uint32
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					r += uint32(row[sx*4])
+					g += uint32(row[sx*4+1])
+					b += uint32(row[sx*4+2])
+					a += uint32(row[sx*4+3])
+				}
+			}
+			// The pixels are alpha-premultiplied, so white shows through as 255 - alpha
+			n := uint32((y1 - y0) * (x1 - x0))
+			white := 255 - a/n
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r/n + white)
+			dst.Pix[i+1] = uint8(g/n + white)
+			dst.Pix[i+2] = uint8(b/n + white)
+			dst.Pix[i+3] = 255
+		}
+	}
+	return dst
+}
+
+// exclusiveThumbnailPaths returns where a file's thumbnails are stored, leaving out paths
+// another file's thumbnail rows also hold: an upload to the key of a deleted file makes
+// its thumbnails at the same paths before the deleted file's rows are swept
+func exclusiveThumbnailPaths(q sqlx.Queryer, fileID string) ([]string, error) {
+	var paths []string
+	err := sqlx.Select(q, &paths,
+		`SELECT path FROM file_thumbnails t WHERE file_id = ?
+		AND NOT EXISTS (SELECT 1 FROM file_thumbnails o WHERE o.path = t.path AND o.file_id <> t.file_id)`,
+		fileID,
+	)
+	return paths, err
+}
+
+// removeThumbnailFiles removes thumbnail images, logging failures; a thumbnail left behind
+// is never served once its row is gone
+func removeThumbnailFiles(paths []string) {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Error("Failed to remove thumbnail", zap.String("path", path), zap.Error(err))
+		}
+	}
+}
+
+// removeThumbnails deletes a file's thumbnails along with their rows
+func removeThumbnails(db *sqlx.DB, fileID string) error {
+	paths, err := exclusiveThumbnailPaths(db, fileID)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM file_thumbnails WHERE file_id = ?", fileID); err != nil {
+		return err
+	}
+	removeThumbnailFiles(paths)
+	return nil
+}
+
+// currentThumbnailExists reports whether the live file at a key has a thumbnail made for
+// the given width of its current content
+func currentThumbnailExists(q sqlx.Queryer, bucketID int, key string, size int) (bool, error) {
+	var exists bool
+	err := q.QueryRowx(
+		`SELECT EXISTS (SELECT 1 FROM file_thumbnails t JOIN files f ON f.id = t.file_id
+		WHERE f.bucket_id = ? AND f.key = ? AND f.status = ? AND f.staged = 0 AND t.size = ? AND t.checksum = f.checksum)`,
+		bucketID, key, models.FileStatusUploaded, size,
+	).Scan(&exists)
+	return exists, err
+}
+
+// listedThumbnails returns the current thumbnails of the given files, by file ID, smallest
+// first
+func listedThumbnails(q sqlx.Queryer, fileIDs []string) (map[string][]models.Thumbnail, error) {
+	thumbnails := make(map[string][]models.Thumbnail)
+	if len(fileIDs) == 0 {
+		return thumbnails, nil
+	}
+	query, args, err := sqlx.In(
+		`SELECT t.file_id, f.key, t.size, t.width, t.height FROM file_thumbnails t JOIN files f ON f.id = t.file_id
+		WHERE t.file_id IN (?) AND t.checksum = f.checksum ORDER BY t.file_id, t.size`,
+		fileIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.Queryx(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var fileID, key string
+		var thumbnail models.Thumbnail
+		if err := rows.Scan(&fileID, &key, &thumbnail.Size, &thumbnail.Width, &thumbnail.Height); err != nil {
+			return nil, err
+		}
+		thumbnail.Key = thumbnailKey(key, thumbnail.Size)
+		thumbnails[fileID] = append(thumbnails[fileID], thumbnail)
+	}
+	return thumbnails, rows.Err()
+}
+
+// StartThumbnailSweeper periodically makes the thumbnails of images uploaded since its last
+// pass, so uploads never wait for them, and removes thumbnails that outlived their file or
+// content. Only the instance holding the sweeper's lease runs it.
+func (h *FileHandler) StartThumbnailSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			h.jobs.runPeriodic(thumbnailSweeperLease, h.sweepThumbnails)
+		}
+	}()
+}
+
+// sweepThumbnails removes the thumbnails of up to MAX_SYNC_ROWS files that were deleted,
+// changed content or lost their bucket's widths, then makes those of up to MAX_SYNC_ROWS
+// images due for them, oldest first, stopping between files once ctx is cancelled
+func (h *FileHandler) sweepThumbnails(ctx context.Context) {
+	var staleIDs []string
+	if err := h.db.Select(&staleIDs,
+		`SELECT DISTINCT t.file_id FROM file_thumbnails t
+		LEFT JOIN files f ON f.id = t.file_id
+		LEFT JOIN buckets b ON b.id = f.bucket_id
+		WHERE f.id IS NULL OR f.status <> ? OR f.staged <> 0 OR f.checksum IS NOT t.checksum
+			OR f.encryption_key_hash IS NOT NULL OR b.thumbnail_widths = '[]'
+		LIMIT ?`,
+		models.FileStatusUploaded, h.config.MaxSyncRows,
+	); err != nil {
+		logger.Error("Failed to query stale thumbnails", zap.Error(err))
+		return
+	}
+	for _, fileID := range staleIDs {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := removeThumbnails(h.db, fileID); err != nil {
+			logger.Error("Failed to remove stale thumbnails", zap.String("file_id", fileID), zap.Error(err))
+		}
+	}
+
+	condition, args := thumbnailsDue()
+	var fileIDs []string
+	if err := h.db.Select(&fileIDs,
+		`SELECT f.id FROM files f JOIN buckets b ON f.bucket_id = b.id
+		WHERE `+condition+` ORDER BY f.updated_at LIMIT ?`,
+		append(args, h.config.MaxSyncRows)...,
+	); err != nil {
+		logger.Error("Failed to query images due for thumbnails", zap.Error(err))
+		return
+	}
+	for _, fileID := range fileIDs {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := h.generateThumbnails(fileID); err != nil {
+			logger.Error("Failed to generate thumbnails", zap.String("file_id", fileID), zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"file-upload-service/api"
+	"file-upload-service/models"
+)
+
+// storedUpdatedAt is the text of a row's updated_at, which is what sync clients compare
+func (e *testEnv) storedUpdatedAt(table string, id interface{}) string {
+	e.t.Helper()
+	var updatedAt string
+	if err := e.db.Get(&updatedAt, "SELECT CAST(updated_at AS TEXT) FROM "+table+" WHERE id = ?", id); err != nil {
+		e.t.Fatal(err)
+	}
+	// Column defaults are SQLite's CURRENT_TIMESTAMP, UTC without a zone
+	if len(updatedAt) > len("2006-01-02 15:04:05") && !strings.HasSuffix(updatedAt, "+00:00") {
+		e.t.Fatalf("%s %v: updated_at %q is not UTC", table, id, updatedAt)
+	}
+	return updatedAt
+}
+
+// expectAdvances applies a change and checks that it moved a row's updated_at forward
+func (e *testEnv) expectAdvances(table string, id interface{}, change string, apply func()) {
+	e.t.Helper()
+	before := e.storedUpdatedAt(table, id)
+	// The triggers stamp milliseconds
+	time.Sleep(2 * time.Millisecond)
+	apply()
+	if after := e.storedUpdatedAt(table, id); after <= before {
+		e.t.Fatalf("%s %v: %s left updated_at at %q (was %q)", table, id, change, after, before)
+	}
+}
+
+func TestUpdatedAtAdvancesOnEveryWritePath(t *testing.T) {
+	// A zone ahead of UTC makes local stamps sort after the triggers' UTC ones
+	local := time.Local
+	time.Local = time.FixedZone("UTC+14", 14*60*60)
+	t.Cleanup(func() { time.Local = local })
+
+	env := newTestEnv(t)
+	buckets := NewBucketHandler(env.db, api.NewPager(env.cfg.PaginationSecret))
+	clients := NewClientHandler(env.db)
+
+	var clientRowID int
+	if err := env.db.Get(&clientRowID, "SELECT id FROM clients WHERE client_id = ?", env.clientID); err != nil {
+		t.Fatal(err)
+	}
+	shortURLs := true
+	updateClient := func() {
+		w := serveAdmin(clients.UpdateClient, newRequest(http.MethodPut, "/clients/"+strconv.Itoa(clientRowID),
+			models.UpdateClientRequest{ShortURLs: &shortURLs}), map[string]string{"id": strconv.Itoa(clientRowID)})
+		expectStatus(t, w, http.StatusOK)
+		shortURLs = !shortURLs
+	}
+	env.expectAdvances("clients", clientRowID, "PUT /clients/{id}", updateClient)
+	env.expectAdvances("clients", clientRowID, "a direct update", func() {
+		env.db.MustExec("UPDATE clients SET name = name || '-renamed' WHERE id = ?", clientRowID)
+	})
+	env.expectAdvances("clients", clientRowID, "recording use", func() {
+		if err := TouchClientLastUsed(env.db, env.clientID, time.Now().UTC()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	env.expectAdvances("clients", clientRowID, "PUT /clients/{id} again", updateClient)
+
+	w := env.serve(buckets.CreateBucket, newRequest(http.MethodPost, "/buckets", models.CreateBucketRequest{Name: "photos"}), nil)
+	expectStatus(t, w, http.StatusCreated)
+	var bucket models.Bucket
+	decode(t, w, &bucket)
+	updateBucket := func() {
+		w := env.serve(buckets.UpdateBucket, newRequest(http.MethodPut, "/buckets/"+strconv.Itoa(bucket.ID),
+			map[string]interface{}{"public_paths": []string{"pub/**"}}), map[string]string{"id": strconv.Itoa(bucket.ID)})
+		expectStatus(t, w, http.StatusOK)
+	}
+	env.expectAdvances("buckets", bucket.ID, "PUT /buckets/{id}", updateBucket)
+	env.expectAdvances("buckets", bucket.ID, "a direct update", func() {
+		env.db.MustExec("UPDATE buckets SET public_paths = public_paths WHERE id = ?", bucket.ID)
+	})
+	env.expectAdvances("buckets", bucket.ID, "PUT /buckets/{id} again", updateBucket)
+
+	signed := env.signedUpload(signedURLRequest(bucket.ID, "docs/a.txt", 64))
+	env.expectAdvances("files", signed.FileID, "the upload", func() {
+		expectStatus(t, serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, []byte("content")), nil), http.StatusOK)
+	})
+	env.expectAdvances("files", signed.FileID, "a direct rename", func() {
+		env.db.MustExec("UPDATE files SET file_name = 'renamed.txt' WHERE id = ?", signed.FileID)
+	})
+	env.expectAdvances("files", signed.FileID, "DELETE /files", func() {
+		env.deletePath(bucket.ID, "docs")
+	})
+
+	group := env.createUploadGroup(bucket.ID, "batch/a.txt")
+	env.expectAdvances("upload_groups", group.GroupID, "a direct update", func() {
+		env.db.MustExec("UPDATE upload_groups SET expires_at = expires_at WHERE id = ?", group.GroupID)
+	})
+	env.expectAdvances("upload_groups", group.GroupID, "the abort", func() {
+		w := env.serve(env.files.AbortUploadGroup, newRequest(http.MethodPost, "/files/upload-groups/"+group.GroupID+"/abort", nil),
+			map[string]string{"id": group.GroupID})
+		expectStatus(t, w, http.StatusOK)
+	})
+}
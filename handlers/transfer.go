@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// sendfileChunkSize is how much of a file a download hands to the response at a time;
+// cancellation is checked between chunks
+const sendfileChunkSize = 4 << 20
+
+// copyBuffers pools the buffers uploads are copied to disk through, so a large buffer
+// costs an allocation per concurrent upload instead of one per request
+type copyBuffers struct {
+	pool sync.Pool
+}
+
+// newCopyBuffers returns a pool of size-byte buffers, or nil when pooling is off.
+// Both get and put accept a nil pool.
+func newCopyBuffers(size int, enabled bool) *copyBuffers {
+	if !enabled || size <= 0 {
+		return nil
+	}
+	return &copyBuffers{pool: sync.Pool{New: func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}}}
+}
+
+// get takes a buffer from the pool; nil when pooling is off
+func (b *copyBuffers) get() *[]byte {
+	if b == nil {
+		return nil
+	}
+	return b.pool.Get().(*[]byte)
+}
+
+// put returns a buffer taken with get
+func (b *copyBuffers) put(buf *[]byte) {
+	if b == nil || buf == nil {
+		return
+	}
+	b.pool.Put(buf)
+}
+
+// bufferedCopy copies src to dst through buf, or with io.Copy when buf is nil. The
+// destination's ReadFrom is hidden because an *os.File would otherwise ignore buf and copy
+// through a 32 KiB buffer of its own for any source it cannot hand to the kernel.
+func bufferedCopy(dst io.Writer, src io.Reader, buf *[]byte) (int64, error) {
+	if buf == nil {
+		return io.Copy(dst, src)
+	}
+	return io.CopyBuffer(struct{ io.Writer }{dst}, src, *buf)
+}
+
+// streamFile copies an open file to a response, stopping as soon as ctx is cancelled.
+// With sendfile on, the file is handed over in chunks through io.CopyN: the response sees
+// the *os.File behind each chunk and lets the runtime send it with sendfile(2), without
+// copying the bytes through user space. dst must be the response writer itself, since
+// a wrapper would hide its ReadFrom. Otherwise it falls back to copyWithContext.
+func streamFile(ctx context.Context, dst io.Writer, f *os.File, sendfile bool) (int64, error) {
+	if !sendfile {
+		return copyWithContext(ctx, dst, f)
+	}
+
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n, err := io.CopyN(dst, f, sendfileChunkSize)
+		written += n
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// streamFileRange copies length bytes of f from its current offset to a response, the way
+// streamFile copies the rest of it
+func streamFileRange(ctx context.Context, dst io.Writer, f *os.File, length int64, sendfile bool) (int64, error) {
+	if !sendfile {
+		return copyWithContext(ctx, dst, io.LimitReader(f, length))
+	}
+
+	var written int64
+	for written < length {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		chunk := length - written
+		if chunk > sendfileChunkSize {
+			chunk = sendfileChunkSize
+		}
+		n, err := io.CopyN(dst, f, chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
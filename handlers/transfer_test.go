@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// testBufferBytes is the pooled buffer size the copy tests run with
+const testBufferBytes = 64 << 10
+
+// transferContent is size deterministic bytes; text keeps mimetype detection at text/plain
+func transferContent(size int, text bool) []byte {
+	content := make([]byte, size)
+	rng := rand.New(rand.NewSource(int64(size)))
+	rng.Read(content)
+	if text {
+		for i := range content {
+			content[i] = 'a' + content[i]%26
+		}
+	}
+	return content
+}
+
+// boundarySizes are the sizes around a buffer or chunk size where copy loops go wrong
+func boundarySizes(size int) []int {
+	return []int{0, size - 1, size, size + 1}
+}
+
+// writeTransferFile stores content in a file of dir and opens it for reading
+func writeTransferFile(tb testing.TB, dir string, content []byte) *os.File {
+	tb.Helper()
+	path := filepath.Join(dir, "src-"+strconv.Itoa(len(content)))
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { f.Close() })
+	return f
+}
+
+// serveStream serves a file through streamFile or, when length is not negative,
+// streamFileRange from offset, and returns the bytes a client receives
+func serveStream(t *testing.T, f *os.File, offset, length int64, sendfile bool) []byte {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			t.Error(err)
+			return
+		}
+		var err error
+		if length < 0 {
+			_, err = streamFile(r.Context(), w, f, sendfile)
+		} else {
+			_, err = streamFileRange(r.Context(), w, f, length, sendfile)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	received, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return received
+}
+
+func TestBufferedCopyIsByteIdentical(t *testing.T) {
+	dir := t.TempDir()
+	for _, pooled := range []bool{false, true} {
+		buffers := newCopyBuffers(testBufferBytes, pooled)
+		for _, size := range boundarySizes(testBufferBytes) {
+			content := transferContent(size, false)
+			src := writeTransferFile(t, dir, content)
+			dstPath := filepath.Join(dir, "dst")
+			dst, err := os.Create(dstPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf := buffers.get()
+			n, err := bufferedCopy(dst, src, buf)
+			buffers.put(buf)
+			dst.Close()
+			if err != nil || n != int64(size) {
+				t.Fatalf("pooled=%v size=%d: copied %d bytes (%v)", pooled, size, n, err)
+			}
+			if copied, err := os.ReadFile(dstPath); err != nil || !bytes.Equal(copied, content) {
+				t.Fatalf("pooled=%v size=%d: copy differs from the source (%v)", pooled, size, err)
+			}
+		}
+	}
+}
+
+func TestStreamFileIsByteIdentical(t *testing.T) {
+	dir := t.TempDir()
+	for _, sendfile := range []bool{false, true} {
+		for _, size := range boundarySizes(sendfileChunkSize) {
+			content := transferContent(size, false)
+			f := writeTransferFile(t, dir, content)
+			if received := serveStream(t, f, 0, -1, sendfile); !bytes.Equal(received, content) {
+				t.Fatalf("sendfile=%v size=%d: received %d bytes that differ from the file", sendfile, size, len(received))
+			}
+		}
+	}
+}
+
+func TestStreamFileRangeIsByteIdentical(t *testing.T) {
+	dir := t.TempDir()
+	const offset = 3
+	for _, sendfile := range []bool{false, true} {
+		for _, length := range boundarySizes(sendfileChunkSize) {
+			// Bytes past the range must not be sent
+			content := transferContent(offset+length+5, false)
+			f := writeTransferFile(t, dir, content)
+			want := content[offset : offset+length]
+			if received := serveStream(t, f, offset, int64(length), sendfile); !bytes.Equal(received, want) {
+				t.Fatalf("sendfile=%v length=%d: received %d bytes that differ from the range", sendfile, length, len(received))
+			}
+		}
+	}
+}
+
+func TestUploadAndDownloadAtBufferBoundaries(t *testing.T) {
+	for _, fast := range []bool{false, true} {
+		t.Run("fast_transfers="+strconv.FormatBool(fast), func(t *testing.T) {
+			env := newTestEnv(t)
+			env.cfg.FastTransfers = fast
+			env.cfg.UploadBufferBytes = testBufferBytes
+			env.files.buffers = newCopyBuffers(env.cfg.UploadBufferBytes, env.cfg.FastTransfers)
+			bucketID := env.createBucket("photos")
+
+			for _, size := range boundarySizes(testBufferBytes) {
+				content := transferContent(size, true)
+				key := "docs/" + strconv.Itoa(size) + ".txt"
+				// A signed URL declares at least one byte; an empty upload under it is allowed
+				declared := int64(size)
+				if declared == 0 {
+					declared = 1
+				}
+				signed := env.signedUpload(signedURLRequest(bucketID, key, declared))
+				w := serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, content), nil)
+				expectStatus(t, w, http.StatusOK)
+				if stored, err := os.ReadFile(env.diskPath(bucketID, key)); err != nil || !bytes.Equal(stored, content) {
+					t.Fatalf("size %d: stored bytes differ from the upload (%v)", size, err)
+				}
+
+				w = serveAnonymous(env.files.DownloadFile, newRequest(http.MethodGet, env.downloadTarget(signed.FileID), nil), nil)
+				expectStatus(t, w, http.StatusOK)
+				if !bytes.Equal(w.Body.Bytes(), content) {
+					t.Fatalf("size %d: downloaded %d bytes that differ from the upload", size, w.Body.Len())
+				}
+			}
+		})
+	}
+}
+
+// benchmarkSize is the file size the copy benchmarks move per operation
+const benchmarkSize = 16 << 20
+
+func BenchmarkBufferedCopy(b *testing.B) {
+	dir := b.TempDir()
+	content := transferContent(benchmarkSize, false)
+	for _, pooled := range []bool{false, true} {
+		b.Run("pooled="+strconv.FormatBool(pooled), func(b *testing.B) {
+			buffers := newCopyBuffers(256<<10, pooled)
+			src := writeTransferFile(b, dir, content)
+			dst, err := os.Create(filepath.Join(dir, "dst"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer dst.Close()
+
+			b.SetBytes(benchmarkSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				src.Seek(0, io.SeekStart)
+				dst.Seek(0, io.SeekStart)
+				buf := buffers.get()
+				if _, err := bufferedCopy(dst, src, buf); err != nil {
+					b.Fatal(err)
+				}
+				buffers.put(buf)
+			}
+		})
+	}
+}
+
+func BenchmarkStreamFile(b *testing.B) {
+	dir := b.TempDir()
+	content := transferContent(benchmarkSize, false)
+	for _, sendfile := range []bool{false, true} {
+		b.Run("sendfile="+strconv.FormatBool(sendfile), func(b *testing.B) {
+			path := filepath.Join(dir, "src")
+			if err := os.WriteFile(path, content, 0644); err != nil {
+				b.Fatal(err)
+			}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				f, err := os.Open(path)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer f.Close()
+				streamFile(r.Context(), w, f, sendfile)
+			}))
+			defer srv.Close()
+
+			b.SetBytes(benchmarkSize)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(srv.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkCopyWithContext(b *testing.B) {
+	content := transferContent(benchmarkSize, false)
+	b.SetBytes(benchmarkSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := copyWithContext(context.Background(), io.Discard, bytes.NewReader(content)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"file-upload-service/config"
+	"file-upload-service/models"
+
+	"go.uber.org/zap"
+)
+
+// uploadCallbackAttempts is how many times a completion callback is tried before giving up
+const uploadCallbackAttempts = 3
+
+// uploadCallbackTimeout bounds a single callback attempt
+const uploadCallbackTimeout = 5 * time.Second
+
+// uploadCallbackBackoff is the wait before the first retry; it doubles for each later one
+const uploadCallbackBackoff = time.Second
+
+// uploadCallbackEvent names the event an upload callback reports
+const uploadCallbackEvent = "file.uploaded"
+
+// replaceCallbackEvent names the event reported when a file's content was replaced
+const replaceCallbackEvent = "file.replaced"
+
+// validateCallbackURL checks a signed URL's callback_url: an absolute http(s) URL without
+// credentials that does not obviously point inside the network. Hostnames are checked
+// again when the callback connects, after DNS resolution.
+func validateCallbackURL(raw string, allowPrivate bool) error {
+	callbackURL, err := url.Parse(raw)
+	if err != nil || (callbackURL.Scheme != "http" && callbackURL.Scheme != "https") || callbackURL.Host == "" {
+		return errors.New("callback_url must be an absolute http or https URL")
+	}
+	if callbackURL.User != nil {
+		return errors.New("callback_url cannot contain credentials")
+	}
+	if allowPrivate {
+		return nil
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(callbackURL.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errors.New("callback_url cannot point to localhost")
+	}
+	if ip := net.ParseIP(host); ip != nil && !importAddressAllowed(ip) {
+		return errors.New("callback_url cannot point to a loopback, private or link-local address")
+	}
+	return nil
+}
+
+// newUploadCallbackClient builds the HTTP client upload callbacks are sent with. Redirects
+// are not followed: a callback that answers with one has failed.
+func newUploadCallbackClient(cfg *config.Config) *http.Client {
+	dialer := newGuardedDialer(cfg.UploadCallbackAllowPrivate)
+
+	return &http.Client{
+		Timeout: uploadCallbackTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: uploadCallbackTimeout,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// postUploadCallback makes one callback attempt; any status outside 2xx is a failure
+func (h *FileHandler) postUploadCallback(callbackURL string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sendUploadCallback delivers a completed upload's payload to its callback URL, retrying
+// with backoff. It runs in the background after the upload has been answered, so
+// failures are only logged.
+func (h *FileHandler) sendUploadCallback(ctx context.Context, callbackURL string, payload models.UploadCallbackPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to encode upload callback", zap.String("file_id", payload.FileID), zap.Error(err))
+		return
+	}
+
+	backoff := uploadCallbackBackoff
+	for attempt := 1; attempt <= uploadCallbackAttempts; attempt++ {
+		err = h.postUploadCallback(callbackURL, body)
+		if err == nil {
+			h.logRequest(ctx, "info", "Upload callback delivered",
+				zap.String("file_id", payload.FileID),
+				zap.Int("attempt", attempt),
+			)
+			return
+		}
+		h.logRequest(ctx, "error", "Upload callback attempt failed",
+			zap.String("file_id", payload.FileID),
+			zap.Int("attempt", attempt),
+			zap.Error(err),
+		)
+		if attempt < uploadCallbackAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	h.logRequest(ctx, "error", "Giving up on upload callback",
+		zap.String("file_id", payload.FileID),
+		zap.Int("attempts", uploadCallbackAttempts),
+	)
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/umakantv/go-utils/errs"
+	"go.uber.org/zap"
+)
+
+// uploadFormTemplate is the manual-testing page for a signed upload URL. It posts the
+// picked file to the upload endpoint with the page's token and shows the JSON result.
+var uploadFormTemplate = template.Must(template.New("upload-form").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Upload {{.FileName}}</title>
+<style>
+body { font-family: sans-serif; max-width: 40rem; margin: 2rem auto; }
+dt { font-weight: bold; }
+pre { background: #f4f4f4; padding: 1rem; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Upload a file</h1>
+<dl>
+<dt>File name</dt><dd id="file-name">{{.FileName}}</dd>
+<dt>Key</dt><dd id="key">{{.Key}}</dd>
+<dt>Maximum size</dt><dd id="max-size">{{.MaxSize}} bytes</dd>
+<dt>Expected mimetype</dt><dd id="mimetype">{{.Mimetype}}{{if .AllowMimetypeMismatch}} (content is not checked){{end}}</dd>
+</dl>
+<form id="upload-form">
+<input type="file" name="file" required>
+<button type="submit">Upload</button>
+</form>
+<pre id="result"></pre>
+<script>
+document.getElementById("upload-form").addEventListener("submit", async function (event) {
+  event.preventDefault();
+  const result = document.getElementById("result");
+  result.textContent = "Uploading...";
+  try {
+    const response = await fetch("/files/upload?token=" + encodeURIComponent({{.Token}}), {
+      method: "POST",
+      body: new FormData(event.target),
+    });
+    const body = await response.text();
+    let shown = body;
+    try { shown = JSON.stringify(JSON.parse(body), null, 2); } catch (e) {}
+    result.textContent = response.status + " " + response.statusText + "\n" + shown;
+  } catch (e) {
+    result.textContent = "Upload failed: " + e;
+  }
+});
+</script>
+</body>
+</html>
+`))
+
+// uploadFormData is what the upload form shows about its token
+type uploadFormData struct {
+	Token                 string
+	FileName              string
+	Key                   string
+	MaxSize               int64
+	Mimetype              string
+	AllowMimetypeMismatch bool
+}
+
+// UploadForm handles GET /files/upload/form - serve an HTML page for manually testing a
+// signed upload URL (no auth header required, like the upload itself). The page is only
+// served when UPLOAD_FORM_ENABLED is set; otherwise the route answers 404. Loading the
+// page does not use up the token.
+func (h *FileHandler) UploadForm(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !h.config.UploadFormEnabled {
+		h.logRequest(ctx, "info", "Upload form is disabled")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("Not found"))
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		h.logRequest(ctx, "error", "Missing upload token")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Missing upload token"))
+		return
+	}
+
+	tokenData, status, appErr := h.loadUploadToken(ctx, token)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	// FilePath is <client_name>/<bucket_name>/<key>; only the key is shown
+	key := filepath.ToSlash(tokenData.FilePath)
+	if parts := strings.SplitN(key, "/", 3); len(parts) == 3 {
+		key = parts[2]
+	}
+	// A prefix token takes any key beneath its prefix
+	if tokenData.KeyPrefix != "" {
+		key = tokenData.KeyPrefix + "/"
+	}
+
+	h.logRequest(ctx, "info", "Serving upload form", zap.String("file_id", tokenData.FileID))
+
+	// The page carries the token, so keep it out of caches and referrers
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(http.StatusOK)
+	if err := uploadFormTemplate.Execute(w, uploadFormData{
+		Token:                 token,
+		FileName:              tokenData.FileName,
+		Key:                   key,
+		MaxSize:               tokenData.FileSize,
+		Mimetype:              tokenData.Mimetype,
+		AllowMimetypeMismatch: tokenData.AllowMimetypeMismatch,
+	}); err != nil {
+		h.logRequest(ctx, "error", "Failed to render upload form", zap.Error(err))
+	}
+}
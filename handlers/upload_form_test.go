@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// uploadFormTarget is the form page for the token of a signed upload URL
+func uploadFormTarget(signedURL string) string {
+	parsed, err := url.Parse(signedURL)
+	if err != nil {
+		panic(err)
+	}
+	return "/files/upload/form?token=" + parsed.Query().Get("token")
+}
+
+func TestUploadFormShowsTokenConstraints(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.UploadFormEnabled = true
+	bucketID := env.createBucket("photos")
+	req := signedURLRequest(bucketID, "invoices/2024/<receipt>.pdf", 2048)
+	req.Mimetype = "application/pdf"
+	signed := env.signedUpload(req)
+
+	w := serveAnonymous(env.files.UploadForm, newRequest(http.MethodGet, uploadFormTarget(signed.SignedURL), nil), nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Fatalf("Content-Type = %q, want HTML", got)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Fatalf("Cache-Control = %q, want no-store", got)
+	}
+
+	page := w.Body.String()
+	for _, want := range []string{
+		`<dd id="key">invoices/2024/&lt;receipt&gt;.pdf</dd>`,
+		`<dd id="max-size">2048 bytes</dd>`,
+		`<dd id="mimetype">application/pdf</dd>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Fatalf("form does not contain %s:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, env.clientName) {
+		t.Fatal("form shows the client name from the token's storage path")
+	}
+
+	// Loading the page leaves the token usable
+	w = serveAnonymous(env.files.UploadFile, uploadRequest(signed.SignedURL, []byte("%PDF-1.4\n")), nil)
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestUploadFormDisabledIs404(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.UploadFormEnabled = false
+	bucketID := env.createBucket("photos")
+	signed := env.signedUpload(signedURLRequest(bucketID, "docs/a.txt", 64))
+
+	w := serveAnonymous(env.files.UploadForm, newRequest(http.MethodGet, uploadFormTarget(signed.SignedURL), nil), nil)
+	expectStatus(t, w, http.StatusNotFound)
+	if strings.Contains(w.Body.String(), "<html") {
+		t.Fatal("disabled form route served the page")
+	}
+}
+
+func TestUploadFormUnknownToken(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.UploadFormEnabled = true
+
+	w := serveAnonymous(env.files.UploadForm, newRequest(http.MethodGet, "/files/upload/form?token=unknown", nil), nil)
+	expectStatus(t, w, http.StatusUnauthorized)
+}
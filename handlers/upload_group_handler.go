@@ -0,0 +1,542 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// stagingRoot holds bytes uploaded into an upload group until the group is committed
+const stagingRoot = "./staging"
+
+// maxUploadGroupEntries caps how many files a single upload group may declare
+const maxUploadGroupEntries = 100
+
+// stagingPath returns where a grouped upload is written before commit
+func stagingPath(groupID, fileID string) string {
+	return filepath.Join(stagingRoot, groupID, fileID)
+}
+
+// loadUploadGroup fetches an upload group owned by the client.
+// On failure it returns the HTTP status to respond with and the error body.
+func (h *FileHandler) loadUploadGroup(ctx context.Context, clientID, groupID string) (*models.UploadGroup, int, *errs.AppError) {
+	var group models.UploadGroup
+	err := h.db.QueryRow(
+		"SELECT id, client_id, status, expires_at, created_at, updated_at FROM upload_groups WHERE id = ?",
+		groupID,
+	).Scan(&group.ID, &group.ClientID, &group.Status, &group.ExpiresAt, &group.CreatedAt, &group.UpdatedAt)
+	if err == sql.ErrNoRows || (err == nil && group.ClientID != clientID) {
+		h.logRequest(ctx, "info", "Upload group not found", zap.String("group_id", groupID))
+		return nil, http.StatusNotFound, errs.NewNotFoundError("Upload group not found")
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query upload group", zap.Error(err))
+		return nil, http.StatusInternalServerError, errs.NewInternalServerError("Database error")
+	}
+	return &group, 0, nil
+}
+
+// claimUploadGroup atomically moves an open group to the given status.
+// Returns false if the group was no longer open (another request got there first).
+func (h *FileHandler) claimUploadGroup(groupID, status string) (bool, error) {
+	result, err := h.db.Exec(
+		"UPDATE upload_groups SET status = ?, updated_at = ? WHERE id = ? AND status = ?",
+		status, time.Now().UTC(), groupID, models.UploadGroupStatusOpen,
+	)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected == 1, nil
+}
+
+// discardUploadGroup removes a claimed group's staged bytes and soft-deletes its file rows
+func (h *FileHandler) discardUploadGroup(groupID string) error {
+	if err := os.RemoveAll(filepath.Join(stagingRoot, groupID)); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	_, err := h.db.Exec(
+		"UPDATE files SET status = ?, deleted_at = ?, updated_at = ? WHERE upload_group_id = ? AND staged = 1 AND deleted_at IS NULL",
+		models.FileStatusDeleted, now, now, groupID,
+	)
+	return err
+}
+
+// isUploadGroupOpen reports whether uploads into the group are still accepted
+func (h *FileHandler) isUploadGroupOpen(groupID string) bool {
+	var status string
+	var expiresAt time.Time
+	err := h.db.QueryRow("SELECT status, expires_at FROM upload_groups WHERE id = ?", groupID).Scan(&status, &expiresAt)
+	return err == nil && status == models.UploadGroupStatusOpen && time.Now().Before(expiresAt)
+}
+
+// CreateUploadGroup handles POST /files/upload-groups - create a group of uploads committed together
+func (h *FileHandler) CreateUploadGroup(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req models.CreateUploadGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+
+	if len(req.Entries) == 0 {
+		h.logRequest(ctx, "error", "Missing required field: entries")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("entries is required"))
+		return
+	}
+	if len(req.Entries) > maxUploadGroupEntries {
+		h.logRequest(ctx, "error", "Too many upload group entries", zap.Int("count", len(req.Entries)))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(fmt.Sprintf("entries cannot contain more than %d items", maxUploadGroupEntries)))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	groupID := uuid.New().String()
+
+	// Validate every entry up front so the group is created all-or-nothing
+	uploads := make([]*pendingUpload, 0, len(req.Entries))
+	seenPaths := make(map[string]int)
+	for i, entry := range req.Entries {
+		if entry.OnConflict != "" && entry.OnConflict != models.OnConflictReject && entry.OnConflict != models.OnConflictError {
+			h.logRequest(ctx, "error", "Upload group entry asks to replace a stored file", zap.Int("entry", i))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(fmt.Sprintf("entries[%d]: on_conflict=%s is not supported in upload groups", i, entry.OnConflict)))
+			return
+		}
+		if entry.ExpiresInSeconds != nil {
+			h.logRequest(ctx, "error", "Upload group entry sets its own lifetime", zap.Int("entry", i))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(fmt.Sprintf("entries[%d]: expires_in_seconds is not supported; entry URLs live as long as the group", i)))
+			return
+		}
+		if entry.Extract {
+			h.logRequest(ctx, "error", "Upload group entry asks for extraction", zap.Int("entry", i))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(fmt.Sprintf("entries[%d]: extract is not supported in upload groups", i)))
+			return
+		}
+		upload, status, appErr := h.prepareUpload(ctx, clientID, entry)
+		if appErr != nil {
+			appErr.Message = fmt.Sprintf("entries[%d]: %s", i, appErr.Message)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(appErr)
+			return
+		}
+		if first, ok := seenPaths[upload.TokenData.FilePath]; ok {
+			h.logRequest(ctx, "error", "Duplicate key in upload group", zap.String("key", entry.Key))
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errs.NewValidationError(fmt.Sprintf("entries[%d]: key duplicates entries[%d] in the same bucket", i, first)))
+			return
+		}
+		seenPaths[upload.TokenData.FilePath] = i
+		upload.TokenData.GroupID = groupID
+		h.restrictUploadIP(r, upload, entry)
+		uploads = append(uploads, upload)
+	}
+
+	h.logRequest(ctx, "info", "Creating upload group",
+		zap.String("group_id", groupID),
+		zap.String("client_id", clientID),
+		zap.Int("entries", len(uploads)),
+	)
+
+	now := time.Now().UTC()
+	ttl := h.config.UploadGroupTTL
+	expiresAt := now.Add(ttl)
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to begin transaction", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to create upload group"))
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"INSERT INTO upload_groups (id, client_id, status, expires_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+		groupID, clientID, models.UploadGroupStatusOpen, expiresAt, now, now,
+	); err != nil {
+		h.logRequest(ctx, "error", "Failed to create upload group", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to create upload group"))
+		return
+	}
+	for i, upload := range uploads {
+		// Earlier entries count towards the quota once their rows are inserted
+		if err := checkUploadQuotas(tx, upload, now); err != nil {
+			if quotaErr, ok := asQuotaError(err); ok {
+				h.writeQuotaExceeded(ctx, w, quotaErr, fmt.Sprintf("entries[%d]: ", i))
+				return
+			}
+			h.logRequest(ctx, "error", "Failed to check quotas", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to create upload group"))
+			return
+		}
+		// Group entries reserve no keys; only a stored file can refuse one
+		outcome, existingID, err := claimUploadKey(tx, upload, models.OnConflictReject, false, expiresAt, now)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to check entry key", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to create upload group"))
+			return
+		}
+		if outcome == keyExists {
+			h.logRequest(ctx, "error", "File already stored at entry key", zap.Int("entry", i), zap.String("existing_file_id", existingID))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(models.FileExistsConflict{
+				Code:    http.StatusConflict,
+				Message: fmt.Sprintf("entries[%d]: a file already exists at this key", i),
+				FileID:  existingID,
+			})
+			return
+		}
+		if err := insertFileRecord(tx, upload, models.FileStatusPending, now); err != nil {
+			h.logRequest(ctx, "error", "Failed to create file record", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to create upload group"))
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		h.logRequest(ctx, "error", "Failed to commit upload group", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to create upload group"))
+		return
+	}
+
+	// Entry tokens live as long as the group itself
+	entries := make([]models.SignedURLResponse, 0, len(uploads))
+	for _, upload := range uploads {
+		entry, err := h.issueUploadToken(upload, ttl, now)
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to store upload token in cache", zap.Error(err))
+			if claimed, _ := h.claimUploadGroup(groupID, models.UploadGroupStatusAborted); claimed {
+				h.discardUploadGroup(groupID)
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to generate signed URL"))
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	h.logRequest(ctx, "info", "Upload group created successfully", zap.String("group_id", groupID))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.UploadGroupResponse{
+		GroupID:   groupID,
+		Status:    models.UploadGroupStatusOpen,
+		ExpiresAt: expiresAt,
+		Entries:   entries,
+	})
+}
+
+// CommitUploadGroup handles POST /files/upload-groups/{id}/commit - make every entry live at once
+func (h *FileHandler) CommitUploadGroup(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	groupID := mux.Vars(r)["id"]
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Committing upload group", zap.String("group_id", groupID), zap.String("client_id", clientID))
+
+	group, status, appErr := h.loadUploadGroup(ctx, clientID, groupID)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+	if group.Status != models.UploadGroupStatusOpen {
+		h.logRequest(ctx, "error", "Upload group is not open", zap.String("group_id", groupID), zap.String("status", group.Status))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Upload group is " + group.Status))
+		return
+	}
+	if time.Now().After(group.ExpiresAt) {
+		h.logRequest(ctx, "error", "Upload group has expired", zap.String("group_id", groupID))
+		if claimed, _ := h.claimUploadGroup(groupID, models.UploadGroupStatusExpired); claimed {
+			h.discardUploadGroup(groupID)
+		}
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Upload group has expired"))
+		return
+	}
+
+	// Resolve every entry's final path and make sure its bytes have been staged
+	rows, err := h.db.Query(
+		`SELECT f.id, f.bucket_id, f.key, c.name, b.name
+		 FROM files f
+		 JOIN clients c ON f.client_id = c.client_id
+		 JOIN buckets b ON f.bucket_id = b.id
+		 WHERE f.upload_group_id = ? AND f.staged = 1 AND f.deleted_at IS NULL`,
+		groupID,
+	)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query upload group files", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to commit upload group"))
+		return
+	}
+	finalPaths := make(map[string]string)
+	bucketIDs := make(map[string]int)
+	keys := make(map[string]string)
+	fileIDs := make([]string, 0)
+	missing := make([]string, 0)
+	for rows.Next() {
+		var fileID, key, clientName, bucketName string
+		var bucketID int
+		if err := rows.Scan(&fileID, &bucketID, &key, &clientName, &bucketName); err != nil {
+			h.logRequest(ctx, "error", "Failed to scan file row", zap.Error(err))
+			continue
+		}
+		fileIDs = append(fileIDs, fileID)
+		bucketIDs[fileID] = bucketID
+		keys[fileID] = key
+		finalPaths[fileID] = filepath.Join("./uploads", clientName, bucketName, key)
+		if _, err := os.Stat(stagingPath(groupID, fileID)); err != nil {
+			missing = append(missing, fileID)
+		}
+	}
+	rows.Close()
+
+	if len(missing) > 0 {
+		h.logRequest(ctx, "info", "Upload group has entries that are not uploaded yet",
+			zap.String("group_id", groupID),
+			zap.Int("missing", len(missing)),
+		)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(models.UploadGroupCommitResponse{
+			GroupID: groupID,
+			Status:  models.UploadGroupStatusOpen,
+			FileIDs: fileIDs,
+			Missing: missing,
+		})
+		return
+	}
+
+	// Claim the group so a concurrent commit, abort or expiry sweep cannot interleave
+	claimed, err := h.claimUploadGroup(groupID, models.UploadGroupStatusCommitting)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to claim upload group", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to commit upload group"))
+		return
+	}
+	if !claimed {
+		h.logRequest(ctx, "error", "Upload group changed state during commit", zap.String("group_id", groupID))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Upload group is no longer open"))
+		return
+	}
+
+	// Move the staged bytes into place, undoing earlier moves if any one fails. In a
+	// versioning bucket the content each move replaces is linked aside first, and
+	// recorded as a version when the commit goes through.
+	moved := make([]string, 0, len(fileIDs))
+	versions := make(map[string]*keptVersion)
+	restore := func() {
+		for _, id := range moved {
+			os.Rename(finalPaths[id], stagingPath(groupID, id))
+		}
+		for id, version := range versions {
+			version.putBack(finalPaths[id])
+		}
+		h.db.Exec(
+			"UPDATE upload_groups SET status = ?, updated_at = ? WHERE id = ?",
+			models.UploadGroupStatusOpen, time.Now().UTC(), groupID,
+		)
+	}
+	for _, id := range fileIDs {
+		version, err := keepVersionAtKey(h.db, bucketIDs[id], keys[id], finalPaths[id])
+		if version != nil {
+			versions[id] = version
+		}
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(finalPaths[id]), 0755)
+		}
+		if err == nil {
+			err = os.Rename(stagingPath(groupID, id), finalPaths[id])
+		}
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to move staged file into place", zap.String("file_id", id), zap.Error(err))
+			restore()
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to commit upload group"))
+			return
+		}
+		moved = append(moved, id)
+	}
+
+	now := time.Now().UTC()
+	tx, err := h.db.Begin()
+	if err == nil {
+		for _, version := range versions {
+			if err = version.record(tx, now); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			_, err = tx.Exec("UPDATE files SET staged = 0, updated_at = ? WHERE upload_group_id = ? AND staged = 1", now, groupID)
+		}
+		if err == nil {
+			_, err = tx.Exec("UPDATE upload_groups SET status = ?, updated_at = ? WHERE id = ?", models.UploadGroupStatusCommitted, now, groupID)
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to mark upload group committed", zap.Error(err))
+		restore()
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to commit upload group"))
+		return
+	}
+
+	os.RemoveAll(filepath.Join(stagingRoot, groupID))
+
+	h.logRequest(ctx, "info", "Upload group committed successfully", zap.String("group_id", groupID), zap.Int("files", len(fileIDs)))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.UploadGroupCommitResponse{
+		GroupID: groupID,
+		Status:  models.UploadGroupStatusCommitted,
+		FileIDs: fileIDs,
+	})
+}
+
+// AbortUploadGroup handles POST /files/upload-groups/{id}/abort - discard every entry of a group
+func (h *FileHandler) AbortUploadGroup(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	groupID := mux.Vars(r)["id"]
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Aborting upload group", zap.String("group_id", groupID), zap.String("client_id", clientID))
+
+	group, status, appErr := h.loadUploadGroup(ctx, clientID, groupID)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	claimed, err := h.claimUploadGroup(groupID, models.UploadGroupStatusAborted)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to claim upload group", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to abort upload group"))
+		return
+	}
+	if !claimed {
+		h.logRequest(ctx, "error", "Upload group is not open", zap.String("group_id", groupID), zap.String("status", group.Status))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Upload group is " + group.Status))
+		return
+	}
+
+	if err := h.discardUploadGroup(groupID); err != nil {
+		h.logRequest(ctx, "error", "Failed to clean up upload group", zap.String("group_id", groupID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to abort upload group"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Upload group aborted successfully", zap.String("group_id", groupID))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.UploadGroupResponse{
+		GroupID:   groupID,
+		Status:    models.UploadGroupStatusAborted,
+		ExpiresAt: group.ExpiresAt,
+	})
+}
+
+// StartUploadGroupSweeper periodically expires open upload groups past their deadline,
+// discarding their staged bytes and file rows. Only the instance holding the sweeper's
+// lease runs it.
+func (h *FileHandler) StartUploadGroupSweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			h.jobs.runPeriodic(uploadGroupSweeperLease, h.sweepExpiredUploadGroups)
+		}
+	}()
+}
+
+// sweepExpiredUploadGroups expires every open group whose deadline has passed, stopping
+// between groups once ctx is cancelled
+func (h *FileHandler) sweepExpiredUploadGroups(ctx context.Context) {
+	var groupIDs []string
+	if err := h.db.Select(&groupIDs,
+		"SELECT id FROM upload_groups WHERE status = ? AND expires_at < ?",
+		models.UploadGroupStatusOpen, time.Now().UTC(),
+	); err != nil {
+		logger.Error("Failed to query expired upload groups", zap.Error(err))
+		return
+	}
+
+	for _, groupID := range groupIDs {
+		if ctx.Err() != nil {
+			return
+		}
+		claimed, err := h.claimUploadGroup(groupID, models.UploadGroupStatusExpired)
+		if err != nil || !claimed {
+			continue
+		}
+		if err := h.discardUploadGroup(groupID); err != nil {
+			logger.Error("Failed to clean up expired upload group", zap.String("group_id", groupID), zap.Error(err))
+			continue
+		}
+		logger.Info("Expired upload group cleaned up", zap.String("group_id", groupID))
+	}
+}
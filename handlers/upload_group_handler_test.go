@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"file-upload-service/models"
+)
+
+// createUploadGroup declares a group with one entry per key and returns the response
+func (e *testEnv) createUploadGroup(bucketID int, keys ...string) models.UploadGroupResponse {
+	e.t.Helper()
+	req := models.CreateUploadGroupRequest{}
+	for _, key := range keys {
+		req.Entries = append(req.Entries, signedURLRequest(bucketID, key, 64))
+	}
+	w := e.serve(e.files.CreateUploadGroup, newRequest(http.MethodPost, "/files/upload-groups", req), nil)
+	expectStatus(e.t, w, http.StatusCreated)
+
+	var group models.UploadGroupResponse
+	decode(e.t, w, &group)
+	return group
+}
+
+// liveKeys lists the keys of a bucket a client can currently list
+func (e *testEnv) liveKeys(bucketID int, path string) []string {
+	e.t.Helper()
+	w := e.serve(e.files.ListFiles, newRequest(http.MethodGet, "/buckets/1/files?path="+path, nil),
+		map[string]string{"id": strconv.Itoa(bucketID)})
+	expectStatus(e.t, w, http.StatusOK)
+
+	var resp models.ListFilesResponse
+	decode(e.t, w, &resp)
+	keys := make([]string, 0, len(resp.Items))
+	for _, f := range resp.Items {
+		keys = append(keys, f.Key)
+	}
+	return keys
+}
+
+func TestUploadGroupCommitMakesEntriesLiveTogether(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	group := env.createUploadGroup(bucketID, "docs/a.txt", "docs/b.txt")
+	if len(group.Entries) != 2 {
+		t.Fatalf("group has %d entries, want 2", len(group.Entries))
+	}
+
+	w := serveAnonymous(env.files.UploadFile, uploadRequest(group.Entries[0].SignedURL, []byte("first")), nil)
+	expectStatus(t, w, http.StatusOK)
+	if keys := env.liveKeys(bucketID, "docs"); len(keys) != 0 {
+		t.Fatalf("staged entries are listed before commit: %v", keys)
+	}
+
+	commit := func() *models.UploadGroupCommitResponse {
+		w := env.serve(env.files.CommitUploadGroup, newRequest(http.MethodPost, "/files/upload-groups/"+group.GroupID+"/commit", nil),
+			map[string]string{"id": group.GroupID})
+		var resp models.UploadGroupCommitResponse
+		decode(t, w, &resp)
+		if w.Code == http.StatusConflict {
+			return &resp
+		}
+		expectStatus(t, w, http.StatusOK)
+		return &resp
+	}
+
+	resp := commit()
+	if resp.Status != models.UploadGroupStatusOpen || len(resp.Missing) != 1 || resp.Missing[0] != group.Entries[1].FileID {
+		t.Fatalf("commit with a missing entry = %+v, want it refused naming %s", resp, group.Entries[1].FileID)
+	}
+
+	w = serveAnonymous(env.files.UploadFile, uploadRequest(group.Entries[1].SignedURL, []byte("second")), nil)
+	expectStatus(t, w, http.StatusOK)
+
+	resp = commit()
+	if resp.Status != models.UploadGroupStatusCommitted || len(resp.FileIDs) != 2 {
+		t.Fatalf("commit = %+v, want both files committed", resp)
+	}
+	if keys := env.liveKeys(bucketID, "docs"); len(keys) != 2 {
+		t.Fatalf("listed %v after commit, want both entries", keys)
+	}
+	content, err := os.ReadFile(env.diskPath(bucketID, "docs/b.txt"))
+	if err != nil || string(content) != "second" {
+		t.Fatalf("committed content = %q, %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(stagingRoot, group.GroupID)); !os.IsNotExist(err) {
+		t.Fatalf("staging directory left behind after commit: %v", err)
+	}
+
+	// A committed group cannot be committed or aborted again
+	w = env.serve(env.files.AbortUploadGroup, newRequest(http.MethodPost, "/files/upload-groups/"+group.GroupID+"/abort", nil),
+		map[string]string{"id": group.GroupID})
+	expectStatus(t, w, http.StatusConflict)
+}
+
+func TestUploadGroupAbortDiscardsEntries(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	group := env.createUploadGroup(bucketID, "docs/a.txt", "docs/b.txt")
+
+	w := serveAnonymous(env.files.UploadFile, uploadRequest(group.Entries[0].SignedURL, []byte("first")), nil)
+	expectStatus(t, w, http.StatusOK)
+
+	w = env.serve(env.files.AbortUploadGroup, newRequest(http.MethodPost, "/files/upload-groups/"+group.GroupID+"/abort", nil),
+		map[string]string{"id": group.GroupID})
+	expectStatus(t, w, http.StatusOK)
+
+	if _, err := os.Stat(filepath.Join(stagingRoot, group.GroupID)); !os.IsNotExist(err) {
+		t.Fatalf("staged bytes left behind after abort: %v", err)
+	}
+	var live int
+	if err := env.db.Get(&live, "SELECT COUNT(*) FROM files WHERE upload_group_id = ? AND deleted_at IS NULL", group.GroupID); err != nil {
+		t.Fatal(err)
+	}
+	if live != 0 {
+		t.Fatalf("%d file rows of an aborted group are still live", live)
+	}
+
+	// Uploads into an aborted group are refused
+	w = serveAnonymous(env.files.UploadFile, uploadRequest(group.Entries[1].SignedURL, []byte("second")), nil)
+	expectStatus(t, w, http.StatusConflict)
+}
+
+func TestUploadGroupRejectsDuplicateKeys(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	req := models.CreateUploadGroupRequest{Entries: []models.CreateSignedURLRequest{
+		signedURLRequest(bucketID, "docs/a.txt", 64),
+		signedURLRequest(bucketID, "docs/a.txt", 64),
+	}}
+
+	w := env.serve(env.files.CreateUploadGroup, newRequest(http.MethodPost, "/files/upload-groups", req), nil)
+	expectStatus(t, w, http.StatusBadRequest)
+}
+
+func TestUploadGroupSweeperExpiresOpenGroups(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	group := env.createUploadGroup(bucketID, "docs/a.txt")
+	env.db.MustExec("UPDATE upload_groups SET expires_at = datetime('now', '-1 minute') WHERE id = ?", group.GroupID)
+
+	env.files.sweepExpiredUploadGroups(context.Background())
+
+	var status string
+	if err := env.db.Get(&status, "SELECT status FROM upload_groups WHERE id = ?", group.GroupID); err != nil {
+		t.Fatal(err)
+	}
+	if status != models.UploadGroupStatusExpired {
+		t.Fatalf("status = %q after the sweep, want expired", status)
+	}
+}
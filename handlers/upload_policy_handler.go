@@ -0,0 +1,448 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// maxFormFieldBytes is the largest form field a streamed upload may send ahead of its file
+const maxFormFieldBytes = 8 << 10
+
+// policyFilenameVariable in a policy upload's key is replaced by the uploaded file's name
+const policyFilenameVariable = "${filename}"
+
+var errInvalidPolicy = errors.New("policy signature does not match")
+
+// signUploadPolicy returns the hex HMAC-SHA256 of an encoded policy
+func (h *FileHandler) signUploadPolicy(encoded string) string {
+	mac := hmac.New(sha256.New, h.config.UploadPolicySecret)
+	mac.Write([]byte(encoded))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// decodeUploadPolicy verifies the signature of an encoded policy and returns the policy
+func (h *FileHandler) decodeUploadPolicy(encoded, signature string) (models.UploadPolicy, error) {
+	var policy models.UploadPolicy
+	if encoded == "" || !hmac.Equal([]byte(signature), []byte(h.signUploadPolicy(encoded))) {
+		return policy, errInvalidPolicy
+	}
+	body, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return policy, errInvalidPolicy
+	}
+	if err := json.Unmarshal(body, &policy); err != nil {
+		return policy, errInvalidPolicy
+	}
+	return policy, nil
+}
+
+// validateCreateUploadPolicyRequest checks the fields of an upload policy request
+func validateCreateUploadPolicyRequest(req models.CreateUploadPolicyRequest) error {
+	switch {
+	case req.BucketID <= 0:
+		return errors.New("bucket_id is required and must be a positive integer")
+	case req.MaxSize <= 0:
+		return errors.New("max_size must be greater than 0")
+	case req.MinSize < 0 || req.MinSize > req.MaxSize:
+		return errors.New("min_size must be between 0 and max_size, where 0 means the default of 1")
+	case req.OwnerEntityType == "":
+		return errors.New("owner_entity_type is required")
+	case req.OwnerEntityID == "":
+		return errors.New("owner_entity_id is required")
+	case req.OnConflict != "" && req.OnConflict != models.OnConflictReject && req.OnConflict != models.OnConflictError &&
+		req.OnConflict != models.OnConflictOverwrite && req.OnConflict != models.OnConflictNewVersion &&
+		req.OnConflict != models.OnConflictRename:
+		return errors.New("on_conflict must be one of reject, overwrite, new-version, rename")
+	}
+	if req.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(req.ContentType); err != nil || !strings.Contains(req.ContentType, "/") {
+			return errors.New(`content_type must be a mimetype such as "image/png" or "image/*"`)
+		}
+	}
+	return nil
+}
+
+// resolveUploadPrefix checks that the client may upload to a bucket and canonicalizes a
+// key prefix for it, for URLs and policies that leave the rest of the key to each upload.
+// On failure it returns the HTTP status to respond with and the error body.
+func (h *FileHandler) resolveUploadPrefix(ctx context.Context, clientID string, bucketID int, rawPrefix string) (string, int, *errs.AppError) {
+	var bucketClientID string
+	var bucketArchived, bucketLowercaseKeys int
+	err := h.db.QueryRow(
+		"SELECT client_id, archived, lowercase_keys FROM buckets WHERE id = ?", bucketID,
+	).Scan(&bucketClientID, &bucketArchived, &bucketLowercaseKeys)
+	if err != nil {
+		h.logRequest(ctx, "error", "Bucket not found", zap.Int("bucket_id", bucketID), zap.Error(err))
+		return "", http.StatusNotFound, errs.NewNotFoundError("Bucket not found")
+	}
+	if bucketClientID != clientID {
+		h.logRequest(ctx, "error", "Bucket does not belong to client",
+			zap.Int("bucket_id", bucketID),
+			zap.String("client_id", clientID),
+		)
+		return "", http.StatusForbidden, errs.NewAuthorizationError("Access denied: bucket does not belong to your account")
+	}
+	if bucketArchived != 0 {
+		h.logRequest(ctx, "error", "Bucket is archived", zap.Int("bucket_id", bucketID))
+		return "", http.StatusConflict, errs.NewValidationError("Cannot upload to an archived bucket")
+	}
+
+	prefix, err := canonicalizeKey(rawPrefix, bucketLowercaseKeys != 0)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid key prefix", zap.String("key_prefix", rawPrefix), zap.Error(err))
+		return "", http.StatusBadRequest, errs.NewValidationError("key_prefix: " + err.Error())
+	}
+	return prefix, 0, nil
+}
+
+// CreateUploadPolicy handles POST /files/upload-policy - sign a policy that lets a browser
+// upload any file meeting its conditions straight to the service, without a signed URL
+// per file. The policy is not stored: it travels with each upload and is trusted only
+// because of its signature.
+func (h *FileHandler) CreateUploadPolicy(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	var req models.CreateUploadPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+	if err := validateCreateUploadPolicyRequest(req); err != nil {
+		h.logRequest(ctx, "error", "Invalid upload policy request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+	if req.MinSize == 0 {
+		req.MinSize = 1
+	}
+	ttl, err := h.signedURLTTL(req.ExpiresInSeconds)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid policy lifetime", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	// The bucket is checked again on every upload; this only refuses policies that could
+	// never be used
+	prefix, status, appErr := h.resolveUploadPrefix(ctx, clientID, req.BucketID, req.KeyPrefix)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	policy := models.UploadPolicy{
+		Expiration:      time.Now().Add(ttl).UTC(),
+		ClientID:        clientID,
+		OwnerEntityType: req.OwnerEntityType,
+		OwnerEntityID:   req.OwnerEntityID,
+		OnConflict:      req.OnConflict,
+		Conditions: models.UploadPolicyConditions{
+			BucketID:           req.BucketID,
+			KeyPrefix:          prefix,
+			ContentType:        strings.ToLower(req.ContentType),
+			ContentLengthRange: [2]int64{req.MinSize, req.MaxSize},
+		},
+	}
+	body, _ := json.Marshal(policy)
+	encoded := base64.RawURLEncoding.EncodeToString(body)
+
+	h.logRequest(ctx, "info", "Upload policy created",
+		zap.String("client_id", clientID),
+		zap.Int("bucket_id", req.BucketID),
+		zap.String("key_prefix", prefix),
+		zap.Time("expires_at", policy.Expiration),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.UploadPolicyResponse{
+		UploadURL: "http://localhost:8080/files/upload/policy",
+		Fields: map[string]string{
+			"policy":    encoded,
+			"signature": h.signUploadPolicy(encoded),
+		},
+		Policy:    policy,
+		ExpiresAt: policy.Expiration,
+	})
+}
+
+// PolicyUpload handles POST /files/upload/policy - store a file posted as a multipart form
+// under a signed upload policy (no auth header required; the signature is the
+// credential). The policy, signature, key and optional mimetype and file_name fields
+// must come before the file part, so every condition is checked before its bytes are
+// streamed to disk.
+func (h *FileHandler) PolicyUpload(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if h.rejectCustomerKey(ctx, w, r) {
+		return
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		h.logRequest(ctx, "error", "Policy upload is not a multipart form", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Upload must be a multipart/form-data form"))
+		return
+	}
+
+	fields, file, status, appErr := h.readFormFields(ctx, reader)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+	h.storePolicyUpload(ctx, w, fields, file, h.uploaderOf(r))
+	file.Close()
+}
+
+// readFormFields reads the fields of a streamed upload form up to its file part, which it
+// returns unread. Fields after the file part are never seen, so forms must send them first.
+// On failure it returns the HTTP status to respond with and the error body.
+func (h *FileHandler) readFormFields(ctx context.Context, reader *multipart.Reader) (map[string]string, *multipart.Part, int, *errs.AppError) {
+	fields := map[string]string{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			h.logRequest(ctx, "error", "Upload form has no file part")
+			return nil, nil, http.StatusBadRequest, errs.NewValidationError("Missing file in upload")
+		}
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				h.logRequest(ctx, "error", "Upload body exceeds size limit")
+				return nil, nil, http.StatusRequestEntityTooLarge, &errs.AppError{
+					Code:    http.StatusRequestEntityTooLarge,
+					Message: "File size exceeds allowed limit",
+				}
+			}
+			h.logRequest(ctx, "error", "Failed to parse multipart form", zap.Error(err))
+			return nil, nil, http.StatusBadRequest, errs.NewValidationError("Failed to parse upload form")
+		}
+		if part.FormName() == "file" {
+			return fields, part, 0, nil
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxFormFieldBytes+1))
+		part.Close()
+		if err != nil || len(value) > maxFormFieldBytes {
+			h.logRequest(ctx, "error", "Upload form field too large", zap.String("field", part.FormName()))
+			return nil, nil, http.StatusBadRequest, errs.NewValidationError(fmt.Sprintf("Form field %s is too large", part.FormName()))
+		}
+		fields[part.FormName()] = string(value)
+	}
+}
+
+// storePolicyUpload checks the form fields sent ahead of file against their policy, one
+// condition at a time, then streams the file into the bucket, recording uploader on it
+func (h *FileHandler) storePolicyUpload(ctx context.Context, w http.ResponseWriter, fields map[string]string, file *multipart.Part, uploader uploaderInfo) {
+	policy, err := h.decodeUploadPolicy(fields["policy"], fields["signature"])
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid upload policy signature")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(errs.NewAuthorizationError("Invalid policy signature"))
+		return
+	}
+	conditions := policy.Conditions
+	policyDenied := func(reason string) {
+		h.logRequest(ctx, "error", "Policy upload does not meet its policy",
+			zap.Int("bucket_id", conditions.BucketID),
+			zap.String("reason", reason),
+		)
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(errs.NewAuthorizationError(reason))
+	}
+
+	if time.Now().After(policy.Expiration) {
+		policyDenied("Policy has expired")
+		return
+	}
+
+	key := strings.ReplaceAll(fields["key"], policyFilenameVariable, path.Base(file.FileName()))
+	mimetype := normalizeMimetype(fields["mimetype"])
+	if mimetype == "" {
+		mimetype = normalizeMimetype(file.Header.Get("Content-Type"))
+	}
+	fileName := fields["file_name"]
+	if fileName == "" {
+		fileName = path.Base(file.FileName())
+	}
+	if fileName == "" || fileName == "." || fileName == "/" {
+		fileName = path.Base(key)
+	}
+	if mimetype == "" {
+		h.logRequest(ctx, "error", "Missing required field: mimetype")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("mimetype is required"))
+		return
+	}
+	if conditions.ContentType != "" && !mimetypeAllowed(mimetype, []string{conditions.ContentType}) {
+		policyDenied(fmt.Sprintf("mimetype %s does not match the policy's content_type %s", mimetype, conditions.ContentType))
+		return
+	}
+
+	minSize, maxSize := conditions.ContentLengthRange[0], conditions.ContentLengthRange[1]
+	prepared, status, appErr := h.prepareUpload(ctx, policy.ClientID, models.CreateSignedURLRequest{
+		BucketID:        conditions.BucketID,
+		Key:             key,
+		FileName:        fileName,
+		FileSize:        maxSize,
+		Mimetype:        mimetype,
+		OwnerEntityType: policy.OwnerEntityType,
+		OwnerEntityID:   policy.OwnerEntityID,
+		OnConflict:      policy.OnConflict,
+	})
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+	if conditions.KeyPrefix != "" && !strings.HasPrefix(prepared.Key, conditions.KeyPrefix+"/") {
+		policyDenied(fmt.Sprintf("key must be beneath %s/", conditions.KeyPrefix))
+		return
+	}
+
+	filePath := filepath.Join(uploadsRoot, prepared.TokenData.FilePath)
+	if !h.hasDiskSpace(filePath, maxSize) {
+		writeInsufficientStorage(w)
+		return
+	}
+
+	detected, body, err := sniffContentType(file)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to read policy upload", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Failed to read upload body"))
+		return
+	}
+	prepared.DetectedMimetype = detected
+	if !prepared.TokenData.AllowMimetypeMismatch && !mimetypesMatch(mimetype, detected) {
+		h.logRequest(ctx, "error", "Uploaded content does not match declared mimetype",
+			zap.String("declared", mimetype),
+			zap.String("detected", detected),
+		)
+		writeMimetypeMismatch(w, mimetype, detected)
+		return
+	}
+
+	head := &headCapture{}
+	buf := h.buffers.get()
+	tmpPath, written, err := stageFile(filePath, io.TeeReader(body, head), maxSize, buf)
+	h.buffers.put(buf)
+	if err == errFileTooLarge {
+		h.logRequest(ctx, "error", "Policy upload exceeds size limit", zap.Int64("max_size", maxSize))
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(errs.AppError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("File exceeds the policy's maximum size of %d bytes", maxSize),
+		})
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to stream policy upload", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to save file"))
+		return
+	}
+	if written < minSize {
+		os.Remove(tmpPath)
+		h.logRequest(ctx, "error", "Policy upload below size limit", zap.Int64("min_size", minSize), zap.Int64("bytes_written", written))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(
+			fmt.Sprintf("File is smaller than the policy's minimum size of %d bytes", minSize),
+		))
+		return
+	}
+	prepared.TokenData.FileSize = written
+	prepared.Image = h.imageDimensions(ctx, prepared.TokenData.FileID, detected, head.buf)
+	prepared.Uploader = uploader
+
+	outcome, existingID, err := h.storeImportedFile(prepared, policy.OnConflict, tmpPath)
+	if err != nil {
+		if quotaErr, ok := asQuotaError(err); ok {
+			h.writeQuotaExceeded(ctx, w, quotaErr, "")
+			return
+		}
+		h.logRequest(ctx, "error", "Failed to store policy upload", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to save file"))
+		return
+	}
+	switch outcome {
+	case keyExists:
+		h.writeFileExistsConflict(ctx, w, existingID, prepared.Key)
+		return
+	case keyExhausted:
+		h.logRequest(ctx, "error", "No free key left to rename to", zap.String("key", prepared.Key))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.AppError{Code: http.StatusConflict, Message: keyConflictMessage(outcome)})
+		return
+	}
+	// A rename may have moved the upload to another key
+	tokenData := prepared.TokenData
+	filePath = filepath.Join(uploadsRoot, tokenData.FilePath)
+
+	scanStatus, signature := h.scanAfterUpload(ctx, tokenData.FileID, written, nil)
+	if scanStatus == models.ScanStatusInfected {
+		h.logRequest(ctx, "info", "Uploaded file quarantined", zap.String("file_id", tokenData.FileID), zap.String("signature", signature))
+		writeQuarantined(w, signature)
+		return
+	}
+
+	h.logRequest(ctx, "info", "File uploaded successfully",
+		zap.String("file_id", tokenData.FileID),
+		zap.String("client_id", policy.ClientID),
+		zap.Int("bucket_id", tokenData.BucketID),
+		zap.Int64("bytes_written", written),
+	)
+
+	response := map[string]interface{}{
+		"message":    "File uploaded successfully",
+		"file_id":    tokenData.FileID,
+		"file_name":  tokenData.FileName,
+		"file_size":  written,
+		"mimetype":   tokenData.Mimetype,
+		"bucket_id":  tokenData.BucketID,
+		"key":        prepared.Key,
+		"saved_path": filePath,
+	}
+	if scanStatus != "" {
+		response["scan_status"] = scanStatus
+	}
+	if prepared.Image != nil {
+		response["image"] = prepared.Image
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
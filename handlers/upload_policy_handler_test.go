@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"file-upload-service/models"
+)
+
+// policyRequest asks for a policy for text files of 5 to 64 bytes beneath avatars/u1
+func policyRequest(bucketID int) models.CreateUploadPolicyRequest {
+	return models.CreateUploadPolicyRequest{
+		BucketID:        bucketID,
+		KeyPrefix:       "avatars/u1",
+		ContentType:     "text/*",
+		MinSize:         5,
+		MaxSize:         64,
+		OwnerEntityType: "user",
+		OwnerEntityID:   "u1",
+	}
+}
+
+// uploadPolicy signs an upload policy as requested
+func (e *testEnv) uploadPolicy(req models.CreateUploadPolicyRequest) models.UploadPolicyResponse {
+	e.t.Helper()
+	w := e.serve(e.files.CreateUploadPolicy, newRequest(http.MethodPost, "/files/upload-policy", req), nil)
+	expectStatus(e.t, w, http.StatusCreated)
+	var policy models.UploadPolicyResponse
+	decode(e.t, w, &policy)
+	return policy
+}
+
+// encodePolicy encodes and signs a policy document the way CreateUploadPolicy does
+func (e *testEnv) encodePolicy(policy models.UploadPolicy) (encoded, signature string) {
+	e.t.Helper()
+	body, err := json.Marshal(policy)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	encoded = base64.RawURLEncoding.EncodeToString(body)
+	return encoded, e.files.signUploadPolicy(encoded)
+}
+
+// policyUpload posts a file under a policy, with its fields ahead of the file part
+func (e *testEnv) policyUpload(policy, signature, key, mimetype string, content []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("policy", policy)
+	form.WriteField("signature", signature)
+	form.WriteField("key", key)
+	form.WriteField("mimetype", mimetype)
+	part, err := form.CreateFormFile("file", "note.txt")
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	part.Write(content)
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/files/upload/policy", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return serveAnonymous(e.files.PolicyUpload, r, nil)
+}
+
+// storedFiles counts the file rows of a bucket
+func (e *testEnv) storedFiles(bucketID int) int {
+	return e.rowsFor("files", "bucket_id", strconv.Itoa(bucketID))
+}
+
+func TestPolicyUploadStoresAFileMeetingItsConditions(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	policy := env.uploadPolicy(policyRequest(bucketID))
+
+	w := env.policyUpload(policy.Fields["policy"], policy.Fields["signature"], "avatars/u1/${filename}", "text/plain", []byte("hello there"))
+	expectStatus(t, w, http.StatusCreated)
+	var stored struct {
+		Key      string `json:"key"`
+		FileSize int64  `json:"file_size"`
+	}
+	decode(t, w, &stored)
+	if stored.Key != "avatars/u1/note.txt" || stored.FileSize != 11 {
+		t.Fatalf("stored %+v, want avatars/u1/note.txt of 11 bytes", stored)
+	}
+}
+
+func TestPolicyUploadRefusesTampering(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	policy := env.uploadPolicy(policyRequest(bucketID))
+	encoded, signature := policy.Fields["policy"], policy.Fields["signature"]
+
+	// The same document with a larger maximum, under the original signature
+	widened := policy.Policy
+	widened.Conditions.ContentLengthRange[1] = 1 << 20
+	widenedEncoded, _ := env.encodePolicy(widened)
+
+	flipped := "0" + signature[1:]
+	if signature[0] == '0' {
+		flipped = "1" + signature[1:]
+	}
+	for name, form := range map[string][2]string{
+		"edited policy":     {widenedEncoded, signature},
+		"altered signature": {encoded, flipped},
+		"no signature":      {encoded, ""},
+		"no policy":         {"", signature},
+	} {
+		w := env.policyUpload(form[0], form[1], "avatars/u1/a.txt", "text/plain", []byte("hello there"))
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "Invalid policy signature") {
+			t.Fatalf("%s: %d %s, want 403 Invalid policy signature", name, w.Code, w.Body.String())
+		}
+	}
+	if n := env.storedFiles(bucketID); n != 0 {
+		t.Fatalf("%d files stored under tampered policies", n)
+	}
+}
+
+func TestPolicyUploadExpires(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	policy := env.uploadPolicy(policyRequest(bucketID)).Policy
+	policy.Expiration = time.Now().Add(-time.Second).UTC()
+	encoded, signature := env.encodePolicy(policy)
+
+	w := env.policyUpload(encoded, signature, "avatars/u1/a.txt", "text/plain", []byte("hello there"))
+	expectRefused(t, w, http.StatusForbidden, "Policy has expired")
+	if n := env.storedFiles(bucketID); n != 0 {
+		t.Fatalf("%d files stored under an expired policy", n)
+	}
+}
+
+func TestPolicyUploadEnforcesEachCondition(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	policy := env.uploadPolicy(policyRequest(bucketID))
+
+	cases := []struct {
+		name     string
+		key      string
+		mimetype string
+		content  []byte
+		status   int
+		message  string
+	}{
+		{"below min_size", "avatars/u1/a.txt", "text/plain", []byte("hi"), http.StatusBadRequest,
+			"File is smaller than the policy's minimum size of 5 bytes"},
+		{"above max_size", "avatars/u1/b.txt", "text/plain", bytes.Repeat([]byte("a"), 65), http.StatusRequestEntityTooLarge,
+			"File exceeds the policy's maximum size of 64 bytes"},
+		{"other content_type", "avatars/u1/c.json", "application/json", []byte(`{"a": 1}`), http.StatusForbidden,
+			"mimetype application/json does not match the policy's content_type text/*"},
+		{"outside key_prefix", "avatars/u2/d.txt", "text/plain", []byte("hello there"), http.StatusForbidden,
+			"key must be beneath avatars/u1/"},
+		{"key_prefix as a name prefix", "avatars/u1-other/e.txt", "text/plain", []byte("hello there"), http.StatusForbidden,
+			"key must be beneath avatars/u1/"},
+	}
+	for _, c := range cases {
+		w := env.policyUpload(policy.Fields["policy"], policy.Fields["signature"], c.key, c.mimetype, c.content)
+		if w.Code != c.status || !strings.Contains(w.Body.String(), c.message) {
+			t.Fatalf("%s: %d %s, want %d %q", c.name, w.Code, w.Body.String(), c.status, c.message)
+		}
+	}
+	if n := env.storedFiles(bucketID); n != 0 {
+		t.Fatalf("%d files stored by refused uploads", n)
+	}
+
+	// The bounds themselves are accepted
+	for i, size := range []int{5, 64} {
+		key := "avatars/u1/bound-" + strconv.Itoa(i) + ".txt"
+		w := env.policyUpload(policy.Fields["policy"], policy.Fields["signature"], key, "text/plain", bytes.Repeat([]byte("a"), size))
+		expectStatus(t, w, http.StatusCreated)
+	}
+}
+
+func TestCreateUploadPolicyMinSize(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+
+	// 0 is accepted and means the default of 1 byte
+	req := policyRequest(bucketID)
+	req.MinSize = 0
+	if got := env.uploadPolicy(req).Policy.Conditions.ContentLengthRange; got != [2]int64{1, 64} {
+		t.Fatalf("content_length_range = %v, want [1 64]", got)
+	}
+
+	for _, minSize := range []int64{-1, 65} {
+		req.MinSize = minSize
+		w := env.serve(env.files.CreateUploadPolicy, newRequest(http.MethodPost, "/files/upload-policy", req), nil)
+		expectRefused(t, w, http.StatusBadRequest, "min_size must be between 0 and max_size, where 0 means the default of 1")
+	}
+}
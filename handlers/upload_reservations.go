@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// reserveUploadKey claims the key of a prepared upload until expiresAt, recording its
+// file as the key's one outstanding upload. It returns false when another upload still
+// holds an unexpired reservation on the key. The claim is a single upsert that only
+// replaces a lapsed reservation, so it stays correct even across service instances.
+func reserveUploadKey(exec sqlx.Execer, upload *pendingUpload, expiresAt, now time.Time) (bool, error) {
+	result, err := exec.Exec(
+		`INSERT INTO upload_reservations (bucket_id, key, file_id, expires_at, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (bucket_id, key) DO UPDATE SET file_id = excluded.file_id, expires_at = excluded.expires_at, created_at = excluded.created_at
+		WHERE upload_reservations.expires_at <= ?`,
+		upload.TokenData.BucketID, upload.Key, upload.TokenData.FileID, expiresAt, now, now,
+	)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected == 1, nil
+}
+
+// activeReservation returns the pending file holding an unexpired reservation on a key.
+// found is false when the key is free.
+func (h *FileHandler) activeReservation(bucketID int, key string) (fileID string, expiresAt time.Time, found bool, err error) {
+	err = h.db.QueryRow(
+		"SELECT file_id, expires_at FROM upload_reservations WHERE bucket_id = ? AND key = ? AND expires_at > ?",
+		bucketID, key, time.Now().UTC(),
+	).Scan(&fileID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return "", time.Time{}, false, nil
+	}
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	return fileID, expiresAt, true, nil
+}
+
+// releaseReservation frees the key reserved by a file once its upload is done
+func (h *FileHandler) releaseReservation(fileID string) error {
+	_, err := h.db.Exec("DELETE FROM upload_reservations WHERE file_id = ?", fileID)
+	return err
+}
+
+// retirePendingUpload marks the file row of an upload that will never complete deleted,
+// the way a discarded upload group retires its rows, and frees its key. Rows that are no
+// longer pending are left alone; retired reports whether the row was.
+func retirePendingUpload(exec sqlx.Execer, fileID string, now time.Time) (retired bool, err error) {
+	result, err := exec.Exec(
+		"UPDATE files SET status = ?, deleted_at = ?, updated_at = ? WHERE id = ? AND status = ?",
+		models.FileStatusDeleted, now, now, fileID, models.FileStatusPending,
+	)
+	if err != nil {
+		return false, err
+	}
+	if _, err := exec.Exec("DELETE FROM upload_reservations WHERE file_id = ?", fileID); err != nil {
+		return false, err
+	}
+	affected, _ := result.RowsAffected()
+	return affected > 0, nil
+}
+
+// Outcomes of claiming the key of a prepared upload
+const (
+	keyClaimed = iota
+	// keyPending means another upload holds an unexpired reservation on the key
+	keyPending
+	// keyExists means a file is stored at the key and on_conflict is reject
+	keyExists
+	// keyExhausted means on_conflict=rename found no free key
+	keyExhausted
+)
+
+// maxRenameAttempts caps how many "name (n).ext" keys a rename tries before giving up
+const maxRenameAttempts = 1000
+
+// renamedKey returns the n-th disambiguated form of a key, inserting " (n)" before the
+// extension of its last segment: "photos/IMG_0001.jpg" becomes "photos/IMG_0001 (2).jpg"
+func renamedKey(key string, n int) string {
+	dir, name := "", key
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		dir, name = key[:i+1], key[i+1:]
+	}
+	ext := filepath.Ext(name)
+	if ext == name {
+		// Dotfiles such as ".env" have no extension to keep
+		ext = ""
+	}
+	return fmt.Sprintf("%s%s (%d)%s", dir, strings.TrimSuffix(name, ext), n, ext)
+}
+
+// keyReserved reports whether an upload holds an unexpired reservation on a key
+func keyReserved(q sqlx.Queryer, bucketID int, key string, now time.Time) (bool, error) {
+	var reserved bool
+	err := q.QueryRowx(
+		"SELECT EXISTS (SELECT 1 FROM upload_reservations WHERE bucket_id = ? AND key = ? AND expires_at > ?)",
+		bucketID, key, now,
+	).Scan(&reserved)
+	return reserved, err
+}
+
+// storedFileAtKey returns the newest uploaded file at the key of a prepared upload, or ""
+// when there is none. Pending rows of uploads that never completed hold nothing to
+// conflict with.
+func storedFileAtKey(q sqlx.Queryer, upload *pendingUpload) (string, error) {
+	var fileID string
+	err := q.QueryRowx(
+		"SELECT id FROM files WHERE bucket_id = ? AND key = ? AND status = ? AND staged = 0 ORDER BY created_at DESC LIMIT 1",
+		upload.TokenData.BucketID, upload.Key, models.FileStatusUploaded,
+	).Scan(&fileID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return fileID, err
+}
+
+// claimUploadKey settles the key of a prepared upload inside the transaction that writes
+// its file row, following the request's on_conflict mode, and with reserve set reserves
+// the key until expiresAt. For new-version the upload takes over the stored file's id;
+// for overwrite it records the stored file to delete once the upload completes.
+// existingID names the stored file, if any. For rename the upload moves to the first free
+// key instead.
+func claimUploadKey(tx *sqlx.Tx, upload *pendingUpload, onConflict string, reserve bool, expiresAt, now time.Time) (outcome int, existingID string, err error) {
+	if onConflict == models.OnConflictRename {
+		outcome, err = claimRenamedKey(tx, upload, reserve, expiresAt, now)
+		return outcome, "", err
+	}
+
+	existingID, err = storedFileAtKey(tx, upload)
+	if err != nil {
+		return 0, "", err
+	}
+	if existingID != "" {
+		switch onConflict {
+		case models.OnConflictOverwrite:
+			upload.TokenData.Replaces = existingID
+		case models.OnConflictNewVersion:
+			upload.TokenData.FileID = existingID
+			upload.TokenData.NewVersion = true
+		default:
+			return keyExists, existingID, nil
+		}
+	}
+
+	if reserve {
+		reserved, err := reserveUploadKey(tx, upload, expiresAt, now)
+		if err != nil {
+			return 0, "", err
+		}
+		if !reserved {
+			return keyPending, existingID, nil
+		}
+	}
+	return keyClaimed, existingID, nil
+}
+
+// claimRenamedKey moves a prepared upload to the first key of the form "name (n).ext" that
+// holds no stored file and no reservation, trying the requested key first. With reserve set
+// the chosen key is reserved in the same transaction; otherwise the caller stores the file
+// before committing. Claims are serialized, so concurrent renames of one key always end up
+// on distinct keys.
+func claimRenamedKey(tx *sqlx.Tx, upload *pendingUpload, reserve bool, expiresAt, now time.Time) (int, error) {
+	original := upload.Key
+	for n := 1; n <= maxRenameAttempts; n++ {
+		candidate := original
+		if n > 1 {
+			candidate = renamedKey(original, n)
+		}
+		if len(candidate) > maxKeyLength {
+			break
+		}
+		upload.setKey(candidate)
+
+		existingID, err := storedFileAtKey(tx, upload)
+		if err != nil {
+			return 0, err
+		}
+		if existingID != "" {
+			continue
+		}
+		if !reserve {
+			reserved, err := keyReserved(tx, upload.TokenData.BucketID, candidate, now)
+			if err != nil {
+				return 0, err
+			}
+			if !reserved {
+				return keyClaimed, nil
+			}
+			continue
+		}
+		reserved, err := reserveUploadKey(tx, upload, expiresAt, now)
+		if err != nil {
+			return 0, err
+		}
+		if reserved {
+			return keyClaimed, nil
+		}
+	}
+	upload.setKey(original)
+	return keyExhausted, nil
+}
+
+// insertPendingUpload writes the file row for a signed URL upload and, unless the caller
+// allows parallel uploads, reserves its key in the same transaction so a refused request
+// never leaves a pending row behind. A new version writes no row: its file already has one.
+// Claims are serialized in-process to keep bursts for one key from contending on SQLite
+// writes. The outcome is keyClaimed when the upload may go ahead; an upload past its
+// owner's quota or its bucket's limits fails with a quotaError.
+func (h *FileHandler) insertPendingUpload(upload *pendingUpload, allowParallel bool, onConflict string, expiresAt, now time.Time) (outcome int, existingID string, err error) {
+	h.reserveMu.Lock()
+	defer h.reserveMu.Unlock()
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	if err := checkUploadQuotas(tx, upload, now); err != nil {
+		return 0, "", err
+	}
+	outcome, existingID, err = claimUploadKey(tx, upload, onConflict, !allowParallel, expiresAt, now)
+	if err != nil || outcome != keyClaimed {
+		return outcome, existingID, err
+	}
+	if !upload.TokenData.NewVersion {
+		if err := insertFileRecord(tx, upload, models.FileStatusPending, now); err != nil {
+			return 0, "", err
+		}
+	}
+	return keyClaimed, existingID, tx.Commit()
+}
+
+// storedContent describes the bytes an upload stored for a file
+type storedContent struct {
+	Size             int64
+	DetectedMimetype string
+	// Checksum is empty for uploads that are not checksummed
+	Checksum   string
+	ScanStatus sql.NullString
+	// EncKey is the customer key the bytes were encrypted with, nil when they are in the clear
+	EncKey *customerKey
+	// Image is the image dimensions read from the bytes, nil when there are none
+	Image *models.ImageDimensions
+	// ObjectID is the storage object the bytes share in a dedupe bucket
+	ObjectID sql.NullInt64
+	// DeclaredSize is the file_size a signed URL was issued for; SizeMismatch is set when
+	// Size differs from it beyond the tolerance. Other uploads leave both unset.
+	DeclaredSize sql.NullInt64
+	SizeMismatch bool
+	// Uploader is where the bytes came from, empty for authenticated uploads
+	Uploader uploaderInfo
+}
+
+// updateFileVersion makes the bytes of an on_conflict=new-version upload the content of its
+// existing file, which keeps its id
+func updateFileVersion(exec sqlx.Execer, data models.UploadTokenData, content storedContent, now time.Time) error {
+	keyHash, iv := content.EncKey.columns()
+	imageWidth, imageHeight, imageFormat := imageDimensionColumns(content.Image)
+	uploaderIP, uploaderUserAgent := content.Uploader.columns()
+	_, err := exec.Exec(
+		`UPDATE files SET file_name = ?, file_size = ?, size_mismatch = ?, declared_file_size = ?, mimetype = ?, detected_mimetype = ?, checksum = ?, metadata = ?,
+		scan_status = ?, scan_signature = NULL, scanned_at = NULL, encryption_key_hash = ?, encryption_iv = ?,
+		image_width = ?, image_height = ?, image_format = ?, storage_object_id = ?, uploader_ip = ?, uploader_user_agent = ?, updated_at = ?
+		WHERE id = ?`,
+		data.FileName, content.Size, content.SizeMismatch, content.DeclaredSize, data.Mimetype, content.DetectedMimetype, content.Checksum, encodeFileMetadata(data.Metadata),
+		content.ScanStatus, keyHash, iv, imageWidth, imageHeight, imageFormat, content.ObjectID, uploaderIP, uploaderUserAgent, now, data.FileID,
+	)
+	return err
+}
+
+// retireReplacedFile deletes the file an on_conflict=overwrite upload has just replaced.
+// Its bytes are already gone, so only the row is marked.
+func retireReplacedFile(exec sqlx.Execer, fileID string, now time.Time) error {
+	_, err := exec.Exec(
+		"UPDATE files SET status = ?, deleted_at = ?, updated_at = ? WHERE id = ? AND deleted_at IS NULL",
+		models.FileStatusDeleted, now, now, fileID,
+	)
+	return err
+}
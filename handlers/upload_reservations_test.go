@@ -0,0 +1,450 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"file-upload-service/models"
+)
+
+func TestGenerateSignedURLAllowsOnePendingUploadPerKey(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+
+	const requests = 100
+	responses := make([]*httptest.ResponseRecorder, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = env.serve(env.files.GenerateSignedURL,
+				newRequest(http.MethodPost, "/files/signed-url", signedURLRequest(bucketID, "docs/a.txt", 64)), nil)
+		}(i)
+	}
+	wg.Wait()
+
+	var created []models.SignedURLResponse
+	var conflicts []models.PendingUploadConflict
+	for _, w := range responses {
+		switch w.Code {
+		case http.StatusCreated:
+			var resp models.SignedURLResponse
+			decode(t, w, &resp)
+			created = append(created, resp)
+		case http.StatusConflict:
+			var conflict models.PendingUploadConflict
+			decode(t, w, &conflict)
+			conflicts = append(conflicts, conflict)
+		default:
+			t.Fatalf("unexpected status %d; body: %s", w.Code, w.Body.String())
+		}
+	}
+	if len(created) != 1 || len(conflicts) != requests-1 {
+		t.Fatalf("got %d created and %d conflicts, want 1 and %d", len(created), len(conflicts), requests-1)
+	}
+	for _, conflict := range conflicts {
+		if conflict.Code != http.StatusConflict || conflict.FileID != created[0].FileID || conflict.ExpiresAt.IsZero() {
+			t.Fatalf("conflict = %+v, want a 409 naming pending file %s", conflict, created[0].FileID)
+		}
+	}
+
+	var rows int
+	if err := env.db.Get(&rows, "SELECT COUNT(*) FROM files WHERE key = 'docs/a.txt'"); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Fatalf("%d file rows for the key, want only the pending one", rows)
+	}
+}
+
+func TestUploadReleasesKeyReservation(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	req := signedURLRequest(bucketID, "docs/a.txt", 64)
+
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+	expectStatus(t, w, http.StatusCreated)
+	var first models.SignedURLResponse
+	decode(t, w, &first)
+
+	w = env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+	expectStatus(t, w, http.StatusConflict)
+
+	w = serveAnonymous(env.files.UploadFile, uploadRequest(first.SignedURL, []byte("content")), nil)
+	expectStatus(t, w, http.StatusOK)
+
+	// The key now holds a stored file, so only a replacing upload can claim it
+	req.OnConflict = models.OnConflictOverwrite
+	w = env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+	expectStatus(t, w, http.StatusCreated)
+}
+
+func TestGenerateSignedURLAllowParallel(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	req := signedURLRequest(bucketID, "docs/a.txt", 64)
+	req.AllowParallel = true
+
+	for i := 0; i < 3; i++ {
+		w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+		expectStatus(t, w, http.StatusCreated)
+	}
+}
+
+func TestExpiredReservationIsReplaced(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	req := signedURLRequest(bucketID, "docs/a.txt", 64)
+
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+	expectStatus(t, w, http.StatusCreated)
+	env.db.MustExec("UPDATE upload_reservations SET expires_at = datetime('now', '-1 minute')")
+
+	w = env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+	expectStatus(t, w, http.StatusCreated)
+}
+
+// liveFiles returns the ids of the live files stored at a key
+func (e *testEnv) liveFiles(bucketID int, key string) []string {
+	e.t.Helper()
+	var ids []string
+	if err := e.db.Select(&ids, "SELECT id FROM files WHERE bucket_id = ? AND key = ? AND deleted_at IS NULL", bucketID, key); err != nil {
+		e.t.Fatal(err)
+	}
+	return ids
+}
+
+func TestGenerateSignedURLRejectsTakenKey(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	existing := env.putFile(bucketID, "docs/a.txt", []byte("stored"))
+
+	for _, mode := range []string{"", models.OnConflictReject, models.OnConflictError} {
+		req := signedURLRequest(bucketID, "docs/a.txt", 64)
+		req.OnConflict = mode
+		w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+		expectStatus(t, w, http.StatusConflict)
+
+		var conflict models.FileExistsConflict
+		decode(t, w, &conflict)
+		if conflict.FileID != existing {
+			t.Fatalf("on_conflict=%q: conflict names %q, want the stored file %s", mode, conflict.FileID, existing)
+		}
+	}
+	if ids := env.liveFiles(bucketID, "docs/a.txt"); len(ids) != 1 {
+		t.Fatalf("live files at the key = %v, want only the stored one", ids)
+	}
+}
+
+func TestGenerateSignedURLRejectsUnknownConflictMode(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	req := signedURLRequest(bucketID, "docs/a.txt", 64)
+	req.OnConflict = "replace"
+
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+	expectStatus(t, w, http.StatusBadRequest)
+}
+
+func TestGenerateSignedURLOverwrite(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	existing := env.putFile(bucketID, "docs/a.txt", []byte("old"))
+
+	req := signedURLRequest(bucketID, "docs/a.txt", 64)
+	req.OnConflict = models.OnConflictOverwrite
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+	expectStatus(t, w, http.StatusCreated)
+	var resp models.SignedURLResponse
+	decode(t, w, &resp)
+	if resp.FileID == existing {
+		t.Fatal("overwrite reused the stored file's id")
+	}
+
+	// The stored file stays live until the upload completes
+	if ids := env.liveFiles(bucketID, "docs/a.txt"); len(ids) != 2 {
+		t.Fatalf("live files before the upload = %v, want the stored and the pending file", ids)
+	}
+
+	w = serveAnonymous(env.files.UploadFile, uploadRequest(resp.SignedURL, []byte("new")), nil)
+	expectStatus(t, w, http.StatusOK)
+
+	if ids := env.liveFiles(bucketID, "docs/a.txt"); len(ids) != 1 || ids[0] != resp.FileID {
+		t.Fatalf("live files after the upload = %v, want only %s", ids, resp.FileID)
+	}
+	content, err := os.ReadFile(env.diskPath(bucketID, "docs/a.txt"))
+	if err != nil || string(content) != "new" {
+		t.Fatalf("stored content = %q, %v", content, err)
+	}
+}
+
+func TestGenerateSignedURLNewVersion(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	existing := env.putFile(bucketID, "docs/a.txt", []byte("old"))
+
+	req := signedURLRequest(bucketID, "docs/a.txt", 64)
+	req.FileName = "renamed.txt"
+	req.OnConflict = models.OnConflictNewVersion
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+	expectStatus(t, w, http.StatusCreated)
+	var resp models.SignedURLResponse
+	decode(t, w, &resp)
+	if resp.FileID != existing {
+		t.Fatalf("new version got file_id %s, want the stored file's %s", resp.FileID, existing)
+	}
+
+	// A second request for the key waits behind the pending new version
+	w = env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+	expectStatus(t, w, http.StatusConflict)
+
+	w = serveAnonymous(env.files.UploadFile, uploadRequest(resp.SignedURL, []byte("version two")), nil)
+	expectStatus(t, w, http.StatusOK)
+
+	if ids := env.liveFiles(bucketID, "docs/a.txt"); len(ids) != 1 || ids[0] != existing {
+		t.Fatalf("live files after the upload = %v, want only %s", ids, existing)
+	}
+	var fileName string
+	if err := env.db.Get(&fileName, "SELECT file_name FROM files WHERE id = ?", existing); err != nil {
+		t.Fatal(err)
+	}
+	if fileName != "renamed.txt" {
+		t.Fatalf("file_name = %q after the new version, want renamed.txt", fileName)
+	}
+	content, err := os.ReadFile(env.diskPath(bucketID, "docs/a.txt"))
+	if err != nil || string(content) != "version two" {
+		t.Fatalf("stored content = %q, %v", content, err)
+	}
+}
+
+func TestDirectUploadConflictModes(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	existing := env.putFile(bucketID, "docs/a.txt", []byte("old"))
+
+	upload := func(mode, content string) *httptest.ResponseRecorder {
+		return env.serve(env.files.DirectUpload, directUploadRequest(map[string]string{
+			"bucket_id":         strconv.Itoa(bucketID),
+			"key":               "docs/a.txt",
+			"mimetype":          "text/plain",
+			"owner_entity_type": "user",
+			"owner_entity_id":   "user-1",
+			"on_conflict":       mode,
+		}, []byte(content)), nil)
+	}
+
+	w := upload("", "rejected")
+	expectStatus(t, w, http.StatusConflict)
+
+	w = upload(models.OnConflictNewVersion, "second")
+	expectStatus(t, w, http.StatusCreated)
+	var resp struct {
+		FileID string `json:"file_id"`
+	}
+	decode(t, w, &resp)
+	if resp.FileID != existing {
+		t.Fatalf("new version got file_id %s, want %s", resp.FileID, existing)
+	}
+
+	w = upload(models.OnConflictOverwrite, "third")
+	expectStatus(t, w, http.StatusCreated)
+	decode(t, w, &resp)
+	if ids := env.liveFiles(bucketID, "docs/a.txt"); len(ids) != 1 || ids[0] != resp.FileID || resp.FileID == existing {
+		t.Fatalf("live files after the overwrite = %v, want only the new file %s", ids, resp.FileID)
+	}
+	content, err := os.ReadFile(env.diskPath(bucketID, "docs/a.txt"))
+	if err != nil || string(content) != "third" {
+		t.Fatalf("stored content = %q, %v", content, err)
+	}
+}
+
+func TestConcurrentDirectUploadsToOneKeyStoreOneFile(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+
+	const requests = 20
+	codes := make([]int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := env.serve(env.files.DirectUpload, directUploadRequest(map[string]string{
+				"bucket_id":         strconv.Itoa(bucketID),
+				"key":               "docs/race.txt",
+				"mimetype":          "text/plain",
+				"owner_entity_type": "user",
+				"owner_entity_id":   "user-1",
+			}, []byte("content")), nil)
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Fatalf("unexpected status %d", code)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d direct uploads stored a file at a free key, want exactly 1", created)
+	}
+	if ids := env.liveFiles(bucketID, "docs/race.txt"); len(ids) != 1 {
+		t.Fatalf("live files at the key = %v, want 1", ids)
+	}
+}
+
+func TestUploadGroupChecksEntryKeys(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.putFile(bucketID, "docs/a.txt", []byte("stored"))
+
+	req := models.CreateUploadGroupRequest{Entries: []models.CreateSignedURLRequest{signedURLRequest(bucketID, "docs/a.txt", 64)}}
+	w := env.serve(env.files.CreateUploadGroup, newRequest(http.MethodPost, "/files/upload-groups", req), nil)
+	expectStatus(t, w, http.StatusConflict)
+
+	req.Entries[0].OnConflict = models.OnConflictOverwrite
+	w = env.serve(env.files.CreateUploadGroup, newRequest(http.MethodPost, "/files/upload-groups", req), nil)
+	expectStatus(t, w, http.StatusBadRequest)
+}
+
+func TestRenamedKey(t *testing.T) {
+	for _, tc := range []struct {
+		key  string
+		n    int
+		want string
+	}{
+		{"photos/IMG_0001.jpg", 2, "photos/IMG_0001 (2).jpg"},
+		{"photos/archive.tar.gz", 3, "photos/archive.tar (3).gz"},
+		{"notes/todo", 2, "notes/todo (2)"},
+		{".env", 2, ".env (2)"},
+		{"a.b/c", 2, "a.b/c (2)"},
+	} {
+		if got := renamedKey(tc.key, tc.n); got != tc.want {
+			t.Errorf("renamedKey(%q, %d) = %q, want %q", tc.key, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestGenerateSignedURLRenamesSequentially(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.putFile(bucketID, "photos/IMG_0001.jpg", []byte("stored"))
+
+	req := signedURLRequest(bucketID, "photos/IMG_0001.jpg", 64)
+	req.OnConflict = models.OnConflictRename
+	for _, want := range []string{"photos/IMG_0001 (2).jpg", "photos/IMG_0001 (3).jpg"} {
+		w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+		expectStatus(t, w, http.StatusCreated)
+
+		var resp models.SignedURLResponse
+		decode(t, w, &resp)
+		if resp.Key != want {
+			t.Fatalf("renamed to %q, want %q", resp.Key, want)
+		}
+
+		w = serveAnonymous(env.files.UploadFile, uploadRequest(resp.SignedURL, []byte("content")), nil)
+		expectStatus(t, w, http.StatusOK)
+		if _, err := os.Stat(env.diskPath(bucketID, want)); err != nil {
+			t.Fatalf("upload not stored at the renamed key: %v", err)
+		}
+	}
+
+	// A free key is used as requested
+	req.Key = "photos/IMG_0002.jpg"
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+	expectStatus(t, w, http.StatusCreated)
+	var resp models.SignedURLResponse
+	decode(t, w, &resp)
+	if resp.Key != req.Key {
+		t.Fatalf("free key renamed to %q", resp.Key)
+	}
+}
+
+func TestConcurrentRenamesGetDistinctKeys(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.putFile(bucketID, "photos/burst.jpg", []byte("stored"))
+
+	const requests = 20
+	responses := make([]*httptest.ResponseRecorder, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := signedURLRequest(bucketID, "photos/burst.jpg", 64)
+			req.OnConflict = models.OnConflictRename
+			responses[i] = env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+		}(i)
+	}
+	wg.Wait()
+
+	keys := make(map[string]bool)
+	for _, w := range responses {
+		expectStatus(t, w, http.StatusCreated)
+		var resp models.SignedURLResponse
+		decode(t, w, &resp)
+		if resp.Key == "photos/burst.jpg" || keys[resp.Key] {
+			t.Fatalf("key %q handed out twice or over the stored file", resp.Key)
+		}
+		keys[resp.Key] = true
+	}
+	for n := 2; n <= requests+1; n++ {
+		if key := renamedKey("photos/burst.jpg", n); !keys[key] {
+			t.Fatalf("keys %v skip %q", keys, key)
+		}
+	}
+}
+
+func TestDirectUploadRenames(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.putFile(bucketID, "docs/a.txt", []byte("old"))
+
+	w := env.serve(env.files.DirectUpload, directUploadRequest(map[string]string{
+		"bucket_id":         strconv.Itoa(bucketID),
+		"key":               "docs/a.txt",
+		"mimetype":          "text/plain",
+		"owner_entity_type": "user",
+		"owner_entity_id":   "user-1",
+		"on_conflict":       models.OnConflictRename,
+	}, []byte("new")), nil)
+	expectStatus(t, w, http.StatusCreated)
+
+	var resp struct {
+		Key string `json:"key"`
+	}
+	decode(t, w, &resp)
+	if resp.Key != "docs/a (2).txt" {
+		t.Fatalf("stored at %q, want docs/a (2).txt", resp.Key)
+	}
+	content, err := os.ReadFile(env.diskPath(bucketID, "docs/a.txt"))
+	if err != nil || string(content) != "old" {
+		t.Fatalf("stored file changed to %q, %v", content, err)
+	}
+	if ids := env.liveFiles(bucketID, resp.Key); len(ids) != 1 {
+		t.Fatalf("live files at the renamed key = %v, want one", ids)
+	}
+}
+
+func TestRenameRejectsAllowParallel(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	req := signedURLRequest(bucketID, "docs/a.txt", 64)
+	req.OnConflict = models.OnConflictRename
+	req.AllowParallel = true
+
+	w := env.serve(env.files.GenerateSignedURL, newRequest(http.MethodPost, "/files/signed-url", req), nil)
+	expectStatus(t, w, http.StatusBadRequest)
+}
@@ -0,0 +1,443 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"file-upload-service/config"
+	"file-upload-service/models"
+
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// errImportAddressBlocked is returned when a URL import would connect to an internal address
+var errImportAddressBlocked = errors.New("address is not allowed")
+
+// errImportTooManyRedirects is returned when a URL import exceeds URL_IMPORT_MAX_REDIRECTS
+var errImportTooManyRedirects = errors.New("too many redirects")
+
+// errImportScheme is returned when a URL import is redirected away from http(s)
+var errImportScheme = errors.New("unsupported URL scheme")
+
+// blockedImportNetworks are the ranges a URL import may not connect to unless
+// URL_IMPORT_ALLOW_PRIVATE is set: loopback, private, link-local (cloud metadata
+// endpoints live there), carrier-grade NAT, multicast and reserved space
+var blockedImportNetworks = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+// parseCIDRs parses a fixed list of networks, panicking on a typo
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// importAddressAllowed reports whether a URL import may connect to ip
+func importAddressAllowed(ip net.IP) bool {
+	for _, network := range blockedImportNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newGuardedDialer returns the dialer for requests to caller-supplied URLs. Unless
+// allowPrivate is set, the address check runs on every connection after DNS resolution,
+// so neither redirects nor a hostname that resolves (or re-resolves) to an internal
+// address can get past it.
+func newGuardedDialer(allowPrivate bool) *net.Dialer {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !importAddressAllowed(ip) {
+				return errImportAddressBlocked
+			}
+			return nil
+		}
+	}
+	return dialer
+}
+
+// newURLImportClient builds the HTTP client URL imports fetch with. Proxies from the
+// environment are ignored since the address check would only see the proxy's address.
+func newURLImportClient(cfg *config.Config) *http.Client {
+	dialer := newGuardedDialer(cfg.URLImportAllowPrivate)
+
+	return &http.Client{
+		Timeout: cfg.URLImportTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.URLImportMaxRedirects {
+				return errImportTooManyRedirects
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errImportScheme
+			}
+			return nil
+		},
+	}
+}
+
+// parseImportSourceURL checks that source_url is an absolute http(s) URL
+func parseImportSourceURL(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, errors.New("source_url is required")
+	}
+	sourceURL, err := url.Parse(raw)
+	if err != nil || (sourceURL.Scheme != "http" && sourceURL.Scheme != "https") || sourceURL.Host == "" {
+		return nil, errors.New("source_url must be an absolute http or https URL")
+	}
+	return sourceURL, nil
+}
+
+// fetchErrorResponse maps a failed fetch to the status and error body to respond with
+func fetchErrorResponse(err error) (int, *errs.AppError) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errImportAddressBlocked):
+		return http.StatusBadRequest, errs.NewValidationError("source_url resolves to an address that is not allowed (loopback, private or link-local)")
+	case errors.Is(err, errImportTooManyRedirects):
+		return http.StatusBadGateway, &errs.AppError{Code: http.StatusBadGateway, Message: "Source redirected too many times"}
+	case errors.Is(err, errImportScheme):
+		return http.StatusBadGateway, &errs.AppError{Code: http.StatusBadGateway, Message: "Source redirected to a URL that is not http or https"}
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, &errs.AppError{Code: http.StatusGatewayTimeout, Message: "Timed out fetching source_url"}
+	}
+	return http.StatusBadGateway, &errs.AppError{Code: http.StatusBadGateway, Message: "Failed to fetch source_url"}
+}
+
+// ImportFromURL handles POST /files/import-url - create a file from bytes the server fetches
+// from a URL. The bytes are streamed into the normal storage path and the files row is
+// written exactly as a completed signed URL upload would be.
+func (h *FileHandler) ImportFromURL(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if h.rejectCustomerKey(ctx, w, r) {
+		return
+	}
+
+	var req models.ImportURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	sourceURL, err := parseImportSourceURL(req.SourceURL)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid source_url", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	// The upload request is completed from the response; check what is known before fetching
+	upload := models.CreateSignedURLRequest{
+		BucketID:        req.BucketID,
+		Key:             req.Key,
+		FileName:        req.FileName,
+		FileSize:        1,
+		Mimetype:        req.Mimetype,
+		OwnerEntityType: req.OwnerEntityType,
+		OwnerEntityID:   req.OwnerEntityID,
+		Metadata:        req.Metadata,
+		OnConflict:      req.OnConflict,
+	}
+	precheck := upload
+	precheck.FileName, precheck.Mimetype = "import", "application/octet-stream"
+	if err := validateCreateSignedURLRequest(precheck); err != nil {
+		h.logRequest(ctx, "error", "Invalid import request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Fetching URL import",
+		zap.String("client_id", clientID),
+		zap.Int("bucket_id", req.BucketID),
+		zap.String("source_host", sourceURL.Host),
+	)
+
+	fetchReq, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceURL.String(), nil)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to build import request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("source_url must be an absolute http or https URL"))
+		return
+	}
+	resp, err := h.importClient.Do(fetchReq)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to fetch URL import", zap.String("source_host", sourceURL.Host), zap.Error(err))
+		status, appErr := fetchErrorResponse(err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		h.logRequest(ctx, "error", "URL import source did not respond with 200",
+			zap.String("source_host", sourceURL.Host),
+			zap.Int("source_status", resp.StatusCode),
+		)
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(errs.AppError{
+			Code:    http.StatusBadGateway,
+			Message: fmt.Sprintf("Source responded with HTTP %d", resp.StatusCode),
+		})
+		return
+	}
+
+	maxSize := h.config.URLImportMaxBytes
+	tooLarge := func() {
+		h.logRequest(ctx, "error", "URL import exceeds size limit", zap.Int64("max_size", maxSize))
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(errs.AppError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("Source file exceeds the import limit of %d bytes", maxSize),
+		})
+	}
+	if resp.ContentLength > maxSize {
+		tooLarge()
+		return
+	}
+
+	detected, body, err := sniffContentType(resp.Body)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to read URL import body", zap.Error(err))
+		status, appErr := fetchErrorResponse(err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+
+	// Fill in what the caller left out from the response
+	finalURL := resp.Request.URL
+	if upload.FileName == "" {
+		upload.FileName = path.Base(finalURL.Path)
+		if upload.FileName == "/" || upload.FileName == "." {
+			upload.FileName = path.Base(req.Key)
+		}
+	}
+	if upload.Mimetype == "" {
+		upload.Mimetype = normalizeMimetype(resp.Header.Get("Content-Type"))
+		if upload.Mimetype == "" || upload.Mimetype == "application/octet-stream" {
+			upload.Mimetype = detected
+		}
+	}
+	if resp.ContentLength > 0 {
+		upload.FileSize = resp.ContentLength
+	}
+
+	prepared, status, appErr := h.prepareUpload(ctx, clientID, upload)
+	if appErr != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+	prepared.DetectedMimetype = detected
+	if !prepared.TokenData.AllowMimetypeMismatch && !mimetypesMatch(upload.Mimetype, detected) {
+		h.logRequest(ctx, "error", "Imported content does not match declared mimetype",
+			zap.String("declared", upload.Mimetype),
+			zap.String("detected", detected),
+		)
+		writeMimetypeMismatch(w, upload.Mimetype, detected)
+		return
+	}
+
+	// Stream the body next to its final path; it is moved into place once the key is claimed
+	head := &headCapture{}
+	buf := h.buffers.get()
+	tmpPath, written, err := stageFile(filepath.Join(uploadsRoot, prepared.TokenData.FilePath), io.TeeReader(body, head), maxSize, buf)
+	h.buffers.put(buf)
+	if err == errFileTooLarge {
+		tooLarge()
+		return
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to stream URL import", zap.Error(err))
+		status, appErr := fetchErrorResponse(err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(appErr)
+		return
+	}
+	if written == 0 {
+		os.Remove(tmpPath)
+		h.logRequest(ctx, "error", "URL import source returned an empty body", zap.String("source_host", sourceURL.Host))
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(errs.AppError{Code: http.StatusBadGateway, Message: "Source returned an empty file"})
+		return
+	}
+	prepared.TokenData.FileSize = written
+	prepared.Image = h.imageDimensions(ctx, prepared.TokenData.FileID, detected, head.buf)
+
+	outcome, existingID, err := h.storeImportedFile(prepared, req.OnConflict, tmpPath)
+	if err != nil {
+		if quotaErr, ok := asQuotaError(err); ok {
+			h.writeQuotaExceeded(ctx, w, quotaErr, "")
+			return
+		}
+		h.logRequest(ctx, "error", "Failed to store URL import", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to save file"))
+		return
+	}
+	switch outcome {
+	case keyExists:
+		h.writeFileExistsConflict(ctx, w, existingID, prepared.Key)
+		return
+	case keyExhausted:
+		h.logRequest(ctx, "error", "No free key left to rename to", zap.String("key", prepared.Key))
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errs.AppError{Code: http.StatusConflict, Message: keyConflictMessage(outcome)})
+		return
+	}
+	tokenData := prepared.TokenData
+	filePath := filepath.Join(uploadsRoot, tokenData.FilePath)
+
+	scanStatus, signature := h.scanAfterUpload(ctx, tokenData.FileID, written, nil)
+	if scanStatus == models.ScanStatusInfected {
+		h.logRequest(ctx, "info", "Imported file quarantined", zap.String("file_id", tokenData.FileID), zap.String("signature", signature))
+		writeQuarantined(w, signature)
+		return
+	}
+
+	h.logRequest(ctx, "info", "File imported successfully",
+		zap.String("file_id", tokenData.FileID),
+		zap.String("client_id", clientID),
+		zap.Int("bucket_id", tokenData.BucketID),
+		zap.Int64("bytes_written", written),
+	)
+
+	response := map[string]interface{}{
+		"message":    "File imported successfully",
+		"file_id":    tokenData.FileID,
+		"file_name":  tokenData.FileName,
+		"file_size":  written,
+		"mimetype":   tokenData.Mimetype,
+		"bucket_id":  tokenData.BucketID,
+		"key":        prepared.Key,
+		"saved_path": filePath,
+	}
+	if len(tokenData.Metadata) > 0 {
+		response["metadata"] = tokenData.Metadata
+	}
+	if scanStatus != "" {
+		response["scan_status"] = scanStatus
+	}
+	if prepared.Image != nil {
+		response["image"] = prepared.Image
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// storeImportedFile claims the key of a URL import, moves its staged bytes into place and
+// records the file in one serialized transaction, so the on_conflict check sees every
+// earlier upload. Direct uploads are stored through it too. A rename only changes the last
+// segment of the key, so the staged file is already in the right directory. The staged
+// file is removed unless the outcome is keyClaimed. An upload past its owner's quota or its
+// bucket's limits fails with a quotaError.
+func (h *FileHandler) storeImportedFile(upload *pendingUpload, onConflict, tmpPath string) (outcome int, existingID string, err error) {
+	h.reserveMu.Lock()
+	defer h.reserveMu.Unlock()
+
+	tx, err := h.db.Beginx()
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	if err := checkUploadQuotas(tx, upload, now); err != nil {
+		os.Remove(tmpPath)
+		return 0, "", err
+	}
+	outcome, existingID, err = claimUploadKey(tx, upload, onConflict, false, now, now)
+	if err != nil || outcome != keyClaimed {
+		os.Remove(tmpPath)
+		return outcome, existingID, err
+	}
+
+	filePath := filepath.Join(uploadsRoot, upload.TokenData.FilePath)
+	version, err := preserveVersionAtKey(tx, upload.TokenData.BucketID, upload.Key, filePath, now)
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, "", err
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		version.discard()
+		return 0, "", err
+	}
+	if upload.TokenData.NewVersion {
+		err = updateFileVersion(tx, upload.TokenData, storedContent{
+			Size:             upload.TokenData.FileSize,
+			DetectedMimetype: upload.DetectedMimetype,
+			ScanStatus:       h.pendingScanStatus(),
+			Image:            upload.Image,
+			Uploader:         upload.Uploader,
+		}, now)
+	} else {
+		upload.ScanStatus = h.pendingScanStatus()
+		err = insertFileRecord(tx, upload, models.FileStatusUploaded, now)
+		if err == nil && upload.TokenData.Replaces != "" {
+			err = retireReplacedFile(tx, upload.TokenData.Replaces, now)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		// In a versioning bucket the bytes this upload replaced are still kept aside.
+		// Otherwise bytes that replaced a stored file cannot be taken back; only a new key
+		// is cleaned up.
+		if !version.putBack(filePath) && existingID == "" {
+			os.Remove(filePath)
+		}
+		return 0, "", err
+	}
+	return keyClaimed, existingID, nil
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"file-upload-service/models"
+)
+
+// publicImportHost is the name tests give the import source standing in for a public server
+const publicImportHost = "files.example.com"
+
+// importSource serves the bodies of URL imports on loopback and routes publicImportHost
+// to it; every other address still goes through the guarded dialer
+func (e *testEnv) importSource(handler http.Handler) *httptest.Server {
+	srv := httptest.NewServer(handler)
+	e.t.Cleanup(srv.Close)
+	guarded := newGuardedDialer(false)
+	e.files.importClient.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if address == publicImportHost+":80" {
+				return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+			}
+			return guarded.DialContext(ctx, network, address)
+		},
+	}
+	return srv
+}
+
+// importURL imports sourceURL into a bucket at docs/imported.txt
+func (e *testEnv) importURL(bucketID int, sourceURL string) *httptest.ResponseRecorder {
+	return e.serve(e.files.ImportFromURL, newRequest(http.MethodPost, "/files/import-url", models.ImportURLRequest{
+		BucketID:        bucketID,
+		Key:             "docs/imported.txt",
+		SourceURL:       sourceURL,
+		Mimetype:        "text/plain",
+		OwnerEntityType: "user",
+		OwnerEntityID:   "u1",
+	}), nil)
+}
+
+func TestImportAddressAllowed(t *testing.T) {
+	cases := []struct {
+		address string
+		allowed bool
+	}{
+		{"127.0.0.1", false},
+		{"127.8.9.10", false},
+		{"::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:192.168.1.1", false},
+		{"224.0.0.1", false},
+		{"93.184.216.34", true},
+		{"::ffff:93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+	}
+	for _, c := range cases {
+		if got := importAddressAllowed(net.ParseIP(c.address)); got != c.allowed {
+			t.Errorf("importAddressAllowed(%s) = %v, want %v", c.address, got, c.allowed)
+		}
+	}
+}
+
+func TestGuardedDialerChecksTheResolvedAddress(t *testing.T) {
+	control := newGuardedDialer(false).Control
+	for _, address := range []string{"127.0.0.1:80", "[::1]:443", "169.254.169.254:80", "[::ffff:127.0.0.1]:80", "[fe80::1%eth0]:80"} {
+		if err := control("tcp", address, nil); err != errImportAddressBlocked {
+			t.Errorf("dial to %s: %v, want errImportAddressBlocked", address, err)
+		}
+	}
+	if err := control("tcp", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("dial to a public address: %v", err)
+	}
+	if newGuardedDialer(true).Control != nil {
+		t.Error("URL_IMPORT_ALLOW_PRIVATE still checks addresses")
+	}
+}
+
+func TestImportRefusesInternalSources(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	var fetched int
+	srv := env.importSource(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+			return
+		}
+		fetched++
+		w.Write([]byte("internal secret"))
+	}))
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	loopback := srv.URL + "/secret"
+
+	cases := []struct {
+		name      string
+		sourceURL string
+	}{
+		{"loopback", loopback},
+		{"IPv6 loopback", strings.Replace(loopback, "127.0.0.1", "[::1]", 1)},
+		{"IPv6-mapped loopback", strings.Replace(loopback, "127.0.0.1", "[::ffff:127.0.0.1]", 1)},
+		{"hostname resolving to loopback", strings.Replace(loopback, "127.0.0.1", "localhost", 1)},
+		{"link-local metadata address", "http://169.254.169.254/latest/meta-data/"},
+		{"private address", "http://10.0.0.1/secret"},
+		{"redirect to loopback", "http://" + publicImportHost + "/redirect?to=" + loopback},
+		{"redirect to a hostname resolving to loopback", "http://" + publicImportHost + "/redirect?to=http://localhost:" + strconv.Itoa(port) + "/secret"},
+		{"redirect to link-local", "http://" + publicImportHost + "/redirect?to=http://169.254.169.254/latest/meta-data/"},
+		{"redirect to a private address", "http://" + publicImportHost + "/redirect?to=http://192.168.1.1/"},
+	}
+	for _, c := range cases {
+		w := env.importURL(bucketID, c.sourceURL)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "address that is not allowed") {
+			t.Errorf("%s: %d %s, want 400 address not allowed", c.name, w.Code, w.Body.String())
+		}
+	}
+	if fetched != 0 {
+		t.Fatalf("the internal source was fetched %d times", fetched)
+	}
+	if n := env.storedFiles(bucketID); n != 0 {
+		t.Fatalf("%d files stored from internal sources", n)
+	}
+}
+
+func TestImportCapsTheSourceSize(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.URLImportMaxBytes = 16
+	bucketID := env.createBucket("photos")
+	env.importSource(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := bytes.Repeat([]byte("a"), 16)
+		if r.URL.Path != "/fits.txt" {
+			body = append(body, 'a')
+		}
+		if r.URL.Path == "/streamed.txt" {
+			// Without a Content-Length the cap applies while the body streams in
+			w.Write(body[:8])
+			w.(http.Flusher).Flush()
+			w.Write(body[8:])
+			return
+		}
+		w.Write(body)
+	}))
+
+	for _, name := range []string{"declared.txt", "streamed.txt"} {
+		w := env.importURL(bucketID, "http://"+publicImportHost+"/"+name)
+		expectRefused(t, w, http.StatusRequestEntityTooLarge, "Source file exceeds the import limit of 16 bytes")
+	}
+	if n := env.storedFiles(bucketID); n != 0 {
+		t.Fatalf("%d files stored from oversized sources", n)
+	}
+
+	w := env.importURL(bucketID, "http://"+publicImportHost+"/fits.txt")
+	expectStatus(t, w, http.StatusCreated)
+}
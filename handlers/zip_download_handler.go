@@ -0,0 +1,512 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"file-upload-service/models"
+
+	"github.com/umakantv/go-utils/errs"
+	"github.com/umakantv/go-utils/httpserver"
+	"go.uber.org/zap"
+)
+
+// zipMissingEntryName is the trailer entry listing the files a zip download left out
+const zipMissingEntryName = "_missing.txt"
+
+// zipCandidate is a file matched by a zip download request
+type zipCandidate struct {
+	FileID     string
+	Key        string
+	FileSize   int64
+	ScanStatus string
+	Encrypted  bool
+	// FilePath is the resolved storage path relative to ./uploads/
+	FilePath string
+}
+
+// validateZipDownloadURLRequest checks the fields of a zip download request that need no
+// database lookup
+func validateZipDownloadURLRequest(req models.ZipDownloadURLRequest, maxFiles int) error {
+	switch {
+	case len(req.FileIDs) > 0 && (req.BucketID != 0 || req.Prefix != ""):
+		return errors.New("Give either bucket_id and prefix, or file_ids, not both")
+	case len(req.FileIDs) == 0 && req.BucketID <= 0:
+		return errors.New("bucket_id, or file_ids, is required")
+	case len(req.FileIDs) > maxFiles:
+		return fmt.Errorf("file_ids may list at most %d files", maxFiles)
+	}
+	for _, fileID := range req.FileIDs {
+		if fileID == "" {
+			return errors.New("file_ids must not contain empty IDs")
+		}
+	}
+	if req.ArchiveName != "" {
+		if err := validateDownloadFilename(req.ArchiveName); err != nil {
+			return errors.New(strings.Replace(err.Error(), "download_filename", "archive_name", 1))
+		}
+	}
+	return nil
+}
+
+// GenerateZipDownloadURL handles POST /files/zip-download-url - one signed URL downloading
+// every file beneath a prefix of a bucket, or a list of files, as a zip archive. The files
+// are resolved and checked against the size limits now; the URL then streams them.
+func (h *FileHandler) GenerateZipDownloadURL(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var req models.ZipDownloadURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logRequest(ctx, "error", "Invalid request body", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Invalid JSON"))
+		return
+	}
+	if err := validateZipDownloadURLRequest(req, h.config.ZipDownloadMaxFiles); err != nil {
+		h.logRequest(ctx, "error", "Invalid zip download request", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	ttl, err := h.signedURLTTL(req.ExpiresInSeconds)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid signed URL lifetime", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(err.Error()))
+		return
+	}
+
+	// Get client ID from Basic auth context
+	auth := httpserver.GetRequestAuth(ctx)
+	if auth == nil {
+		h.logRequest(ctx, "error", "Client ID not found in auth context")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Authentication required"))
+		return
+	}
+	clientID := auth.Client
+
+	h.logRequest(ctx, "info", "Generating zip download URL",
+		zap.String("client_id", clientID),
+		zap.Int("bucket_id", req.BucketID),
+		zap.String("prefix", req.Prefix),
+		zap.Int("file_ids", len(req.FileIDs)),
+	)
+
+	var candidates []zipCandidate
+	var names []string
+	archiveName := req.ArchiveName
+	if len(req.FileIDs) > 0 {
+		var status int
+		var appErr *errs.AppError
+		candidates, names, status, appErr = h.zipCandidatesByID(ctx, clientID, req.FileIDs)
+		if appErr != nil {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(appErr)
+			return
+		}
+		if archiveName == "" {
+			archiveName = "download.zip"
+		}
+	} else {
+		var bucketName string
+		var status int
+		var appErr *errs.AppError
+		candidates, names, bucketName, status, appErr = h.zipCandidatesByPrefix(ctx, clientID, req.BucketID, req.Prefix)
+		if appErr != nil {
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(appErr)
+			return
+		}
+		if archiveName == "" {
+			archiveName = bucketName + ".zip"
+			if prefix := strings.Trim(req.Prefix, "/"); prefix != "" {
+				archiveName = path.Base(prefix) + ".zip"
+			}
+		}
+	}
+
+	// Encrypted files need their customer key and unscanned ones are held back, so both
+	// are left out of the archive and reported instead
+	tokenData := models.ZipDownloadTokenData{ClientID: clientID, ArchiveName: archiveName}
+	var skipped []models.ZipDownloadSkipped
+	for i, candidate := range candidates {
+		switch {
+		case candidate.Encrypted:
+			skipped = append(skipped, models.ZipDownloadSkipped{FileID: candidate.FileID, Key: candidate.Key, Reason: models.ZipSkipEncrypted})
+		case candidate.ScanStatus == models.ScanStatusPending:
+			skipped = append(skipped, models.ZipDownloadSkipped{FileID: candidate.FileID, Key: candidate.Key, Reason: models.ZipSkipAwaitingScan})
+		default:
+			tokenData.Entries = append(tokenData.Entries, models.ZipDownloadEntry{
+				FileID:   candidate.FileID,
+				Name:     names[i],
+				FilePath: candidate.FilePath,
+			})
+			tokenData.TotalBytes += candidate.FileSize
+		}
+	}
+	if len(tokenData.Entries) == 0 {
+		h.logRequest(ctx, "info", "No files to download", zap.Int("skipped", len(skipped)))
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errs.NewNotFoundError("No downloadable files found"))
+		return
+	}
+	if tokenData.TotalBytes > h.config.ZipDownloadMaxBytes {
+		h.logRequest(ctx, "info", "Zip download too large",
+			zap.Int64("total_bytes", tokenData.TotalBytes),
+			zap.Int64("max_bytes", h.config.ZipDownloadMaxBytes),
+		)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError(fmt.Sprintf(
+			"files total %d bytes, more than the %d a zip download may hold", tokenData.TotalBytes, h.config.ZipDownloadMaxBytes,
+		)))
+		return
+	}
+
+	token := generateDownloadToken()
+	expiresAt := time.Now().UTC().Add(ttl)
+	tokenData.ExpiresAt = expiresAt
+	if err := h.cache.Set("zip-download:"+token, tokenData, ttl); err != nil {
+		h.logRequest(ctx, "error", "Failed to store zip download manifest in cache", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to generate download URL"))
+		return
+	}
+
+	signedURL, err := h.signedURL(clientID, models.ShortTokenKindZipDownload, token, ttl)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to build zip download URL", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to generate download URL"))
+		return
+	}
+
+	h.logRequest(ctx, "info", "Zip download URL generated successfully",
+		zap.String("client_id", clientID),
+		zap.Int("files", len(tokenData.Entries)),
+		zap.Int("skipped", len(skipped)),
+		zap.Int64("total_bytes", tokenData.TotalBytes),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.ZipDownloadURLResponse{
+		SignedURL:  signedURL,
+		ExpiresAt:  expiresAt,
+		FileCount:  len(tokenData.Entries),
+		TotalBytes: tokenData.TotalBytes,
+		Skipped:    skipped,
+	})
+}
+
+// zipCandidatesByPrefix resolves the uploaded files beneath prefix in a bucket of the
+// client, each named in the archive by its key relative to the prefix. More files than
+// ZIP_DOWNLOAD_MAX_FILES are refused rather than cut short.
+func (h *FileHandler) zipCandidatesByPrefix(ctx context.Context, clientID string, bucketID int, rawPrefix string) ([]zipCandidate, []string, string, int, *errs.AppError) {
+	var bucket models.Bucket
+	var clientName string
+	err := h.db.QueryRow(
+		`SELECT b.id, b.client_id, b.name, b.lowercase_keys, b.archived, COALESCE(b.archive_mode, ''), c.name
+		 FROM buckets b JOIN clients c ON c.client_id = b.client_id WHERE b.id = ?`,
+		bucketID,
+	).Scan(&bucket.ID, &bucket.ClientID, &bucket.Name, &bucket.LowercaseKeys, &bucket.Archived, &bucket.ArchiveMode, &clientName)
+	if err == sql.ErrNoRows {
+		h.logRequest(ctx, "info", "Bucket not found", zap.Int("bucket_id", bucketID))
+		return nil, nil, "", http.StatusNotFound, errs.NewNotFoundError("Bucket not found")
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query bucket", zap.Int("bucket_id", bucketID), zap.Error(err))
+		return nil, nil, "", http.StatusInternalServerError, errs.NewInternalServerError("Failed to generate download URL")
+	}
+	if bucket.ClientID != clientID {
+		h.logRequest(ctx, "error", "Client does not own this bucket",
+			zap.Int("bucket_id", bucketID),
+			zap.String("requesting_client", clientID),
+		)
+		return nil, nil, "", http.StatusForbidden, errs.NewAuthorizationError("Access denied")
+	}
+	if readsFrozen(bucket.Archived, bucket.ArchiveMode) {
+		h.logRequest(ctx, "info", "Bucket is archived", zap.Int("bucket_id", bucketID))
+		return nil, nil, "", http.StatusConflict, errs.NewValidationError("Cannot download from an archived bucket")
+	}
+
+	// The prefix is canonicalized like a key; an empty one covers the whole bucket
+	prefix := strings.Trim(rawPrefix, "/")
+	if prefix != "" {
+		if prefix, err = sanitizeKey(prefix, bucket.LowercaseKeys); err != nil {
+			h.logRequest(ctx, "error", "Invalid prefix", zap.String("prefix", rawPrefix), zap.Error(err))
+			return nil, nil, "", http.StatusBadRequest, errs.NewValidationError(err.Error())
+		}
+	}
+
+	query := `SELECT id, key, file_size, COALESCE(scan_status, ''), encryption_key_hash IS NOT NULL
+		FROM files WHERE bucket_id = ? AND status = ? AND deleted_at IS NULL AND staged = 0`
+	args := []interface{}{bucketID, models.FileStatusUploaded}
+	if prefix != "" {
+		condition, conditionArgs := keyPrefixCondition("key", prefix)
+		query += " AND " + condition
+		args = append(args, conditionArgs...)
+	}
+	query += " ORDER BY key LIMIT ?"
+	args = append(args, h.config.ZipDownloadMaxFiles+1)
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query files under prefix", zap.Error(err))
+		return nil, nil, "", http.StatusInternalServerError, errs.NewInternalServerError("Failed to generate download URL")
+	}
+	defer rows.Close()
+
+	var candidates []zipCandidate
+	var names []string
+	for rows.Next() {
+		var candidate zipCandidate
+		if err := rows.Scan(&candidate.FileID, &candidate.Key, &candidate.FileSize, &candidate.ScanStatus, &candidate.Encrypted); err != nil {
+			h.logRequest(ctx, "error", "Failed to scan file", zap.Error(err))
+			return nil, nil, "", http.StatusInternalServerError, errs.NewInternalServerError("Failed to generate download URL")
+		}
+		candidate.FilePath = filepath.Join(clientName, bucket.Name, candidate.Key)
+		candidates = append(candidates, candidate)
+		names = append(names, strings.TrimPrefix(candidate.Key, prefix+"/"))
+	}
+	if err := rows.Err(); err != nil {
+		h.logRequest(ctx, "error", "Failed to read files under prefix", zap.Error(err))
+		return nil, nil, "", http.StatusInternalServerError, errs.NewInternalServerError("Failed to generate download URL")
+	}
+	if len(candidates) > h.config.ZipDownloadMaxFiles {
+		h.logRequest(ctx, "info", "Too many files under prefix", zap.String("prefix", prefix))
+		return nil, nil, "", http.StatusBadRequest, errs.NewValidationError(fmt.Sprintf(
+			"more than %d files match, the most a zip download may hold", h.config.ZipDownloadMaxFiles,
+		))
+	}
+	return candidates, names, bucket.Name, 0, nil
+}
+
+// zipCandidatesByID resolves a list of the client's files. Entries are named by key, or
+// by <bucket_name>/<key> when the files come from more than one bucket.
+func (h *FileHandler) zipCandidatesByID(ctx context.Context, clientID string, fileIDs []string) ([]zipCandidate, []string, int, *errs.AppError) {
+	var candidates []zipCandidate
+	var bucketNames []string
+	buckets := map[string]bool{}
+	seen := map[string]bool{}
+	for _, fileID := range fileIDs {
+		if seen[fileID] {
+			continue
+		}
+		seen[fileID] = true
+
+		var candidate zipCandidate
+		var ownerClientID, status, clientName, bucketName, archiveMode string
+		var deletedAt sql.NullTime
+		var archived bool
+		err := h.db.QueryRow(
+			`SELECT f.id, f.key, f.file_size, COALESCE(f.scan_status, ''), f.encryption_key_hash IS NOT NULL,
+				f.client_id, f.status, f.deleted_at, c.name, b.name, b.archived, COALESCE(b.archive_mode, '')
+			 FROM files f
+			 JOIN clients c ON f.client_id = c.client_id
+			 JOIN buckets b ON f.bucket_id = b.id
+			 WHERE f.id = ? AND f.staged = 0`,
+			fileID,
+		).Scan(&candidate.FileID, &candidate.Key, &candidate.FileSize, &candidate.ScanStatus, &candidate.Encrypted,
+			&ownerClientID, &status, &deletedAt, &clientName, &bucketName, &archived, &archiveMode)
+		if err != nil && err != sql.ErrNoRows {
+			h.logRequest(ctx, "error", "Failed to query file", zap.String("file_id", fileID), zap.Error(err))
+			return nil, nil, http.StatusInternalServerError, errs.NewInternalServerError("Failed to generate download URL")
+		}
+		if err == sql.ErrNoRows || deletedAt.Valid || status != models.FileStatusUploaded {
+			h.logRequest(ctx, "info", "File not found", zap.String("file_id", fileID))
+			return nil, nil, http.StatusNotFound, errs.NewNotFoundError(fmt.Sprintf("File %s not found", fileID))
+		}
+		if ownerClientID != clientID {
+			h.logRequest(ctx, "error", "Client does not own this file",
+				zap.String("file_id", fileID),
+				zap.String("requesting_client", clientID),
+				zap.String("owner_client", ownerClientID),
+			)
+			return nil, nil, http.StatusForbidden, errs.NewAuthorizationError("Access denied")
+		}
+		if readsFrozen(archived, archiveMode) {
+			h.logRequest(ctx, "info", "Bucket is archived", zap.String("file_id", fileID))
+			return nil, nil, http.StatusConflict, errs.NewValidationError("Cannot download from an archived bucket")
+		}
+
+		candidate.FilePath = filepath.Join(clientName, bucketName, candidate.Key)
+		candidates = append(candidates, candidate)
+		bucketNames = append(bucketNames, bucketName)
+		buckets[bucketName] = true
+	}
+
+	names := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		names[i] = candidate.Key
+		if len(buckets) > 1 {
+			names[i] = bucketNames[i] + "/" + candidate.Key
+		}
+	}
+	return candidates, names, 0, nil
+}
+
+// ZipDownload handles GET and HEAD /files/zip-download - stream the files of a zip download URL as
+// one archive built on the fly (no auth header required). Files deleted, archived away,
+// replaced with content that cannot be served, or missing on disk since the URL was issued
+// are left out and listed in a trailing _missing.txt entry.
+func (h *FileHandler) ZipDownload(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		h.logRequest(ctx, "error", "Missing download token")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errs.NewValidationError("Missing download token"))
+		return
+	}
+
+	cachedData, err := h.cache.Get("zip-download:" + token)
+	if err != nil {
+		h.logRequest(ctx, "error", "Invalid or expired zip download token", zap.Error(err))
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errs.NewAuthenticationError("Invalid or expired download token"))
+		return
+	}
+
+	// Same re-marshal as DownloadFile: the cache hands back a generic map
+	var tokenData models.ZipDownloadTokenData
+	intermediate, err := json.Marshal(cachedData)
+	if err == nil {
+		err = json.Unmarshal(intermediate, &tokenData)
+	}
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to parse zip download manifest", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errs.NewInternalServerError("Failed to parse token data"))
+		return
+	}
+
+	if r.Method != http.MethodHead {
+		if err := touchClientDownload(h.db, tokenData.ClientID, time.Now().UTC()); err != nil {
+			h.logRequest(ctx, "error", "Failed to record client activity", zap.String("client_id", tokenData.ClientID), zap.Error(err))
+		}
+	}
+
+	h.logRequest(ctx, "info", "Serving zip download",
+		zap.String("client_id", tokenData.ClientID),
+		zap.String("archive_name", tokenData.ArchiveName),
+		zap.Int("files", len(tokenData.Entries)),
+	)
+
+	// The archive's length is not known until it is written, so it is sent chunked
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition(models.DispositionAttachment, tokenData.ArchiveName))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	zw := zip.NewWriter(w)
+	var missing []string
+	taken := map[string]bool{}
+	for _, entry := range tokenData.Entries {
+		taken[entry.Name] = true
+		reason, err := h.writeZipEntry(ctx, w, zw, entry)
+		if err != nil {
+			// The archive is already partly sent; cutting it short is all that is left
+			h.logRequest(ctx, "error", "Failed to stream zip entry", zap.String("file_id", entry.FileID), zap.Error(err))
+			return
+		}
+		if reason != "" {
+			h.logRequest(ctx, "info", "Zip entry left out", zap.String("file_id", entry.FileID), zap.String("reason", reason))
+			missing = append(missing, entry.Name+"\t"+reason)
+		}
+	}
+
+	if len(missing) > 0 {
+		name := zipMissingEntryName
+		for i := 1; taken[name]; i++ {
+			name = fmt.Sprintf("_missing-%d.txt", i)
+		}
+		trailer, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+		if err == nil {
+			_, err = trailer.Write([]byte(strings.Join(missing, "\n") + "\n"))
+		}
+		if err != nil {
+			h.logRequest(ctx, "error", "Failed to write zip trailer", zap.Error(err))
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		h.logRequest(ctx, "error", "Failed to finish zip archive", zap.Error(err))
+	}
+}
+
+// writeZipEntry adds one file of a zip download to the archive. A file that can no longer
+// be served is not written and the reason returned; err is only set when the archive
+// itself could not be written to w, which ends the download.
+func (h *FileHandler) writeZipEntry(ctx context.Context, w http.ResponseWriter, zw *zip.Writer, entry models.ZipDownloadEntry) (reason string, err error) {
+	if err := checkTokenTarget(h.db, entry.FileID, models.ShortTokenKindDownload, entry.FilePath, false); err != nil {
+		switch {
+		case errors.Is(err, errTargetFileDeleted):
+			return "deleted", nil
+		case errors.Is(err, errTargetBucketArchived):
+			return "bucket archived", nil
+		case errors.Is(err, errTargetBucketRenamed):
+			return "bucket renamed", nil
+		}
+		h.logRequest(ctx, "error", "Failed to check zip entry", zap.String("file_id", entry.FileID), zap.Error(err))
+		return "unavailable", nil
+	}
+	pending, err := awaitingScan(h.db, entry.FileID)
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query scan status", zap.String("file_id", entry.FileID), zap.Error(err))
+		return "unavailable", nil
+	}
+	if pending {
+		return "awaiting scan", nil
+	}
+	keyHash, _, err := fileEncryption(h.db, entry.FileID, "")
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to query file encryption", zap.String("file_id", entry.FileID), zap.Error(err))
+		return "unavailable", nil
+	}
+	if keyHash != "" {
+		return "encrypted", nil
+	}
+
+	// Register as a reader so a concurrent deletion cannot remove the file mid-entry
+	filePath := filepath.Join("./uploads", entry.FilePath)
+	readCtx, release, ok := h.locks.acquireDownload(ctx, filePath, w)
+	if !ok {
+		return "deleted", nil
+	}
+	defer release()
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		h.logRequest(ctx, "error", "File missing on disk", zap.String("file_id", entry.FileID), zap.Error(err))
+		return "missing on disk", nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		h.logRequest(ctx, "error", "Failed to stat file", zap.String("file_id", entry.FileID), zap.Error(err))
+		return "missing on disk", nil
+	}
+
+	dst, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     entry.Name,
+		Method:   zip.Deflate,
+		Modified: info.ModTime(),
+	})
+	if err != nil {
+		return "", err
+	}
+	_, err = copyWithContext(readCtx, dst, f)
+	return "", err
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"file-upload-service/models"
+)
+
+func TestHeadZipDownloadSendsNoArchive(t *testing.T) {
+	env := newTestEnv(t)
+	bucketID := env.createBucket("photos")
+	env.putFile(bucketID, "docs/a.txt", []byte("first"))
+	env.putFile(bucketID, "docs/b.txt", []byte("second"))
+
+	w := env.serve(env.files.GenerateZipDownloadURL, newRequest(http.MethodPost, "/files/zip-download-url",
+		models.ZipDownloadURLRequest{BucketID: bucketID, Prefix: "docs/"}), nil)
+	expectStatus(t, w, http.StatusCreated)
+	var signed models.ZipDownloadURLResponse
+	decode(t, w, &signed)
+	target := signed.SignedURL[strings.Index(signed.SignedURL, "/files/"):]
+
+	w = serveAnonymous(env.files.ZipDownload, newRequest(http.MethodHead, target, nil), nil)
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Content-Type"); got != "application/zip" {
+		t.Fatalf("HEAD Content-Type = %q, want application/zip", got)
+	}
+	if w.Body.Len() != 0 {
+		t.Fatalf("HEAD sent %d body bytes", w.Body.Len())
+	}
+
+	w = serveAnonymous(env.files.ZipDownload, newRequest(http.MethodGet, target, nil), nil)
+	expectStatus(t, w, http.StatusOK)
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archive.File) != 2 {
+		t.Fatalf("archive holds %d entries, want 2", len(archive.File))
+	}
+}
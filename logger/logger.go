@@ -0,0 +1,48 @@
+package logger
+
+import (
+	goutilslogger "github.com/umakantv/go-utils/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// LoggerConfig configures the service's logger, like the go-utils one it replaces
+type LoggerConfig = goutilslogger.LoggerConfig
+
+var log *zap.Logger
+
+// Init builds the service's logger, whose core redacts every line before it is written
+// (see redactingCore). The go-utils logger is initialized too, as the go-utils packages
+// log through it; they only log route names and URL paths.
+func Init(loggerConfig LoggerConfig) {
+	goutilslogger.Init(loggerConfig)
+
+	eConfig := zap.NewProductionEncoderConfig()
+	eConfig.CallerKey = loggerConfig.CallerKey
+	eConfig.TimeKey = loggerConfig.TimeKey
+	eConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	config := zap.NewProductionConfig()
+	config.EncoderConfig = eConfig
+
+	var err error
+	log, err = config.Build(
+		zap.AddCallerSkip(loggerConfig.CallerSkip),
+		zap.WrapCore(func(core zapcore.Core) zapcore.Core { return redactingCore{core} }),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func Info(message string, fields ...zap.Field) {
+	log.Info(message, fields...)
+}
+
+func Debug(message string, fields ...zap.Field) {
+	log.Debug(message, fields...)
+}
+
+func Error(message string, fields ...zap.Field) {
+	log.Error(message, fields...)
+}
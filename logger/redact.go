@@ -0,0 +1,105 @@
+package logger
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// uploadsRoot is the directory the service stores files under
+const uploadsRoot = "./uploads"
+
+// sensitiveFields are field names whose values are masked before logging
+var sensitiveFields = map[string]bool{
+	"token":         true,
+	"client_secret": true,
+	"secret":        true,
+	"signature":     true,
+	"authorization": true,
+	"password":      true,
+}
+
+// storagePathFields are field names carrying on-disk paths, logged relative to the uploads root
+var storagePathFields = map[string]bool{
+	"full_path":  true,
+	"disk_path":  true,
+	"saved_path": true,
+}
+
+// uploadsPathPattern matches a relative reference to the uploads root at the start of a
+// path, e.g. "uploads/acme/..." or "./uploads/acme/..." inside an error message
+var uploadsPathPattern = regexp.MustCompile(`(^|[\s"'(])(?:\./)?uploads/`)
+
+// absUploadsRoot is the absolute uploads root, stripped from logged paths as well
+var absUploadsRoot, _ = filepath.Abs(uploadsRoot)
+
+// sensitiveField reports whether the value of a field is masked
+func sensitiveField(key string) bool {
+	return sensitiveFields[strings.ToLower(key)]
+}
+
+// maskSecret keeps a short prefix of a secret so log lines can still be correlated
+func maskSecret(value string) string {
+	if len(value) <= 8 {
+		return "****"
+	}
+	return value[:4] + "****"
+}
+
+// relativeToUploads rewrites storage paths in a log value relative to the uploads root
+func relativeToUploads(value string) string {
+	if absUploadsRoot != "" {
+		value = strings.ReplaceAll(value, absUploadsRoot+string(filepath.Separator), "")
+	}
+	return uploadsPathPattern.ReplaceAllString(value, "$1")
+}
+
+// redactFields masks sensitive fields and shortens storage paths before they reach the log
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, field := range fields {
+		switch {
+		case sensitiveField(field.Key):
+			if field.Type == zapcore.StringType {
+				redacted[i] = zap.String(field.Key, maskSecret(field.String))
+			} else {
+				redacted[i] = zap.String(field.Key, "****")
+			}
+		case storagePathFields[field.Key] && field.Type == zapcore.StringType:
+			redacted[i] = zap.String(field.Key, relativeToUploads(field.String))
+		case field.Type == zapcore.ErrorType:
+			if err, ok := field.Interface.(error); ok && err != nil {
+				redacted[i] = zap.String(field.Key, relativeToUploads(err.Error()))
+			} else {
+				redacted[i] = field
+			}
+		default:
+			redacted[i] = field
+		}
+	}
+	return redacted
+}
+
+// redactingCore passes every field through redactFields on its way to the wrapped core,
+// so no log call can skip the redaction
+type redactingCore struct {
+	zapcore.Core
+}
+
+func (c redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return redactingCore{c.Core.With(redactFields(fields))}
+}
+
+func (c redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(entry, redactFields(fields))
+}
@@ -0,0 +1,167 @@
+package logger
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// observedLogger returns a logger wrapped in redactingCore and the entries it writes
+func observedLogger() (*zap.Logger, *observer.ObservedLogs) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	return zap.New(redactingCore{core}), logs
+}
+
+func TestRedactingCoreMasksSensitiveFields(t *testing.T) {
+	log, logs := observedLogger()
+
+	log.Info("issued",
+		zap.String("token", "abcdef0123456789"),
+		zap.String("Client_Secret", "s3cr3t-value-long"),
+		zap.String("signature", "short"),
+		zap.Int("password", 123456),
+		zap.String("file_name", "report.pdf"),
+	)
+
+	fields := logs.All()[0].ContextMap()
+	expected := map[string]interface{}{
+		"token":         "abcd****",
+		"Client_Secret": "s3cr****",
+		"signature":     "****",
+		"password":      "****",
+		"file_name":     "report.pdf",
+	}
+	for key, want := range expected {
+		if fields[key] != want {
+			t.Errorf("%s logged as %v, want %v", key, fields[key], want)
+		}
+	}
+}
+
+func TestRedactingCoreMasksFieldsAddedWithWith(t *testing.T) {
+	log, logs := observedLogger()
+
+	log.With(zap.String("authorization", "Bearer abcdefghijkl")).Info("request")
+
+	if got := logs.All()[0].ContextMap()["authorization"]; got != "Bear****" {
+		t.Errorf("authorization logged as %v", got)
+	}
+}
+
+func TestRedactingCoreShortensStoragePaths(t *testing.T) {
+	log, logs := observedLogger()
+
+	abs := filepath.Join(absUploadsRoot, "acme", "photos", "a.png")
+	log.Error("write failed",
+		zap.String("full_path", "./uploads/acme/photos/a.png"),
+		zap.String("disk_path", abs),
+		zap.Error(errors.New("open uploads/acme/photos/a.png: permission denied")),
+	)
+
+	fields := logs.All()[0].ContextMap()
+	if fields["full_path"] != "acme/photos/a.png" {
+		t.Errorf("full_path logged as %v", fields["full_path"])
+	}
+	if fields["disk_path"] != "acme/photos/a.png" {
+		t.Errorf("disk_path logged as %v", fields["disk_path"])
+	}
+	if fields["error"] != "open acme/photos/a.png: permission denied" {
+		t.Errorf("error logged as %v", fields["error"])
+	}
+}
+
+// deniedFieldWords are words that mark a logged field as holding a credential
+var deniedFieldWords = []string{"token", "secret", "signature", "authorization", "password"}
+
+// safeFieldNames contain a denied word but do not hold a credential
+var safeFieldNames = map[string]bool{}
+
+// lintLoggedFields returns the zap field names in a file that look like credentials but
+// are not masked by redactingCore
+func lintLoggedFields(fset *token.FileSet, file *ast.File) []string {
+	var violations []string
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) == 0 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "zap" {
+			return true
+		}
+		lit, ok := call.Args[0].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return true
+		}
+		key, err := strconv.Unquote(lit.Value)
+		if err != nil || sensitiveField(key) || safeFieldNames[key] {
+			return true
+		}
+		for _, word := range deniedFieldWords {
+			if strings.Contains(strings.ToLower(key), word) {
+				violations = append(violations, fset.Position(lit.Pos()).String()+": "+key)
+				break
+			}
+		}
+		return true
+	})
+	return violations
+}
+
+func TestLoggedFieldNamesAreMasked(t *testing.T) {
+	fset := token.NewFileSet()
+	err := filepath.WalkDir("..", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && (d.Name() == "uploads" || strings.HasPrefix(d.Name(), ".")) && path != ".." {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		for _, violation := range lintLoggedFields(fset, file) {
+			t.Errorf("credential-like field logged unmasked: %s", violation)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoggedFieldLintCatchesUnmaskedField(t *testing.T) {
+	src := `package handlers
+
+func issue(t string) {
+	logger.Info("issued", zap.String("Token", t), zap.String("api_token", t))
+}
+`
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "violation.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	violations := lintLoggedFields(fset, file)
+	if len(violations) != 1 || !strings.HasSuffix(violations[0], ": api_token") {
+		t.Fatalf("expected only api_token to be flagged, got %v", violations)
+	}
+}
@@ -14,6 +14,7 @@ func main() {
 	commandFlag := flag.String("command", "start", "Command to run modules")
 	nameFlag := flag.String("name", "", "Migration name (alphanum+underscore only)")
 	dirFlag := flag.String("dir", ".", "Target directory for the new .sql file (e.g. ./migrations)")
+	devFlag := flag.Bool("dev", false, "Seed an empty database with a demo client, bucket and files (also DEV_MODE=true)")
 	flag.Parse()
 
 	if *commandFlag == "" {
@@ -23,7 +24,7 @@ func main() {
 
 	switch *commandFlag {
 	case "start":
-		server.StartServer()
+		server.StartServer(*devFlag)
 	case "create-migration":
 		migrations.CreateMigration(nameFlag, dirFlag)
 	}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Archive expansion job statuses
+const (
+	ExpansionStatusRunning   = "running"
+	ExpansionStatusCompleted = "completed"
+	ExpansionStatusFailed    = "failed"
+)
+
+// ExpandArchiveRequest represents a request to extract a stored zip file into the bucket it
+// is stored in, one file per entry, under Prefix
+type ExpandArchiveRequest struct {
+	Prefix string `json:"prefix"`
+	// OnConflict decides what happens when a file is already stored at an entry's key;
+	// entries that hit an existing key under "error" are skipped
+	OnConflict string `json:"on_conflict,omitempty"`
+}
+
+// ExpandedEntry is an archive entry stored as a new file
+type ExpandedEntry struct {
+	Name       string `json:"name"`
+	Key        string `json:"key"`
+	FileID     string `json:"file_id"`
+	FileSize   int64  `json:"file_size"`
+	Mimetype   string `json:"mimetype"`
+	ScanStatus string `json:"scan_status,omitempty"`
+}
+
+// ExpandEntryOutcome is an archive entry that was not stored, and why
+type ExpandEntryOutcome struct {
+	Name   string `json:"name"`
+	Key    string `json:"key,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// ExpandArchiveSummary reports what became of each file entry of an archive. Skipped
+// entries were left out by choice (symlinks, keys already taken); errors are entries that
+// were refused (unsafe names, size limits, keys or content the bucket does not accept).
+type ExpandArchiveSummary struct {
+	Created []ExpandedEntry      `json:"created"`
+	Skipped []ExpandEntryOutcome `json:"skipped"`
+	Errors  []ExpandEntryOutcome `json:"errors"`
+}
+
+// ArchiveExpansion is a background expansion of a large archive
+type ArchiveExpansion struct {
+	ID           string         `db:"id"`
+	Status       string         `db:"status"`
+	FileID       string         `db:"file_id"`
+	ClientID     string         `db:"client_id"`
+	BucketID     int            `db:"bucket_id"`
+	Prefix       string         `db:"prefix"`
+	OnConflict   string         `db:"on_conflict"`
+	EntriesTotal int            `db:"entries_total"`
+	EntriesDone  int            `db:"entries_done"`
+	Summary      string         `db:"summary"`
+	Error        sql.NullString `db:"error"`
+	StartedAt    time.Time      `db:"started_at"`
+	FinishedAt   sql.NullTime   `db:"finished_at"`
+}
+
+// ArchiveExpansionResponse represents a background expansion and its progress
+type ArchiveExpansionResponse struct {
+	ID           string               `json:"id"`
+	Status       string               `json:"status"`
+	FileID       string               `json:"file_id"`
+	BucketID     int                  `json:"bucket_id"`
+	Prefix       string               `json:"prefix"`
+	EntriesTotal int                  `json:"entries_total"`
+	EntriesDone  int                  `json:"entries_done"`
+	Summary      ExpandArchiveSummary `json:"summary"`
+	Error        string               `json:"error,omitempty"`
+	StartedAt    time.Time            `json:"started_at"`
+	FinishedAt   *time.Time           `json:"finished_at,omitempty"`
+}
@@ -0,0 +1,26 @@
+package models
+
+// Audit event actions
+const (
+	AuditActionMimetypeCorrected = "file.mimetype_corrected"
+	AuditActionFilePurged        = "file.purged"
+	AuditActionFileQuarantined   = "file.quarantined"
+	AuditActionQuarantineRelease = "file.quarantine_released"
+	AuditActionQuarantineDelete  = "file.quarantine_deleted"
+	AuditActionClientInactive    = "client.inactive_flagged"
+	AuditActionClientArchived    = "client.inactive_archived"
+	AuditActionClientExempted    = "client.inactivity_exempted"
+	AuditActionClientUnexempted  = "client.inactivity_unexempted"
+	AuditActionSignedURLRevoked  = "signed_url.revoked"
+	AuditActionBucketDeleted     = "bucket.deleted"
+)
+
+// AuditEvent is an entry of the append-only audit log
+type AuditEvent struct {
+	Action   string
+	Actor    string
+	ClientID string
+	FileID   string
+	// Detail is encoded as a JSON object
+	Detail map[string]interface{}
+}
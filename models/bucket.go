@@ -11,32 +11,164 @@ type CORSRule struct {
 	AllowedMethods []string `json:"AllowedMethods"`
 	AllowedOrigins []string `json:"AllowedOrigins"`
 	ExposeHeaders  []string `json:"ExposeHeaders"`
+	// MaxAgeSeconds is how long browsers may cache a preflight answer; 0 means 600
+	MaxAgeSeconds int `json:"MaxAgeSeconds,omitempty"`
 }
 
 // CORSPolicy is a list of CORS rules
 type CORSPolicy []CORSRule
 
+// HotlinkProtection limits which sites may embed a bucket's public files
+type HotlinkProtection struct {
+	// AllowedReferers are origins such as "https://example.com" or "https://*.example.com"
+	// whose pages may fetch the files, matched against Origin or the origin of Referer
+	AllowedReferers []string `json:"allowed_referers"`
+	// AllowEmptyReferer admits requests sending neither header, such as direct visits
+	AllowEmptyReferer bool `json:"allow_empty_referer"`
+	// PlaceholderKey names a file of the bucket served in place of refused ones; refused
+	// requests answer 403 without it
+	PlaceholderKey string `json:"placeholder_key,omitempty"`
+}
+
+// Bucket archive modes
+const (
+	// ArchiveModeFreezeWrites stops uploads, deletions and updates; files stay listable,
+	// downloadable and publicly served
+	ArchiveModeFreezeWrites = "freeze-writes"
+	// ArchiveModeFreezeAll also stops listing, downloads and public serving
+	ArchiveModeFreezeAll = "freeze-all"
+)
+
 // Bucket represents a storage bucket
 type Bucket struct {
-	ID          int             `json:"id" db:"id"`
-	Name        string          `json:"name" db:"name"`
-	ClientID    string          `json:"client_id" db:"client_id"`
-	CORSPolicy  json.RawMessage `json:"cors_policy" db:"cors_policy"`
-	PublicPaths json.RawMessage `json:"public_paths" db:"public_paths"`
-	Archived    bool            `json:"archived" db:"archived"`
-	CreatedAt   time.Time       `json:"created_at" db:"created_at"`
-	UpdatedAt   time.Time       `json:"updated_at" db:"updated_at"`
+	ID            int             `json:"id" db:"id"`
+	Name          string          `json:"name" db:"name"`
+	ClientID      string          `json:"client_id" db:"client_id"`
+	CORSPolicy    json.RawMessage `json:"cors_policy" db:"cors_policy"`
+	PublicPaths   json.RawMessage `json:"public_paths" db:"public_paths"`
+	Archived      bool            `json:"archived" db:"archived"`
+	ArchiveMode   string          `json:"archive_mode,omitempty" db:"archive_mode"`
+	LowercaseKeys bool            `json:"lowercase_keys" db:"lowercase_keys"`
+	// AllowMimetypeMismatch accepts uploads whose content does not match the declared mimetype
+	AllowMimetypeMismatch bool            `json:"allow_mimetype_mismatch" db:"allow_mimetype_mismatch"`
+	StrictFileSize        bool            `json:"strict_file_size" db:"strict_file_size"`
+	AllowedMimetypes      json.RawMessage `json:"allowed_mimetypes" db:"allowed_mimetypes"`
+	Versioning            bool            `json:"versioning" db:"versioning"`
+	Dedupe                bool            `json:"dedupe" db:"dedupe"`
+	MaxKeyDepth           int             `json:"max_key_depth" db:"max_key_depth"`
+	MaxTopLevelFolders    int             `json:"max_top_level_folders" db:"max_top_level_folders"`
+	ThumbnailWidths       json.RawMessage `json:"thumbnail_widths" db:"thumbnail_widths"`
+	ImageSizes            json.RawMessage `json:"image_sizes" db:"image_sizes"`
+	ConvertImages         bool            `json:"convert_images" db:"convert_images"`
+	Compression           bool            `json:"compression" db:"compression"`
+	CompressionMinBytes   int64           `json:"compression_min_bytes" db:"compression_min_bytes"`
+	HotlinkProtection     json.RawMessage `json:"hotlink_protection" db:"hotlink_protection"`
+	PublicRateLimit       int             `json:"public_rate_limit" db:"public_rate_limit"`
+	MaxTotalBytes         int64           `json:"max_total_bytes" db:"max_total_bytes"`
+	MaxFileCount          int             `json:"max_file_count" db:"max_file_count"`
+	ResponseHeaders       json.RawMessage `json:"response_headers" db:"response_headers"`
+	CreatedAt             time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt             time.Time       `json:"updated_at" db:"updated_at"`
 }
 
 // CreateBucketRequest represents the request to create a bucket
 type CreateBucketRequest struct {
-	Name        string          `json:"name"`
-	CORSPolicy  json.RawMessage `json:"cors_policy"`
-	PublicPaths json.RawMessage `json:"public_paths"`
+	Name                  string          `json:"name"`
+	CORSPolicy            json.RawMessage `json:"cors_policy"`
+	PublicPaths           json.RawMessage `json:"public_paths"`
+	LowercaseKeys         bool            `json:"lowercase_keys"`
+	AllowMimetypeMismatch bool            `json:"allow_mimetype_mismatch"`
+	StrictFileSize        bool            `json:"strict_file_size"`
+	AllowedMimetypes      json.RawMessage `json:"allowed_mimetypes"`
+	Versioning            bool            `json:"versioning"`
+	Dedupe                bool            `json:"dedupe"`
+	// MaxKeyDepth defaults to 20 segments; MaxTopLevelFolders to 0, no limit
+	MaxKeyDepth        *int `json:"max_key_depth"`
+	MaxTopLevelFolders *int `json:"max_top_level_folders"`
+	// ThumbnailWidths defaults to [], no thumbnails
+	ThumbnailWidths json.RawMessage `json:"thumbnail_widths"`
+	// ImageSizes defaults to [], no resizing on the public route
+	ImageSizes json.RawMessage `json:"image_sizes"`
+	// ConvertImages lets the public route serve images as WebP or AVIF to browsers
+	// accepting them
+	ConvertImages bool `json:"convert_images"`
+	// Compression lets the public route compress text assets for clients accepting gzip or
+	// br, once they are CompressionMinBytes (default 1024) or larger
+	Compression         bool   `json:"compression"`
+	CompressionMinBytes *int64 `json:"compression_min_bytes"`
+	// HotlinkProtection limits which sites may embed the bucket's public files; null or
+	// omitted lets any site embed them
+	HotlinkProtection json.RawMessage `json:"hotlink_protection"`
+	// PublicRateLimit is how many public file requests a minute one address may make to
+	// the bucket, below the server-wide limit; 0 leaves only that one
+	PublicRateLimit int `json:"public_rate_limit"`
+	// MaxTotalBytes and MaxFileCount cap what the bucket may hold, counting uploads still
+	// reserved by signed URLs; 0 leaves the bucket without that limit
+	MaxTotalBytes int64 `json:"max_total_bytes"`
+	MaxFileCount  int   `json:"max_file_count"`
+	// ResponseHeaders are sent with every public response of the bucket; null or omitted
+	// sends none
+	ResponseHeaders json.RawMessage `json:"response_headers"`
+}
+
+// ArchiveBucketRequest represents the optional body of a request to archive a bucket
+type ArchiveBucketRequest struct {
+	// Mode is freeze-writes or freeze-all; freeze-all when omitted
+	Mode string `json:"mode"`
+}
+
+// RenameBucketRequest represents the request to rename a bucket
+type RenameBucketRequest struct {
+	Name string `json:"name"`
+}
+
+// DeleteBucketResponse summarizes what deleting a bucket removed
+type DeleteBucketResponse struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// FilesDeleted counts the uploaded and quarantined files deleted with the bucket
+	FilesDeleted    int `json:"files_deleted"`
+	VersionsDeleted int `json:"versions_deleted"`
 }
 
 // UpdateBucketRequest represents the request to update a bucket
 type UpdateBucketRequest struct {
-	CORSPolicy  json.RawMessage `json:"cors_policy"`
-	PublicPaths json.RawMessage `json:"public_paths"`
+	CORSPolicy            json.RawMessage `json:"cors_policy"`
+	PublicPaths           json.RawMessage `json:"public_paths"`
+	LowercaseKeys         *bool           `json:"lowercase_keys"`
+	AllowMimetypeMismatch *bool           `json:"allow_mimetype_mismatch"`
+	StrictFileSize        *bool           `json:"strict_file_size"`
+	AllowedMimetypes      json.RawMessage `json:"allowed_mimetypes"`
+	Versioning            *bool           `json:"versioning"`
+	Dedupe                *bool           `json:"dedupe"`
+	MaxKeyDepth           *int            `json:"max_key_depth"`
+	MaxTopLevelFolders    *int            `json:"max_top_level_folders"`
+	ThumbnailWidths       json.RawMessage `json:"thumbnail_widths"`
+	ImageSizes            json.RawMessage `json:"image_sizes"`
+	ConvertImages         *bool           `json:"convert_images"`
+	Compression           *bool           `json:"compression"`
+	CompressionMinBytes   *int64          `json:"compression_min_bytes"`
+	HotlinkProtection     json.RawMessage `json:"hotlink_protection"`
+	PublicRateLimit       *int            `json:"public_rate_limit"`
+	MaxTotalBytes         *int64          `json:"max_total_bytes"`
+	MaxFileCount          *int            `json:"max_file_count"`
+	ResponseHeaders       json.RawMessage `json:"response_headers"`
+	// CreatedAt is only decoded to reject it: created_at cannot be changed
+	CreatedAt json.RawMessage `json:"created_at"`
+}
+
+// BucketQuotaExceededError is the error returned when an upload would take a bucket past
+// its max_total_bytes or max_file_count. The limit left at 0 is not enforced.
+type BucketQuotaExceededError struct {
+	Code           int    `json:"Code"`
+	Message        string `json:"Message"`
+	BucketID       int    `json:"bucket_id"`
+	UsedBytes      int64  `json:"used_bytes"`
+	ReservedBytes  int64  `json:"reserved_bytes"`
+	SnapshotBytes  int64  `json:"snapshot_bytes"`
+	RequestedBytes int64  `json:"requested_bytes"`
+	MaxTotalBytes  int64  `json:"max_total_bytes"`
+	FileCount      int    `json:"file_count"`
+	ReservedFiles  int    `json:"reserved_files"`
+	MaxFileCount   int    `json:"max_file_count"`
 }
@@ -4,24 +4,45 @@ import "time"
 
 // Client represents an IAM-like client for authentication
 type Client struct {
-	ID           int       `json:"id" db:"id"`
-	Name         string    `json:"name" db:"name"`
-	ClientID     string    `json:"client_id" db:"client_id"`
-	ClientSecret string    `json:"client_secret,omitempty" db:"client_secret"`
-	CreatedAt    time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+	ID           int    `json:"id" db:"id"`
+	Name         string `json:"name" db:"name"`
+	ClientID     string `json:"client_id" db:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty" db:"client_secret"`
+	ShortURLs    bool   `json:"short_urls" db:"short_urls"`
+	// LastUsedAt and LastDownloadAt track activity to within an hour for the inactivity policy
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	LastDownloadAt *time.Time `json:"last_download_at,omitempty" db:"last_download_at"`
+	// InactivityDays overrides INACTIVITY_DAYS for the client
+	InactivityDays *int      `json:"inactivity_days,omitempty" db:"inactivity_days"`
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at" db:"updated_at"`
 }
 
 // CreateClientRequest represents the request to create a client
 type CreateClientRequest struct {
 	Name string `json:"name"`
+	// ShortURLs issues this client's signed URLs as short /<SHORT_URL_PATH>/<token> links
+	ShortURLs bool `json:"short_urls"`
+}
+
+// UpdateClientRequest represents the request to change a client's settings; omitted
+// fields are left as they are
+type UpdateClientRequest struct {
+	ShortURLs *bool `json:"short_urls"`
+	// InactivityDays overrides INACTIVITY_DAYS for the client; 0 goes back to the global value
+	InactivityDays *int `json:"inactivity_days"`
 }
 
 // ClientResponse represents the client response (without secret)
 type ClientResponse struct {
-	ID        int       `json:"id"`
-	Name      string    `json:"name"`
-	ClientID  string    `json:"client_id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-}
\ No newline at end of file
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	ClientID  string `json:"client_id"`
+	ShortURLs bool   `json:"short_urls"`
+	// LastUsedAt and LastDownloadAt are kept to within an hour
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+	LastDownloadAt *time.Time `json:"last_download_at,omitempty"`
+	InactivityDays *int       `json:"inactivity_days,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// Events reported to INACTIVITY_WEBHOOK_URL
+const (
+	InactivityEventFlagged  = "client.inactive"
+	InactivityEventArchived = "client.archived"
+)
+
+// InactiveClient is a client the inactivity policy flagged, or one exempt from it
+type InactiveClient struct {
+	ClientID       string     `json:"client_id"`
+	Name           string     `json:"name"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+	LastDownloadAt *time.Time `json:"last_download_at,omitempty"`
+	// InactivityDays is the limit that applies to the client: its override or INACTIVITY_DAYS
+	InactivityDays int        `json:"inactivity_days"`
+	Exempt         bool       `json:"exempt"`
+	FlaggedAt      *time.Time `json:"flagged_at,omitempty"`
+	// ArchiveAfter is when the client's buckets are archived unless it is active again first
+	ArchiveAfter *time.Time `json:"archive_after,omitempty"`
+	ArchivedAt   *time.Time `json:"archived_at,omitempty"`
+}
+
+// InactiveClientListResponse is the response to the inactive client report
+type InactiveClientListResponse struct {
+	Clients    []InactiveClient `json:"clients"`
+	Truncated  bool             `json:"truncated"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// InactivityWebhookPayload is POSTed to INACTIVITY_WEBHOOK_URL when a client is flagged
+// and again when its buckets are archived
+type InactivityWebhookPayload struct {
+	Event        string     `json:"event"`
+	ClientID     string     `json:"client_id"`
+	ClientName   string     `json:"client_name"`
+	LastActiveAt time.Time  `json:"last_active_at"`
+	ArchiveAfter *time.Time `json:"archive_after,omitempty"`
+	BucketIDs    []int      `json:"bucket_ids,omitempty"`
+	OccurredAt   time.Time  `json:"occurred_at"`
+}
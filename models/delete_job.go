@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// Delete job statuses
+const (
+	DeleteJobStatusQueued    = "queued"
+	DeleteJobStatusRunning   = "running"
+	DeleteJobStatusCompleted = "completed"
+	DeleteJobStatusFailed    = "failed"
+)
+
+// DeleteJob is a delete-by-path request that matched more files than one synchronous
+// request may process, so it is carried out in the background
+type DeleteJob struct {
+	ID       string `json:"id" db:"id"`
+	ClientID string `json:"-" db:"client_id"`
+	BucketID int    `json:"bucket_id" db:"bucket_id"`
+	Path     string `json:"path" db:"path"`
+	Status   string `json:"status" db:"status"`
+	// Matched is how many files were under the path when the job was queued
+	Matched    int        `json:"matched" db:"matched"`
+	Deleted    int        `json:"deleted" db:"deleted"`
+	Missing    int        `json:"missing" db:"missing"`
+	Failed     int        `json:"failed" db:"failed"`
+	Error      string     `json:"error,omitempty" db:"error"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at" db:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty" db:"finished_at"`
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"file-upload-service/api"
+)
+
+// DownloadRedemption is one download through a signed URL
+type DownloadRedemption struct {
+	ID             string         `db:"id"`
+	TokenHash      string         `db:"token_hash"`
+	FileID         string         `db:"file_id"`
+	VersionID      sql.NullString `db:"version_id"`
+	ClientID       string         `db:"client_id"`
+	RemoteIP       string         `db:"remote_ip"`
+	UserAgent      string         `db:"user_agent"`
+	Country        sql.NullString `db:"country"`
+	Region         sql.NullString `db:"region"`
+	TokenExpiresAt time.Time      `db:"token_expires_at"`
+	RedeemedAt     time.Time      `db:"redeemed_at"`
+}
+
+// GeoLocation is the coarse place a geo resolver found an address in
+type GeoLocation struct {
+	Country string `json:"country"`
+	Region  string `json:"region,omitempty"`
+}
+
+// DownloadRedemptionResponse represents a redemption as returned by the API. TokenHash is
+// the hex SHA-256 of the signed URL's token, so redemptions of one URL can be grouped.
+type DownloadRedemptionResponse struct {
+	ID         string       `json:"id"`
+	TokenHash  string       `json:"token_hash"`
+	VersionID  string       `json:"version_id,omitempty"`
+	RemoteIP   string       `json:"remote_ip"`
+	UserAgent  string       `json:"user_agent"`
+	Geo        *GeoLocation `json:"geo,omitempty"`
+	RedeemedAt time.Time    `json:"redeemed_at"`
+}
+
+// DownloadRedemptionListResponse represents the redemptions of a file's download URLs
+// issued by the requesting client
+type DownloadRedemptionListResponse struct {
+	api.Page[DownloadRedemptionResponse]
+	FileID string `json:"file_id"`
+}
@@ -3,22 +3,64 @@ package models
 import (
 	"database/sql"
 	"time"
+
+	"file-upload-service/api"
+)
+
+// What an upload does when a file is already stored at its key
+const (
+	OnConflictReject     = "reject"
+	OnConflictOverwrite  = "overwrite"
+	OnConflictNewVersion = "new-version"
+	OnConflictRename     = "rename"
+	// OnConflictError is another name for OnConflictReject
+	OnConflictError = "error"
+)
+
+// File statuses
+const (
+	FileStatusPending  = "pending"
+	FileStatusUploaded = "uploaded"
+	FileStatusDeleted  = "deleted"
+	// FileStatusQuarantined marks a file the virus scanner found infected
+	FileStatusQuarantined = "quarantined"
+)
+
+// Virus scan statuses of a file's current content
+const (
+	ScanStatusPending  = "pending"
+	ScanStatusClean    = "clean"
+	ScanStatusInfected = "infected"
+	// ScanStatusReleased marks an infected file an admin let out of quarantine
+	ScanStatusReleased = "released"
+)
+
+// Thumbnail statuses of an image in a bucket with thumbnail widths
+const (
+	ThumbnailStatusPending = "pending"
+	ThumbnailStatusReady   = "ready"
+	ThumbnailStatusFailed  = "failed"
 )
 
 // File represents a file record in the system
 type File struct {
-	ID              string       `json:"id" db:"id"`
-	FileName        string       `json:"file_name" db:"file_name"`
-	FileSize        int64        `json:"file_size" db:"file_size"`
-	Mimetype        string       `json:"mimetype" db:"mimetype"`
-	ClientID        string       `json:"client_id" db:"client_id"`
-	BucketID        int          `json:"bucket_id" db:"bucket_id"`
-	Key             string       `json:"key" db:"key"`
-	OwnerEntityType string       `json:"owner_entity_type" db:"owner_entity_type"`
-	OwnerEntityID   string       `json:"owner_entity_id" db:"owner_entity_id"`
-	CreatedAt       time.Time    `json:"created_at" db:"created_at"`
-	UpdatedAt       time.Time    `json:"updated_at" db:"updated_at"`
-	DeletedAt       sql.NullTime `json:"deleted_at,omitempty" db:"deleted_at"`
+	ID               string         `json:"id" db:"id"`
+	FileName         string         `json:"file_name" db:"file_name"`
+	FileSize         int64          `json:"file_size" db:"file_size"`
+	Mimetype         string         `json:"mimetype" db:"mimetype"`
+	DetectedMimetype sql.NullString `json:"detected_mimetype,omitempty" db:"detected_mimetype"`
+	Checksum         sql.NullString `json:"checksum,omitempty" db:"checksum"`
+	ClientID         string         `json:"client_id" db:"client_id"`
+	BucketID         int            `json:"bucket_id" db:"bucket_id"`
+	Key              string         `json:"key" db:"key"`
+	OwnerEntityType  string         `json:"owner_entity_type" db:"owner_entity_type"`
+	OwnerEntityID    string         `json:"owner_entity_id" db:"owner_entity_id"`
+	UploadGroupID    sql.NullString `json:"upload_group_id,omitempty" db:"upload_group_id"`
+	Staged           bool           `json:"staged" db:"staged"`
+	Status           string         `json:"status" db:"status"`
+	CreatedAt        time.Time      `json:"created_at" db:"created_at"`
+	UpdatedAt        time.Time      `json:"updated_at" db:"updated_at"`
+	DeletedAt        sql.NullTime   `json:"deleted_at,omitempty" db:"deleted_at"`
 }
 
 // CreateSignedURLRequest represents the request to generate a signed URL for upload
@@ -30,33 +72,308 @@ type CreateSignedURLRequest struct {
 	Mimetype        string `json:"mimetype"`
 	OwnerEntityType string `json:"owner_entity_type"`
 	OwnerEntityID   string `json:"owner_entity_id"`
+	// AllowParallel skips the one-outstanding-token-per-key cap, for callers that
+	// intentionally run concurrent writers with overwrite semantics
+	AllowParallel bool `json:"allow_parallel,omitempty"`
+	// OnConflict decides what happens when a file is already stored at the key:
+	// "reject" (the default, also spelled "error") refuses the request, "overwrite" gives
+	// the upload a new file_id and deletes the stored file once the upload completes,
+	// "new-version" replaces the stored file's content and keeps its file_id, and
+	// "rename" stores the upload under a free key like "name (2).ext"
+	OnConflict string `json:"on_conflict,omitempty"`
+	// ExpiresInSeconds is how long the signed URL stays valid; 15 minutes when omitted
+	ExpiresInSeconds *int `json:"expires_in_seconds,omitempty"`
+	// MaxUses is how many successful uploads the signed URL accepts, so a client can
+	// retry an upload whose response it never saw; 1 when omitted
+	MaxUses int `json:"max_uses,omitempty"`
+	// Metadata holds custom key/value pairs stored with the file and returned with it
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// CallbackURL is POSTed an UploadCallbackPayload once the upload completes
+	CallbackURL string `json:"callback_url,omitempty"`
+	// RestrictIP binds the signed URL to one IP address: AllowedIP when set, otherwise
+	// the address this request came from. Leave it off for URLs handed to a browser.
+	RestrictIP bool   `json:"restrict_ip,omitempty"`
+	AllowedIP  string `json:"allowed_ip,omitempty"`
+	// KeyPrefix replaces Key for a URL that accepts up to MaxFiles uploads, together at
+	// most MaxTotalBytes, each stored under the prefix at a key sent with the upload.
+	// FileSize is then the most bytes one file may have, MaxTotalBytes when omitted, and
+	// Mimetype an optional pattern ("image/*") every file must match.
+	KeyPrefix     string `json:"key_prefix,omitempty"`
+	MaxFiles      int    `json:"max_files,omitempty"`
+	MaxTotalBytes int64  `json:"max_total_bytes,omitempty"`
+	// Extract has the uploaded zip unpacked under Key, one file per entry, instead of
+	// being stored; OnConflict then applies to the entries
+	Extract bool `json:"extract,omitempty"`
+}
+
+// ReplaceFileURLRequest represents the request for a signed URL that replaces the content
+// of an existing file, keeping its file_id and key
+type ReplaceFileURLRequest struct {
+	// FileSize is the most bytes the new content may have
+	FileSize int64 `json:"file_size"`
+	// Mimetype of the new content; the file's current mimetype when omitted
+	Mimetype string `json:"mimetype,omitempty"`
+	// ExpiresInSeconds is how long the signed URL stays valid; 15 minutes when omitted
+	ExpiresInSeconds *int `json:"expires_in_seconds,omitempty"`
+	// CallbackURL is POSTed an UploadCallbackPayload once the replacement completes
+	CallbackURL string `json:"callback_url,omitempty"`
 }
 
 // SignedURLResponse represents the response with signed URL
 type SignedURLResponse struct {
-	FileID    string    `json:"file_id"`
+	// FileID is empty for a prefix URL, whose files are created as they are uploaded
+	FileID string `json:"file_id,omitempty"`
+	// Key is where the file will be stored, which differs from the requested key after a rename
+	Key       string    `json:"key,omitempty"`
 	SignedURL string    `json:"signed_url"`
 	ExpiresAt time.Time `json:"expires_at"`
+	// EncryptionKeyRequired is set on download URLs of files encrypted with a customer key,
+	// which must be fetched with the key in the X-Encryption-Key header
+	EncryptionKeyRequired bool `json:"encryption_key_required,omitempty"`
+	// KeyPrefix, MaxFiles and MaxTotalBytes echo the limits of a prefix URL
+	KeyPrefix     string `json:"key_prefix,omitempty"`
+	MaxFiles      int    `json:"max_files,omitempty"`
+	MaxTotalBytes int64  `json:"max_total_bytes,omitempty"`
 }
 
-// UploadTokenData represents the data stored in Redis for upload validation
-type UploadTokenData struct {
-	FileID          string `json:"file_id"`
+// ImportURLRequest represents the request to import a file the server fetches from a URL.
+// FileName defaults to the last segment of the URL path, and Mimetype to the
+// Content-Type of the response (or the sniffed type when the source sends none).
+type ImportURLRequest struct {
+	BucketID        int               `json:"bucket_id"`
+	Key             string            `json:"key"`
+	SourceURL       string            `json:"source_url"`
+	FileName        string            `json:"file_name,omitempty"`
+	Mimetype        string            `json:"mimetype,omitempty"`
+	OwnerEntityType string            `json:"owner_entity_type"`
+	OwnerEntityID   string            `json:"owner_entity_id"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	OnConflict      string            `json:"on_conflict,omitempty"`
+}
+
+// InlineUploadRequest represents the request to create a small file whose bytes travel
+// base64-encoded in the JSON body
+type InlineUploadRequest struct {
+	BucketID        int    `json:"bucket_id"`
+	Key             string `json:"key"`
 	FileName        string `json:"file_name"`
-	FileSize        int64  `json:"file_size"`
 	Mimetype        string `json:"mimetype"`
-	ClientID        string `json:"client_id"`
-	BucketID        int    `json:"bucket_id"`
+	OwnerEntityType string `json:"owner_entity_type"`
+	OwnerEntityID   string `json:"owner_entity_id"`
+	// Content is the file's bytes in standard base64
+	Content    string            `json:"content"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	OnConflict string            `json:"on_conflict,omitempty"`
+}
+
+// CreateSignedURLsRequest represents a batch of signed URL requests.
+// Each entry is validated exactly like a single signed URL request.
+type CreateSignedURLsRequest struct {
+	Entries []CreateSignedURLRequest `json:"entries"`
+}
+
+// BatchItemError is the error of one entry of a batch request
+type BatchItemError struct {
+	Code    int    `json:"Code"`
+	Message string `json:"Message"`
+}
+
+// SignedURLBatchResult is the outcome of one entry of a signed URL batch, in request order.
+// Exactly one of the signed URL fields or Error is set.
+type SignedURLBatchResult struct {
+	Index     int             `json:"index"`
+	FileID    string          `json:"file_id,omitempty"`
+	Key       string          `json:"key,omitempty"`
+	SignedURL string          `json:"signed_url,omitempty"`
+	ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+	Error     *BatchItemError `json:"error,omitempty"`
+}
+
+// SignedURLBatchResponse represents the per-entry results of a signed URL batch
+type SignedURLBatchResponse struct {
+	Results   []SignedURLBatchResult `json:"results"`
+	Succeeded int                    `json:"succeeded"`
+	Failed    int                    `json:"failed"`
+}
+
+// GenerateDownloadSignedURLsRequest represents a request for download URLs of many files at
+// once. The other fields apply to every URL, as on a single download URL request.
+type GenerateDownloadSignedURLsRequest struct {
+	FileIDs          []string `json:"file_ids"`
+	ExpiresInSeconds *int     `json:"expires_in_seconds,omitempty"`
+	MaxUses          int      `json:"max_uses,omitempty"`
+	Disposition      string   `json:"disposition,omitempty"`
+}
+
+// DownloadURLBatchResult is the outcome for one file of a download URL batch. Exactly one
+// of SignedURL or Error is set.
+type DownloadURLBatchResult struct {
+	SignedURL             string          `json:"signed_url,omitempty"`
+	ExpiresAt             *time.Time      `json:"expires_at,omitempty"`
+	EncryptionKeyRequired bool            `json:"encryption_key_required,omitempty"`
+	Error                 *BatchItemError `json:"error,omitempty"`
+}
+
+// DownloadURLBatchResponse represents the results of a download URL batch, by file_id
+type DownloadURLBatchResponse struct {
+	Results   map[string]DownloadURLBatchResult `json:"results"`
+	Succeeded int                               `json:"succeeded"`
+	Failed    int                               `json:"failed"`
+}
+
+// PendingUploadConflict is the error returned when a key already has an outstanding
+// upload token. It carries the pending file so the caller can wait for it or reuse it.
+type PendingUploadConflict struct {
+	Code      int       `json:"Code"`
+	Message   string    `json:"Message"`
+	FileID    string    `json:"file_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// FileExistsConflict is the error returned when a file is already stored at the key of an
+// upload and on_conflict is reject. It names the stored file.
+type FileExistsConflict struct {
+	Code    int    `json:"Code"`
+	Message string `json:"Message"`
+	FileID  string `json:"file_id"`
+}
+
+// ReadRangeNotSatisfiableError is the error returned when a read starts outside the file.
+// It carries the file's size so the caller can correct the offset.
+type ReadRangeNotSatisfiableError struct {
+	Code     int    `json:"Code"`
+	Message  string `json:"Message"`
+	FileSize int64  `json:"file_size"`
+}
+
+// UploadTokenData represents the data stored in Redis for upload validation
+type UploadTokenData struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	FileSize int64  `json:"file_size"`
+	Mimetype string `json:"mimetype"`
+	ClientID string `json:"client_id"`
+	BucketID int    `json:"bucket_id"`
 	// FilePath is the resolved storage path relative to ./uploads/
 	// Format: <client_name>/<bucket_name>/<key>  (key may itself contain slashes)
 	FilePath        string `json:"file_path"`
 	OwnerEntityType string `json:"owner_entity_type"`
 	OwnerEntityID   string `json:"owner_entity_id"`
+	// GroupID is set when the upload belongs to an upload group; the bytes are
+	// written to the group's staging area until the group is committed
+	GroupID string `json:"group_id,omitempty"`
+	// AllowMimetypeMismatch is copied from the bucket and skips the content type check on upload
+	AllowMimetypeMismatch bool `json:"allow_mimetype_mismatch,omitempty"`
+	// Replaces is the stored file an on_conflict=overwrite upload deletes once it completes
+	Replaces string `json:"replaces,omitempty"`
+	// NewVersion is set when the upload replaces the content of the existing file FileID
+	// (on_conflict=new-version) instead of creating a file
+	NewVersion bool `json:"new_version,omitempty"`
+	// StrictFileSize is copied from the bucket and rejects uploads whose size differs from
+	// FileSize beyond the tolerance, rather than flagging them
+	StrictFileSize bool `json:"strict_file_size,omitempty"`
+	// Metadata is the validated custom metadata of the file
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// ExpiresAt is when the token lapses; zero for tokens issued before it was recorded
+	ExpiresAt time.Time `json:"expires_at"`
+	// CallbackURL is notified once the upload completes
+	CallbackURL string `json:"callback_url,omitempty"`
+	// Replace marks a token from POST /files/{id}/replace-url: the upload overwrites the
+	// bytes of the existing live file instead of completing a new one
+	Replace bool `json:"replace,omitempty"`
+	// AllowedIP is the only address the upload is accepted from; any address when empty
+	AllowedIP string `json:"allowed_ip,omitempty"`
+	// KeyPrefix marks a token accepting up to MaxFiles uploads beneath the prefix, each
+	// creating its own file, together at most MaxTotalBytes. FileID is then empty,
+	// FileSize caps each file and Mimetype, when set, is the pattern files must match.
+	KeyPrefix     string `json:"key_prefix,omitempty"`
+	MaxFiles      int    `json:"max_files,omitempty"`
+	MaxTotalBytes int64  `json:"max_total_bytes,omitempty"`
+	// OnConflict applies to each upload of a prefix token, or each entry of an extracted zip
+	OnConflict string `json:"on_conflict,omitempty"`
+	// ExtractTo marks a token whose uploaded zip is unpacked beneath this key instead of
+	// being stored; the file row of FileID is retired once the upload arrives
+	ExtractTo string `json:"extract_to,omitempty"`
+}
+
+// UploadCallbackPayload is POSTed to a signed URL's callback_url once its upload has been
+// written, so the system that asked for the URL learns about it without polling
+type UploadCallbackPayload struct {
+	Event           string    `json:"event"`
+	FileID          string    `json:"file_id"`
+	BucketID        int       `json:"bucket_id"`
+	Key             string    `json:"key"`
+	FileName        string    `json:"file_name"`
+	Size            int64     `json:"size"`
+	Mimetype        string    `json:"mimetype"`
+	Checksum        string    `json:"checksum"`
+	OwnerEntityType string    `json:"owner_entity_type"`
+	OwnerEntityID   string    `json:"owner_entity_id"`
+	GroupID         string    `json:"group_id,omitempty"`
+	UploadedAt      time.Time `json:"uploaded_at"`
+}
+
+// UploadTokenInfo is what the holder of an upload token may learn about the upload it
+// allows, e.g. to render "Uploading invoice.pdf (max 4 MB)". It leaves out the client,
+// bucket and storage path.
+type UploadTokenInfo struct {
+	FileName  string     `json:"file_name"`
+	MaxSize   int64      `json:"max_size"`
+	Mimetype  string     `json:"mimetype"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// KeyPrefix, FilesRemaining and BytesRemaining describe a prefix token
+	KeyPrefix      string `json:"key_prefix,omitempty"`
+	FilesRemaining *int   `json:"files_remaining,omitempty"`
+	BytesRemaining *int64 `json:"bytes_remaining,omitempty"`
+}
+
+// RevokeSignedURLResponse reports a signed URL revoked through DELETE /files/tokens/{token}
+type RevokeSignedURLResponse struct {
+	Message string `json:"message"`
+	// Kind is "upload", "download" or "zip-download"
+	Kind   string `json:"kind"`
+	FileID string `json:"file_id,omitempty"`
+	// UploadCancelled is set when the URL's file had not been uploaded yet and its pending
+	// row was retired with it
+	UploadCancelled bool `json:"upload_cancelled,omitempty"`
 }
 
 // GenerateDownloadSignedURLRequest represents the request to generate a download signed URL
 type GenerateDownloadSignedURLRequest struct {
 	FileID string `json:"file_id"`
+	// BucketID and Key name the file by its key instead of FileID; the newest uploaded
+	// file at the key is downloaded
+	BucketID int    `json:"bucket_id,omitempty"`
+	Key      string `json:"key,omitempty"`
+	// ExpiresInSeconds is how long the signed URL stays valid; 15 minutes when omitted
+	ExpiresInSeconds *int `json:"expires_in_seconds,omitempty"`
+	// VersionID downloads an earlier version of the file's key instead of its current content
+	VersionID string `json:"version_id,omitempty"`
+	// MaxUses is how many downloads the signed URL allows; 1 when omitted
+	MaxUses int `json:"max_uses,omitempty"`
+	// Disposition is DispositionInline or DispositionAttachment; attachment when omitted
+	Disposition string `json:"disposition,omitempty"`
+	// DownloadFilename is the name browsers save the file under; the file's own name when omitted
+	DownloadFilename string `json:"download_filename,omitempty"`
+	// RestrictIP binds the signed URL to one IP address: AllowedIP when set, otherwise
+	// the address this request came from. Off by default.
+	RestrictIP bool   `json:"restrict_ip,omitempty"`
+	AllowedIP  string `json:"allowed_ip,omitempty"`
+}
+
+// Content dispositions a download URL can serve its file with
+const (
+	// DispositionAttachment makes browsers save the file
+	DispositionAttachment = "attachment"
+	// DispositionInline lets browsers display the file, such as a PDF or an image
+	DispositionInline = "inline"
+)
+
+// ReadFileRangeRequest represents a request to read part of a file's content directly.
+// A negative Offset counts back from the end of the file, so -100 reads its last 100 bytes.
+type ReadFileRangeRequest struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
 }
 
 // DownloadTokenData represents the data stored in Redis for download validation
@@ -69,24 +386,102 @@ type DownloadTokenData struct {
 	// FilePath is the resolved storage path relative to ./uploads/
 	// Format: <client_name>/<bucket_name>/<key>  (key may itself contain slashes)
 	FilePath string `json:"file_path"`
+	// VersionID is set when an earlier version is downloaded; its bytes are read from
+	// ./versions/<version_id> instead of FilePath
+	VersionID string `json:"version_id,omitempty"`
+	// GrantID and GranteeClientID are set when another client downloads the file through a grant
+	GrantID         string `json:"grant_id,omitempty"`
+	GranteeClientID string `json:"grantee_client_id,omitempty"`
+	// Metadata is emitted as X-File-Meta-* headers when FILE_META_HEADERS is enabled
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Encrypted is set when the content was encrypted with a customer key, which the
+	// download must then send in X-Encryption-Key
+	Encrypted bool `json:"encrypted,omitempty"`
+	// MaxUses is how many downloads the token allows; zero in tokens issued before URLs
+	// could be reused, which allow one
+	MaxUses int `json:"max_uses,omitempty"`
+	// ExpiresAt is when the token lapses, recorded with each redemption
+	ExpiresAt time.Time `json:"expires_at"`
+	// Disposition is the Content-Disposition type of the download; empty in tokens issued
+	// before it could be chosen, which download as attachments
+	Disposition string `json:"disposition,omitempty"`
+	// DownloadFilename replaces FileName in Content-Disposition when set
+	DownloadFilename string `json:"download_filename,omitempty"`
+	// AllowedIP is the only address the file is downloaded to; any address when empty
+	AllowedIP string `json:"allowed_ip,omitempty"`
+}
+
+// ImageDimensions are the pixel size and format read from an image's header at upload
+type ImageDimensions struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"`
 }
 
 // FileListItem represents a file entry in a non-recursive list response
 type FileListItem struct {
-	ID        string    `json:"id"`
-	Key       string    `json:"key"`
-	FileName  string    `json:"file_name"`
-	FileSize  int64     `json:"file_size"`
-	Mimetype  string    `json:"mimetype"`
-	CreatedAt time.Time `json:"created_at"`
+	ID               string `json:"id"`
+	Key              string `json:"key"`
+	FileName         string `json:"file_name"`
+	FileSize         int64  `json:"file_size"`
+	Mimetype         string `json:"mimetype"`
+	DetectedMimetype string `json:"detected_mimetype,omitempty"`
+	Checksum         string `json:"checksum,omitempty"`
+	// SizeMismatch is set when the uploaded bytes, reported as FileSize, differed from the
+	// size declared for the signed URL by more than the tolerance; DeclaredFileSize is that
+	// declared size
+	SizeMismatch     bool   `json:"size_mismatch,omitempty"`
+	DeclaredFileSize *int64 `json:"declared_file_size,omitempty"`
+	// Metadata holds the file's custom key/value pairs
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Image is set for GIF, JPEG and PNG files whose dimensions could be read
+	Image *ImageDimensions `json:"image,omitempty"`
+	// Thumbnails is set for GIF, JPEG and PNG files in a bucket with thumbnail widths
+	Thumbnails *FileThumbnails `json:"thumbnails,omitempty"`
+	// UploadedFrom is where the bytes came from when they were uploaded without
+	// authentication, through a signed URL or an upload policy
+	UploadedFrom *Uploader `json:"uploaded_from,omitempty"`
+	// Status is only reported when pending files are included in the listing
+	Status string `json:"status,omitempty"`
+	// ScanStatus is reported when a virus scanner is configured; pending files cannot be
+	// downloaded yet
+	ScanStatus string `json:"scan_status,omitempty"`
+	// DownloadCount counts completed downloads through download URLs and the public
+	// route; it and LastDownloadedAt trail actual downloads by a few seconds
+	DownloadCount    int64      `json:"download_count"`
+	LastDownloadedAt *time.Time `json:"last_downloaded_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
 }
 
-// ListFilesResponse represents the list response for a bucket path
+// Uploader is the address and User-Agent an unauthenticated upload came from. The address
+// is the client's as reported by a trusted proxy (TRUSTED_PROXIES) when there is one.
+type Uploader struct {
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// Thumbnail is one generated thumbnail of an image, stored under its own key. Size is the
+// bucket's thumbnail width it was made for; an image narrower than that keeps its width.
+type Thumbnail struct {
+	Size   int    `json:"size"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Key    string `json:"key"`
+}
+
+// FileThumbnails reports the thumbnails of an image. Items are listed once Status is ready.
+type FileThumbnails struct {
+	Status string      `json:"status"`
+	Items  []Thumbnail `json:"items,omitempty"`
+}
+
+// ListFilesResponse represents the list response for a bucket path: the files directly
+// under it in the shared page envelope, plus the folders found on this page
 type ListFilesResponse struct {
-	BucketID int            `json:"bucket_id"`
-	Path     string         `json:"path"`
-	Files    []FileListItem `json:"files"`
-	Folders  []string       `json:"folders"`
+	api.Page[FileListItem]
+	BucketID int      `json:"bucket_id"`
+	Path     string   `json:"path"`
+	Folders  []string `json:"folders"`
 }
 
 // DeleteFilesRequest represents a request to delete multiple files.
@@ -102,4 +497,4 @@ type DeleteFilesResponse struct {
 	Deleted []string `json:"deleted"`
 	Missing []string `json:"missing"`
 	Failed  []string `json:"failed"`
-}
\ No newline at end of file
+}
@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// File event types
+const (
+	FileEventCreated = "created"
+	FileEventUpdated = "updated"
+	FileEventDeleted = "deleted"
+)
+
+// FileEvent is one change to the visible files of a bucket. The file fields describe the
+// file after the change, or before it for deleted events.
+type FileEvent struct {
+	Seq    int64  `json:"seq" db:"seq"`
+	Event  string `json:"event" db:"event"`
+	FileID string `json:"file_id" db:"file_id"`
+	Key    string `json:"key" db:"key"`
+	// PreviousKey is set on updated events that moved the file to a new key
+	PreviousKey string    `json:"previous_key,omitempty" db:"previous_key"`
+	FileName    string    `json:"file_name" db:"file_name"`
+	FileSize    int64     `json:"file_size" db:"file_size"`
+	Mimetype    string    `json:"mimetype" db:"mimetype"`
+	OccurredAt  time.Time `json:"occurred_at" db:"created_at"`
+}
+
+// BucketChangesResponse represents the changes of a bucket after a cursor, oldest first.
+// Cursor is passed back as ?since= to continue; when Truncated is set more events are
+// already waiting.
+type BucketChangesResponse struct {
+	BucketID  int         `json:"bucket_id"`
+	Events    []FileEvent `json:"events"`
+	Cursor    string      `json:"cursor"`
+	Truncated bool        `json:"truncated"`
+}
+
+// ResyncRequiredError is returned when the events after a cursor have been compacted away.
+// The client must list the bucket again; Cursor is where to resume afterwards.
+type ResyncRequiredError struct {
+	Code           int    `json:"Code"`
+	Message        string `json:"Message"`
+	ResyncRequired bool   `json:"resync_required"`
+	Cursor         string `json:"cursor"`
+}
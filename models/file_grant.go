@@ -0,0 +1,53 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// File grant permissions
+const (
+	GrantPermissionDownload = "download"
+)
+
+// FileGrant is a grant letting another client download a specific file
+type FileGrant struct {
+	ID               string       `db:"id"`
+	FileID           string       `db:"file_id"`
+	OwnerClientID    string       `db:"owner_client_id"`
+	GranteeClientID  string       `db:"grantee_client_id"`
+	Permission       string       `db:"permission"`
+	ExpiresAt        sql.NullTime `db:"expires_at"`
+	RevokedAt        sql.NullTime `db:"revoked_at"`
+	DownloadCount    int          `db:"download_count"`
+	LastDownloadedAt sql.NullTime `db:"last_downloaded_at"`
+	CreatedAt        time.Time    `db:"created_at"`
+}
+
+// CreateFileGrantRequest represents the request to grant another client access to a file
+type CreateFileGrantRequest struct {
+	GranteeClientID string `json:"grantee_client_id"`
+	// Permission defaults to download, the only permission supported
+	Permission string `json:"permission"`
+	// ExpiresAt is optional; a grant without it lasts until revoked
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// FileGrantResponse represents a grant as returned by the API
+type FileGrantResponse struct {
+	ID               string     `json:"id"`
+	FileID           string     `json:"file_id"`
+	GranteeClientID  string     `json:"grantee_client_id"`
+	Permission       string     `json:"permission"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	DownloadCount    int        `json:"download_count"`
+	LastDownloadedAt *time.Time `json:"last_downloaded_at,omitempty"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// FileGrantListResponse represents the active grants of a file
+type FileGrantListResponse struct {
+	FileID string              `json:"file_id"`
+	Grants []FileGrantResponse `json:"grants"`
+}
@@ -0,0 +1,21 @@
+package models
+
+// PurgeFilesRequest represents a request to permanently erase files, e.g. for a GDPR
+// erasure request. Either file_ids OR (owner_entity_type + owner_entity_id) must be
+// provided, but not both.
+type PurgeFilesRequest struct {
+	FileIDs         []string `json:"file_ids,omitempty"`
+	OwnerEntityType string   `json:"owner_entity_type,omitempty"`
+	OwnerEntityID   string   `json:"owner_entity_id,omitempty"`
+	// LegalBasis is recorded in the audit log with every purged file
+	LegalBasis string `json:"legal_basis"`
+	// SecureWipe overwrites the bytes with zeros before they are unlinked
+	SecureWipe bool `json:"secure_wipe"`
+}
+
+// PurgeFilesResponse represents the purge files response
+type PurgeFilesResponse struct {
+	Purged  []string `json:"purged"`
+	Missing []string `json:"missing"`
+	Failed  []string `json:"failed"`
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// QuarantinedFile is a file the virus scanner found infected, awaiting an admin decision
+type QuarantinedFile struct {
+	ID        string    `json:"id" db:"id"`
+	ClientID  string    `json:"client_id" db:"client_id"`
+	BucketID  int       `json:"bucket_id" db:"bucket_id"`
+	Key       string    `json:"key" db:"key"`
+	FileName  string    `json:"file_name" db:"file_name"`
+	FileSize  int64     `json:"file_size" db:"file_size"`
+	Mimetype  string    `json:"mimetype" db:"mimetype"`
+	Signature string    `json:"signature" db:"scan_signature"`
+	ScannedAt time.Time `json:"scanned_at" db:"scanned_at"`
+}
+
+// QuarantineListResponse represents a page of quarantined files.
+// When Truncated is set, NextCursor should be passed back as ?cursor= for the next page.
+type QuarantineListResponse struct {
+	Files      []QuarantinedFile `json:"files"`
+	Truncated  bool              `json:"truncated"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// QuarantineResolutionResponse reports a quarantined file after an admin released or
+// deleted it
+type QuarantineResolutionResponse struct {
+	FileID     string `json:"file_id"`
+	Status     string `json:"status"`
+	ScanStatus string `json:"scan_status"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// FileVersion is an earlier content of a key in a versioning bucket, or a delete marker
+// recording that the key's file was deleted
+type FileVersion struct {
+	ID           string    `json:"version_id" db:"id"`
+	FileID       string    `json:"file_id" db:"file_id"`
+	FileSize     int64     `json:"file_size" db:"file_size"`
+	Mimetype     string    `json:"mimetype" db:"mimetype"`
+	Checksum     string    `json:"checksum,omitempty" db:"checksum"`
+	DeleteMarker bool      `json:"delete_marker" db:"delete_marker"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+}
+
+// FileVersionListResponse represents the versions kept for a file's key, newest first
+type FileVersionListResponse struct {
+	FileID   string        `json:"file_id"`
+	BucketID int           `json:"bucket_id"`
+	Key      string        `json:"key"`
+	Versions []FileVersion `json:"versions"`
+}
+
+// PurgeFileVersionsRequest represents a request to permanently remove versions of a file's
+// key. Every version of the key is removed when version_ids is omitted.
+type PurgeFileVersionsRequest struct {
+	VersionIDs []string `json:"version_ids,omitempty"`
+}
+
+// PurgeFileVersionsResponse represents the purge versions response
+type PurgeFileVersionsResponse struct {
+	Purged     []string `json:"purged"`
+	Missing    []string `json:"missing"`
+	Failed     []string `json:"failed"`
+	BytesFreed int64    `json:"bytes_freed"`
+}
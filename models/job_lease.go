@@ -0,0 +1,16 @@
+package models
+
+// JobLease reports which instance holds a background job's lease
+type JobLease struct {
+	Name string `json:"name"`
+	// Holder is the instance_id of the holder; empty when the lease is free
+	Holder    string `json:"holder"`
+	HeldHere  bool   `json:"held_here"`
+	ExpiresIn int64  `json:"expires_in_ms"`
+}
+
+// JobLeaseListResponse represents the leases known to the answering instance
+type JobLeaseListResponse struct {
+	InstanceID string     `json:"instance_id"`
+	Leases     []JobLease `json:"leases"`
+}
@@ -0,0 +1,47 @@
+package models
+
+// ServiceLimits represents the limits the service enforces, as configured on this instance.
+// Version changes whenever any limit does, so callers can cache the rest until it moves.
+type ServiceLimits struct {
+	Version string `json:"version"`
+
+	// Largest accepted file of each single-request upload path, in bytes
+	DirectUploadMaxBytes int64 `json:"direct_upload_max_bytes"`
+	InlineUploadMaxBytes int64 `json:"inline_upload_max_bytes"`
+	URLImportMaxBytes    int64 `json:"url_import_max_bytes"`
+
+	URLImportTimeoutSeconds int `json:"url_import_timeout_seconds"`
+	URLImportMaxRedirects   int `json:"url_import_max_redirects"`
+
+	// Largest range a single POST /files/{id}/read returns, in bytes
+	ReadRangeMaxBytes int64 `json:"read_range_max_bytes"`
+
+	// Limits of POST /files/{id}/expand; archives over the sync limits run as a background job
+	ArchiveExpandMaxEntryBytes  int64 `json:"archive_expand_max_entry_bytes"`
+	ArchiveExpandMaxTotalBytes  int64 `json:"archive_expand_max_total_bytes"`
+	ArchiveExpandMaxEntries     int   `json:"archive_expand_max_entries"`
+	ArchiveExpandMaxRatio       int   `json:"archive_expand_max_ratio"`
+	ArchiveExpandSyncMaxEntries int   `json:"archive_expand_sync_max_entries"`
+	ArchiveExpandSyncMaxBytes   int64 `json:"archive_expand_sync_max_bytes"`
+
+	// Limits of POST /files/zip-download-url
+	ZipDownloadMaxFiles int   `json:"zip_download_max_files"`
+	ZipDownloadMaxBytes int64 `json:"zip_download_max_bytes"`
+
+	MaxKeyLength             int `json:"max_key_length"`
+	DefaultMaxKeyDepth       int `json:"default_max_key_depth"`
+	MaxKeyDepthLimit         int `json:"max_key_depth_limit"`
+	MaxMetadataBytes         int `json:"max_metadata_bytes"`
+	MaxMetadataKeyLength     int `json:"max_metadata_key_length"`
+	SignedURLDefaultTTL      int `json:"signed_url_default_ttl_seconds"`
+	SignedURLMinTTL          int `json:"signed_url_min_ttl_seconds"`
+	SignedURLMaxTTL          int `json:"signed_url_max_ttl_seconds"`
+	SignedURLMaxUses         int `json:"signed_url_max_uses"`
+	SignedURLBatchMaxEntries int `json:"signed_url_batch_max_entries"`
+	SignedURLPrefixMaxFiles  int `json:"signed_url_prefix_max_files"`
+	UploadGroupMaxEntries    int `json:"upload_group_max_entries"`
+	UploadGroupTTL           int `json:"upload_group_ttl_seconds"`
+
+	// MaxSyncRows caps the files a single delete, purge or listing request may process
+	MaxSyncRows int `json:"max_sync_rows"`
+}
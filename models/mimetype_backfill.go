@@ -0,0 +1,98 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Mimetype backfill job statuses
+const (
+	BackfillStatusRunning   = "running"
+	BackfillStatusCompleted = "completed"
+	BackfillStatusFailed    = "failed"
+)
+
+// Mimetype correction statuses
+const (
+	CorrectionStatusProposed  = "proposed"
+	CorrectionStatusApplied   = "applied"
+	CorrectionStatusDismissed = "dismissed"
+	// CorrectionStatusStale marks a proposal whose file changed or was deleted before it was applied
+	CorrectionStatusStale = "stale"
+)
+
+// MimetypeBackfillJob is a run of the content-type correction backfill
+type MimetypeBackfillJob struct {
+	ID         string         `db:"id"`
+	Status     string         `db:"status"`
+	BucketID   sql.NullInt64  `db:"bucket_id"`
+	AutoApply  bool           `db:"auto_apply"`
+	Cursor     string         `db:"cursor"`
+	Scanned    int            `db:"scanned"`
+	Proposed   int            `db:"proposed"`
+	Applied    int            `db:"applied"`
+	Unreadable int            `db:"unreadable"`
+	Error      sql.NullString `db:"error"`
+	StartedAt  time.Time      `db:"started_at"`
+	FinishedAt sql.NullTime   `db:"finished_at"`
+}
+
+// CreateMimetypeBackfillRequest represents the request to start a backfill job
+type CreateMimetypeBackfillRequest struct {
+	// BucketID limits the job to one bucket; every bucket is scanned when omitted
+	BucketID *int `json:"bucket_id,omitempty"`
+	// AutoApply applies unambiguous corrections straight away instead of leaving them for review
+	AutoApply bool `json:"auto_apply"`
+}
+
+// MimetypeBackfillJobResponse represents a backfill job and its progress
+type MimetypeBackfillJobResponse struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	BucketID   *int       `json:"bucket_id,omitempty"`
+	AutoApply  bool       `json:"auto_apply"`
+	Scanned    int        `json:"scanned"`
+	Proposed   int        `json:"proposed"`
+	Applied    int        `json:"applied"`
+	Unreadable int        `json:"unreadable"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// MimetypeCorrection is a proposed change of a file's stored mimetype
+type MimetypeCorrection struct {
+	ID               string         `json:"id" db:"id"`
+	JobID            string         `json:"job_id" db:"job_id"`
+	FileID           string         `json:"file_id" db:"file_id"`
+	CurrentMimetype  string         `json:"current_mimetype" db:"current_mimetype"`
+	ProposedMimetype string         `json:"proposed_mimetype" db:"proposed_mimetype"`
+	Unambiguous      bool           `json:"unambiguous" db:"unambiguous"`
+	Status           string         `json:"status" db:"status"`
+	ResolvedBy       sql.NullString `json:"-" db:"resolved_by"`
+	ResolvedAt       sql.NullTime   `json:"-" db:"resolved_at"`
+	CreatedAt        time.Time      `json:"created_at" db:"created_at"`
+}
+
+// MimetypeCorrectionListResponse represents a page of correction proposals.
+// When Truncated is set, NextCursor should be passed back as ?cursor= for the next page.
+type MimetypeCorrectionListResponse struct {
+	Status      string               `json:"status"`
+	Corrections []MimetypeCorrection `json:"corrections"`
+	Truncated   bool                 `json:"truncated"`
+	NextCursor  string               `json:"next_cursor,omitempty"`
+}
+
+// ResolveMimetypeCorrectionsRequest names the proposals to apply or dismiss
+type ResolveMimetypeCorrectionsRequest struct {
+	CorrectionIDs []string `json:"correction_ids"`
+}
+
+// ResolveMimetypeCorrectionsResponse reports what happened to each named proposal
+type ResolveMimetypeCorrectionsResponse struct {
+	Resolved []string `json:"resolved"`
+	// Stale lists proposals whose file changed or was deleted since they were made
+	Stale []string `json:"stale"`
+	// Skipped lists unknown ids and proposals already resolved
+	Skipped []string `json:"skipped"`
+}
@@ -0,0 +1,65 @@
+package models
+
+import "time"
+
+// OwnerQuota caps the bytes a client may store for an owner entity. An empty
+// OwnerEntityID makes it the default for every owner of OwnerEntityType.
+type OwnerQuota struct {
+	ID              int       `db:"id"`
+	ClientID        string    `db:"client_id"`
+	OwnerEntityType string    `db:"owner_entity_type"`
+	OwnerEntityID   string    `db:"owner_entity_id"`
+	MaxBytes        int64     `db:"max_bytes"`
+	CreatedAt       time.Time `db:"created_at"`
+	UpdatedAt       time.Time `db:"updated_at"`
+}
+
+// SetOwnerQuotaRequest represents the request to set a quota. Leave OwnerEntityID out
+// to set the default of the owner type.
+type SetOwnerQuotaRequest struct {
+	OwnerEntityType string `json:"owner_entity_type"`
+	OwnerEntityID   string `json:"owner_entity_id,omitempty"`
+	MaxBytes        int64  `json:"max_bytes"`
+}
+
+// OwnerQuotaResponse represents a quota as returned by the API
+type OwnerQuotaResponse struct {
+	OwnerEntityType string    `json:"owner_entity_type"`
+	OwnerEntityID   string    `json:"owner_entity_id,omitempty"`
+	MaxBytes        int64     `json:"max_bytes"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// OwnerQuotaListResponse represents every quota a client has set
+type OwnerQuotaListResponse struct {
+	Quotas []OwnerQuotaResponse `json:"quotas"`
+}
+
+// OwnerUsage is the storage one owner entity holds against their quota. UsedBytes counts
+// stored files, including quarantined ones; ReservedBytes counts the declared sizes of
+// uploads whose URL is still outstanding; SnapshotBytes counts the bytes unexpired
+// snapshots hold of files deleted or replaced since. LimitBytes is nil for owners without a quota.
+type OwnerUsage struct {
+	OwnerEntityType string `json:"owner_entity_type"`
+	OwnerEntityID   string `json:"owner_entity_id"`
+	UsedBytes       int64  `json:"used_bytes"`
+	ReservedBytes   int64  `json:"reserved_bytes"`
+	SnapshotBytes   int64  `json:"snapshot_bytes"`
+	FileCount       int    `json:"file_count"`
+	LimitBytes      *int64 `json:"limit_bytes"`
+}
+
+// OwnerQuotaExceededError is the error returned when an upload would take its owner
+// entity past their quota
+type OwnerQuotaExceededError struct {
+	Code            int    `json:"Code"`
+	Message         string `json:"Message"`
+	OwnerEntityType string `json:"owner_entity_type"`
+	OwnerEntityID   string `json:"owner_entity_id"`
+	UsedBytes       int64  `json:"used_bytes"`
+	ReservedBytes   int64  `json:"reserved_bytes"`
+	SnapshotBytes   int64  `json:"snapshot_bytes"`
+	RequestedBytes  int64  `json:"requested_bytes"`
+	LimitBytes      int64  `json:"limit_bytes"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// PresignedURLRequest represents a request for a URL that serves a file through the public
+// route until it expires, whether or not the file is in the bucket's public paths
+type PresignedURLRequest struct {
+	FileID string `json:"file_id"`
+	// ExpiresInSeconds is how long the URL stays valid; 15 minutes when omitted
+	ExpiresInSeconds *int `json:"expires_in_seconds,omitempty"`
+}
+
+// PresignedURLResponse represents the response with a presigned public URL
+type PresignedURLResponse struct {
+	SignedURL string    `json:"signed_url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
@@ -0,0 +1,16 @@
+package models
+
+// Kinds of signed URL a short token can stand for
+const (
+	ShortTokenKindUpload   = "upload"
+	ShortTokenKindDownload = "download"
+	// ShortTokenKindZipDownload is also the path of its long form, /files/zip-download
+	ShortTokenKindZipDownload = "zip-download"
+)
+
+// ShortTokenData maps a short signed URL token to the full upload or download token it
+// stands for. Stored in the cache under short:<token> for as long as the full token.
+type ShortTokenData struct {
+	Kind  string `json:"kind"`
+	Token string `json:"token"`
+}
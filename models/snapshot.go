@@ -0,0 +1,67 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// BucketSnapshot represents a point-in-time copy of a bucket's live files
+type BucketSnapshot struct {
+	ID         string    `json:"id" db:"id"`
+	BucketID   int       `json:"bucket_id" db:"bucket_id"`
+	ClientID   string    `json:"client_id" db:"client_id"`
+	Storage    string    `json:"storage" db:"storage"`
+	FileCount  int       `json:"file_count" db:"file_count"`
+	TotalBytes int64     `json:"total_bytes" db:"total_bytes"`
+	ExpiresAt  time.Time `json:"expires_at" db:"expires_at"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// SnapshotFile is a file row as it was when a snapshot was taken
+type SnapshotFile struct {
+	SnapshotID       string         `db:"snapshot_id"`
+	FileID           string         `db:"file_id"`
+	Key              string         `db:"key"`
+	FileName         string         `db:"file_name"`
+	FileSize         int64          `db:"file_size"`
+	Mimetype         string         `db:"mimetype"`
+	DetectedMimetype sql.NullString `db:"detected_mimetype"`
+	OwnerEntityType  string         `db:"owner_entity_type"`
+	OwnerEntityID    string         `db:"owner_entity_id"`
+	CreatedAt        sql.NullTime   `db:"created_at"`
+	Metadata         string         `db:"metadata"`
+	// EncryptionKeyHash and EncryptionIV are kept for content encrypted with a customer key
+	EncryptionKeyHash sql.NullString `db:"encryption_key_hash"`
+	EncryptionIV      sql.NullString `db:"encryption_iv"`
+	// ImageWidth, ImageHeight and ImageFormat are kept for images whose dimensions were read
+	ImageWidth  sql.NullInt64  `db:"image_width"`
+	ImageHeight sql.NullInt64  `db:"image_height"`
+	ImageFormat sql.NullString `db:"image_format"`
+}
+
+// CreateSnapshotResponse represents a newly created snapshot
+type CreateSnapshotResponse struct {
+	BucketSnapshot
+	// Skipped lists uploaded file rows left out because their bytes are missing from disk
+	Skipped []string `json:"skipped"`
+}
+
+// SnapshotListResponse represents the snapshots kept for a bucket
+type SnapshotListResponse struct {
+	BucketID  int              `json:"bucket_id"`
+	Snapshots []BucketSnapshot `json:"snapshots"`
+}
+
+// RestoreSnapshotResponse represents the result of restoring a bucket from a snapshot
+type RestoreSnapshotResponse struct {
+	SnapshotID string `json:"snapshot_id"`
+	// Restored lists snapshot files whose bytes or metadata were put back
+	Restored []string `json:"restored"`
+	// Unchanged lists snapshot files that already matched the snapshot
+	Unchanged []string `json:"unchanged"`
+	// Superseded lists newer files at a restored key, deleted because the key now holds the snapshot bytes
+	Superseded []string `json:"superseded"`
+	// Pruned lists files uploaded since the snapshot and deleted because prune=true
+	Pruned []string `json:"pruned"`
+	Failed []string `json:"failed"`
+}
@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// BucketUsage reports how much a bucket stores and how much deduplication saves it
+type BucketUsage struct {
+	BucketID int  `json:"bucket_id"`
+	Dedupe   bool `json:"dedupe"`
+	// FileCount and LogicalBytes cover the bucket's live files, as if each kept its own bytes
+	FileCount    int64 `json:"file_count"`
+	LogicalBytes int64 `json:"logical_bytes"`
+	// StoredBytes is LogicalBytes less what files sharing a storage object save
+	StoredBytes int64 `json:"stored_bytes"`
+	// DedupedFiles is how many files share the bytes of an earlier file with the same content
+	DedupedFiles int64 `json:"deduped_files"`
+	SavedBytes   int64 `json:"saved_bytes"`
+	// DeletedFileCount and DeletedBytes cover files deleted but not purged yet; their
+	// bytes are already gone from the bucket's directory
+	DeletedFileCount int64 `json:"deleted_file_count"`
+	DeletedBytes     int64 `json:"deleted_bytes"`
+	// Folders breaks the live files down by top-level folder
+	Folders []FolderUsage `json:"folders"`
+	// ComputedAt is when the figures were computed; they are cached for a short while
+	ComputedAt time.Time `json:"computed_at"`
+}
+
+// FolderUsage reports the live files under one top-level folder of a bucket. Files at
+// the root of the bucket are reported under the empty folder "".
+type FolderUsage struct {
+	Folder    string `json:"folder" db:"folder"`
+	FileCount int64  `json:"file_count" db:"file_count"`
+	Bytes     int64  `json:"bytes" db:"bytes"`
+}
@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+// Upload group statuses
+const (
+	UploadGroupStatusOpen       = "open"
+	UploadGroupStatusCommitting = "committing"
+	UploadGroupStatusCommitted  = "committed"
+	UploadGroupStatusAborted    = "aborted"
+	UploadGroupStatusExpired    = "expired"
+)
+
+// UploadGroup represents a set of uploads that are committed or discarded together
+type UploadGroup struct {
+	ID        string    `json:"id" db:"id"`
+	ClientID  string    `json:"client_id" db:"client_id"`
+	Status    string    `json:"status" db:"status"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// CreateUploadGroupRequest represents the request to create an upload group.
+// Each entry is validated exactly like a single signed URL request.
+type CreateUploadGroupRequest struct {
+	Entries []CreateSignedURLRequest `json:"entries"`
+}
+
+// UploadGroupResponse represents an upload group with its per-entry signed URLs
+type UploadGroupResponse struct {
+	GroupID   string              `json:"group_id"`
+	Status    string              `json:"status"`
+	ExpiresAt time.Time           `json:"expires_at"`
+	Entries   []SignedURLResponse `json:"entries,omitempty"`
+}
+
+// UploadGroupCommitResponse represents the result of committing an upload group
+type UploadGroupCommitResponse struct {
+	GroupID string   `json:"group_id"`
+	Status  string   `json:"status"`
+	FileIDs []string `json:"file_ids"`
+	// Missing lists entries whose bytes have not been uploaded yet (commit refused)
+	Missing []string `json:"missing,omitempty"`
+}
@@ -0,0 +1,52 @@
+package models
+
+import "time"
+
+// CreateUploadPolicyRequest represents the request for a pre-signed POST policy: the
+// conditions any upload made with it must meet, instead of one exact upload
+type CreateUploadPolicyRequest struct {
+	BucketID int `json:"bucket_id"`
+	// KeyPrefix is the folder every uploaded key must be beneath; empty allows any key
+	KeyPrefix string `json:"key_prefix"`
+	// ContentType is the mimetype uploads must declare, exact or as "type/*"; empty
+	// allows any the bucket does
+	ContentType string `json:"content_type,omitempty"`
+	// MinSize defaults to 1 byte; MaxSize is required
+	MinSize         int64  `json:"min_size,omitempty"`
+	MaxSize         int64  `json:"max_size"`
+	OwnerEntityType string `json:"owner_entity_type"`
+	OwnerEntityID   string `json:"owner_entity_id"`
+	// OnConflict applies to every upload made with the policy; "error" when omitted
+	OnConflict string `json:"on_conflict,omitempty"`
+	// ExpiresInSeconds is how long the policy stays valid; 15 minutes when omitted
+	ExpiresInSeconds *int `json:"expires_in_seconds,omitempty"`
+}
+
+// UploadPolicyConditions are what a policy upload is checked against, each on its own
+type UploadPolicyConditions struct {
+	BucketID    int    `json:"bucket_id"`
+	KeyPrefix   string `json:"key_prefix"`
+	ContentType string `json:"content_type,omitempty"`
+	// ContentLengthRange holds the smallest and largest accepted sizes in bytes
+	ContentLengthRange [2]int64 `json:"content_length_range"`
+}
+
+// UploadPolicy is the document a policy signs. It is handed out base64-encoded and comes
+// back unchanged with every upload, so the server keeps no state for it.
+type UploadPolicy struct {
+	Expiration      time.Time              `json:"expiration"`
+	ClientID        string                 `json:"client_id"`
+	OwnerEntityType string                 `json:"owner_entity_type"`
+	OwnerEntityID   string                 `json:"owner_entity_id"`
+	OnConflict      string                 `json:"on_conflict,omitempty"`
+	Conditions      UploadPolicyConditions `json:"conditions"`
+}
+
+// UploadPolicyResponse represents the response of POST /files/upload-policy. Fields are
+// posted as form fields ahead of the file, together with key and content_type.
+type UploadPolicyResponse struct {
+	UploadURL string            `json:"upload_url"`
+	Fields    map[string]string `json:"fields"`
+	Policy    UploadPolicy      `json:"policy"`
+	ExpiresAt time.Time         `json:"expires_at"`
+}
@@ -0,0 +1,58 @@
+package models
+
+import "time"
+
+// Reasons a file matched by a zip download is left out of the archive
+const (
+	ZipSkipEncrypted    = "encrypted"
+	ZipSkipAwaitingScan = "awaiting_scan"
+)
+
+// ZipDownloadURLRequest represents a request for one URL downloading several files as a
+// zip archive: every file beneath Prefix in a bucket, or the files listed in FileIDs
+type ZipDownloadURLRequest struct {
+	BucketID int `json:"bucket_id,omitempty"`
+	// Prefix is the folder to download; empty downloads the whole bucket
+	Prefix  string   `json:"prefix,omitempty"`
+	FileIDs []string `json:"file_ids,omitempty"`
+	// ArchiveName is the file name the archive is saved as; derived from the prefix or
+	// bucket when omitted
+	ArchiveName      string `json:"archive_name,omitempty"`
+	ExpiresInSeconds *int   `json:"expires_in_seconds,omitempty"`
+}
+
+// ZipDownloadSkipped is a file matched by a zip download request that the archive will
+// not contain, and why
+type ZipDownloadSkipped struct {
+	FileID string `json:"file_id"`
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+// ZipDownloadURLResponse represents the response with a zip download URL
+type ZipDownloadURLResponse struct {
+	SignedURL  string               `json:"signed_url"`
+	ExpiresAt  time.Time            `json:"expires_at"`
+	FileCount  int                  `json:"file_count"`
+	TotalBytes int64                `json:"total_bytes"`
+	Skipped    []ZipDownloadSkipped `json:"skipped,omitempty"`
+}
+
+// ZipDownloadEntry is one file of a zip download manifest
+type ZipDownloadEntry struct {
+	FileID string `json:"file_id"`
+	// Name is the entry's name inside the archive
+	Name string `json:"name"`
+	// FilePath is the resolved storage path relative to ./uploads/
+	FilePath string `json:"file_path"`
+}
+
+// ZipDownloadTokenData represents the manifest stored in Redis for a zip download URL.
+// The URL may be used any number of times until ExpiresAt.
+type ZipDownloadTokenData struct {
+	ClientID    string             `json:"client_id"`
+	ArchiveName string             `json:"archive_name"`
+	Entries     []ZipDownloadEntry `json:"entries"`
+	TotalBytes  int64              `json:"total_bytes"`
+	ExpiresAt   time.Time          `json:"expires_at"`
+}
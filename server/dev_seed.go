@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+// Known credentials and names for the dev mode demo data
+const (
+	devClientName   = "demo"
+	devClientID     = "demo-client"
+	devClientSecret = "demo-secret"
+	devBucketName   = "demo-bucket"
+)
+
+// devCORSPolicy lets any origin read public files from the demo bucket
+const devCORSPolicy = `[{"AllowedHeaders":["*"],"AllowedMethods":["GET","HEAD"],"AllowedOrigins":["*"],"ExposeHeaders":[]}]`
+
+// devPublicPaths makes everything under public/ in the demo bucket readable without auth
+const devPublicPaths = `["public/*"]`
+
+// devSampleFile is a sample file written to the demo bucket
+type devSampleFile struct {
+	Key      string
+	Mimetype string
+	Content  string
+}
+
+var devSampleFiles = []devSampleFile{
+	{Key: "public/hello.txt", Mimetype: "text/plain", Content: "Hello from the file upload service!\n"},
+	{Key: "public/logo.svg", Mimetype: "image/svg+xml", Content: `<svg xmlns="http://www.w3.org/2000/svg" width="64" height="64"><circle cx="32" cy="32" r="30" fill="#4a90d9"/></svg>` + "\n"},
+	{Key: "docs/readme.md", Mimetype: "text/markdown", Content: "# Demo bucket\n\nFiles under docs/ need a signed download URL.\n"},
+	{Key: "docs/config.json", Mimetype: "application/json", Content: `{"environment": "dev", "seeded": true}` + "\n"},
+}
+
+var errDatabaseNotEmpty = errors.New("dev mode refuses to run against a database that already holds non-demo data")
+
+// seedDevData populates an empty database with a demo client, bucket and sample files.
+// A database that only holds the demo data from an earlier dev run is left as it is.
+// Any other data means this is not a dev database, and errDatabaseNotEmpty is returned.
+func seedDevData(db *sqlx.DB) error {
+	var clients, demoClients int
+	if err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(client_id = ?), 0) FROM clients", devClientID).Scan(&clients, &demoClients); err != nil {
+		return err
+	}
+	var foreignBuckets int
+	if err := db.QueryRow("SELECT COUNT(*) FROM buckets WHERE client_id <> ?", devClientID).Scan(&foreignBuckets); err != nil {
+		return err
+	}
+
+	if clients > demoClients || foreignBuckets > 0 {
+		return errDatabaseNotEmpty
+	}
+	if demoClients > 0 {
+		var bucketID int64
+		if err := db.QueryRow("SELECT id FROM buckets WHERE client_id = ? AND name = ?", devClientID, devBucketName).Scan(&bucketID); err != nil {
+			return err
+		}
+		logger.Info("Dev mode: demo data already present, skipping seed")
+		logDevUsage(bucketID)
+		return nil
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Sample files written to disk are removed again unless their rows are committed
+	var written []string
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		for _, path := range written {
+			os.Remove(path)
+		}
+	}()
+
+	now := time.Now().UTC()
+	if _, err := tx.Exec(
+		"INSERT INTO clients (name, client_id, client_secret, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+		devClientName, devClientID, devClientSecret, now, now,
+	); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO buckets (name, client_id, cors_policy, public_paths, archived, created_at, updated_at) VALUES (?, ?, ?, ?, 0, ?, ?)",
+		devBucketName, devClientID, devCORSPolicy, devPublicPaths, now, now,
+	)
+	if err != nil {
+		return err
+	}
+	bucketID, _ := result.LastInsertId()
+
+	for _, sample := range devSampleFiles {
+		diskPath := filepath.Join("./uploads", devClientName, devBucketName, sample.Key)
+		if err := os.MkdirAll(filepath.Dir(diskPath), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(diskPath, []byte(sample.Content), 0644); err != nil {
+			return err
+		}
+		written = append(written, diskPath)
+
+		if _, err := tx.Exec(
+			"INSERT INTO files (id, file_name, file_size, mimetype, client_id, bucket_id, key, owner_entity_type, owner_entity_id, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			uuid.New().String(), filepath.Base(sample.Key), len(sample.Content), sample.Mimetype,
+			devClientID, bucketID, sample.Key, "user", "demo-user", models.FileStatusUploaded, now, now,
+		); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	committed = true
+
+	logger.Info("Dev mode: seeded demo data",
+		zap.String("client_id", devClientID),
+		zap.Int64("bucket_id", bucketID),
+		zap.Int("files", len(devSampleFiles)),
+	)
+	logDevUsage(bucketID)
+	return nil
+}
+
+// logDevUsage prints the demo credentials and example requests
+func logDevUsage(bucketID int64) {
+	credentials := devClientID + ":" + devClientSecret
+	logger.Info("Dev mode: demo credentials",
+		zap.String("client_id", devClientID),
+		zap.String("client_secret", devClientSecret),
+		zap.String("bucket", devBucketName),
+	)
+	examples := []string{
+		fmt.Sprintf("curl -u %s http://localhost:8080/buckets", credentials),
+		fmt.Sprintf("curl -u %s 'http://localhost:8080/buckets/%d/files?path=public'", credentials, bucketID),
+		fmt.Sprintf("curl http://localhost:8080/files/%s/public/hello.txt", devBucketName),
+		fmt.Sprintf("curl -u %s -X POST http://localhost:8080/files/direct-upload -F bucket_id=%d -F key=public/new.txt -F owner_entity_type=user -F owner_entity_id=demo-user -F file=@./new.txt", credentials, bucketID),
+	}
+	for _, example := range examples {
+		logger.Info("Dev mode: try " + example)
+	}
+}
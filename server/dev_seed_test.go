@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"file-upload-service/api"
+	cachepackage "file-upload-service/cache"
+	"file-upload-service/config"
+	"file-upload-service/handlers"
+	"file-upload-service/logger"
+	"file-upload-service/models"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/umakantv/go-utils/cache"
+	"github.com/umakantv/go-utils/db/migrations"
+	"github.com/umakantv/go-utils/httpserver"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init(logger.LoggerConfig{
+		CallerKey:  "file",
+		TimeKey:    "timestamp",
+		CallerSkip: 1,
+	})
+	os.Exit(m.Run())
+}
+
+// Stand-ins for the Redis stores, enough for one process serving requests in order
+type (
+	testLeaseStore       struct{}
+	testUploadQuotaStore struct{}
+	testUploadUseStore   struct{}
+	testTokenBatchStore  struct{ cache cache.Cache }
+	testRateLimitStore   struct{}
+)
+
+func (testLeaseStore) Acquire(name, holder string, ttl time.Duration) (bool, error) { return true, nil }
+func (testLeaseStore) Renew(name, holder string, ttl time.Duration) (bool, error)   { return true, nil }
+func (testLeaseStore) Release(name, holder string) error                            { return nil }
+func (testLeaseStore) Holder(name string) (string, time.Duration, error)            { return "", 0, nil }
+
+func (testUploadQuotaStore) Take(token string, files int, bytes int64, maxFiles int, maxBytes int64, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+func (testUploadQuotaStore) Give(token string, files int, bytes int64) error { return nil }
+func (testUploadQuotaStore) Usage(token string) (int, int64, error)          { return 0, 0, nil }
+
+func (testUploadUseStore) Grant(fileID string, uses int, ttl time.Duration) error { return nil }
+func (testUploadUseStore) Claim(fileID string) (int, bool, error)                 { return 0, true, nil }
+func (testUploadUseStore) Give(fileID string) error                               { return nil }
+func (testUploadUseStore) Revoke(fileID string) error                             { return nil }
+
+func (s testTokenBatchStore) SetMany(entries []cachepackage.TokenEntry, onlyNew bool) ([]string, error) {
+	for _, entry := range entries {
+		if err := s.cache.Set(entry.Key, entry.Value, entry.TTL); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (testRateLimitStore) Allow(key string, perMinute, burst int) (bool, time.Duration, error) {
+	return true, 0, nil
+}
+
+// startDevServer boots the service in dev mode the way StartServer does, against a fresh
+// database in a temporary working directory and on a free port, and returns its base URL
+func startDevServer(t *testing.T) string {
+	t.Helper()
+
+	migrationsDir, err := filepath.Abs("../database/migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	db, err := sqlx.Open("sqlite3", filepath.Join(dir, "test.db")+"?_busy_timeout=10000&_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrations.Migrate(db, migrationsDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := seedDevData(db); err != nil {
+		t.Fatalf("seeding an empty database: %v", err)
+	}
+	// A restart finds the demo data and leaves it as it is
+	if err := seedDevData(db); err != nil {
+		t.Fatalf("seeding a dev database again: %v", err)
+	}
+
+	memoryCache, err := cache.New(cache.Config{Type: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.InitializeConfig()
+	pathLocks := handlers.NewPathLocks(cfg.DeleteReadWaitTimeout())
+	downloadCounts := handlers.NewDownloadCounts(db)
+	fileHandler := handlers.NewFileHandler(db, memoryCache, cfg, pathLocks, handlers.NewJobLeases(testLeaseStore{}, "instance-test", time.Minute), testUploadQuotaStore{}, testUploadUseStore{}, testTokenBatchStore{cache: memoryCache}, downloadCounts)
+	bucketHandler := handlers.NewBucketHandler(db, api.NewPager(cfg.PaginationSecret))
+	publicFileHandler := handlers.NewPublicFileHandler(db, cfg, pathLocks, testRateLimitStore{}, downloadCounts)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	server := httpserver.New(port, NewAuthChecker(db).CheckAuth)
+	registerRoutes(server, cfg, handlers.NewClientHandler(db), fileHandler, bucketHandler, publicFileHandler)
+	go server.Start()
+
+	baseURL := "http://127.0.0.1:" + port
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get(baseURL + "/health")
+		if err == nil {
+			resp.Body.Close()
+			return baseURL
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("server did not come up: %v", err)
+		}
+	}
+}
+
+// devRequest sends a request with the demo client's credentials
+func devRequest(t *testing.T, method, url, contentType string, body io.Reader) *http.Response {
+	t.Helper()
+	r, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetBasicAuth(devClientID, devClientSecret)
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// readBody reads a response body, checking its status first
+func readBody(t *testing.T, resp *http.Response, status int) []byte {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: status = %d, want %d; body: %s", resp.Request.Method, resp.Request.URL, resp.StatusCode, status, body)
+	}
+	return body
+}
+
+func TestDevModeUploadListAndServe(t *testing.T) {
+	baseURL := startDevServer(t)
+
+	// The demo bucket is found with the demo credentials alone
+	var buckets api.Page[models.Bucket]
+	if err := json.Unmarshal(readBody(t, devRequest(t, http.MethodGet, baseURL+"/buckets", "", nil), http.StatusOK), &buckets); err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets.Items) != 1 || buckets.Items[0].Name != devBucketName {
+		t.Fatalf("buckets = %+v, want only %s", buckets.Items, devBucketName)
+	}
+	bucketID := buckets.Items[0].ID
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	for name, value := range map[string]string{
+		"bucket_id":         strconv.Itoa(bucketID),
+		"key":               "public/new.txt",
+		"mimetype":          "text/plain",
+		"owner_entity_type": "user",
+		"owner_entity_id":   "demo-user",
+	} {
+		writer.WriteField(name, value)
+	}
+	part, err := writer.CreateFormFile("file", "new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("uploaded in dev mode\n"))
+	writer.Close()
+	readBody(t, devRequest(t, http.MethodPost, baseURL+"/files/direct-upload", writer.FormDataContentType(), &form), http.StatusCreated)
+
+	var listing models.ListFilesResponse
+	resp := devRequest(t, http.MethodGet, fmt.Sprintf("%s/buckets/%d/files?path=public", baseURL, bucketID), "", nil)
+	if err := json.Unmarshal(readBody(t, resp, http.StatusOK), &listing); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, item := range listing.Items {
+		keys = append(keys, item.Key)
+	}
+	if fmt.Sprint(keys) != "[public/hello.txt public/logo.svg public/new.txt]" {
+		t.Fatalf("listed %v, want the seeded public files and the upload", keys)
+	}
+
+	for key, want := range map[string]string{
+		"public/hello.txt": devSampleFiles[0].Content,
+		"public/new.txt":   "uploaded in dev mode\n",
+	} {
+		resp, err := http.Get(baseURL + "/files/" + devBucketName + "/" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(readBody(t, resp, http.StatusOK)); got != want {
+			t.Errorf("%s served %q, want %q", key, got, want)
+		}
+		resp.Body.Close()
+	}
+
+	// Files outside public/ need a signed URL
+	resp, err = http.Get(baseURL + "/files/" + devBucketName + "/docs/readme.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("docs/readme.md was served without a signed URL")
+	}
+}
+
+func TestDevSeedLeavesNoFilesWhenItFails(t *testing.T) {
+	migrationsDir, err := filepath.Abs("../database/migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	db, err := sqlx.Open("sqlite3", filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := migrations.Migrate(db, migrationsDir); err != nil {
+		t.Fatal(err)
+	}
+	// The last sample's row cannot be inserted, after every sample was written to disk
+	last := devSampleFiles[len(devSampleFiles)-1]
+	db.MustExec(fmt.Sprintf(
+		"CREATE TRIGGER fail_seed BEFORE INSERT ON files WHEN NEW.key = '%s' BEGIN SELECT RAISE(ABORT, 'seed failed'); END", last.Key,
+	))
+
+	if err := seedDevData(db); err == nil {
+		t.Fatal("seeding succeeded despite the failing insert")
+	}
+	for _, sample := range devSampleFiles {
+		if _, err := os.Stat(filepath.Join("./uploads", devClientName, devBucketName, sample.Key)); !os.IsNotExist(err) {
+			t.Errorf("%s was left on disk: %v", sample.Key, err)
+		}
+	}
+	var clients int
+	if err := db.Get(&clients, "SELECT COUNT(*) FROM clients"); err != nil {
+		t.Fatal(err)
+	}
+	if clients != 0 {
+		t.Fatalf("%d clients left after the failed seed", clients)
+	}
+}
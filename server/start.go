@@ -5,17 +5,23 @@ import (
 	"encoding/base64"
 	"net/http"
 	"strings"
+	"file-upload-service/api"
 	cachepackage "file-upload-service/cache"
+	"file-upload-service/config"
 	"file-upload-service/database"
 	"file-upload-service/handlers"
+	"file-upload-service/logger"
 	"os"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/umakantv/go-utils/httpserver"
-	"github.com/umakantv/go-utils/logger"
 	"go.uber.org/zap"
 )
 
+// fileIDPattern matches the UUIDs used as file ids in routes
+const fileIDPattern = "[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}"
+
 // AuthChecker handles authentication for the service
 type AuthChecker struct {
 	db *sqlx.DB
@@ -65,6 +71,10 @@ func (a *AuthChecker) CheckAuth(r *http.Request) (bool, httpserver.RequestAuth)
 		var dbClientID string
 		err = a.db.QueryRow("SELECT client_id FROM clients WHERE client_id = ? AND client_secret = ?", clientID, clientSecret).Scan(&dbClientID)
 		if err == nil && dbClientID == clientID {
+			// Keeps the client clear of the inactivity policy; a failure must not fail the request
+			if err := handlers.TouchClientLastUsed(a.db, clientID, time.Now().UTC()); err != nil {
+				logger.Error("Failed to record client activity", zap.String("client_id", clientID), zap.Error(err))
+			}
 			return true, httpserver.RequestAuth{
 				Type:   "basic",
 				Client: clientID,
@@ -76,7 +86,8 @@ func (a *AuthChecker) CheckAuth(r *http.Request) (bool, httpserver.RequestAuth)
 	return false, httpserver.RequestAuth{}
 }
 
-func StartServer() {
+// StartServer boots the service. In dev mode an empty database is seeded with demo data first.
+func StartServer(devMode bool) {
 	// Initialize logger
 	logger.Init(logger.LoggerConfig{
 		CallerKey:  "file",
@@ -86,27 +97,107 @@ func StartServer() {
 
 	logger.Info("Starting File Upload Service...")
 
+	// Load configuration
+	cfg := config.InitializeConfig()
+
 	// Initialize database
 	dbConn := database.InitializeDatabase()
 	defer dbConn.Close()
 
+	// Seed demo data for local development; never touches a database holding other data
+	if devMode || cfg.DevMode {
+		if err := seedDevData(dbConn); err != nil {
+			logger.Error("Failed to seed dev data", zap.Error(err))
+			os.Exit(1)
+		}
+	}
+
+	// Flag stored keys written before canonicalization was enforced
+	handlers.ReportNonCanonicalKeys(dbConn)
+
 	// Initialize cache
-	cache := cachepackage.InitializeCache()
+	cache := cachepackage.InitializeCache(cfg)
 	defer cache.Close()
+	redisClient := cachepackage.InitializeRedisClient(cfg)
+	defer redisClient.Close()
 
 	// Initialize auth checker
 	authChecker := NewAuthChecker(dbConn)
 
 	// Initialize handlers
 	clientHandler := handlers.NewClientHandler(dbConn)
-	fileHandler := handlers.NewFileHandler(dbConn, cache)
-	bucketHandler := handlers.NewBucketHandler(dbConn)
-	publicFileHandler := handlers.NewPublicFileHandler(dbConn)
-
-	// Create HTTP server with authentication
+	pathLocks := handlers.NewPathLocks(cfg.DeleteReadWaitTimeout())
+	jobLeases := handlers.NewJobLeases(cachepackage.NewLeaseStore(redisClient), cfg.InstanceID, cfg.JobLeaseTTL)
+	downloadCounts := handlers.NewDownloadCounts(dbConn)
+	fileHandler := handlers.NewFileHandler(dbConn, cache, cfg, pathLocks, jobLeases, cachepackage.NewUploadQuotaStore(redisClient), cachepackage.NewUploadUseStore(redisClient), cachepackage.NewTokenBatchStore(redisClient), downloadCounts)
+	bucketHandler := handlers.NewBucketHandler(dbConn, api.NewPager(cfg.PaginationSecret))
+	publicFileHandler := handlers.NewPublicFileHandler(dbConn, cfg, pathLocks, cachepackage.NewRateLimitStore(redisClient), downloadCounts)
+
+	// Start background jobs; with several replicas each runs on the lease holder only
+	fileHandler.StartUploadGroupSweeper(time.Minute)
+	fileHandler.StartSnapshotSweeper(time.Minute)
+	fileHandler.StartFileEventSweeper(time.Minute)
+	fileHandler.StartMimetypeBackfillResumer(time.Minute)
+	fileHandler.StartDeleteJobResumer(time.Minute)
+	fileHandler.StartArchiveExpansionResumer(time.Minute)
+	fileHandler.StartScanSweeper(30 * time.Second)
+	fileHandler.StartInactivitySweeper(time.Minute)
+	fileHandler.StartObjectSweeper(time.Minute)
+	fileHandler.StartThumbnailSweeper(10 * time.Second)
+	fileHandler.StartRedemptionSweeper(time.Minute)
+	downloadCounts.StartFlusher(5 * time.Second)
+
+	// Create HTTP server with authentication and register the routes
 	server := httpserver.New("8080", authChecker.CheckAuth)
+	registerRoutes(server, cfg, clientHandler, fileHandler, bucketHandler, publicFileHandler)
+
+	logger.Info("File Upload Service started on port 8080")
+	logger.Info("Health check: GET /health")
+	logger.Info("Client API: POST/GET /clients, GET/PUT /clients/{id} (Bearer auth)")
+	logger.Info("Mimetype Backfill API: POST /admin/mimetype-backfills, GET /admin/mimetype-backfills/{id}, GET /admin/mimetype-corrections, POST /admin/mimetype-corrections/apply|dismiss (Bearer auth)")
+	logger.Info("Job Lease API: GET /admin/job-leases (Bearer auth)")
+	logger.Info("Metrics API: GET /admin/metrics (Bearer auth)")
+	logger.Info("Quarantine API: GET /admin/quarantine, POST /admin/quarantine/{id}/release, DELETE /admin/quarantine/{id} (Bearer auth)")
+	logger.Info("Inactivity API: GET /admin/inactive-clients, POST/DELETE /admin/inactive-clients/{client_id}/exempt (Bearer auth)")
+	logger.Info("Bucket API: POST/GET /buckets, GET/PUT/PATCH/DELETE /buckets/{id}, GET /buckets/by-name/{name}, POST /buckets/{id}/archive, POST /buckets/{id}/unarchive, POST /buckets/{id}/rename, GET /buckets/{id}/usage (Basic auth)")
+	logger.Info("Snapshot API: POST/GET /buckets/{id}/snapshots, POST /buckets/{id}/snapshots/{sid}/restore (Basic auth)")
+	logger.Info("Changes API: GET /buckets/{id}/changes?since=<cursor> (Basic auth)")
+	logger.Info("File API: POST /files/signed-url (Basic auth), POST /files/upload (token in URL, CORS enforced if configured)")
+	logger.Info("File API: POST /files/signed-urls (Basic auth, up to 100 entries)")
+	logger.Info("File API: POST /files/{id}/replace-url (Basic auth, new content for an existing file)")
+	logger.Info("File API: GET /files/upload/info (token in URL)")
+	logger.Info("File API: GET /files/upload/form (token in URL, only with UPLOAD_FORM_ENABLED=true)")
+	logger.Info("File API: POST /files/direct-upload (Basic auth, small files only)")
+	logger.Info("File API: POST /files/inline (Basic auth, base64 JSON, small files only)")
+	logger.Info("File API: POST /files/import-url (Basic auth, server fetches the file)")
+	logger.Info("File API: POST /files/upload-policy (Basic auth), POST /files/upload/policy (signed policy in form)")
+	logger.Info("File API: POST /files/download-url (Basic auth), GET/HEAD /files/download (token in URL)")
+	logger.Info("File API: POST /files/download-urls (Basic auth, up to 100 files)")
+	logger.Info("File API: POST /files/zip-download-url (Basic auth), GET/HEAD /files/zip-download (token in URL)")
+	logger.Info("File API: POST /files/presigned-url (Basic auth), served by the public file route")
+	logger.Info("File API: DELETE /files, GET /files/delete-jobs/{id} (Basic auth)")
+	logger.Info("File API: DELETE /files/tokens/{token} (Basic auth, revoke a signed URL)")
+	logger.Info("File API: POST /files/{id}/read (Basic auth)")
+	logger.Info("File API: GET /files/{id}/redemptions (Basic auth, downloads through issued URLs)")
+	logger.Info("File API: POST /files/{id}/expand, GET /files/expansions/{id} (Basic auth)")
+	logger.Info("Short URL API: POST/GET/HEAD /" + cfg.ShortURLPath + "/{token} (token in URL, clients with short_urls)")
+	logger.Info("File API: POST /files/purge (Basic auth, permanent erasure)")
+	logger.Info("Limits API: GET /limits (Basic auth)")
+	logger.Info("Quota API: PUT/GET/DELETE /quotas, GET /quotas/usage (Basic auth, storage per owner entity)")
+	logger.Info("File Grant API: POST/GET /files/{id}/grants, DELETE /files/{id}/grants/{grant_id} (Basic auth)")
+	logger.Info("File Version API: GET/DELETE /files/{id}/versions (Basic auth, versioning buckets)")
+	logger.Info("Upload Group API: POST /files/upload-groups, POST /files/upload-groups/{id}/commit|abort (Basic auth)")
+	logger.Info("Public File API: GET/HEAD/OPTIONS /files/{bucket_name}/{file_path} (no auth, CORS enforced)")
+
+	// Start server
+	if err := server.Start(); err != nil {
+		logger.Error("Server failed to start", zap.Error(err))
+		os.Exit(1)
+	}
+}
 
-	// Register routes
+// registerRoutes registers the routes of every API of the service on server
+func registerRoutes(server *httpserver.Server, cfg *config.Config, clientHandler *handlers.ClientHandler, fileHandler *handlers.FileHandler, bucketHandler *handlers.BucketHandler, publicFileHandler *handlers.PublicFileHandler) {
 	server.Register(httpserver.Route{
 		Name:     "HealthCheck",
 		Method:   "GET",
@@ -140,6 +231,105 @@ func StartServer() {
 		AuthType: "bearer",
 	}, httpserver.HandlerFunc(clientHandler.GetClient))
 
+	server.Register(httpserver.Route{
+		Name:     "UpdateClient",
+		Method:   "PUT",
+		Path:     "/clients/{id}",
+		AuthType: "bearer",
+	}, httpserver.HandlerFunc(clientHandler.UpdateClient))
+
+	// Mimetype backfill routes (Bearer auth - admin only)
+	server.Register(httpserver.Route{
+		Name:     "StartMimetypeBackfill",
+		Method:   "POST",
+		Path:     "/admin/mimetype-backfills",
+		AuthType: "bearer",
+	}, httpserver.HandlerFunc(fileHandler.StartMimetypeBackfill))
+
+	server.Register(httpserver.Route{
+		Name:     "GetMimetypeBackfill",
+		Method:   "GET",
+		Path:     "/admin/mimetype-backfills/{id}",
+		AuthType: "bearer",
+	}, httpserver.HandlerFunc(fileHandler.GetMimetypeBackfill))
+
+	server.Register(httpserver.Route{
+		Name:     "ListMimetypeCorrections",
+		Method:   "GET",
+		Path:     "/admin/mimetype-corrections",
+		AuthType: "bearer",
+	}, httpserver.HandlerFunc(fileHandler.ListMimetypeCorrections))
+
+	server.Register(httpserver.Route{
+		Name:     "ApplyMimetypeCorrections",
+		Method:   "POST",
+		Path:     "/admin/mimetype-corrections/apply",
+		AuthType: "bearer",
+	}, httpserver.HandlerFunc(fileHandler.ApplyMimetypeCorrections))
+
+	server.Register(httpserver.Route{
+		Name:     "DismissMimetypeCorrections",
+		Method:   "POST",
+		Path:     "/admin/mimetype-corrections/dismiss",
+		AuthType: "bearer",
+	}, httpserver.HandlerFunc(fileHandler.DismissMimetypeCorrections))
+
+	server.Register(httpserver.Route{
+		Name:     "ListJobLeases",
+		Method:   "GET",
+		Path:     "/admin/job-leases",
+		AuthType: "bearer",
+	}, httpserver.HandlerFunc(fileHandler.ListJobLeases))
+
+	server.Register(httpserver.Route{
+		Name:     "Metrics",
+		Method:   "GET",
+		Path:     "/admin/metrics",
+		AuthType: "bearer",
+	}, httpserver.HandlerFunc(handlers.Metrics))
+
+	server.Register(httpserver.Route{
+		Name:     "ListQuarantinedFiles",
+		Method:   "GET",
+		Path:     "/admin/quarantine",
+		AuthType: "bearer",
+	}, httpserver.HandlerFunc(fileHandler.ListQuarantinedFiles))
+
+	server.Register(httpserver.Route{
+		Name:     "ReleaseQuarantinedFile",
+		Method:   "POST",
+		Path:     "/admin/quarantine/{id:" + fileIDPattern + "}/release",
+		AuthType: "bearer",
+	}, httpserver.HandlerFunc(fileHandler.ReleaseQuarantinedFile))
+
+	server.Register(httpserver.Route{
+		Name:     "DeleteQuarantinedFile",
+		Method:   "DELETE",
+		Path:     "/admin/quarantine/{id:" + fileIDPattern + "}",
+		AuthType: "bearer",
+	}, httpserver.HandlerFunc(fileHandler.DeleteQuarantinedFile))
+
+	server.Register(httpserver.Route{
+		Name:     "ListInactiveClients",
+		Method:   "GET",
+		Path:     "/admin/inactive-clients",
+		AuthType: "bearer",
+	}, httpserver.HandlerFunc(fileHandler.ListInactiveClients))
+
+	server.Register(httpserver.Route{
+		Name:     "ExemptInactiveClient",
+		Method:   "POST",
+		Path:     "/admin/inactive-clients/{client_id}/exempt",
+		AuthType: "bearer",
+	}, httpserver.HandlerFunc(fileHandler.ExemptInactiveClient))
+
+	server.Register(httpserver.Route{
+		Name:     "UnexemptInactiveClient",
+		Method:   "DELETE",
+		Path:     "/admin/inactive-clients/{client_id}/exempt",
+		AuthType: "bearer",
+	}, httpserver.HandlerFunc(fileHandler.UnexemptInactiveClient))
+
 	// Bucket management routes (Basic auth - client credentials)
 	server.Register(httpserver.Route{
 		Name:     "CreateBucket",
@@ -155,6 +345,14 @@ func StartServer() {
 		AuthType: "basic",
 	}, httpserver.HandlerFunc(bucketHandler.GetBuckets))
 
+	// Registered before the /buckets/{id}/... routes, which would otherwise match it
+	server.Register(httpserver.Route{
+		Name:     "GetBucketByName",
+		Method:   "GET",
+		Path:     "/buckets/by-name/{name}",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(bucketHandler.GetBucketByName))
+
 	server.Register(httpserver.Route{
 		Name:     "GetBucket",
 		Method:   "GET",
@@ -169,6 +367,13 @@ func StartServer() {
 		AuthType: "basic",
 	}, httpserver.HandlerFunc(bucketHandler.UpdateBucket))
 
+	server.Register(httpserver.Route{
+		Name:     "PatchBucket",
+		Method:   "PATCH",
+		Path:     "/buckets/{id}",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(bucketHandler.PatchBucket))
+
 	server.Register(httpserver.Route{
 		Name:     "ArchiveBucket",
 		Method:   "POST",
@@ -176,6 +381,56 @@ func StartServer() {
 		AuthType: "basic",
 	}, httpserver.HandlerFunc(bucketHandler.ArchiveBucket))
 
+	server.Register(httpserver.Route{
+		Name:     "UnarchiveBucket",
+		Method:   "POST",
+		Path:     "/buckets/{id}/unarchive",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(bucketHandler.UnarchiveBucket))
+
+	server.Register(httpserver.Route{
+		Name:     "RenameBucket",
+		Method:   "POST",
+		Path:     "/buckets/{id}/rename",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(bucketHandler.RenameBucket))
+
+	server.Register(httpserver.Route{
+		Name:     "DeleteBucket",
+		Method:   "DELETE",
+		Path:     "/buckets/{id}",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(bucketHandler.DeleteBucket))
+
+	server.Register(httpserver.Route{
+		Name:     "BucketUsage",
+		Method:   "GET",
+		Path:     "/buckets/{id}/usage",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.BucketUsage))
+
+	// Bucket snapshot routes (Basic auth) - point-in-time copies for restoring after bulk changes
+	server.Register(httpserver.Route{
+		Name:     "CreateSnapshot",
+		Method:   "POST",
+		Path:     "/buckets/{id}/snapshots",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.CreateSnapshot))
+
+	server.Register(httpserver.Route{
+		Name:     "ListSnapshots",
+		Method:   "GET",
+		Path:     "/buckets/{id}/snapshots",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.ListSnapshots))
+
+	server.Register(httpserver.Route{
+		Name:     "RestoreSnapshot",
+		Method:   "POST",
+		Path:     "/buckets/{id}/snapshots/{sid}/restore",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.RestoreSnapshot))
+
 	// File upload routes (Basic auth for signed URL generation)
 	server.Register(httpserver.Route{
 		Name:     "GenerateSignedURL",
@@ -184,6 +439,96 @@ func StartServer() {
 		AuthType: "basic",
 	}, httpserver.HandlerFunc(fileHandler.GenerateSignedURL))
 
+	server.Register(httpserver.Route{
+		Name:     "GenerateSignedURLs",
+		Method:   "POST",
+		Path:     "/files/signed-urls",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.GenerateSignedURLs))
+
+	// Upload group routes (Basic auth) - entries stay staged until committed
+	server.Register(httpserver.Route{
+		Name:     "CreateUploadGroup",
+		Method:   "POST",
+		Path:     "/files/upload-groups",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.CreateUploadGroup))
+
+	server.Register(httpserver.Route{
+		Name:     "CommitUploadGroup",
+		Method:   "POST",
+		Path:     "/files/upload-groups/{id}/commit",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.CommitUploadGroup))
+
+	server.Register(httpserver.Route{
+		Name:     "AbortUploadGroup",
+		Method:   "POST",
+		Path:     "/files/upload-groups/{id}/abort",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.AbortUploadGroup))
+
+	// File grant routes (Basic auth) - let another client download a specific file.
+	// The id is constrained to a UUID so these never shadow public file paths.
+	server.Register(httpserver.Route{
+		Name:     "CreateFileGrant",
+		Method:   "POST",
+		Path:     "/files/{id:" + fileIDPattern + "}/grants",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.CreateFileGrant))
+
+	server.Register(httpserver.Route{
+		Name:     "ListFileGrants",
+		Method:   "GET",
+		Path:     "/files/{id:" + fileIDPattern + "}/grants",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.ListFileGrants))
+
+	server.Register(httpserver.Route{
+		Name:     "ListDownloadRedemptions",
+		Method:   "GET",
+		Path:     "/files/{id:" + fileIDPattern + "}/redemptions",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.ListDownloadRedemptions))
+
+	server.Register(httpserver.Route{
+		Name:     "RevokeFileGrant",
+		Method:   "DELETE",
+		Path:     "/files/{id:" + fileIDPattern + "}/grants/{grant_id}",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.RevokeFileGrant))
+
+	// Revoke an upload or download URL before it expires
+	server.Register(httpserver.Route{
+		Name:     "RevokeSignedURL",
+		Method:   "DELETE",
+		Path:     "/files/tokens/{token}",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.RevokeSignedURL))
+
+	// Replace the content of an existing file, keeping its file_id and key
+	server.Register(httpserver.Route{
+		Name:     "ReplaceFileURL",
+		Method:   "POST",
+		Path:     "/files/{id:" + fileIDPattern + "}/replace-url",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.ReplaceFileURL))
+
+	// Versions kept for a file's key in a versioning bucket
+	server.Register(httpserver.Route{
+		Name:     "ListFileVersions",
+		Method:   "GET",
+		Path:     "/files/{id:" + fileIDPattern + "}/versions",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.ListFileVersions))
+
+	server.Register(httpserver.Route{
+		Name:     "PurgeFileVersions",
+		Method:   "DELETE",
+		Path:     "/files/{id:" + fileIDPattern + "}/versions",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.PurgeFileVersions))
+
 	// File upload endpoint (no auth - token in URL)
 	server.Register(httpserver.Route{
 		Name:     "UploadFile",
@@ -192,6 +537,71 @@ func StartServer() {
 		AuthType: "none",
 	}, httpserver.HandlerFunc(fileHandler.UploadFile))
 
+	// CORS preflight for browser uploads, answered from the bucket's cors_policy
+	server.Register(httpserver.Route{
+		Name:     "UploadPreflight",
+		Method:   "OPTIONS",
+		Path:     "/files/upload",
+		AuthType: "none",
+	}, httpserver.HandlerFunc(fileHandler.UploadPreflight))
+
+	// Manual-testing page for a signed upload URL; answers 404 unless UPLOAD_FORM_ENABLED=true.
+	// Registered before the public file route, which would otherwise match it.
+	server.Register(httpserver.Route{
+		Name:     "UploadForm",
+		Method:   "GET",
+		Path:     "/files/upload/form",
+		AuthType: "none",
+	}, httpserver.HandlerFunc(fileHandler.UploadForm))
+
+	// Upload token info for pages holding only the signed URL (no auth, token in URL).
+	// Also registered before the public file route.
+	server.Register(httpserver.Route{
+		Name:     "UploadTokenInfo",
+		Method:   "GET",
+		Path:     "/files/upload/info",
+		AuthType: "none",
+	}, httpserver.HandlerFunc(fileHandler.UploadTokenInfo))
+
+	// Direct upload endpoint for small files (Basic auth - no signed URL round trip)
+	server.Register(httpserver.Route{
+		Name:     "DirectUpload",
+		Method:   "POST",
+		Path:     "/files/direct-upload",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.DirectUpload))
+
+	// Inline upload of tiny files sent as base64 JSON (Basic auth)
+	server.Register(httpserver.Route{
+		Name:     "InlineUpload",
+		Method:   "POST",
+		Path:     "/files/inline",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.InlineUpload))
+
+	// Import a file fetched from a URL (Basic auth)
+	server.Register(httpserver.Route{
+		Name:     "ImportFromURL",
+		Method:   "POST",
+		Path:     "/files/import-url",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.ImportFromURL))
+
+	// Upload policies: signed with Basic auth, used from a browser form without auth
+	server.Register(httpserver.Route{
+		Name:     "CreateUploadPolicy",
+		Method:   "POST",
+		Path:     "/files/upload-policy",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.CreateUploadPolicy))
+
+	server.Register(httpserver.Route{
+		Name:     "PolicyUpload",
+		Method:   "POST",
+		Path:     "/files/upload/policy",
+		AuthType: "none",
+	}, httpserver.HandlerFunc(fileHandler.PolicyUpload))
+
 	// File download routes (Basic auth for signed URL generation)
 	server.Register(httpserver.Route{
 		Name:     "GenerateDownloadSignedURL",
@@ -200,6 +610,29 @@ func StartServer() {
 		AuthType: "basic",
 	}, httpserver.HandlerFunc(fileHandler.GenerateDownloadSignedURL))
 
+	// Synchronous byte-range reads (Basic auth, no token)
+	server.Register(httpserver.Route{
+		Name:     "ReadFileRange",
+		Method:   "POST",
+		Path:     "/files/{id:" + fileIDPattern + "}/read",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.ReadFileRange))
+
+	// Server-side zip expansion (Basic auth); large archives are expanded by a background job
+	server.Register(httpserver.Route{
+		Name:     "ExpandArchive",
+		Method:   "POST",
+		Path:     "/files/{id:" + fileIDPattern + "}/expand",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.ExpandArchive))
+
+	server.Register(httpserver.Route{
+		Name:     "GetArchiveExpansion",
+		Method:   "GET",
+		Path:     "/files/expansions/{id}",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.GetArchiveExpansion))
+
 	// File download endpoint (no auth - token in URL)
 	server.Register(httpserver.Route{
 		Name:     "DownloadFile",
@@ -208,6 +641,82 @@ func StartServer() {
 		AuthType: "none",
 	}, httpserver.HandlerFunc(fileHandler.DownloadFile))
 
+	// HEAD checks a download URL before fetching it, without using it up
+	server.Register(httpserver.Route{
+		Name:     "HeadDownloadFile",
+		Method:   "HEAD",
+		Path:     "/files/download",
+		AuthType: "none",
+	}, httpserver.HandlerFunc(fileHandler.DownloadFile))
+
+	// Download URLs for many files at once (Basic auth)
+	server.Register(httpserver.Route{
+		Name:     "GenerateDownloadSignedURLs",
+		Method:   "POST",
+		Path:     "/files/download-urls",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.GenerateDownloadSignedURLs))
+
+	// Several files as one zip archive: URL generation (Basic auth), then the download
+	// itself (no auth - token in URL)
+	server.Register(httpserver.Route{
+		Name:     "GenerateZipDownloadURL",
+		Method:   "POST",
+		Path:     "/files/zip-download-url",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.GenerateZipDownloadURL))
+
+	server.Register(httpserver.Route{
+		Name:     "ZipDownload",
+		Method:   "GET",
+		Path:     "/files/zip-download",
+		AuthType: "none",
+	}, httpserver.HandlerFunc(fileHandler.ZipDownload))
+
+	server.Register(httpserver.Route{
+		Name:     "HeadZipDownload",
+		Method:   "HEAD",
+		Path:     "/files/zip-download",
+		AuthType: "none",
+	}, httpserver.HandlerFunc(fileHandler.ZipDownload))
+
+	// Presigned public URLs: served by the public file route until they expire (Basic auth)
+	server.Register(httpserver.Route{
+		Name:     "GeneratePresignedURL",
+		Method:   "POST",
+		Path:     "/files/presigned-url",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.GeneratePresignedURL))
+
+	// Short signed URLs for clients that opted into them (token in URL path, no auth header)
+	server.Register(httpserver.Route{
+		Name:     "ShortUpload",
+		Method:   "POST",
+		Path:     "/" + cfg.ShortURLPath + "/{token}",
+		AuthType: "none",
+	}, httpserver.HandlerFunc(fileHandler.ShortUpload))
+
+	server.Register(httpserver.Route{
+		Name:     "ShortUploadPreflight",
+		Method:   "OPTIONS",
+		Path:     "/" + cfg.ShortURLPath + "/{token}",
+		AuthType: "none",
+	}, httpserver.HandlerFunc(fileHandler.ShortUploadPreflight))
+
+	server.Register(httpserver.Route{
+		Name:     "ShortDownload",
+		Method:   "GET",
+		Path:     "/" + cfg.ShortURLPath + "/{token}",
+		AuthType: "none",
+	}, httpserver.HandlerFunc(fileHandler.ShortDownload))
+
+	server.Register(httpserver.Route{
+		Name:     "HeadShortDownload",
+		Method:   "HEAD",
+		Path:     "/" + cfg.ShortURLPath + "/{token}",
+		AuthType: "none",
+	}, httpserver.HandlerFunc(fileHandler.ShortDownload))
+
 	// File list endpoint (Basic auth)
 	server.Register(httpserver.Route{
 		Name:     "ListFiles",
@@ -216,6 +725,14 @@ func StartServer() {
 		AuthType: "basic",
 	}, httpserver.HandlerFunc(fileHandler.ListFiles))
 
+	// Bucket change feed for sync clients (Basic auth)
+	server.Register(httpserver.Route{
+		Name:     "ListBucketChanges",
+		Method:   "GET",
+		Path:     "/buckets/{id}/changes",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.ListBucketChanges))
+
 	// File delete endpoint (Basic auth)
 	server.Register(httpserver.Route{
 		Name:     "DeleteFiles",
@@ -224,6 +741,58 @@ func StartServer() {
 		AuthType: "basic",
 	}, httpserver.HandlerFunc(fileHandler.DeleteFiles))
 
+	// Progress of path deletes too large to run synchronously (Basic auth)
+	server.Register(httpserver.Route{
+		Name:     "GetDeleteJob",
+		Method:   "GET",
+		Path:     "/files/delete-jobs/{id}",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.GetDeleteJob))
+
+	// File purge endpoint for erasure requests (Basic auth)
+	server.Register(httpserver.Route{
+		Name:     "PurgeFiles",
+		Method:   "POST",
+		Path:     "/files/purge",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.PurgeFiles))
+
+	server.Register(httpserver.Route{
+		Name:     "GetLimits",
+		Method:   "GET",
+		Path:     "/limits",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.GetLimits))
+
+	// Owner storage quota endpoints (Basic auth)
+	server.Register(httpserver.Route{
+		Name:     "SetOwnerQuota",
+		Method:   "PUT",
+		Path:     "/quotas",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.SetOwnerQuota))
+
+	server.Register(httpserver.Route{
+		Name:     "ListOwnerQuotas",
+		Method:   "GET",
+		Path:     "/quotas",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.ListOwnerQuotas))
+
+	server.Register(httpserver.Route{
+		Name:     "DeleteOwnerQuota",
+		Method:   "DELETE",
+		Path:     "/quotas",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.DeleteOwnerQuota))
+
+	server.Register(httpserver.Route{
+		Name:     "OwnerUsage",
+		Method:   "GET",
+		Path:     "/quotas/usage",
+		AuthType: "basic",
+	}, httpserver.HandlerFunc(fileHandler.OwnerUsage))
+
 	// Public file access endpoint (no auth, CORS enforced if configured)
 	server.Register(httpserver.Route{
 		Name:     "ServePublicFile",
@@ -232,17 +801,19 @@ func StartServer() {
 		AuthType: "none",
 	}, httpserver.HandlerFunc(publicFileHandler.ServePublicFile))
 
-	logger.Info("File Upload Service started on port 8080")
-	logger.Info("Health check: GET /health")
-	logger.Info("Client API: POST/GET /clients, GET /clients/{id} (Bearer auth)")
-	logger.Info("Bucket API: POST/GET /buckets, GET/PUT /buckets/{id}, POST /buckets/{id}/archive (Basic auth)")
-	logger.Info("File API: POST /files/signed-url (Basic auth), POST /files/upload (token in URL)")
-	logger.Info("File API: POST /files/download-url (Basic auth), GET /files/download (token in URL)")
-	logger.Info("Public File API: GET /files/{bucket_name}/{file_path} (no auth, CORS enforced)")
+	// HEAD lets CDNs and link previews check a public file's existence and size
+	server.Register(httpserver.Route{
+		Name:     "HeadPublicFile",
+		Method:   "HEAD",
+		Path:     "/files/{bucket_name}/{file_path:.*}",
+		AuthType: "none",
+	}, httpserver.HandlerFunc(publicFileHandler.ServePublicFile))
 
-	// Start server
-	if err := server.Start(); err != nil {
-		logger.Error("Server failed to start", zap.Error(err))
-		os.Exit(1)
-	}
+	// CORS preflight for public files, answered from the bucket's cors_policy
+	server.Register(httpserver.Route{
+		Name:     "PublicFilePreflight",
+		Method:   "OPTIONS",
+		Path:     "/files/{bucket_name}/{file_path:.*}",
+		AuthType: "none",
+	}, httpserver.HandlerFunc(publicFileHandler.PublicFilePreflight))
 }